@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-sip-ua/b2bua/b2bua"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// adminRequest 管理套接字的请求，每行一个 JSON 对象
+type adminRequest struct {
+	Command string `json:"command"` // 命令及参数，与命令行交互模式相同，如 "calls user=100"
+}
+
+// adminResponse 管理套接字的响应，每个请求一行
+type adminResponse struct {
+	OK     bool   `json:"ok"`               // 命令是否执行成功
+	Output string `json:"output,omitempty"` // 命令的输出
+	Error  string `json:"error,omitempty"`  // 失败原因，参数错误时为命令的用法
+	Exit   bool   `json:"exit,omitempty"`   // 命令（exit、drain）结束了进程，响应后关闭连接
+}
+
+var (
+	quit     = make(chan struct{}) // 经管理套接字执行 exit、drain 后关闭，-nc 模式下 main 随之退出
+	quitOnce sync.Once
+)
+
+// listenAdmin 在 address 上监听管理套接字：unix:路径 为 UNIX 域套接字（只允许属主和同组用户访问），
+// 否则为 TCP 地址。TCP 没有认证，应只监听本机地址
+func listenAdmin(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		os.Remove(path) // 上次运行留下的套接字文件
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// serveAdmin 接受管理套接字的连接，每个连接依次执行请求
+func serveAdmin(b2bua *b2bua.B2BUA, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go serveAdminConn(b2bua, conn)
+	}
+}
+
+// serveAdminConn 读取一个连接上的请求并逐行响应，无法解析的请求返回错误后继续
+func serveAdminConn(b2bua *b2bua.B2BUA, conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	encoder.SetEscapeHTML(false) // 命令用法中的 <参数> 原样输出
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var request adminRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			encoder.Encode(adminResponse{Error: "invalid request: " + err.Error()})
+			continue
+		}
+		response := adminCommand(b2bua, request.Command)
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+		if response.Exit {
+			quitOnce.Do(func() { close(quit) })
+			return
+		}
+	}
+}
+
+// adminCommand 执行管理套接字的一条命令，输出写到缓冲区
+func adminCommand(b2bua *b2bua.B2BUA, input string) adminResponse {
+	words := strings.Fields(input)
+	if len(words) == 0 {
+		return adminResponse{Error: "empty command"}
+	}
+	cmd, args := findCommand(words)
+	if cmd == nil {
+		return adminResponse{Error: fmt.Sprintf("未知命令: %s", words[0])}
+	}
+	var out bytes.Buffer
+	err := cmd.handler(b2bua, &out, args)
+	response := adminResponse{OK: err == nil || err == errExit, Output: out.String(), Exit: err == errExit}
+	switch err {
+	case nil, errExit:
+	case errUsage:
+		response.Error = "用法: " + cmd.usageOf()
+	default:
+		response.Error = err.Error()
+	}
+	return response
+}
@@ -0,0 +1,187 @@
+package b2bua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// 账户管理的错误
+var (
+	ErrAccountExists   = errors.New("account already exists")
+	ErrAccountNotFound = errors.New("account not found")
+)
+
+// accountEntry 账户文件中的一个账户：只有密码时为字符串，设置了显示名称时为 {"password": ..., "name": ...}
+type accountEntry struct {
+	Password string `json:"password"`
+	Name     string `json:"name,omitempty"`
+}
+
+func (e accountEntry) MarshalJSON() ([]byte, error) {
+	if e.Name == "" {
+		return json.Marshal(e.Password)
+	}
+	type entry accountEntry
+	return json.Marshal(entry(e))
+}
+
+func (e *accountEntry) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.Password); err == nil {
+		return nil
+	}
+	type entry accountEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// loadAccounts 从账户文件加载 SIP 账户及其显示名称，文件不存在时不加载
+func (b *B2BUA) loadAccounts(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string]accountEntry)
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return fmt.Errorf("parse accounts %s: %w", path, err)
+	}
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
+	for username, account := range accounts {
+		b.accounts[username] = account.Password
+		if account.Name != "" {
+			b.names[username] = account.Name
+		}
+	}
+	logger.Infof("Loaded %d accounts from %s", len(accounts), path)
+	return nil
+}
+
+// saveAccounts 原子地写入账户文件：先写临时文件，再重命名。未配置账户文件时不保存，调用方需持有 accountsMu
+func (b *B2BUA) saveAccounts() error {
+	path := b.config.AccountsFile
+	if path == "" {
+		return nil
+	}
+	accounts := make(map[string]accountEntry, len(b.accounts))
+	for username, password := range b.accounts {
+		accounts[username] = accountEntry{Password: password, Name: b.names[username]}
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CreateAccount 添加一个 SIP 账户并保存到账户文件，账户已存在时返回 ErrAccountExists
+func (b *B2BUA) CreateAccount(username, password string) error {
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
+	if _, found := b.accounts[username]; found {
+		return ErrAccountExists
+	}
+	b.accounts[username] = password
+	if err := b.saveAccounts(); err != nil {
+		delete(b.accounts, username)
+		return err
+	}
+	logger.Infof("Account %s created", username)
+	return nil
+}
+
+// DeleteAccount 删除一个 SIP 账户并保存到账户文件，账户已注册的联系地址随之注销
+func (b *B2BUA) DeleteAccount(username string) error {
+	b.accountsMu.Lock()
+	password, found := b.accounts[username]
+	if !found {
+		b.accountsMu.Unlock()
+		return ErrAccountNotFound
+	}
+	name, named := b.names[username]
+	delete(b.accounts, username)
+	delete(b.names, username)
+	if err := b.saveAccounts(); err != nil {
+		b.accounts[username] = password
+		if named {
+			b.names[username] = name
+		}
+		b.accountsMu.Unlock()
+		return err
+	}
+	b.accountsMu.Unlock()
+	logger.Infof("Account %s deleted", username)
+
+	if aor, err := b.ParseAOR(username); err == nil {
+		b.Unregister(aor)
+	}
+	return nil
+}
+
+// SetPassword 修改 SIP 账户的密码并保存到账户文件，已注册的终端在下次认证时使用新密码
+func (b *B2BUA) SetPassword(username, password string) error {
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
+	previous, found := b.accounts[username]
+	if !found {
+		return ErrAccountNotFound
+	}
+	b.accounts[username] = password
+	if err := b.saveAccounts(); err != nil {
+		b.accounts[username] = previous
+		return err
+	}
+	logger.Infof("Password of account %s changed", username)
+	return nil
+}
+
+// ChangeDisplayName 修改 SIP 账户的显示名称并保存到账户文件，name 为空时删除
+func (b *B2BUA) ChangeDisplayName(username, name string) error {
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
+	if _, found := b.accounts[username]; !found {
+		return ErrAccountNotFound
+	}
+	previous, named := b.names[username]
+	if name == "" {
+		delete(b.names, username)
+	} else {
+		b.names[username] = name
+	}
+	if err := b.saveAccounts(); err != nil {
+		if named {
+			b.names[username] = previous
+		} else {
+			delete(b.names, username)
+		}
+		return err
+	}
+	logger.Infof("Display name of account %s changed to %q", username, name)
+	return nil
+}
+
+// hasAccount 检查是否存在账户 username
+func (b *B2BUA) hasAccount(username string) bool {
+	b.accountsMu.RLock()
+	defer b.accountsMu.RUnlock()
+	_, found := b.accounts[username]
+	return found
+}
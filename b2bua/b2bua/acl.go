@@ -0,0 +1,150 @@
+package b2bua
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ACLConfig 信令来源地址访问控制，条目为 CIDR 或单个 IP。
+// 命中 Deny 的来源被拒绝；Allow 非空时，只有命中 Allow 的来源被接受。
+type ACLConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ipACL 解析后的访问控制列表
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPACL(config ACLConfig) (*ipACL, error) {
+	allow, err := parseNetworks(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetworks(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipACL{allow: allow, deny: deny}, nil
+}
+
+// parseNetworks 解析 CIDR 列表，单个 IP 视为主机地址
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ACL entry %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry %s: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Permits 检查来源 IP 是否被允许
+func (acl *ipACL) Permits(ip net.IP) bool {
+	if ip == nil {
+		return len(acl.allow) == 0
+	}
+	for _, network := range acl.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, network := range acl.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclFilter 按监听传输协议、SIP profile 和中继检查信令来源
+type aclFilter struct {
+	listeners map[string]*ipACL // 传输协议（udp、tcp、tls、wss） -> ACL
+	profiles  map[string]*ipACL // profile 名称 -> ACL
+	trunks    map[string]*ipACL // 中继名称 -> ACL
+}
+
+func newACLFilter(listeners map[string]ACLConfig, profiles []SIPProfileConfig, trunks []TrunkConfig) (*aclFilter, error) {
+	filter := &aclFilter{
+		listeners: make(map[string]*ipACL),
+		profiles:  make(map[string]*ipACL),
+		trunks:    make(map[string]*ipACL),
+	}
+	for listener, config := range listeners {
+		acl, err := newIPACL(config)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener, err)
+		}
+		filter.listeners[strings.ToLower(listener)] = acl
+	}
+	for _, profile := range profiles {
+		acl, err := newIPACL(profile.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+		filter.profiles[profile.Name] = acl
+	}
+	for _, trunk := range trunks {
+		acl, err := newIPACL(trunk.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("trunk %s: %w", trunk.Name, err)
+		}
+		filter.trunks[trunk.Name] = acl
+	}
+	return filter, nil
+}
+
+// filterACL 对 REGISTER/INVITE 执行来源访问控制，在认证之前以 403 拒绝，返回 false 表示请求已被拒绝
+func (b *B2BUA) filterACL(req sip.Request, tx sip.ServerTransaction) bool {
+	if req.Method() != sip.REGISTER && req.Method() != sip.INVITE {
+		return true
+	}
+	ip := net.ParseIP(sourceIP(req))
+
+	listener := strings.ToLower(req.Transport())
+	if acl, found := b.aclFilter.listeners[listener]; found && !acl.Permits(ip) {
+		return b.rejectACL(req, tx, "listener "+listener)
+	}
+	if profile := b.requestProfile(req); profile != nil {
+		if acl, found := b.aclFilter.profiles[profile.Name]; found && !acl.Permits(ip) {
+			return b.rejectACL(req, tx, "profile "+profile.Name)
+		}
+	}
+	if trunk := b.trunkForRequest(req); trunk != nil {
+		if acl, found := b.aclFilter.trunks[trunk.Name]; found && !acl.Permits(ip) {
+			return b.rejectACL(req, tx, "trunk "+trunk.Name)
+		}
+	}
+	return true
+}
+
+func (b *B2BUA) rejectACL(req sip.Request, tx sip.ServerTransaction, scope string) bool {
+	logger.Warnf("%s from %s denied by %s ACL", req.Method(), req.Source(), scope)
+	b.metrics.Inc(MetricACLRejected + strings.Replace(scope, " ", ".", 1))
+	if tx != nil {
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 403, "Forbidden", ""))
+	}
+	return false
+}
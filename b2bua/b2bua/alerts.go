@@ -0,0 +1,365 @@
+package b2bua
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	defaultAlertInterval   = 30  // 默认评估间隔（秒）
+	defaultAlertWindow     = 300 // 默认统计窗口（秒）
+	defaultAlertMinCalls   = 10  // failure_rate 默认的最少呼叫数
+	defaultTrunkDownFailed = 5   // trunk_down 默认的连续失败次数
+)
+
+// AlertType 告警规则类型
+type AlertType string
+
+const (
+	AlertFailureRate      AlertType = "failure_rate"      // 窗口内失败呼叫（未应答且未取消）的占比超过阈值
+	AlertRegistrationDrop AlertType = "registration_drop" // 当前注册数比窗口内的最高值下降超过阈值比例
+	AlertTrunkDown        AlertType = "trunk_down"        // 发往中继的呼叫连续超时或返回 5xx 达到阈值次数，中继应答任意其它响应后恢复
+)
+
+// AlertsConfig 内置告警配置，供不部署 Prometheus/Alertmanager 的小型部署使用。
+// 告警触发和恢复时产生 alert.firing、alert.resolved 事件（经 webhook 投递），并可发送邮件
+type AlertsConfig struct {
+	Interval int         `json:"interval"` // 评估间隔（秒），默认 30
+	Rules    []AlertRule `json:"rules"`    // 告警规则
+	Email    AlertEmail  `json:"email"`    // 邮件通知，未配置 SMTP 服务器时不发送
+}
+
+// AlertRule 告警规则
+type AlertRule struct {
+	Name      string    `json:"name"`      // 规则名称，用于事件和计数器，为空时使用类型
+	Type      AlertType `json:"type"`      // 规则类型：failure_rate、registration_drop 或 trunk_down
+	Window    int       `json:"window"`    // 统计窗口（秒），默认 300，trunk_down 不使用
+	Threshold float64   `json:"threshold"` // 阈值：failure_rate 为失败占比（0-1），registration_drop 为下降比例（0-1），trunk_down 为连续失败次数（默认 5）
+	MinCalls  int       `json:"min_calls"` // failure_rate：窗口内呼叫少于该数时不评估，默认 10
+	Trunks    []string  `json:"trunks"`    // trunk_down：检查的中继名称，为空表示全部
+}
+
+// AlertEmail 告警邮件通知配置
+type AlertEmail struct {
+	SMTP     string   `json:"smtp"`     // SMTP 服务器地址（host:port）
+	Username string   `json:"username"` // SMTP 认证用户名，为空时不认证
+	Password string   `json:"password"` // SMTP 认证密码
+	From     string   `json:"from"`     // 发件人地址
+	To       []string `json:"to"`       // 收件人地址
+}
+
+// Alert 一条告警的状态
+type Alert struct {
+	Rule    string     `json:"rule"`              // 规则名称
+	Type    AlertType  `json:"type"`              // 规则类型
+	Trunk   string     `json:"trunk,omitempty"`   // trunk_down 告警的中继
+	Value   float64    `json:"value"`             // 触发时的观测值：失败占比、下降比例或连续失败次数
+	Message string     `json:"message"`           // 告警说明
+	Since   time.Time  `json:"since"`             // 触发时间
+	Firing  bool       `json:"firing"`            // 是否仍在告警，恢复的告警为 false
+	Ended   *time.Time `json:"ended,omitempty"`   // 恢复时间，仍在告警时为空
+	Details string     `json:"details,omitempty"` // 附加信息
+}
+
+// callOutcome 一次已结束呼叫的结果
+type callOutcome struct {
+	time   time.Time
+	failed bool
+}
+
+// registrationSample 一次注册数采样
+type registrationSample struct {
+	time  time.Time
+	count int
+}
+
+// alerter 保存告警规则的统计数据和当前告警
+type alerter struct {
+	config        AlertsConfig
+	mutex         sync.Mutex
+	outcomes      []callOutcome        // 最大窗口内已结束呼叫的结果
+	registrations []registrationSample // 最大窗口内的注册数采样
+	trunkFailures map[string]int       // 各中继的连续失败次数
+	active        map[string]*Alert    // 正在告警的规则，键为规则名称（trunk_down 加上中继名称）
+	window        time.Duration        // 所有规则中最大的统计窗口
+}
+
+// newAlerter 校验告警规则并填充默认值，没有规则时返回 nil
+func newAlerter(config AlertsConfig) (*alerter, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultAlertInterval
+	}
+	a := &alerter{
+		config:        config,
+		trunkFailures: make(map[string]int),
+		active:        make(map[string]*Alert),
+	}
+	a.config.Rules = make([]AlertRule, len(config.Rules))
+	for i, rule := range config.Rules {
+		switch rule.Type {
+		case AlertFailureRate, AlertRegistrationDrop:
+			if rule.Threshold <= 0 || rule.Threshold > 1 {
+				return nil, fmt.Errorf("alert rule %d: threshold must be between 0 and 1", i)
+			}
+		case AlertTrunkDown:
+			if rule.Threshold <= 0 {
+				rule.Threshold = defaultTrunkDownFailed
+			}
+		default:
+			return nil, fmt.Errorf("alert rule %d: unknown type %q", i, rule.Type)
+		}
+		if rule.Name == "" {
+			rule.Name = string(rule.Type)
+		}
+		if rule.Window <= 0 {
+			rule.Window = defaultAlertWindow
+		}
+		if rule.MinCalls <= 0 {
+			rule.MinCalls = defaultAlertMinCalls
+		}
+		if window := time.Duration(rule.Window) * time.Second; window > a.window {
+			a.window = window
+		}
+		a.config.Rules[i] = rule
+	}
+	if email := config.Email; email.SMTP != "" && (email.From == "" || len(email.To) == 0) {
+		return nil, fmt.Errorf("alert email: from and to required")
+	}
+	return a, nil
+}
+
+// startAlerts 启动告警规则的定期评估
+func (b *B2BUA) startAlerts(config AlertsConfig) error {
+	a, err := newAlerter(config)
+	if err != nil || a == nil {
+		return err
+	}
+	b.alerts = a
+	go func() {
+		ticker := time.NewTicker(time.Duration(a.config.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stopCh:
+				return
+			case <-ticker.C:
+				b.evaluateAlerts(time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// recordCallOutcome 记录一次已结束呼叫的结果，用于 failure_rate 规则
+func (b *B2BUA) recordCallOutcome(cdr *CDR) {
+	if b.alerts == nil {
+		return
+	}
+	b.alerts.mutex.Lock()
+	defer b.alerts.mutex.Unlock()
+	b.alerts.outcomes = append(b.alerts.outcomes, callOutcome{time: cdr.End, failed: cdr.Disposition == "failed"})
+}
+
+// recordTrunkResult 记录发往中继的 B 路的最终结果，code 为最终响应码，没有响应时为 408
+func (b *B2BUA) recordTrunkResult(call *B2BCall, code sip.StatusCode) {
+	if b.alerts == nil || call.trunk == nil {
+		return
+	}
+	b.alerts.mutex.Lock()
+	if code == 408 || code >= 500 && code < 600 {
+		b.alerts.trunkFailures[call.trunk.Name]++
+	} else {
+		b.alerts.trunkFailures[call.trunk.Name] = 0
+	}
+	b.alerts.mutex.Unlock()
+	b.evaluateTrunkAlerts(time.Now())
+}
+
+// evaluateAlerts 采样注册数并评估所有规则
+func (b *B2BUA) evaluateAlerts(now time.Time) {
+	a := b.alerts
+	registrations := b.activeRegistrations()
+
+	a.mutex.Lock()
+	a.registrations = append(a.registrations, registrationSample{time: now, count: registrations})
+	a.expire(now)
+	type result struct {
+		rule    AlertRule
+		firing  bool
+		value   float64
+		message string
+	}
+	var results []result
+	for _, rule := range a.config.Rules {
+		since := now.Add(-time.Duration(rule.Window) * time.Second)
+		switch rule.Type {
+		case AlertFailureRate:
+			total, failed := 0, 0
+			for _, outcome := range a.outcomes {
+				if outcome.time.After(since) {
+					total++
+					if outcome.failed {
+						failed++
+					}
+				}
+			}
+			if total < rule.MinCalls { // 呼叫太少，保持当前状态
+				continue
+			}
+			rate := float64(failed) / float64(total)
+			results = append(results, result{rule, rate > rule.Threshold, rate,
+				fmt.Sprintf("%d of %d calls failed (%.0f%%) in the last %ds", failed, total, rate*100, rule.Window)})
+		case AlertRegistrationDrop:
+			peak := 0
+			for _, sample := range a.registrations {
+				if sample.time.After(since) && sample.count > peak {
+					peak = sample.count
+				}
+			}
+			if peak == 0 {
+				continue
+			}
+			drop := float64(peak-registrations) / float64(peak)
+			results = append(results, result{rule, drop > rule.Threshold, drop,
+				fmt.Sprintf("registrations dropped from %d to %d (%.0f%%) in the last %ds", peak, registrations, drop*100, rule.Window)})
+		}
+	}
+	a.mutex.Unlock()
+
+	for _, r := range results {
+		b.setAlert(r.rule, "", r.firing, r.value, r.message, now)
+	}
+	b.evaluateTrunkAlerts(now)
+}
+
+// evaluateTrunkAlerts 评估 trunk_down 规则
+func (b *B2BUA) evaluateTrunkAlerts(now time.Time) {
+	a := b.alerts
+	a.mutex.Lock()
+	failures := make(map[string]int, len(a.trunkFailures))
+	for trunk, count := range a.trunkFailures {
+		failures[trunk] = count
+	}
+	a.mutex.Unlock()
+
+	for _, rule := range a.config.Rules {
+		if rule.Type != AlertTrunkDown {
+			continue
+		}
+		for trunk, count := range failures {
+			if len(rule.Trunks) > 0 && !trunkMatches(rule.Trunks, &TrunkConfig{Name: trunk}) {
+				continue
+			}
+			b.setAlert(rule, trunk, float64(count) >= rule.Threshold, float64(count),
+				fmt.Sprintf("trunk %s: %d consecutive calls timed out or failed with 5xx", trunk, count), now)
+		}
+	}
+}
+
+// expire 丢弃超出最大窗口的统计数据，调用时持有锁
+func (a *alerter) expire(now time.Time) {
+	since := now.Add(-a.window)
+	i := 0
+	for i < len(a.outcomes) && !a.outcomes[i].time.After(since) {
+		i++
+	}
+	a.outcomes = a.outcomes[i:]
+	i = 0
+	for i < len(a.registrations) && !a.registrations[i].time.After(since) {
+		i++
+	}
+	a.registrations = a.registrations[i:]
+}
+
+// setAlert 更新一条告警的状态，状态变化时产生事件、计数并发送邮件
+func (b *B2BUA) setAlert(rule AlertRule, trunk string, firing bool, value float64, message string, now time.Time) {
+	a := b.alerts
+	key := rule.Name
+	if trunk != "" {
+		key += "/" + trunk
+	}
+	a.mutex.Lock()
+	alert, active := a.active[key]
+	switch {
+	case firing && !active:
+		alert = &Alert{Rule: rule.Name, Type: rule.Type, Trunk: trunk, Value: value, Message: message, Since: now, Firing: true}
+		a.active[key] = alert
+	case !firing && active:
+		delete(a.active, key)
+		resolved := *alert
+		resolved.Firing, resolved.Ended, resolved.Value, resolved.Details = false, &now, value, message
+		alert = &resolved
+	default:
+		if active { // 告警持续，更新观测值
+			alert.Value, alert.Details = value, message
+		}
+		a.mutex.Unlock()
+		return
+	}
+	a.mutex.Unlock()
+
+	eventType := EventAlertResolved
+	if firing {
+		eventType = EventAlertFiring
+		b.metrics.Inc(MetricAlert + rule.Name)
+		logger.Warnf("Alert %s firing: %s", key, message)
+	} else {
+		logger.Infof("Alert %s resolved: %s", key, message)
+	}
+	b.emit(eventType, map[string]interface{}{"alert": alert})
+	go b.mailAlert(alert)
+}
+
+// Alerts 返回正在告警的规则
+func (b *B2BUA) Alerts() []Alert {
+	if b.alerts == nil {
+		return nil
+	}
+	b.alerts.mutex.Lock()
+	defer b.alerts.mutex.Unlock()
+	alerts := make([]Alert, 0, len(b.alerts.active))
+	for _, alert := range b.alerts.active {
+		alerts = append(alerts, *alert)
+	}
+	return alerts
+}
+
+// mailAlert 发送告警邮件，失败时只记录日志
+func (b *B2BUA) mailAlert(alert *Alert) {
+	email := b.alerts.config.Email
+	if email.SMTP == "" {
+		return
+	}
+	state := "FIRING"
+	if !alert.Firing {
+		state = "RESOLVED"
+	}
+	subject := fmt.Sprintf("[%s] %s %s", state, b.Identity().Name, alert.Rule)
+	if alert.Trunk != "" {
+		subject += " " + alert.Trunk
+	}
+	body := alert.Message
+	if !alert.Firing {
+		body += "\r\nNow: " + alert.Details
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n",
+		email.From, strings.Join(email.To, ", "), subject, time.Now().Format(time.RFC1123Z), body)
+
+	var auth smtp.Auth
+	if email.Username != "" {
+		host, _, _ := net.SplitHostPort(email.SMTP)
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+	if err := smtp.SendMail(email.SMTP, auth, email.From, email.To, []byte(msg)); err != nil {
+		logger.Warnf("Alert email to %v failed: %v", email.To, err)
+	}
+}
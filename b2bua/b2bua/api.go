@@ -0,0 +1,721 @@
+package b2bua
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+// APIHandler 返回 B2BUA 的 REST 管理接口，挂载在 /api/ 下。所有路由都需要认证（见 APIConfig）
+func (b *B2BUA) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/version", b.apiVersion)
+	mux.HandleFunc("/api/bans", b.apiBans)
+	mux.HandleFunc("/api/bans/", b.apiBans)
+	mux.HandleFunc("/api/accounts/", b.apiAccounts)
+	mux.HandleFunc("/api/numbers", b.apiNumbers)
+	mux.HandleFunc("/api/numbers/", b.apiNumbers)
+	mux.HandleFunc("/api/metrics", b.apiMetrics)
+	mux.HandleFunc("/api/alerts", b.apiAlerts)
+	mux.HandleFunc("/api/export", b.apiExport)
+	mux.HandleFunc("/api/calls", b.apiCalls)
+	mux.HandleFunc("/api/calls/", b.apiCallContext)
+	mux.HandleFunc("/api/cdrs/", b.apiCDRs)
+	mux.HandleFunc("/api/history", b.apiHistory)
+	mux.HandleFunc("/api/traces", b.apiTraces)
+	mux.HandleFunc("/api/traces/", b.apiTraces)
+	mux.HandleFunc("/api/recordings", b.apiRecordings)
+	mux.HandleFunc("/api/recordings/", b.apiRecordings)
+	mux.HandleFunc("/api/tls/certificates", b.apiCertificates)
+	mux.HandleFunc("/api/tls/reload", b.apiReloadCertificates)
+	mux.HandleFunc("/api/drain", b.apiDrain)
+	mux.HandleFunc("/api/registry/", b.apiRegistry)
+	mux.HandleFunc("/api/config/effective", b.apiEffectiveConfig)
+	mux.HandleFunc("/api/profiles", b.apiProfiles)
+	mux.HandleFunc("/api/conferences", b.apiConferences)
+	mux.HandleFunc("/api/conferences/", b.apiConferences)
+	mux.HandleFunc("/api/queues", b.apiQueues)
+	mux.HandleFunc("/api/queues/", b.apiQueues)
+	mux.HandleFunc("/api/dispatcher", b.apiDispatcher)
+	mux.HandleFunc("/api/nodes", b.apiNodes)
+	mux.HandleFunc("/api/nodes/registrations", b.apiNodes)
+	mux.HandleFunc("/api/cluster", b.apiCluster)
+	mux.HandleFunc("/api/cluster/", b.apiCluster)
+	return b.requireAPIAuth(mux)
+}
+
+// apiVersion GET /api/version 返回实例标识和版本
+func (b *B2BUA) apiVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Identity())
+}
+
+// apiBans GET /api/bans 列出封禁地址；DELETE /api/bans/{ip} 解除封禁
+func (b *B2BUA) apiBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.Bans())
+	case http.MethodDelete:
+		ip := strings.TrimPrefix(r.URL.Path, "/api/bans/")
+		if ip == "" || ip == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "missing ip")
+			return
+		}
+		if !b.Unban(ip) {
+			writeError(w, http.StatusNotFound, "ip not banned")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiAccounts GET /api/accounts/{user}/features 返回账户的呼叫功能；PUT /api/accounts/{user}/features
+// 修改账户的呼叫功能，请求体为要修改的项，如 {"reject_anonymous": true}，前转目的地被账户所属租户的被叫号码名单拒绝时返回 403。
+// GET /api/accounts/{user}/name 返回账户的显示名称；
+// PUT /api/accounts/{user}/name 修改显示名称并保存到账户文件，请求体为 {"name": "<显示名称>"}，为空时删除
+func (b *B2BUA) apiAccounts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/accounts/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "features" && parts[1] != "name") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !b.hasAccount(parts[0]) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if parts[1] == "name" {
+		b.apiDisplayName(w, r, parts[0])
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.Features(parts[0]))
+	case http.MethodPut:
+		features := b.Features(parts[0])
+		if err := json.NewDecoder(r.Body).Decode(&features); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := b.checkForwardTargets(parts[0], features); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrForwardNotAllowed) {
+				status = http.StatusForbidden
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		b.SetFeatures(parts[0], features)
+		writeJSON(w, http.StatusOK, features)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// displayNameRequest /api/accounts/{user}/name 的请求和响应
+type displayNameRequest struct {
+	Name string `json:"name"`
+}
+
+// apiDisplayName 查询或修改账户的显示名称
+func (b *B2BUA) apiDisplayName(w http.ResponseWriter, r *http.Request, user string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, displayNameRequest{Name: b.DisplayName(user)})
+	case http.MethodPut:
+		var req displayNameRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		switch err := b.ChangeDisplayName(user, req.Name); err {
+		case nil:
+			writeJSON(w, http.StatusOK, req)
+		case ErrAccountNotFound:
+			writeError(w, http.StatusNotFound, "account not found")
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiNumbers GET /api/numbers 列出号码名单；POST /api/numbers/{tenant}/{callers|callees}/{blacklist|whitelist}
+// 添加号码，请求体为 {"number": "<号码或前缀*>"}；DELETE /api/numbers/{tenant}/{callers|callees}/{blacklist|whitelist}/{number}
+// 删除号码。tenant 为 * 时用于所有租户
+func (b *B2BUA) apiNumbers(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/numbers/"), "/")
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, b.NumberLists())
+	case r.Method == http.MethodPost && len(parts) == 3:
+		var request struct {
+			Number string `json:"number"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := b.AddNumber(parts[0], parts[1], parts[2], request.Number); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, b.NumberLists())
+	case r.Method == http.MethodDelete && len(parts) == 4:
+		removed, err := b.RemoveNumber(parts[0], parts[1], parts[2], parts[3])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "number not in list")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiEffectiveConfig GET /api/config/effective?tenant=&listener=&profile=&trunk= 返回按层级合并后生效的配置
+func (b *B2BUA) apiEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	effective, err := b.EffectiveConfig(query.Get("tenant"), query.Get("listener"), query.Get("profile"), query.Get("trunk"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, effective)
+}
+
+// apiProfiles GET /api/profiles 返回各 SIP profile 的监听、注册数和通话数
+func (b *B2BUA) apiProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Profiles())
+}
+
+// apiConferences GET /api/conferences 返回进行中的会议室及与会者；PUT /api/conferences/{room}/participants/{id}
+// 设置静音，请求体为 {"muted": true|false}；DELETE /api/conferences/{room}/participants/{id} 将与会者移出会议室
+func (b *B2BUA) apiConferences(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/conferences"), "/"), "/")
+	if r.Method == http.MethodGet && parts[0] == "" {
+		writeJSON(w, http.StatusOK, b.Conferences())
+		return
+	}
+	if len(parts) != 3 || parts[1] != "participants" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var request struct {
+			Muted bool `json:"muted"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := b.MuteParticipant(parts[0], parts[2], request.Muted); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := b.KickParticipant(parts[0], parts[2]); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiQueues GET /api/queues 返回各呼叫队列的状态、统计和坐席；PUT /api/queues/{name}/agents/{user} 设置坐席状态，
+// 请求体为 {"state": "available"|"busy"}
+func (b *B2BUA) apiQueues(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/queues"), "/"), "/")
+	if r.Method == http.MethodGet && parts[0] == "" {
+		writeJSON(w, http.StatusOK, b.Queues())
+		return
+	}
+	if len(parts) != 3 || parts[1] != "agents" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var request struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if err := b.SetAgentState(parts[0], parts[2], request.State); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrQueueNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiDispatcher GET /api/dispatcher 返回负载分发各目标的状态
+func (b *B2BUA) apiDispatcher(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Dispatcher())
+}
+
+// apiNodes GET /api/nodes 返回其它节点的同步状态；POST /api/nodes/registrations 接收其它节点拥有的注册，
+// 需要携带共享密钥
+func (b *B2BUA) apiNodes(w http.ResponseWriter, r *http.Request) {
+	if b.scaleOut == nil {
+		writeError(w, http.StatusNotFound, "scale out is not enabled")
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/nodes" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, b.Nodes())
+	case r.URL.Path == nodeRegistrationsPath && r.Method == http.MethodPost:
+		if r.Header.Get(nodeSecretHeader) != b.scaleOut.config.Secret {
+			writeError(w, http.StatusForbidden, "invalid node secret")
+			return
+		}
+		var shared nodeRegistrations
+		if err := json.NewDecoder(r.Body).Decode(&shared); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := b.applyNodeRegistrations(&shared); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiCluster GET /api/cluster 返回主备状态；PUT /api/cluster/role 切换角色，请求体为 {"role": "active"|"standby"}；
+// POST /api/cluster/state 接收主用实例复制的状态，需要携带共享密钥
+func (b *B2BUA) apiCluster(w http.ResponseWriter, r *http.Request) {
+	if b.cluster == nil {
+		writeError(w, http.StatusNotFound, "cluster is not enabled")
+		return
+	}
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/cluster"); {
+	case (path == "" || path == "/") && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, b.Cluster())
+	case path == "/role" && r.Method == http.MethodPut:
+		var request struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := b.SetClusterRole(request.Role); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/state" && r.Method == http.MethodPost:
+		if r.Header.Get(clusterSecretHeader) != b.cluster.config.Secret {
+			writeError(w, http.StatusForbidden, "invalid cluster secret")
+			return
+		}
+		var state clusterState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if !b.applyClusterState(&state) {
+			writeError(w, http.StatusConflict, "already active")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "" || path == "/" || path == "/role" || path == "/state":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiMetrics GET /api/metrics 返回所有计数器
+func (b *B2BUA) apiMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Metrics())
+}
+
+// apiAlerts GET /api/alerts 返回正在告警的规则
+func (b *B2BUA) apiAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	alerts := b.Alerts()
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+	writeJSON(w, http.StatusOK, alerts)
+}
+
+// apiExport GET /api/export?format=json|prom 返回当前的状态快照：计数器、通话和注册
+func (b *B2BUA) apiExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	var out bytes.Buffer
+	if err := b.ExportState(&out, format); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format == ExportPrometheus {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(out.Bytes())
+}
+
+// callInfo 是 /api/calls 返回的通话信息
+type callInfo struct {
+	ID      string            `json:"id"`
+	Caller  string            `json:"caller"`
+	Callee  string            `json:"callee"`
+	Class   string            `json:"class"`
+	State   CallState         `json:"state"`
+	Cause   ReleaseCause      `json:"cause,omitempty"` // 正在挂断（terminating）的呼叫的释放原因
+	Start   time.Time         `json:"start"`
+	Context map[string]string `json:"context"`
+}
+
+// originateRequest POST /api/calls 的请求：第三方呼叫控制（点击拨号）
+type originateRequest struct {
+	Caller  string `json:"caller"`  // 先呼叫的 A 方：号码、user@域名或 SIP URI
+	Callee  string `json:"callee"`  // A 方应答后呼叫的 B 方
+	Timeout int    `json:"timeout"` // 等待 A 方应答的秒数，0 为 30 秒
+}
+
+// apiCalls GET /api/calls 列出当前通话，分叉的多个分支只列出一次；
+// POST /api/calls 发起第三方呼叫，先呼叫 caller，应答后呼叫 callee 并接通，返回呼叫 ID。caller 不是本地账户或不允许呼叫 callee 时返回 403
+func (b *B2BUA) apiCalls(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.callInfos())
+	case http.MethodPost:
+		var req originateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if req.Caller == "" || req.Callee == "" {
+			writeError(w, http.StatusBadRequest, "caller and callee required")
+			return
+		}
+		id, err := b.Originate(req.Caller, req.Callee, req.Timeout)
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+		case ErrNoOriginateRoute:
+			writeError(w, http.StatusNotFound, err.Error())
+		case ErrUnknownCaller, ErrCalleeNotAllowed:
+			writeError(w, http.StatusForbidden, err.Error())
+		case ErrOriginateNeedsRelay, ErrCapacityExhausted:
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+		default:
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiCallContext 读写通话上下文：
+// GET /api/calls/{id}/context 返回上下文；PUT /api/calls/{id}/context 合并写入 JSON 对象；
+// DELETE /api/calls/{id}/context/{key} 删除一个键。DELETE /api/calls/{id} 取消呼叫
+func (b *B2BUA) apiCallContext(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/calls/"), "/")
+	if len(parts) == 1 && parts[0] != "" && r.Method == http.MethodDelete {
+		if err := b.CancelCall(parts[0]); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(parts) < 2 || parts[1] != "context" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	call := b.findCallByID(parts[0])
+	if call == nil {
+		writeError(w, http.StatusNotFound, "call not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2:
+		writeJSON(w, http.StatusOK, call.Context.All())
+	case r.Method == http.MethodPut && len(parts) == 2:
+		values := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		for key, value := range values {
+			call.Context.Set(key, value)
+		}
+		writeJSON(w, http.StatusOK, call.Context.All())
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[2] != "":
+		call.Context.Delete(parts[2])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiHistory GET /api/history?limit=N 返回最近结束的呼叫的话单（含通话时长和释放原因），最近结束的在前，默认 50 个
+func (b *B2BUA) apiHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	cdrs := b.CallHistory(limit)
+	if cdrs == nil {
+		cdrs = []*CDR{}
+	}
+	writeJSON(w, http.StatusOK, cdrs)
+}
+
+// apiCDRs GET /api/cdrs/{id} 返回最近结束的呼叫的话单和标签；POST /api/cdrs/{id}/tags 添加标签或评分，
+// 请求体为 {"label": "<标签>", "rating": <1-5>, "source": "<来源>"}
+func (b *B2BUA) apiCDRs(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/cdrs/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] != "":
+		cdr, found := b.CompletedCDR(parts[0])
+		if !found {
+			writeError(w, http.StatusNotFound, ErrCallNotCompleted.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, cdr)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "tags":
+		var tag CallTag
+		if err := json.NewDecoder(r.Body).Decode(&tag); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		cdr, err := b.TagCall(parts[0], tag)
+		if err == ErrCallNotCompleted {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, cdr)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiTraces GET /api/traces 列出进行中的跟踪；POST /api/traces 开始跟踪，请求体为
+// {"target": "<ip|user>", "file": "<路径>"}，file 为空时输出到控制台；DELETE /api/traces/{target} 停止跟踪
+func (b *B2BUA) apiTraces(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.Traces())
+	case http.MethodPost:
+		var request TraceInfo
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		trace, err := b.StartTrace(request.Target, request.File)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, trace)
+	case http.MethodDelete:
+		target := strings.TrimPrefix(r.URL.Path, "/api/traces/")
+		if target == "" || target == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "missing target")
+			return
+		}
+		if !b.StopTrace(target) {
+			writeError(w, http.StatusNotFound, "target not traced")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiRecordings GET /api/recordings 列出录音文件；GET /api/recordings/{name} 下载录音
+func (b *B2BUA) apiRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/recordings")
+	if name == "" || name == "/" {
+		recordings, err := b.Recordings()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, recordings)
+		return
+	}
+	path, err := b.RecordingPath(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "recording not found")
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeFile(w, r, path)
+}
+
+// apiCertificates GET /api/tls/certificates 返回当前加载的证书
+func (b *B2BUA) apiCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Certificates())
+}
+
+// apiReloadCertificates POST /api/tls/reload 重新加载证书，可用于证书续期后的部署钩子
+func (b *B2BUA) apiReloadCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := b.ReloadCertificates(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Certificates())
+}
+
+// apiDrain GET /api/drain 返回排空状态；POST /api/drain?timeout=秒数 进入排空模式（默认超时 10 分钟），
+// 通话结束或超时后关闭 B2BUA
+func (b *B2BUA) apiDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		timeout := defaultDrainTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid timeout: "+value)
+				return
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+		b.Drain(timeout)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	remaining, draining := b.drainRemaining()
+	status := struct {
+		Draining    bool `json:"draining"`
+		ActiveCalls int  `json:"active_calls"`
+		Remaining   int  `json:"remaining_seconds,omitempty"`
+	}{Draining: draining, ActiveCalls: len(b.Calls())}
+	if draining && remaining > 0 {
+		status.Remaining = int(remaining.Seconds())
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// apiRegistry POST /api/registry/flush 清空内存中的注册表；POST /api/registry/reload 清空并从快照重建；
+// POST /api/registry/reconcile 与快照对账。与命令行的 registry 命令相同
+func (b *B2BUA) apiRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var report registry2.ReconcileReport
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/api/registry/") {
+	case "flush":
+		b.FlushRegistry()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "reload":
+		report, err = b.ReloadRegistry()
+	case "reconcile":
+		report, err = b.ReconcileRegistry()
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if errors.Is(err, ErrNoRegistryBackend) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// writeJSON 以 JSON 格式写入响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("API: encode response failed: %v", err)
+	}
+}
+
+// writeError 以 JSON 格式写入错误响应
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,88 @@
+package b2bua
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIConfig REST 管理接口的认证。请求须携带 Authorization: Bearer <token>，或经 HTTPS 以 client_ca 签发的
+// 客户端证书连接；两者都未配置时拒绝所有请求。主备复制和节点间的注册同步以各自的共享密钥认证
+type APIConfig struct {
+	Token    string `json:"token"`     // Bearer 令牌
+	CertFile string `json:"cert_file"` // 管理接口的 TLS 证书，与 key_file 同时配置时以 HTTPS 监听
+	KeyFile  string `json:"key_file"`  // 管理接口的 TLS 私钥
+	ClientCA string `json:"client_ca"` // 校验客户端证书的 CA 文件（PEM），持有有效证书的客户端不需要令牌，需要 cert_file
+}
+
+// validateAPI 检查管理接口的认证配置
+func validateAPI(config APIConfig) error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("api: cert_file and key_file must be set together")
+	}
+	if config.ClientCA != "" && config.CertFile == "" {
+		return fmt.Errorf("api: client_ca requires cert_file")
+	}
+	if config.Token == "" && config.ClientCA == "" {
+		logger.Warnf("REST API has neither a token nor a client CA configured, all requests are rejected")
+	}
+	return nil
+}
+
+// ServeAPI 在 addr 上提供 REST 管理接口，配置了证书时以 HTTPS 监听，阻塞直到监听失败
+func (b *B2BUA) ServeAPI(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", b.APIHandler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	config := b.config.API
+	if config.CertFile == "" {
+		return server.ListenAndServe()
+	}
+	if config.ClientCA != "" {
+		pool, err := loadCertPool(config.ClientCA)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	return server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+}
+
+// requireAPIAuth 在任何路由处理之前检查请求的认证，未认证时返回 401
+func (b *B2BUA) requireAPIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.authorizeAPI(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+ProductName+`"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeAPI 检查请求是否携带有效的客户端证书、Bearer 令牌，或为携带共享密钥的节点间请求
+func (b *B2BUA) authorizeAPI(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if token := b.config.API.Token; token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && secretEqual(strings.TrimPrefix(auth, "Bearer "), token) {
+			return true
+		}
+	}
+	switch {
+	case r.URL.Path == nodeRegistrationsPath && b.scaleOut != nil:
+		return secretEqual(r.Header.Get(nodeSecretHeader), b.scaleOut.config.Secret)
+	case r.URL.Path == "/api/cluster/state" && b.cluster != nil:
+		return secretEqual(r.Header.Get(clusterSecretHeader), b.cluster.config.Secret)
+	}
+	return false
+}
+
+// secretEqual 以固定时间比较令牌或共享密钥，空值不匹配
+func secretEqual(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,40 @@
+package b2bua
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		auth  string
+		tls   bool
+		want  int
+	}{
+		{"no credentials", "secret", "", false, http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", false, http.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", false, http.StatusOK},
+		{"no token configured", "", "Bearer ", false, http.StatusUnauthorized},
+		{"client certificate", "", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		b := &B2BUA{config: &B2BUAConfig{API: APIConfig{Token: tt.token}}}
+		req := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+		}
+		rec := httptest.NewRecorder()
+		b.APIHandler().ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d; want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
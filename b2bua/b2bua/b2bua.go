@@ -1,40 +1,132 @@
 package b2bua
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	registry2 "go-sip-ua/b2bua/registry"
+	"sync"
+	"time"
 
-	"github.com/ghettovoice/gosip/log"        // 导入日志模块
-	"github.com/ghettovoice/gosip/sip"        // 导入 SIP 协议模块
-	"github.com/ghettovoice/gosip/sip/parser" // 导入 SIP 解析模块
-	"github.com/ghettovoice/gosip/transport"  // 导入传输模块
-	"go-sip-ua/pkg/account"                   // 导入账户管理模块
-	"go-sip-ua/pkg/auth"                      // 导入认证模块
-	"go-sip-ua/pkg/session"                   // 导入会话管理模块
-	"go-sip-ua/pkg/stack"                     // 导入 SIP 协议栈模块
-	"go-sip-ua/pkg/ua"                        // 导入用户代理模块
-	"go-sip-ua/pkg/utils"                     // 导入工具模块
+	"github.com/ghettovoice/gosip/log"       // 导入日志模块
+	"github.com/ghettovoice/gosip/sip"       // 导入 SIP 协议模块
+	"github.com/ghettovoice/gosip/transport" // 导入传输模块
+	"github.com/google/uuid"                 // 导入 UUID 模块
+	"go-sip-ua/pkg/account"                  // 导入账户管理模块
+	"go-sip-ua/pkg/auth"                     // 导入认证模块
+	"go-sip-ua/pkg/media"                    // 导入媒体模块
+	"go-sip-ua/pkg/session"                  // 导入会话管理模块
+	"go-sip-ua/pkg/stack"                    // 导入 SIP 协议栈模块
+	"go-sip-ua/pkg/ua"                       // 导入用户代理模块
+	"go-sip-ua/pkg/utils"                    // 导入工具模块
 )
 
-// B2BCall 表示一个 B2BUA 呼叫，包含源会话和目标会话
+// B2BCall 表示一个 B2BUA 呼叫，包含源会话和目标会话。
+// 呼叫分叉到多个联系地址时，各分支共享 ID 和上下文
 type B2BCall struct {
-	src  *session.Session // 源会话
-	dest *session.Session // 目标会话
+	ID         string             // 呼叫 ID
+	Caller     string             // 主叫
+	Callee     string             // 被叫
+	Start      time.Time          // 呼叫开始时间
+	Context    *CallContext       // 通话上下文
+	Class      string             // 呼叫分类：internal、inbound、outbound 或 transit，路由时确定
+	users      []string           // 主叫和被叫的用户标识，用于按租户分发事件
+	src        *session.Session   // 源会话
+	dest       *session.Session   // 目标会话
+	failover   []routeTarget      // 目标会话超时或返回 503 时依次尝试的备用地址
+	forks      [][]routeTarget    // q 值较低的各组联系地址，本组分支全部失败后依次并行呼叫
+	media      *callMedia         // 媒体中继会话，未启用媒体中继时为 nil
+	sdpPolicy  *SDPPolicy         // 发往 B 路的 SDP 策略，未配置时为 nil
+	bandwidth  int                // A 路 offer 的媒体带宽（kbps），用于呼叫准入控制
+	identity   string             // A 路的断言身份（P-Asserted-Identity 的值），未认证时为空
+	privacy    []string           // A 路请求的 Privacy 取值
+	hops       int                // A 路 INVITE 已经过的 B2BUA 实例数（跳数头域）
+	called     sip.Uri            // 前转后的被叫，B 路 INVITE 的 To；未前转时为 nil，使用 A 路的 To
+	dialed     string             // 该分支呼叫的本地账户，用于遇忙和无应答前转
+	diversion  []string           // 前转记录，作为 Diversion 头域发往 B 路
+	trunk      *TrunkConfig       // B 路经过的中继，未经中继时为 nil
+	profile    *SIPProfileConfig  // 收到 A 路 INVITE 的 SIP profile，全局监听时为 nil
+	answer     string             // A 路在本地应答时（呼叫队列、代答）发给 A 路的 SDP，B 路 offer 只保留其中的编解码
+	offer      string             // 预先生成的 B 路 offer（寻呼成员），为空时由 A 路的 offer 改写
+	autoAnswer bool               // B 路请求被叫自动应答（对讲、寻呼）
+	origin     sip.Uri            // 第三方呼叫控制发起的呼叫中 B 路的主叫（A 方），为 nil 时使用 A 路 INVITE 的 From
+	ctx        context.Context    // 呼叫的上下文，呼叫结束、被取消或 B2BUA 关闭时取消
+	cancel     context.CancelFunc // 取消 ctx，中止未完成的 B 路呼叫
 }
 
 // String 返回 B2BCall 的字符串表示
 func (b *B2BCall) String() string {
+	if b.dest == nil { // 第三方呼叫的 A 方尚未应答
+		return fmt.Sprintf("%s => -", b.src.Contact())
+	}
 	return fmt.Sprintf("%s => %s", b.src.Contact(), b.dest.Contact())
 }
 
 // B2BUA 表示 B2BUA 的核心逻辑
 type B2BUA struct {
-	stack    *stack.SipStack    // SIP 协议栈
-	ua       *ua.UserAgent      // 用户代理
-	accounts map[string]string  // 账户信息（用户名 -> 密码）
-	registry registry2.Registry // 注册管理
-	domains  []string           // 域名列表
-	calls    []*B2BCall         // 当前通话列表
+	stack      *stack.SipStack    // SIP 协议栈
+	ua         *ua.UserAgent      // 用户代理
+	accounts   map[string]string  // 账户信息（用户名 -> 密码）
+	accountsMu sync.RWMutex       // 保护 accounts 和 names
+	names      map[string]string  // 账户显示名称（用户名 -> 显示名称）
+	registry   registry2.Registry // 注册管理
+	domains    []string           // 域名列表
+	calls      []*B2BCall         // 当前通话列表
+	callsMu    sync.Mutex         // 保护 calls
+
+	config        *B2BUAConfig           // 配置
+	identity      Identity               // 实例标识
+	authenticator *auth.ServerAuthorizer // 认证器，禁用认证时为 nil
+	events        eventBus               // 事件回调
+	fingerprints  *fingerprintTracker    // 注册设备指纹跟踪
+	drain         *drainState            // 排空模式状态，未排空时为 nil
+	drained       chan struct{}          // 排空结束并关闭后被关闭
+	drainMu       sync.Mutex             // 保护 drain
+
+	registryBackend     registry2.Backend // 注册表持久化后端，未配置时为 nil
+	persistCh           chan struct{}     // 触发异步保存注册表快照
+	floodGuard          *floodGuard       // 来源 IP 限速与封禁
+	registerPacer       *registerPacer    // 注册风暴准入控制，未配置时为 nil
+	capacity            *capacityManager  // 呼叫数、注册数及资源耗尽时的准入与 Retry-After
+	registerRelay       *registerRelay    // REGISTER 上行转发，未配置时为 nil
+	survivability       *survivability    // 生存模式路由
+	scannerFilter       *scannerFilter    // 扫描器特征过滤
+	aclFilter           *aclFilter        // 来源地址访问控制
+	topology            *topologyHider    // 拓扑隐藏，未启用时为 nil
+	survey              *survey           // 通话后调查，未启用时为 nil
+	headerRules         []*headerRule     // 头域操作规则
+	numberLists         *numberLists      // 按租户的号码黑白名单
+	features            *accountFeatures  // 按账户的呼叫功能设置
+	alerts              *alerter          // 内置告警，未配置规则时为 nil
+	conferences         conferences       // 进行中的会议室
+	queues              *callQueues       // 呼叫队列
+	huntGroups          *huntGroups       // 振铃组
+	scaleOut            *scaleOut         // 水平扩展，未启用时为 nil
+	cluster             *cluster          // 主备高可用，未启用时为 nil
+	dispatcher          *dispatcher       // 负载分发，未启用时为 nil
+	pages               pages             // 进行中的寻呼
+	regEvents           regEvents         // reg 事件订阅
+	metrics             *metrics          // 计数器
+	callHooks           callHooks         // 呼叫回调
+	dtmfHooks           dtmfHooks         // 按键回调
+	cdrWriter           *cdrWriter        // 话单文件，未配置时为 nil
+	completed           completedCalls    // 最近结束的呼叫，用于添加标签和查询通话历史
+	certStore           *stack.CertStore  // TLS 证书，未启用 TLS 时为 nil
+	resolver            *stack.Resolver   // 出局路由的 NAPTR/SRV 解析
+	trunkRoutes         []trunkRoute      // 中继出局路由
+	outboundProxy       *sip.SipUri       // 全局出局代理，未配置时为 nil
+	traces              peerTraces        // 按对端地址或用户的 SIP 消息跟踪
+	mediaRelay          *media.Relay      // 媒体中继，未启用时为 nil
+	holdMusic           *media.Audio      // 保持音乐，未配置时为 nil
+	featureTone         *media.Audio      // 功能码的确认音，未配置时为 nil
+	locations           *locations        // 紧急呼叫的静态位置
+	transcodingSessions int32             // 当前转码的通话数
+	stopCh              chan struct{}     // 关闭时通知后台任务退出
+	stopOnce            sync.Once
+	ctx                 context.Context    // 根上下文，关闭时取消，中止进行中的 B 路呼叫和上游请求
+	cancel              context.CancelFunc // 取消 ctx
+	shutdownDone        chan struct{}      // 关闭完成后被关闭
+	shutdownErr         error              // 关闭的结果，shutdownDone 关闭后有效
 }
 
 var (
@@ -46,22 +138,140 @@ func init() {
 }
 
 // NewB2BUA 创建一个新的 B2BUA 实例
-func NewB2BUA(disableAuth, enableTLS bool) *B2BUA {
+func NewB2BUA(config *B2BUAConfig) *B2BUA {
+	if config == nil {
+		config = &B2BUAConfig{}
+	}
+
 	b := &B2BUA{
-		registry: registry2.NewMemoryRegistry(), // 初始化内存注册表
-		accounts: make(map[string]string),       // 初始化账户信息
+		registry:      registry2.NewMemoryRegistry(),             // 初始化内存注册表
+		accounts:      make(map[string]string),                   // 初始化账户信息
+		names:         make(map[string]string),                   // 初始化账户显示名称
+		config:        config,                                    // 保存配置
+		drained:       make(chan struct{}),                       // 排空结束通知
+		identity:      newIdentity(config.Identity),              // 实例标识
+		fingerprints:  newFingerprintTracker(config.Fingerprint), // 初始化设备指纹跟踪
+		floodGuard:    newFloodGuard(config.RateLimit),           // 初始化限速与防洪
+		registerPacer: newRegisterPacer(config.RegisterPacing),   // 初始化注册准入控制
+		scannerFilter: newScannerFilter(config.ScannerFilter),    // 初始化扫描器特征过滤
+		numberLists:   newNumberLists(config.NumberLists),        // 初始化号码黑白名单
+		features:      newAccountFeatures(config.Features),       // 初始化账户功能设置
+		metrics:       newMetrics(),                              // 初始化计数器
+		stopCh:        make(chan struct{}),
+		shutdownDone:  make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.traces.traces = make(map[string]*peerTrace)
+	b.conferences.rooms = make(map[string]*conferenceRoom)
+	b.pages.pages = make(map[*session.Session]*page)
+	b.capacity = newCapacityManager(config.Capacity, config.MediaRelay.RetryAfter, b.activeCalls, b.activeBandwidth, b.activeRegistrations, b.drainRemaining)
+	go b.floodGuard.run(b.stopCh) // 清理过期的限速状态
+
+	if err := b.startLogging(config.Log); err != nil { // 日志输出到文件
+		logger.Panic(err)
+	}
+
+	if err := b.startWebhooks(config.Webhooks); err != nil { // 启动事件 webhook
+		logger.Panic(err)
+	}
+	if err := b.startAlerts(config.Alerts); err != nil { // 启动内置告警
+		logger.Panic(err)
+	}
+
+	if config.CDRFile != "" {
+		b.cdrWriter = &cdrWriter{path: config.CDRFile}
+	}
+	b.completed.size = config.CallHistory
+
+	aclFilter, err := newACLFilter(config.ListenerACL, config.Profiles, config.Trunks)
+	if err != nil {
+		logger.Panic(err)
+	}
+	b.aclFilter = aclFilter
+	if b.topology, err = newTopologyHider(config.TopologyHiding); err != nil {
+		logger.Panic(err)
+	}
+	if b.headerRules, err = newHeaderRules(config.HeaderRules); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateCallerIDRules(config.CallerID); err != nil {
+		logger.Panic(err)
+	}
+
+	trunkRoutes, err := newTrunkRoutes(config.Trunks)
+	if err != nil {
+		logger.Panic(err)
+	}
+	b.trunkRoutes = trunkRoutes
+	if b.outboundProxy, err = parseOutboundProxy(config.OutboundProxy); err != nil {
+		logger.Panic(err)
+	}
+	b.resolver = newResolver(config.DNS)
+	if b.locations, err = newLocations(config.Location); err != nil {
+		logger.Panic(err)
+	}
+
+	if config.RegisterRelay.Upstream != "" { // 边缘代理模式
+		relay, err := newRegisterRelay(config.RegisterRelay)
+		if err != nil {
+			logger.Panic(err)
+		}
+		b.registerRelay = relay
+
+		survivability, err := newSurvivability(config.Survivability)
+		if err != nil {
+			logger.Panic(err)
+		}
+		b.survivability = survivability
+	}
+
+	for username, name := range config.DisplayNames {
+		b.SetDisplayName(username, name)
+	}
+
+	if err := validateOverrides(config); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateAPI(config.API); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateTrustedTrunks(config); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateProfiles(config); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateEarlyMedia(config.EarlyMedia); err != nil {
+		logger.Panic(err)
+	}
+	if err := validateRel100(config.Rel100); err != nil {
+		logger.Panic(err)
 	}
 
 	var authenticator *auth.ServerAuthorizer
-	if !disableAuth { // 如果未禁用认证
+	if config.usesSetting(func(o ConfigOverrides) bool { return o.Auth != "" && o.Auth != AuthNone }) { // 任一层级需要认证
 		authenticator = auth.NewServerAuthorizer(b.requestCredential, "b2bua", false) // 创建认证器
+		authenticator.OnAuthFailure(b.handleAuthFailure)                              // 统计认证失败
+		if config.NonceSecret != "" {                                                 // 集群部署时使用签名 nonce
+			authenticator.SetNonceSecret([]byte(config.NonceSecret))
+		}
+	}
+	b.authenticator = authenticator
+
+	viaPolicies, err := newViaPolicies(config.Via)
+	if err != nil {
+		logger.Panic(err)
 	}
 
 	// 初始化 SIP 协议栈
 	stack := stack.NewSipStack(&stack.SipStackConfig{
-		UserAgent:  "Go B2BUA/1.0.0",                 // 用户代理标识
-		Extensions: []string{"replaces", "outbound"}, // 支持的扩展
-		Dns:        "8.8.8.8",                        // DNS 服务器
+		UserAgent:      b.identity.UserAgent,  // 用户代理标识
+		Server:         b.identity.Server,     // 响应的 Server 头域
+		ViaPolicies:    viaPolicies,           // 按传输协议的 rport/Via 处理
+		TelDomain:      config.TelDomain,      // tel: URI 映射的域名
+		CompactHeaders: config.CompactHeaders, // 使用紧凑头域名的传输协议
+		Extensions:     extensions(config),    // 支持的扩展
+		Dns:            config.DNS.Server,     // DNS 服务器，为空时使用系统配置
 		ServerAuthManager: stack.ServerAuthManager{
 			Authenticator:     authenticator,       // 认证器
 			RequiresChallenge: b.requiresChallenge, // 是否需要挑战
@@ -69,131 +279,367 @@ func NewB2BUA(disableAuth, enableTLS bool) *B2BUA {
 	})
 
 	stack.OnConnectionError(b.handleConnectionError) // 设置连接错误处理函数
+	stack.OnRequestFilter(b.filterRequest)           // 设置请求过滤函数（限速、封禁）
 
-	// 监听 UDP 端口
-	if err := stack.Listen("udp", "0.0.0.0:5060"); err != nil {
-		logger.Panic(err)
+	plain, secure := config.Listen.sipListeners(config.EnableTLS)
+	profilePlain, profileSecure := config.profileListeners() // 各 SIP profile 的监听
+	plain, secure = append(plain, profilePlain...), append(secure, profileSecure...)
+	if len(plain)+len(secure) == 0 {
+		logger.Panic("no SIP listener enabled")
 	}
 
-	// 监听 TCP 端口
-	if err := stack.Listen("tcp", "0.0.0.0:5060"); err != nil {
-		logger.Panic(err)
+	// 监听 UDP/TCP 端口
+	for _, listener := range plain {
+		if err := stack.Listen(listener.network, listener.addr); err != nil {
+			b.listenerFailed(listener, err)
+		}
 	}
 
-	if enableTLS { // 如果启用 TLS
-		tlsOptions := &transport.TLSConfig{Cert: "certs/cert.pem", Key: "certs/key.pem"} // TLS 配置
-		if err := stack.ListenTLS("tls", "0.0.0.0:5061", tlsOptions); err != nil {       // 监听 TLS 端口
+	if config.EnableTLS { // 如果启用 TLS
+		certStore, err := newCertStore(config.TLS) // 加载证书，支持 SNI 和热加载
+		if err != nil {
 			logger.Panic(err)
 		}
-		if err := stack.ListenTLS("wss", "0.0.0.0:5081", tlsOptions); err != nil { // 监听 WSS 端口
-			logger.Panic(err)
+		b.certStore = certStore
+		for _, listener := range secure { // 监听 TLS/WSS 端口
+			tlsConfig, err := listenerTLSConfig(certStore, config.TLS, listener.network)
+			if err != nil {
+				logger.Panic(err)
+			}
+			if err := stack.ListenTLSConfig(listener.network, listener.addr, tlsConfig); err != nil {
+				b.listenerFailed(listener, err)
+			}
+		}
+		if config.TLS.ReloadInterval > 0 {
+			go b.watchCertificates(time.Duration(config.TLS.ReloadInterval) * time.Second)
 		}
 	}
 
 	// 初始化用户代理
 	ua := ua.NewUserAgent(&ua.UserAgentConfig{
-		SipStack: stack, // 绑定 SIP 协议栈
+		SipStack:       stack,                           // 绑定 SIP 协议栈
+		Retransmission: config.Retransmission.session(), // UDP 上 200 OK 的重传
 	})
+	ua.RetransmitHandler = func(kind string) { // 统计重传
+		b.metrics.Inc(MetricRetransmit + kind)
+	}
 
-	// 设置 INVITE 状态处理函数
-	ua.InviteStateHandler = func(sess *session.Session, req *sip.Request, resp *sip.Response, state session.Status) {
-		logger.Infof("InviteStateHandler: state => %v, type => %s", state, sess.Direction())
-
-		switch state {
-		case session.InviteReceived: // 收到 INVITE 请求
-			to, _ := (*req).To()
-			from, _ := (*req).From()
-			caller := from.Address
-			called := to.Address
-
-			doInvite := func(instance *registry2.ContactInstance) {
-				displayName := ""
-				if from.DisplayName != nil {
-					displayName = from.DisplayName.String()
-				}
+	ua.InviteStateHandler = b.handleInviteState     // 设置 INVITE 状态处理函数
+	ua.UnknownDialogHandler = b.handleUnknownDialog // 设置未知对话请求处理函数
+	ua.InfoHandler = b.handleInfo                   // 设置 INFO 请求处理函数（按键转发）
 
-				profile := account.NewProfile(caller, displayName, nil, 0, stack)
+	// 设置注册状态处理函数
+	ua.RegisterStateHandler = func(state account.RegisterState) {
+		logger.Infof("RegisterStateHandler: state => %v", state)
+	}
 
-				recipient, err := parser.ParseSipUri("sip:" + called.User().String() + "@" + instance.Source + ";transport=" + instance.Transport)
-				if err != nil {
-					logger.Error(err)
-				}
+	stack.OnRequest(sip.REGISTER, b.handleRegister)   // 设置 REGISTER 请求处理函数
+	stack.OnRequest(sip.SUBSCRIBE, b.handleSubscribe) // 设置 SUBSCRIBE 请求处理函数（reg 事件）
+	b.initRegistryBackend(config.RegistrySnapshot)    // 从快照恢复注册信息
+	if config.AccountsFile != "" {                    // 从账户文件加载账户
+		if err := b.loadAccounts(config.AccountsFile); err != nil {
+			logger.Panic(err)
+		}
+	}
+	b.stack = stack
+	b.mediaRelay = b.newMediaRelay(config.MediaRelay)
+	if config.MusicOnHold.File != "" && b.mediaRelay != nil {
+		if b.holdMusic, err = media.LoadWAV(config.MusicOnHold.File); err != nil {
+			logger.Panic(err)
+		}
+	}
+	if b.queues, err = newCallQueues(config.Queues, b.stack.GetNetworkInfo("udp").Host); err != nil {
+		logger.Panic(err)
+	}
+	if len(b.queues.queues) > 0 {
+		go b.runQueues()
+	}
+	b.regEvents.subs = make(map[string]*regSubscription)
+	go b.runRegEvents()
+	if b.huntGroups, err = newHuntGroups(config.HuntGroups); err != nil {
+		logger.Panic(err)
+	}
+	if config.ScaleOut.Node != "" {
+		if b.scaleOut, err = newScaleOut(config.ScaleOut); err != nil {
+			logger.Panic(err)
+		}
+		go b.runScaleOut()
+	}
+	if config.Cluster.Role != "" {
+		if b.cluster, err = newCluster(config.Cluster); err != nil {
+			logger.Panic(err)
+		}
+		go b.runCluster()
+	}
+	if len(config.Dispatcher.Targets) > 0 {
+		if b.dispatcher, err = newDispatcher(config.Dispatcher); err != nil {
+			logger.Panic(err)
+		}
+		if b.dispatcher.config.ProbeInterval > 0 {
+			go b.monitorDispatcher()
+		}
+	}
+	if b.mediaRelay != nil {
+		if b.survey, err = newSurvey(config.Survey); err != nil {
+			logger.Panic(err)
+		}
+	}
+	if config.FeatureCodes.ConfirmTone != "" && b.mediaRelay != nil {
+		if b.featureTone, err = media.LoadWAV(config.FeatureCodes.ConfirmTone); err != nil {
+			logger.Panic(err)
+		}
+	}
+	b.ua = ua
+	if err := b.startHEP(config.HEP); err != nil { // 抓包
+		logger.Panic(err)
+	}
 
-				offer := sess.RemoteSdp()
-				dest, err := ua.Invite(profile, called, recipient, &offer)
-				if err != nil {
-					logger.Errorf("B-Leg session error: %v", err)
-					return
-				}
-				b.calls = append(b.calls, &B2BCall{src: sess, dest: dest})
-			}
+	if err := b.startSIPTrace(config.Log); err != nil { // SIP 消息跟踪
+		logger.Panic(err)
+	}
+	b.stack.OnMessage(b.traceMessage) // 按对端跟踪
 
-			if contacts, found := b.registry.GetContacts(called); found { // 查找被叫方的注册信息
-				sess.Provisional(100, "Trying")
-				for _, instance := range *contacts {
-					doInvite(instance)
-				}
-				return
-			}
+	if b.registerRelay != nil && config.Survivability.ProbeInterval > 0 { // 探测上游可用性
+		go b.monitorUpstream(time.Duration(config.Survivability.ProbeInterval) * time.Second)
+	}
+	return b
+}
 
-			sess.Reject(404, fmt.Sprintf("%v Not found", called)) // 如果未找到被叫方，返回 404
+// handleInviteState 处理 INVITE 会话的状态变化：新呼叫的路由、临时响应与应答的转发以及各路的结束
+func (b *B2BUA) handleInviteState(sess *session.Session, req *sip.Request, resp *sip.Response, state session.Status) {
+	callLog := logger
+	if call := b.findCall(sess); call != nil {
+		callLog = call.Log()
+	}
+	callLog.Infof("InviteStateHandler: state => %v, type => %s", state, sess.Direction())
 
-		case session.ReInviteReceived: // 收到 re-INVITE 请求
-			logger.Infof("re-INVITE")
-			switch sess.Direction() {
-			case session.Incoming:
-				sess.Accept(200)
-			case session.Outgoing:
-				// TODO: 提供适当的响应
-			}
+	switch state {
+	case session.InviteReceived: // 收到 INVITE 请求
+		if b.rejectsRel100(sess, *req) { // 未启用 100rel
+			return
+		}
+		if b.replaceDialog(sess, *req) { // 带 Replaces 的 INVITE 取代已建立呼叫中的一路
+			return
+		}
+		bandwidth := media.EstimateBandwidth(session.SdpBody(*req))
+		if o := b.capacity.AdmitCall(bandwidth); o != nil { // 排空模式或呼叫数、媒体带宽已达上限
+			b.rejectOverload(sess, o)
+			return
+		}
 
-		case session.EarlyMedia, session.Provisional: // 早期媒体或临时响应
-			call := b.findCall(sess)
-			if call != nil && call.dest == sess {
-				answer := call.dest.RemoteSdp()
-				call.src.ProvideAnswer(answer)
-				call.src.Provisional((*resp).StatusCode(), (*resp).Reason())
-			}
+		to, _ := (*req).To()
+		from, _ := (*req).From()
+		caller := from.Address
+		called := to.Address
 
-		case session.Confirmed: // 会话确认
-			call := b.findCall(sess)
-			if call != nil && call.dest == sess {
-				answer := call.dest.RemoteSdp()
+		call := &B2BCall{ // 各分支共享的呼叫信息
+			ID:        uuid.New().String(),
+			Caller:    caller.String(),
+			Callee:    called.String(),
+			Start:     time.Now(),
+			Context:   newCallContext(),
+			users:     []string{userOf(caller), userOf(called)},
+			src:       sess,
+			media:     b.newCallMedia(*req),
+			bandwidth: bandwidth,
+			hops:      b.requestHops(*req),
+		}
+		call.ctx, call.cancel = context.WithCancel(b.ctx)
+		if call.profile = b.requestProfile(*req); call.profile != nil {
+			call.Context.Set("profile", call.profile.Name)
+		}
+		call.Log().Infof("New call from %v, source %s", caller, (*req).Source())
+		b.manipulateRequest(*req)
+		b.assertIdentity(call, *req)
+		if b.handleFeatureCode(call, sess, *req) { // 本地账户拨打功能码
+			return
+		}
+		// 回拨功能码改变了被叫
+		called = calledURI(call)
+		if ok, reason := b.checkNumbers(*req); !ok { // 号码黑白名单
+			call.Log().Warnf("Call blocked: %s", reason)
+			b.metrics.Inc(MetricNumberBlocked)
+			b.emitFor(call.users, EventNumberBlocked, map[string]interface{}{
+				"call_id": call.ID,
+				"caller":  call.Caller,
+				"callee":  call.Callee,
+				"reason":  reason,
+			})
+			sess.Reject(603, "Decline")
+			b.finishCall(call, session.Failure)
+			return
+		}
+		if b.rejectsAnonymous(*req) { // 被叫开启了匿名呼叫拒绝
+			call.Log().Infof("Anonymous call rejected by %s", called.User())
+			b.metrics.Inc(MetricAnonymous)
+			sess.Reject(433, "Anonymity Disallowed")
+			b.finishCall(call, session.Failure)
+			return
+		}
+		if b.exceedsHops(call, nil) { // 实例之间的路由环路或转接次数过多
+			sess.Reject(483, "Too Many Hops", b.warning(399, "transit hop limit"))
+			b.finishCall(call, session.Failure)
+			return
+		}
+		if !b.anchorMedia(call) { // 媒体端口耗尽
+			b.rejectOverload(sess, b.capacity.Exhausted(capacityMediaPorts, "media capacity exhausted"))
+			b.finishCall(call, session.Failure)
+			return
+		}
+		b.watchDTMF(call)
+		b.watchFax(call)
+		b.watchVideoLoss(call)
+		b.runCallHooks(call, *req)
+		b.emitFor(call.users, EventCallStarted, map[string]interface{}{
+			"call_id": call.ID,
+			"caller":  call.Caller,
+			"callee":  call.Callee,
+			"context": call.Context.All(),
+		})
+
+		if b.joinConference(call, sess, called) { // 会议号码
+			return
+		}
+		if b.enterQueue(call, sess, called) { // 队列号码
+			return
+		}
+		if b.startHunt(call, called) { // 振铃组号码
+			return
+		}
+		if b.startPage(call, sess, called) { // 寻呼组号码
+			return
+		}
+		b.recordCaller(called, *req)
+		if forwarded := b.forwardUnconditional(call, called); forwarded != nil { // 被叫设置了无条件前转
+			called = forwarded
+		}
+		if called = b.doNotDisturb(call, called); called == nil { // 被叫开启了免打扰且未设置遇忙前转
+			return
+		}
+		b.routeCall(call, called)
+
+	case session.ReInviteReceived: // 收到 re-INVITE 请求，转发到另一路
+		callLog.Infof("re-INVITE")
+		b.handleReInvite(sess, *req)
+
+	case session.UpdateReceived: // 收到 UPDATE 请求，转发到另一路
+		callLog.Infof("UPDATE")
+		b.handleUpdate(sess, *req)
+
+	case session.EarlyMedia, session.Provisional: // 早期媒体或临时响应
+		call := b.findCall(sess)
+		if call != nil && call.dest == sess && (*resp).StatusCode() > 100 {
+			call.Context.transition(CallRinging)
+		}
+		if state == session.Provisional && len((*resp).Body()) > 0 { // 带 SDP 的临时响应随后以早期媒体再次通知，只转发一次
+			return
+		}
+		if call != nil && call.dest == sess && call.answer == "" && !call.Context.isPickedUp() { // 排队或被代答的 A 路已应答
+			b.forwardProvisional(call, *resp)
+		}
+
+	case session.Confirmed: // 会话确认
+		if b.originAnswered(sess) { // 第三方呼叫的 A 方应答
+			return
+		}
+		call := b.findCall(sess)
+		if call != nil && call.dest == sess && sess.Direction() == session.Incoming { // 以 Replaces 取代 B 路的会话，取代时已接通
+			return
+		}
+		if call != nil && call.dest == sess && b.pageAnswered(call) { // 寻呼组成员自动应答
+			return
+		}
+		if call != nil && call.dest == sess && call.Context.isPickedUp() { // 被代答的呼叫在代答时已接通
+			if sess.Direction() == session.Outgoing { // 被代答后才应答的分支
+				sess.End()
+			}
+			return
+		}
+		if call != nil && call.dest == sess {
+			b.callAnswered(call)
+			b.huntAnswered(call)
+			b.recordTrunkResult(call, 200)
+			answer := b.relayAnswer(call)
+			if !b.agentAnswered(call) { // 排队的 A 路已在本地应答
 				call.src.ProvideAnswer(answer)
 				call.src.Accept(200)
 			}
+			b.startRecording(call)
+			b.watchMediaTimeout(call)
+			b.watchMediaRelease(call)
+			b.refreshVideo(call, "answer")
+		}
 
-		case session.Failure, session.Canceled, session.Terminated: // 会话失败、取消或终止
-			call := b.findCall(sess)
-			if call != nil {
-				if call.src == sess {
+	case session.Failure, session.Canceled, session.Terminated: // 会话失败、取消或终止
+		if b.leaveConference(sess, state) { // 与会者挂机
+			return
+		}
+		if b.queueLegEnded(sess, state) { // 排队的主叫挂机或坐席未应答
+			return
+		}
+		if b.huntLegEnded(sess, state) { // 振铃组成员未应答
+			return
+		}
+		if b.pageLegEnded(sess, state) { // 寻呼的主叫或成员挂机
+			return
+		}
+		if b.originEnded(sess, resp, state) { // 第三方呼叫的 A 方未应答或挂机
+			return
+		}
+		call := b.findCall(sess)
+		if call != nil && call.dest == sess && state == session.Failure {
+			b.recordTrunkResult(call, finalCode(resp))
+		}
+		if call != nil && call.dest == sess && state == session.Failure && b.failover(call, resp) { // 切换到备用地址
+			b.removeCall(sess, state)
+			return
+		}
+		if call != nil && call.dest == sess && state == session.Failure && b.nextFork(call, resp) { // 呼叫 q 值较低的联系地址
+			b.removeCall(sess, state)
+			return
+		}
+		if call != nil && call.dest == sess && state == session.Failure && b.forwardOnFailure(call, resp) { // 遇忙或无应答前转
+			b.removeCall(sess, state)
+			return
+		}
+		if call != nil {
+			b.recordCause(call, sess, resp, state)
+			if call.src == sess {
+				if call.dest != nil && !call.dest.IsEnded() { // 通话后调查时 B 路已先结束；第三方呼叫在呼叫 B 方之前没有 B 路
 					call.dest.End()
-				} else if call.dest == sess {
-					call.src.End()
 				}
+			} else if call.dest == sess && state == session.Terminated && !b.hasOtherLegs(call) && b.startSurvey(call) { // 主叫一路保留到调查结束后再移除，转接时不调查
+				return
+			} else if call.dest == sess && b.transcodingRejected(call, resp) { // 没有共同编解码且转码容量已满
+				b.rejectOverload(call.src, b.capacity.Exhausted(capacityTranscoding, "transcoding capacity exhausted"))
+			} else if call.dest == sess && !b.hasOtherLegs(call) && !call.src.IsEnded() { // 其它分支仍在振铃时保留 A 路
+				call.src.End()
 			}
-			b.removeCall(sess)
 		}
+		b.removeCall(sess, state)
 	}
-
-	// 设置注册状态处理函数
-	ua.RegisterStateHandler = func(state account.RegisterState) {
-		logger.Infof("RegisterStateHandler: state => %v", state)
-	}
-
-	stack.OnRequest(sip.REGISTER, b.handleRegister) // 设置 REGISTER 请求处理函数
-	b.stack = stack
-	b.ua = ua
-	return b
 }
 
 // Calls 返回当前的通话列表
 func (b *B2BUA) Calls() []*B2BCall {
-	return b.calls
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	calls := make([]*B2BCall, len(b.calls))
+	copy(calls, b.calls)
+	return calls
+}
+
+// addCall 添加一个通话
+func (b *B2BUA) addCall(call *B2BCall) {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	b.calls = append(b.calls, call)
 }
 
 // findCall 根据会话查找通话
 func (b *B2BUA) findCall(sess *session.Session) *B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
 	for _, call := range b.calls {
 		if call.src == sess || call.dest == sess {
 			return call
@@ -202,26 +648,97 @@ func (b *B2BUA) findCall(sess *session.Session) *B2BCall {
 	return nil
 }
 
-// removeCall 根据会话移除通话
-func (b *B2BUA) removeCall(sess *session.Session) {
+// removeCall 根据会话移除通话，呼叫的最后一个分支移除后输出话单
+func (b *B2BUA) removeCall(sess *session.Session, state session.Status) {
+	b.callsMu.Lock()
+	var removed *B2BCall
 	for idx, call := range b.calls {
 		if call.src == sess || call.dest == sess {
+			removed = call
 			b.calls = append(b.calls[:idx], b.calls[idx+1:]...)
-			return
+			break
 		}
 	}
+	last := removed != nil
+	if removed != nil {
+		for _, call := range b.calls {
+			if call.ID == removed.ID {
+				last = false
+				break
+			}
+		}
+	}
+	b.callsMu.Unlock()
+
+	if last {
+		b.finishCall(removed, state)
+	}
 }
 
-// Shutdown 关闭 B2BUA
-func (b *B2BUA) Shutdown() {
-	b.ua.Shutdown()
+// findCallByID 根据呼叫 ID 查找通话
+func (b *B2BUA) findCallByID(id string) *B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		if call.ID == id {
+			return call
+		}
+	}
+	return nil
+}
+
+// ErrCallNotFound 呼叫不存在或已结束
+var ErrCallNotFound = errors.New("call not found")
+
+// CancelCall 由管理员取消一个呼叫：取消呼叫的上下文以中止未完成的 B 路呼叫（已收到临时响应的发送 CANCEL），
+// 未应答的 A 路返回 487，已建立的分支发送 BYE
+func (b *B2BUA) CancelCall(id string) error {
+	legs := b.callLegs(id)
+	if len(legs) == 0 {
+		return ErrCallNotFound
+	}
+
+	call := legs[0]
+	call.Log().Infof("Call canceled by administrator")
+	call.Context.release(CauseAdmin, 0)
+	call.cancel()
+	switch {
+	case call.src.IsInProgress() && call.src.Direction() == session.Incoming:
+		call.src.Reject(487, "Request Terminated")
+	case !call.src.IsEnded(): // 已建立的 A 路，或第三方呼叫中正在振铃的 A 路（发送 CANCEL）
+		call.src.End()
+	}
+	for _, leg := range legs {
+		if leg.dest != nil && leg.dest.Status() == session.Confirmed {
+			leg.dest.End()
+		}
+	}
+	return nil
 }
 
 // requiresChallenge 检查请求是否需要挑战
 func (b *B2BUA) requiresChallenge(req sip.Request) bool {
 	switch req.Method() {
-	case sip.REGISTER, sip.INVITE: // REGISTER 和 INVITE 请求需要挑战
-		return true
+	case sip.REGISTER: // REGISTER 请求需要挑战
+		if b.mutuallyAuthenticated(req) { // 双向 TLS 已认证的对端
+			return false
+		}
+		if b.registerRelay != nil { // 转发的 REGISTER 由上游注册服务器认证
+			if to, ok := req.To(); ok && b.registerRelay.Matches(to.Address) {
+				return false
+			}
+		}
+		return b.requestConfig(req).Auth.Value != AuthNone
+	case sip.INVITE: // INVITE 请求需要挑战，双向 TLS 已认证的对端、其它节点转发的呼叫及对话内的 re-INVITE 除外
+		if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+			return false
+		}
+		return !b.mutuallyAuthenticated(req) && b.fromNode(req) == "" && b.requestConfig(req).Auth.Value == AuthChallenge
+	case sip.SUBSCRIBE: // 初始 SUBSCRIBE 与 REGISTER 一样需要挑战，对话内的刷新除外
+		if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+			return false
+		}
+		return !b.mutuallyAuthenticated(req) && b.requestConfig(req).Auth.Value != AuthNone
 	case sip.CANCEL, sip.OPTIONS, sip.INFO, sip.BYE: // 其他请求不需要挑战
 		return false
 	}
@@ -230,12 +747,39 @@ func (b *B2BUA) requiresChallenge(req sip.Request) bool {
 
 // AddAccount 添加一个 SIP 账户
 func (b *B2BUA) AddAccount(username, password string) {
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
 	b.accounts[username] = password
 }
 
-// GetAccounts 返回所有 SIP 账户
+// SetDisplayName 设置账户的显示名称，内部呼叫的 B 路 INVITE 使用该名称作为主叫显示名称；name 为空时删除。
+// 不保存到账户文件，运行时修改使用 ChangeDisplayName
+func (b *B2BUA) SetDisplayName(username, name string) {
+	b.accountsMu.Lock()
+	defer b.accountsMu.Unlock()
+	if name == "" {
+		delete(b.names, username)
+		return
+	}
+	b.names[username] = name
+}
+
+// DisplayName 返回账户的显示名称，未设置时返回空
+func (b *B2BUA) DisplayName(username string) string {
+	b.accountsMu.RLock()
+	defer b.accountsMu.RUnlock()
+	return b.names[username]
+}
+
+// GetAccounts 返回所有 SIP 账户的副本
 func (b *B2BUA) GetAccounts() map[string]string {
-	return b.accounts
+	b.accountsMu.RLock()
+	defer b.accountsMu.RUnlock()
+	accounts := make(map[string]string, len(b.accounts))
+	for username, password := range b.accounts {
+		accounts[username] = password
+	}
+	return accounts
 }
 
 // GetRegistry 返回注册管理
@@ -245,7 +789,10 @@ func (b *B2BUA) GetRegistry() registry2.Registry {
 
 // requestCredential 根据用户名获取凭证
 func (b *B2BUA) requestCredential(username string) (string, string, error) {
-	if password, found := b.accounts[username]; found {
+	b.accountsMu.RLock()
+	password, found := b.accounts[username]
+	b.accountsMu.RUnlock()
+	if found {
 		logger.Infof("Found user %s", username)
 		return password, "", nil
 	}
@@ -254,37 +801,233 @@ func (b *B2BUA) requestCredential(username string) (string, string, error) {
 
 // handleRegister 处理 REGISTER 请求
 func (b *B2BUA) handleRegister(request sip.Request, tx sip.ServerTransaction) {
-	headers := request.GetHeaders("Expires")
-	to, _ := request.To()
+	to, ok := request.To()
+	if !ok || to == nil || to.Address == nil {
+		logger.Warnf("Malformed REGISTER from %s: missing To", request.Source())
+		tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 400, "Bad Request", ""))
+		return
+	}
 	aor := to.Address.Clone()
-	var expires sip.Expires = 0
-	if len(headers) > 0 {
-		expires = *headers[0].(*sip.Expires)
+
+	if registering(request) {
+		if !b.isRegistered(aor, request.Source()) { // 排空模式或注册数已达上限时拒绝新注册
+			if o := b.capacity.AdmitRegister(); o != nil {
+				b.rejectOverloadRequest(request, tx, o)
+				return
+			}
+		}
 	}
 
-	reason := ""
-	if len(headers) > 0 && expires != sip.Expires(0) {
-		instance := registry2.NewContactInstanceForRequest(request)
-		logger.Infof("Registered [%v] expires [%d] source %s", to, expires, request.Source())
-		reason = "Registered"
-		b.registry.AddAor(aor, instance)
-	} else {
-		logger.Infof("Logged out [%v] expires [%d] ", to, expires)
-		reason = "UnRegistered"
-		instance := registry2.NewContactInstanceForRequest(request)
-		b.registry.RemoveContact(aor, instance)
+	if b.registerRelay != nil && b.registerRelay.Matches(aor) { // 转发到上游注册服务器
+		b.relayRegister(b.ctx, request, tx, aor)
+		return
+	}
+	b.registerLocally(request, tx, aor)
+}
+
+// registerLocally 在本地处理 REGISTER 请求（RFC 3261 10.3），200 OK 携带 AOR 当前的所有联系地址及其剩余有效期。
+// 部分 ATA 固件发送的保活 REGISTER 不带 Contact，按查询处理
+func (b *B2BUA) registerLocally(request sip.Request, tx sip.ServerTransaction, aor sip.Uri) {
+	if b.config.RegisterExpiry.tooBrief(request) {
+		b.rejectBrief(request, tx)
+		return
+	}
+	if registering(request) && !b.checkFingerprint(request, tx) {
+		return
+	}
+	grant := func(instance *registry2.ContactInstance) sip.Expires { // 按有效期策略调整
+		return b.config.RegisterExpiry.grantExpires(sip.Expires(instance.RegExpires))
+	}
+	reason, expires, err := b.updateRegistry(request, aor, grant)
+	if err != nil {
+		logger.Warnf("Rejecting REGISTER for %v: %v", aor, err)
+		tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 400, "Bad Request", ""))
+		return
 	}
 
 	resp := sip.NewResponseFromRequest(request.MessageID(), request, 200, reason, "")
-	sip.CopyHeaders("Expires", request, resp)
-	utils.BuildContactHeader("Contact", request, resp, &expires)
+	if len(request.GetHeaders("Expires")) > 0 {
+		resp.AppendHeader(&expires)
+	}
+	b.appendBindings(resp, aor)
 	tx.Respond(resp)
 }
 
+// updateRegistry 根据 REGISTER 请求更新本地注册表：Contact: * 注销 AOR 的所有联系地址，否则按每个联系地址的有效期
+// 添加、刷新或注销，没有 Contact 时不修改（查询）。grant 返回联系地址实际授予的有效期，为 0 时注销，为 nil 时按请求的值授予。
+// 返回响应的原因短语和授予第一个联系地址的有效期。Contact: * 不符合 RFC 3261 10.3 的要求时返回错误，注册表不变
+func (b *B2BUA) updateRegistry(request sip.Request, aor sip.Uri, grant func(*registry2.ContactInstance) sip.Expires) (string, sip.Expires, error) {
+	to, _ := request.To()
+	aor = b.registryAOR(aor)
+
+	if registry2.IsWildcard(request) {
+		expires, ok := registry2.RequestExpires(request)
+		if !ok || expires != 0 || len(request.GetHeaders("Contact")) != 1 {
+			return "", 0, fmt.Errorf("Contact: * requires Expires: 0 and no other Contact")
+		}
+		logger.Infof("Logged out all contacts of [%v] source %s", to, request.Source())
+		if contacts, found := b.registry.GetContacts(aor); found {
+			for _, instance := range *contacts {
+				b.emitRegistration(EventUnregistered, aor, instance)
+			}
+		}
+		b.registry.RemoveAor(aor)
+		b.persistRegistry()
+		b.regChanged(aor)
+		return "UnRegistered", 0, nil
+	}
+
+	instances := registry2.NewContactInstancesForRequest(request)
+	if len(instances) == 0 {
+		return "OK", 0, nil
+	}
+	reason, granted := "UnRegistered", sip.Expires(0)
+	for i, instance := range instances {
+		if instance.RegExpires > 0 && grant != nil {
+			instance.RegExpires = uint32(grant(instance))
+		}
+		if instance.RegExpires == 0 {
+			logger.Infof("Logged out [%v] contact %v source %s", to, instance.Contact.Address, request.Source())
+			if b.registry.RemoveContact(aor, instance) == nil {
+				b.emitRegistration(EventUnregistered, aor, instance)
+			}
+			continue
+		}
+		if i == 0 {
+			granted = sip.Expires(instance.RegExpires)
+		}
+		logger.Infof("Registered [%v] contact %v expires [%d] source %s", to, instance.Contact.Address, instance.RegExpires, request.Source())
+		reason = "Registered"
+		contacts, _ := b.registry.GetContacts(aor)
+		if contacts == nil || (*contacts)[instance.Binding()] == nil { // 刷新已有的联系地址不产生事件
+			b.emitRegistration(EventRegistered, aor, instance)
+		}
+		b.registry.AddAor(aor, instance)
+	}
+	b.persistRegistry()
+	b.regChanged(aor)
+	return reason, granted, nil
+}
+
+// emitRegistration 产生联系地址注册或注销的事件
+func (b *B2BUA) emitRegistration(eventType EventType, aor sip.Uri, instance *registry2.ContactInstance) {
+	data := map[string]interface{}{
+		"aor":        aor.String(),
+		"source":     instance.Source,
+		"transport":  instance.Transport,
+		"user_agent": instance.UserAgent,
+	}
+	if instance.Contact != nil && instance.Contact.Address != nil {
+		data["contact"] = instance.Contact.Address.String()
+	}
+	if eventType == EventRegistered {
+		data["expires"] = instance.RegExpires
+	}
+	b.emitFor([]string{userOf(aor)}, eventType, data)
+}
+
+// appendBindings 在 REGISTER 的响应中列出 AOR 当前的所有联系地址，expires 参数为剩余有效期
+func (b *B2BUA) appendBindings(resp sip.Response, aor sip.Uri) {
+	contacts, found := b.registry.GetContacts(b.registryAOR(aor))
+	if !found {
+		return
+	}
+	now := time.Now().Unix()
+	for _, instance := range *contacts {
+		if instance.Contact == nil {
+			continue
+		}
+		remaining := int64(instance.LastUpdated) + int64(instance.RegExpires) - now
+		if remaining <= 0 {
+			continue
+		}
+		expires := sip.Expires(remaining)
+		contact := instance.Contact.Clone().(*sip.ContactHeader)
+		if contact.Params == nil {
+			contact.Params = sip.NewParams()
+		}
+		utils.AddParamsToContact(contact, &expires)
+		resp.AppendHeader(contact)
+	}
+}
+
+// registering 检查 REGISTER 请求是否注册（或刷新）了至少一个联系地址，注销和查询返回 false
+func registering(request sip.Request) bool {
+	for _, instance := range registry2.NewContactInstancesForRequest(request) {
+		if instance.RegExpires > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isRegistered 检查 AOR 是否已有来自 source 的注册
+func (b *B2BUA) isRegistered(aor sip.Uri, source string) bool {
+	if contacts, found := b.registry.GetContacts(b.registryAOR(aor)); found {
+		for _, instance := range *contacts {
+			if instance.Source == source {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFingerprint 检查注册请求的设备指纹，返回 false 表示请求已被拒绝或要求重新认证
+func (b *B2BUA) checkFingerprint(request sip.Request, tx sip.ServerTransaction) bool {
+	policy := b.config.Fingerprint.Policy
+	if policy == FingerprintOff {
+		return true
+	}
+
+	to, _ := request.To()
+	user := to.Address.User().String()
+	userAgent := ""
+	if hdrs := request.GetHeaders("User-Agent"); len(hdrs) > 0 {
+		userAgent = hdrs[0].Value()
+	}
+
+	fp := b.fingerprints.fingerprintOf(userAgent, request.Source())
+	anomalies, reauthed := b.fingerprints.Check(user, fp)
+	if reauthed {
+		logger.Infof("User %s re-authenticated from %s (%s)", user, request.Source(), userAgent)
+		return true
+	}
+	if len(anomalies) == 0 {
+		return true
+	}
+
+	b.emitFor([]string{userOf(to.Address)}, EventRegistrationAnomaly, map[string]interface{}{
+		"user":       user,
+		"source":     request.Source(),
+		"user_agent": userAgent,
+		"anomalies":  anomalies,
+		"policy":     string(policy),
+	})
+
+	switch policy {
+	case FingerprintBlock:
+		tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 403, "Forbidden", ""))
+		return false
+	case FingerprintReauth:
+		if b.authenticator != nil {
+			b.fingerprints.RequireReauth(user, fp)
+			b.authenticator.Challenge(request, tx)
+			return false
+		}
+	}
+
+	b.fingerprints.Accept(user, fp)
+	return true
+}
+
 // handleConnectionError 处理连接错误
 func (b *B2BUA) handleConnectionError(connError *transport.ConnectionError) {
 	logger.Debugf("Handle Connection Lost: Source: %v, Dest: %v, Network: %v", connError.Source, connError.Dest, connError.Net)
-	b.registry.HandleConnectionError(connError)
+	if b.registry.HandleConnectionError(connError) {
+		b.persistRegistry()
+		b.notifyRegSubscribers() // 移除的联系地址所属的 AOR 未知，由各订阅比较变化
+	}
 }
 
 // SetLogLevel 设置日志级别
@@ -0,0 +1,30 @@
+package b2bua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+func init() {
+	logger = log.NewDefaultLogrusLogger()
+}
+
+// parseRequest parses a raw SIP request; lines are joined with CRLF.
+func parseRequest(t *testing.T, source, transport string, lines ...string) sip.Request {
+	t.Helper()
+	msg, err := parser.ParseMessage([]byte(strings.Join(lines, "\r\n")+"\r\n\r\n"), logger)
+	if err != nil {
+		t.Fatalf("parse request: %v", err)
+	}
+	request, ok := msg.(sip.Request)
+	if !ok {
+		t.Fatalf("parsed %T; want sip.Request", msg)
+	}
+	request.SetSource(source)
+	request.SetTransport(transport)
+	return request
+}
@@ -0,0 +1,37 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 呼叫分类，在路由时按来源（本地分机或中继）和去向（本地注册终端或中继、上游）确定
+const (
+	CallInternal = "internal" // 分机之间的内部呼叫
+	CallInbound  = "inbound"  // 来自中继，呼叫本地分机
+	CallOutbound = "outbound" // 本地分机经中继或上游出局
+	CallTransit  = "transit"  // 来自中继，又经中继或上游出局
+)
+
+// CallClassConfig 按呼叫分类的策略
+type CallClassConfig struct {
+	HeaderProfile string `json:"header_profile"` // 该类呼叫 B 路 INVITE 使用的头域配置，优先于租户和监听，出局中继的设置优先于它
+	Record        bool   `json:"record"`         // 录制该类呼叫
+	MediaMode     string `json:"media_mode"`     // 经媒体中继锚定的该类呼叫应答后的媒体处理：relay（保持锚定）或 release（确认连通后释放为端到端，如分机之间的内部呼叫），为空时按请求生效的媒体模式
+}
+
+// classifyCall 确定呼叫分类并计数，local 表示被叫为本地注册的终端
+func (b *B2BUA) classifyCall(call *B2BCall, req sip.Request, local bool) {
+	fromTrunk := b.trunkForRequest(req) != nil
+	switch {
+	case fromTrunk && local:
+		call.Class = CallInbound
+	case fromTrunk:
+		call.Class = CallTransit
+	case local:
+		call.Class = CallInternal
+	default:
+		call.Class = CallOutbound
+	}
+	b.metrics.Inc(MetricCallClass + call.Class)
+	call.Log().Infof("Call class: %s", call.Class)
+}
@@ -0,0 +1,235 @@
+package b2bua
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// CallContext 通话上下文键值存储（例如账户 ID、活动 ID、队列名），
+// 同一呼叫的所有分支共享，在 CDR 的自定义字段和事件中输出
+type CallContext struct {
+	mutex        sync.RWMutex
+	values       map[string]string
+	answered     time.Time        // 任一分支应答的时间
+	finished     bool             // 已输出话单
+	mediaTimeout bool             // 因媒体超时而结束
+	pickedUp     bool             // 振铃时被其它账户代答
+	tags         []CallTag        // 通话中添加的标签（如通话后调查的回答），随话单输出
+	state        CallState        // 呼叫状态
+	cause        ReleaseCause     // 释放原因，以最先结束呼叫的一方为准
+	causeCode    int              // B 路失败时的最终响应状态码
+	earlyMedia   *session.Session // 早期媒体已转发给主叫的分支（first 策略）
+}
+
+func newCallContext() *CallContext {
+	return &CallContext{values: make(map[string]string), state: CallTrying}
+}
+
+// Get 读取一个键
+func (c *CallContext) Get(key string) (string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	value, found := c.values[key]
+	return value, found
+}
+
+// Set 写入一个键
+func (c *CallContext) Set(key, value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] = value
+}
+
+// Delete 删除一个键
+func (c *CallContext) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.values, key)
+}
+
+// All 返回所有键值的副本
+func (c *CallContext) All() map[string]string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	values := make(map[string]string, len(c.values))
+	for key, value := range c.values {
+		values[key] = value
+	}
+	return values
+}
+
+// markAnswered 记录首次应答时间，已应答过时返回 false
+func (c *CallContext) markAnswered(at time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.answered.IsZero() {
+		return false
+	}
+	c.answered = at
+	if c.state == CallTrying || c.state == CallRinging {
+		c.state = CallAnswered
+	}
+	return true
+}
+
+// markFinished 标记呼叫已结束，已标记过时返回 false
+func (c *CallContext) markFinished() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.finished {
+		return false
+	}
+	c.finished = true
+	return true
+}
+
+// isFinished 检查呼叫是否已结束
+func (c *CallContext) isFinished() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.finished
+}
+
+// markPickedUp 标记呼叫被代答，已应答或已被代答时返回 false
+func (c *CallContext) markPickedUp() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pickedUp || !c.answered.IsZero() {
+		return false
+	}
+	c.pickedUp = true
+	return true
+}
+
+// unmarkPickedUp 代答失败时取消标记
+func (c *CallContext) unmarkPickedUp() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pickedUp = false
+}
+
+// isPickedUp 检查呼叫是否已被代答
+func (c *CallContext) isPickedUp() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pickedUp
+}
+
+// markMediaTimeout 记录呼叫因媒体超时而结束
+func (c *CallContext) markMediaTimeout() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mediaTimeout = true
+	c.releaseLocked(CauseMediaTimeout, 0)
+}
+
+// transition 将呼叫转换到 to，不允许的转换（如应答后迟到的振铃）被忽略并返回 false
+func (c *CallContext) transition(to CallState) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, next := range callTransitions[c.state] {
+		if next == to {
+			c.state = to
+			return true
+		}
+	}
+	return false
+}
+
+// callState 返回呼叫状态
+func (c *CallContext) callState() CallState {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.state
+}
+
+// release 记录释放原因和 B 路的最终响应状态码，并转换到 terminating。已有原因时不覆盖
+// （随后挂断的另一路不是释放呼叫的一方）
+func (c *CallContext) release(cause ReleaseCause, code int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.releaseLocked(cause, code)
+}
+
+func (c *CallContext) releaseLocked(cause ReleaseCause, code int) {
+	if c.cause != "" {
+		return
+	}
+	c.cause, c.causeCode = cause, code
+	c.state = CallTerminating
+}
+
+// selectEarlyMedia 选择转发早期媒体的分支：尚未选择或选中的分支已结束时选择 leg，返回 leg 是否为选中的分支
+func (c *CallContext) selectEarlyMedia(leg *session.Session) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.earlyMedia == nil || c.earlyMedia.IsEnded() {
+		c.earlyMedia = leg
+	}
+	return c.earlyMedia == leg
+}
+
+// releaseCause 返回释放原因和 B 路的最终响应状态码，未记录时为空
+func (c *CallContext) releaseCause() (ReleaseCause, int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cause, c.causeCode
+}
+
+// timedOut 检查呼叫是否因媒体超时而结束
+func (c *CallContext) timedOut() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.mediaTimeout
+}
+
+// addTag 添加一个标签
+func (c *CallContext) addTag(tag CallTag) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tags = append(c.tags, tag)
+}
+
+// Tags 返回通话中添加的标签
+func (c *CallContext) Tags() []CallTag {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]CallTag(nil), c.tags...)
+}
+
+// answeredAt 返回应答时间，未应答时为零值
+func (c *CallContext) answeredAt() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.answered
+}
+
+// CallHook 在新呼叫路由之前调用，可读写通话上下文
+type CallHook func(call *B2BCall, req sip.Request)
+
+// callHooks 保存已注册的呼叫回调
+type callHooks struct {
+	mutex sync.RWMutex
+	hooks []CallHook
+}
+
+// OnCallStart 注册一个呼叫回调，在新呼叫路由到被叫之前同步调用
+func (b *B2BUA) OnCallStart(hook CallHook) {
+	b.callHooks.mutex.Lock()
+	defer b.callHooks.mutex.Unlock()
+	b.callHooks.hooks = append(b.callHooks.hooks, hook)
+}
+
+// runCallHooks 依次调用所有呼叫回调
+func (b *B2BUA) runCallHooks(call *B2BCall, req sip.Request) {
+	b.callHooks.mutex.RLock()
+	hooks := b.callHooks.hooks
+	b.callHooks.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(call, req)
+	}
+}
@@ -0,0 +1,113 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const defaultInternationalPrefix = "00" // 默认的国际冠字
+
+// CallerIDRule 主叫号码和名称改写规则，用于发往中继的 B 路 From（很多中继拒绝没有有效主叫号码的呼叫）。
+// 按配置顺序使用第一条匹配的规则，依次执行去掉前缀、添加前缀、E.164 规范化，设置 number 时直接使用固定号码
+type CallerIDRule struct {
+	Trunks              []string `json:"trunks"`               // 只用于经这些中继出局的呼叫，为空时不限（不用于本地注册的被叫）
+	Accounts            []string `json:"accounts"`             // 只用于这些主叫账户（user 或 user@domain），为空时不限
+	StripPrefix         string   `json:"strip_prefix"`         // 去掉主叫号码的前缀，如分机的出局字冠 9
+	AddPrefix           string   `json:"add_prefix"`           // 添加到主叫号码前的前缀
+	E164                bool     `json:"e164"`                 // 规范化为 E.164（+国家码号码）
+	CountryCode         string   `json:"country_code"`         // E.164 规范化时国内号码的国家码，如 86
+	NationalPrefix      string   `json:"national_prefix"`      // 国内长途字冠，如 0，E.164 规范化时去掉
+	InternationalPrefix string   `json:"international_prefix"` // 国际冠字，默认 00，E.164 规范化时替换为 +
+	Number              string   `json:"number"`               // 固定的主叫号码（如中继的引示号），优先于其它改写
+	Name                string   `json:"name"`                 // 固定的主叫名称，为空时保留原名称
+}
+
+// validateCallerIDRules 检查主叫号码改写规则
+func validateCallerIDRules(rules []CallerIDRule) error {
+	for i, rule := range rules {
+		if rule.E164 && !isDigits(rule.CountryCode) {
+			return fmt.Errorf("caller_id[%d]: e164 requires a numeric country_code", i)
+		}
+	}
+	return nil
+}
+
+// isDigits 检查字符串是否为非空的纯数字
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize 按规则改写主叫号码，非数字号码（如 alice）只在设置了固定号码时改写
+func (r *CallerIDRule) normalize(number string) string {
+	if r.Number != "" {
+		return r.Number
+	}
+	if strings.HasPrefix(number, "+") || !isDigits(number) { // 已是 E.164 或非数字号码
+		return number
+	}
+	return r.e164(r.AddPrefix + strings.TrimPrefix(number, r.StripPrefix))
+}
+
+// e164 将数字号码规范化为 E.164，没有国际冠字和国内长途字冠的号码视为国内号码
+func (r *CallerIDRule) e164(number string) string {
+	if !r.E164 || strings.HasPrefix(number, "+") {
+		return number
+	}
+	international := r.InternationalPrefix
+	if international == "" {
+		international = defaultInternationalPrefix
+	}
+	switch {
+	case strings.HasPrefix(number, international):
+		return "+" + strings.TrimPrefix(number, international)
+	case r.NationalPrefix != "" && strings.HasPrefix(number, r.NationalPrefix):
+		return "+" + r.CountryCode + strings.TrimPrefix(number, r.NationalPrefix)
+	}
+	return "+" + r.CountryCode + number
+}
+
+// callerIDRule 返回用于呼叫和目的地的第一条匹配的主叫号码改写规则
+func (b *B2BUA) callerIDRule(target routeTarget, from sip.Uri) *CallerIDRule {
+	for i := range b.config.CallerID {
+		rule := &b.config.CallerID[i]
+		if target.local && len(rule.Trunks) > 0 {
+			continue
+		}
+		if trunkMatches(rule.Trunks, target.trunk) && accountMatches(rule.Accounts, from) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// rewriteCallerID 按规则改写 B 路 From 的主叫号码和名称，改写后的号码记录在呼叫上下文的 caller_id 中
+func (b *B2BUA) rewriteCallerID(call *B2BCall, target routeTarget, uri sip.Uri, name string) (sip.Uri, string) {
+	rule := b.callerIDRule(target, uri)
+	if rule == nil {
+		return uri, name
+	}
+	if rule.Name != "" {
+		name = rule.Name
+	}
+	number := ""
+	if uri.User() != nil {
+		number = uri.User().String()
+	}
+	if rewritten := rule.normalize(number); rewritten != number {
+		uri = uri.Clone()
+		uri.SetUser(sip.String{Str: rewritten})
+		call.Log().Infof("Caller ID: %s => %s", number, rewritten)
+		call.Context.Set("caller_id", rewritten)
+	}
+	return uri, name
+}
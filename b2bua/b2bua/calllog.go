@@ -0,0 +1,30 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/log"
+	"go-sip-ua/pkg/session"
+)
+
+// Log 返回带有呼叫字段的日志记录器，同一呼叫两路的日志都带有相同的 call_uuid，便于检索
+func (b *B2BCall) Log() log.Logger {
+	fields := log.Fields{
+		"call_uuid": b.ID,
+		"caller":    b.Caller,
+		"callee":    b.Callee,
+	}
+	if callID := sessionCallID(b.src); callID != "" {
+		fields["call_id_a"] = callID
+	}
+	if callID := sessionCallID(b.dest); callID != "" {
+		fields["call_id_b"] = callID
+	}
+	return logger.WithFields(fields)
+}
+
+// sessionCallID 返回会话的 SIP Call-ID
+func sessionCallID(sess *session.Session) string {
+	if sess == nil || sess.CallID() == nil {
+		return ""
+	}
+	return sess.CallID().Value()
+}
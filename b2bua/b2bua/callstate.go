@@ -0,0 +1,76 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// CallState 呼叫的状态，同一呼叫的所有分支共享
+type CallState string
+
+// 呼叫状态
+const (
+	CallTrying      CallState = "trying"      // 收到 INVITE，正在路由或等待 B 路的响应
+	CallRinging     CallState = "ringing"     // B 路振铃或有早期媒体
+	CallAnswered    CallState = "answered"    // 已应答
+	CallHeld        CallState = "held"        // 一路保持了通话
+	CallTerminating CallState = "terminating" // 已确定释放原因，正在挂断其余各路
+)
+
+// callTransitions 允许的状态转换，不在表中的转换被忽略（如应答后迟到的 180）
+var callTransitions = map[CallState][]CallState{
+	CallTrying:   {CallRinging, CallAnswered, CallTerminating},
+	CallRinging:  {CallAnswered, CallTerminating},
+	CallAnswered: {CallHeld, CallTerminating},
+	CallHeld:     {CallAnswered, CallTerminating},
+}
+
+// ReleaseCause 呼叫的释放原因
+type ReleaseCause string
+
+// 释放原因
+const (
+	CauseCallerHangup   ReleaseCause = "caller_hangup"   // 主叫挂机
+	CauseCalleeHangup   ReleaseCause = "callee_hangup"   // 被叫挂机
+	CauseCallerCancel   ReleaseCause = "caller_cancel"   // 主叫在应答前取消
+	CauseCalleeBusy     ReleaseCause = "callee_busy"     // 被叫忙（486、600）
+	CauseCalleeRejected ReleaseCause = "callee_rejected" // B 路返回其它失败响应（如 404、603）
+	CauseTimeout        ReleaseCause = "timeout"         // 被叫无应答：振铃超时、B 路请求超时或 480
+	CauseMediaTimeout   ReleaseCause = "media_timeout"   // 媒体超时
+	CauseAdmin          ReleaseCause = "admin"           // 管理员挂断（命令行或 REST 接口）
+	CauseRejected       ReleaseCause = "rejected"        // 呼叫在本地被拒绝（未找到路由、黑名单、容量不足等）
+	CauseCanceled       ReleaseCause = "canceled"        // 呼叫在应答前被取消
+)
+
+// failureCause 返回 B 路失败响应对应的释放原因
+func failureCause(code sip.StatusCode) ReleaseCause {
+	switch code {
+	case 486, 600:
+		return CauseCalleeBusy
+	case 408, 480:
+		return CauseTimeout
+	}
+	return CauseCalleeRejected
+}
+
+// State 返回呼叫当前的状态
+func (b *B2BCall) State() CallState {
+	return b.Context.callState()
+}
+
+// recordCause 在一路结束时记录释放原因：A 路结束时为主叫挂机或取消，B 路结束且没有其它分支时为被叫挂机或
+// B 路的失败响应。转接、分叉时被挂断或取消的分支不是释放原因
+func (b *B2BUA) recordCause(call *B2BCall, sess *session.Session, resp *sip.Response, state session.Status) {
+	switch {
+	case call.src == sess && state == session.Canceled:
+		call.Context.release(CauseCallerCancel, 0)
+	case call.src == sess:
+		call.Context.release(CauseCallerHangup, 0)
+	case call.dest != sess || b.hasOtherLegs(call):
+	case state == session.Terminated:
+		call.Context.release(CauseCalleeHangup, 0)
+	case state == session.Failure:
+		code := finalCode(resp)
+		call.Context.release(failureCause(code), int(code))
+	}
+}
@@ -0,0 +1,134 @@
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const completedCallHistory = 1000 // 内存中默认保留的已结束呼叫话单数，可在这些呼叫上添加标签
+
+// ErrCallNotCompleted 呼叫不存在、仍在进行或已超出保留的已结束呼叫
+var ErrCallNotCompleted = errors.New("completed call not found")
+
+// CallTag 附加到已结束呼叫的标签或评分，如通话后满意度调查的结果或坐席的处置码
+type CallTag struct {
+	Label  string    `json:"label,omitempty"`  // 标签，如处置码 sale、callback
+	Rating int       `json:"rating,omitempty"` // 评分 1-5，0 表示未评分
+	Value  string    `json:"value,omitempty"`  // 标签的值，如调查问题的按键
+	Source string    `json:"source,omitempty"` // 来源，如 survey、agent
+	Time   time.Time `json:"time"`             // 添加时间
+}
+
+// callTagRecord 标签文件中的一条记录
+type callTagRecord struct {
+	CallID string  `json:"call_id"`
+	Tag    CallTag `json:"tag"`
+}
+
+// completedCall 已结束呼叫的话单及用于分发事件的用户
+type completedCall struct {
+	cdr   *CDR
+	users []string
+}
+
+// completedCalls 在环形缓冲区中按结束顺序保存最近的已结束呼叫，写满后覆盖最早的
+type completedCalls struct {
+	mutex sync.Mutex
+	size  int      // 保留的呼叫数，为 0 时使用 completedCallHistory
+	ring  []string // 呼叫 ID，第一次保存时分配
+	next  int      // 下一个写入位置
+	calls map[string]*completedCall
+}
+
+// add 保存一个已结束的呼叫，缓冲区已满时丢弃最早的
+func (c *completedCalls) add(call *B2BCall, cdr *CDR) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ring == nil {
+		if c.size <= 0 {
+			c.size = completedCallHistory
+		}
+		c.ring = make([]string, c.size)
+		c.calls = make(map[string]*completedCall)
+	}
+	if oldest := c.ring[c.next]; oldest != "" {
+		delete(c.calls, oldest)
+	}
+	saved := *cdr // 话单已随 call.ended 事件发出，标签加在副本上
+	c.calls[cdr.CallID] = &completedCall{cdr: &saved, users: call.users}
+	c.ring[c.next] = cdr.CallID
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// recent 返回最近结束的至多 limit 个呼叫的话单副本，最近结束的在前
+func (c *completedCalls) recent(limit int) []*CDR {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var cdrs []*CDR
+	for i := 1; i <= len(c.ring) && len(cdrs) < limit; i++ {
+		id := c.ring[(c.next-i+len(c.ring))%len(c.ring)]
+		if id == "" {
+			break
+		}
+		if call, found := c.calls[id]; found {
+			cdr := *call.cdr
+			cdr.Tags = append([]CallTag(nil), call.cdr.Tags...)
+			cdrs = append(cdrs, &cdr)
+		}
+	}
+	return cdrs
+}
+
+// CallHistory 返回最近结束的至多 limit 个呼叫的话单，最近结束的在前
+func (b *B2BUA) CallHistory(limit int) []*CDR {
+	return b.completed.recent(limit)
+}
+
+// CompletedCDR 返回最近结束的呼叫的话单（含标签）
+func (b *B2BUA) CompletedCDR(callID string) (*CDR, bool) {
+	b.completed.mutex.Lock()
+	defer b.completed.mutex.Unlock()
+	call, found := b.completed.calls[callID]
+	if !found {
+		return nil, false
+	}
+	cdr := *call.cdr
+	cdr.Tags = append([]CallTag(nil), call.cdr.Tags...)
+	return &cdr, true
+}
+
+// TagCall 为最近结束的呼叫添加标签或评分，追加到话单文件旁的标签文件，并产生 call.tagged 事件。
+// 返回带有全部标签的话单
+func (b *B2BUA) TagCall(callID string, tag CallTag) (*CDR, error) {
+	if tag.Label == "" && tag.Rating == 0 {
+		return nil, errors.New("label or rating required")
+	}
+	if tag.Rating < 0 || tag.Rating > 5 {
+		return nil, fmt.Errorf("invalid rating %d, expected 1-5", tag.Rating)
+	}
+	tag.Time = time.Now()
+
+	b.completed.mutex.Lock()
+	call, found := b.completed.calls[callID]
+	if !found {
+		b.completed.mutex.Unlock()
+		return nil, ErrCallNotCompleted
+	}
+	call.cdr.Tags = append(call.cdr.Tags, tag)
+	b.completed.mutex.Unlock()
+
+	if b.cdrWriter != nil {
+		if err := b.cdrWriter.WriteTag(&callTagRecord{CallID: callID, Tag: tag}); err != nil {
+			logger.Errorf("Write call tag failed: %v", err)
+		}
+	}
+	cdr, _ := b.CompletedCDR(callID)
+	b.emitFor(call.users, EventCallTagged, map[string]interface{}{
+		"call_id": callID,
+		"tag":     tag,
+		"cdr":     cdr,
+	})
+	return cdr, nil
+}
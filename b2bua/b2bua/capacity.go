@@ -0,0 +1,254 @@
+package b2bua
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+const (
+	defaultCapacityRetryAfter    = 30                     // 容量耗尽时默认的 Retry-After（秒）
+	defaultCapacityMaxRetryAfter = 300                    // 默认 Retry-After 上限（秒）
+	portQueuePollInterval        = 100 * time.Millisecond // 排队等待媒体端口时重试分配的间隔
+)
+
+// 容量资源
+const (
+	capacityMediaPorts    = "media_ports"
+	capacityTranscoding   = "transcoding"
+	capacityCalls         = "calls"
+	capacityRegistrations = "registrations"
+	capacityBandwidth     = "bandwidth"     // 通话媒体带宽
+	capacityRegisterRate  = "register_rate" // 注册风暴准入控制
+	capacityDrain         = "drain"         // 排空模式
+)
+
+// CapacityConfig 同时进行的呼叫数、媒体带宽与注册数上限。超过上限的新呼叫和新注册返回 503，
+// Retry-After 按当前负载计算
+type CapacityConfig struct {
+	MaxCalls         int `json:"max_calls"`         // 同时进行的呼叫数上限，0 表示不限制
+	MaxBandwidth     int `json:"max_bandwidth"`     // 同时进行的呼叫的媒体带宽上限（kbps，单方向），0 表示不限制。每个呼叫按 A 路 offer 的 b=TIAS/b=AS 计算，没有时按编解码估算
+	MaxRegistrations int `json:"max_registrations"` // 注册的联系地址数上限，0 表示不限制，已注册终端的续约不受限制
+	RetryAfter       int `json:"retry_after"`       // 负载达到上限时的 Retry-After（秒），默认 30，按超出上限的比例递增并加随机抖动
+	MaxRetryAfter    int `json:"max_retry_after"`   // Retry-After 上限（秒），默认 300
+}
+
+// overload 一次过载拒绝
+type overload struct {
+	resource   string // 耗尽的资源
+	retryAfter int    // Retry-After（秒）
+	warning    string // Warning 头域文本
+}
+
+// capacityManager 集中决定是否接受新呼叫和新注册，并为所有 503 过载响应计算 Retry-After
+type capacityManager struct {
+	config          CapacityConfig
+	mediaRetryAfter int                          // 媒体端口与转码容量耗尽时的 Retry-After（秒），0 时使用 config.RetryAfter
+	calls           func() int                   // 当前呼叫数
+	bandwidth       func() int                   // 当前呼叫的媒体带宽（kbps）
+	registrations   func() int                   // 当前注册的联系地址数
+	draining        func() (time.Duration, bool) // 排空模式的剩余时间
+}
+
+func newCapacityManager(config CapacityConfig, mediaRetryAfter int, calls, bandwidth, registrations func() int, draining func() (time.Duration, bool)) *capacityManager {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = defaultCapacityRetryAfter
+	}
+	if config.MaxRetryAfter <= 0 {
+		config.MaxRetryAfter = defaultCapacityMaxRetryAfter
+	}
+	return &capacityManager{
+		config:          config,
+		mediaRetryAfter: mediaRetryAfter,
+		calls:           calls,
+		bandwidth:       bandwidth,
+		registrations:   registrations,
+		draining:        draining,
+	}
+}
+
+// AdmitCall 检查是否接受媒体带宽为 bandwidth（kbps）的新呼叫，拒绝时返回过载信息
+func (m *capacityManager) AdmitCall(bandwidth int) *overload {
+	if o := m.drainOverload(); o != nil {
+		return o
+	}
+	if m.config.MaxCalls > 0 {
+		if active := m.calls(); active >= m.config.MaxCalls {
+			return m.overload(capacityCalls, m.config.RetryAfter, float64(active+1)/float64(m.config.MaxCalls), "call capacity exhausted")
+		}
+	}
+	if m.config.MaxBandwidth > 0 && bandwidth > 0 {
+		if used := m.bandwidth(); used+bandwidth > m.config.MaxBandwidth {
+			return m.overload(capacityBandwidth, m.config.RetryAfter, float64(used+bandwidth)/float64(m.config.MaxBandwidth), "bandwidth capacity exhausted")
+		}
+	}
+	return nil
+}
+
+// AdmitRegister 检查是否接受新注册（已注册终端的续约不经过此检查），拒绝时返回过载信息
+func (m *capacityManager) AdmitRegister() *overload {
+	if o := m.drainOverload(); o != nil {
+		return o
+	}
+	if m.config.MaxRegistrations > 0 {
+		if active := m.registrations(); active >= m.config.MaxRegistrations {
+			return m.overload(capacityRegistrations, m.config.RetryAfter, float64(active+1)/float64(m.config.MaxRegistrations), "registration capacity exhausted")
+		}
+	}
+	return nil
+}
+
+// Exhausted 返回媒体端口或转码容量耗尽的过载信息
+func (m *capacityManager) Exhausted(resource, warning string) *overload {
+	base := m.mediaRetryAfter
+	if base <= 0 {
+		base = m.config.RetryAfter
+	}
+	return m.overload(resource, base, 1, warning)
+}
+
+// Paced 返回注册准入控制拒绝的过载信息，retryAfter 由令牌桶按预计空闲时间给出
+func (m *capacityManager) Paced(retryAfter int) *overload {
+	return &overload{resource: capacityRegisterRate, retryAfter: retryAfter, warning: "registration rate exceeded"}
+}
+
+// drainOverload 排空模式下返回过载信息，Retry-After 为排空的剩余时间
+func (m *capacityManager) drainOverload() *overload {
+	remaining, draining := m.draining()
+	if !draining {
+		return nil
+	}
+	seconds := int(remaining.Seconds()) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &overload{resource: capacityDrain, retryAfter: seconds, warning: "draining"}
+}
+
+// overload 按负载（当前数量与上限之比，不小于 1）计算 Retry-After：基础值乘以负载，
+// 再加至多四分之一基础值的随机抖动，使被拒绝的终端分散重试
+func (m *capacityManager) overload(resource string, base int, load float64, warning string) *overload {
+	if load < 1 {
+		load = 1
+	}
+	seconds := int(float64(base)*load) + rand.Intn(base/4+1)
+	if seconds > m.config.MaxRetryAfter {
+		seconds = m.config.MaxRetryAfter
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &overload{resource: resource, retryAfter: seconds, warning: warning}
+}
+
+// header 返回 Retry-After 头域
+func (o *overload) header() sip.Header {
+	return &sip.GenericHeader{HeaderName: "Retry-After", Contents: strconv.Itoa(o.retryAfter)}
+}
+
+// rejectOverload 以 503、Retry-After 和 Warning 拒绝呼叫
+func (b *B2BUA) rejectOverload(sess *session.Session, o *overload) {
+	b.metrics.Inc(MetricCapacity + o.resource + ".rejected")
+	sess.Reject(503, "Service Unavailable", o.header(), b.warning(399, o.warning))
+}
+
+// rejectOverloadRequest 以 503、Retry-After 和 Warning 拒绝非 INVITE 请求（如 REGISTER）
+func (b *B2BUA) rejectOverloadRequest(request sip.Request, tx sip.ServerTransaction, o *overload) {
+	b.metrics.Inc(MetricCapacity + o.resource + ".rejected")
+	if tx == nil {
+		return
+	}
+	resp := sip.NewResponseFromRequest(request.MessageID(), request, 503, "Service Unavailable", "")
+	resp.AppendHeader(o.header())
+	resp.AppendHeader(b.warning(399, o.warning))
+	tx.Respond(resp)
+}
+
+// activeCalls 返回当前的呼叫数，分叉的多个分支只计一次
+func (b *B2BUA) activeCalls() int {
+	seen := make(map[string]bool)
+	for _, call := range b.Calls() {
+		seen[call.ID] = true
+	}
+	return len(seen)
+}
+
+// activeBandwidth 返回当前呼叫的媒体带宽（kbps），分叉的多个分支只计一次
+func (b *B2BUA) activeBandwidth() int {
+	seen := make(map[string]bool)
+	total := 0
+	for _, call := range b.Calls() {
+		if !seen[call.ID] {
+			seen[call.ID] = true
+			total += call.bandwidth
+		}
+	}
+	return total
+}
+
+// activeRegistrations 返回注册表中本节点拥有的联系地址数
+func (b *B2BUA) activeRegistrations() int {
+	count := 0
+	for _, instances := range b.registry.GetAllContacts() {
+		for _, instance := range instances {
+			if instance.Node == "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// anchorMedia 为新呼叫分配 A 路 offer 的媒体中继端口。端口耗尽时按 queue_timeout 排队等待，
+// 仍无可用端口时返回 false。其它错误不影响呼叫（SDP 原样转发）
+func (b *B2BUA) anchorMedia(call *B2BCall) bool {
+	sdp := call.src.RemoteSdp()
+	if call.media == nil || sdp == "" {
+		return true
+	}
+	deadline := time.Now().Add(time.Duration(b.config.MediaRelay.QueueTimeout) * time.Millisecond)
+	queued := false
+	for {
+		_, err := call.media.relay.Rewrite(media.LegA, sdp)
+		if !errors.Is(err, media.ErrNoPorts) {
+			return true
+		}
+		if !queued {
+			b.capacityExhausted(call, capacityMediaPorts)
+		}
+		if time.Now().After(deadline) {
+			call.Log().Warnf("Media relay ports exhausted, rejecting call")
+			return false
+		}
+		if !queued {
+			queued = true
+			b.metrics.Inc(MetricCapacity + capacityMediaPorts + ".queued")
+		}
+		time.Sleep(portQueuePollInterval)
+	}
+}
+
+// capacityExhausted 记录容量耗尽并产生事件
+func (b *B2BUA) capacityExhausted(call *B2BCall, resource string) {
+	b.metrics.Inc(MetricCapacity + resource + ".exhausted")
+	b.emitFor(call.users, EventCapacityExhausted, map[string]interface{}{
+		"call_id":  call.ID,
+		"resource": resource,
+	})
+}
+
+// transcodingRejected 检查 B 路是否因没有共同编解码（488）失败，且因转码容量已满未能提供转码
+func (b *B2BUA) transcodingRejected(call *B2BCall, resp *sip.Response) bool {
+	if call.media == nil || resp == nil || *resp == nil || (*resp).StatusCode() != 488 {
+		return false
+	}
+	call.media.mutex.Lock()
+	unavailable := call.media.unavailable
+	call.media.mutex.Unlock()
+	return unavailable
+}
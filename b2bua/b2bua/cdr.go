@@ -0,0 +1,131 @@
+package b2bua
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go-sip-ua/pkg/session"
+)
+
+// CDR 话单
+type CDR struct {
+	CallID      string            `json:"call_id"`              // 呼叫 ID
+	Caller      string            `json:"caller"`               // 主叫
+	Callee      string            `json:"callee"`               // 被叫
+	Start       time.Time         `json:"start"`                // 呼叫开始时间
+	Answer      *time.Time        `json:"answer,omitempty"`     // 应答时间，未应答时为空
+	End         time.Time         `json:"end"`                  // 结束时间
+	Duration    float64           `json:"duration"`             // 通话时长（秒），从应答开始计算
+	Disposition string            `json:"disposition"`          // answered、media_timeout（应答后因媒体超时而结束）、canceled 或 failed
+	Cause       ReleaseCause      `json:"cause,omitempty"`      // 释放原因，如 caller_hangup、callee_busy、timeout、media_timeout、admin
+	CauseCode   int               `json:"cause_code,omitempty"` // B 路失败时的最终响应状态码
+	Class       string            `json:"class,omitempty"`      // 呼叫分类：internal、inbound、outbound 或 transit，未路由的呼叫为空
+	Quality     *CallQuality      `json:"quality,omitempty"`    // 两路的丢包、抖动、往返时延和 MOS 估计，未经媒体中继的呼叫为空
+	Custom      map[string]string `json:"custom,omitempty"`     // 通话上下文
+	Tags        []CallTag         `json:"tags,omitempty"`       // 标签和评分：通话中添加的（如通话后调查的回答）随话单写入，结束后添加的另存于标签文件
+}
+
+// cdrWriter 以 JSON Lines 格式追加写入话单文件，呼叫结束后添加的标签写入同目录的 <话单文件>.tags
+type cdrWriter struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// Write 追加一条话单
+func (w *cdrWriter) Write(cdr *CDR) error {
+	return w.append(w.path, cdr)
+}
+
+// WriteTag 追加一条标签记录
+func (w *cdrWriter) WriteTag(record *callTagRecord) error {
+	return w.append(w.path+".tags", record)
+}
+
+func (w *cdrWriter) append(path string, v interface{}) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(v)
+}
+
+// newCDR 根据呼叫生成话单
+func newCDR(call *B2BCall, state session.Status, end time.Time) *CDR {
+	cdr := &CDR{
+		CallID: call.ID,
+		Caller: call.Caller,
+		Callee: call.Callee,
+		Class:  call.Class,
+		Start:  call.Start,
+		End:    end,
+		Custom: call.Context.All(),
+		Tags:   call.Context.Tags(),
+	}
+	if quality, ok := callQuality(call); ok {
+		cdr.Quality = quality
+	}
+	if answered := call.Context.answeredAt(); !answered.IsZero() {
+		cdr.Answer = &answered
+		cdr.Duration = end.Sub(answered).Seconds()
+		cdr.Disposition = "answered"
+		if call.Context.timedOut() {
+			cdr.Disposition = "media_timeout"
+		}
+	} else if state == session.Canceled {
+		cdr.Disposition = "canceled"
+	} else {
+		cdr.Disposition = "failed"
+	}
+	cdr.Cause, cdr.CauseCode = call.Context.releaseCause()
+	return cdr
+}
+
+// finishCall 在呼叫的最后一个分支结束时输出话单和事件
+func (b *B2BUA) finishCall(call *B2BCall, state session.Status) {
+	if !call.Context.markFinished() { // 重复的结束通知不再输出话单
+		return
+	}
+	if call.cancel != nil {
+		call.cancel()
+	}
+	b.closeMedia(call)
+	switch state { // 没有一路记录释放原因：呼叫在本地被拒绝或取消
+	case session.Failure:
+		call.Context.release(CauseRejected, 0)
+	case session.Canceled:
+		call.Context.release(CauseCanceled, 0)
+	}
+	cdr := newCDR(call, state, time.Now())
+	call.Log().Infof("Call ended: %s (%s), duration %.1fs", cdr.Disposition, cdr.Cause, cdr.Duration)
+	b.recordQuality(cdr.Quality)
+	b.recordCallOutcome(cdr)
+	b.completed.add(call, cdr)
+	if b.cdrWriter != nil {
+		if err := b.cdrWriter.Write(cdr); err != nil {
+			call.Log().Errorf("Write CDR failed: %v", err)
+		}
+	}
+	b.emitFor(call.users, EventCallEnded, map[string]interface{}{
+		"call_id": call.ID,
+		"context": cdr.Custom,
+		"cdr":     cdr,
+	})
+}
+
+// callAnswered 记录呼叫的首次应答时间，首次应答时产生 call.answered 事件
+func (b *B2BUA) callAnswered(call *B2BCall) {
+	if !call.Context.markAnswered(time.Now()) {
+		return
+	}
+	b.emitFor(call.users, EventCallAnswered, map[string]interface{}{
+		"call_id": call.ID,
+		"caller":  call.Caller,
+		"callee":  call.Callee,
+	})
+}
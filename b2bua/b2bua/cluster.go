@@ -0,0 +1,416 @@
+package b2bua
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	registry2 "go-sip-ua/b2bua/registry"
+	"go-sip-ua/pkg/session"
+)
+
+// 主备角色
+const (
+	ClusterActive  = "active"  // 主用：处理呼叫并向备用实例复制状态
+	ClusterStandby = "standby" // 备用：接收复制的状态，主用超时未复制时接管
+)
+
+const (
+	defaultClusterSyncInterval    = 2                  // 默认的复制间隔（秒）
+	defaultClusterFailoverTimeout = 10                 // 默认的接管超时（秒）
+	clusterSecretHeader           = "X-Cluster-Secret" // 复制请求携带共享密钥的头域
+)
+
+// ClusterConfig 主备高可用：主用实例定期将注册信息和已建立通话的对话状态经管理接口复制到备用实例，备用实例超过
+// failover_timeout 未收到状态时接管（通常配合虚拟 IP 或 DNS 切换）。接管后，已建立通话的对话内请求仍可路由：
+// BYE 转发给另一路，会话刷新的 re-INVITE/UPDATE 以原来的 SDP 应答。两个实例都为主用时，较早成为主用的实例保留主用
+type ClusterConfig struct {
+	Role            string `json:"role"`             // 初始角色：active 或 standby，为空时不启用
+	Node            string `json:"node"`             // 实例名称，默认主机名
+	Peer            string `json:"peer"`             // 对端管理接口的地址，例如 http://10.0.0.2:6658
+	Secret          string `json:"secret"`           // 复制请求的共享密钥，两端配置相同的值
+	SyncInterval    int    `json:"sync_interval"`    // 主用实例复制状态的间隔（秒），0 为 2 秒
+	FailoverTimeout int    `json:"failover_timeout"` // 备用实例超过该时间（秒）未收到状态时接管，0 为 10 秒
+}
+
+// ReplicatedCall 复制到备用实例的已建立通话
+type ReplicatedCall struct {
+	ID       string              `json:"id"`
+	Caller   string              `json:"caller"`
+	Callee   string              `json:"callee"`
+	Answered time.Time           `json:"answered"`
+	A        session.DialogState `json:"a"` // A 路（主叫一侧）的对话
+	B        session.DialogState `json:"b"` // B 路（被叫一侧）的对话
+}
+
+// ClusterStatus 主备状态
+type ClusterStatus struct {
+	Node        string    `json:"node"`
+	Role        string    `json:"role"`
+	Peer        string    `json:"peer"`
+	ActiveSince time.Time `json:"active_since,omitempty"` // 成为主用的时间
+	LastSync    time.Time `json:"last_sync,omitempty"`    // 主用：最近一次成功复制的时间；备用：最近一次收到状态的时间
+	LastError   string    `json:"last_error,omitempty"`   // 最近一次复制失败的原因
+	Calls       int       `json:"calls"`                  // 备用实例保存（或接管后仍在进行）的通话数
+}
+
+// clusterState 主用实例复制的状态
+type clusterState struct {
+	Node          string              `json:"node"`
+	ActiveSince   time.Time           `json:"active_since"`
+	Registrations []*registry2.Record `json:"registrations"`
+	Calls         []ReplicatedCall    `json:"calls"`
+}
+
+// cluster 主备角色及复制的通话
+type cluster struct {
+	config      ClusterConfig
+	client      *http.Client
+	mutex       sync.Mutex
+	role        string
+	activeSince time.Time
+	lastSync    time.Time
+	lastError   string
+	calls       map[string]*ReplicatedCall // 任一路的 Call-ID -> 复制的通话
+}
+
+// newCluster 按配置创建主备状态
+func newCluster(config ClusterConfig) (*cluster, error) {
+	if config.Role != ClusterActive && config.Role != ClusterStandby {
+		return nil, fmt.Errorf("cluster: invalid role %q", config.Role)
+	}
+	if config.Peer == "" {
+		return nil, fmt.Errorf("cluster: missing peer")
+	}
+	if config.Node == "" {
+		config.Node, _ = os.Hostname()
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultClusterSyncInterval
+	}
+	if config.FailoverTimeout <= 0 {
+		config.FailoverTimeout = defaultClusterFailoverTimeout
+	}
+	c := &cluster{
+		config:   config,
+		client:   &http.Client{Timeout: time.Duration(config.SyncInterval) * time.Second},
+		role:     config.Role,
+		lastSync: time.Now(), // 备用实例启动后等待一个接管超时
+		calls:    make(map[string]*ReplicatedCall),
+	}
+	if c.role == ClusterActive {
+		c.activeSince = time.Now()
+	}
+	return c, nil
+}
+
+// Cluster 返回主备状态，未启用时返回 nil
+func (b *B2BUA) Cluster() *ClusterStatus {
+	if b.cluster == nil {
+		return nil
+	}
+	c := b.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	calls := make(map[*ReplicatedCall]bool)
+	for _, call := range c.calls {
+		calls[call] = true
+	}
+	return &ClusterStatus{
+		Node:        c.config.Node,
+		Role:        c.role,
+		Peer:        c.config.Peer,
+		ActiveSince: c.activeSince,
+		LastSync:    c.lastSync,
+		LastError:   c.lastError,
+		Calls:       len(calls),
+	}
+}
+
+// runCluster 主用时定期复制状态，备用时检查是否需要接管
+func (b *B2BUA) runCluster() {
+	c := b.cluster
+	ticker := time.NewTicker(time.Duration(c.config.SyncInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			c.mutex.Lock()
+			role, lastSync := c.role, c.lastSync
+			c.mutex.Unlock()
+			if role == ClusterActive {
+				b.replicate()
+			} else if time.Since(lastSync) > time.Duration(c.config.FailoverTimeout)*time.Second {
+				b.takeOver(fmt.Errorf("no state from %s for %v", c.config.Peer, time.Since(lastSync).Round(time.Second)))
+			}
+		}
+	}
+}
+
+// clusterSnapshot 返回需要复制的注册信息和两路都已确认的通话
+func (b *B2BUA) clusterSnapshot() clusterState {
+	c := b.cluster
+	c.mutex.Lock()
+	state := clusterState{Node: c.config.Node, ActiveSince: c.activeSince}
+	c.mutex.Unlock()
+	state.Registrations = b.registry.Snapshot()
+	for _, leg := range b.Calls() {
+		if leg.dest == nil || leg.src.Status() != session.Confirmed || leg.dest.Status() != session.Confirmed {
+			continue
+		}
+		state.Calls = append(state.Calls, ReplicatedCall{
+			ID:       leg.ID,
+			Caller:   leg.Caller,
+			Callee:   leg.Callee,
+			Answered: leg.Context.answeredAt(),
+			A:        leg.src.DialogState(),
+			B:        leg.dest.DialogState(),
+		})
+	}
+	return state
+}
+
+// replicate 将状态发送到备用实例。对端也是主用且较早成为主用时，本实例转为备用
+func (b *B2BUA) replicate() {
+	c := b.cluster
+	body, err := json.Marshal(b.clusterSnapshot())
+	if err != nil {
+		logger.Errorf("Cluster: marshal state failed: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(c.config.Peer, "/")+"/api/cluster/state", bytes.NewReader(body))
+	if err != nil {
+		b.replicated(err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSecretHeader, c.config.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		b.replicated(err)
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		b.replicated(nil)
+	case http.StatusConflict:
+		b.setClusterRole(ClusterStandby, fmt.Errorf("peer %s has been active longer", c.config.Peer))
+	default:
+		b.replicated(fmt.Errorf("peer %s returned %s", c.config.Peer, resp.Status))
+	}
+}
+
+// replicated 记录一次复制的结果，只在失败原因变化时记录日志
+func (b *B2BUA) replicated(err error) {
+	c := b.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		if c.lastError != "" {
+			logger.Infof("Cluster: replication to %s recovered", c.config.Peer)
+		}
+		c.lastSync, c.lastError = time.Now(), ""
+		b.metrics.Inc(MetricCluster + "replicated")
+		return
+	}
+	if c.lastError != err.Error() {
+		logger.Warnf("Cluster: replication to %s failed: %v", c.config.Peer, err)
+	}
+	c.lastError = err.Error()
+	b.metrics.Inc(MetricCluster + "replication_failed")
+}
+
+// applyClusterState 备用实例保存收到的状态：以复制的注册信息替换本地注册表，保存已建立通话的对话。
+// 本实例为主用且较早成为主用时拒绝（返回 false），否则转为备用后保存
+func (b *B2BUA) applyClusterState(state *clusterState) bool {
+	c := b.cluster
+	c.mutex.Lock()
+	role, activeSince := c.role, c.activeSince
+	c.mutex.Unlock()
+	if role == ClusterActive {
+		if activeSince.Before(state.ActiveSince) || (activeSince.Equal(state.ActiveSince) && c.config.Node < state.Node) {
+			logger.Warnf("Cluster: %s is also active, keeping the active role", state.Node)
+			return false
+		}
+		b.setClusterRole(ClusterStandby, fmt.Errorf("%s has been active longer", state.Node))
+	}
+
+	now := time.Now()
+	b.registry.Flush()
+	for _, record := range state.Registrations {
+		aor, instance, err := record.Instance()
+		if err != nil || instance.Expired(now) {
+			continue
+		}
+		b.registry.AddAor(aor, instance)
+	}
+	b.persistRegistry()
+
+	calls := make(map[string]*ReplicatedCall, 2*len(state.Calls))
+	for i := range state.Calls {
+		call := &state.Calls[i]
+		calls[call.A.CallID] = call
+		calls[call.B.CallID] = call
+	}
+	c.mutex.Lock()
+	c.calls = calls
+	c.lastSync = now
+	c.mutex.Unlock()
+	return true
+}
+
+// takeOver 备用实例接管为主用
+func (b *B2BUA) takeOver(reason error) {
+	b.setClusterRole(ClusterActive, reason)
+}
+
+// SetClusterRole 手动切换主备角色，例如维护前将备用实例切换为主用
+func (b *B2BUA) SetClusterRole(role string) error {
+	if b.cluster == nil {
+		return fmt.Errorf("cluster is not enabled")
+	}
+	if role != ClusterActive && role != ClusterStandby {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	b.setClusterRole(role, fmt.Errorf("set by operator"))
+	return nil
+}
+
+// setClusterRole 切换角色，记录日志并发送事件
+func (b *B2BUA) setClusterRole(role string, reason error) {
+	c := b.cluster
+	c.mutex.Lock()
+	if c.role == role {
+		c.mutex.Unlock()
+		return
+	}
+	c.role = role
+	if role == ClusterActive {
+		c.activeSince = time.Now()
+	} else {
+		c.activeSince = time.Time{}
+		c.lastSync = time.Now()
+	}
+	calls := len(c.calls) / 2
+	c.mutex.Unlock()
+
+	logger.Warnf("Cluster: %s becomes %s (%d replicated calls): %v", c.config.Node, role, calls, reason)
+	b.metrics.Inc(MetricCluster + role)
+	b.emit(EventClusterRole, map[string]interface{}{
+		"node":   c.config.Node,
+		"role":   role,
+		"calls":  calls,
+		"reason": reason.Error(),
+	})
+}
+
+// clusterDialog 接管后处理复制的通话的对话内请求，不属于复制的通话时返回 false
+func (b *B2BUA) clusterDialog(req sip.Request, tx sip.ServerTransaction) bool {
+	callID, ok := req.CallID()
+	if !ok {
+		return false
+	}
+	c := b.cluster
+	c.mutex.Lock()
+	call := c.calls[string(*callID)]
+	active := c.role == ClusterActive
+	c.mutex.Unlock()
+	if call == nil || !active {
+		return false
+	}
+	received, other := call.A, call.B
+	if string(*callID) == call.B.CallID {
+		received, other = call.B, call.A
+	}
+	if tx == nil || req.IsAck() {
+		return true
+	}
+
+	switch req.Method() {
+	case sip.BYE: // 应答后向另一路发送 BYE
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", ""))
+		c.mutex.Lock()
+		delete(c.calls, call.A.CallID)
+		delete(c.calls, call.B.CallID)
+		c.mutex.Unlock()
+		logger.Infof("Cluster: BYE for replicated call %s (%s -> %s)", call.ID, call.Caller, call.Callee)
+		b.metrics.Inc(MetricCluster + "bye")
+		go b.clusterBye(call, other)
+	case sip.INVITE, sip.UPDATE: // 会话刷新，以原来的 SDP 应答
+		resp := sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", "")
+		if contact, err := parseContact(received.LocalContact); err == nil {
+			resp.AppendHeader(contact)
+		}
+		if received.LocalSdp != "" && len(req.Body()) > 0 {
+			contentType := sip.ContentType("application/sdp")
+			resp.AppendHeader(&contentType)
+			resp.SetBody(received.LocalSdp, true)
+		}
+		tx.Respond(resp)
+		b.metrics.Inc(MetricCluster + "refresh")
+	default:
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", ""))
+	}
+	return true
+}
+
+// parseContact 解析复制的 Contact 头域值
+func parseContact(value string) (*sip.ContactHeader, error) {
+	displayName, uri, params, err := parser.ParseAddressValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return &sip.ContactHeader{DisplayName: displayName, Address: uri, Params: params}, nil
+}
+
+// clusterBye 按复制的对话状态向一路发送 BYE
+func (b *B2BUA) clusterBye(call *ReplicatedCall, dialog session.DialogState) {
+	target, err := parser.ParseUri(dialog.RemoteTarget)
+	if err != nil {
+		logger.Errorf("Cluster: call %s: invalid remote target %q: %v", call.ID, dialog.RemoteTarget, err)
+		return
+	}
+	fromName, fromUri, fromParams, err := parser.ParseAddressValue(dialog.LocalURI)
+	if err != nil {
+		logger.Errorf("Cluster: call %s: invalid local URI %q: %v", call.ID, dialog.LocalURI, err)
+		return
+	}
+	toName, toUri, toParams, err := parser.ParseAddressValue(dialog.RemoteURI)
+	if err != nil {
+		logger.Errorf("Cluster: call %s: invalid remote URI %q: %v", call.ID, dialog.RemoteURI, err)
+		return
+	}
+
+	callID := sip.CallID(dialog.CallID)
+	maxForwards := sip.MaxForwards(70)
+	headers := []sip.Header{
+		&sip.FromHeader{DisplayName: fromName, Address: fromUri, Params: fromParams},
+		&sip.ToHeader{DisplayName: toName, Address: toUri, Params: toParams},
+		&callID,
+		&sip.CSeq{SeqNo: dialog.LocalCSeq + 1, MethodName: sip.BYE},
+		&maxForwards,
+	}
+	for _, route := range dialog.RouteSet {
+		_, uri, _, err := parser.ParseAddressValue(route)
+		if err != nil {
+			continue
+		}
+		headers = append(headers, &sip.RouteHeader{Addresses: []sip.Uri{uri}})
+	}
+	req := sip.NewRequest("", sip.BYE, target, "SIP/2.0", headers, "", nil)
+
+	if _, err := b.sendRequest(context.Background(), req, dialog.Transport, dialog.Destination, defaultRelayTimeout); err != nil {
+		logger.Warnf("Cluster: BYE for replicated call %s to %s failed: %v", call.ID, dialog.Destination, err)
+	}
+}
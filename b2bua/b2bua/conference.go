@@ -0,0 +1,235 @@
+package b2bua
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// ConferenceConfig 会议室：呼叫会议号码的 INVITE 在本地应答，与会者的媒体在媒体中继中混音，需要启用媒体中继
+type ConferenceConfig struct {
+	Prefix          string `json:"prefix"`           // 会议号码前缀，拨打前缀加房间号加入会议室，如前缀为 *8 时拨打 *8100 进入会议室 100
+	Domain          string `json:"domain"`           // 会议域名，请求 URI 为该域名时用户部分为房间号，如 sip:100@conference.example.com
+	MaxParticipants int    `json:"max_participants"` // 每个会议室的最大人数，达到时返回 486；0 不限制
+}
+
+// ErrConferenceNotFound 会议室或与会者不存在
+var ErrConferenceNotFound = errors.New("conference or participant not found")
+
+// conferences 进行中的会议室
+type conferences struct {
+	mutex sync.Mutex
+	rooms map[string]*conferenceRoom // 房间号 -> 会议室
+}
+
+// conferenceRoom 一个会议室，最后一个与会者离开时关闭
+type conferenceRoom struct {
+	name         string
+	created      time.Time
+	mixer        *media.Mixer
+	participants map[string]*participant // 呼叫 ID -> 与会者
+}
+
+// participant 一个与会者，即一个在本地应答的 A 路
+type participant struct {
+	call   *B2BCall
+	joined time.Time
+	muted  bool
+}
+
+// ConferenceParticipant 与会者的状态
+type ConferenceParticipant struct {
+	ID     string    `json:"id"` // 呼叫 ID
+	Caller string    `json:"caller"`
+	Joined time.Time `json:"joined"`
+	Muted  bool      `json:"muted"`
+}
+
+// ConferenceRoom 会议室的状态
+type ConferenceRoom struct {
+	Name         string                  `json:"name"`
+	Created      time.Time               `json:"created"`
+	Participants []ConferenceParticipant `json:"participants"` // 按加入时间排序
+}
+
+// conferenceRoomFor 返回被叫对应的会议室房间号，不是会议号码时返回空
+func (b *B2BUA) conferenceRoomFor(called sip.Uri) string {
+	config := b.config.Conference
+	if called == nil || called.User() == nil {
+		return ""
+	}
+	user := called.User().String()
+	if config.Domain != "" && strings.EqualFold(called.Host(), config.Domain) {
+		return user
+	}
+	if config.Prefix != "" && strings.HasPrefix(user, config.Prefix) && len(user) > len(config.Prefix) {
+		return strings.TrimPrefix(user, config.Prefix)
+	}
+	return ""
+}
+
+// joinConference 被叫为会议号码时在本地应答 A 路并加入会议室，返回 true 表示呼叫已处理
+func (b *B2BUA) joinConference(call *B2BCall, sess *session.Session, called sip.Uri) bool {
+	name := b.conferenceRoomFor(called)
+	if name == "" {
+		return false
+	}
+	call.Context.Set("conference", name)
+	if call.media == nil {
+		sess.Reject(488, "Not Acceptable Here", b.warning(399, "conference requires media relay"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	answer, err := call.media.relay.Answer(media.LegA, sess.RemoteSdp())
+	if err != nil {
+		call.Log().Warnf("Conference %s: answer failed: %v", name, err)
+		sess.Reject(488, "Not Acceptable Here", b.warning(305, "incompatible media format"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+
+	b.conferences.mutex.Lock()
+	room := b.conferences.rooms[name]
+	if room == nil {
+		room = &conferenceRoom{name: name, created: time.Now(), mixer: media.NewMixer(), participants: make(map[string]*participant)}
+		b.conferences.rooms[name] = room
+	}
+	if max := b.config.Conference.MaxParticipants; max > 0 && len(room.participants) >= max {
+		b.conferences.mutex.Unlock()
+		call.Log().Warnf("Conference %s is full", name)
+		sess.Reject(486, "Busy Here", b.warning(399, "conference full"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	if err := room.mixer.Add(call.ID, call.media.relay, media.LegA); err != nil {
+		b.closeRoomIfEmpty(room)
+		b.conferences.mutex.Unlock()
+		call.Log().Errorf("Conference %s: %v", name, err)
+		sess.Reject(500, "Server Internal Error")
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	room.participants[call.ID] = &participant{call: call, joined: time.Now()}
+	count := len(room.participants)
+	b.conferences.mutex.Unlock()
+
+	sess.ProvideAnswer(answer)
+	sess.Accept(200)
+	b.callAnswered(call)
+	call.Log().Infof("Joined conference %s (%d participants)", name, count)
+	b.metrics.Inc(MetricConference + "joined")
+	b.emitFor(call.users, EventConferenceJoined, map[string]interface{}{
+		"call_id":      call.ID,
+		"caller":       call.Caller,
+		"conference":   name,
+		"participants": count,
+	})
+	return true
+}
+
+// leaveConference A 路结束时将其移出所在的会议室并结束呼叫，不是与会者时返回 false
+func (b *B2BUA) leaveConference(sess *session.Session, state session.Status) bool {
+	b.conferences.mutex.Lock()
+	var room *conferenceRoom
+	var left *participant
+	for _, r := range b.conferences.rooms {
+		for id, p := range r.participants {
+			if p.call.src == sess {
+				room, left = r, p
+				delete(r.participants, id)
+				r.mixer.Remove(id)
+				break
+			}
+		}
+	}
+	if left == nil {
+		b.conferences.mutex.Unlock()
+		return false
+	}
+	count := len(room.participants)
+	b.closeRoomIfEmpty(room)
+	b.conferences.mutex.Unlock()
+
+	call := left.call
+	call.Log().Infof("Left conference %s (%d participants)", room.name, count)
+	b.metrics.Inc(MetricConference + "left")
+	b.emitFor(call.users, EventConferenceLeft, map[string]interface{}{
+		"call_id":      call.ID,
+		"caller":       call.Caller,
+		"conference":   room.name,
+		"participants": count,
+	})
+	b.finishCall(call, state)
+	return true
+}
+
+// closeRoomIfEmpty 关闭没有与会者的会议室，调用时持有 conferences.mutex
+func (b *B2BUA) closeRoomIfEmpty(room *conferenceRoom) {
+	if len(room.participants) > 0 {
+		return
+	}
+	room.mixer.Close()
+	delete(b.conferences.rooms, room.name)
+}
+
+// Conferences 返回进行中的会议室及与会者，按房间号排序
+func (b *B2BUA) Conferences() []ConferenceRoom {
+	b.conferences.mutex.Lock()
+	defer b.conferences.mutex.Unlock()
+	rooms := make([]ConferenceRoom, 0, len(b.conferences.rooms))
+	for _, room := range b.conferences.rooms {
+		status := ConferenceRoom{Name: room.name, Created: room.created, Participants: []ConferenceParticipant{}}
+		for id, p := range room.participants {
+			status.Participants = append(status.Participants, ConferenceParticipant{ID: id, Caller: p.call.Caller, Joined: p.joined, Muted: p.muted})
+		}
+		sort.Slice(status.Participants, func(i, j int) bool { return status.Participants[i].Joined.Before(status.Participants[j].Joined) })
+		rooms = append(rooms, status)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// participant 查找会议室中的与会者，调用时持有 conferences.mutex
+func (b *B2BUA) participant(room, id string) (*conferenceRoom, *participant) {
+	r := b.conferences.rooms[room]
+	if r == nil || r.participants[id] == nil {
+		return nil, nil
+	}
+	return r, r.participants[id]
+}
+
+// MuteParticipant 将与会者静音或取消静音：静音的与会者仍能听到其他人，但其他人听不到他
+func (b *B2BUA) MuteParticipant(room, id string, muted bool) error {
+	b.conferences.mutex.Lock()
+	defer b.conferences.mutex.Unlock()
+	r, p := b.participant(room, id)
+	if p == nil {
+		return ErrConferenceNotFound
+	}
+	p.muted = muted
+	r.mixer.SetMuted(id, muted)
+	p.call.Log().Infof("Conference %s: muted %v", room, muted)
+	return nil
+}
+
+// KickParticipant 将与会者移出会议室并挂断
+func (b *B2BUA) KickParticipant(room, id string) error {
+	b.conferences.mutex.Lock()
+	_, p := b.participant(room, id)
+	b.conferences.mutex.Unlock()
+	if p == nil {
+		return ErrConferenceNotFound
+	}
+	p.call.Log().Infof("Kicked from conference %s", room)
+	if !p.call.src.IsEnded() {
+		p.call.src.End()
+	}
+	b.leaveConference(p.call.src, session.Terminated)
+	return nil
+}
@@ -0,0 +1,99 @@
+package b2bua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// B2BUAConfig 描述 B2BUA 的可用配置项
+type B2BUAConfig struct {
+	Identity          IdentityConfig             `json:"identity"`           // 实例标识：产品名称、版本、User-Agent/Server 头域等
+	Listen            ListenConfig               `json:"listen"`             // 各传输协议及管理接口的监听地址
+	API               APIConfig                  `json:"api"`                // REST 管理接口的认证：Bearer 令牌或客户端证书，都未配置时拒绝所有请求
+	Profiles          []SIPProfileConfig         `json:"profiles"`           // SIP profile：独立的监听、域名和策略（如对内 5060、对外 5080），呼叫可在 profile 之间桥接
+	Hooks             LifecycleHooks             `json:"-"`                  // 嵌入 B2BUA 的应用设置的生命周期回调
+	Via               map[string]ViaConfig       `json:"via"`                // 按传输协议（udp、tcp、tls、ws、wss）配置 rport 及响应的发送地址
+	DisplayNames      map[string]string          `json:"display_names"`      // 账户显示名称（用户名 -> 显示名称），内部呼叫的 B 路 INVITE 用作主叫显示名称
+	TelDomain         string                     `json:"tel_domain"`         // 收到的 tel: URI 转换为 SIP URI 时使用的域名，为空时使用本机地址
+	Domain            string                     `json:"domain"`             // 默认域名：注册表按 user@域名 区分账户，以 IP 地址注册或呼叫的账户视为该域名下的账户；为空时使用本机地址
+	CompactHeaders    []string                   `json:"compact_headers"`    // 使用紧凑头域名发送消息的传输协议（如 udp），减少 UDP 分片
+	DisableAuth       bool                       `json:"disable_auth"`       // 是否禁用认证（全局认证策略 none），可按租户、监听、中继通过 auth 覆盖
+	NonceSecret       string                     `json:"nonce_secret"`       // 摘要认证 nonce 签名密钥，集群中各节点配置相同的值，使任一节点都能校验其它节点签发的 nonce；未配置时 nonce 只保存在进程内存中，重启后失效，客户端需重新认证
+	EnableTLS         bool                       `json:"enable_tls"`         // 是否启用 TLS/WSS 监听
+	TLS               TLSConfig                  `json:"tls"`                // TLS/WSS 证书
+	Fingerprint       FingerprintConfig          `json:"fingerprint"`        // 注册设备指纹异常检测
+	AccountsFile      string                     `json:"accounts_file"`      // 账户文件路径（JSON，用户名 -> 密码），命令行增删账户和修改密码时保存；为空时账户只保存在内存中
+	RegistrySnapshot  string                     `json:"registry_snapshot"`  // 注册表快照文件路径，为空时不持久化注册信息
+	RegisterExpiry    RegisterExpiryConfig       `json:"register_expiry"`    // 本地注册的最小有效期（过短时返回 423）、最大有效期及随机抖动
+	RegisterPacing    RegisterPacingConfig       `json:"register_pacing"`    // 注册风暴时的准入排队与 503 退避
+	RegEvent          RegEventConfig             `json:"reg_event"`          // 注册事件包（reg 事件订阅）的订阅权限与有效期
+	RateLimit         RateLimitConfig            `json:"rate_limit"`         // 来源 IP 限速与防洪
+	Capacity          CapacityConfig             `json:"capacity"`           // 同时进行的呼叫数、媒体带宽与注册数上限，超过时返回 503 和按负载计算的 Retry-After
+	RegisterRelay     RegisterRelayConfig        `json:"register_relay"`     // REGISTER 上行转发（边缘代理模式）
+	Survivability     SurvivabilityConfig        `json:"survivability"`      // 分支机构生存模式
+	ScannerFilter     ScannerFilterConfig        `json:"scanner_filter"`     // 扫描器/攻击特征过滤
+	UnknownDialog     UnknownDialogConfig        `json:"unknown_dialog"`     // 未知对话请求的处理
+	ListenerACL       map[string]ACLConfig       `json:"listener_acl"`       // 按监听传输协议（udp、tcp、tls、wss）配置的来源地址访问控制
+	TopologyHiding    TopologyHidingConfig       `json:"topology_hiding"`    // 拓扑隐藏：不向另一路暴露路由头域、终端地址和内部网络地址
+	DNS               DNSConfig                  `json:"dns"`                // 出局路由的 DNS（NAPTR/SRV）解析
+	ENUM              ENUMConfig                 `json:"enum"`               // 经中继出局前查询 ENUM，有记录时直接经 SIP 呼叫
+	ScaleOut          ScaleOutConfig             `json:"scale_out"`          // 水平扩展：节点间共享注册信息，呼叫注册在其它节点上的终端时转发给该节点
+	Cluster           ClusterConfig              `json:"cluster"`            // 主备高可用：向备用实例复制注册信息和已建立通话的对话状态，主用故障时备用接管
+	Dispatcher        DispatcherConfig           `json:"dispatcher"`         // 负载分发模式：发往非本地账户的呼叫按轮流、加权或哈希分发到一组下游服务器
+	OutboundProxy     string                     `json:"outbound_proxy"`     // 全局出局代理（如边界 SBC），出局呼叫加入 Route 头域经其发送
+	StripParts        []string                   `json:"strip_parts"`        // 转发到 B 路时从 multipart 消息体中去掉的部分（如 application/isup、application/pidf+xml），"*" 表示只保留 SDP
+	TenantOverrides   map[string]ConfigOverrides `json:"tenant_overrides"`   // 按租户（SIP 域名）覆盖的认证策略、媒体模式、头域配置
+	ListenerOverrides map[string]ConfigOverrides `json:"listener_overrides"` // 按监听传输协议（udp、tcp、tls、wss）覆盖的配置，优先于租户
+	HeaderProfile     string                     `json:"header_profile"`     // 全局使用的头域配置名称
+	HeaderProfiles    map[string]HeaderProfile   `json:"header_profiles"`    // 头域配置：B 路 INVITE 复制或附加的头域
+	HeaderRules       []HeaderRule               `json:"header_rules"`       // 头域操作规则：按方向、中继、主叫账户添加、删除、替换头域或按正则改写值
+	Transit           TransitConfig              `json:"transit"`            // 转接跳数限制：在自定义头域中记录经过的实例数，防止实例或租户之间的路由环路
+	Features          map[string]AccountFeatures `json:"features"`           // 按账户（用户名）的呼叫功能，如匿名呼叫拒绝，可由用户拨打功能码或通过 REST 接口修改
+	FeatureCodes      FeatureCodesConfig         `json:"feature_codes"`      // 功能码
+	RingTimeout       RingTimeoutConfig          `json:"ring_timeout"`       // 振铃超时：B 路超时未应答时取消，转到下一个目的地、无应答前转或语音信箱
+	EarlyMedia        string                     `json:"early_media"`        // 多个分支返回带 SDP 的 180/183 时转发给主叫的早期媒体：first（默认）、latest 或 ringback（主叫播放本地回铃音）
+	Rel100            string                     `json:"100rel"`             // 可靠临时响应（RFC 3262）：supported（默认，主叫支持时可靠地转发 180/183）、required（B 路要求 100rel）或 disabled
+	Conference        ConferenceConfig           `json:"conference"`         // 会议室：呼叫会议号码在本地应答，媒体在媒体中继中混音
+	Queues            []QueueConfig              `json:"queues"`             // 呼叫队列：呼叫在本地应答并播放等待音乐，按轮流或最长空闲分配给坐席
+	HuntGroups        []HuntGroupConfig          `json:"hunt_groups"`        // 振铃组：呼叫组号码时按同振、顺序、轮流或累加策略呼叫成员
+	PagingGroups      []PagingGroupConfig        `json:"paging_groups"`      // 寻呼组：呼叫组号码时以自动应答同时呼叫所有成员，主叫的声音单向发往成员
+	Intercom          IntercomConfig             `json:"intercom"`           // 对讲与寻呼请求被叫自动应答的头域
+	PickupGroups      map[string][]string        `json:"pickup_groups"`      // 代答组：组名 -> 成员账户，成员可拨打组代答功能码代答组内其他成员正在振铃的呼叫
+	NumberLists       map[string]NumberLists     `json:"number_lists"`       // 按租户（SIP 域名，* 表示所有租户）的主叫、被叫号码黑白名单，匹配时返回 603，可通过 REST 接口和命令行修改
+	CallerID          []CallerIDRule             `json:"caller_id"`          // 主叫号码改写规则：按中继和主叫账户去掉或添加前缀、规范化为 E.164、使用固定号码和名称
+	AssertedIdentity  AssertedIdentityConfig     `json:"asserted_identity"`  // 网络断言身份：按认证身份插入 P-Asserted-Identity，在可信中继间传递，向不可信中继按 Privacy 匿名主叫
+	CallClasses       map[string]CallClassConfig `json:"call_classes"`       // 按呼叫分类（internal、inbound、outbound、transit）配置的头域配置与录音策略
+	Trunks            []TrunkConfig              `json:"trunks"`             // SIP 中继
+	Webhooks          []WebhookConfig            `json:"webhooks"`           // 事件 webhook，可按租户配置
+	Alerts            AlertsConfig               `json:"alerts"`             // 内置告警规则（失败率、注册数下降、中继故障），经 webhook 或邮件通知
+	Log               LogConfig                  `json:"log"`                // 日志文件及 SIP 消息跟踪文件，支持按大小/时间切分与压缩
+	MediaRelay        MediaRelayConfig           `json:"media_relay"`        // 媒体中继（RTP 锚定）
+	Transcoding       TranscodingConfig          `json:"transcoding"`        // 两路没有共同编解码时在媒体中继中转码
+	VideoRefresh      VideoRefreshConfig         `json:"video_refresh"`      // 视频通话应答、恢复或丢包后向发送方请求关键帧（SIP INFO 或 RTCP PLI）
+	MusicOnHold       MusicOnHoldConfig          `json:"music_on_hold"`      // 一路保持通话时由媒体中继向另一路播放的保持音乐
+	Survey            SurveyConfig               `json:"survey"`             // 通话后调查：被叫挂机后由媒体中继向主叫播放问题并收集按键
+	Recording         RecordingConfig            `json:"recording"`          // 通话录音，需要启用媒体中继
+	SDPPolicy         *SDPPolicy                 `json:"sdp_policy"`         // 全局 SDP 策略（编解码过滤、排序、ptime、去掉视频、带宽上限）
+	SDPPolicies       map[string]SDPPolicy       `json:"sdp_policies"`       // 按主叫账户（user 或 user@domain）配置的 SDP 策略
+	Location          LocationConfig             `json:"location"`           // 紧急呼叫的位置信息（Geolocation/PIDF-LO）
+	Retransmission    RetransmissionConfig       `json:"retransmission"`     // UDP 上 INVITE 200 OK 的重传与 ACK 等待
+	DTMF              DTMFConfig                 `json:"dtmf"`               // 按键（RFC 2833 / SIP INFO）转发与转换
+	Fax               FaxConfig                  `json:"fax"`                // 传真：T.38 re-INVITE 转发或 G.711 透传，传真音检测
+	HEP               HEPConfig                  `json:"hep"`                // HEPv3 抓包（Homer）
+	CDRFile           string                     `json:"cdr_file"`           // 话单文件路径（JSON Lines），为空时只通过事件输出话单
+	CallHistory       int                        `json:"call_history"`       // 内存中保留的最近结束的呼叫数（history 命令和 /api/history），默认 1000
+}
+
+// LoadConfig 从 JSON 文件加载配置
+func LoadConfig(path string) (*B2BUAConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &B2BUAConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return config, nil
+}
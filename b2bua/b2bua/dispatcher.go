@@ -0,0 +1,331 @@
+package b2bua
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/util"
+	"go-sip-ua/pkg/session"
+)
+
+// 负载分发算法
+const (
+	DispatchRoundRobin = "round_robin" // 依次分发到每个可用目标
+	DispatchWeighted   = "weighted"    // 按权重平滑轮流分发
+	DispatchHash       = "hash"        // 按呼叫的键哈希，同一键总是分发到同一目标，该目标不可用时才改为其它目标
+)
+
+// hash 算法的键
+const (
+	DispatchKeyCallID = "call_id" // A 路的 Call-ID
+	DispatchKeyFrom   = "from"    // 主叫用户
+	DispatchKeyTo     = "to"      // 被叫号码
+)
+
+const (
+	defaultDispatchProbeInterval = 10 // 默认的 OPTIONS 探测间隔（秒）
+	defaultDispatchTimeout       = 4  // 默认等待探测响应的时间（秒）
+	defaultDispatchMaxFailures   = 3  // 默认连续探测失败多少次后移除目标
+)
+
+// DispatcherConfig 负载分发模式：发往非本地账户的呼叫不经中继或上游，按算法分发到一组下游服务器（如媒体服务器、
+// PBX），首选目标失败时依次尝试其它可用目标。定期向每个目标发送 OPTIONS，连续失败的目标不再分发，恢复后重新加入
+type DispatcherConfig struct {
+	Targets       []DispatcherTarget `json:"targets"`        // 下游服务器，为空时不启用
+	Algorithm     string             `json:"algorithm"`      // 分发算法：round_robin（默认）、weighted 或 hash
+	HashKey       string             `json:"hash_key"`       // hash 算法的键：call_id（默认）、from（主叫用户）或 to（被叫号码）
+	ProbeInterval int                `json:"probe_interval"` // OPTIONS 探测间隔（秒），0 为 10 秒，小于 0 时不探测
+	Timeout       int                `json:"timeout"`        // 等待探测响应的时间（秒），0 为 4 秒
+	MaxFailures   int                `json:"max_failures"`   // 连续探测失败多少次后移除目标，0 为 3 次
+}
+
+// DispatcherTarget 一个下游服务器
+type DispatcherTarget struct {
+	URI    string `json:"uri"`    // 地址，例如 sip:10.0.0.10:5060;transport=udp
+	Weight int    `json:"weight"` // weighted 算法的权重，0 为 1
+}
+
+// DispatcherTargetStatus 下游服务器的状态
+type DispatcherTargetStatus struct {
+	URI       string    `json:"uri"`
+	Weight    int       `json:"weight"`
+	Up        bool      `json:"up"`                   // 是否参与分发
+	Failures  int       `json:"failures"`             // 连续探测失败次数
+	Calls     int64     `json:"calls"`                // 首选该目标的呼叫数
+	LastProbe time.Time `json:"last_probe,omitempty"` // 最近一次探测的时间
+	LastError string    `json:"last_error,omitempty"` // 最近一次探测失败的原因
+}
+
+// dispatcher 下游服务器及其可用性
+type dispatcher struct {
+	mutex   sync.Mutex
+	config  DispatcherConfig
+	targets []*dispatchTarget
+	next    int // round_robin 下一个呼叫的首选目标
+}
+
+// dispatchTarget 一个下游服务器的状态
+type dispatchTarget struct {
+	config    DispatcherTarget
+	uri       sip.SipUri
+	up        bool
+	failures  int
+	current   int // weighted 算法的当前权重
+	calls     int64
+	lastProbe time.Time
+	lastError string
+}
+
+// newDispatcher 按配置创建负载分发，目标初始均视为可用
+func newDispatcher(config DispatcherConfig) (*dispatcher, error) {
+	switch config.Algorithm {
+	case "":
+		config.Algorithm = DispatchRoundRobin
+	case DispatchRoundRobin, DispatchWeighted, DispatchHash:
+	default:
+		return nil, fmt.Errorf("dispatcher: invalid algorithm %q", config.Algorithm)
+	}
+	switch config.HashKey {
+	case "":
+		config.HashKey = DispatchKeyCallID
+	case DispatchKeyCallID, DispatchKeyFrom, DispatchKeyTo:
+	default:
+		return nil, fmt.Errorf("dispatcher: invalid hash key %q", config.HashKey)
+	}
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = defaultDispatchProbeInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultDispatchTimeout
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaultDispatchMaxFailures
+	}
+	d := &dispatcher{config: config}
+	for _, target := range config.Targets {
+		uri, err := parser.ParseSipUri(target.URI)
+		if err != nil {
+			return nil, fmt.Errorf("dispatcher: parse target %s: %w", target.URI, err)
+		}
+		if target.Weight <= 0 {
+			target.Weight = 1
+		}
+		d.targets = append(d.targets, &dispatchTarget{config: target, uri: uri, up: true})
+	}
+	return d, nil
+}
+
+// order 返回一个呼叫依次尝试的可用目标，第一个为按算法选择的首选目标。没有可用目标时返回 nil
+func (d *dispatcher) order(key string) []*dispatchTarget {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var healthy []*dispatchTarget
+	for _, target := range d.targets {
+		if target.up {
+			healthy = append(healthy, target)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	switch d.config.Algorithm {
+	case DispatchWeighted: // 平滑加权轮询：每次所有目标加上权重，选择当前权重最大的目标并减去总权重
+		total, best := 0, 0
+		for i, target := range healthy {
+			target.current += target.config.Weight
+			total += target.config.Weight
+			if target.current > healthy[best].current {
+				best = i
+			}
+		}
+		healthy[best].current -= total
+		ordered := append([]*dispatchTarget{healthy[best]}, healthy[:best]...)
+		healthy = append(ordered, healthy[best+1:]...)
+	case DispatchHash: // 最高随机权重哈希：目标增减时只影响原来分发到该目标的键
+		scores := make(map[*dispatchTarget]uint32, len(healthy))
+		for _, target := range healthy {
+			h := fnv.New32a()
+			h.Write([]byte(key + "|" + target.config.URI))
+			scores[target] = h.Sum32()
+		}
+		sort.SliceStable(healthy, func(i, j int) bool { return scores[healthy[i]] > scores[healthy[j]] })
+	default:
+		start := d.next % len(healthy)
+		d.next++
+		healthy = append(healthy[start:], healthy[:start]...)
+	}
+	healthy[0].calls++
+	return healthy
+}
+
+// dispatchKey 返回呼叫在 hash 算法中的键
+func (b *B2BUA) dispatchKey(call *B2BCall, called sip.Uri) string {
+	switch b.dispatcher.config.HashKey {
+	case DispatchKeyFrom:
+		if from, ok := call.src.Request().From(); ok && from.Address != nil && from.Address.User() != nil {
+			return from.Address.User().String()
+		}
+	case DispatchKeyTo:
+		return routingNumber(called)
+	}
+	return call.src.CallID().Value()
+}
+
+// dispatch 负载分发模式下将呼叫发往按算法选择的下游服务器，失败时依次切换到其它可用目标
+func (b *B2BUA) dispatch(call *B2BCall, called sip.Uri) {
+	sess := call.src
+	if b.exceedsHops(call, nil) {
+		sess.Reject(483, "Too Many Hops", b.warning(399, "transit hop limit"))
+		b.finishCall(call, session.Failure)
+		return
+	}
+	order := b.dispatcher.order(b.dispatchKey(call, called))
+	if len(order) == 0 {
+		call.Log().Warnf("Dispatcher: no target available for %v", called)
+		b.metrics.Inc(MetricDispatcher + "unavailable")
+		sess.Reject(503, "Service Unavailable", b.warning(399, "no dispatch target available"))
+		b.finishCall(call, session.Failure)
+		return
+	}
+	b.classifyCall(call, sess.Request(), false)
+	b.trying(call)
+	call.dialed = ""
+	var targets []routeTarget
+	for _, target := range order {
+		recipient := target.uri.Clone().(*sip.SipUri)
+		recipient.FUser = called.User()
+		targets = append(targets, b.routeTargets(call, *recipient, b.outboundProxy, nil)...)
+	}
+	call.Log().Infof("Dispatcher: %v => %s (%s)", called, order[0].config.URI, b.dispatcher.config.Algorithm)
+	call.Context.Set("dispatch_target", order[0].config.URI)
+	b.metrics.Inc(MetricDispatcher + "calls")
+	if !b.dialTargets(call, targets) {
+		sess.Reject(503, "Service Unavailable", b.warning(399, "no reachable dispatch target"))
+		b.finishCall(call, session.Failure)
+	}
+}
+
+// Dispatcher 返回负载分发各目标的状态，未启用时返回 nil
+func (b *B2BUA) Dispatcher() []DispatcherTargetStatus {
+	if b.dispatcher == nil {
+		return nil
+	}
+	d := b.dispatcher
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	status := make([]DispatcherTargetStatus, 0, len(d.targets))
+	for _, target := range d.targets {
+		status = append(status, DispatcherTargetStatus{
+			URI:       target.config.URI,
+			Weight:    target.config.Weight,
+			Up:        target.up,
+			Failures:  target.failures,
+			Calls:     target.calls,
+			LastProbe: target.lastProbe,
+			LastError: target.lastError,
+		})
+	}
+	return status
+}
+
+// monitorDispatcher 定期并发探测所有目标
+func (b *B2BUA) monitorDispatcher() {
+	ticker := time.NewTicker(time.Duration(b.dispatcher.config.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, target := range b.dispatcher.targets {
+				wg.Add(1)
+				go func(target *dispatchTarget) {
+					defer wg.Done()
+					b.dispatchProbed(target, b.probeTarget(b.ctx, target))
+				}(target)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// probeTarget 向目标发送一次 OPTIONS，除 503 外的任何最终响应都表示目标可用
+func (b *B2BUA) probeTarget(ctx context.Context, target *dispatchTarget) error {
+	transport := "UDP"
+	if tp, ok := target.uri.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+		transport = strings.ToUpper(tp.String())
+	}
+	port := sip.DefaultPort(transport)
+	if target.uri.FPort != nil {
+		port = *target.uri.FPort
+	}
+	local := b.stack.GetNetworkInfo(transport)
+	localUri := &sip.SipUri{FHost: local.Host, FPort: local.Port}
+
+	callID := sip.CallID(util.RandString(32))
+	maxForwards := sip.MaxForwards(70)
+	req := sip.NewRequest("", sip.OPTIONS, target.uri.Clone(), "SIP/2.0", []sip.Header{
+		&sip.FromHeader{Address: localUri, Params: sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})},
+		&sip.ToHeader{Address: target.uri.Clone()},
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: sip.OPTIONS},
+		&maxForwards,
+	}, "", nil)
+
+	resp, err := b.sendRequest(ctx, req, transport, fmt.Sprintf("%v:%v", target.uri.FHost, port), b.dispatcher.config.Timeout)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == 503 {
+		return fmt.Errorf("%d %s", resp.StatusCode(), resp.Reason())
+	}
+	return nil
+}
+
+// dispatchProbed 记录一次探测的结果：连续失败达到上限时移除目标，成功时恢复
+func (b *B2BUA) dispatchProbed(target *dispatchTarget, err error) {
+	d := b.dispatcher
+	d.mutex.Lock()
+	target.lastProbe = time.Now()
+	changed := false
+	if err != nil {
+		target.failures++
+		target.lastError = err.Error()
+		if target.up && target.failures >= d.config.MaxFailures {
+			target.up, changed = false, true
+		}
+	} else {
+		target.failures = 0
+		target.lastError = ""
+		if !target.up {
+			target.up, changed = true, true
+			target.current = 0
+		}
+	}
+	d.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if err != nil {
+		logger.Warnf("Dispatcher target %s down: %v", target.config.URI, err)
+		b.metrics.Inc(MetricDispatcher + "down")
+		b.emit(EventDispatcherDown, map[string]interface{}{
+			"target": target.config.URI,
+			"error":  err.Error(),
+		})
+		return
+	}
+	logger.Infof("Dispatcher target %s recovered", target.config.URI)
+	b.metrics.Inc(MetricDispatcher + "up")
+	b.emit(EventDispatcherUp, map[string]interface{}{
+		"target": target.config.URI,
+	})
+}
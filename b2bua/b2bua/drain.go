@@ -0,0 +1,76 @@
+package b2bua
+
+import (
+	"time"
+)
+
+const (
+	drainPollInterval   = time.Second      // 排空期间检查通话数量的间隔
+	defaultDrainTimeout = 10 * time.Minute // REST 接口排空的默认超时时间
+)
+
+// drainState 保存排空（维护）模式的状态
+type drainState struct {
+	deadline time.Time // 排空截止时间
+}
+
+// Drain 进入排空模式：不再接受新的 INVITE 和新的注册（返回 503 和 Retry-After），
+// 已有通话继续进行，直到所有通话结束或超时后关闭 B2BUA。
+// 返回的 channel 在 B2BUA 关闭后被关闭；重复调用返回同一个 channel。
+func (b *B2BUA) Drain(timeout time.Duration) <-chan struct{} {
+	b.drainMu.Lock()
+	defer b.drainMu.Unlock()
+
+	if b.drain != nil {
+		return b.drained
+	}
+
+	state := &drainState{
+		deadline: time.Now().Add(timeout),
+	}
+	b.drain = state
+	logger.Infof("Draining: %d active calls, timeout %v", len(b.Calls()), timeout)
+
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			active := len(b.Calls())
+			if active == 0 {
+				logger.Infof("Drained: no active calls, shutting down")
+				break
+			}
+			if time.Now().After(state.deadline) {
+				logger.Warnf("Drain timeout: %d calls still active, shutting down", active)
+				break
+			}
+		}
+		b.Shutdown()
+		close(b.drained)
+	}()
+
+	return b.drained
+}
+
+// Drained 返回排空结束并关闭 B2BUA 后被关闭的 channel，未调用 Drain 的一方（如经 REST 接口排空时的 main）据此退出
+func (b *B2BUA) Drained() <-chan struct{} {
+	return b.drained
+}
+
+// IsDraining 返回 B2BUA 是否处于排空模式
+func (b *B2BUA) IsDraining() bool {
+	b.drainMu.Lock()
+	defer b.drainMu.Unlock()
+	return b.drain != nil
+}
+
+// drainRemaining 返回排空的剩余时间，未处于排空模式时返回 false
+func (b *B2BUA) drainRemaining() (time.Duration, bool) {
+	b.drainMu.Lock()
+	defer b.drainMu.Unlock()
+
+	if b.drain == nil {
+		return 0, false
+	}
+	return time.Until(b.drain.deadline), true
+}
@@ -0,0 +1,164 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+const defaultDTMFDuration = 100 * time.Millisecond // 对端未给出时长时使用的按键时长
+
+// DTMFConfig 按键（DTMF）处理配置
+type DTMFConfig struct {
+	Mode     string `json:"mode"`     // auto（默认）：两路方式不同时在 RFC 2833 与 SIP INFO 之间转换；transparent：按收到的方式透传
+	Duration int    `json:"duration"` // 转换时使用的按键时长（毫秒），默认 100
+}
+
+// DTMFHook 在收到一路的按键时调用，可用于路由或 IVR 逻辑。from 为发送按键的一路
+type DTMFHook func(call *B2BCall, from media.Leg, digit string)
+
+// dtmfHooks 保存已注册的按键回调
+type dtmfHooks struct {
+	mutex sync.RWMutex
+	hooks []DTMFHook
+}
+
+// OnDTMF 注册一个按键回调
+func (b *B2BUA) OnDTMF(hook DTMFHook) {
+	b.dtmfHooks.mutex.Lock()
+	defer b.dtmfHooks.mutex.Unlock()
+	b.dtmfHooks.hooks = append(b.dtmfHooks.hooks, hook)
+}
+
+// interworkDTMF 是否在 RFC 2833 与 SIP INFO 之间转换
+func (b *B2BUA) interworkDTMF() bool {
+	return !strings.EqualFold(b.config.DTMF.Mode, "transparent")
+}
+
+func (b *B2BUA) dtmfDuration(duration time.Duration) time.Duration {
+	if duration > 0 {
+		return duration
+	}
+	if b.config.DTMF.Duration > 0 {
+		return time.Duration(b.config.DTMF.Duration) * time.Millisecond
+	}
+	return defaultDTMFDuration
+}
+
+// watchDTMF 检测媒体中继转发的 RFC 2833 按键。同一按键的结束包会重复发送，按时间戳去重
+func (b *B2BUA) watchDTMF(call *B2BCall) {
+	if call.media == nil {
+		return
+	}
+	var mutex sync.Mutex
+	var ended [2]uint32
+	var seen [2]bool
+	call.media.relay.OnRTP(func(from media.Leg, codec string, packet []byte) {
+		if !strings.HasPrefix(strings.ToLower(codec), "telephone-event/") {
+			return
+		}
+		event, ok := media.ParseTelephoneEvent(packet)
+		if !ok || !event.End {
+			return
+		}
+		mutex.Lock()
+		duplicate := seen[from] && ended[from] == event.Timestamp
+		seen[from], ended[from] = true, event.Timestamp
+		mutex.Unlock()
+		if duplicate {
+			return
+		}
+		digit, ok := media.DTMFDigit(event.Event)
+		if !ok {
+			return
+		}
+		duration := time.Duration(event.Duration) * time.Second / 8000
+		b.receiveDTMF(call, from, digit, "rfc2833")
+		if b.interworkDTMF() && !call.media.relay.HasTelephoneEvent(from.Other()) { // 另一路未协商 telephone-event，改用 SIP INFO
+			if peer := b.peerSession(call, from); peer != nil {
+				peer.Info(media.DTMFInfoBody(digit, b.dtmfDuration(duration)), "application/dtmf-relay")
+			}
+		}
+	})
+}
+
+// handleInfo 处理对话内的 INFO：按键按另一路支持的方式转发，其他内容原样转发到另一路
+func (b *B2BUA) handleInfo(sess *session.Session, req sip.Request) {
+	call := b.findCall(sess)
+	if call == nil {
+		return
+	}
+	from := media.LegA
+	if call.dest == sess {
+		from = media.LegB
+	}
+	peer := b.peerSession(call, from)
+
+	contentType := ""
+	if hdrs := req.GetHeaders("Content-Type"); len(hdrs) > 0 {
+		contentType = hdrs[0].Value()
+	}
+	digit, duration, ok := media.ParseDTMFInfo(contentType, req.Body())
+	if ok {
+		b.receiveDTMF(call, from, digit, "info")
+		if b.inSurvey(call) { // 被叫已挂机
+			return
+		}
+		if b.interworkDTMF() && b.anchored(call) && call.media.relay.HasTelephoneEvent(from.Other()) { // 另一路支持 RFC 2833
+			go func() {
+				if err := call.media.relay.SendDTMF(from.Other(), digit, b.dtmfDuration(duration)); err != nil {
+					call.Log().Warnf("DTMF: %v", err)
+				}
+			}()
+			return
+		}
+	}
+	if peer != nil {
+		peer.Info(req.Body(), contentType)
+	}
+}
+
+// peerSession 返回 from 另一路的会话：A 路对应已应答（或唯一）的 B 路分支
+func (b *B2BUA) peerSession(call *B2BCall, from media.Leg) *session.Session {
+	if from == media.LegB {
+		return call.src
+	}
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	var peer *session.Session
+	for _, leg := range b.calls {
+		if leg.src != call.src || leg.dest == nil {
+			continue
+		}
+		if leg.dest.Status() == session.Confirmed {
+			return leg.dest
+		}
+		peer = leg.dest
+	}
+	return peer
+}
+
+// receiveDTMF 产生按键事件并调用按键回调
+func (b *B2BUA) receiveDTMF(call *B2BCall, from media.Leg, digit, method string) {
+	call.Log().Infof("DTMF %s from %s-Leg (%s)", digit, from, method)
+	if from == media.LegA && b.inSurvey(call) {
+		b.surveyDigit(call, digit)
+	}
+	b.emitFor(call.users, EventDTMF, map[string]interface{}{
+		"call_id": call.ID,
+		"leg":     from.String(),
+		"digit":   digit,
+		"method":  method,
+	})
+
+	b.dtmfHooks.mutex.RLock()
+	hooks := b.dtmfHooks.hooks
+	b.dtmfHooks.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook(call, from, digit)
+	}
+}
@@ -0,0 +1,41 @@
+package b2bua
+
+import (
+	"fmt"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 早期媒体策略：多个分支返回带 SDP 的 180/183 时转发给主叫的早期媒体
+const (
+	EarlyMediaFirst    = "first"    // 第一个带 SDP 的分支，该分支结束前其它分支的 SDP 不转发（默认）
+	EarlyMediaLatest   = "latest"   // 最后一个带 SDP 的分支，主叫的媒体随之切换
+	EarlyMediaRingback = "ringback" // 不转发早期媒体，向主叫发送不带 SDP 的 180，由主叫播放本地回铃音
+)
+
+// validateEarlyMedia 检查早期媒体策略
+func validateEarlyMedia(policy string) error {
+	switch policy {
+	case "", EarlyMediaFirst, EarlyMediaLatest, EarlyMediaRingback:
+		return nil
+	}
+	return fmt.Errorf("invalid early media policy %q", policy)
+}
+
+// forwardProvisional 将 B 路的临时响应转发给 A 路，按早期媒体策略决定是否携带该分支的 SDP
+func (b *B2BUA) forwardProvisional(call *B2BCall, resp sip.Response) {
+	code, reason := resp.StatusCode(), resp.Reason()
+	switch b.config.EarlyMedia {
+	case EarlyMediaRingback:
+		if code == 183 {
+			code, reason = 180, "Ringing"
+		}
+	case EarlyMediaLatest:
+		call.src.ProvideAnswer(b.relayAnswer(call))
+	default:
+		if call.dest.RemoteSdp() != "" && call.Context.selectEarlyMedia(call.dest) {
+			call.src.ProvideAnswer(b.relayAnswer(call))
+		}
+	}
+	b.sendProvisional(call, code, reason)
+}
@@ -0,0 +1,56 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// ENUMConfig ENUM 查询：经中继出局前查询被叫号码在 ENUM 树中的 NAPTR 记录（E2U+sip），有记录时直接经 SIP
+// 呼叫记录中的 URI，没有记录时经中继出局；SIP 目的地超时或返回 503 时切换到中继
+type ENUMConfig struct {
+	Enabled bool     `json:"enabled"`
+	Domains []string `json:"domains"` // 依次查询的 ENUM 树，默认 e164.arpa，可配置私有树如 e164.example.com
+	Trunks  []string `json:"trunks"`  // 只对经这些中继出局的呼叫查询，为空时对所有中继
+}
+
+// enumTargets 查询被叫号码的 ENUM 记录，返回经 SIP 直接呼叫的候选地址。未启用、中继不需要查询或没有记录时返回 nil
+func (b *B2BUA) enumTargets(call *B2BCall, called sip.Uri, trunk *TrunkConfig) []routeTarget {
+	config := b.config.ENUM
+	if !config.Enabled || !b.enumTrunk(trunk) {
+		return nil
+	}
+	number := routingNumber(called)
+	uri, err := b.resolver.LookupENUM(call.ctx, number, config.Domains)
+	if err != nil {
+		call.Log().Warnf("ENUM lookup of %s failed: %v", number, err)
+		b.metrics.Inc(MetricENUM + "error")
+		return nil
+	}
+	if uri == "" {
+		b.metrics.Inc(MetricENUM + "miss")
+		return nil
+	}
+	recipient, err := parser.ParseSipUri(uri)
+	if err != nil {
+		call.Log().Warnf("ENUM record of %s: invalid URI %q: %v", number, uri, err)
+		b.metrics.Inc(MetricENUM + "error")
+		return nil
+	}
+	call.Log().Infof("ENUM: %s => %s, trunk %s as fallback", number, uri, trunk.Name)
+	call.Context.Set("enum", uri)
+	b.metrics.Inc(MetricENUM + "hit")
+	return b.routeTargets(call, recipient, b.outboundProxy, nil)
+}
+
+// enumTrunk 检查经 trunk 出局的呼叫是否需要查询 ENUM
+func (b *B2BUA) enumTrunk(trunk *TrunkConfig) bool {
+	if len(b.config.ENUM.Trunks) == 0 {
+		return true
+	}
+	for _, name := range b.config.ENUM.Trunks {
+		if name == trunk.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/google/uuid"
+)
+
+// EventType 表示 B2BUA 事件的类型
+type EventType string
+
+const (
+	EventRegistrationAnomaly EventType = "registration.anomaly"      // 注册来源/设备发生异常变化
+	EventRegistered          EventType = "registration.registered"   // 联系地址注册或刷新
+	EventUnregistered        EventType = "registration.unregistered" // 联系地址注销
+	EventAuthFailed          EventType = "security.auth_failed"      // 摘要认证失败
+	EventSourceBanned        EventType = "security.banned"           // 来源 IP 被临时封禁
+	EventNumberBlocked       EventType = "security.number_blocked"   // 主叫或被叫号码被黑白名单拒绝
+	EventUpstreamDown        EventType = "upstream.down"             // 上游不可用，进入生存模式
+	EventUpstreamUp          EventType = "upstream.up"               // 上游恢复，退出生存模式
+	EventCallStarted         EventType = "call.started"              // 新呼叫，携带通话上下文
+	EventCallAnswered        EventType = "call.answered"             // 呼叫首次应答
+	EventCallEnded           EventType = "call.ended"                // 呼叫结束，携带话单
+	EventCallTagged          EventType = "call.tagged"               // 已结束的呼叫添加了标签或评分，携带话单和全部标签
+	EventCapacityExhausted   EventType = "capacity.exhausted"        // 媒体端口或转码容量耗尽
+	EventDTMF                EventType = "call.dtmf"                 // 收到一路的按键
+	EventFax                 EventType = "call.fax"                  // 检测到传真：T.38 协商成功、T.38 被拒绝回退到 G.711 透传或检测到传真音
+	EventAlertFiring         EventType = "alert.firing"              // 内置告警规则触发，携带告警
+	EventAlertResolved       EventType = "alert.resolved"            // 内置告警恢复，携带告警
+	EventConferenceJoined    EventType = "conference.joined"         // 与会者加入会议室
+	EventConferenceLeft      EventType = "conference.left"           // 与会者离开或被移出会议室
+	EventCallPickedUp        EventType = "call.picked_up"            // 振铃中的呼叫被其它账户代答
+	EventClusterRole         EventType = "cluster.role"              // 主备角色切换：备用接管为主用或主用转为备用
+	EventDispatcherDown      EventType = "dispatcher.down"           // 负载分发的目标连续探测失败，不再分发
+	EventDispatcherUp        EventType = "dispatcher.up"             // 负载分发的目标恢复
+)
+
+// Event 表示 B2BUA 内部产生的一个事件
+type Event struct {
+	ID    string                 `json:"id"`              // 事件唯一标识，至少一次投递时用于接收方去重
+	Type  EventType              `json:"type"`            // 事件类型
+	Time  time.Time              `json:"time"`            // 事件产生时间
+	Users []string               `json:"users,omitempty"` // 事件涉及的用户（user@domain），域名即租户
+	Data  map[string]interface{} `json:"data"`            // 事件附带的数据
+}
+
+// EventHandler 是事件回调函数，在产生事件的 goroutine 中同步调用，不应阻塞
+type EventHandler func(event *Event)
+
+// eventBus 保存已注册的事件回调
+type eventBus struct {
+	mutex    sync.RWMutex
+	handlers []EventHandler
+}
+
+// OnEvent 注册一个事件回调
+func (b *B2BUA) OnEvent(handler EventHandler) {
+	b.events.mutex.Lock()
+	defer b.events.mutex.Unlock()
+	b.events.handlers = append(b.events.handlers, handler)
+}
+
+// emit 产生一个不属于任何租户的事件并通知所有回调
+func (b *B2BUA) emit(eventType EventType, data map[string]interface{}) {
+	b.emitFor(nil, eventType, data)
+}
+
+// emitFor 产生一个与指定用户（user@domain）相关的事件并通知所有回调
+func (b *B2BUA) emitFor(users []string, eventType EventType, data map[string]interface{}) {
+	event := &Event{
+		ID:    uuid.New().String(),
+		Type:  eventType,
+		Time:  time.Now(),
+		Users: users,
+		Data:  data,
+	}
+	logger.Infof("Event [%s]: %v", eventType, data)
+
+	b.events.mutex.RLock()
+	handlers := b.events.handlers
+	b.events.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// userOf 返回 URI 对应的用户标识 user@domain
+func userOf(uri sip.Uri) string {
+	if uri.User() == nil {
+		return uri.Host()
+	}
+	return uri.User().String() + "@" + uri.Host()
+}
+
+// tenantOf 返回用户标识所属的租户（域名）
+func tenantOf(user string) string {
+	if idx := strings.LastIndex(user, "@"); idx >= 0 {
+		return strings.ToLower(user[idx+1:])
+	}
+	return strings.ToLower(user)
+}
@@ -0,0 +1,175 @@
+package b2bua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 状态快照的导出格式
+const (
+	ExportJSON       = "json" // JSON 文档
+	ExportPrometheus = "prom" // Prometheus 文本格式，可作为 node_exporter textfile 收集器的输入
+)
+
+// StateSnapshot 某一时刻的实例状态：计数器、当前通话和注册，用于无法抓取指标的隔离环境定期导出
+type StateSnapshot struct {
+	Time          time.Time           `json:"time"`
+	Instance      Identity            `json:"instance"`
+	Metrics       map[string]uint64   `json:"metrics"`
+	Calls         []callInfo          `json:"calls"`
+	Registrations []registrationState `json:"registrations"`
+	Queues        []QueueStatus       `json:"queues"`
+}
+
+// registrationState 快照中的一个注册联系地址
+type registrationState struct {
+	AOR       string `json:"aor"`
+	Contact   string `json:"contact"`
+	Source    string `json:"source"`
+	Transport string `json:"transport"`
+	UserAgent string `json:"user_agent"`
+	Expires   uint32 `json:"expires"`
+	Node      string `json:"node,omitempty"`     // 拥有该流的节点，本节点的注册为空
+	Instance  string `json:"instance,omitempty"` // 设备标识（+sip.instance）
+}
+
+// callInfos 返回当前通话，分叉的多个分支只列出一次
+func (b *B2BUA) callInfos() []callInfo {
+	calls := make([]callInfo, 0)
+	seen := make(map[string]bool)
+	for _, call := range b.Calls() {
+		if seen[call.ID] {
+			continue
+		}
+		seen[call.ID] = true
+		cause, _ := call.Context.releaseCause()
+		calls = append(calls, callInfo{
+			ID:      call.ID,
+			Caller:  call.Caller,
+			Callee:  call.Callee,
+			Class:   call.Class,
+			State:   call.State(),
+			Cause:   cause,
+			Start:   call.Start,
+			Context: call.Context.All(),
+		})
+	}
+	return calls
+}
+
+// State 返回当前的状态快照
+func (b *B2BUA) State() *StateSnapshot {
+	snapshot := &StateSnapshot{
+		Time:          time.Now(),
+		Instance:      b.Identity(),
+		Metrics:       b.Metrics(),
+		Calls:         b.callInfos(),
+		Registrations: make([]registrationState, 0),
+		Queues:        b.Queues(),
+	}
+	for aor, instances := range b.registry.GetAllContacts() {
+		for _, instance := range instances {
+			registration := registrationState{
+				AOR:       aor.String(),
+				Source:    instance.Source,
+				Transport: instance.Transport,
+				UserAgent: instance.UserAgent,
+				Expires:   instance.RegExpires,
+				Node:      instance.Node,
+				Instance:  instance.InstanceID,
+			}
+			if instance.Contact != nil && instance.Contact.Address != nil {
+				registration.Contact = instance.Contact.Address.String()
+			}
+			snapshot.Registrations = append(snapshot.Registrations, registration)
+		}
+	}
+	sort.Slice(snapshot.Registrations, func(i, j int) bool {
+		return snapshot.Registrations[i].AOR+snapshot.Registrations[i].Contact < snapshot.Registrations[j].AOR+snapshot.Registrations[j].Contact
+	})
+	return snapshot
+}
+
+// ExportState 以 json 或 prom 格式写出当前的状态快照
+func (b *B2BUA) ExportState(w io.Writer, format string) error {
+	snapshot := b.State()
+	switch format {
+	case ExportJSON, "":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(snapshot)
+	case ExportPrometheus:
+		return snapshot.writePrometheus(w)
+	}
+	return fmt.Errorf("invalid export format %q, expected json or prom", format)
+}
+
+// writePrometheus 以 Prometheus 文本格式写出快照：计数器、通话和注册的信息指标
+func (s *StateSnapshot) writePrometheus(w io.Writer) error {
+	var out strings.Builder
+	names := make([]string, 0, len(s.Metrics))
+	for name := range s.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metric := promName(name)
+		fmt.Fprintf(&out, "# TYPE %s untyped\n%s %d\n", metric, metric, s.Metrics[name])
+	}
+
+	out.WriteString("# TYPE b2bua_call_info gauge\n")
+	for _, call := range s.Calls {
+		fmt.Fprintf(&out, "b2bua_call_info{id=%s,caller=%s,callee=%s,class=%s} 1\n",
+			promLabel(call.ID), promLabel(call.Caller), promLabel(call.Callee), promLabel(call.Class))
+	}
+	out.WriteString("# TYPE b2bua_call_start_time_seconds gauge\n")
+	for _, call := range s.Calls {
+		fmt.Fprintf(&out, "b2bua_call_start_time_seconds{id=%s} %d\n", promLabel(call.ID), call.Start.Unix())
+	}
+	out.WriteString("# TYPE b2bua_registration_expires_seconds gauge\n")
+	for _, r := range s.Registrations {
+		fmt.Fprintf(&out, "b2bua_registration_expires_seconds{aor=%s,contact=%s,source=%s,transport=%s,user_agent=%s} %d\n",
+			promLabel(r.AOR), promLabel(r.Contact), promLabel(r.Source), promLabel(r.Transport), promLabel(r.UserAgent), r.Expires)
+	}
+	out.WriteString("# TYPE b2bua_queue_waiting gauge\n")
+	for _, q := range s.Queues {
+		fmt.Fprintf(&out, "b2bua_queue_waiting{queue=%s} %d\n", promLabel(q.Name), q.Waiting)
+	}
+	out.WriteString("# TYPE b2bua_queue_longest_wait_seconds gauge\n")
+	for _, q := range s.Queues {
+		fmt.Fprintf(&out, "b2bua_queue_longest_wait_seconds{queue=%s} %.1f\n", promLabel(q.Name), q.LongestWait)
+	}
+	out.WriteString("# TYPE b2bua_queue_agents gauge\n")
+	for _, q := range s.Queues {
+		states := make(map[string]int)
+		for _, agent := range q.Agents {
+			states[agent.State]++
+		}
+		for _, state := range []string{AgentAvailable, AgentBusy, AgentRinging, AgentTalking, AgentWrapUp, AgentOffline} {
+			fmt.Fprintf(&out, "b2bua_queue_agents{queue=%s,state=%s} %d\n", promLabel(q.Name), promLabel(state), states[state])
+		}
+	}
+	fmt.Fprintf(&out, "# TYPE b2bua_snapshot_time_seconds gauge\nb2bua_snapshot_time_seconds{instance=%s,version=%s} %d\n",
+		promLabel(s.Instance.Name), promLabel(s.Instance.Build), s.Time.Unix())
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// promName 将计数器名称转换为 Prometheus 指标名称，如 capacity.calls 转换为 b2bua_capacity_calls
+func promName(name string) string {
+	return "b2bua_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// promLabel 返回加引号并转义的标签值
+func promLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
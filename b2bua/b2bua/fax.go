@@ -0,0 +1,72 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+)
+
+// T.38 re-INVITE 的处理方式
+const (
+	FaxPassthrough = "passthrough" // 将 T.38 re-INVITE 转发到另一路，媒体中继透传 UDPTL
+	FaxG711        = "g711"        // 以 488 拒绝 T.38，两端保持 G.711 透传传真
+)
+
+// FaxConfig 传真处理配置
+type FaxConfig struct {
+	T38    string `json:"t38"`    // T.38 re-INVITE 的处理：passthrough（默认）或 g711。passthrough 时另一路拒绝 T.38 同样以拒绝应答，发起方回退到 G.711 透传
+	Detect bool   `json:"detect"` // 在媒体中继中检测 CNG/CED 传真音，需要启用媒体中继
+}
+
+// acceptT38 检查是否转发 from 一路发起的 T.38 re-INVITE
+func (b *B2BUA) acceptT38(call *B2BCall, from media.Leg) bool {
+	if strings.EqualFold(b.config.Fax.T38, FaxG711) {
+		call.Log().Infof("Fax: T.38 from %s-Leg rejected, staying on G.711 pass-through", from)
+		b.metrics.Inc(MetricFax + "t38.rejected")
+		b.faxDetected(call, from, "g711")
+		return false
+	}
+	return true
+}
+
+// faxFallback 另一路拒绝 T.38 时记录回退到 G.711 透传
+func (b *B2BUA) faxFallback(call *B2BCall, to media.Leg, code sip.StatusCode) {
+	call.Log().Infof("Fax: %s-Leg refused T.38 (%d), falling back to G.711 pass-through", to, code)
+	b.metrics.Inc(MetricFax + "t38.refused")
+	b.faxDetected(call, to.Other(), "g711")
+}
+
+// watchFax 检测媒体中继转发的 G.711 音频中的传真音。两路各检测一次，检测到后记录在呼叫上下文中
+func (b *B2BUA) watchFax(call *B2BCall) {
+	if call.media == nil || !b.config.Fax.Detect {
+		return
+	}
+	var mutex sync.Mutex
+	detectors := [2]*media.FaxDetector{media.NewFaxDetector(), media.NewFaxDetector()}
+	call.media.relay.OnRTP(func(from media.Leg, codec string, packet []byte) {
+		mutex.Lock()
+		tone, ok := detectors[from].Detect(codec, packet)
+		mutex.Unlock()
+		if ok {
+			call.Log().Infof("Fax: %s tone from %s-Leg", tone, from)
+			b.faxDetected(call, from, strings.ToLower(string(tone)))
+		}
+	})
+}
+
+// faxDetected 产生传真事件。mode 为 t38、g711（T.38 被拒绝后的 G.711 透传）或检测到的传真音 cng、ced
+func (b *B2BUA) faxDetected(call *B2BCall, from media.Leg, mode string) {
+	b.metrics.Inc(MetricFax + mode)
+	if mode == "t38" || mode == "g711" {
+		call.Context.Set("fax", mode)
+	} else if _, found := call.Context.Get("fax"); !found {
+		call.Context.Set("fax", "g711")
+	}
+	b.emitFor(call.users, EventFax, map[string]interface{}{
+		"call_id": call.ID,
+		"leg":     from.String(),
+		"mode":    mode,
+	})
+}
@@ -0,0 +1,306 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// 默认的功能码
+const (
+	defaultRejectAnonymousOn  = "*77" // 开启匿名呼叫拒绝
+	defaultRejectAnonymousOff = "*87" // 关闭匿名呼叫拒绝
+	defaultForwardAllOn       = "*72" // 开启无条件前转，后接目的号码
+	defaultForwardAllOff      = "*73" // 关闭无条件前转
+	defaultDoNotDisturb       = "*76" // 切换免打扰
+	defaultCallback           = "*69" // 回拨最近一次来电
+)
+
+const (
+	featureAckTimeout  = 5 * time.Second        // 应答功能码呼叫后等待 ACK 的时间
+	featureHangupDelay = 500 * time.Millisecond // 未配置确认音时应答后挂机前的等待
+)
+
+// AccountFeatures 账户的呼叫功能，可通过配置、功能码或 REST 接口设置
+type AccountFeatures struct {
+	RejectAnonymous bool   `json:"reject_anonymous"`            // 拒绝隐藏主叫号码的来电（433 Anonymity Disallowed）
+	ForwardAll      string `json:"forward_all,omitempty"`       // 无条件前转（CFU）的目的号码或 SIP URI，为空时不前转
+	ForwardBusy     string `json:"forward_busy,omitempty"`      // 遇忙前转（CFB）的目的地，被叫返回 486 或 600 时前转
+	ForwardNoAnswer string `json:"forward_no_answer,omitempty"` // 无应答前转（CFNA）的目的地，振铃超时或被叫返回 408、480 时前转
+	NoAnswerTimeout int    `json:"no_answer_timeout,omitempty"` // 振铃超时（秒），超时后无应答前转或转语音信箱；未设置时设置了无应答前转为 20，否则使用全局 ring_timeout
+	DoNotDisturb    bool   `json:"do_not_disturb,omitempty"`    // 免打扰：来电按遇忙处理，设置了遇忙前转时前转，否则返回 486
+}
+
+// FeatureCodesConfig 功能码配置：本地账户拨打功能码时修改自己的功能设置，不呼叫其它用户。
+// 启用媒体中继时应答呼叫、播放确认音后挂机，否则以带说明的 603 结束呼叫
+type FeatureCodesConfig struct {
+	RejectAnonymousOn  string `json:"reject_anonymous_on"`  // 开启匿名呼叫拒绝，默认 *77
+	RejectAnonymousOff string `json:"reject_anonymous_off"` // 关闭匿名呼叫拒绝，默认 *87
+	ForwardAllOn       string `json:"forward_all_on"`       // 开启无条件前转，后接目的号码（如 *72100），默认 *72
+	ForwardAllOff      string `json:"forward_all_off"`      // 关闭无条件前转，默认 *73
+	DoNotDisturb       string `json:"do_not_disturb"`       // 切换免打扰，默认 *76
+	Callback           string `json:"callback"`             // 回拨最近一次未隐藏号码的来电，默认 *69
+	GroupPickup        string `json:"group_pickup"`         // 代答所在代答组（pickup_groups）中正在振铃的呼叫，默认 *8
+	DirectedPickup     string `json:"directed_pickup"`      // 代答指定分机正在振铃的呼叫，后接分机号（如 **101），默认 **
+	Intercom           string `json:"intercom"`             // 对讲：后接分机号（如 *80101），被叫话机免提自动应答，默认 *80
+	ConfirmTone        string `json:"confirm_tone"`         // 修改设置后播放一遍的确认音（WAV），需要媒体中继
+}
+
+// accountFeatures 按账户保存的功能设置
+type accountFeatures struct {
+	mutex       sync.Mutex
+	accounts    map[string]AccountFeatures
+	lastCallers map[string]sip.Uri // 各账户最近一次未隐藏号码的来电的主叫，用于回拨
+}
+
+// newAccountFeatures 从配置创建账户功能设置
+func newAccountFeatures(config map[string]AccountFeatures) *accountFeatures {
+	f := &accountFeatures{accounts: make(map[string]AccountFeatures), lastCallers: make(map[string]sip.Uri)}
+	for user, features := range config {
+		f.accounts[user] = features
+	}
+	return f
+}
+
+// Features 返回账户的功能设置
+func (b *B2BUA) Features(username string) AccountFeatures {
+	b.features.mutex.Lock()
+	defer b.features.mutex.Unlock()
+	return b.features.accounts[username]
+}
+
+// SetFeatures 设置账户的功能
+func (b *B2BUA) SetFeatures(username string, features AccountFeatures) {
+	b.features.mutex.Lock()
+	defer b.features.mutex.Unlock()
+	b.features.accounts[username] = features
+	logger.Infof("Features of %s: %+v", username, features)
+}
+
+// updateFeatures 在锁内修改账户的功能设置
+func (b *B2BUA) updateFeatures(username string, update func(*AccountFeatures)) AccountFeatures {
+	b.features.mutex.Lock()
+	defer b.features.mutex.Unlock()
+	features := b.features.accounts[username]
+	update(&features)
+	b.features.accounts[username] = features
+	logger.Infof("Features of %s: %+v", username, features)
+	return features
+}
+
+// featureCode 返回功能码的配置值，未配置时使用默认值
+func featureCode(code, fallback string) string {
+	if code != "" {
+		return code
+	}
+	return fallback
+}
+
+// localCaller 返回发起请求的本地账户：认证的账户，或不需要认证时 From 中已配置的账户。不是本地账户时返回空
+func (b *B2BUA) localCaller(req sip.Request) string {
+	if user := b.authenticatedUser(req); user != "" {
+		return user
+	}
+	from, _ := req.From()
+	if b.requiresChallenge(req) || from == nil || from.Address == nil || from.Address.User() == nil {
+		return ""
+	}
+	if _, found := b.accounts[from.Address.User().String()]; found {
+		return from.Address.User().String()
+	}
+	return ""
+}
+
+// handleFeatureCode 本地账户拨打功能码时修改其功能设置并结束呼叫，返回 true。拨打回拨功能码时将被叫改为
+// 最近一次来电的主叫，返回 false 继续路由。不是功能码时返回 false
+func (b *B2BUA) handleFeatureCode(call *B2BCall, sess *session.Session, req sip.Request) bool {
+	to, _ := req.To()
+	if to == nil || to.Address == nil || to.Address.User() == nil {
+		return false
+	}
+	dialed := to.Address.User().String()
+	if !strings.HasPrefix(dialed, "*") {
+		return false
+	}
+	user := b.localCaller(req)
+	if user == "" {
+		return false
+	}
+
+	codes := b.config.FeatureCodes
+	forwardOn := featureCode(codes.ForwardAllOn, defaultForwardAllOn)
+	directedPickup := featureCode(codes.DirectedPickup, defaultDirectedPickup)
+	intercom := featureCode(codes.Intercom, defaultIntercom)
+	var name, status string
+	switch {
+	case dialed == featureCode(codes.RejectAnonymousOn, defaultRejectAnonymousOn):
+		name, status = "reject_anonymous_on", "Anonymous Call Rejection On"
+		b.updateFeatures(user, func(features *AccountFeatures) { features.RejectAnonymous = true })
+	case dialed == featureCode(codes.RejectAnonymousOff, defaultRejectAnonymousOff):
+		name, status = "reject_anonymous_off", "Anonymous Call Rejection Off"
+		b.updateFeatures(user, func(features *AccountFeatures) { features.RejectAnonymous = false })
+	case dialed == featureCode(codes.ForwardAllOff, defaultForwardAllOff):
+		name, status = "forward_all_off", "Call Forwarding Off"
+		b.updateFeatures(user, func(features *AccountFeatures) { features.ForwardAll = "" })
+	case strings.HasPrefix(dialed, forwardOn):
+		target := strings.TrimPrefix(dialed, forwardOn)
+		if target == "" {
+			sess.Reject(484, "Address Incomplete", b.warning(399, "forwarding target required"))
+			b.finishCall(call, session.Failure)
+			return true
+		}
+		if err := b.checkForwardTargets(user, AccountFeatures{ForwardAll: target}); err != nil {
+			call.Log().Warnf("Feature code %s: %v", dialed, err)
+			sess.Reject(403, "Forbidden", b.warning(399, "forwarding target not allowed"))
+			b.finishCall(call, session.Failure)
+			return true
+		}
+		name, status = "forward_all_on", "Call Forwarding On"
+		b.updateFeatures(user, func(features *AccountFeatures) { features.ForwardAll = target })
+	case dialed == featureCode(codes.DoNotDisturb, defaultDoNotDisturb):
+		name, status = "do_not_disturb", "Do Not Disturb Off"
+		features := b.updateFeatures(user, func(features *AccountFeatures) { features.DoNotDisturb = !features.DoNotDisturb })
+		if features.DoNotDisturb {
+			status = "Do Not Disturb On"
+		}
+	case dialed == featureCode(codes.Callback, defaultCallback):
+		b.metrics.Inc(MetricFeatureCode + "callback")
+		return b.callback(call, sess, user)
+	case dialed == featureCode(codes.GroupPickup, defaultGroupPickup):
+		return b.groupPickup(call, sess, user)
+	case strings.HasPrefix(dialed, intercom) && len(dialed) > len(intercom):
+		return b.intercom(call, sess, user, strings.TrimPrefix(dialed, intercom))
+	case strings.HasPrefix(dialed, directedPickup) && len(dialed) > len(directedPickup):
+		return b.pickup(call, sess, user, "directed", map[string]bool{strings.TrimPrefix(dialed, directedPickup): true})
+	default:
+		return false
+	}
+	call.Log().Infof("Feature code %s: %s for %s", dialed, status, user)
+	b.metrics.Inc(MetricFeatureCode + name)
+	call.Context.Set("feature_code", name)
+	b.confirmFeature(call, sess, status)
+	return true
+}
+
+// confirmFeature 功能码处理完成后结束呼叫：启用媒体中继时应答、播放确认音后挂机，否则以带说明的 603 拒绝
+func (b *B2BUA) confirmFeature(call *B2BCall, sess *session.Session, status string) {
+	answer := ""
+	if call.media != nil {
+		var err error
+		if answer, err = call.media.relay.Answer(media.LegA, sess.RemoteSdp()); err != nil {
+			call.Log().Warnf("Feature code: answer failed: %v", err)
+		}
+	}
+	if answer == "" {
+		sess.Reject(603, status, b.warning(399, strings.ToLower(status)))
+		b.finishCall(call, session.Failure)
+		return
+	}
+
+	sess.ProvideAnswer(answer)
+	sess.Accept(200)
+	b.callAnswered(call)
+	go func() {
+		deadline := time.Now().Add(featureAckTimeout)
+		for sess.Status() != session.Confirmed && !sess.IsEnded() && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if tone := b.featureTone; tone != nil && call.media.relay.Play(media.LegA, tone) == nil {
+			time.Sleep(time.Duration(len(tone.Samples)) * time.Second / time.Duration(tone.Rate))
+			call.media.relay.StopPlay(media.LegA)
+		} else {
+			time.Sleep(featureHangupDelay)
+		}
+		if !sess.IsEnded() {
+			sess.End()
+		}
+		b.finishCall(call, session.Terminated)
+	}()
+}
+
+// callback 将被叫改为账户最近一次来电的主叫。没有记录时以 404 拒绝 A 路并返回 true
+func (b *B2BUA) callback(call *B2BCall, sess *session.Session, user string) bool {
+	b.features.mutex.Lock()
+	last := b.features.lastCallers[user]
+	b.features.mutex.Unlock()
+	if last == nil {
+		call.Log().Infof("Callback: no caller to call back for %s", user)
+		sess.Reject(404, "Not Found", b.warning(399, "no caller to call back"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	call.Log().Infof("Callback: %s calls back %s", user, last)
+	call.called = last.Clone()
+	call.Callee = last.String()
+	call.Context.Set("feature_code", "callback")
+	return false
+}
+
+// recordCaller 记录本地账户的来电主叫，用于回拨。隐藏号码的来电不记录
+func (b *B2BUA) recordCaller(called sip.Uri, req sip.Request) {
+	if called.User() == nil || isAnonymous(req) {
+		return
+	}
+	user := called.User().String()
+	if _, found := b.accounts[user]; !found {
+		return
+	}
+	from, _ := req.From()
+	b.features.mutex.Lock()
+	defer b.features.mutex.Unlock()
+	b.features.lastCallers[user] = from.Address.Clone()
+}
+
+// doNotDisturb 被叫开启了免打扰时按遇忙处理：设置了遇忙前转时返回前转后的被叫，否则以 486 拒绝 A 路并返回 nil。
+// 未开启时返回原被叫
+func (b *B2BUA) doNotDisturb(call *B2BCall, called sip.Uri) sip.Uri {
+	if called.User() == nil || !b.Features(called.User().String()).DoNotDisturb {
+		return called
+	}
+	user := called.User().String()
+	call.Log().Infof("Do not disturb: %s", user)
+	b.metrics.Inc(MetricDoNotDisturb)
+	if next := b.divert(call, user, called, ForwardBusy); next != nil {
+		return next
+	}
+	call.src.Reject(486, "Busy Here", b.warning(399, "do not disturb"))
+	b.finishCall(call, session.Failure)
+	return nil
+}
+
+// isAnonymous 检查来电是否隐藏了主叫号码：From 为 anonymous 或 anonymous.invalid，或请求了 Privacy: id、user、header
+func isAnonymous(req sip.Request) bool {
+	for _, value := range privacyValues(req) {
+		if value == "id" || value == "user" || value == "header" {
+			return true
+		}
+	}
+	from, _ := req.From()
+	if from == nil || from.Address == nil {
+		return true
+	}
+	if strings.EqualFold(from.Address.Host(), "anonymous.invalid") {
+		return true
+	}
+	if from.Address.User() == nil {
+		return false
+	}
+	switch strings.ToLower(from.Address.User().String()) {
+	case "anonymous", "restricted", "withheld", "unavailable":
+		return true
+	}
+	return false
+}
+
+// rejectsAnonymous 检查被叫的本地账户是否拒绝该匿名来电
+func (b *B2BUA) rejectsAnonymous(req sip.Request) bool {
+	to, _ := req.To()
+	if to == nil || to.Address == nil || to.Address.User() == nil {
+		return false
+	}
+	return b.Features(to.Address.User().String()).RejectAnonymous && isAnonymous(req)
+}
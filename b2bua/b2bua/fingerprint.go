@@ -0,0 +1,158 @@
+package b2bua
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go-sip-ua/pkg/utils"
+)
+
+// FingerprintPolicy 表示检测到设备指纹异常时的处理策略
+type FingerprintPolicy string
+
+const (
+	FingerprintOff    FingerprintPolicy = ""       // 不检测
+	FingerprintAlert  FingerprintPolicy = "alert"  // 仅产生事件
+	FingerprintReauth FingerprintPolicy = "reauth" // 产生事件并要求重新认证
+	FingerprintBlock  FingerprintPolicy = "block"  // 产生事件并拒绝注册
+)
+
+const (
+	maxKnownFingerprints = 8                // 每个账户记住的设备类型/网络数量上限
+	reauthWindow         = 30 * time.Second // 要求重新认证后，等待客户端重新提交凭证的时间
+)
+
+// FingerprintConfig 注册设备指纹异常检测配置
+type FingerprintConfig struct {
+	Policy FingerprintPolicy `json:"policy"`
+	// CountryResolver 可选，根据 IP 返回国家代码；设置后按国家而不是网段判断来源变化
+	CountryResolver func(ip net.IP) string `json:"-"`
+}
+
+// fingerprint 表示一次注册的设备指纹
+type fingerprint struct {
+	device  string // User-Agent 中的产品名，例如 yealink
+	network string // 来源网段或国家
+}
+
+// deviceHistory 记录一个账户见过的设备类型和来源网络
+type deviceHistory struct {
+	devices  map[string]time.Time
+	networks map[string]time.Time
+	reauth   map[fingerprint]time.Time // 已要求重新认证、等待确认的指纹
+}
+
+// fingerprintTracker 按账户跟踪注册设备指纹
+type fingerprintTracker struct {
+	mutex    sync.Mutex
+	config   FingerprintConfig
+	accounts map[string]*deviceHistory
+}
+
+func newFingerprintTracker(config FingerprintConfig) *fingerprintTracker {
+	return &fingerprintTracker{
+		config:   config,
+		accounts: make(map[string]*deviceHistory),
+	}
+}
+
+// fingerprintOf 根据 User-Agent 和来源地址计算指纹
+func (ft *fingerprintTracker) fingerprintOf(userAgent, source string) fingerprint {
+	device := strings.ToLower(strings.TrimSpace(userAgent))
+	if idx := strings.IndexAny(device, "/ "); idx > 0 {
+		device = device[:idx]
+	}
+
+	network := utils.GetIP(source)
+	if ip := net.ParseIP(network); ip != nil {
+		if ft.config.CountryResolver != nil {
+			network = ft.config.CountryResolver(ip)
+		} else if ip4 := ip.To4(); ip4 != nil {
+			network = (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+		} else {
+			network = (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+		}
+	}
+	return fingerprint{device: device, network: network}
+}
+
+// Check 检查账户的一次注册，返回是否异常以及异常原因。
+// 首次注册的账户直接学习指纹；确认后的指纹会被记住，后续不再报警。
+// reauthed 表示该指纹之前已被要求重新认证，本次注册为重新认证后的结果。
+func (ft *fingerprintTracker) Check(user string, fp fingerprint) (anomalies []string, reauthed bool) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	now := time.Now()
+	history, found := ft.accounts[user]
+	if !found {
+		history = &deviceHistory{
+			devices:  make(map[string]time.Time),
+			networks: make(map[string]time.Time),
+			reauth:   make(map[fingerprint]time.Time),
+		}
+		ft.accounts[user] = history
+		history.learn(fp, now)
+		return nil, false
+	}
+
+	if at, ok := history.reauth[fp]; ok {
+		delete(history.reauth, fp)
+		if now.Sub(at) <= reauthWindow {
+			history.learn(fp, now)
+			return nil, true
+		}
+	}
+
+	if _, ok := history.devices[fp.device]; !ok {
+		anomalies = append(anomalies, "new device "+fp.device)
+	}
+	if _, ok := history.networks[fp.network]; !ok {
+		anomalies = append(anomalies, "new network "+fp.network)
+	}
+	if len(anomalies) == 0 {
+		history.learn(fp, now)
+	}
+	return anomalies, false
+}
+
+// Accept 将异常指纹标记为可信（策略为 alert 时使用）
+func (ft *fingerprintTracker) Accept(user string, fp fingerprint) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	if history, found := ft.accounts[user]; found {
+		history.learn(fp, time.Now())
+	}
+}
+
+// RequireReauth 记录一个等待重新认证的指纹
+func (ft *fingerprintTracker) RequireReauth(user string, fp fingerprint) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	if history, found := ft.accounts[user]; found {
+		history.reauth[fp] = time.Now()
+	}
+}
+
+// learn 记住一个指纹，超过上限时淘汰最久未见的记录
+func (h *deviceHistory) learn(fp fingerprint, now time.Time) {
+	h.devices[fp.device] = now
+	h.networks[fp.network] = now
+	evictOldest(h.devices)
+	evictOldest(h.networks)
+}
+
+func evictOldest(seen map[string]time.Time) {
+	for len(seen) > maxKnownFingerprints {
+		var oldest string
+		var oldestAt time.Time
+		for key, at := range seen {
+			if oldest == "" || at.Before(oldestAt) {
+				oldest, oldestAt = key, at
+			}
+		}
+		delete(seen, oldest)
+	}
+}
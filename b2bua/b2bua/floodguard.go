@@ -0,0 +1,305 @@
+package b2bua
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	defaultRateWindow   = 60  // 默认统计窗口（秒）
+	defaultBanTime      = 600 // 默认封禁时长（秒）
+	floodGuardSweepTime = time.Minute
+)
+
+// RateLimitConfig 来源 IP 限速与防洪配置
+type RateLimitConfig struct {
+	Rate         float64 `json:"rate"`          // 每个来源 IP 每秒允许的请求数，0 表示不限速
+	Burst        int     `json:"burst"`         // 令牌桶容量，0 表示使用 2 倍速率
+	AuthFailures int     `json:"auth_failures"` // 统计窗口内认证失败达到该次数时封禁，0 表示不封禁
+	Malformed    int     `json:"malformed"`     // 统计窗口内畸形请求达到该次数时封禁，0 表示不封禁
+	Window       int     `json:"window"`        // 统计窗口（秒）
+	BanTime      int     `json:"ban_time"`      // 封禁时长（秒）
+}
+
+// Ban 表示一个被临时封禁的来源地址
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// offenseCounter 统计窗口内的违规次数
+type offenseCounter struct {
+	authFailures int
+	malformed    int
+	windowStart  time.Time
+}
+
+// floodGuard 按来源 IP 进行限速并在多次违规后临时封禁
+type floodGuard struct {
+	mutex    sync.Mutex
+	config   RateLimitConfig
+	buckets  map[string]*tokenBucket
+	offenses map[string]*offenseCounter
+	bans     map[string]*Ban
+}
+
+func newFloodGuard(config RateLimitConfig) *floodGuard {
+	if config.Burst <= 0 {
+		config.Burst = int(config.Rate*2) + 1
+	}
+	if config.Window <= 0 {
+		config.Window = defaultRateWindow
+	}
+	if config.BanTime <= 0 {
+		config.BanTime = defaultBanTime
+	}
+	fg := &floodGuard{
+		config:   config,
+		buckets:  make(map[string]*tokenBucket),
+		offenses: make(map[string]*offenseCounter),
+		bans:     make(map[string]*Ban),
+	}
+	return fg
+}
+
+// run 定期清理过期的令牌桶、违规计数和封禁，stop 关闭时退出
+func (fg *floodGuard) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(floodGuardSweepTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			fg.sweep(now)
+		}
+	}
+}
+
+// Allow 检查来源 IP 是否被封禁以及是否超过速率
+func (fg *floodGuard) Allow(ip string) bool {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	now := time.Now()
+	if ban, found := fg.bans[ip]; found {
+		if now.Before(ban.Until) {
+			return false
+		}
+		delete(fg.bans, ip)
+	}
+
+	if fg.config.Rate <= 0 {
+		return true
+	}
+
+	bucket, found := fg.buckets[ip]
+	if !found {
+		bucket = &tokenBucket{tokens: float64(fg.config.Burst), last: now}
+		fg.buckets[ip] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * fg.config.Rate
+	if bucket.tokens > float64(fg.config.Burst) {
+		bucket.tokens = float64(fg.config.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RecordAuthFailure 记录一次认证失败，返回是否因此封禁
+func (fg *floodGuard) RecordAuthFailure(ip string) (*Ban, bool) {
+	return fg.record(ip, func(counter *offenseCounter) bool {
+		counter.authFailures++
+		return fg.config.AuthFailures > 0 && counter.authFailures >= fg.config.AuthFailures
+	}, "repeated auth failures")
+}
+
+// RecordMalformed 记录一次畸形请求，返回是否因此封禁
+func (fg *floodGuard) RecordMalformed(ip string) (*Ban, bool) {
+	return fg.record(ip, func(counter *offenseCounter) bool {
+		counter.malformed++
+		return fg.config.Malformed > 0 && counter.malformed >= fg.config.Malformed
+	}, "malformed request flood")
+}
+
+func (fg *floodGuard) record(ip string, count func(counter *offenseCounter) bool, reason string) (*Ban, bool) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	now := time.Now()
+	counter, found := fg.offenses[ip]
+	if !found || now.Sub(counter.windowStart) > time.Duration(fg.config.Window)*time.Second {
+		counter = &offenseCounter{windowStart: now}
+		fg.offenses[ip] = counter
+	}
+	if !count(counter) {
+		return nil, false
+	}
+
+	delete(fg.offenses, ip)
+	ban := &Ban{
+		IP:     ip,
+		Reason: reason,
+		Until:  now.Add(time.Duration(fg.config.BanTime) * time.Second),
+	}
+	fg.bans[ip] = ban
+	return ban, true
+}
+
+// Bans 返回当前生效的封禁列表，按到期时间排序
+func (fg *floodGuard) Bans() []Ban {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(fg.bans))
+	for _, ban := range fg.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Unban 解除对来源 IP 的封禁
+func (fg *floodGuard) Unban(ip string) bool {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	_, found := fg.bans[ip]
+	delete(fg.bans, ip)
+	delete(fg.offenses, ip)
+	return found
+}
+
+// sweep 清理过期的封禁、计数器和空闲的令牌桶
+func (fg *floodGuard) sweep(now time.Time) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	for ip, ban := range fg.bans {
+		if !now.Before(ban.Until) {
+			delete(fg.bans, ip)
+		}
+	}
+	for ip, counter := range fg.offenses {
+		if now.Sub(counter.windowStart) > time.Duration(fg.config.Window)*time.Second {
+			delete(fg.offenses, ip)
+		}
+	}
+	for ip, bucket := range fg.buckets {
+		if now.Sub(bucket.last) > floodGuardSweepTime {
+			delete(fg.buckets, ip)
+		}
+	}
+}
+
+// sourceIP 返回请求的来源 IP
+func sourceIP(req sip.Request) string {
+	source := req.Source()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		return host
+	}
+	return source
+}
+
+// isWellFormed 检查请求是否包含必需的头部，且 CSeq 方法与请求方法一致
+func isWellFormed(req sip.Request) bool {
+	if _, ok := req.From(); !ok {
+		return false
+	}
+	if _, ok := req.To(); !ok {
+		return false
+	}
+	if _, ok := req.CallID(); !ok {
+		return false
+	}
+	cseq, ok := req.CSeq()
+	return ok && cseq.MethodName == req.Method()
+}
+
+// filterRequest 在请求进入处理函数之前执行来源检查，返回 false 表示丢弃请求
+func (b *B2BUA) filterRequest(req sip.Request, tx sip.ServerTransaction) bool {
+	ip := sourceIP(req)
+	if !b.floodGuard.Allow(ip) {
+		b.metrics.Inc(MetricRateLimited)
+		return false
+	}
+
+	if !b.filterScanner(req, tx) { // 在认证之前过滤扫描器流量
+		return false
+	}
+
+	if !isWellFormed(req) {
+		b.metrics.Inc(MetricMalformed)
+		if ban, banned := b.floodGuard.RecordMalformed(ip); banned {
+			b.emitBan(ban)
+		}
+		if tx != nil {
+			tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 400, "Bad Request", ""))
+		}
+		return false
+	}
+
+	if !b.filterACL(req, tx) { // 在认证之前执行来源访问控制
+		return false
+	}
+	if !b.filterDomain(req, tx) { // profile 不服务的域名
+		return false
+	}
+	return b.paceRegister(req, tx) // 注册风暴时的准入控制
+}
+
+// handleAuthFailure 记录认证失败并产生 security.auth_failed 事件，多次失败后封禁来源 IP
+func (b *B2BUA) handleAuthFailure(req sip.Request, reason string) {
+	ip := sourceIP(req)
+	logger.Warnf("Auth failure from %s: %s", ip, reason)
+	data := map[string]interface{}{
+		"ip":     ip,
+		"method": string(req.Method()),
+		"reason": reason,
+	}
+	var users []string
+	if from, ok := req.From(); ok && from.Address != nil {
+		data["from"] = from.Address.String()
+		users = []string{userOf(from.Address)}
+	}
+	b.emitFor(users, EventAuthFailed, data)
+	if ban, banned := b.floodGuard.RecordAuthFailure(ip); banned {
+		b.emitBan(ban)
+	}
+}
+
+func (b *B2BUA) emitBan(ban *Ban) {
+	b.emit(EventSourceBanned, map[string]interface{}{
+		"ip":     ban.IP,
+		"reason": ban.Reason,
+		"until":  ban.Until,
+	})
+}
+
+// Bans 返回当前被临时封禁的来源地址
+func (b *B2BUA) Bans() []Ban {
+	return b.floodGuard.Bans()
+}
+
+// Unban 解除对来源 IP 的封禁
+func (b *B2BUA) Unban(ip string) bool {
+	return b.floodGuard.Unban(ip)
+}
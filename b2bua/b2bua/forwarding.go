@@ -0,0 +1,178 @@
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// 前转原因，用作 Diversion 头域的 reason（RFC 5806）
+const (
+	ForwardUnconditional = "unconditional"
+	ForwardBusy          = "user-busy"
+	ForwardNoAnswer      = "no-answer"
+)
+
+const (
+	defaultNoAnswerTimeout = 20 // 默认的无应答前转振铃时间（秒）
+	maxDiversions          = 5  // 一个呼叫最多前转的次数，防止前转环路
+)
+
+// ErrForwardNotAllowed 前转目的地被账户所属租户的被叫号码名单拒绝
+var ErrForwardNotAllowed = errors.New("forwarding target not allowed")
+
+// forwardTarget 返回账户按原因设置的前转目的地
+func (f AccountFeatures) forwardTarget(reason string) string {
+	switch reason {
+	case ForwardUnconditional:
+		return f.ForwardAll
+	case ForwardBusy:
+		return f.ForwardBusy
+	case ForwardNoAnswer:
+		return f.ForwardNoAnswer
+	}
+	return ""
+}
+
+// forwardURI 将前转目的地解析为 URI，只有号码时使用被叫的域名
+func forwardURI(target string, called sip.Uri) (sip.Uri, error) {
+	if !strings.Contains(target, ":") {
+		target = "sip:" + target + "@" + called.Host()
+	}
+	uri, err := parser.ParseSipUri(target)
+	if err != nil {
+		return nil, err
+	}
+	return &uri, nil
+}
+
+// checkForwardTargets 检查账户的各前转目的地：须为号码或有效的 SIP URI，且通过账户所属租户的被叫号码名单，
+// 使前转不能绕过账户自己的呼叫限制
+func (b *B2BUA) checkForwardTargets(username string, features AccountFeatures) error {
+	account, err := b.ParseAOR(username)
+	if err != nil {
+		return err
+	}
+	for _, reason := range []string{ForwardUnconditional, ForwardBusy, ForwardNoAnswer} {
+		target := features.forwardTarget(reason)
+		if target == "" {
+			continue
+		}
+		uri, err := forwardURI(target, account)
+		if err != nil {
+			return fmt.Errorf("invalid %s forwarding target %q: %v", reason, target, err)
+		}
+		if ok, why := b.allowsCallee(account, uri); !ok {
+			return fmt.Errorf("%w: %s target %q, %s", ErrForwardNotAllowed, reason, target, why)
+		}
+	}
+	return nil
+}
+
+// calledURI 返回分支当前的被叫
+func calledURI(call *B2BCall) sip.Uri {
+	if call.called != nil {
+		return call.called
+	}
+	to, _ := call.src.Request().To()
+	return to.Address
+}
+
+// divert 按 user 的前转设置将呼叫前转，返回新的被叫。未设置前转、目的地无效或前转次数过多时返回 nil
+func (b *B2BUA) divert(call *B2BCall, user string, called sip.Uri, reason string) sip.Uri {
+	target := b.Features(user).forwardTarget(reason)
+	if target == "" {
+		return nil
+	}
+	return b.divertTo(call, user, called, reason, target)
+}
+
+// divertTo 将呼叫前转到 target，记录 Diversion 并向 A 路发送 181，返回新的被叫。目的地无效、被号码名单拒绝或前转次数过多时返回 nil
+func (b *B2BUA) divertTo(call *B2BCall, user string, called sip.Uri, reason, target string) sip.Uri {
+	if len(call.diversion) >= maxDiversions {
+		call.Log().Warnf("Call forwarding: %d diversions, not forwarding %s to %s", len(call.diversion), user, target)
+		return nil
+	}
+	uri, err := forwardURI(target, called)
+	if err != nil {
+		call.Log().Warnf("Call forwarding: invalid target %q of %s: %v", target, user, err)
+		return nil
+	}
+	if ok, why := b.allowsCallee(called, uri); !ok { // 设置后号码名单可能已修改
+		call.Log().Warnf("Call forwarding: target %q of %s not allowed: %s", target, user, why)
+		return nil
+	}
+	diverting := called.Clone()
+	diverting.SetUser(sip.String{Str: user})
+	call.diversion = append(call.diversion, fmt.Sprintf("<%s>;reason=%s;counter=%d", diverting, reason, len(call.diversion)+1))
+	call.called = uri
+	call.Context.Set("forwarded_from", user)
+	call.Context.Set("forward_reason", reason)
+	call.Log().Infof("Call forwarding (%s): %s => %s", reason, user, uri)
+	b.metrics.Inc(MetricForward + reason)
+	b.sendProvisional(call, 181, "Call Is Being Forwarded")
+	return uri
+}
+
+// forwardUnconditional 被叫设置了无条件前转时返回前转后的被叫（依次跟随多级前转），否则返回 nil
+func (b *B2BUA) forwardUnconditional(call *B2BCall, called sip.Uri) sip.Uri {
+	var forwarded sip.Uri
+	for called.User() != nil {
+		next := b.divert(call, called.User().String(), called, ForwardUnconditional)
+		if next == nil {
+			break
+		}
+		called, forwarded = next, next
+	}
+	return forwarded
+}
+
+// forwardOnFailure 本地被叫遇忙或无应答且设置了前转时，将呼叫前转，成功路由时返回 true
+func (b *B2BUA) forwardOnFailure(call *B2BCall, resp *sip.Response) bool {
+	if call.dialed == "" || resp == nil || *resp == nil || !call.src.IsInProgress() || b.hasOtherLegs(call) {
+		return false
+	}
+	reason := ""
+	switch (*resp).StatusCode() {
+	case 486, 600:
+		reason = ForwardBusy
+	case 408, 480:
+		reason = ForwardNoAnswer
+	default:
+		return false
+	}
+	next := b.divert(call, call.dialed, calledURI(call), reason)
+	if next == nil {
+		return false
+	}
+	b.routeCall(call, next)
+	return true
+}
+
+// ringingLegs 返回呼叫本地账户 user 且仍在振铃的分支
+func (b *B2BUA) ringingLegs(call *B2BCall, user string) []*B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	var legs []*B2BCall
+	for _, leg := range b.calls {
+		if leg.src == call.src && leg.dialed == user && leg.dest != nil && leg.dest.IsInProgress() {
+			legs = append(legs, leg)
+		}
+	}
+	return legs
+}
+
+// hasOtherLegs 检查 A 路是否还有其它未结束的分支（分叉的其它联系地址或前转后的新分支）
+func (b *B2BUA) hasOtherLegs(call *B2BCall) bool {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, leg := range b.calls {
+		if leg.src == call.src && leg.dest != nil && leg.dest != call.dest && !leg.dest.IsEnded() {
+			return true
+		}
+	}
+	return false
+}
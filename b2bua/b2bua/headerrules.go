@@ -0,0 +1,205 @@
+package b2bua
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 头域规则的方向
+const (
+	HeaderInbound  = "inbound"  // 收到的 A 路 INVITE，在路由和头域配置复制之前
+	HeaderOutbound = "outbound" // 发出的 B 路 INVITE 的附加头域（头域配置复制或添加的头域）
+)
+
+// 头域规则的操作
+const (
+	HeaderAdd     = "add"     // 添加一个头域
+	HeaderRemove  = "remove"  // 删除头域，设置 match 时只删除值匹配的
+	HeaderSet     = "set"     // 替换所有同名头域为一个，没有时添加
+	HeaderReplace = "replace" // 按正则 match 改写值，value 中可用 $1 引用分组
+)
+
+// HeaderRule 头域操作规则，按配置顺序执行。value 中的 ${from_user}、${from_host}、${to_user}
+// 替换为 A 路 INVITE 的主叫用户、主叫域名和被叫用户。B 路的 From、To、Via、Contact 等由协议栈生成，
+// 出局规则只作用于附加的头域
+type HeaderRule struct {
+	Direction string   `json:"direction"` // inbound 或 outbound（默认）
+	Trunks    []string `json:"trunks"`    // 只用于这些中继（入局为来源中继，出局为目的中继），为空时不限
+	Accounts  []string `json:"accounts"`  // 只用于这些主叫账户（user 或 user@domain），为空时不限
+	Action    string   `json:"action"`    // add、remove、set 或 replace
+	Header    string   `json:"header"`    // 头域名称
+	Value     string   `json:"value"`     // add、set 的值，replace 的替换文本
+	Match     string   `json:"match"`     // 匹配头域值的正则，replace 时必须设置
+}
+
+// headerRule 编译后的规则
+type headerRule struct {
+	HeaderRule
+	match *regexp.Regexp
+}
+
+// newHeaderRules 检查并编译头域规则
+func newHeaderRules(config []HeaderRule) ([]*headerRule, error) {
+	rules := make([]*headerRule, 0, len(config))
+	for i, rule := range config {
+		if rule.Direction == "" {
+			rule.Direction = HeaderOutbound
+		}
+		if rule.Direction != HeaderInbound && rule.Direction != HeaderOutbound {
+			return nil, fmt.Errorf("header_rules[%d]: invalid direction %q", i, rule.Direction)
+		}
+		if rule.Header == "" {
+			return nil, fmt.Errorf("header_rules[%d]: missing header", i)
+		}
+		compiled := &headerRule{HeaderRule: rule}
+		if rule.Match != "" {
+			match, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("header_rules[%d]: %w", i, err)
+			}
+			compiled.match = match
+		}
+		switch rule.Action {
+		case HeaderAdd, HeaderRemove, HeaderSet:
+		case HeaderReplace:
+			if compiled.match == nil {
+				return nil, fmt.Errorf("header_rules[%d]: replace requires match", i)
+			}
+		default:
+			return nil, fmt.Errorf("header_rules[%d]: invalid action %q", i, rule.Action)
+		}
+		rules = append(rules, compiled)
+	}
+	return rules, nil
+}
+
+// applies 检查规则是否用于该方向、中继和主叫
+func (r *headerRule) applies(direction string, trunk *TrunkConfig, from *sip.FromHeader) bool {
+	if r.Direction != direction || !trunkMatches(r.Trunks, trunk) {
+		return false
+	}
+	if from == nil {
+		return len(r.Accounts) == 0
+	}
+	return accountMatches(r.Accounts, from.Address)
+}
+
+// trunkMatches 检查中继是否在列表中，列表为空时总是匹配
+func trunkMatches(names []string, trunk *TrunkConfig) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if trunk != nil && strings.EqualFold(name, trunk.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountMatches 检查主叫（user 或 user@domain）是否在列表中，列表为空时总是匹配
+func accountMatches(accounts []string, uri sip.Uri) bool {
+	if len(accounts) == 0 {
+		return true
+	}
+	if uri == nil || uri.User() == nil {
+		return false
+	}
+	user := uri.User().String()
+	for _, account := range accounts {
+		if strings.EqualFold(account, user) || strings.EqualFold(account, user+"@"+uri.Host()) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply 对同名的头域执行规则，返回执行后的头域
+func (r *headerRule) apply(headers []sip.Header, vars *strings.Replacer) []sip.Header {
+	value := vars.Replace(r.Value)
+	switch r.Action {
+	case HeaderAdd:
+		return append(headers, &sip.GenericHeader{HeaderName: r.Header, Contents: value})
+	case HeaderSet:
+		return []sip.Header{&sip.GenericHeader{HeaderName: r.Header, Contents: value}}
+	case HeaderRemove:
+		var kept []sip.Header
+		for _, header := range headers {
+			if r.match != nil && !r.match.MatchString(header.Value()) {
+				kept = append(kept, header)
+			}
+		}
+		return kept
+	}
+	replaced := make([]sip.Header, 0, len(headers))
+	for _, header := range headers {
+		if r.match.MatchString(header.Value()) {
+			header = &sip.GenericHeader{HeaderName: header.Name(), Contents: r.match.ReplaceAllString(header.Value(), value)}
+		}
+		replaced = append(replaced, header)
+	}
+	return replaced
+}
+
+// headerVars 返回规则值中可用的变量
+func headerVars(req sip.Request) *strings.Replacer {
+	fromUser, fromHost, toUser := "", "", ""
+	if from, ok := req.From(); ok && from.Address != nil {
+		fromHost = from.Address.Host()
+		if from.Address.User() != nil {
+			fromUser = from.Address.User().String()
+		}
+	}
+	if to, ok := req.To(); ok && to.Address != nil && to.Address.User() != nil {
+		toUser = to.Address.User().String()
+	}
+	return strings.NewReplacer("${from_user}", fromUser, "${from_host}", fromHost, "${to_user}", toUser)
+}
+
+// manipulateRequest 对收到的 A 路 INVITE 执行入局规则
+func (b *B2BUA) manipulateRequest(req sip.Request) {
+	if len(b.headerRules) == 0 {
+		return
+	}
+	from, _ := req.From()
+	trunk := b.trunkForRequest(req)
+	vars := headerVars(req)
+	for _, rule := range b.headerRules {
+		if !rule.applies(HeaderInbound, trunk, from) {
+			continue
+		}
+		headers := rule.apply(req.GetHeaders(rule.Header), vars)
+		req.RemoveHeader(rule.Header)
+		for _, header := range headers {
+			req.AppendHeader(header)
+		}
+	}
+}
+
+// manipulateHeaders 对发往 target 的 B 路 INVITE 的附加头域执行出局规则
+func (b *B2BUA) manipulateHeaders(call *B2BCall, target routeTarget, headers []sip.Header) []sip.Header {
+	if len(b.headerRules) == 0 {
+		return headers
+	}
+	request := call.src.Request()
+	from, _ := request.From()
+	vars := headerVars(request)
+	for _, rule := range b.headerRules {
+		if !rule.applies(HeaderOutbound, target.trunk, from) {
+			continue
+		}
+		var same, others []sip.Header
+		for _, header := range headers {
+			if strings.EqualFold(header.Name(), rule.Header) {
+				same = append(same, header)
+			} else {
+				others = append(others, header)
+			}
+		}
+		headers = append(others, rule.apply(same, vars)...)
+	}
+	return headers
+}
@@ -0,0 +1,228 @@
+package b2bua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const hepQueueSize = 4096 // 待发送的抓包数上限，超过时丢弃
+
+// HEP 消息块类型（HEPv3）
+const (
+	hepChunkIPFamily      = 0x0001
+	hepChunkIPProtocol    = 0x0002
+	hepChunkIPv4Src       = 0x0003
+	hepChunkIPv4Dst       = 0x0004
+	hepChunkIPv6Src       = 0x0005
+	hepChunkIPv6Dst       = 0x0006
+	hepChunkSrcPort       = 0x0007
+	hepChunkDstPort       = 0x0008
+	hepChunkTimestamp     = 0x0009
+	hepChunkTimestampUsec = 0x000a
+	hepChunkProtocolType  = 0x000b
+	hepChunkAgentID       = 0x000c
+	hepChunkAuthKey       = 0x000e
+	hepChunkPayload       = 0x000f
+	hepChunkCorrelationID = 0x0011
+
+	hepProtocolSIP = 1
+)
+
+// HEPConfig HEP/EEP 抓包配置，将所有收发的 SIP 消息以 HEPv3 发送到 Homer/heplify-server。
+// 媒体不经过 B2BUA，因此不发送 RTCP 统计
+type HEPConfig struct {
+	Address  string `json:"address"`  // 抓包服务器地址 host:port（UDP），为空时不抓包
+	AgentID  uint32 `json:"agent_id"` // 抓包代理 ID
+	Password string `json:"password"` // 认证密钥
+}
+
+// hepPacket 一条待发送的 SIP 消息
+type hepPacket struct {
+	time     time.Time
+	msg      string
+	callID   string
+	protocol string
+	src, dst string
+}
+
+// hepAgent 异步发送 HEP 数据包
+type hepAgent struct {
+	config HEPConfig
+	conn   net.Conn
+	queue  chan *hepPacket
+}
+
+func newHEPAgent(config HEPConfig) (*hepAgent, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("hep: %w", err)
+	}
+	return &hepAgent{
+		config: config,
+		conn:   conn,
+		queue:  make(chan *hepPacket, hepQueueSize),
+	}, nil
+}
+
+// startHEP 启动抓包代理并挂接到协议栈
+func (b *B2BUA) startHEP(config HEPConfig) error {
+	if config.Address == "" {
+		return nil
+	}
+	agent, err := newHEPAgent(config)
+	if err != nil {
+		return err
+	}
+	b.stack.OnMessage(func(msg sip.Message, outgoing bool) {
+		packet := &hepPacket{
+			time:     time.Now(),
+			msg:      msg.String(),
+			protocol: msg.Transport(),
+		}
+		if callID, ok := msg.CallID(); ok {
+			packet.callID = callID.Value()
+		}
+		packet.src, packet.dst = messageEndpoints(msg, outgoing)
+		select {
+		case agent.queue <- packet:
+		default:
+			b.metrics.Inc(MetricHEPDropped)
+		}
+	})
+	go agent.run(b)
+	return nil
+}
+
+// run 发送队列中的数据包。关联 ID 在发送时确定，此时 B 路呼叫通常已登记
+func (agent *hepAgent) run(b *B2BUA) {
+	defer agent.conn.Close()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case packet := <-agent.queue:
+			data := agent.encode(packet, b.correlationID(packet.callID))
+			if _, err := agent.conn.Write(data); err != nil {
+				logger.Debugf("HEP: send failed: %v", err)
+				b.metrics.Inc(MetricHEPFailed)
+				continue
+			}
+			b.metrics.Inc(MetricHEPSent)
+		}
+	}
+}
+
+// encode 将消息编码为 HEPv3 数据包
+func (agent *hepAgent) encode(packet *hepPacket, correlationID string) []byte {
+	srcIP, srcPort := splitEndpoint(packet.src)
+	dstIP, dstPort := splitEndpoint(packet.dst)
+	protocol := uint8(6) // TCP、TLS、WS、WSS
+	if strings.EqualFold(packet.protocol, "udp") {
+		protocol = 17
+	}
+
+	body := &bytes.Buffer{}
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		writeHEPChunk(body, hepChunkIPFamily, []byte{2})
+		writeHEPChunk(body, hepChunkIPProtocol, []byte{protocol})
+		writeHEPChunk(body, hepChunkIPv4Src, srcIP.To4())
+		writeHEPChunk(body, hepChunkIPv4Dst, dstIP.To4())
+	} else {
+		writeHEPChunk(body, hepChunkIPFamily, []byte{10})
+		writeHEPChunk(body, hepChunkIPProtocol, []byte{protocol})
+		writeHEPChunk(body, hepChunkIPv6Src, srcIP.To16())
+		writeHEPChunk(body, hepChunkIPv6Dst, dstIP.To16())
+	}
+	writeHEPChunk(body, hepChunkSrcPort, uint16Bytes(srcPort))
+	writeHEPChunk(body, hepChunkDstPort, uint16Bytes(dstPort))
+	writeHEPChunk(body, hepChunkTimestamp, uint32Bytes(uint32(packet.time.Unix())))
+	writeHEPChunk(body, hepChunkTimestampUsec, uint32Bytes(uint32(packet.time.Nanosecond()/1000)))
+	writeHEPChunk(body, hepChunkProtocolType, []byte{hepProtocolSIP})
+	writeHEPChunk(body, hepChunkAgentID, uint32Bytes(agent.config.AgentID))
+	if agent.config.Password != "" {
+		writeHEPChunk(body, hepChunkAuthKey, []byte(agent.config.Password))
+	}
+	if correlationID != "" {
+		writeHEPChunk(body, hepChunkCorrelationID, []byte(correlationID))
+	}
+	writeHEPChunk(body, hepChunkPayload, []byte(packet.msg))
+
+	data := make([]byte, 6, 6+body.Len())
+	copy(data, "HEP3")
+	binary.BigEndian.PutUint16(data[4:], uint16(6+body.Len()))
+	return append(data, body.Bytes()...)
+}
+
+func writeHEPChunk(buf *bytes.Buffer, chunkType uint16, value []byte) {
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header[0:], 0) // 通用厂商 ID
+	binary.BigEndian.PutUint16(header[2:], chunkType)
+	binary.BigEndian.PutUint16(header[4:], uint16(6+len(value)))
+	buf.Write(header)
+	buf.Write(value)
+}
+
+func uint16Bytes(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// messageEndpoints 返回消息的源地址和目的地址（host:port）。
+// 发出的请求没有源地址，使用协议栈改写后的 Via 地址
+func messageEndpoints(msg sip.Message, outgoing bool) (string, string) {
+	src, dst := msg.Source(), msg.Destination()
+	if outgoing && src == "" {
+		if via, ok := msg.ViaHop(); ok {
+			port := sip.DefaultPort(msg.Transport())
+			if via.Port != nil {
+				port = *via.Port
+			}
+			src = net.JoinHostPort(via.Host, strconv.Itoa(int(port)))
+		}
+	}
+	return src, dst
+}
+
+// splitEndpoint 解析 host:port，无法解析时返回 0.0.0.0
+func splitEndpoint(endpoint string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return net.IPv4zero, 0
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	p, _ := strconv.Atoi(port)
+	return ip, uint16(p)
+}
+
+// correlationID 返回 SIP Call-ID 对应的关联 ID：B 路消息使用 A 路的 Call-ID，
+// 使 Homer 能将两路关联为同一个呼叫
+func (b *B2BUA) correlationID(callID string) string {
+	if callID == "" {
+		return ""
+	}
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		if call.dest != nil && call.dest.CallID() != nil && call.dest.CallID().Value() == callID {
+			return call.src.CallID().Value()
+		}
+	}
+	return callID
+}
@@ -0,0 +1,287 @@
+package b2bua
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// 振铃组的振铃策略
+const (
+	HuntRingAll    = "ring_all"    // 同时呼叫所有成员
+	HuntSequential = "sequential"  // 按顺序每次呼叫一个成员
+	HuntRoundRobin = "round_robin" // 按顺序每次呼叫一个成员，每个呼叫从上一个呼叫的下一个成员开始
+	HuntMemory     = "memory"      // 依次增加成员：先呼叫第一个，超时后同时呼叫前两个，依此类推
+)
+
+const defaultHuntRingTimeout = 20 // 振铃组每一步的默认振铃时间（秒）
+
+// HuntGroupConfig 振铃组（寻线组）：呼叫组号码时按策略向成员账户的所有联系地址分叉，第一个应答的成员接通，
+// 无人应答时前转到 fallback
+type HuntGroupConfig struct {
+	Name        string   `json:"name"`         // 名称
+	Number      string   `json:"number"`       // 组号码（被叫用户部分）
+	Members     []string `json:"members"`      // 成员账户（用户名），按振铃顺序
+	Strategy    string   `json:"strategy"`     // 振铃策略：ring_all（默认）、sequential、round_robin 或 memory
+	RingTimeout int      `json:"ring_timeout"` // 每一步的振铃时间（秒），ring_all 为总振铃时间；0 为 20 秒
+	Fallback    string   `json:"fallback"`     // 无人应答时前转到的号码或 SIP URI（如语音信箱），为空时返回 480
+}
+
+// huntGroups 振铃组及进行中的振铃
+type huntGroups struct {
+	mutex  sync.Mutex
+	groups map[string]*huntGroup      // 组号码 -> 振铃组
+	hunts  map[*session.Session]*hunt // A 路 -> 进行中的振铃
+}
+
+// huntGroup 一个振铃组
+type huntGroup struct {
+	config HuntGroupConfig
+	next   int // round_robin 下一个呼叫的第一个成员
+}
+
+// hunt 一个呼叫在振铃组中的振铃进度
+type hunt struct {
+	group   *huntGroup
+	call    *B2BCall
+	members []string // 本次振铃的成员顺序
+	step    int      // 当前的一步
+	done    bool     // 已应答、主叫挂机或已结束振铃
+}
+
+// newHuntGroups 按配置创建振铃组
+func newHuntGroups(configs []HuntGroupConfig) (*huntGroups, error) {
+	groups := &huntGroups{groups: make(map[string]*huntGroup), hunts: make(map[*session.Session]*hunt)}
+	for _, config := range configs {
+		if config.Number == "" || len(config.Members) == 0 || groups.groups[config.Number] != nil {
+			return nil, fmt.Errorf("hunt group %q: missing number or members, or duplicate number %q", config.Name, config.Number)
+		}
+		switch config.Strategy {
+		case "":
+			config.Strategy = HuntRingAll
+		case HuntRingAll, HuntSequential, HuntRoundRobin, HuntMemory:
+		default:
+			return nil, fmt.Errorf("hunt group %s: invalid strategy %q", config.Name, config.Strategy)
+		}
+		if config.RingTimeout <= 0 {
+			config.RingTimeout = defaultHuntRingTimeout
+		}
+		groups.groups[config.Number] = &huntGroup{config: config}
+	}
+	return groups, nil
+}
+
+// steps 返回振铃的步数
+func (h *hunt) steps() int {
+	if h.group.config.Strategy == HuntRingAll {
+		return 1
+	}
+	return len(h.members)
+}
+
+// stepMembers 返回某一步新呼叫的成员
+func (h *hunt) stepMembers(step int) []string {
+	if h.group.config.Strategy == HuntRingAll {
+		return h.members
+	}
+	return h.members[step : step+1]
+}
+
+// startHunt 被叫为振铃组号码时按策略呼叫成员，返回 true 表示呼叫已处理
+func (b *B2BUA) startHunt(call *B2BCall, called sip.Uri) bool {
+	if called == nil || called.User() == nil {
+		return false
+	}
+	b.huntGroups.mutex.Lock()
+	group := b.huntGroups.groups[called.User().String()]
+	if group == nil {
+		b.huntGroups.mutex.Unlock()
+		return false
+	}
+	members := append([]string(nil), group.config.Members...)
+	if group.config.Strategy == HuntRoundRobin {
+		members = append(members[group.next:], members[:group.next]...)
+		group.next = (group.next + 1) % len(members)
+	}
+	h := &hunt{group: group, call: call, members: members}
+	b.huntGroups.hunts[call.src] = h
+	b.huntGroups.mutex.Unlock()
+
+	name := group.config.Name
+	call.Context.Set("hunt_group", name)
+	b.classifyCall(call, call.src.Request(), true)
+	b.trying(call)
+	call.Log().Infof("Hunt group %s (%s): %v", name, group.config.Strategy, members)
+	b.metrics.Inc(MetricHuntGroup + name + ".calls")
+	b.huntStep(h, 0)
+	return true
+}
+
+// huntStep 从第 step 步开始呼叫成员：呼叫该步的成员，没有成员在振铃时（未注册）继续下一步，
+// 有成员在振铃时在振铃时间后进入下一步。所有步骤结束时结束振铃
+func (b *B2BUA) huntStep(h *hunt, step int) {
+	call, config := h.call, h.group.config
+	for ; step < h.steps(); step++ {
+		b.huntGroups.mutex.Lock()
+		if h.done {
+			b.huntGroups.mutex.Unlock()
+			return
+		}
+		h.step = step
+		b.huntGroups.mutex.Unlock()
+
+		for _, member := range h.stepMembers(step) {
+			aor := calledURI(call).Clone()
+			aor.SetUser(sip.String{Str: member})
+			if !b.inviteAccount(call, routingURI(aor)) {
+				call.Log().Infof("Hunt group %s: member %s not reachable", config.Name, member)
+			}
+		}
+		if len(b.huntLegs(h)) > 0 {
+			step := step
+			time.AfterFunc(time.Duration(config.RingTimeout)*time.Second, func() { b.huntTimeout(h, step) })
+			return
+		}
+	}
+	b.endHunt(h)
+}
+
+// huntLegs 返回振铃组呼叫中仍在振铃的分支
+func (b *B2BUA) huntLegs(h *hunt) []*B2BCall {
+	var legs []*B2BCall
+	for _, leg := range b.Calls() {
+		if leg.src == h.call.src && leg.dest != nil && leg.dest.IsInProgress() {
+			legs = append(legs, leg)
+		}
+	}
+	return legs
+}
+
+// advanceHunt 振铃仍在第 from 步时进入下一步，返回 false 表示振铃已结束或已进入下一步
+func (b *B2BUA) advanceHunt(h *hunt, from int) bool {
+	b.huntGroups.mutex.Lock()
+	if h.done || h.step != from {
+		b.huntGroups.mutex.Unlock()
+		return false
+	}
+	h.step = from + 1
+	b.huntGroups.mutex.Unlock()
+	b.huntStep(h, from+1)
+	return true
+}
+
+// huntTimeout 一步的振铃时间到时进入下一步，除 memory 策略外取消上一步仍在振铃的分支
+func (b *B2BUA) huntTimeout(h *hunt, step int) {
+	legs := b.huntLegs(h)
+	if !b.advanceHunt(h, step) {
+		return
+	}
+	if h.group.config.Strategy == HuntMemory {
+		return
+	}
+	for _, leg := range legs {
+		leg.dest.End()
+	}
+}
+
+// stopHunt 结束振铃，已结束时返回 false
+func (b *B2BUA) stopHunt(h *hunt) bool {
+	b.huntGroups.mutex.Lock()
+	defer b.huntGroups.mutex.Unlock()
+	if h.done {
+		return false
+	}
+	h.done = true
+	delete(b.huntGroups.hunts, h.call.src)
+	return true
+}
+
+// endHunt 所有成员都未应答：前转到 fallback，未配置时以 480 拒绝 A 路，并取消仍在振铃的分支
+func (b *B2BUA) endHunt(h *hunt) {
+	if !b.stopHunt(h) {
+		return
+	}
+	call, config := h.call, h.group.config
+	legs := b.huntLegs(h)
+	call.Log().Infof("Hunt group %s: no member answered", config.Name)
+	b.metrics.Inc(MetricHuntGroup + config.Name + ".no_answer")
+	if !call.src.IsInProgress() {
+		return
+	}
+	forwarded := false
+	if config.Fallback != "" {
+		if next := b.divertTo(call, config.Number, calledURI(call), ForwardNoAnswer, config.Fallback); next != nil {
+			b.routeCall(call, next)
+			forwarded = true
+		}
+	}
+	if !forwarded {
+		b.ringTimedOut(call)
+	}
+	for _, leg := range legs {
+		leg.dest.End()
+	}
+	if !forwarded && len(legs) == 0 { // 没有分支，由此结束呼叫
+		b.finishCall(call, session.Failure)
+	}
+}
+
+// huntAnswered 振铃组的成员应答时结束振铃并取消其它成员的分支
+func (b *B2BUA) huntAnswered(call *B2BCall) {
+	b.huntGroups.mutex.Lock()
+	h := b.huntGroups.hunts[call.src]
+	b.huntGroups.mutex.Unlock()
+	if h == nil || !b.stopHunt(h) {
+		return
+	}
+	for _, leg := range b.huntLegs(h) {
+		if leg.dest != call.dest {
+			leg.dest.End()
+		}
+	}
+	call.Context.Set("hunt_member", call.dialed)
+	call.Log().Infof("Hunt group %s: answered by %s", h.group.config.Name, call.dialed)
+	b.metrics.Inc(MetricHuntGroup + h.group.config.Name + ".answered")
+}
+
+// huntLegEnded 处理振铃组呼叫的会话结束：成员的分支失败或被取消时移除该分支，没有其它分支在振铃时进入下一步；
+// 主叫挂机时结束振铃并取消所有分支。返回 true 表示已处理，不再按普通呼叫处理
+func (b *B2BUA) huntLegEnded(sess *session.Session, state session.Status) bool {
+	src := sess
+	leg := b.findCall(sess)
+	if leg != nil {
+		src = leg.src
+	}
+	b.huntGroups.mutex.Lock()
+	h := b.huntGroups.hunts[src]
+	b.huntGroups.mutex.Unlock()
+	if h == nil {
+		return false
+	}
+
+	if sess == src { // 主叫挂机
+		if !b.stopHunt(h) {
+			return false
+		}
+		for _, other := range b.huntLegs(h) {
+			other.dest.End()
+		}
+		if leg == nil { // 在两步之间没有分支
+			b.finishCall(h.call, state)
+			return true
+		}
+		return false
+	}
+
+	b.dropLeg(sess)
+	b.huntGroups.mutex.Lock()
+	step := h.step
+	b.huntGroups.mutex.Unlock()
+	if len(b.huntLegs(h)) == 0 {
+		go b.advanceHunt(h, step)
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 产品名称与版本，构建时可通过 -ldflags "-X go-sip-ua/b2bua/b2bua.Version=..." 覆盖
+var (
+	ProductName = "Go B2BUA"
+	Version     = "1.0.0"
+)
+
+// IdentityConfig 实例标识，用于对外展示的名称和版本
+type IdentityConfig struct {
+	Name         string `json:"name"`          // 产品名称，默认 ProductName
+	Version      string `json:"version"`       // 对外报告的版本，默认 Version
+	UserAgent    string `json:"user_agent"`    // 请求的 User-Agent 头域，默认 "<名称>/<版本>"
+	Server       string `json:"server"`        // 响应的 Server 头域，默认与 User-Agent 相同
+	WarningAgent string `json:"warning_agent"` // Warning 头域中的 warn-agent，默认使用名称（空格替换为 -）
+	Banner       string `json:"banner"`        // 命令行标题，默认 "<名称> <版本>"
+}
+
+// Identity 实例标识，已补全默认值
+type Identity struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	UserAgent    string `json:"user_agent"`
+	Server       string `json:"server"`
+	WarningAgent string `json:"warning_agent"`
+	Banner       string `json:"banner"`
+	Build        string `json:"build"` // 实际构建的版本
+}
+
+// newIdentity 根据配置生成实例标识
+func newIdentity(config IdentityConfig) Identity {
+	identity := Identity{
+		Name:         config.Name,
+		Version:      config.Version,
+		UserAgent:    config.UserAgent,
+		Server:       config.Server,
+		WarningAgent: config.WarningAgent,
+		Banner:       config.Banner,
+		Build:        Version,
+	}
+	if identity.Name == "" {
+		identity.Name = ProductName
+	}
+	if identity.Version == "" {
+		identity.Version = Version
+	}
+	if identity.UserAgent == "" {
+		identity.UserAgent = identity.Name + "/" + identity.Version
+	}
+	if identity.Server == "" {
+		identity.Server = identity.UserAgent
+	}
+	if identity.WarningAgent == "" {
+		identity.WarningAgent = strings.Replace(identity.Name, " ", "-", -1)
+	}
+	if identity.Banner == "" {
+		identity.Banner = identity.Name + " " + identity.Version
+	}
+	return identity
+}
+
+// Identity 返回实例标识
+func (b *B2BUA) Identity() Identity {
+	return b.identity
+}
+
+// warning 生成 Warning 头域（RFC 3261 20.43），code 为 3xx 警告码
+func (b *B2BUA) warning(code int, text string) sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Warning",
+		Contents:   fmt.Sprintf("%d %s %q", code, b.identity.WarningAgent, text),
+	}
+}
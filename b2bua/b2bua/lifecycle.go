@@ -0,0 +1,108 @@
+package b2bua
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go-sip-ua/pkg/session"
+)
+
+const shutdownGracePeriod = 3 * time.Second // Shutdown 等待 BYE 事务完成的时间
+
+// LifecycleHooks 生命周期回调，供嵌入 B2BUA 的应用和测试确定性地管理启动和关闭。未设置的回调不调用
+type LifecycleHooks struct {
+	// PreShutdown 在关闭开始时、结束通话之前调用，ctx 为关闭的上下文
+	PreShutdown func(ctx context.Context)
+	// PostShutdown 在协议栈关闭之后调用，err 为关闭的结果
+	PostShutdown func(err error)
+	// OnListenerError 在 NewB2BUA 启动一个 SIP 监听失败时调用。返回 nil 时跳过该监听继续启动，
+	// 返回错误时启动失败；未设置时启动失败
+	OnListenerError func(network, address string, err error) error
+}
+
+// listenerFailed 处理启动 SIP 监听的错误，由 OnListenerError 决定是否继续
+func (b *B2BUA) listenerFailed(listener sipListener, err error) {
+	if hook := b.config.Hooks.OnListenerError; hook != nil {
+		if err = hook(listener.network, listener.addr, err); err == nil {
+			logger.Warnf("Listener %s %s skipped", listener.network, listener.addr)
+			return
+		}
+	}
+	logger.Panic(fmt.Errorf("listen %s %s: %w", listener.network, listener.addr, err))
+}
+
+// Shutdown 关闭 B2BUA：先结束所有通话（已建立的发送 BYE，未应答的呼入返回 503），
+// 等待 BYE 事务完成或超时（shutdownGracePeriod）后再关闭协议栈
+func (b *B2BUA) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	b.ShutdownContext(ctx)
+}
+
+// ShutdownContext 按 ctx 的期限关闭 B2BUA，ctx 结束时不再等待未结束的会话，返回 ctx 的错误。
+// 可重复调用：只关闭一次，之后的调用等待关闭完成（或自己的 ctx 结束）并返回同样的结果
+func (b *B2BUA) ShutdownContext(ctx context.Context) error {
+	first := false
+	b.stopOnce.Do(func() {
+		first = true
+		close(b.stopCh)
+	})
+	if !first {
+		select {
+		case <-b.shutdownDone:
+			return b.shutdownErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if hook := b.config.Hooks.PreShutdown; hook != nil {
+		hook(ctx)
+	}
+	err := b.terminateSessions(ctx)
+	b.cancel() // 中止仍在进行的 B 路呼叫和上游请求
+	b.ua.Shutdown()
+	b.shutdownErr = err
+	close(b.shutdownDone)
+	if hook := b.config.Hooks.PostShutdown; hook != nil {
+		hook(err)
+	}
+	return err
+}
+
+// terminateSessions 结束所有会话并等待它们完成，ctx 结束时返回其错误
+func (b *B2BUA) terminateSessions(ctx context.Context) error {
+	sessions := b.ua.Sessions()
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	logger.Infof("Shutdown: terminating %d sessions of %d calls", len(sessions), len(b.Calls()))
+	pending := make([]*session.Session, 0, len(sessions)) // 已发送 BYE/CANCEL、等待结束的会话
+	for _, sess := range sessions {
+		switch {
+		case sess.Direction() == session.Incoming && sess.IsInProgress(): // 未应答的呼入
+			sess.Reject(503, "Service Unavailable")
+		case !sess.IsEnded():
+			sess.End()
+			pending = append(pending, sess)
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(pending) > 0 {
+		if pending[0].IsEnded() {
+			pending = pending[1:]
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			logger.Warnf("Shutdown: %d sessions did not terminate: %v", len(pending), ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package b2bua
+
+import "net"
+
+// 默认监听地址
+const (
+	defaultSIPAddress   = "0.0.0.0:5060" // UDP/TCP
+	defaultTLSAddress   = "0.0.0.0:5061"
+	defaultWSSAddress   = "0.0.0.0:5081"
+	defaultAdminAddress = "127.0.0.1:6658" // REST 管理接口，默认只在本机监听
+)
+
+// ListenerConfig 单个监听的配置
+type ListenerConfig struct {
+	Address  string `json:"address"`  // 监听地址 host:port，为空时使用默认地址
+	Disabled bool   `json:"disabled"` // 禁用该监听
+}
+
+// ListenConfig 按传输协议配置的监听地址。TLS/WSS 仅在启用 TLS 时监听
+type ListenConfig struct {
+	UDP    ListenerConfig `json:"udp"`
+	TCP    ListenerConfig `json:"tcp"`
+	TLS    ListenerConfig `json:"tls"`
+	WSS    ListenerConfig `json:"wss"`
+	Admin  ListenerConfig `json:"admin"`  // REST 管理接口，默认 127.0.0.1:6658；主备或水平扩展时需配置为其它节点可达的地址
+	Pprof  ListenerConfig `json:"pprof"`  // pprof 性能分析，未配置地址时不监听
+	Socket ListenerConfig `json:"socket"` // 管理套接字：unix:路径 或 host:port，接受与命令行相同的命令（JSON），未配置地址时不监听
+}
+
+// address 返回监听地址，禁用时返回空
+func (l ListenerConfig) address(defaultAddress string) string {
+	if l.Disabled {
+		return ""
+	}
+	if l.Address == "" {
+		return defaultAddress
+	}
+	return l.Address
+}
+
+// AdminAddress 返回管理接口的监听地址，禁用时返回空
+func (c ListenConfig) AdminAddress() string {
+	return c.Admin.address(defaultAdminAddress)
+}
+
+// PprofAddress 返回 pprof 的监听地址，未配置或禁用时返回空
+func (c ListenConfig) PprofAddress() string {
+	return c.Pprof.address("")
+}
+
+// SocketAddress 返回管理套接字的监听地址，未配置或禁用时返回空
+func (c ListenConfig) SocketAddress() string {
+	return c.Socket.address("")
+}
+
+// sipListener 一个 SIP 监听
+type sipListener struct {
+	network string
+	addr    string
+}
+
+// port 返回监听的端口
+func (l sipListener) port() string {
+	_, port, _ := net.SplitHostPort(l.addr)
+	return port
+}
+
+// sipListeners 返回需要启动的 SIP 监听
+func (c ListenConfig) sipListeners(enableTLS bool) (plain, secure []sipListener) {
+	return c.listeners(enableTLS, defaultSIPAddress, defaultTLSAddress, defaultWSSAddress)
+}
+
+// explicitListeners 返回配置了地址的 SIP 监听，未配置地址的传输协议不监听（用于 profile）
+func (c ListenConfig) explicitListeners(enableTLS bool) (plain, secure []sipListener) {
+	return c.listeners(enableTLS, "", "", "")
+}
+
+// listeners 返回需要启动的 SIP 监听，未配置地址的传输协议使用给定的默认地址
+func (c ListenConfig) listeners(enableTLS bool, sipAddress, tlsAddress, wssAddress string) (plain, secure []sipListener) {
+	for _, l := range []sipListener{
+		{"udp", c.UDP.address(sipAddress)},
+		{"tcp", c.TCP.address(sipAddress)},
+	} {
+		if l.addr != "" {
+			plain = append(plain, l)
+		}
+	}
+	if !enableTLS {
+		return
+	}
+	for _, l := range []sipListener{
+		{"tls", c.TLS.address(tlsAddress)},
+		{"wss", c.WSS.address(wssAddress)},
+	} {
+		if l.addr != "" {
+			secure = append(secure, l)
+		}
+	}
+	return
+}
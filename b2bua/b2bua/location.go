@@ -0,0 +1,202 @@
+package b2bua
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/google/uuid"
+	"go-sip-ua/pkg/session"
+)
+
+const pidfContentType = "application/pidf+xml"
+
+// LocationConfig 紧急呼叫的位置信息（RFC 6442 Geolocation 与 PIDF-LO）。紧急号码使用 survivability.emergency_numbers。
+// 紧急呼叫总是保留主叫的 Geolocation 头域和 PIDF-LO；主叫未提供位置且中继要求位置时，注入按账户、站点或默认配置的静态位置
+type LocationConfig struct {
+	Accounts map[string]StaticLocation `json:"accounts"` // 按主叫（user 或 user@domain）配置的位置
+	Sites    []SiteLocation            `json:"sites"`    // 按来源网段配置的站点位置
+	Default  *StaticLocation           `json:"default"`  // 未匹配账户和站点时使用的位置
+}
+
+// SiteLocation 一个站点的位置
+type SiteLocation struct {
+	Name     string         `json:"name"`     // 站点名称
+	Networks []string       `json:"networks"` // 站点的来源网段（CIDR 或单个 IP）
+	Location StaticLocation `json:"location"` // 站点位置
+}
+
+// StaticLocation 静态位置：RFC 5139 城市地址，和/或 WGS84 坐标
+type StaticLocation struct {
+	Country   string   `json:"country"`   // 国家代码（ISO 3166），如 CN
+	A1        string   `json:"a1"`        // 省/州
+	A2        string   `json:"a2"`        // 地市/县
+	A3        string   `json:"a3"`        // 城市
+	A4        string   `json:"a4"`        // 区/街道
+	RD        string   `json:"rd"`        // 道路
+	STS       string   `json:"sts"`       // 道路后缀
+	HNO       string   `json:"hno"`       // 门牌号
+	HNS       string   `json:"hns"`       // 门牌号后缀
+	LOC       string   `json:"loc"`       // 补充位置描述
+	FLR       string   `json:"flr"`       // 楼层
+	NAM       string   `json:"nam"`       // 名称（单位、住户）
+	PC        string   `json:"pc"`        // 邮政编码
+	BLD       string   `json:"bld"`       // 建筑
+	UNIT      string   `json:"unit"`      // 单元
+	ROOM      string   `json:"room"`      // 房间
+	Latitude  *float64 `json:"latitude"`  // 纬度
+	Longitude *float64 `json:"longitude"` // 经度
+	Radius    float64  `json:"radius"`    // 不确定半径（米），为 0 时使用点坐标
+}
+
+// siteLocation 解析后的站点位置
+type siteLocation struct {
+	networks []*net.IPNet
+	location StaticLocation
+}
+
+// locations 解析后的位置配置
+type locations struct {
+	config LocationConfig
+	sites  []siteLocation
+}
+
+func newLocations(config LocationConfig) (*locations, error) {
+	l := &locations{config: config}
+	for _, site := range config.Sites {
+		networks, err := parseNetworks(site.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("location site %s: %w", site.Name, err)
+		}
+		l.sites = append(l.sites, siteLocation{networks: networks, location: site.Location})
+	}
+	return l, nil
+}
+
+// lookup 按主叫账户、来源地址、默认配置的顺序查找静态位置
+func (l *locations) lookup(caller sip.Uri, source string) *StaticLocation {
+	if caller != nil && caller.User() != nil {
+		user := caller.User().String()
+		for _, key := range []string{user + "@" + caller.Host(), user} {
+			if location, found := l.config.Accounts[key]; found {
+				return &location
+			}
+		}
+	}
+	if ip := net.ParseIP(source); ip != nil {
+		for i := range l.sites {
+			for _, network := range l.sites[i].networks {
+				if network.Contains(ip) {
+					return &l.sites[i].location
+				}
+			}
+		}
+	}
+	return l.config.Default
+}
+
+// isEmergency 检查被叫是否为紧急号码
+func (b *B2BUA) isEmergency(called sip.Uri) bool {
+	if called == nil || called.User() == nil {
+		return false
+	}
+	number := routingNumber(called)
+	for _, emergency := range b.config.Survivability.EmergencyNumbers {
+		if number == emergency {
+			return true
+		}
+	}
+	return false
+}
+
+// emergencyLocation 返回紧急呼叫 B 路需要携带的位置：主叫的 Geolocation 相关头域，
+// 或在中继要求位置且主叫未提供时注入的静态位置（Geolocation 头域与 PIDF-LO 部分）
+func (b *B2BUA) emergencyLocation(call *B2BCall, target routeTarget, parts []session.BodyPart) ([]session.BodyPart, []sip.Header) {
+	request := call.src.Request()
+	var headers []sip.Header
+	for _, name := range []string{"Geolocation", "Geolocation-Routing"} {
+		for _, header := range request.GetHeaders(name) {
+			headers = append(headers, header.Clone())
+		}
+	}
+	if len(headers) > 0 || target.trunk == nil || !target.trunk.RequireLocation {
+		return parts, headers
+	}
+
+	from, _ := request.From()
+	var caller sip.Uri
+	if from != nil {
+		caller = from.Address
+	}
+	location := b.locations.lookup(caller, sourceIP(request))
+	if location == nil {
+		call.Log().Warnf("Emergency call to trunk %s without location", target.trunk.Name)
+		return parts, headers
+	}
+
+	contentID := uuid.New().String() + "@" + b.stack.GetNetworkInfo("udp").Host
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", pidfContentType)
+	header.Set("Content-ID", "<"+contentID+">")
+	parts = append(parts, session.BodyPart{Header: header, Body: location.pidf(caller)})
+	headers = append(headers,
+		&sip.GenericHeader{HeaderName: "Geolocation", Contents: "<cid:" + contentID + ">"},
+		&sip.GenericHeader{HeaderName: "Geolocation-Routing", Contents: "yes"},
+	)
+	call.Log().Infof("Emergency call: injected static location toward trunk %s", target.trunk.Name)
+	return parts, headers
+}
+
+// pidf 生成 PIDF-LO 文档（RFC 4119、RFC 5139、RFC 5491）
+func (l *StaticLocation) pidf(entity sip.Uri) string {
+	buf := &strings.Builder{}
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\r\n")
+	buf.WriteString(`<presence xmlns="urn:ietf:params:xml:ns:pidf" xmlns:gp="urn:ietf:params:xml:ns:pidf:geopriv10"` +
+		` xmlns:ca="urn:ietf:params:xml:ns:pidf:geopriv10:civicAddr" xmlns:gml="http://www.opengis.net/gml"` +
+		` xmlns:gs="http://www.opengis.net/pidflo/1.0" xmlns:dm="urn:ietf:params:xml:ns:pidf:data-model"`)
+	if entity != nil {
+		buf.WriteString(` entity="` + escapeXML(entity.String()) + `"`)
+	}
+	buf.WriteString(">\r\n<dm:device id=\"b2bua\">\r\n<gp:geopriv>\r\n<gp:location-info>\r\n")
+
+	civic := []struct{ name, value string }{
+		{"country", l.Country}, {"A1", l.A1}, {"A2", l.A2}, {"A3", l.A3}, {"A4", l.A4},
+		{"RD", l.RD}, {"STS", l.STS}, {"HNO", l.HNO}, {"HNS", l.HNS}, {"LOC", l.LOC},
+		{"FLR", l.FLR}, {"NAM", l.NAM}, {"PC", l.PC}, {"BLD", l.BLD}, {"UNIT", l.UNIT}, {"ROOM", l.ROOM},
+	}
+	civicAddress := &strings.Builder{}
+	for _, element := range civic {
+		if element.value != "" {
+			fmt.Fprintf(civicAddress, "<ca:%s>%s</ca:%s>\r\n", element.name, escapeXML(element.value), element.name)
+		}
+	}
+	if civicAddress.Len() > 0 {
+		buf.WriteString("<ca:civicAddress>\r\n" + civicAddress.String() + "</ca:civicAddress>\r\n")
+	}
+	if l.Latitude != nil && l.Longitude != nil {
+		pos := strconv.FormatFloat(*l.Latitude, 'f', -1, 64) + " " + strconv.FormatFloat(*l.Longitude, 'f', -1, 64)
+		if l.Radius > 0 {
+			fmt.Fprintf(buf, "<gs:Circle srsName=\"urn:ogc:def:crs:EPSG::4326\"><gml:pos>%s</gml:pos>"+
+				"<gs:radius uom=\"urn:ogc:def:uom:EPSG::9001\">%s</gs:radius></gs:Circle>\r\n",
+				pos, strconv.FormatFloat(l.Radius, 'f', -1, 64))
+		} else {
+			fmt.Fprintf(buf, "<gml:Point srsName=\"urn:ogc:def:crs:EPSG::4326\"><gml:pos>%s</gml:pos></gml:Point>\r\n", pos)
+		}
+	}
+
+	buf.WriteString("</gp:location-info>\r\n<gp:usage-rules/>\r\n<gp:method>Manual</gp:method>\r\n</gp:geopriv>\r\n")
+	buf.WriteString("<dm:timestamp>" + time.Now().UTC().Format(time.RFC3339) + "</dm:timestamp>\r\n")
+	buf.WriteString("</dm:device>\r\n</presence>\r\n")
+	return buf.String()
+}
+
+func escapeXML(s string) string {
+	buf := &strings.Builder{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,87 @@
+package b2bua
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/utils"
+)
+
+// LogConfig 日志文件配置。未配置文件时日志输出到标准错误
+type LogConfig struct {
+	File       string `json:"file"`        // 日志文件路径，为空时输出到标准错误
+	SIPTrace   string `json:"sip_trace"`   // SIP 消息跟踪文件路径，记录所有收发的 SIP 消息，为空时不记录
+	MaxSize    int    `json:"max_size"`    // 单个文件的最大大小（MB），超过时切分，0 表示不按大小切分
+	Rotate     string `json:"rotate"`      // 按时间切分：hourly 或 daily，为空时不按时间切分
+	MaxBackups int    `json:"max_backups"` // 保留的历史文件数，0 表示全部保留
+	Compress   bool   `json:"compress"`    // 是否 gzip 压缩历史文件
+}
+
+// rotateConfig 返回 path 的切分配置
+func (c LogConfig) rotateConfig(path string) (utils.RotateConfig, error) {
+	config := utils.RotateConfig{
+		Path:       path,
+		MaxSize:    int64(c.MaxSize) * 1024 * 1024,
+		MaxBackups: c.MaxBackups,
+		Compress:   c.Compress,
+	}
+	switch c.Rotate {
+	case "":
+	case "hourly":
+		config.Interval = time.Hour
+	case "daily":
+		config.Interval = 24 * time.Hour
+	default:
+		return config, fmt.Errorf("log: invalid rotate %q, want hourly or daily", c.Rotate)
+	}
+	return config, nil
+}
+
+// startLogging 将日志输出到文件
+func (b *B2BUA) startLogging(config LogConfig) error {
+	if config.File == "" {
+		return nil
+	}
+	rotate, err := config.rotateConfig(config.File)
+	if err != nil {
+		return err
+	}
+	file, err := utils.NewRotatingFile(rotate)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	utils.SetLogOutput(file)
+	return nil
+}
+
+// startSIPTrace 将所有收发的 SIP 消息写入跟踪文件
+func (b *B2BUA) startSIPTrace(config LogConfig) error {
+	if config.SIPTrace == "" {
+		return nil
+	}
+	rotate, err := config.rotateConfig(config.SIPTrace)
+	if err != nil {
+		return err
+	}
+	file, err := utils.NewRotatingFile(rotate)
+	if err != nil {
+		return fmt.Errorf("sip trace: %w", err)
+	}
+	b.stack.OnMessage(func(msg sip.Message, outgoing bool) {
+		writeSIPTrace(file, msg, outgoing)
+	})
+	return nil
+}
+
+// writeSIPTrace 写入一条消息：时间、方向、传输协议、源和目的地址，随后是消息全文
+func writeSIPTrace(w io.Writer, msg sip.Message, outgoing bool) {
+	direction := "recv"
+	if outgoing {
+		direction = "sent"
+	}
+	src, dst := messageEndpoints(msg, outgoing)
+	fmt.Fprintf(w, "%s %s %s %s -> %s\n%s\n\n",
+		time.Now().Format("2006-01-02 15:04:05.000"), direction, msg.Transport(), src, dst, msg.String())
+}
@@ -0,0 +1,125 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+)
+
+// MediaRelayConfig 媒体中继配置。启用后 B2BUA 改写两路的 SDP，RTP/RTCP 经本机端口转发
+type MediaRelayConfig struct {
+	Enabled bool   `json:"enabled"`  // 是否启用媒体中继（全局媒体模式 relay），可按租户、监听、中继通过 media_mode 覆盖
+	Address string `json:"address"`  // SDP 中通告的媒体地址，为空时使用 SIP 协议栈的地址
+	Bind    string `json:"bind"`     // 媒体端口绑定的地址，为空时绑定所有地址
+	PortMin int    `json:"port_min"` // 媒体端口范围下限
+	PortMax int    `json:"port_max"` // 媒体端口范围上限
+
+	RetryAfter   int `json:"retry_after"`   // 媒体端口或转码容量耗尽时 503 响应的 Retry-After（秒），默认 30
+	QueueTimeout int `json:"queue_timeout"` // 媒体端口耗尽时等待端口释放的最长时间（毫秒），0 表示立即返回 503
+
+	Timeout     int `json:"timeout"`      // 应答后两个方向都没有媒体包的最长时间（秒），超时后向两路发送 BYE，0 表示不检测
+	HoldTimeout int `json:"hold_timeout"` // 通话保持期间的媒体超时（秒），0 表示保持期间不检测
+
+	ICE        bool   `json:"ice"`         // 在媒体端口上以 ICE lite 应答连通性检查，SDP 中通告中继端口的候选地址，改善对称 NAT 后的终端和 WebRTC 浏览器的连通性
+	STUNServer string `json:"stun_server"` // 收集服务器反射候选地址的 STUN 服务器（host:port），为空时只通告 address 的主机候选地址
+
+	SRTP string `json:"srtp"` // SDES-SRTP 的处理：passthrough（默认，crypto 属性与 SRTP 包原样转发）或 terminate（在媒体中继中解密/加密，B 路经 TLS 发送时使用 SRTP，否则使用 RTP）
+}
+
+// SRTP 的处理方式
+const (
+	SRTPPassthrough = "passthrough"
+	SRTPTerminate   = "terminate"
+)
+
+// callMedia 呼叫的媒体中继会话，各分支共享
+type callMedia struct {
+	relay       *media.RelaySession
+	mutex       sync.Mutex
+	recorder    *media.Recorder // 录音，未录音时为 nil
+	recording   string          // 录音文件名
+	transcoding bool            // 两路之间正在转码
+	unavailable bool            // 转码容量已满，未在 offer 中追加编解码
+	held        bool            // 一路保持了通话
+	watching    bool            // 已开始检测媒体超时
+	mode        string          // 创建时请求生效的媒体模式：relay 或 release
+	released    bool            // 媒体已释放为端到端，中继端口已关闭
+	survey      chan string     // 通话后调查期间接收 A 路的按键，未进行调查时为 nil
+}
+
+// newMediaRelay 按配置创建媒体中继，没有任一层级使用媒体中继时返回 nil
+func (b *B2BUA) newMediaRelay(config MediaRelayConfig) *media.Relay {
+	if !b.config.usesSetting(func(o ConfigOverrides) bool { return o.MediaMode == MediaModeRelay || o.MediaMode == MediaModeRelease }) {
+		return nil
+	}
+	address := config.Address
+	if address == "" {
+		address = b.stack.GetNetworkInfo("udp").Host
+	}
+	return media.NewRelay(media.RelayConfig{
+		BindIP:   config.Bind,
+		PublicIP: address,
+		PortMin:  config.PortMin,
+		PortMax:  config.PortMax,
+
+		TerminateSRTP: strings.EqualFold(config.SRTP, SRTPTerminate),
+		ICELite:       config.ICE,
+		STUNServer:    config.STUNServer,
+	})
+}
+
+// secureTarget 设置 B 路是否使用 SRTP：终结 SRTP 时，经 TLS（sips: 或 transport=tls/wss）发送的 B 路使用 SRTP
+func (b *B2BUA) secureTarget(call *B2BCall, target routeTarget) {
+	if call.media == nil || !strings.EqualFold(b.config.MediaRelay.SRTP, SRTPTerminate) {
+		return
+	}
+	hop := target.recipient
+	if target.proxy != nil {
+		hop = *target.proxy
+	}
+	secure := hop.IsEncrypted()
+	if tp, ok := hop.UriParams().Get("transport"); ok && tp != nil {
+		transport := strings.ToLower(tp.String())
+		secure = secure || transport == "tls" || transport == "wss"
+	}
+	call.media.relay.SetSecure(media.LegB, secure)
+}
+
+// newCallMedia 为新呼叫创建媒体中继会话，请求生效的媒体模式不是 relay 或 release 时返回 nil
+func (b *B2BUA) newCallMedia(req sip.Request) *callMedia {
+	mode := b.requestConfig(req).MediaMode.Value
+	if b.mediaRelay == nil || (mode != MediaModeRelay && mode != MediaModeRelease) {
+		return nil
+	}
+	return &callMedia{relay: b.mediaRelay.NewSession(), mode: mode}
+}
+
+// relaySDP 将 from 一路的 SDP 改写为发往另一路的 SDP。未启用媒体中继或媒体已释放时只做拓扑隐藏，改写失败时原样返回
+func (b *B2BUA) relaySDP(call *B2BCall, from media.Leg, sdp string) string {
+	if !b.anchored(call) || sdp == "" {
+		return b.topology.hideSDP(sdp, b.stack.GetNetworkInfo("udp").Host)
+	}
+	rewritten, err := call.media.relay.Rewrite(from, sdp)
+	if err != nil {
+		call.Log().Errorf("Media relay: rewrite %s-Leg SDP failed: %v", from, err)
+		return sdp
+	}
+	return rewritten
+}
+
+// relayAnswer 改写 B 路的 answer 并在需要时启用转码，返回发往 A 路的 answer
+func (b *B2BUA) relayAnswer(call *B2BCall) string {
+	return b.transcodeAnswer(call, b.relaySDP(call, media.LegB, call.dest.RemoteSdp()))
+}
+
+// closeMedia 结束呼叫的录音并关闭媒体端口
+func (b *B2BUA) closeMedia(call *B2BCall) {
+	if call.media == nil {
+		return
+	}
+	b.stopRecording(call)
+	b.releaseTranscoding(call)
+	call.media.relay.Close()
+}
@@ -0,0 +1,134 @@
+package b2bua
+
+import (
+	"strings"
+	"time"
+
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+const (
+	mediaReleaseInterval = 500 * time.Millisecond // 检查两路连通的间隔
+	mediaReleaseWait     = 10 * time.Second       // 应答后等待两路都发送媒体的最长时间，超时后保持锚定
+)
+
+// anchored 呼叫的媒体是否经媒体中继锚定
+func (b *B2BUA) anchored(call *B2BCall) bool {
+	if call.media == nil {
+		return false
+	}
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	return !call.media.released
+}
+
+// releaseMode 返回呼叫应答后的媒体处理：呼叫分类的设置优先于创建媒体中继会话时请求生效的媒体模式
+func (b *B2BUA) releaseMode(call *B2BCall) string {
+	if mode := b.config.CallClasses[call.Class].MediaMode; mode != "" {
+		return mode
+	}
+	return call.media.mode
+}
+
+// needsRelay 返回呼叫必须保持锚定的原因，可以释放时返回空字符串
+func (b *B2BUA) needsRelay(call *B2BCall) string {
+	call.media.mutex.Lock()
+	recording, transcoding, held := call.media.recorder != nil, call.media.transcoding, call.media.held
+	call.media.mutex.Unlock()
+	b.dtmfHooks.mutex.RLock()
+	hooked := len(b.dtmfHooks.hooks) > 0
+	b.dtmfHooks.mutex.RUnlock()
+	relay := call.media.relay
+	switch {
+	case recording:
+		return "recording"
+	case transcoding:
+		return "transcoding"
+	case held:
+		return "hold"
+	case strings.EqualFold(b.config.MediaRelay.SRTP, SRTPTerminate):
+		return "SRTP termination"
+	case b.config.Fax.Detect:
+		return "fax detection"
+	case b.surveys(call):
+		return "post-call survey"
+	case b.topology != nil:
+		return "topology hiding"
+	case hooked:
+		return "DTMF hooks"
+	case b.interworkDTMF() && relay.HasTelephoneEvent(media.LegA) != relay.HasTelephoneEvent(media.LegB):
+		return "DTMF interworking"
+	}
+	return ""
+}
+
+// watchMediaRelease 通话应答后，媒体模式为 release 时等待两路都发送媒体。确认连通且两路都从 SDP
+// 中的地址发送（不在 NAT 后）时释放媒体；有一路在 NAT 后或在等待时间内未确认连通时保持锚定
+func (b *B2BUA) watchMediaRelease(call *B2BCall) {
+	if call.media == nil || b.releaseMode(call) != MediaModeRelease {
+		return
+	}
+	go func() {
+		deadline := time.Now().Add(mediaReleaseWait)
+		ticker := time.NewTicker(mediaReleaseInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if call.Context.isFinished() {
+				return
+			}
+			connected, direct := call.media.relay.DirectPath()
+			switch {
+			case connected && !direct:
+				call.Log().Infof("Media release: a leg is behind NAT, keeping media anchored")
+				b.metrics.Inc(MetricMediaRelease + "nat")
+				return
+			case connected:
+				b.releaseMedia(call)
+				return
+			case time.Now().After(deadline):
+				call.Log().Infof("Media release: connectivity not confirmed in %v, keeping media anchored", mediaReleaseWait)
+				b.metrics.Inc(MetricMediaRelease + "unconfirmed")
+				return
+			}
+		}
+	}()
+}
+
+// releaseMedia 将媒体释放为端到端：先向 A 路发送 B 路原始的 SDP，再将 A 路的应答发往 B 路，
+// 两路都接受后关闭中继端口。B 路拒绝时 A 路已直接发往 B 路，B 路仍经中继发往 A 路，因此保留中继
+func (b *B2BUA) releaseMedia(call *B2BCall) {
+	if reason := b.needsRelay(call); reason != "" {
+		call.Log().Infof("Media release: keeping media anchored for %s", reason)
+		b.metrics.Inc(MetricMediaRelease + "kept")
+		return
+	}
+	offer, err := media.NextVersion(call.src.LocalSdp(), call.dest.RemoteSdp())
+	if err != nil {
+		call.Log().Warnf("Media release: %v", err)
+		b.metrics.Inc(MetricMediaRelease + "failed")
+		return
+	}
+	resp, err := call.src.ReInviteWithContext(call.ctx, offer)
+	if err != nil {
+		call.Log().Warnf("Media release: re-INVITE to A-Leg failed: %v", err)
+		b.metrics.Inc(MetricMediaRelease + "failed")
+		return
+	}
+	if offer, err = media.NextVersion(call.dest.LocalSdp(), session.SdpBody(resp)); err == nil {
+		_, err = call.dest.ReInviteWithContext(call.ctx, offer)
+	}
+	if err != nil {
+		call.Log().Warnf("Media release: re-INVITE to B-Leg failed, keeping the relay: %v", err)
+		b.metrics.Inc(MetricMediaRelease + "failed")
+		return
+	}
+
+	call.media.mutex.Lock()
+	call.media.released = true
+	call.media.mutex.Unlock()
+	call.media.relay.Close()
+	call.Context.Set("media", "released") // 在话单中记录媒体已释放
+	b.metrics.Inc(MetricMediaRelease + "released")
+	call.Log().Infof("Media release: media released end to end")
+}
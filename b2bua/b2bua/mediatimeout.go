@@ -0,0 +1,74 @@
+package b2bua
+
+import (
+	"time"
+)
+
+const mediaTimeoutCheckInterval = time.Second // 媒体超时的检查间隔
+
+// mediaTimeout 返回当前适用的媒体超时，0 表示不检测
+func (b *B2BUA) mediaTimeout(call *B2BCall) time.Duration {
+	call.media.mutex.Lock()
+	held := call.media.held
+	call.media.mutex.Unlock()
+	if held {
+		return time.Duration(b.config.MediaRelay.HoldTimeout) * time.Second
+	}
+	return time.Duration(b.config.MediaRelay.Timeout) * time.Second
+}
+
+// watchMediaTimeout 通话应答后检测媒体超时：两个方向都没有媒体包超过配置的时间时，
+// 向两路发送 BYE 并在话单中记录 media_timeout。同一呼叫只检测一次
+func (b *B2BUA) watchMediaTimeout(call *B2BCall) {
+	if call.media == nil || (b.config.MediaRelay.Timeout <= 0 && b.config.MediaRelay.HoldTimeout <= 0) {
+		return
+	}
+	call.media.mutex.Lock()
+	watching := call.media.watching
+	call.media.watching = true
+	call.media.mutex.Unlock()
+	if watching {
+		return
+	}
+
+	answered := time.Now()
+	go func() {
+		ticker := time.NewTicker(mediaTimeoutCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if call.Context.isFinished() || !b.anchored(call) { // 媒体释放后中继收不到媒体包
+				return
+			}
+			timeout := b.mediaTimeout(call)
+			last := call.media.relay.LastReceived()
+			if last.Before(answered) { // 从应答开始计时
+				last = answered
+			}
+			idle := time.Since(last)
+			if timeout <= 0 || idle < timeout {
+				continue
+			}
+			call.Log().Warnf("Media timeout: no media for %v, terminating call", idle.Round(time.Second))
+			call.Context.markMediaTimeout()
+			b.metrics.Inc(MetricMediaTimeout)
+			call.dest.End()
+			call.src.End()
+			return
+		}
+	}()
+}
+
+// setHeld 记录通话的保持状态，保持期间使用 hold_timeout
+func (b *B2BUA) setHeld(call *B2BCall, held bool) {
+	if held {
+		call.Context.transition(CallHeld)
+	} else {
+		call.Context.transition(CallAnswered)
+	}
+	if call.media == nil {
+		return
+	}
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	call.media.held = held
+}
@@ -0,0 +1,100 @@
+package b2bua
+
+import "sync"
+
+// 计数器名称
+const (
+	MetricRateLimited     = "flood.rate_limited"  // 超过速率或被封禁而丢弃的请求
+	MetricMalformed       = "flood.malformed"     // 畸形请求
+	MetricScannerDropped  = "scanner.dropped"     // 匹配扫描器特征而丢弃的请求
+	MetricScannerRejected = "scanner.rejected"    // 匹配扫描器特征而返回 403 的请求
+	MetricScannerUA       = "scanner.user_agent." // 按 User-Agent 特征统计，后缀为特征
+	MetricScannerDomain   = "scanner.to_domain."  // 按 To 域名特征统计，后缀为域名
+	MetricUnknownDialog   = "dialog.unknown."     // 不属于已知通话的对话内请求，后缀为方法名
+	MetricACLRejected     = "acl.rejected."       // 被 ACL 拒绝的请求，后缀为 listener.<传输协议>、profile.<名称> 或 trunk.<中继名称>
+	MetricRegisterQueued  = "register.queued"     // 注册风暴时排队等待的 REGISTER
+	MetricRegisterPaced   = "register.paced"      // 注册风暴时返回 503 的 REGISTER
+	MetricRouteFailover   = "route.failover"      // 出局呼叫切换到备用地址的次数
+	MetricHEPSent         = "hep.sent"            // 发送到抓包服务器的 SIP 消息
+	MetricHEPFailed       = "hep.failed"          // 发送失败的抓包
+	MetricHEPDropped      = "hep.dropped"         // 队列已满而丢弃的抓包
+	MetricCapacity        = "capacity."           // 容量统计，后缀为 <资源>.exhausted、<资源>.queued 或 <资源>.rejected，资源为 media_ports、transcoding、calls、bandwidth、registrations、register_rate 或 drain；capacity.calls、capacity.bandwidth（kbps）、capacity.registrations 为当前数量
+	MetricRetransmit      = "retransmit."         // 重传统计，后缀为 invite（重复的 INVITE）、ack（重复的 ACK）、2xx（重传的 200 OK）或 ack_timeout
+	MetricWebhook         = "webhook."            // webhook 发送统计，后缀为 <名称>.delivered、<名称>.failed 或 <名称>.dropped
+	MetricCallClass       = "call.class."         // 按呼叫分类统计，后缀为 internal、inbound、outbound 或 transit
+	MetricMediaTimeout    = "media.timeout"       // 因媒体超时而结束的通话
+	MetricMediaRelease    = "media.release."      // 媒体模式 release 的呼叫，后缀为 released（已释放为端到端）、nat（有一路在 NAT 后，保持锚定）、unconfirmed（未确认连通）、kept（录音、转码等需要中继）或 failed（re-INVITE 失败）
+	MetricQuality         = "quality."            // 已结束通话按 MOS 分级统计，后缀为 good、fair 或 poor；quality.active.poor 为当前 MOS 低于 3.1 的通话数
+	MetricTransitRejected = "transit.rejected."   // 达到跳数上限而返回 483 的呼叫，后缀为 global 或 trunk.<中继名称>
+	MetricNumberBlocked   = "numbers.blocked"     // 主叫或被叫号码被黑白名单拒绝的呼叫
+	MetricAnonymous       = "anonymous.rejected"  // 被叫开启匿名呼叫拒绝而返回 433 的呼叫
+	MetricVideoRefresh    = "video.refresh."      // 向一路请求视频关键帧的次数，后缀为 answer、reinvite 或 loss
+	MetricForward         = "forward."            // 前转的呼叫，后缀为 unconditional、user-busy 或 no-answer
+	MetricAlert           = "alert."              // 内置告警触发的次数，后缀为规则名称
+	MetricFeatureCode     = "feature_code."       // 功能码的使用次数，后缀为功能，如 forward_all_on、do_not_disturb、callback
+	MetricDoNotDisturb    = "features.dnd"        // 被叫开启免打扰而按遇忙处理的呼叫
+	MetricRingTimeout     = "ring.timeout."       // 振铃超时而取消的呼叫，后缀为 account（本地被叫）或 route（出局分支）
+	MetricProfileDomain   = "profile.domain."     // 请求 URI 不是 profile 服务的域名而返回 404 的请求，后缀为 profile 名称
+	MetricProfileBridge   = "profile.bridge."     // profile 不允许桥接到目的地所属 profile 而拒绝的呼叫，后缀为 A 路 profile 名称
+	MetricConference      = "conference."         // 会议室与会者加入、离开的次数，后缀为 joined 或 left
+	MetricENUM            = "enum."               // 经中继出局前的 ENUM 查询结果，后缀为 hit、miss 或 error
+	MetricScaleOut        = "scale_out."          // 水平扩展统计，后缀为 forwarded（转发给拥有流的节点的分支）、sync_failed 或 expired（移除的其它节点的注册）
+	MetricCluster         = "cluster."            // 主备统计，后缀为 replicated、replication_failed、active/standby（角色切换）、bye 或 refresh（接管后处理的对话内请求）
+	MetricRegEvent        = "reg_event."          // 注册事件包统计，后缀为 subscribed、notified 或 failed（NOTIFY 失败而删除的订阅）
+	MetricDispatcher      = "dispatcher."         // 负载分发统计，后缀为 calls、unavailable（没有可用目标）、down 或 up（目标状态变化）
+	MetricHuntGroup       = "hunt_group."         // 振铃组统计，后缀为 <组名>.calls、answered 或 no_answer
+	MetricPaging          = "paging."             // 寻呼统计，后缀为 started 或 answered（自动应答的成员分支）
+	MetricPickup          = "pickup."             // 代答功能码的结果，后缀为 directed、group、not_found 或 failed
+	MetricQueue           = "queue."              // 呼叫队列统计，后缀为 <队列>.entered、answered、abandoned、timeout、full 或 wait_ms（已应答呼叫的总等待毫秒数）
+	MetricFax             = "fax."                // 传真统计，后缀为 t38、g711、cng、ced、t38.rejected（按配置拒绝）或 t38.refused（另一路拒绝）
+)
+
+// metrics 保存进程内的计数器
+type metrics struct {
+	mutex    sync.Mutex
+	counters map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{counters: make(map[string]uint64)}
+}
+
+// Inc 将计数器加一
+func (m *metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Add 将计数器增加 delta
+func (m *metrics) Add(name string, delta uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name] += delta
+}
+
+// Snapshot 返回所有计数器的副本
+func (m *metrics) Snapshot() map[string]uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	snapshot := make(map[string]uint64, len(m.counters))
+	for name, value := range m.counters {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// Metrics 返回所有计数器的当前值，以及当前的呼叫数、媒体带宽、注册数和媒体质量差的通话数
+func (b *B2BUA) Metrics() map[string]uint64 {
+	snapshot := b.metrics.Snapshot()
+	snapshot[MetricCapacity+capacityCalls] = uint64(b.activeCalls())
+	snapshot[MetricCapacity+capacityBandwidth] = uint64(b.activeBandwidth())
+	snapshot[MetricCapacity+capacityRegistrations] = uint64(b.activeRegistrations())
+	poor := uint64(0)
+	for _, report := range b.WorstQuality(0) {
+		if report.Quality.MOS >= poorMOS {
+			break
+		}
+		poor++
+	}
+	snapshot[MetricQuality+"active.poor"] = poor
+	return snapshot
+}
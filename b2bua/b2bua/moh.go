@@ -0,0 +1,64 @@
+package b2bua
+
+import (
+	"go-sip-ua/pkg/media"
+)
+
+// MusicOnHoldConfig 保持音乐配置，需要启用媒体中继
+type MusicOnHoldConfig struct {
+	File string `json:"file"` // 一路保持通话（sendonly/inactive）时向另一路播放的音频文件（单声道 16 位 PCM WAV），为空时不播放
+}
+
+// holdOffer 检查 from 一路的 re-INVITE 是否为保持。启用保持音乐时将发往另一路的 offer 改为 sendonly，
+// 使另一路接收媒体中继播放的保持音乐
+func (b *B2BUA) holdOffer(call *B2BCall, offer, relayed string) (string, bool) {
+	if b.holdMusic == nil || !b.anchored(call) || !media.IsHold(offer) {
+		return relayed, false
+	}
+	return setAudioDirection(call, relayed, func(string) string { return "sendonly" }), true
+}
+
+// holdAnswer 将另一路对 sendonly offer 的应答改回与保持方原 offer 相符：原 offer 为 inactive 时应答 inactive
+func (b *B2BUA) holdAnswer(call *B2BCall, offer, answer string) string {
+	original, err := media.ParseSDP(offer)
+	if err != nil {
+		return answer
+	}
+	for _, section := range original.Media {
+		if section.Port() != 0 && section.Type() == "audio" && section.Direction() == "inactive" {
+			return setAudioDirection(call, answer, func(string) string { return "inactive" })
+		}
+	}
+	return answer
+}
+
+// setAudioDirection 按 direction 改写各音频流的方向属性，解析失败时原样返回
+func setAudioDirection(call *B2BCall, sdp string, direction func(string) string) string {
+	parsed, err := media.ParseSDP(sdp)
+	if err != nil {
+		call.Log().Warnf("Music on hold: %v", err)
+		return sdp
+	}
+	for _, section := range parsed.Media {
+		if section.Port() != 0 && section.Type() == "audio" {
+			section.SetDirection(direction(section.Direction()))
+		}
+	}
+	return parsed.String()
+}
+
+// startMusicOnHold 向被保持的一路播放保持音乐
+func (b *B2BUA) startMusicOnHold(call *B2BCall, to media.Leg) {
+	if err := call.media.relay.Play(to, b.holdMusic); err != nil {
+		call.Log().Warnf("Music on hold: %v", err)
+		return
+	}
+	call.Log().Infof("Music on hold to %s-Leg", to)
+}
+
+// stopMusicOnHold 恢复通话时停止播放保持音乐
+func (b *B2BUA) stopMusicOnHold(call *B2BCall, to media.Leg) {
+	if b.holdMusic != nil && call.media != nil {
+		call.media.relay.StopPlay(to)
+	}
+}
@@ -0,0 +1,76 @@
+package b2bua
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ClientAuthMode 表示 TLS 监听对客户端证书的要求
+type ClientAuthMode string
+
+const (
+	ClientAuthNone    ClientAuthMode = ""        // 不要求客户端证书
+	ClientAuthVerify  ClientAuthMode = "verify"  // 客户端提供证书时校验
+	ClientAuthRequire ClientAuthMode = "require" // 必须提供有效的客户端证书
+)
+
+// ClientIdentity 将客户端证书主体映射到账户或中继
+type ClientIdentity struct {
+	Subject string `json:"subject"` // 证书的 CN、DNS 名、URI 或邮箱
+	Account string `json:"account"` // 对应的 SIP 账户，只能以该账户注册和呼叫
+	Trunk   string `json:"trunk"`   // 对应的中继名称，该中继的请求都跳过摘要认证
+}
+
+// certNames 返回证书中可用于映射的名称
+func certNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// clientIdentity 返回请求所在 TLS 连接的客户端证书对应的身份，请求不是经 TLS 或 WSS 收到、或未映射时返回 nil
+func (b *B2BUA) clientIdentity(req sip.Request) *ClientIdentity {
+	if b.stack == nil || len(b.config.TLS.ClientIdentities) == 0 {
+		return nil
+	}
+	cert := b.stack.PeerCertificate(req.Transport(), req.Source())
+	if cert == nil {
+		return nil
+	}
+	for _, name := range certNames(cert) {
+		for i, identity := range b.config.TLS.ClientIdentities {
+			if name != "" && strings.EqualFold(identity.Subject, name) {
+				return &b.config.TLS.ClientIdentities[i]
+			}
+		}
+	}
+	return nil
+}
+
+// mutuallyAuthenticated 检查请求是否来自通过双向 TLS 认证、且身份与请求一致的对端。
+// 映射到中继的对端总是可信；映射到账户的对端只能以该账户注册（To）或呼叫（From）。
+func (b *B2BUA) mutuallyAuthenticated(req sip.Request) bool {
+	identity := b.clientIdentity(req)
+	if identity == nil {
+		return false
+	}
+	if identity.Trunk != "" {
+		return true
+	}
+
+	var user sip.MaybeString
+	if req.Method() == sip.REGISTER {
+		if to, ok := req.To(); ok && to.Address != nil {
+			user = to.Address.User()
+		}
+	} else if from, ok := req.From(); ok && from.Address != nil {
+		user = from.Address.User()
+	}
+	return identity.Account != "" && user != nil && user.String() == identity.Account
+}
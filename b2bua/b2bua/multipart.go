@@ -0,0 +1,40 @@
+package b2bua
+
+import (
+	"strings"
+
+	"go-sip-ua/pkg/session"
+)
+
+// bodyParts 返回随 SDP 转发到 B 路的消息体部分（如 SIP-T ISUP、PIDF-LO 位置信息）。
+// 按中继或全局的 strip_parts 去掉指定类型的部分，紧急呼叫总是保留 PIDF-LO
+func (b *B2BUA) bodyParts(call *B2BCall, target routeTarget, emergency bool) []session.BodyPart {
+	parts := call.src.RemoteBodyParts()
+	strip := b.config.StripParts
+	if target.trunk != nil && target.trunk.StripParts != nil {
+		strip = target.trunk.StripParts
+	}
+	var kept []session.BodyPart
+	for _, part := range parts {
+		if emergency && part.ContentType() == pidfContentType {
+			kept = append(kept, part)
+			continue
+		}
+		if stripPart(strip, part.ContentType()) {
+			call.Log().Debugf("Strip %s body part toward %v", part.ContentType(), target)
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return kept
+}
+
+// stripPart 判断 contentType 类型的部分是否需要去掉
+func stripPart(strip []string, contentType string) bool {
+	for _, pattern := range strip {
+		if pattern == "*" || strings.EqualFold(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 号码名单的类型
+const (
+	NumberCallers = "callers" // 主叫号码，按被叫的租户检查
+	NumberCallees = "callees" // 被叫号码，按主叫的租户检查
+)
+
+// 号码名单
+const (
+	NumberBlacklist = "blacklist" // 黑名单：匹配的号码被拒绝
+	NumberWhitelist = "whitelist" // 白名单：设置后只允许匹配的号码
+)
+
+const allTenants = "*" // 用于所有租户的名单
+
+// NumberLists 一个租户的主叫和被叫号码名单
+type NumberLists struct {
+	Callers NumberList `json:"callers"` // 呼叫该租户用户的主叫号码
+	Callees NumberList `json:"callees"` // 该租户用户呼叫的被叫号码
+}
+
+// NumberList 号码黑名单和白名单，号码以 * 结尾时按前缀匹配（如 400*）。黑名单优先于白名单
+type NumberList struct {
+	Blacklist []string `json:"blacklist"` // 拒绝的号码
+	Whitelist []string `json:"whitelist"` // 为空时不限制，否则只允许这些号码
+}
+
+// matchesNumber 检查号码是否匹配名单中的一项
+func matchesNumber(list []string, number string) bool {
+	for _, entry := range list {
+		if prefix := strings.TrimSuffix(entry, "*"); prefix != entry {
+			if strings.HasPrefix(number, prefix) {
+				return true
+			}
+		} else if entry == number {
+			return true
+		}
+	}
+	return false
+}
+
+// allows 检查号码是否允许，不允许时返回匹配的名单
+func (l *NumberList) allows(number string) (bool, string) {
+	if matchesNumber(l.Blacklist, number) {
+		return false, NumberBlacklist
+	}
+	if len(l.Whitelist) > 0 && !matchesNumber(l.Whitelist, number) {
+		return false, NumberWhitelist
+	}
+	return true, ""
+}
+
+// list 返回类型和名单对应的切片
+func (l *NumberLists) list(kind, name string) (*[]string, error) {
+	var list *NumberList
+	switch kind {
+	case NumberCallers:
+		list = &l.Callers
+	case NumberCallees:
+		list = &l.Callees
+	default:
+		return nil, fmt.Errorf("invalid number list kind %q, expected callers or callees", kind)
+	}
+	switch name {
+	case NumberBlacklist:
+		return &list.Blacklist, nil
+	case NumberWhitelist:
+		return &list.Whitelist, nil
+	}
+	return nil, fmt.Errorf("invalid number list %q, expected blacklist or whitelist", name)
+}
+
+// numberLists 按租户保存的号码名单，可在运行时通过 REST 接口和命令行修改
+type numberLists struct {
+	mutex   sync.Mutex
+	tenants map[string]*NumberLists
+}
+
+// newNumberLists 从配置创建号码名单
+func newNumberLists(config map[string]NumberLists) *numberLists {
+	n := &numberLists{tenants: make(map[string]*NumberLists)}
+	for tenant, lists := range config {
+		lists := lists
+		n.tenants[strings.ToLower(tenant)] = &lists
+	}
+	return n
+}
+
+// check 检查号码是否被租户或所有租户的名单拒绝，拒绝时返回匹配的层级和名单
+func (n *numberLists) check(tenant, kind, number string) (bool, string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, scope := range []string{allTenants, strings.ToLower(tenant)} {
+		lists, found := n.tenants[scope]
+		if !found {
+			continue
+		}
+		list := &lists.Callers
+		if kind == NumberCallees {
+			list = &lists.Callees
+		}
+		if ok, name := list.allows(number); !ok {
+			return false, scope + " " + name
+		}
+	}
+	return true, ""
+}
+
+// checkNumbers 检查 INVITE 的主叫号码（按被叫的租户）和被叫号码（按主叫的租户），拒绝时返回原因
+func (b *B2BUA) checkNumbers(req sip.Request) (bool, string) {
+	from, _ := req.From()
+	to, _ := req.To()
+	if from == nil || to == nil || from.Address == nil || to.Address == nil {
+		return true, ""
+	}
+	if from.Address.User() != nil {
+		if ok, list := b.numberLists.check(to.Address.Host(), NumberCallers, from.Address.User().String()); !ok {
+			return false, fmt.Sprintf("caller %s matched %s", from.Address.User(), list)
+		}
+	}
+	return b.allowsCallee(from.Address, to.Address)
+}
+
+// allowsCallee 按主叫的租户检查被叫号码，用于呼叫、第三方呼叫和前转目的地，拒绝时返回原因
+func (b *B2BUA) allowsCallee(caller, callee sip.Uri) (bool, string) {
+	if callee.User() != nil {
+		if ok, list := b.numberLists.check(caller.Host(), NumberCallees, callee.User().String()); !ok {
+			return false, fmt.Sprintf("callee %s matched %s", callee.User(), list)
+		}
+	}
+	return true, ""
+}
+
+// NumberLists 返回所有租户的号码名单，键为租户域名，* 表示所有租户
+func (b *B2BUA) NumberLists() map[string]NumberLists {
+	b.numberLists.mutex.Lock()
+	defer b.numberLists.mutex.Unlock()
+	lists := make(map[string]NumberLists, len(b.numberLists.tenants))
+	for tenant, l := range b.numberLists.tenants {
+		lists[tenant] = NumberLists{
+			Callers: NumberList{Blacklist: sortedCopy(l.Callers.Blacklist), Whitelist: sortedCopy(l.Callers.Whitelist)},
+			Callees: NumberList{Blacklist: sortedCopy(l.Callees.Blacklist), Whitelist: sortedCopy(l.Callees.Whitelist)},
+		}
+	}
+	return lists
+}
+
+// sortedCopy 返回排序后的副本
+func sortedCopy(list []string) []string {
+	copied := append([]string{}, list...)
+	sort.Strings(copied)
+	return copied
+}
+
+// AddNumber 将号码（或以 * 结尾的前缀）加入租户的名单，kind 为 callers 或 callees，list 为 blacklist 或 whitelist
+func (b *B2BUA) AddNumber(tenant, kind, list, number string) error {
+	if number == "" {
+		return errors.New("missing number")
+	}
+	tenant = strings.ToLower(tenant)
+	b.numberLists.mutex.Lock()
+	defer b.numberLists.mutex.Unlock()
+	lists, found := b.numberLists.tenants[tenant]
+	if !found {
+		lists = &NumberLists{}
+	}
+	entries, err := lists.list(kind, list)
+	if err != nil {
+		return err
+	}
+	for _, entry := range *entries {
+		if entry == number {
+			return nil
+		}
+	}
+	*entries = append(*entries, number)
+	b.numberLists.tenants[tenant] = lists
+	logger.Infof("Number %s added to %s %s %s", number, tenant, kind, list)
+	return nil
+}
+
+// RemoveNumber 从租户的名单中删除号码，号码不在名单中时返回 false
+func (b *B2BUA) RemoveNumber(tenant, kind, list, number string) (bool, error) {
+	tenant = strings.ToLower(tenant)
+	b.numberLists.mutex.Lock()
+	defer b.numberLists.mutex.Unlock()
+	lists, found := b.numberLists.tenants[tenant]
+	if !found {
+		lists = &NumberLists{}
+	}
+	entries, err := lists.list(kind, list)
+	if err != nil {
+		return false, err
+	}
+	for i, entry := range *entries {
+		if entry == number {
+			*entries = append((*entries)[:i], (*entries)[i+1:]...)
+			logger.Infof("Number %s removed from %s %s %s", number, tenant, kind, list)
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,235 @@
+package b2bua
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/google/uuid"
+	registry2 "go-sip-ua/b2bua/registry"
+	"go-sip-ua/pkg/account"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// 第三方呼叫控制的错误
+var (
+	ErrOriginateNeedsRelay = errors.New("originate requires the media relay")
+	ErrNoOriginateRoute    = errors.New("no route to originate target")
+	ErrCapacityExhausted   = errors.New("call capacity exhausted")
+	ErrUnknownCaller       = errors.New("caller is not a local account")
+	ErrCalleeNotAllowed    = errors.New("callee not allowed for caller")
+)
+
+const defaultOriginateTimeout = 30 // 等待 A 方应答的默认时间（秒）
+
+// Originate 发起第三方呼叫（点击拨号，RFC 3725）：先呼叫 A 方（From 为 B 方），A 方应答后以 A 方为主叫，
+// 按转接的路由（本地账户、中继或上游）呼叫 B 方并接通两方。A 方的 offer 由媒体中继生成，因此要求启用媒体中继。
+// caller 须为本地账户，callee 须通过主叫租户的被叫号码名单（number_lists 的 callees）。两者为号码、user@域名或 SIP URI，
+// 只有号码时使用默认域名；timeout 为等待 A 方应答的秒数，0 为 30 秒。
+// A 路发出后呼叫即加入呼叫列表，可被查询、挂断并计入容量。返回呼叫 ID，之后的进展经事件和话单通知
+func (b *B2BUA) Originate(caller, callee string, timeout int) (string, error) {
+	callerURI, err := b.ParseAOR(caller)
+	if err != nil {
+		return "", err
+	}
+	calleeURI, err := b.ParseAOR(callee)
+	if err != nil {
+		return "", err
+	}
+	if callerURI.User() == nil || !b.hasAccount(callerURI.User().String()) { // 只能以本地账户为主叫
+		return "", ErrUnknownCaller
+	}
+	if ok, reason := b.allowsCallee(callerURI, calleeURI); !ok { // 主叫租户的被叫号码名单
+		logger.Warnf("Originate: %s", reason)
+		return "", ErrCalleeNotAllowed
+	}
+	if b.mediaRelay == nil {
+		return "", ErrOriginateNeedsRelay
+	}
+	if o := b.capacity.AdmitCall(0); o != nil {
+		return "", ErrCapacityExhausted
+	}
+
+	call := &B2BCall{
+		ID:      uuid.New().String(),
+		Caller:  callerURI.String(),
+		Callee:  calleeURI.String(),
+		Start:   time.Now(),
+		Context: newCallContext(),
+		users:   []string{userOf(callerURI), userOf(calleeURI)},
+		media:   &callMedia{relay: b.mediaRelay.NewSession(), mode: MediaModeRelay},
+		origin:  callerURI,
+	}
+	call.ctx, call.cancel = context.WithCancel(b.ctx)
+	call.Context.Set("originated", "3pcc")
+	offer, err := call.media.relay.Offer(media.LegA)
+	if err != nil {
+		call.cancel()
+		call.media.relay.Close()
+		return "", err
+	}
+	call.src = b.dialParty(call, callerURI, calleeURI, offer)
+	if call.src == nil {
+		call.cancel()
+		call.media.relay.Close()
+		return "", ErrNoOriginateRoute
+	}
+	call.called = calleeURI
+	b.addCall(call) // 只有 A 路的呼叫，A 方应答并呼叫 B 方后由 B 路的分支取代
+	call.Log().Infof("Originate: calling %v for %v", callerURI, calleeURI)
+	b.emitFor(call.users, EventCallStarted, map[string]interface{}{
+		"call_id": call.ID,
+		"caller":  call.Caller,
+		"callee":  call.Callee,
+		"context": call.Context.All(),
+	})
+	sess := call.src
+	switch { // A 路在加入呼叫列表之前已结束或应答
+	case sess.IsEnded():
+		resp := sess.Response()
+		b.originEnded(sess, &resp, session.Failure)
+		return call.ID, nil
+	case sess.Status() == session.Confirmed:
+		b.originAnswered(sess)
+		return call.ID, nil
+	}
+	if timeout <= 0 {
+		timeout = defaultOriginateTimeout
+	}
+	time.AfterFunc(time.Duration(timeout)*time.Second, func() { // A 方未应答时取消，呼叫以 408 结束
+		if b.findOrigin(sess) == call && sess.IsInProgress() {
+			call.Log().Infof("Originate: %s did not answer within %ds", call.Caller, timeout)
+			call.Context.release(failureCause(408), 408)
+			sess.End()
+		}
+	})
+	return call.ID, nil
+}
+
+// findOrigin 查找 A 路会话所属、尚未呼叫 B 方的第三方呼叫
+func (b *B2BUA) findOrigin(sess *session.Session) *B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		if call.src == sess && call.dest == nil && call.origin != nil {
+			return call
+		}
+	}
+	return nil
+}
+
+// answerOrigin 记录 A 方的应答并返回 sess 所属、尚未呼叫 B 方的第三方呼叫，每个呼叫只返回一次
+func (b *B2BUA) answerOrigin(sess *session.Session) *B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		if call.src == sess && call.dest == nil && call.origin != nil && call.answer == "" {
+			call.answer = sess.LocalSdp() // B 路 offer 只保留协商好的编解码，B 方应答时不再应答 A 路
+			return call
+		}
+	}
+	return nil
+}
+
+// dropOrigin 移除只有 A 路的呼叫，呼叫没有其它分支时输出话单
+func (b *B2BUA) dropOrigin(call *B2BCall, state session.Status) {
+	b.callsMu.Lock()
+	last := true
+	for i := 0; i < len(b.calls); i++ {
+		if b.calls[i] == call {
+			b.calls = append(b.calls[:i], b.calls[i+1:]...)
+			i--
+		} else if b.calls[i].ID == call.ID {
+			last = false
+		}
+	}
+	b.callsMu.Unlock()
+	if last {
+		b.finishCall(call, state)
+	}
+}
+
+// originAnswered A 方应答后以 A 方为主叫呼叫 B 方，sess 不是第三方呼叫的 A 路时返回 false
+func (b *B2BUA) originAnswered(sess *session.Session) bool {
+	call := b.answerOrigin(sess)
+	if call == nil {
+		return false
+	}
+	call.Log().Infof("Originate: %s answered, calling %v", call.Caller, call.called)
+	if !b.transferLeg(call, call.called) {
+		call.Log().Warnf("Originate: no route to %v", call.called)
+		call.Context.release(CauseRejected, 0)
+		sess.End()
+		b.dropOrigin(call, session.Failure)
+		return true
+	}
+	b.dropOrigin(call, session.Failure)
+	if sess.IsEnded() { // A 方在呼叫 B 方期间已挂机
+		for _, leg := range b.callLegs(call.ID) {
+			leg.dest.End()
+		}
+	}
+	return true
+}
+
+// originEnded A 方未应答、拒绝或在呼叫 B 方之前挂机时结束呼叫，sess 不是第三方呼叫的 A 路时返回 false
+func (b *B2BUA) originEnded(sess *session.Session, resp *sip.Response, state session.Status) bool {
+	call := b.findOrigin(sess)
+	if call == nil {
+		return false
+	}
+	switch state {
+	case session.Failure:
+		code := finalCode(resp)
+		call.Log().Infof("Originate: %s did not answer (%d)", call.Caller, code)
+		call.Context.release(failureCause(code), int(code))
+	case session.Terminated:
+		call.Context.release(CauseCallerHangup, 0)
+	}
+	b.dropOrigin(call, state)
+	return true
+}
+
+// dialParty 以 from 为主叫呼叫 party：本地账户呼叫其第一个可用的联系地址，否则按号码前缀经中继或发往上游。
+// 返回 A 路的会话，无法发出时返回 nil
+func (b *B2BUA) dialParty(call *B2BCall, party, from sip.Uri, offer string) *session.Session {
+	for _, target := range b.partyTargets(call, party) {
+		profile := account.NewProfile(b.topology.hideURI(from, b.stack.GetNetworkInfo("udp").Host), "", nil, 0, b.stack)
+		if target.proxy != nil { // 经出局代理发送
+			profile.Routes = []sip.Uri{target.proxy}
+		}
+		headers := b.sendFromProfile(target, profile, nil)
+		sess, err := b.ua.InviteWithParts(call.ctx, profile, party, target.recipient, &offer, nil, headers...)
+		if err == nil {
+			return sess
+		}
+		call.Log().Warnf("Originate: INVITE to %v failed: %v", target.recipient.String(), err)
+	}
+	return nil
+}
+
+// partyTargets 返回呼叫 party 的候选地址：本地账户为其联系地址（按 q 值排序），否则为中继或上游
+func (b *B2BUA) partyTargets(call *B2BCall, party sip.Uri) []routeTarget {
+	if contacts, found := b.registry.GetContacts(b.registryAOR(party)); found && party.User() != nil {
+		var targets []routeTarget
+		nodes := make(map[string]bool)
+		for _, group := range registry2.ForkOrder(*contacts) {
+			for _, instance := range group {
+				if recipient, ok := b.contactRecipient(call, party.User().String(), instance, nodes); ok {
+					targets = append(targets, routeTarget{recipient: recipient, local: true, profile: b.contactProfile(instance)})
+				}
+			}
+		}
+		return targets
+	}
+	recipient, proxy, trunk := b.routeTrunk(party)
+	if recipient == nil {
+		recipient, proxy = b.routeUpstream(party), b.outboundProxy
+	}
+	if recipient == nil {
+		return nil
+	}
+	return b.routeTargets(call, *recipient, proxy, trunk)
+}
@@ -0,0 +1,165 @@
+package b2bua
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+	registry2 "go-sip-ua/b2bua/registry"
+	"go-sip-ua/pkg/session"
+)
+
+// testLeg creates an outgoing session in the given state; requests it sends are appended to sent.
+func testLeg(t *testing.T, to string, status session.Status, sent *[]sip.Request) *session.Session {
+	t.Helper()
+	req := parseRequest(t, "127.0.0.1:5060", "udp",
+		"INVITE sip:"+to+"@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK-"+to,
+		"From: <sip:200@example.com>;tag=from",
+		"To: <sip:"+to+"@example.com>",
+		"Call-ID: "+to+"@example.com",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:b2bua@127.0.0.1:5060>",
+		"Content-Length: 0")
+	contact := &sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: "b2bua"}, FHost: "127.0.0.1"}}
+	callID, _ := req.CallID()
+	record := func(ctx context.Context, request sip.Request, authorizer sip.Authorizer, waitForResult bool, attempt int) (sip.Response, error) {
+		*sent = append(*sent, request)
+		return nil, nil
+	}
+	sess := session.NewInviteSession(record, "UAC", contact, req, *callID, nil, session.Outgoing, logger)
+	if status == session.Confirmed {
+		resp := sip.NewResponseFromRequest("", req, 200, "OK", "")
+		if to, ok := resp.To(); ok {
+			to.Params.Add("tag", sip.String{Str: "answered"})
+		}
+		sess.StoreResponse(resp)
+	}
+	sess.SetState(status)
+	return sess
+}
+
+func newOriginateTestB2BUA(t *testing.T) *B2BUA {
+	t.Helper()
+	config := &B2BUAConfig{
+		Domain:      "example.com",
+		NumberLists: map[string]NumberLists{"example.com": {Callees: NumberList{Blacklist: []string{"900*"}}}},
+	}
+	b := &B2BUA{
+		config:      config,
+		accounts:    map[string]string{"100": "secret"},
+		numberLists: newNumberLists(config.NumberLists),
+		features:    newAccountFeatures(config.Features),
+		metrics:     newMetrics(),
+		ctx:         context.Background(),
+	}
+	b.conferences.rooms = make(map[string]*conferenceRoom)
+	b.pages.pages = make(map[*session.Session]*page)
+	b.capacity = newCapacityManager(config.Capacity, 0, b.activeCalls, b.activeBandwidth, b.activeRegistrations, b.drainRemaining)
+	var err error
+	if b.queues, err = newCallQueues(nil, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if b.huntGroups, err = newHuntGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.trunkRoutes, err = newTrunkRoutes(nil); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestOriginateCaller checks that only local accounts may originate calls and only to callees their tenant may dial.
+func TestOriginateCaller(t *testing.T) {
+	b := newOriginateTestB2BUA(t)
+	tests := []struct {
+		caller, callee string
+		want           error
+	}{
+		{"999", "200", ErrUnknownCaller},
+		{"sip:example.com", "200", ErrUnknownCaller},
+		{"100", "9001", ErrCalleeNotAllowed},
+		{"100", "200", ErrOriginateNeedsRelay}, // checked only after the caller
+	}
+	for _, tt := range tests {
+		if _, err := b.Originate(tt.caller, tt.callee, 0); err != tt.want {
+			t.Errorf("Originate(%q, %q) err = %v; want %v", tt.caller, tt.callee, err, tt.want)
+		}
+	}
+}
+
+// TestOriginateLegFailure checks that when A has answered and the call to B fails, the A leg is hung up and
+// the call is removed.
+func TestOriginateLegFailure(t *testing.T) {
+	var sentA, sentB []sip.Request
+	a := testLeg(t, "100", session.Confirmed, &sentA)
+	bLeg := testLeg(t, "200", session.InviteSent, &sentB)
+
+	b := newOriginateTestB2BUA(t)
+	origin, _ := b.ParseAOR("100")
+	called, _ := b.ParseAOR("200")
+	call := &B2BCall{ID: "3pcc", Context: newCallContext(), src: a, dest: bLeg, origin: origin, called: called, answer: "v=0"}
+	b.addCall(call)
+
+	var resp sip.Response = sip.NewResponse("", "SIP/2.0", 486, "Busy Here", nil, "", nil)
+	b.handleInviteState(bLeg, nil, &resp, session.Failure)
+	if len(sentA) != 1 || sentA[0].Method() != sip.BYE {
+		t.Fatalf("A leg requests = %v; want one BYE", sentA)
+	}
+	if len(b.Calls()) != 0 {
+		t.Errorf("calls = %d; want 0", len(b.Calls()))
+	}
+	a.SetState(session.Terminated)
+	b.handleInviteState(a, nil, nil, session.Terminated) // result of the BYE
+	if len(sentB) != 0 {
+		t.Errorf("B leg requests = %v; want none", sentB)
+	}
+	if !call.Context.isFinished() {
+		t.Errorf("call not finished")
+	}
+}
+
+// TestOriginateNoAnswer checks that the call is removed when A does not answer before B is called.
+func TestOriginateNoAnswer(t *testing.T) {
+	var sent []sip.Request
+	a := testLeg(t, "100", session.InviteSent, &sent)
+
+	b := newOriginateTestB2BUA(t)
+	origin, _ := b.ParseAOR("100")
+	called, _ := b.ParseAOR("200")
+	b.addCall(&B2BCall{ID: "3pcc", Context: newCallContext(), src: a, origin: origin, called: called})
+
+	var resp sip.Response = sip.NewResponse("", "SIP/2.0", 480, "Temporarily Unavailable", nil, "", nil)
+	a.SetState(session.Failure)
+	b.handleInviteState(a, nil, &resp, session.Failure)
+	if len(b.Calls()) != 0 {
+		t.Errorf("calls = %d; want 0", len(b.Calls()))
+	}
+	if len(sent) != 0 {
+		t.Errorf("requests = %v; want none", sent)
+	}
+}
+
+// TestOriginateNoRoute checks that A is hung up and the call removed when A answers but B cannot be routed.
+func TestOriginateNoRoute(t *testing.T) {
+	var sent []sip.Request
+	a := testLeg(t, "100", session.Confirmed, &sent)
+
+	b := newOriginateTestB2BUA(t)
+	b.registry = registry2.NewMemoryRegistry()
+	origin, _ := b.ParseAOR("100")
+	called, _ := b.ParseAOR("300")
+	call := &B2BCall{ID: "3pcc", Context: newCallContext(), src: a, origin: origin, called: called}
+	b.addCall(call)
+
+	b.handleInviteState(a, nil, nil, session.Confirmed)
+	if len(sent) != 1 || sent[0].Method() != sip.BYE {
+		t.Fatalf("A leg requests = %v; want one BYE", sent)
+	}
+	if len(b.Calls()) != 0 {
+		t.Errorf("calls = %d; want 0", len(b.Calls()))
+	}
+	if !call.Context.isFinished() {
+		t.Errorf("call not finished")
+	}
+}
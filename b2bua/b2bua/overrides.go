@@ -0,0 +1,246 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 认证策略
+const (
+	AuthChallenge = "challenge" // 挑战 REGISTER 和 INVITE
+	AuthRegister  = "register"  // 只挑战 REGISTER
+	AuthNone      = "none"      // 不认证
+)
+
+// 媒体模式
+const (
+	MediaModeRelay   = "relay"   // 媒体经媒体中继锚定
+	MediaModeDirect  = "direct"  // 媒体在两端之间直接传输
+	MediaModeRelease = "release" // 媒体先经媒体中继锚定，应答后确认两路连通且都不在 NAT 后时释放为端到端
+)
+
+// ConfigOverrides 可在租户、监听、SIP profile、中继层级覆盖的配置项。配置按 全局 -> 租户 -> 监听 -> profile -> 中继 的顺序合并，
+// 下层设置的项覆盖上层，为空的项继承上层
+type ConfigOverrides struct {
+	Auth          string `json:"auth"`           // 认证策略：challenge、register、none；全局取值由 disable_auth 决定
+	MediaMode     string `json:"media_mode"`     // 媒体模式：relay、direct、release；全局取值由 media_relay.enabled 决定
+	HeaderProfile string `json:"header_profile"` // B 路 INVITE 使用的头域配置，header_profiles 中的名称
+}
+
+// HeaderProfile 头域配置：B 路 INVITE 从 A 路复制的头域及附加的头域
+type HeaderProfile struct {
+	Copy []string          `json:"copy"` // 从 A 路 INVITE 复制到 B 路的头域（如 P-Asserted-Identity、Diversion）
+	Add  map[string]string `json:"add"`  // B 路 INVITE 附加的头域
+}
+
+// EffectiveSetting 一项生效的配置及其来源层级
+type EffectiveSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"` // global、tenant:<域名>、listener:<传输协议>、profile:<名称>、trunk:<名称>
+}
+
+// EffectiveConfig 按层级合并后生效的配置
+type EffectiveConfig struct {
+	Auth          EffectiveSetting `json:"auth"`
+	MediaMode     EffectiveSetting `json:"media_mode"`
+	HeaderProfile EffectiveSetting `json:"header_profile"`
+}
+
+// apply 用一层的设置覆盖已合并的配置
+func (e *EffectiveConfig) apply(source string, overrides ConfigOverrides) {
+	if overrides.Auth != "" {
+		e.Auth = EffectiveSetting{Value: overrides.Auth, Source: source}
+	}
+	if overrides.MediaMode != "" {
+		e.MediaMode = EffectiveSetting{Value: overrides.MediaMode, Source: source}
+	}
+	if overrides.HeaderProfile != "" {
+		e.HeaderProfile = EffectiveSetting{Value: overrides.HeaderProfile, Source: source}
+	}
+}
+
+// globalOverrides 返回全局层的取值
+func (c *B2BUAConfig) globalOverrides() ConfigOverrides {
+	overrides := ConfigOverrides{Auth: AuthChallenge, MediaMode: MediaModeDirect, HeaderProfile: c.HeaderProfile}
+	if c.DisableAuth {
+		overrides.Auth = AuthNone
+	}
+	if c.MediaRelay.Enabled {
+		overrides.MediaMode = MediaModeRelay
+	}
+	return overrides
+}
+
+// layers 返回全局层之下配置的所有层
+func (c *B2BUAConfig) layers() map[string]ConfigOverrides {
+	layers := make(map[string]ConfigOverrides)
+	for tenant, overrides := range c.TenantOverrides {
+		layers["tenant:"+tenant] = overrides
+	}
+	for listener, overrides := range c.ListenerOverrides {
+		layers["listener:"+listener] = overrides
+	}
+	for _, profile := range c.Profiles {
+		layers["profile:"+profile.Name] = profile.Overrides
+	}
+	for _, trunk := range c.Trunks {
+		layers["trunk:"+trunk.Name] = trunk.Overrides
+	}
+	return layers
+}
+
+// validateOverrides 检查各层的取值
+func validateOverrides(config *B2BUAConfig) error {
+	layers := config.layers()
+	layers["global"] = config.globalOverrides()
+	for source, overrides := range layers {
+		switch overrides.Auth {
+		case "", AuthChallenge, AuthRegister, AuthNone:
+		default:
+			return fmt.Errorf("%s: invalid auth policy %q", source, overrides.Auth)
+		}
+		switch overrides.MediaMode {
+		case "", MediaModeRelay, MediaModeDirect, MediaModeRelease:
+		default:
+			return fmt.Errorf("%s: invalid media mode %q", source, overrides.MediaMode)
+		}
+		if _, found := config.HeaderProfiles[overrides.HeaderProfile]; overrides.HeaderProfile != "" && !found {
+			return fmt.Errorf("%s: unknown header profile %q", source, overrides.HeaderProfile)
+		}
+	}
+	for tenant, overrides := range config.TenantOverrides {
+		if overrides.Auth == AuthNone || overrides.Auth == AuthRegister { // 租户取自 From 域名，由发送方决定
+			return fmt.Errorf("tenant:%s: auth policy %q cannot be set per tenant, set it on a trunk with an ACL", tenant, overrides.Auth)
+		}
+	}
+	for _, trunk := range config.Trunks {
+		if trunk.Overrides.Auth != "" && len(trunk.ACL.Allow) == 0 && !trunkHasIdentity(config, trunk.Name) {
+			return fmt.Errorf("trunk:%s: auth policy requires an ACL allow list or a TLS client identity", trunk.Name)
+		}
+	}
+	for class, policy := range config.CallClasses {
+		switch class {
+		case CallInternal, CallInbound, CallOutbound, CallTransit:
+		default:
+			return fmt.Errorf("call_classes: unknown call class %q", class)
+		}
+		if _, found := config.HeaderProfiles[policy.HeaderProfile]; policy.HeaderProfile != "" && !found {
+			return fmt.Errorf("class:%s: unknown header profile %q", class, policy.HeaderProfile)
+		}
+		switch policy.MediaMode {
+		case "", MediaModeRelay, MediaModeRelease:
+		default:
+			return fmt.Errorf("class:%s: invalid media mode %q", class, policy.MediaMode)
+		}
+	}
+	return nil
+}
+
+// trunkHasIdentity 检查是否有双向 TLS 客户端身份映射到中继
+func trunkHasIdentity(config *B2BUAConfig, trunk string) bool {
+	for _, identity := range config.TLS.ClientIdentities {
+		if identity.Trunk == trunk {
+			return true
+		}
+	}
+	return false
+}
+
+// usesSetting 检查是否有任一层使用指定的取值，用于决定是否创建认证器和媒体中继
+func (c *B2BUAConfig) usesSetting(match func(ConfigOverrides) bool) bool {
+	if match(c.globalOverrides()) {
+		return true
+	}
+	for _, overrides := range c.layers() {
+		if match(overrides) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConfig 按 全局 -> 租户 -> 监听 -> profile -> 中继 的顺序合并配置，参数为空时跳过该层
+func (b *B2BUA) resolveConfig(tenant, listener string, profile *SIPProfileConfig, trunk *TrunkConfig) EffectiveConfig {
+	global := b.config.globalOverrides()
+	effective := EffectiveConfig{
+		Auth:          EffectiveSetting{Value: global.Auth, Source: "global"},
+		MediaMode:     EffectiveSetting{Value: global.MediaMode, Source: "global"},
+		HeaderProfile: EffectiveSetting{Value: global.HeaderProfile, Source: "global"},
+	}
+	for name, overrides := range b.config.TenantOverrides {
+		if tenant != "" && strings.EqualFold(name, tenant) {
+			effective.apply("tenant:"+name, overrides)
+		}
+	}
+	for name, overrides := range b.config.ListenerOverrides {
+		if listener != "" && strings.EqualFold(name, listener) {
+			effective.apply("listener:"+name, overrides)
+		}
+	}
+	if profile != nil {
+		effective.apply("profile:"+profile.Name, profile.Overrides)
+	}
+	if trunk != nil {
+		effective.apply("trunk:"+trunk.Name, trunk.Overrides)
+	}
+	return effective
+}
+
+// requestConfig 返回请求生效的配置：租户为 From 域名，监听为收到请求的传输协议，profile 为收到请求的监听所属的 profile，
+// 中继为按来源确认的中继（见 sourceTrunk），只有 From 域名匹配的中继不参与合并
+func (b *B2BUA) requestConfig(req sip.Request) EffectiveConfig {
+	tenant := ""
+	if from, ok := req.From(); ok && from.Address != nil {
+		tenant = from.Address.Host()
+	}
+	return b.resolveConfig(tenant, req.Transport(), b.requestProfile(req), b.sourceTrunk(req))
+}
+
+// EffectiveConfig 返回租户、监听、profile、中继组合下生效的配置及各项的来源，参数为空时跳过该层
+func (b *B2BUA) EffectiveConfig(tenant, listener, profile, trunk string) (EffectiveConfig, error) {
+	var profileConfig *SIPProfileConfig
+	if profile != "" {
+		if profileConfig = b.profileNamed(profile); profileConfig == nil {
+			return EffectiveConfig{}, fmt.Errorf("unknown profile %q", profile)
+		}
+	}
+	var trunkConfig *TrunkConfig
+	if trunk != "" {
+		if trunkConfig = b.trunkNamed(trunk); trunkConfig == nil {
+			return EffectiveConfig{}, fmt.Errorf("unknown trunk %q", trunk)
+		}
+	}
+	return b.resolveConfig(tenant, listener, profileConfig, trunkConfig), nil
+}
+
+// profileHeaders 返回 B 路 INVITE 按头域配置需要携带的头域。发往中继时中继层的设置优先，
+// 其次是呼叫分类的设置，否则按 A 路请求所属的层级
+func (b *B2BUA) profileHeaders(call *B2BCall, target routeTarget) []sip.Header {
+	request := call.src.Request()
+	effective := b.requestConfig(request)
+	if class := b.config.CallClasses[call.Class]; class.HeaderProfile != "" {
+		effective.HeaderProfile = EffectiveSetting{Value: class.HeaderProfile, Source: "class:" + call.Class}
+	}
+	if target.trunk != nil && target.trunk.Overrides.HeaderProfile != "" {
+		effective.HeaderProfile = EffectiveSetting{Value: target.trunk.Overrides.HeaderProfile, Source: "trunk:" + target.trunk.Name}
+	}
+	profile, found := b.config.HeaderProfiles[effective.HeaderProfile.Value]
+	if !found {
+		return nil
+	}
+	var headers []sip.Header
+	for _, name := range profile.Copy {
+		if b.topology != nil && b.topology.strips(name) {
+			continue
+		}
+		for _, header := range request.GetHeaders(name) {
+			headers = append(headers, header.Clone())
+		}
+	}
+	for name, value := range profile.Add {
+		headers = append(headers, &sip.GenericHeader{HeaderName: name, Contents: value})
+	}
+	return headers
+}
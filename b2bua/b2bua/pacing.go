@@ -0,0 +1,146 @@
+package b2bua
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	defaultPacingQueueTime     = 500  // 默认最长排队时间（毫秒）
+	defaultPacingMaxQueue      = 1000 // 默认排队请求数上限
+	defaultPacingMaxRetryAfter = 300  // 默认 Retry-After 上限（秒）
+)
+
+// RegisterPacingConfig 注册风暴（重启或切换后大量终端同时注册）时的准入控制
+type RegisterPacingConfig struct {
+	Rate          float64  `json:"rate"`            // 每秒接受的 REGISTER 数，0 表示不限制
+	Burst         int      `json:"burst"`           // 令牌桶容量，0 表示使用 2 倍速率
+	QueueTime     int      `json:"queue_time"`      // 超过速率时最多排队等待的时间（毫秒）
+	MaxQueue      int      `json:"max_queue"`       // 同时排队的请求数上限
+	MaxRetryAfter int      `json:"max_retry_after"` // 拒绝时 Retry-After 的上限（秒）
+	PriorityUsers []string `json:"priority_users"`  // 不受限制的账户（如支持紧急呼叫的话机），user 或 user@domain
+}
+
+// registerPacer 全局 REGISTER 令牌桶。令牌不足时请求预约后续令牌并排队等待，
+// 排队已满时返回 503，Retry-After 按预计空闲时间递增，使重试均匀分散
+type registerPacer struct {
+	mutex    sync.Mutex
+	config   RegisterPacingConfig
+	priority map[string]bool
+	tokens   float64
+	last     time.Time
+	queued   int
+	nextSlot time.Time // 已分配给被拒绝请求的最晚重试时间
+}
+
+func newRegisterPacer(config RegisterPacingConfig) *registerPacer {
+	if config.Rate <= 0 {
+		return nil
+	}
+	if config.Burst <= 0 {
+		config.Burst = int(config.Rate*2) + 1
+	}
+	if config.QueueTime <= 0 {
+		config.QueueTime = defaultPacingQueueTime
+	}
+	if config.MaxQueue <= 0 {
+		config.MaxQueue = defaultPacingMaxQueue
+	}
+	if config.MaxRetryAfter <= 0 {
+		config.MaxRetryAfter = defaultPacingMaxRetryAfter
+	}
+	p := &registerPacer{
+		config:   config,
+		priority: make(map[string]bool),
+		tokens:   float64(config.Burst),
+		last:     time.Now(),
+	}
+	for _, user := range config.PriorityUsers {
+		p.priority[strings.ToLower(user)] = true
+	}
+	return p
+}
+
+// IsPriority 检查 AOR 是否为优先账户
+func (p *registerPacer) IsPriority(aor sip.Uri) bool {
+	if aor.User() == nil {
+		return false
+	}
+	user := strings.ToLower(aor.User().String())
+	return p.priority[user] || p.priority[user+"@"+strings.ToLower(aor.Host())]
+}
+
+// Admit 申请一个令牌。返回需要排队等待的时间；无法排队时返回 false 和建议的 Retry-After（秒）
+func (p *registerPacer) Admit() (time.Duration, int, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.config.Rate
+	if p.tokens > float64(p.config.Burst) {
+		p.tokens = float64(p.config.Burst)
+	}
+	p.last = now
+	if p.tokens >= 1 {
+		p.tokens--
+		return 0, 0, true
+	}
+
+	wait := time.Duration((1 - p.tokens) / p.config.Rate * float64(time.Second))
+	if wait <= time.Duration(p.config.QueueTime)*time.Millisecond && p.queued < p.config.MaxQueue {
+		p.tokens-- // 预约令牌
+		p.queued++
+		return wait, 0, true
+	}
+
+	// 为被拒绝的请求分配递增的重试时间
+	if p.nextSlot.Before(now.Add(wait)) {
+		p.nextSlot = now.Add(wait)
+	}
+	retryAfter := int(math.Ceil(p.nextSlot.Sub(now).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	if retryAfter < p.config.MaxRetryAfter {
+		p.nextSlot = p.nextSlot.Add(time.Duration(float64(time.Second) / p.config.Rate))
+	} else {
+		retryAfter = p.config.MaxRetryAfter
+	}
+	return 0, retryAfter, false
+}
+
+// Done 排队的请求等待结束
+func (p *registerPacer) Done() {
+	p.mutex.Lock()
+	p.queued--
+	p.mutex.Unlock()
+}
+
+// paceRegister 在认证之前对 REGISTER 进行准入控制，返回 false 表示已拒绝。
+// 携带认证信息的请求是已接受请求的后续，优先账户不受限制
+func (b *B2BUA) paceRegister(req sip.Request, tx sip.ServerTransaction) bool {
+	if b.registerPacer == nil || req.Method() != sip.REGISTER || len(req.GetHeaders("Authorization")) > 0 {
+		return true
+	}
+	if to, ok := req.To(); ok && b.registerPacer.IsPriority(to.Address) {
+		return true
+	}
+
+	wait, retryAfter, admitted := b.registerPacer.Admit()
+	if admitted {
+		if wait > 0 {
+			b.metrics.Inc(MetricRegisterQueued)
+			time.Sleep(wait)
+			b.registerPacer.Done()
+		}
+		return true
+	}
+
+	b.metrics.Inc(MetricRegisterPaced)
+	b.rejectOverloadRequest(req, tx, b.capacity.Paced(retryAfter))
+	return false
+}
@@ -0,0 +1,307 @@
+package b2bua
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+const (
+	defaultIntercom          = "*80"                                              // 对讲功能码，后接分机号
+	defaultAutoAnswerInfo    = "<http://127.0.0.1>;info=alert-autoanswer;delay=0" // 请求自动应答的 Alert-Info
+	defaultPagingRingTimeout = 10                                                 // 寻呼组成员未自动应答时的默认振铃时间（秒）
+)
+
+// IntercomConfig 对讲与寻呼：B 路 INVITE 携带 Alert-Info 和 Call-Info（answer-after）头域，请求被叫话机免提自动应答
+type IntercomConfig struct {
+	AlertInfo   string `json:"alert_info"`   // Alert-Info 头域的值，默认 <http://127.0.0.1>;info=alert-autoanswer;delay=0
+	AnswerAfter int    `json:"answer_after"` // Call-Info 头域 answer-after 参数：自动应答前的振铃时间（秒）
+}
+
+// PagingGroupConfig 寻呼组：呼叫组号码时在本地应答主叫，同时以自动应答呼叫所有成员，主叫的声音经媒体中继
+// 单向发往所有应答的成员。需要启用媒体中继
+type PagingGroupConfig struct {
+	Name        string   `json:"name"`         // 名称
+	Number      string   `json:"number"`       // 组号码（被叫用户部分）
+	Members     []string `json:"members"`      // 成员账户（用户名）
+	RingTimeout int      `json:"ring_timeout"` // 成员未自动应答时的振铃时间（秒），超时取消；0 为 10 秒
+}
+
+// pages 进行中的寻呼
+type pages struct {
+	mutex sync.Mutex
+	pages map[*session.Session]*page // 主叫的会话 -> 寻呼
+}
+
+// page 一次寻呼：主叫和应答的成员在混音器中，成员静音
+type page struct {
+	group PagingGroupConfig
+	call  *B2BCall
+	mixer *media.Mixer
+}
+
+// autoAnswerHeaders 分支请求自动应答时添加 Alert-Info 和 Call-Info 头域
+func (b *B2BUA) autoAnswerHeaders(call *B2BCall, headers []sip.Header) []sip.Header {
+	if !call.autoAnswer {
+		return headers
+	}
+	config := b.config.Intercom
+	alertInfo := config.AlertInfo
+	if alertInfo == "" {
+		alertInfo = defaultAutoAnswerInfo
+	}
+	callInfo := fmt.Sprintf("<sip:%s>;answer-after=%d", b.stack.GetNetworkInfo("udp").Host, config.AnswerAfter)
+	return append(headers,
+		&sip.GenericHeader{HeaderName: "Alert-Info", Contents: alertInfo},
+		&sip.GenericHeader{HeaderName: "Call-Info", Contents: callInfo},
+	)
+}
+
+// intercom 对讲功能码：将被叫改为本地分机 extension 并请求自动应答，返回 false 继续路由。分机不存在时以 404
+// 拒绝 A 路并返回 true
+func (b *B2BUA) intercom(call *B2BCall, sess *session.Session, user, extension string) bool {
+	if !b.hasAccount(extension) {
+		call.Log().Infof("Intercom: %s is not a local account", extension)
+		sess.Reject(404, "Not Found", b.warning(399, "intercom extension not found"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	called, err := forwardURI(extension, calledURI(call))
+	if err != nil {
+		sess.Reject(484, "Address Incomplete")
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	call.Log().Infof("Intercom: %s calls %s", user, extension)
+	b.metrics.Inc(MetricFeatureCode + "intercom")
+	call.called = called
+	call.Callee = called.String()
+	call.autoAnswer = true
+	call.Context.Set("feature_code", "intercom")
+	return false
+}
+
+// pagingGroupFor 返回被叫号码对应的寻呼组
+func (b *B2BUA) pagingGroupFor(called sip.Uri) *PagingGroupConfig {
+	if called == nil || called.User() == nil {
+		return nil
+	}
+	for i := range b.config.PagingGroups {
+		if b.config.PagingGroups[i].Number == called.User().String() {
+			return &b.config.PagingGroups[i]
+		}
+	}
+	return nil
+}
+
+// startPage 被叫为寻呼组号码时在本地应答主叫并以自动应答呼叫所有成员，返回 true 表示呼叫已处理
+func (b *B2BUA) startPage(call *B2BCall, sess *session.Session, called sip.Uri) bool {
+	group := b.pagingGroupFor(called)
+	if group == nil {
+		return false
+	}
+	call.Context.Set("paging_group", group.Name)
+	if call.media == nil {
+		sess.Reject(488, "Not Acceptable Here", b.warning(399, "paging requires media relay"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	answer, err := call.media.relay.Answer(media.LegA, sess.RemoteSdp())
+	if err != nil {
+		call.Log().Warnf("Paging %s: answer failed: %v", group.Name, err)
+		sess.Reject(488, "Not Acceptable Here", b.warning(305, "incompatible media format"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	p := &page{group: *group, call: call, mixer: media.NewMixer()}
+	if err := p.mixer.Add(call.ID, call.media.relay, media.LegA); err != nil {
+		p.mixer.Close()
+		call.Log().Errorf("Paging %s: %v", group.Name, err)
+		sess.Reject(500, "Server Internal Error")
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	b.classifyCall(call, sess.Request(), true)
+	call.answer = answer
+	b.pages.mutex.Lock()
+	b.pages.pages[sess] = p
+	b.pages.mutex.Unlock()
+
+	pager := b.localCaller(sess.Request())
+	paged := 0
+	for _, member := range group.Members {
+		if member != pager && b.pageMember(p, member) {
+			paged++
+		}
+	}
+	if paged == 0 {
+		call.Log().Infof("Paging %s: no member reachable", group.Name)
+		b.stopPage(p)
+		sess.Reject(480, "Temporarily Unavailable", b.warning(399, "no paging group member reachable"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+
+	sess.ProvideAnswer(answer)
+	sess.Accept(200)
+	b.callAnswered(call)
+	call.Log().Infof("Paging %s: %d members", group.Name, paged)
+	b.metrics.Inc(MetricPaging + "started")
+
+	timeout := group.RingTimeout
+	if timeout <= 0 {
+		timeout = defaultPagingRingTimeout
+	}
+	time.AfterFunc(time.Duration(timeout)*time.Second, func() { // 取消未自动应答的成员
+		for _, leg := range b.Calls() {
+			if leg.src == sess && leg.dest.IsInProgress() {
+				leg.dest.End()
+			}
+		}
+	})
+	return true
+}
+
+// pageMember 以自动应答呼叫成员的所有联系地址。每个分支使用单独的媒体中继会话，在本地以只发送的 offer 呼叫，
+// 应答后加入寻呼的混音器。至少发起了一个分支时返回 true
+func (b *B2BUA) pageMember(p *page, member string) bool {
+	call := p.call
+	aor := calledURI(call).Clone()
+	aor.SetUser(sip.String{Str: member})
+	contacts, found := b.registry.GetContacts(b.registryAOR(routingURI(aor)))
+	if !found {
+		return false
+	}
+	paged := false
+	nodes := make(map[string]bool)
+	for _, instance := range *contacts {
+		recipient, ok := b.contactRecipient(call, member, instance, nodes)
+		if !ok {
+			continue
+		}
+		relay := b.mediaRelay.NewSession()
+		offer, err := relay.Answer(media.LegB, call.src.RemoteSdp()) // 媒体终结在中继的 B 路一侧
+		if err != nil {
+			relay.Close()
+			call.Log().Warnf("Paging %s: offer to %s failed: %v", p.group.Name, member, err)
+			continue
+		}
+		leg := *call
+		leg.called = aor
+		leg.dialed = member
+		leg.media = &callMedia{relay: relay, mode: MediaModeRelay}
+		leg.offer = sendOnly(offer)
+		leg.autoAnswer = true
+		if b.inviteLeg(&leg, routeTarget{recipient: recipient, local: true, profile: b.contactProfile(instance)}, nil) {
+			paged = true
+		} else {
+			relay.Close()
+		}
+	}
+	return paged
+}
+
+// sendOnly 将 SDP 中的音频流设为只发送：寻呼成员只接收主叫的声音
+func sendOnly(sdp string) string {
+	parsed, err := media.ParseSDP(sdp)
+	if err != nil {
+		return sdp
+	}
+	for _, section := range parsed.Media {
+		if section.Type() == "audio" && section.Port() != 0 {
+			section.SetDirection("sendonly")
+		}
+	}
+	return parsed.String()
+}
+
+// pageOf 返回分支所在的寻呼
+func (b *B2BUA) pageOf(src *session.Session) *page {
+	b.pages.mutex.Lock()
+	defer b.pages.mutex.Unlock()
+	return b.pages.pages[src]
+}
+
+// memberID 返回寻呼成员分支在混音器中的标识
+func memberID(leg *B2BCall) string {
+	return leg.dest.CallID().Value()
+}
+
+// pageAnswered 寻呼成员自动应答时将其加入混音器（静音），不是寻呼成员的分支时返回 false
+func (b *B2BUA) pageAnswered(leg *B2BCall) bool {
+	p := b.pageOf(leg.src)
+	if p == nil {
+		return false
+	}
+	id := memberID(leg)
+	if _, err := leg.media.relay.Rewrite(media.LegB, leg.dest.RemoteSdp()); err != nil {
+		leg.Log().Warnf("Paging %s: %v", p.group.Name, err)
+		leg.dest.End()
+		return true
+	}
+	if err := p.mixer.Add(id, leg.media.relay, media.LegB); err != nil {
+		leg.Log().Warnf("Paging %s: %v", p.group.Name, err)
+		leg.dest.End()
+		return true
+	}
+	p.mixer.SetMuted(id, true)
+	leg.Log().Infof("Paging %s: %s answered", p.group.Name, leg.dialed)
+	b.metrics.Inc(MetricPaging + "answered")
+	return true
+}
+
+// stopPage 结束寻呼：关闭混音器，挂断所有成员的分支并关闭它们的媒体中继会话
+func (b *B2BUA) stopPage(p *page) {
+	b.pages.mutex.Lock()
+	delete(b.pages.pages, p.call.src)
+	b.pages.mutex.Unlock()
+	p.mixer.Close()
+	for _, leg := range b.Calls() {
+		if leg.src != p.call.src {
+			continue
+		}
+		if !leg.dest.IsEnded() {
+			leg.dest.End()
+		}
+		if leg.media != p.call.media {
+			leg.media.relay.Close()
+		}
+	}
+}
+
+// pageLegEnded 处理寻呼的会话结束：主叫挂机时结束寻呼，成员挂机时将其移出混音器，所有成员都挂机后挂断主叫。
+// 返回 true 表示已处理，不再按普通呼叫处理
+func (b *B2BUA) pageLegEnded(sess *session.Session, state session.Status) bool {
+	src := sess
+	leg := b.findCall(sess)
+	if leg != nil {
+		src = leg.src
+	}
+	p := b.pageOf(src)
+	if p == nil {
+		return false
+	}
+	if sess == src { // 主叫挂机
+		b.stopPage(p)
+		b.finishCall(p.call, state)
+		return true
+	}
+
+	p.mixer.Remove(memberID(leg))
+	leg.media.relay.Close()
+	b.dropLeg(sess)
+	for _, other := range b.Calls() {
+		if other.src == src && !other.dest.IsEnded() {
+			return true
+		}
+	}
+	p.call.Log().Infof("Paging %s: all members left", p.group.Name)
+	if !src.IsEnded() {
+		src.End()
+	}
+	return true
+}
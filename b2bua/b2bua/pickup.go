@@ -0,0 +1,144 @@
+package b2bua
+
+import (
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// 默认的代答功能码
+const (
+	defaultGroupPickup    = "*8" // 代答所在代答组中正在振铃的呼叫
+	defaultDirectedPickup = "**" // 代答指定分机正在振铃的呼叫，后接分机号（如 **101）
+)
+
+// pickupGroupMembers 返回与 user 同在某个代答组中的账户（不含 user 自己）
+func (b *B2BUA) pickupGroupMembers(user string) map[string]bool {
+	members := make(map[string]bool)
+	for _, group := range b.config.PickupGroups {
+		in := false
+		for _, member := range group {
+			if member == user {
+				in = true
+				break
+			}
+		}
+		if !in {
+			continue
+		}
+		for _, member := range group {
+			if member != user {
+				members[member] = true
+			}
+		}
+	}
+	return members
+}
+
+// ringingCall 返回 users 中某个账户正在振铃、主叫尚未被应答的呼叫，有多个时返回最早的呼叫
+func (b *B2BUA) ringingCall(users map[string]bool) *B2BCall {
+	var found *B2BCall
+	for _, leg := range b.Calls() {
+		if leg.dest == nil || leg.dest.Direction() != session.Outgoing || !leg.dest.IsInProgress() || !users[leg.dialed] {
+			continue
+		}
+		if leg.answer != "" || !leg.src.IsInProgress() || leg.Context.isPickedUp() { // 排队的呼叫已在本地应答
+			continue
+		}
+		if found == nil || leg.Start.Before(found.Start) {
+			found = leg
+		}
+	}
+	return found
+}
+
+// groupPickup 代答所在代答组中正在振铃的呼叫
+func (b *B2BUA) groupPickup(call *B2BCall, sess *session.Session, user string) bool {
+	members := b.pickupGroupMembers(user)
+	if len(members) == 0 {
+		call.Log().Infof("Pickup: %s is not in a pickup group", user)
+		sess.Reject(403, "Forbidden", b.warning(399, "not in a pickup group"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	return b.pickup(call, sess, user, "group", members)
+}
+
+// pickup 本地账户 user 代答 users 中某个账户正在振铃的呼叫：在媒体中继中分别应答主叫和代答者，
+// 代答者的会话作为呼叫的一个分支，取消其它振铃的分支。始终返回 true
+func (b *B2BUA) pickup(call *B2BCall, sess *session.Session, user, kind string, users map[string]bool) bool {
+	call.Context.Set("feature_code", "pickup_"+kind)
+	target := b.ringingCall(users)
+	if target == nil {
+		call.Log().Infof("Pickup: no ringing call for %s", user)
+		b.metrics.Inc(MetricPickup + "not_found")
+		sess.Reject(404, "Not Found", b.warning(399, "no call to pick up"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	if !b.anchored(target) {
+		call.Log().Warnf("Pickup: call %s is not anchored in the media relay", target.ID)
+		sess.Reject(488, "Not Acceptable Here", b.warning(399, "pickup requires media relay"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	callerAnswer, err := target.media.relay.Answer(media.LegA, target.src.RemoteSdp())
+	if err == nil && target.Context.markPickedUp() {
+		offer := sess.RemoteSdp()
+		if restricted, err := media.RestrictOffer(offer, callerAnswer); err == nil { // 使用主叫已协商的编解码
+			offer = restricted
+		}
+		var pickerAnswer string
+		if pickerAnswer, err = target.media.relay.Answer(media.LegB, offer); err != nil {
+			target.Context.unmarkPickedUp()
+		} else {
+			b.answerPickup(target, sess, user, callerAnswer, pickerAnswer)
+			call.Context.Set("picked_up_call", target.ID)
+			call.Log().Infof("Pickup: %s picked up call %s (%s)", user, target.ID, kind)
+			b.metrics.Inc(MetricPickup + kind)
+			b.finishCall(call, session.Terminated)
+			return true
+		}
+	}
+	if err != nil {
+		call.Log().Warnf("Pickup: answer failed: %v", err)
+		sess.Reject(488, "Not Acceptable Here", b.warning(305, "incompatible media format"))
+	} else { // 其它分支已应答或已被代答
+		sess.Reject(404, "Not Found", b.warning(399, "no call to pick up"))
+	}
+	b.metrics.Inc(MetricPickup + "failed")
+	b.finishCall(call, session.Failure)
+	return true
+}
+
+// answerPickup 应答主叫和代答者，将代答者的会话加入呼叫并取消其它振铃的分支
+func (b *B2BUA) answerPickup(target *B2BCall, sess *session.Session, user, callerAnswer, pickerAnswer string) {
+	leg := *target
+	leg.dest = sess
+	leg.dialed = user
+	leg.answer = callerAnswer
+	leg.failover = nil
+	leg.forks = nil
+	leg.trunk = nil
+	b.addCall(&leg) // 先加入代答者的分支，其它分支结束时不挂断主叫
+
+	sess.ProvideAnswer(pickerAnswer)
+	sess.Accept(200)
+	target.src.ProvideAnswer(callerAnswer)
+	target.src.Accept(200)
+	b.callAnswered(target)
+	target.Context.Set("picked_up_by", user)
+	for _, other := range b.Calls() {
+		if other.src == target.src && other.dest != sess && !other.dest.IsEnded() {
+			other.dest.End()
+		}
+	}
+	leg.Log().Infof("Picked up by %s", user)
+	b.startRecording(&leg)
+	b.watchMediaTimeout(&leg)
+	b.emitFor(append(leg.users, user), EventCallPickedUp, map[string]interface{}{
+		"call_id":      leg.ID,
+		"caller":       leg.Caller,
+		"callee":       leg.Callee,
+		"picked_up_by": user,
+	})
+}
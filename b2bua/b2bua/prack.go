@@ -0,0 +1,61 @@
+package b2bua
+
+import (
+	"fmt"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// 可靠临时响应（RFC 3262 100rel）的使用方式
+const (
+	Rel100Supported = "supported" // 支持 100rel：B 路 INVITE 携带 Supported: 100rel，主叫支持时可靠地转发临时响应（默认）
+	Rel100Required  = "required"  // B 路 INVITE 携带 Require: 100rel，用于要求可靠临时响应的运营商
+	Rel100Disabled  = "disabled"  // 不使用 100rel，要求 100rel 的 INVITE 返回 420
+)
+
+// validateRel100 检查 100rel 的使用方式
+func validateRel100(mode string) error {
+	switch mode {
+	case "", Rel100Supported, Rel100Required, Rel100Disabled:
+		return nil
+	}
+	return fmt.Errorf("invalid 100rel mode %q", mode)
+}
+
+// extensions 返回协议栈在 Supported 头域中声明的扩展
+func extensions(config *B2BUAConfig) []string {
+	options := []string{"replaces", "outbound"}
+	if config.Rel100 != Rel100Disabled {
+		options = append(options, session.Extension100rel)
+	}
+	return options
+}
+
+// rejectsRel100 未启用 100rel 时以 420 拒绝要求 100rel 的 INVITE
+func (b *B2BUA) rejectsRel100(sess *session.Session, req sip.Request) bool {
+	if b.config.Rel100 != Rel100Disabled || !session.HasOption(req, "Require", session.Extension100rel) {
+		return false
+	}
+	unsupported := &sip.GenericHeader{HeaderName: "Unsupported", Contents: session.Extension100rel}
+	sess.Reject(420, "Bad Extension", unsupported)
+	return true
+}
+
+// rel100Headers 按 100rel 的使用方式为 B 路 INVITE 添加 Require 头域，Supported 由协议栈添加
+func (b *B2BUA) rel100Headers(headers []sip.Header) []sip.Header {
+	if b.config.Rel100 != Rel100Required {
+		return headers
+	}
+	return append(headers, &sip.RequireHeader{Options: []string{session.Extension100rel}})
+}
+
+// sendProvisional 向 A 路发送临时响应：主叫支持 100rel 时可靠地发送，等待主叫的 PRACK。
+// B 路的可靠临时响应由用户代理自动发送 PRACK，两路的 RSeq 各自独立
+func (b *B2BUA) sendProvisional(call *B2BCall, code sip.StatusCode, reason string) {
+	if code > 100 && b.config.Rel100 != Rel100Disabled && call.src.SupportsReliable() {
+		call.src.ProvisionalReliable(code, reason)
+		return
+	}
+	call.src.Provisional(code, reason)
+}
@@ -0,0 +1,153 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// 匿名的主叫（RFC 3323）
+const (
+	anonymousDisplayName = "Anonymous"
+	anonymousURI         = "sip:anonymous@anonymous.invalid"
+)
+
+// AssertedIdentityConfig 网络断言身份（RFC 3325）配置。可信域由标记为 trusted 的中继组成：
+// 来自可信中继的 P-Asserted-Identity 原样接受并继续传给可信中继；本地账户的呼叫按认证的身份生成；
+// 其它来源的 P-Asserted-Identity 被去掉。发往不可信的中继时不携带 P-Asserted-Identity，
+// 主叫要求 Privacy: id 时 From 改为匿名
+type AssertedIdentityConfig struct {
+	Enabled      bool `json:"enabled"`       // 启用 P-Asserted-Identity 与 Privacy 处理
+	TrustedLocal bool `json:"trusted_local"` // 本地注册的终端视为可信，接收 P-Asserted-Identity
+}
+
+// assertIdentity 确定 A 路的断言身份：可信中继的 P-Asserted-Identity，或认证的本地账户（摘要认证或双向 TLS）。
+// 在路由之前调用，记录在呼叫中并去掉请求中不可信的 P-Asserted-Identity 和 P-Preferred-Identity
+func (b *B2BUA) assertIdentity(call *B2BCall, req sip.Request) {
+	if !b.config.AssertedIdentity.Enabled {
+		return
+	}
+	call.privacy = privacyValues(req)
+	if b.trustedSource(req) {
+		if hdrs := req.GetHeaders("P-Asserted-Identity"); len(hdrs) > 0 {
+			call.identity = hdrs[0].Value()
+		}
+		return
+	}
+	req.RemoveHeader("P-Asserted-Identity")
+	req.RemoveHeader("P-Preferred-Identity")
+
+	user := b.authenticatedUser(req)
+	from, _ := req.From()
+	if user == "" || from == nil || from.Address == nil {
+		return
+	}
+	identity := &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: user}, FHost: from.Address.Host()}}
+	if name := b.DisplayName(user); name != "" {
+		identity.DisplayName = sip.String{Str: name}
+	} else if from.DisplayName != nil {
+		identity.DisplayName = from.DisplayName
+	}
+	call.identity = identity.String()
+	call.Log().Infof("Asserted identity: %s", call.identity)
+}
+
+// trustedSource 检查请求是否来自可信中继：来源 IP 命中中继 ACL 或双向 TLS 映射的中继，只有 From 域名匹配不算可信
+func (b *B2BUA) trustedSource(req sip.Request) bool {
+	trunk := b.sourceTrunk(req)
+	return trunk != nil && trunk.Trusted
+}
+
+// validateTrustedTrunks 检查可信中继能按来源确认：配置了 ACL allow 或映射了双向 TLS 身份
+func validateTrustedTrunks(config *B2BUAConfig) error {
+	for _, trunk := range config.Trunks {
+		if trunk.Trusted && len(trunk.ACL.Allow) == 0 && !trunkHasIdentity(config, trunk.Name) {
+			return fmt.Errorf("trunk %s: trusted trunk requires an ACL allow list or a TLS client identity", trunk.Name)
+		}
+	}
+	return nil
+}
+
+// authenticatedUser 返回请求经认证的账户：双向 TLS 映射的账户，或通过摘要认证的 Authorization 用户名。
+// 未认证时返回空字符串
+func (b *B2BUA) authenticatedUser(req sip.Request) string {
+	if b.mutuallyAuthenticated(req) {
+		if identity := b.clientIdentity(req); identity != nil && identity.Account != "" {
+			return identity.Account
+		}
+	}
+	if !b.requiresChallenge(req) { // 未经摘要认证
+		return ""
+	}
+	for _, header := range req.GetHeaders("Authorization") {
+		if user := sip.AuthFromValue(header.Value()).Username(); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// privacyValues 返回 Privacy 头域的取值（小写）
+func privacyValues(req sip.Request) []string {
+	var values []string
+	for _, header := range req.GetHeaders("Privacy") {
+		for _, value := range strings.Split(header.Value(), ";") {
+			if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// trustedTarget 检查 B 路目的地是否可信
+func (b *B2BUA) trustedTarget(target routeTarget) bool {
+	if target.trunk != nil {
+		return target.trunk.Trusted
+	}
+	return target.local && b.config.AssertedIdentity.TrustedLocal
+}
+
+// identityHeaders 返回发往 target 的头域：去掉头域配置复制的 P-Asserted-Identity，
+// 目的地可信时携带断言身份和 Privacy
+func (b *B2BUA) identityHeaders(call *B2BCall, target routeTarget, headers []sip.Header) []sip.Header {
+	if !b.config.AssertedIdentity.Enabled {
+		return headers
+	}
+	kept := headers[:0]
+	for _, header := range headers {
+		switch strings.ToLower(header.Name()) {
+		case "p-asserted-identity", "p-preferred-identity", "privacy":
+		default:
+			kept = append(kept, header)
+		}
+	}
+	if call.identity == "" || !b.trustedTarget(target) {
+		return kept
+	}
+	kept = append(kept, &sip.GenericHeader{HeaderName: "P-Asserted-Identity", Contents: call.identity})
+	if len(call.privacy) > 0 {
+		kept = append(kept, &sip.GenericHeader{HeaderName: "Privacy", Contents: strings.Join(call.privacy, ";")})
+	}
+	return kept
+}
+
+// privateCaller 主叫要求 Privacy: id（或 user、header）且目的地不可信时返回匿名的主叫 URI 和显示名称
+func (b *B2BUA) privateCaller(call *B2BCall, target routeTarget, uri sip.Uri, name string) (sip.Uri, string) {
+	if !b.config.AssertedIdentity.Enabled || b.trustedTarget(target) {
+		return uri, name
+	}
+	for _, value := range call.privacy {
+		if value == "id" || value == "user" || value == "header" {
+			anonymous, err := parser.ParseSipUri(anonymousURI)
+			if err != nil {
+				return uri, name
+			}
+			call.Log().Infof("Privacy: %s, anonymizing From toward untrusted target", value)
+			return &anonymous, anonymousDisplayName
+		}
+	}
+	return uri, name
+}
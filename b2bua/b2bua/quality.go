@@ -0,0 +1,82 @@
+package b2bua
+
+import (
+	"sort"
+
+	"go-sip-ua/pkg/media"
+)
+
+// MOS 分级阈值
+const (
+	goodMOS = 4.0 // 不低于该值为 good
+	poorMOS = 3.1 // 低于该值为 poor，之间为 fair
+)
+
+// CallQuality 通话两路的媒体质量，由媒体中继根据转发的 RTP 和两端的 RTCP 报告统计
+type CallQuality struct {
+	A   media.Quality `json:"a"`   // A 路（主叫）
+	B   media.Quality `json:"b"`   // B 路（被叫）
+	MOS float64       `json:"mos"` // 两路中较低的 MOS
+}
+
+// QualityReport 活跃通话的媒体质量
+type QualityReport struct {
+	Call    *B2BCall
+	Quality CallQuality
+}
+
+// callQuality 返回呼叫的媒体质量，未启用媒体中继或还没有 RTP 时返回 false
+func callQuality(call *B2BCall) (*CallQuality, bool) {
+	if call.media == nil {
+		return nil, false
+	}
+	legs, ok := call.media.relay.Quality()
+	if !ok {
+		return nil, false
+	}
+	quality := &CallQuality{A: legs[media.LegA], B: legs[media.LegB], MOS: legs[media.LegA].MOS}
+	if quality.B.Packets > 0 && (quality.A.Packets == 0 || quality.B.MOS < quality.MOS) {
+		quality.MOS = quality.B.MOS
+	}
+	return quality, true
+}
+
+// qualityGrade 返回 MOS 的分级：good、fair 或 poor
+func qualityGrade(mos float64) string {
+	switch {
+	case mos >= goodMOS:
+		return "good"
+	case mos >= poorMOS:
+		return "fair"
+	}
+	return "poor"
+}
+
+// WorstQuality 返回媒体质量最差的 limit 个活跃通话，按 MOS 升序，limit 不大于 0 时返回全部
+func (b *B2BUA) WorstQuality(limit int) []QualityReport {
+	reports := make([]QualityReport, 0)
+	seen := make(map[string]bool)
+	for _, call := range b.Calls() {
+		if seen[call.ID] {
+			continue
+		}
+		if quality, ok := callQuality(call); ok {
+			seen[call.ID] = true
+			reports = append(reports, QualityReport{Call: call, Quality: *quality})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Quality.MOS < reports[j].Quality.MOS
+	})
+	if limit > 0 && len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports
+}
+
+// recordQuality 通话结束时按 MOS 分级计数
+func (b *B2BUA) recordQuality(quality *CallQuality) {
+	if quality != nil {
+		b.metrics.Inc(MetricQuality + qualityGrade(quality.MOS))
+	}
+}
@@ -0,0 +1,604 @@
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// 排队呼叫的分配策略
+const (
+	QueueRoundRobin  = "round_robin"  // 按坐席顺序轮流分配
+	QueueLongestIdle = "longest_idle" // 分配给空闲时间最长的坐席
+)
+
+// 坐席状态
+const (
+	AgentAvailable = "available" // 空闲，可以分配呼叫
+	AgentBusy      = "busy"      // 示忙（由坐席或管理员设置），不分配呼叫
+	AgentRinging   = "ringing"   // 正在振铃
+	AgentTalking   = "talking"   // 正在通话（队列分配的或其它呼叫）
+	AgentWrapUp    = "wrap_up"   // 通话结束后的整理时间
+	AgentOffline   = "offline"   // 未注册
+)
+
+const defaultAgentRingTimeout = 15 // 振铃坐席的默认超时（秒）
+
+// QueueConfig 呼叫队列：呼叫队列号码的 INVITE 在本地应答并播放等待音乐，按策略分配给空闲的坐席（本地注册的账户），
+// 坐席应答后两路接通。需要启用媒体中继
+type QueueConfig struct {
+	Name        string   `json:"name"`         // 队列名称
+	Number      string   `json:"number"`       // 队列号码（被叫用户部分）
+	Agents      []string `json:"agents"`       // 坐席：本地账户的用户名或 AOR
+	Strategy    string   `json:"strategy"`     // 分配策略：round_robin 或 longest_idle（默认）
+	Music       string   `json:"music"`        // 等待音乐（单声道 16 位 WAV 文件），为空时使用 music_on_hold.file
+	RingTimeout int      `json:"ring_timeout"` // 振铃坐席的超时（秒），超时未应答时分配给下一个坐席；0 为 15 秒
+	WrapUp      int      `json:"wrap_up"`      // 坐席通话结束后的整理时间（秒），期间不分配呼叫
+	MaxWait     int      `json:"max_wait"`     // 最长等待时间（秒），超时后挂断；0 不限制
+	MaxLength   int      `json:"max_length"`   // 最多等待的呼叫数，达到时返回 486；0 不限制
+}
+
+// ErrQueueNotFound 队列或坐席不存在
+var ErrQueueNotFound = errors.New("queue or agent not found")
+
+// callQueues 所有呼叫队列
+type callQueues struct {
+	mutex  sync.Mutex
+	queues []*callQueue
+}
+
+// callQueue 一个呼叫队列及其统计
+type callQueue struct {
+	config    QueueConfig
+	music     *media.Audio  // 等待音乐，为 nil 时使用全局保持音乐
+	agents    []*queueAgent // 按配置顺序
+	next      int           // 轮流分配的下一个坐席
+	calls     []*queuedCall // 等待中和已接通的呼叫，按进入队列的顺序
+	entered   int           // 进入队列的呼叫数
+	answered  int           // 坐席应答的呼叫数
+	abandoned int           // 等待中挂机的呼叫数
+	timedOut  int           // 等待超时的呼叫数
+	waited    time.Duration // 已应答呼叫的总等待时间
+}
+
+// queueAgent 队列的一个坐席
+type queueAgent struct {
+	user      string
+	aor       sip.Uri
+	paused    bool      // 示忙
+	onCall    bool      // 正在振铃或通话
+	ringing   bool      // 正在振铃
+	idleSince time.Time // 上次通话结束或振铃未应答的时间
+	wrapUntil time.Time // 整理时间结束的时间
+	answered  int       // 应答的呼叫数
+}
+
+// queuedCall 进入队列的呼叫
+type queuedCall struct {
+	call    *B2BCall
+	entered time.Time
+	agent   *queueAgent      // 正在振铃或通话的坐席，等待分配时为 nil
+	dest    *session.Session // 应答的坐席分支，未接通时为 nil
+}
+
+// QueueAgentStatus 坐席的状态
+type QueueAgentStatus struct {
+	User      string    `json:"user"`
+	State     string    `json:"state"`
+	Answered  int       `json:"answered"`
+	IdleSince time.Time `json:"idle_since"`
+}
+
+// QueueStatus 队列的状态和统计
+type QueueStatus struct {
+	Name        string             `json:"name"`
+	Number      string             `json:"number"`
+	Strategy    string             `json:"strategy"`
+	Waiting     int                `json:"waiting"`      // 等待中的呼叫数
+	LongestWait float64            `json:"longest_wait"` // 等待最久的呼叫已等待的时间（秒）
+	Entered     int                `json:"entered"`
+	Answered    int                `json:"answered"`
+	Abandoned   int                `json:"abandoned"`
+	TimedOut    int                `json:"timed_out"`
+	AverageWait float64            `json:"average_wait"` // 已应答呼叫的平均等待时间（秒）
+	Agents      []QueueAgentStatus `json:"agents"`
+}
+
+// newCallQueues 按配置创建呼叫队列，host 为坐席 AOR 的默认域名
+func newCallQueues(configs []QueueConfig, host string) (*callQueues, error) {
+	queues := &callQueues{}
+	numbers := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" || config.Number == "" || numbers[config.Number] {
+			return nil, fmt.Errorf("queue %q: missing name or number, or duplicate number %q", config.Name, config.Number)
+		}
+		numbers[config.Number] = true
+		switch config.Strategy {
+		case "":
+			config.Strategy = QueueLongestIdle
+		case QueueRoundRobin, QueueLongestIdle:
+		default:
+			return nil, fmt.Errorf("queue %s: invalid strategy %q", config.Name, config.Strategy)
+		}
+		q := &callQueue{config: config}
+		if config.Music != "" {
+			music, err := media.LoadWAV(config.Music)
+			if err != nil {
+				return nil, fmt.Errorf("queue %s: %w", config.Name, err)
+			}
+			q.music = music
+		}
+		for _, agent := range config.Agents {
+			address := agent
+			if !strings.Contains(agent, ":") {
+				address = "sip:" + agent + "@" + host
+			}
+			aor, err := parser.ParseUri(address)
+			if err != nil || aor.User() == nil {
+				return nil, fmt.Errorf("queue %s: invalid agent %q", config.Name, agent)
+			}
+			q.agents = append(q.agents, &queueAgent{user: aor.User().String(), aor: aor, idleSince: time.Now()})
+		}
+		queues.queues = append(queues.queues, q)
+	}
+	return queues, nil
+}
+
+// queueFor 返回被叫号码对应的队列
+func (b *B2BUA) queueFor(called sip.Uri) *callQueue {
+	if called == nil || called.User() == nil {
+		return nil
+	}
+	for _, q := range b.queues.queues {
+		if q.config.Number == called.User().String() {
+			return q
+		}
+	}
+	return nil
+}
+
+// enterQueue 被叫为队列号码时在本地应答 A 路、播放等待音乐并分配坐席，返回 true 表示呼叫已处理
+func (b *B2BUA) enterQueue(call *B2BCall, sess *session.Session, called sip.Uri) bool {
+	q := b.queueFor(called)
+	if q == nil {
+		return false
+	}
+	name := q.config.Name
+	call.Context.Set("queue", name)
+	if call.media == nil {
+		sess.Reject(488, "Not Acceptable Here", b.warning(399, "queue requires media relay"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+
+	b.queues.mutex.Lock()
+	if q.config.MaxLength > 0 && q.waiting() >= q.config.MaxLength {
+		b.queues.mutex.Unlock()
+		call.Log().Warnf("Queue %s is full", name)
+		b.metrics.Inc(MetricQueue + name + ".full")
+		sess.Reject(486, "Busy Here", b.warning(399, "queue full"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	b.queues.mutex.Unlock()
+
+	answer, err := call.media.relay.Answer(media.LegA, sess.RemoteSdp())
+	if err != nil {
+		call.Log().Warnf("Queue %s: answer failed: %v", name, err)
+		sess.Reject(488, "Not Acceptable Here", b.warning(305, "incompatible media format"))
+		b.finishCall(call, session.Failure)
+		return true
+	}
+	b.classifyCall(call, sess.Request(), true)
+	call.answer = answer
+	sess.ProvideAnswer(answer)
+	sess.Accept(200)
+	b.callAnswered(call)
+	if music := b.queueMusic(q); music != nil {
+		if err := call.media.relay.Play(media.LegA, music); err != nil {
+			call.Log().Warnf("Queue %s: music: %v", name, err)
+		}
+	}
+
+	qc := &queuedCall{call: call, entered: time.Now()}
+	b.queues.mutex.Lock()
+	q.calls = append(q.calls, qc)
+	q.entered++
+	b.queues.mutex.Unlock()
+	call.Log().Infof("Entered queue %s", name)
+	b.metrics.Inc(MetricQueue + name + ".entered")
+
+	if q.config.MaxWait > 0 {
+		time.AfterFunc(time.Duration(q.config.MaxWait)*time.Second, func() { b.queueTimeout(q, qc) })
+	}
+	b.distribute(q)
+	return true
+}
+
+// queueMusic 返回队列的等待音乐
+func (b *B2BUA) queueMusic(q *callQueue) *media.Audio {
+	if q.music != nil {
+		return q.music
+	}
+	return b.holdMusic
+}
+
+// waiting 返回等待中的呼叫数，调用时持有 queues.mutex
+func (q *callQueue) waiting() int {
+	n := 0
+	for _, qc := range q.calls {
+		if qc.dest == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// remove 将呼叫移出队列，调用时持有 queues.mutex
+func (q *callQueue) remove(qc *queuedCall) bool {
+	for i, c := range q.calls {
+		if c == qc {
+			q.calls = append(q.calls[:i], q.calls[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release 坐席结束振铃或通话，wrapUp 为之后的整理时间。调用时持有 queues.mutex
+func (a *queueAgent) release(wrapUp time.Duration) {
+	a.onCall, a.ringing = false, false
+	a.idleSince = time.Now()
+	a.wrapUntil = a.idleSince.Add(wrapUp)
+}
+
+// agentState 返回坐席的状态，调用时持有 queues.mutex
+func (b *B2BUA) agentState(agent *queueAgent, now time.Time) string {
+	switch {
+	case agent.ringing:
+		return AgentRinging
+	case agent.onCall:
+		return AgentTalking
+	case agent.paused:
+		return AgentBusy
+	case !b.registry.AorIsRegistered(b.registryAOR(agent.aor)):
+		return AgentOffline
+	case b.userOnCall(agent.user):
+		return AgentTalking
+	case now.Before(agent.wrapUntil):
+		return AgentWrapUp
+	}
+	return AgentAvailable
+}
+
+// userOnCall 检查本地账户是否正在进行其它呼叫（作为主叫或被叫）
+func (b *B2BUA) userOnCall(user string) bool {
+	for _, call := range b.Calls() {
+		if call.dest != nil && call.dest.Status() == session.Confirmed && call.dialed == user {
+			return true
+		}
+		if from, ok := call.src.Request().From(); ok && from.Address.User() != nil && from.Address.User().String() == user && !call.src.IsEnded() {
+			return true
+		}
+	}
+	return false
+}
+
+// pickAgent 按队列的策略选择一个空闲的坐席，调用时持有 queues.mutex
+func (b *B2BUA) pickAgent(q *callQueue, now time.Time) *queueAgent {
+	var picked *queueAgent
+	for i := range q.agents {
+		index := i
+		if q.config.Strategy == QueueRoundRobin {
+			index = (q.next + i) % len(q.agents)
+		}
+		agent := q.agents[index]
+		if b.agentState(agent, now) != AgentAvailable {
+			continue
+		}
+		if q.config.Strategy == QueueRoundRobin {
+			q.next = index + 1
+			return agent
+		}
+		if picked == nil || agent.idleSince.Before(picked.idleSince) {
+			picked = agent
+		}
+	}
+	return picked
+}
+
+// distribute 将等待中的呼叫按进入队列的顺序分配给空闲的坐席
+func (b *B2BUA) distribute(q *callQueue) {
+	type offer struct {
+		qc    *queuedCall
+		agent *queueAgent
+	}
+	var offers []offer
+	now := time.Now()
+	b.queues.mutex.Lock()
+	for _, qc := range q.calls {
+		if qc.dest != nil || qc.agent != nil {
+			continue
+		}
+		agent := b.pickAgent(q, now)
+		if agent == nil {
+			break
+		}
+		agent.onCall, agent.ringing = true, true
+		qc.agent = agent
+		offers = append(offers, offer{qc, agent})
+	}
+	b.queues.mutex.Unlock()
+
+	for _, o := range offers {
+		if b.offerCall(q, o.qc, o.agent) {
+			continue
+		}
+		b.queues.mutex.Lock()
+		if o.qc.agent == o.agent {
+			o.qc.agent = nil
+		}
+		o.agent.release(0)
+		b.queues.mutex.Unlock()
+	}
+}
+
+// offerCall 向坐席的所有联系地址发起 B 路呼叫，超时未应答时取消。成功发起时返回 true
+func (b *B2BUA) offerCall(q *callQueue, qc *queuedCall, agent *queueAgent) bool {
+	if !b.inviteAccount(qc.call, agent.aor) {
+		return false
+	}
+	qc.call.Log().Infof("Queue %s: offering to agent %s", q.config.Name, agent.user)
+
+	timeout := q.config.RingTimeout
+	if timeout <= 0 {
+		timeout = defaultAgentRingTimeout
+	}
+	time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		b.queues.mutex.Lock()
+		ringing := qc.agent == agent && qc.dest == nil
+		b.queues.mutex.Unlock()
+		if !ringing {
+			return
+		}
+		qc.call.Log().Infof("Queue %s: agent %s did not answer within %ds", q.config.Name, agent.user, timeout)
+		for _, leg := range b.ringingLegs(qc.call, agent.user) {
+			leg.dest.End()
+		}
+	})
+	return true
+}
+
+// queuedCallOf 查找 A 路所在的队列和排队的呼叫，调用时持有 queues.mutex
+func (b *B2BUA) queuedCallOf(src *session.Session) (*callQueue, *queuedCall) {
+	for _, q := range b.queues.queues {
+		for _, qc := range q.calls {
+			if qc.call.src == src {
+				return q, qc
+			}
+		}
+	}
+	return nil, nil
+}
+
+// agentAnswered 坐席应答排队的呼叫时停止等待音乐、取消该坐席的其它分支。A 路已在本地应答时返回 true，
+// 此时不再向 A 路发送应答
+func (b *B2BUA) agentAnswered(call *B2BCall) bool {
+	if call.answer == "" {
+		return false
+	}
+	b.queues.mutex.Lock()
+	q, qc := b.queuedCallOf(call.src)
+	if qc == nil || qc.dest != nil {
+		b.queues.mutex.Unlock()
+		return true
+	}
+	qc.dest = call.dest
+	agent := qc.agent
+	agent.ringing = false
+	agent.answered++
+	wait := time.Since(qc.entered)
+	q.answered++
+	q.waited += wait
+	b.queues.mutex.Unlock()
+
+	call.media.relay.StopPlay(media.LegA)
+	for _, leg := range b.ringingLegs(call, agent.user) { // 坐席的其它终端
+		if leg.dest != call.dest {
+			leg.dest.End()
+		}
+	}
+	call.Context.Set("queue_agent", agent.user)
+	call.Log().Infof("Queue %s: answered by %s after %.1fs", q.config.Name, agent.user, wait.Seconds())
+	b.metrics.Inc(MetricQueue + q.config.Name + ".answered")
+	b.metrics.Add(MetricQueue+q.config.Name+".wait_ms", uint64(wait/time.Millisecond))
+	return true
+}
+
+// queueLegEnded 处理排队呼叫的会话结束：等待中的主叫挂机时移出队列并结束呼叫，坐席未应答时释放坐席并重新分配，
+// 已接通的呼叫结束时释放坐席。返回 true 表示已处理，不再按普通呼叫处理
+func (b *B2BUA) queueLegEnded(sess *session.Session, state session.Status) bool {
+	src := sess
+	leg := b.findCall(sess)
+	if leg != nil {
+		src = leg.src
+	}
+	b.queues.mutex.Lock()
+	q, qc := b.queuedCallOf(src)
+	if qc == nil {
+		b.queues.mutex.Unlock()
+		return false
+	}
+	agent := qc.agent
+
+	switch {
+	case qc.dest != nil: // 已接通，按普通呼叫结束
+		if sess == qc.call.src || sess == qc.dest {
+			q.remove(qc)
+			agent.release(time.Duration(q.config.WrapUp) * time.Second)
+		}
+		b.queues.mutex.Unlock()
+		if sess == qc.dest {
+			go b.distribute(q)
+		}
+		return false
+
+	case sess == src: // 主叫在等待中挂机
+		q.remove(qc)
+		q.abandoned++
+		if agent != nil {
+			agent.release(0)
+		}
+		b.queues.mutex.Unlock()
+		qc.call.Log().Infof("Queue %s: caller abandoned after %.1fs", q.config.Name, time.Since(qc.entered).Seconds())
+		b.metrics.Inc(MetricQueue + q.config.Name + ".abandoned")
+		if agent != nil {
+			for _, leg := range b.ringingLegs(qc.call, agent.user) {
+				leg.dest.End()
+			}
+		}
+		qc.call.Context.Set("queue_result", "abandoned")
+		b.finishCall(qc.call, state)
+		return true
+	}
+
+	// 坐席的一个分支失败或被取消
+	b.dropLeg(sess)
+	if agent == nil || len(b.ringingLegs(qc.call, agent.user)) > 0 {
+		b.queues.mutex.Unlock()
+		return true
+	}
+	qc.agent = nil
+	agent.release(0)
+	b.queues.mutex.Unlock()
+	qc.call.Log().Infof("Queue %s: agent %s did not answer", q.config.Name, agent.user)
+	go b.distribute(q)
+	return true
+}
+
+// dropLeg 移除一个分支而不结束呼叫
+func (b *B2BUA) dropLeg(sess *session.Session) {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for i, call := range b.calls {
+		if call.dest == sess {
+			b.calls = append(b.calls[:i], b.calls[i+1:]...)
+			return
+		}
+	}
+}
+
+// queueTimeout 呼叫等待超过 max_wait 时挂断
+func (b *B2BUA) queueTimeout(q *callQueue, qc *queuedCall) {
+	b.queues.mutex.Lock()
+	if qc.dest != nil || !q.remove(qc) {
+		b.queues.mutex.Unlock()
+		return
+	}
+	q.timedOut++
+	agent := qc.agent
+	if agent != nil {
+		agent.release(0)
+	}
+	b.queues.mutex.Unlock()
+
+	call := qc.call
+	call.Log().Infof("Queue %s: no agent answered within %ds", q.config.Name, q.config.MaxWait)
+	b.metrics.Inc(MetricQueue + q.config.Name + ".timeout")
+	if agent != nil {
+		for _, leg := range b.ringingLegs(call, agent.user) {
+			leg.dest.End()
+		}
+	}
+	call.Context.Set("queue_result", "timeout")
+	if !call.src.IsEnded() {
+		call.src.End()
+	}
+	b.finishCall(call, session.Terminated)
+}
+
+// runQueues 定期重新分配等待中的呼叫，处理坐席注册、整理时间结束和其它呼叫结束
+func (b *B2BUA) runQueues() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			for _, q := range b.queues.queues {
+				b.distribute(q)
+			}
+		}
+	}
+}
+
+// Queues 返回各队列的状态和统计
+func (b *B2BUA) Queues() []QueueStatus {
+	now := time.Now()
+	b.queues.mutex.Lock()
+	defer b.queues.mutex.Unlock()
+	statuses := make([]QueueStatus, 0, len(b.queues.queues))
+	for _, q := range b.queues.queues {
+		status := QueueStatus{
+			Name:      q.config.Name,
+			Number:    q.config.Number,
+			Strategy:  q.config.Strategy,
+			Waiting:   q.waiting(),
+			Entered:   q.entered,
+			Answered:  q.answered,
+			Abandoned: q.abandoned,
+			TimedOut:  q.timedOut,
+			Agents:    make([]QueueAgentStatus, 0, len(q.agents)),
+		}
+		for _, qc := range q.calls {
+			if wait := now.Sub(qc.entered).Seconds(); qc.dest == nil && wait > status.LongestWait {
+				status.LongestWait = wait
+			}
+		}
+		if q.answered > 0 {
+			status.AverageWait = q.waited.Seconds() / float64(q.answered)
+		}
+		for _, agent := range q.agents {
+			status.Agents = append(status.Agents, QueueAgentStatus{
+				User:      agent.user,
+				State:     b.agentState(agent, now),
+				Answered:  agent.answered,
+				IdleSince: agent.idleSince,
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// SetAgentState 由坐席或管理员设置坐席示忙（busy）或空闲（available）
+func (b *B2BUA) SetAgentState(queue, user, state string) error {
+	if state != AgentAvailable && state != AgentBusy {
+		return fmt.Errorf("invalid agent state %q, expected %s or %s", state, AgentAvailable, AgentBusy)
+	}
+	b.queues.mutex.Lock()
+	defer b.queues.mutex.Unlock()
+	for _, q := range b.queues.queues {
+		if q.config.Name != queue {
+			continue
+		}
+		for _, agent := range q.agents {
+			if agent.user == user {
+				agent.paused = state == AgentBusy
+				logger.Infof("Queue %s: agent %s set %s", queue, user, state)
+				return nil
+			}
+		}
+	}
+	return ErrQueueNotFound
+}
@@ -0,0 +1,134 @@
+package b2bua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go-sip-ua/pkg/media"
+)
+
+// RecordingConfig 通话录音配置，需要启用媒体中继。录音为 8kHz 单声道 WAV 文件，
+// 两路音频混合后写入，目前只支持 G.711（PCMU/PCMA）
+type RecordingConfig struct {
+	Directory string   `json:"directory"` // 录音目录，为空时不录音
+	All       bool     `json:"all"`       // 是否录制所有通话，也可通过 call_classes 录制某类呼叫
+	Users     []string `json:"users"`     // 需要录音的账户（user 或 user@domain），主叫或被叫匹配时录音
+}
+
+// callContextRecord 通话上下文中的录音开关，值为 true 时录制该通话（如由呼叫回调或 REST 接口设置）
+const callContextRecord = "record"
+
+// Recording 描述一个录音文件
+type Recording struct {
+	Name     string    `json:"name"`     // 文件名：<呼叫 ID>-<开始时间>.wav
+	CallID   string    `json:"call_id"`  // 呼叫 ID
+	Size     int64     `json:"size"`     // 文件大小（字节）
+	Modified time.Time `json:"modified"` // 最后写入时间
+}
+
+// shouldRecord 检查通话是否需要录音
+func (b *B2BUA) shouldRecord(call *B2BCall) bool {
+	config := b.config.Recording
+	if config.Directory == "" || call.media == nil {
+		return false
+	}
+	if value, ok := call.Context.Get(callContextRecord); ok {
+		return value == "true"
+	}
+	if config.All || b.config.CallClasses[call.Class].Record {
+		return true
+	}
+	for _, user := range call.users {
+		for _, recorded := range config.Users {
+			if strings.EqualFold(user, recorded) || strings.EqualFold(strings.SplitN(user, "@", 2)[0], recorded) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startRecording 通话应答后开始录音，同一呼叫只录一次
+func (b *B2BUA) startRecording(call *B2BCall) {
+	if !b.shouldRecord(call) {
+		return
+	}
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	if call.media.recording != "" {
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.wav", call.ID, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(b.config.Recording.Directory, 0755); err != nil {
+		call.Log().Errorf("Recording: %v", err)
+		return
+	}
+	recorder, err := media.NewRecorder(filepath.Join(b.config.Recording.Directory, name))
+	if err != nil {
+		call.Log().Errorf("Recording: %v", err)
+		return
+	}
+	call.media.recorder = recorder
+	call.media.recording = name
+	call.media.relay.OnRTP(recorder.WriteRTP)
+	call.Context.Set("recording", name) // 在话单中记录录音文件
+	call.Log().Infof("Recording to %s", name)
+}
+
+// stopRecording 结束录音
+func (b *B2BUA) stopRecording(call *B2BCall) {
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	if call.media.recorder == nil {
+		return
+	}
+	if err := call.media.recorder.Close(); err != nil {
+		call.Log().Errorf("Recording: close %s failed: %v", call.media.recording, err)
+	}
+	call.media.recorder = nil
+}
+
+// Recordings 列出录音文件，按时间倒序
+func (b *B2BUA) Recordings() ([]Recording, error) {
+	recordings := make([]Recording, 0)
+	if b.config.Recording.Directory == "" {
+		return recordings, nil
+	}
+	files, err := ioutil.ReadDir(b.config.Recording.Directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return recordings, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".wav") {
+			continue
+		}
+		recording := Recording{Name: file.Name(), Size: file.Size(), Modified: file.ModTime()}
+		if len(file.Name()) > 36 {
+			recording.CallID = file.Name()[:36] // UUID
+		}
+		recordings = append(recordings, recording)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Modified.After(recordings[j].Modified) })
+	return recordings, nil
+}
+
+// RecordingPath 返回录音文件的路径，文件名无效或不存在时返回错误
+func (b *B2BUA) RecordingPath(name string) (string, error) {
+	if b.config.Recording.Directory == "" || name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, ".wav") {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(b.config.Recording.Directory, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,464 @@
+package b2bua
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/util"
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+const (
+	regEventPackage       = "reg"                     // 注册事件包的名称
+	regEventContentType   = "application/reginfo+xml" // 注册状态文档的类型
+	defaultRegEventExpiry = 3600                      // 默认及最大订阅有效期（秒）
+	regEventCheckInterval = 10 * time.Second          // 检查订阅过期和联系地址过期的间隔
+	reginfoNamespace      = "urn:ietf:params:xml:ns:reginfo"
+)
+
+// RegEventConfig 注册事件包（RFC 3680）：终端和配置系统订阅 AOR 的 reg 事件，联系地址添加、刷新或移除时收到 NOTIFY
+type RegEventConfig struct {
+	Watchers   []string `json:"watchers"`    // 可以订阅任意 AOR 的账户（如配置系统），其它账户只能订阅自己的 AOR
+	MaxExpires uint32   `json:"max_expires"` // 订阅的最大有效期（秒），0 为 3600
+}
+
+// reginfo 注册状态文档（RFC 3680 第 5 节）
+type reginfo struct {
+	XMLName       xml.Name          `xml:"reginfo"`
+	Xmlns         string            `xml:"xmlns,attr"`
+	Version       int               `xml:"version,attr"`
+	State         string            `xml:"state,attr"`
+	Registrations []regRegistration `xml:"registration"`
+}
+
+// regRegistration 一个 AOR 的注册状态
+type regRegistration struct {
+	AOR      string       `xml:"aor,attr"`
+	ID       string       `xml:"id,attr"`
+	State    string       `xml:"state,attr"` // init、active 或 terminated
+	Contacts []regContact `xml:"contact"`
+}
+
+// regContact 一个联系地址的状态及引起变化的事件
+type regContact struct {
+	ID      string `xml:"id,attr"`
+	State   string `xml:"state,attr"` // active 或 terminated
+	Event   string `xml:"event,attr"` // registered、refreshed、expired 或 unregistered
+	Expires int64  `xml:"expires,attr,omitempty"`
+	Q       string `xml:"q,attr,omitempty"`
+	URI     string `xml:"uri"`
+}
+
+// regBinding 已通知给订阅者的一个联系地址
+type regBinding struct {
+	event       string // 最近一次引起变化的事件
+	uri         string
+	q           float64
+	lastUpdated uint32
+	expiresAt   int64
+}
+
+// regSubscription 一个 reg 事件订阅，即以 SUBSCRIBE 建立的对话
+type regSubscription struct {
+	id          string             // Call-ID 与本端标签
+	tag         string             // 本端标签
+	aor         sip.Uri            // 订阅的 AOR（注册表中的形式）
+	callID      sip.CallID         // 对话的 Call-ID
+	local       *sip.FromHeader    // NOTIFY 的 From：SUBSCRIBE 的 To 加上本端标签
+	remote      *sip.ToHeader      // NOTIFY 的 To：SUBSCRIBE 的 From
+	target      sip.Uri            // NOTIFY 的请求 URI：SUBSCRIBE 的 Contact
+	routes      []sip.Uri          // 路由集：SUBSCRIBE 的 Record-Route
+	contact     *sip.ContactHeader // 本端 Contact
+	transport   string
+	destination string // 订阅者的地址（SUBSCRIBE 的来源）
+
+	mutex     sync.Mutex            // 串行化发往该订阅者的 NOTIFY
+	cseq      uint32                // 最近一次 NOTIFY 的 CSeq
+	version   int                   // 下一个 NOTIFY 文档的版本号
+	expiresAt time.Time             // 订阅到期时间
+	bindings  map[string]regBinding // 已通知的联系地址：绑定 -> 状态
+	ended     bool                  // 已发送 terminated 的 NOTIFY
+}
+
+// regEvents 当前的 reg 事件订阅
+type regEvents struct {
+	mutex sync.Mutex
+	subs  map[string]*regSubscription // 订阅 ID -> 订阅
+}
+
+// eventPackage 返回请求 Event 头域中的事件包名称（小写）
+func eventPackage(req sip.Request) string {
+	for _, header := range req.GetHeaders("Event") {
+		value := header.Value()
+		if i := strings.Index(value, ";"); i >= 0 {
+			value = value[:i]
+		}
+		return strings.ToLower(strings.TrimSpace(value))
+	}
+	return ""
+}
+
+// handleSubscribe 处理 SUBSCRIBE 请求：只支持 reg 事件。新订阅检查订阅者是否可以查看该 AOR，
+// 对话内的 SUBSCRIBE 刷新或取消（Expires: 0）订阅。接受后立即发送包含完整状态的 NOTIFY
+func (b *B2BUA) handleSubscribe(req sip.Request, tx sip.ServerTransaction) {
+	if eventPackage(req) != regEventPackage {
+		resp := sip.NewResponseFromRequest(req.MessageID(), req, 489, "Bad Event", "")
+		resp.AppendHeader(&sip.GenericHeader{HeaderName: "Allow-Events", Contents: regEventPackage})
+		tx.Respond(resp)
+		return
+	}
+	to, _ := req.To()
+	from, _ := req.From()
+	callID, _ := req.CallID()
+	if to == nil || from == nil || callID == nil || to.Address == nil {
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 400, "Bad Request", ""))
+		return
+	}
+
+	maxExpires := b.config.RegEvent.MaxExpires
+	if maxExpires == 0 {
+		maxExpires = defaultRegEventExpiry
+	}
+	expires, ok := registry2.RequestExpires(req)
+	if !ok || uint32(expires) > maxExpires {
+		expires = sip.Expires(maxExpires)
+	}
+
+	var sub *regSubscription
+	if tag, ok := dialogTag(to); ok { // 对话内：刷新或取消订阅
+		b.regEvents.mutex.Lock()
+		sub = b.regEvents.subs[string(*callID)+"|"+tag]
+		b.regEvents.mutex.Unlock()
+		if sub == nil {
+			tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 481, "Subscription Does Not Exist", ""))
+			return
+		}
+	} else {
+		aor := b.registryAOR(to.Address)
+		if !b.mayWatch(req, aor) {
+			logger.Warnf("Rejecting reg SUBSCRIBE for %v from %s: not allowed", aor, req.Source())
+			tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 403, "Forbidden", ""))
+			return
+		}
+		if sub = newRegSubscription(req, aor); sub == nil {
+			tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 400, "Bad Request", ""))
+			return
+		}
+		b.regEvents.mutex.Lock()
+		b.regEvents.subs[sub.id] = sub
+		b.regEvents.mutex.Unlock()
+		logger.Infof("reg subscription %s for %v from %s", sub.id, aor, req.Source())
+		b.metrics.Inc(MetricRegEvent + "subscribed")
+	}
+
+	resp := sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", "")
+	if respTo, ok := resp.To(); ok && !respTo.Params.Has("tag") {
+		respTo.Params.Add("tag", sip.String{Str: sub.tag})
+	}
+	resp.AppendHeader(&expires)
+	resp.AppendHeader(sub.contact.Clone())
+	tx.Respond(resp)
+
+	sub.mutex.Lock()
+	sub.expiresAt = time.Now().Add(time.Duration(expires) * time.Second)
+	sub.mutex.Unlock()
+	if expires == 0 {
+		go b.endRegSubscription(sub, "timeout")
+		return
+	}
+	go b.notifyReg(sub, true)
+}
+
+// dialogTag 返回 To 头域的标签，没有标签（初始请求）时返回 false
+func dialogTag(to *sip.ToHeader) (string, bool) {
+	if to.Params == nil {
+		return "", false
+	}
+	tag, ok := to.Params.Get("tag")
+	if !ok || tag == nil {
+		return "", false
+	}
+	return tag.String(), true
+}
+
+// mayWatch 检查订阅者是否可以查看 aor 的注册状态：订阅自己的 AOR、配置为 watcher 的账户，或未启用认证时 From 符合上述条件
+func (b *B2BUA) mayWatch(req sip.Request, aor sip.Uri) bool {
+	user := b.authenticatedUser(req)
+	if user == "" && b.requestConfig(req).Auth.Value == AuthNone {
+		if from, ok := req.From(); ok && from.Address != nil && from.Address.User() != nil {
+			user = from.Address.User().String()
+		}
+	}
+	if user == "" {
+		return false
+	}
+	if aor.User() != nil && aor.User().String() == user {
+		return true
+	}
+	for _, watcher := range b.config.RegEvent.Watchers {
+		if watcher == user {
+			return true
+		}
+	}
+	return false
+}
+
+// newRegSubscription 根据初始 SUBSCRIBE 建立订阅的对话状态，缺少 Contact 或本端地址无效时返回 nil
+func newRegSubscription(req sip.Request, aor sip.Uri) *regSubscription {
+	to, _ := req.To()
+	from, _ := req.From()
+	callID, _ := req.CallID()
+	contact, ok := req.Contact()
+	if !ok || contact == nil || contact.Address == nil {
+		return nil
+	}
+	tag := util.RandString(8)
+	localParams, remoteParams := sip.NewParams(), sip.NewParams()
+	if to.Params != nil {
+		localParams = to.Params.Clone()
+	}
+	if from.Params != nil {
+		remoteParams = from.Params.Clone()
+	}
+	local := &sip.FromHeader{DisplayName: to.DisplayName, Address: to.Address.Clone(), Params: localParams.Add("tag", sip.String{Str: tag})}
+	remote := &sip.ToHeader{DisplayName: from.DisplayName, Address: from.Address.Clone(), Params: remoteParams}
+	var routes []sip.Uri
+	for _, header := range req.GetHeaders("Record-Route") {
+		if rr, ok := header.(*sip.RecordRouteHeader); ok {
+			routes = append(routes, rr.Addresses...)
+		}
+	}
+	localContact, err := parser.ParseSipUri("sip:" + req.Destination())
+	if err != nil {
+		return nil
+	}
+	return &regSubscription{
+		id:          string(*callID) + "|" + tag,
+		tag:         tag,
+		aor:         aor,
+		callID:      *callID,
+		local:       local,
+		remote:      remote,
+		target:      contact.Address.Clone(),
+		routes:      routes,
+		contact:     &sip.ContactHeader{Address: &localContact},
+		transport:   req.Transport(),
+		destination: req.Source(),
+		bindings:    make(map[string]regBinding),
+	}
+}
+
+// regChanged 通知订阅了 aor 的订阅者其联系地址的变化
+func (b *B2BUA) regChanged(aor sip.Uri) {
+	key := registry2.AORKey(aor)
+	for _, sub := range b.regSubscriptions() {
+		if registry2.AORKey(sub.aor) == key {
+			go b.notifyReg(sub, false)
+		}
+	}
+}
+
+// notifyRegSubscribers 向联系地址有变化的所有订阅者发送 NOTIFY
+func (b *B2BUA) notifyRegSubscribers() {
+	for _, sub := range b.regSubscriptions() {
+		go b.notifyReg(sub, false)
+	}
+}
+
+// regSubscriptions 返回当前的所有订阅
+func (b *B2BUA) regSubscriptions() []*regSubscription {
+	b.regEvents.mutex.Lock()
+	defer b.regEvents.mutex.Unlock()
+	subs := make([]*regSubscription, 0, len(b.regEvents.subs))
+	for _, sub := range b.regEvents.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// runRegEvents 定期结束到期的订阅，并通知过期、经连接断开或其它节点同步移除的联系地址
+func (b *B2BUA) runRegEvents() {
+	ticker := time.NewTicker(regEventCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case now := <-ticker.C:
+			for _, sub := range b.regSubscriptions() {
+				sub.mutex.Lock()
+				expired := now.After(sub.expiresAt)
+				sub.mutex.Unlock()
+				if expired {
+					go b.endRegSubscription(sub, "timeout")
+				} else {
+					go b.notifyReg(sub, false)
+				}
+			}
+		}
+	}
+}
+
+// notifyReg 向订阅者发送 AOR 的注册状态，force 为 false 时只在联系地址有变化时发送
+func (b *B2BUA) notifyReg(sub *regSubscription, force bool) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.ended {
+		return
+	}
+	info, changed := b.regState(sub, time.Now())
+	if !changed && !force {
+		return
+	}
+	state := fmt.Sprintf("active;expires=%d", int(time.Until(sub.expiresAt).Seconds()))
+	b.sendRegNotify(sub, info, state)
+}
+
+// endRegSubscription 以最终的 NOTIFY 结束订阅，reason 为 Subscription-State 的终止原因
+func (b *B2BUA) endRegSubscription(sub *regSubscription, reason string) {
+	b.regEvents.mutex.Lock()
+	delete(b.regEvents.subs, sub.id)
+	b.regEvents.mutex.Unlock()
+
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.ended {
+		return
+	}
+	info, _ := b.regState(sub, time.Now())
+	b.sendRegNotify(sub, info, "terminated;reason="+reason)
+	sub.ended = true
+	logger.Infof("reg subscription %s for %v ended: %s", sub.id, sub.aor, reason)
+}
+
+// regState 生成订阅的 AOR 的完整注册状态文档，与已通知的联系地址比较得出各联系地址的事件。
+// 返回的 changed 表示联系地址有变化。调用者持有 sub.mutex
+func (b *B2BUA) regState(sub *regSubscription, now time.Time) (*reginfo, bool) {
+	current := make(map[string]regBinding)
+	if contacts, found := b.registry.GetContacts(sub.aor); found {
+		for binding, instance := range *contacts {
+			if instance.Contact == nil || instance.Contact.Address == nil || instance.Expired(now) {
+				continue
+			}
+			current[binding] = regBinding{
+				uri:         instance.Contact.Address.String(),
+				q:           instance.Q,
+				lastUpdated: instance.LastUpdated,
+				expiresAt:   int64(instance.LastUpdated) + int64(instance.RegExpires),
+			}
+		}
+	}
+
+	registration := regRegistration{AOR: sub.aor.String(), ID: regID(registry2.AORKey(sub.aor)), State: "init"}
+	changed := false
+	for binding, contact := range current {
+		previous, found := sub.bindings[binding]
+		switch {
+		case !found:
+			contact.event = "registered"
+			changed = true
+		case previous.lastUpdated != contact.lastUpdated:
+			contact.event = "refreshed"
+			changed = true
+		default: // 未变化，完整状态中沿用上次的事件
+			contact.event = previous.event
+		}
+		current[binding] = contact
+		registration.Contacts = append(registration.Contacts, regContact{
+			ID:      regID(binding),
+			State:   "active",
+			Event:   contact.event,
+			Expires: contact.expiresAt - now.Unix(),
+			Q:       fmt.Sprintf("%.3g", contact.q),
+			URI:     contact.uri,
+		})
+	}
+	for binding, previous := range sub.bindings {
+		if _, found := current[binding]; found {
+			continue
+		}
+		event := "unregistered"
+		if previous.expiresAt <= now.Unix() {
+			event = "expired"
+		}
+		registration.Contacts = append(registration.Contacts, regContact{
+			ID:    regID(binding),
+			State: "terminated",
+			Event: event,
+			URI:   previous.uri,
+		})
+		changed = true
+	}
+	switch {
+	case len(current) > 0:
+		registration.State = "active"
+	case len(sub.bindings) > 0:
+		registration.State = "terminated"
+	}
+	sub.bindings = current
+
+	info := &reginfo{
+		Xmlns:         reginfoNamespace,
+		State:         "full",
+		Registrations: []regRegistration{registration},
+	}
+	return info, changed
+}
+
+// regID 返回状态文档中注册或联系地址的标识
+func regID(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// sendRegNotify 发送一个 NOTIFY，文档的版本号依次递增。订阅者不再接受（发送失败或返回错误）时删除订阅。
+// 调用者持有 sub.mutex
+func (b *B2BUA) sendRegNotify(sub *regSubscription, info *reginfo, state string) {
+	info.Version = sub.version
+	sub.version++
+	body, err := xml.Marshal(info)
+	if err != nil {
+		logger.Errorf("reg subscription %s: marshal reginfo failed: %v", sub.id, err)
+		return
+	}
+	sub.cseq++
+	maxForwards := sip.MaxForwards(70)
+	callID := sub.callID
+	headers := []sip.Header{
+		sub.local.Clone(),
+		sub.remote.Clone(),
+		&callID,
+		&sip.CSeq{SeqNo: sub.cseq, MethodName: sip.NOTIFY},
+		&maxForwards,
+		sub.contact.Clone(),
+		&sip.GenericHeader{HeaderName: "Event", Contents: regEventPackage},
+		&sip.GenericHeader{HeaderName: "Subscription-State", Contents: state},
+		&sip.GenericHeader{HeaderName: "Content-Type", Contents: regEventContentType},
+	}
+	for _, route := range sub.routes {
+		headers = append(headers, &sip.RouteHeader{Addresses: []sip.Uri{route}})
+	}
+	req := sip.NewRequest("", sip.NOTIFY, sub.target.Clone(), "SIP/2.0", headers, xml.Header+string(body), nil)
+
+	resp, err := b.sendRequest(b.ctx, req, sub.transport, sub.destination, defaultRelayTimeout)
+	if err == nil && !resp.IsSuccess() {
+		err = fmt.Errorf("%d %s", resp.StatusCode(), resp.Reason())
+	}
+	if err != nil {
+		logger.Warnf("reg subscription %s: NOTIFY to %s failed, removing: %v", sub.id, sub.destination, err)
+		b.metrics.Inc(MetricRegEvent + "failed")
+		sub.ended = true
+		b.regEvents.mutex.Lock()
+		delete(b.regEvents.subs, sub.id)
+		b.regEvents.mutex.Unlock()
+		return
+	}
+	b.metrics.Inc(MetricRegEvent + "notified")
+}
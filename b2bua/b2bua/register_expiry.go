@@ -0,0 +1,62 @@
+package b2bua
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/ghettovoice/gosip/sip"
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+// RegisterExpiryConfig 本地注册的有效期策略
+type RegisterExpiryConfig struct {
+	Min    uint32 `json:"min"`    // 最小有效期（秒），请求值小于该值时返回 423 Interval Too Brief 并携带 Min-Expires
+	Max    uint32 `json:"max"`    // 最大有效期（秒），请求值大于该值时按该值授予（同样按 Jitter 缩短），为 0 时不限制
+	Jitter int    `json:"jitter"` // 随机缩短授予有效期的最大百分比（0-50），使大量终端的重新注册时间分散
+}
+
+// grantExpires 返回本地注册实际授予的有效期：先限制在 Max 之内，再按 Jitter 随机缩短，最后不低于 Min
+func (c RegisterExpiryConfig) grantExpires(requested sip.Expires) sip.Expires {
+	expires := uint32(requested)
+	if c.Max > 0 && expires > c.Max { // 超过 Max 的请求同样需要分散
+		expires = c.Max
+	}
+	jitter := c.Jitter
+	if jitter > 50 {
+		jitter = 50
+	}
+	if jitter > 0 {
+		if spread := uint64(expires) * uint64(jitter) / 100; spread > 0 { // uint64 避免溢出
+			expires -= uint32(rand.Int63n(int64(spread) + 1))
+		}
+	}
+	if expires < c.Min { // 缩短后不低于最小有效期
+		expires = c.Min
+	}
+	if expires == 0 { // 不能把注册变成注销
+		expires = 1
+	}
+	return sip.Expires(expires)
+}
+
+// tooBrief 检查 REGISTER 请求是否有联系地址的有效期短于最小有效期（注销不受限制，RFC 3261 10.3）
+func (c RegisterExpiryConfig) tooBrief(request sip.Request) bool {
+	if c.Min == 0 {
+		return false
+	}
+	for _, instance := range registry2.NewContactInstancesForRequest(request) {
+		if instance.RegExpires > 0 && instance.RegExpires < c.Min {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBrief 以 423 Interval Too Brief 拒绝有效期过短的注册，Min-Expires 为最小有效期
+func (b *B2BUA) rejectBrief(request sip.Request, tx sip.ServerTransaction) {
+	min := b.config.RegisterExpiry.Min
+	logger.Infof("Rejecting REGISTER from %s: expires shorter than %d", request.Source(), min)
+	resp := sip.NewResponseFromRequest(request.MessageID(), request, 423, "Interval Too Brief", "")
+	resp.AppendHeader(&sip.GenericHeader{HeaderName: "Min-Expires", Contents: fmt.Sprint(min)})
+	tx.Respond(resp)
+}
@@ -0,0 +1,275 @@
+package b2bua
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+const (
+	defaultRelayTimeout  = 8                // 默认等待上游响应的时间（秒）
+	upstreamRetryBackoff = 30 * time.Second // 上游不可用后，暂停转发的时间
+)
+
+// relayedResponseHeaders 从上游响应透传给终端的头部
+var relayedResponseHeaders = []string{
+	"Contact", "Expires", "Min-Expires", "WWW-Authenticate", "Proxy-Authenticate",
+	"Service-Route", "Path", "Date", "Retry-After",
+}
+
+// RegisterRelayConfig REGISTER 上行转发配置。
+// 匹配的 REGISTER 以边缘代理身份（携带 Path）转发到主注册服务器，成功后在本地缓存注册信息；
+// 上游不可用时由本地接管注册，保证分支机构内部呼叫可用。
+type RegisterRelayConfig struct {
+	Upstream string   `json:"upstream"` // 主注册服务器地址，例如 sip:registrar.example.com;transport=udp，为空时不转发
+	Domains  []string `json:"domains"`  // 需要转发的域名，为空表示全部
+	Users    []string `json:"users"`    // 需要转发的用户名，为空表示全部
+	Timeout  int      `json:"timeout"`  // 等待上游最终响应的时间（秒）
+}
+
+// registerRelay 选择需要转发的 REGISTER 并跟踪上游可用性
+type registerRelay struct {
+	config   RegisterRelayConfig
+	upstream sip.SipUri
+	domains  map[string]bool
+	users    map[string]bool
+	mutex    sync.Mutex
+	down     bool      // 上游不可用
+	retryAt  time.Time // 上游不可用时，在此之前不再尝试转发
+}
+
+func newRegisterRelay(config RegisterRelayConfig) (*registerRelay, error) {
+	upstream, err := parser.ParseSipUri(config.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream registrar %s: %w", config.Upstream, err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRelayTimeout
+	}
+	relay := &registerRelay{
+		config:   config,
+		upstream: upstream,
+		domains:  make(map[string]bool),
+		users:    make(map[string]bool),
+	}
+	for _, domain := range config.Domains {
+		relay.domains[strings.ToLower(domain)] = true
+	}
+	for _, user := range config.Users {
+		relay.users[user] = true
+	}
+	return relay, nil
+}
+
+// Matches 检查 AOR 是否需要转发到上游
+func (r *registerRelay) Matches(aor sip.Uri) bool {
+	if len(r.domains) > 0 && !r.domains[strings.ToLower(aor.Host())] {
+		return false
+	}
+	if len(r.users) > 0 {
+		if aor.User() == nil || !r.users[aor.User().String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// Available 返回是否应尝试上游：上游正常，或不可用后的退避时间已过
+func (r *registerRelay) Available() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !r.down || time.Now().After(r.retryAt)
+}
+
+// IsDown 返回上游是否被标记为不可用
+func (r *registerRelay) IsDown() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.down
+}
+
+// MarkDown 将上游标记为不可用，在退避时间内直接由本地处理，返回状态是否发生变化
+func (r *registerRelay) MarkDown() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := !r.down
+	r.down = true
+	r.retryAt = time.Now().Add(upstreamRetryBackoff)
+	return changed
+}
+
+// MarkUp 将上游标记为可用，返回状态是否发生变化
+func (r *registerRelay) MarkUp() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := r.down
+	r.down = false
+	return changed
+}
+
+// target 返回上游上指定用户的地址
+func (r *registerRelay) target(user string) sip.SipUri {
+	uri := r.upstream.Clone().(*sip.SipUri)
+	uri.FUser = sip.String{Str: user}
+	return *uri
+}
+
+// transport 返回连接上游使用的传输协议
+func (r *registerRelay) transport() string {
+	if tp, ok := r.upstream.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+		return strings.ToUpper(tp.String())
+	}
+	return "UDP"
+}
+
+// destination 返回上游的 host:port
+func (r *registerRelay) destination() string {
+	port := sip.DefaultPort(r.transport())
+	if r.upstream.FPort != nil {
+		port = *r.upstream.FPort
+	}
+	return fmt.Sprintf("%v:%v", r.upstream.FHost, port)
+}
+
+// relayRegister 将 REGISTER 转发到上游，上游不可用时回退到本地注册
+func (b *B2BUA) relayRegister(ctx context.Context, request sip.Request, tx sip.ServerTransaction, aor sip.Uri) {
+	relay := b.registerRelay
+	if hdrs := request.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if maxForwards, ok := hdrs[0].(*sip.MaxForwards); ok && *maxForwards == 0 {
+			tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 483, "Too Many Hops", ""))
+			return
+		}
+	}
+
+	if relay.Available() {
+		response, err := b.forwardRegister(ctx, request)
+		if err == nil {
+			b.upstreamUp()
+			if response.IsSuccess() { // 缓存上游已接受的注册，有效期以上游授予的为准
+				if _, _, err := b.updateRegistry(request, aor, upstreamGrant(response)); err != nil {
+					logger.Warnf("Upstream accepted REGISTER for %v, not cached: %v", aor, err)
+				}
+			}
+			tx.Respond(relayResponse(request, response))
+			return
+		}
+		logger.Warnf("Upstream registrar unavailable, registering %v locally: %v", aor, err)
+		b.upstreamDown(err)
+	}
+
+	// 生存模式：已在本地缓存的终端直接续约，其它终端使用本地账户认证
+	if !b.isRegistered(aor, request.Source()) && b.authenticator != nil && !b.mutuallyAuthenticated(request) &&
+		b.requestConfig(request).Auth.Value != AuthNone {
+		if _, ok := b.authenticator.Authenticate(request, tx); !ok {
+			return
+		}
+	}
+	b.registerLocally(request, tx, aor)
+}
+
+// upstreamGrant 返回上游在 200 OK 中授予联系地址的有效期，响应没有携带时按请求的值
+func upstreamGrant(response sip.Response) func(*registry2.ContactInstance) sip.Expires {
+	return func(instance *registry2.ContactInstance) sip.Expires {
+		if expires, ok := registry2.GrantedExpires(response, instance.Contact); ok {
+			return expires
+		}
+		return sip.Expires(instance.RegExpires)
+	}
+}
+
+// forwardRegister 以边缘代理身份将 REGISTER 发送到上游，返回上游的最终响应
+func (b *B2BUA) forwardRegister(ctx context.Context, request sip.Request) (sip.Response, error) {
+	transport := b.registerRelay.transport()
+
+	req := sip.CopyRequest(request)
+	if hdrs := req.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if maxForwards, ok := hdrs[0].(*sip.MaxForwards); ok {
+			*maxForwards--
+		}
+	}
+	local := b.stack.GetNetworkInfo(transport)
+	req.PrependHeader(&sip.GenericHeader{
+		HeaderName: "Path",
+		Contents:   fmt.Sprintf("<sip:%s;transport=%s;lr>", local.Addr(), strings.ToLower(transport)),
+	})
+	req.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       transport,
+		Params: sip.NewParams().
+			Add("rport", nil).
+			Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}})
+	return b.sendUpstream(ctx, req)
+}
+
+// sendUpstream 将请求发送到上游并等待最终响应，超时或 ctx 取消时返回错误
+func (b *B2BUA) sendUpstream(ctx context.Context, req sip.Request) (sip.Response, error) {
+	relay := b.registerRelay
+	return b.sendRequest(ctx, req, relay.transport(), relay.destination(), relay.config.Timeout)
+}
+
+// sendRequest 将请求经 transport 发往 destination（host:port）并等待最终响应，timeout 秒内没有最终响应或
+// ctx 取消时返回错误
+func (b *B2BUA) sendRequest(ctx context.Context, req sip.Request, transport, destination string, timeout int) (sip.Response, error) {
+	req.SetSource("")
+	req.SetTransport(transport)
+	req.SetDestination(destination)
+
+	clientTx, err := b.stack.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { // 丢弃事务后续的重传响应和错误
+		go func() {
+			for {
+				select {
+				case <-clientTx.Done():
+					return
+				case <-clientTx.Errors():
+				case <-clientTx.Responses():
+				}
+			}
+		}()
+	}()
+
+	deadline, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+	for {
+		select {
+		case <-deadline.Done():
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("no final response from %s within %ds", destination, timeout)
+		case err, ok := <-clientTx.Errors():
+			if !ok {
+				return nil, fmt.Errorf("transaction terminated")
+			}
+			return nil, err
+		case response, ok := <-clientTx.Responses():
+			if !ok {
+				return nil, fmt.Errorf("transaction terminated")
+			}
+			if response.IsProvisional() {
+				continue
+			}
+			return response, nil
+		}
+	}
+}
+
+// relayResponse 根据上游响应构造返回给终端的响应
+func relayResponse(request sip.Request, upstream sip.Response) sip.Response {
+	resp := sip.NewResponseFromRequest(request.MessageID(), request, upstream.StatusCode(), upstream.Reason(), upstream.Body())
+	for _, name := range relayedResponseHeaders {
+		sip.CopyHeaders(name, upstream, resp)
+	}
+	return resp
+}
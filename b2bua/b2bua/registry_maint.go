@@ -0,0 +1,151 @@
+package b2bua
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+// initRegistryBackend 初始化注册表持久化后端，并从快照恢复注册信息
+func (b *B2BUA) initRegistryBackend(path string) {
+	if path == "" {
+		return
+	}
+	b.registryBackend = registry2.NewFileBackend(path)
+	b.persistCh = make(chan struct{}, 1)
+
+	if report, err := b.ReconcileRegistry(); err != nil {
+		logger.Errorf("Restore registry from %s failed: %v", path, err)
+	} else {
+		logger.Infof("Registry restored from %s: %+v", path, report)
+	}
+
+	go func() {
+		for range b.persistCh {
+			if err := b.registryBackend.Save(b.registry.Snapshot()); err != nil {
+				logger.Errorf("Save registry snapshot failed: %v", err)
+			}
+		}
+	}()
+}
+
+// persistRegistry 异步保存注册表快照，多次调用会被合并
+func (b *B2BUA) persistRegistry() {
+	if b.persistCh == nil {
+		return
+	}
+	select {
+	case b.persistCh <- struct{}{}:
+	default: // 已有待保存的请求
+	}
+}
+
+// ErrNoRegistryBackend 未配置注册表快照，无法重建或对账
+var ErrNoRegistryBackend = errors.New("registry backend not configured")
+
+// FlushRegistry 清空内存中的注册表（不修改持久化快照），之后可通过 ReloadRegistry 重建
+func (b *B2BUA) FlushRegistry() {
+	b.registry.Flush()
+	logger.Infof("Registry flushed")
+}
+
+// ReloadRegistry 清空内存中的注册表，并从持久化快照重建
+func (b *B2BUA) ReloadRegistry() (registry2.ReconcileReport, error) {
+	if b.registryBackend == nil {
+		return registry2.ReconcileReport{}, ErrNoRegistryBackend
+	}
+	records, err := b.registryBackend.Load()
+	if err != nil {
+		return registry2.ReconcileReport{}, err
+	}
+	b.registry.Flush()
+	report := registry2.Reconcile(b.registry, records, time.Now())
+	logger.Infof("Registry reloaded: %+v", report)
+	return report, nil
+}
+
+// ReconcileRegistry 将内存注册表与持久化快照对账，并保存对账后的结果
+func (b *B2BUA) ReconcileRegistry() (registry2.ReconcileReport, error) {
+	if b.registryBackend == nil {
+		return registry2.ReconcileReport{}, ErrNoRegistryBackend
+	}
+	records, err := b.registryBackend.Load()
+	if err != nil {
+		return registry2.ReconcileReport{}, err
+	}
+	report := registry2.Reconcile(b.registry, records, time.Now())
+	if err := b.registryBackend.Save(b.registry.Snapshot()); err != nil {
+		return report, err
+	}
+	logger.Infof("Registry reconciled: %+v", report)
+	return report, nil
+}
+
+// ErrNotRegistered AOR 没有注册的联系地址
+var ErrNotRegistered = errors.New("aor not registered")
+
+// ParseAOR 将 user、user@host 或 SIP URI 解析为注册表中的 AOR，只有用户名时使用默认域名
+func (b *B2BUA) ParseAOR(aor string) (sip.Uri, error) {
+	if !strings.Contains(aor, ":") {
+		if !strings.Contains(aor, "@") {
+			domain := b.config.Domain
+			if domain == "" {
+				domain = b.stack.GetNetworkInfo("udp").Host
+			}
+			aor += "@" + domain
+		}
+		aor = "sip:" + aor
+	}
+	uri, err := parser.ParseSipUri(aor)
+	if err != nil {
+		return nil, err
+	}
+	return b.registryAOR(&uri), nil
+}
+
+// Contacts 返回 AOR 注册的所有联系地址，按 q 值从高到低排列
+func (b *B2BUA) Contacts(aor sip.Uri) []*registry2.ContactInstance {
+	contacts, found := b.registry.GetContacts(b.registryAOR(aor))
+	if !found {
+		return nil
+	}
+	var instances []*registry2.ContactInstance
+	for _, group := range registry2.ForkOrder(*contacts) {
+		instances = append(instances, group...)
+	}
+	return instances
+}
+
+// Unregister 注销 AOR 的所有联系地址（与 Contact: * 的效果相同），用于清除失效的绑定，返回注销的联系地址数
+func (b *B2BUA) Unregister(aor sip.Uri) (int, error) {
+	aor = b.registryAOR(aor)
+	contacts, found := b.registry.GetContacts(aor)
+	if !found || len(*contacts) == 0 {
+		return 0, ErrNotRegistered
+	}
+	removed := len(*contacts)
+	for _, instance := range *contacts {
+		b.emitRegistration(EventUnregistered, aor, instance)
+	}
+	b.registry.RemoveAor(aor)
+	b.persistRegistry()
+	b.regChanged(aor)
+	logger.Infof("Unregistered %d contacts of %v by administrator", removed, aor)
+	return removed, nil
+}
+
+// FlushRegistrations 注销所有 AOR 的联系地址并保存快照。与 FlushRegistry 不同，注销会产生事件、通知 reg
+// 事件的订阅者，且不能从快照恢复。返回注销的联系地址数
+func (b *B2BUA) FlushRegistrations() int {
+	removed := 0
+	for aor := range b.registry.GetAllContacts() {
+		if n, err := b.Unregister(aor); err == nil {
+			removed += n
+		}
+	}
+	return removed
+}
@@ -0,0 +1,66 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// handleReInvite 将一路的 re-INVITE 转发到另一路，用另一路的应答回复。没有 SDP 的 re-INVITE
+// （会话刷新）直接用当前的 SDP 应答
+func (b *B2BUA) handleReInvite(sess *session.Session, req sip.Request) {
+	call := b.findCall(sess)
+	offer := session.SdpBody(req)
+	if call == nil || offer == "" {
+		sess.AnswerReInvite(sess.LocalSdp())
+		return
+	}
+	from := media.LegA
+	if call.dest == sess {
+		from = media.LegB
+	}
+	peer := b.peerSession(call, from)
+	if peer == nil || peer.Status() != session.Confirmed { // 另一路尚未建立
+		sess.RejectReInvite(491, "Request Pending")
+		return
+	}
+
+	t38 := media.IsT38(offer)
+	if t38 && !b.acceptT38(call, from) {
+		sess.RejectReInvite(488, "Not Acceptable Here", b.warning(305, "T.38 not supported"))
+		return
+	}
+
+	relayed, hold := b.holdOffer(call, offer, b.relaySDP(call, from, offer))
+	go func() {
+		resp, err := peer.ReInviteWithContext(call.ctx, relayed)
+		if err != nil {
+			code, reason := sip.StatusCode(500), "Server Internal Error"
+			if reqErr, ok := err.(*sip.RequestError); ok {
+				code, reason = sip.StatusCode(reqErr.Code), reqErr.Reason
+			}
+			call.Log().Warnf("re-INVITE to %s-Leg failed: %v", from.Other(), err)
+			if t38 {
+				b.faxFallback(call, from.Other(), code)
+			}
+			sess.RejectReInvite(code, reason)
+			return
+		}
+		answer := session.SdpBody(resp)
+		relayed := b.relaySDP(call, from.Other(), answer)
+		b.setHeld(call, media.IsHold(offer))
+		if hold { // 保持：向另一路播放保持音乐
+			relayed = b.holdAnswer(call, offer, relayed)
+			b.startMusicOnHold(call, from.Other())
+		} else {
+			b.stopMusicOnHold(call, from.Other())
+		}
+		sess.AnswerReInvite(relayed)
+		if !hold && !media.IsHold(offer) { // 恢复通话或媒体变化后画面需要关键帧
+			b.refreshVideo(call, "reinvite")
+		}
+		if t38 && media.IsT38(answer) {
+			b.faxDetected(call, from, "t38")
+		}
+	}()
+}
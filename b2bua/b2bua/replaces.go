@@ -0,0 +1,206 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// replacesTarget Replaces 头域（RFC 3891）标识的对话，to-tag 为本端的 tag
+type replacesTarget struct {
+	callID    string
+	toTag     string
+	fromTag   string
+	earlyOnly bool // 只替换早期对话
+}
+
+// parseReplaces 解析 Replaces 头域的值，如 "abc@host;to-tag=x;from-tag=y"
+func parseReplaces(value string) (replacesTarget, bool) {
+	parts := strings.Split(value, ";")
+	target := replacesTarget{callID: strings.TrimSpace(parts[0])}
+	for _, param := range parts[1:] {
+		name, val := strings.TrimSpace(param), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, val = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		switch strings.ToLower(name) {
+		case "to-tag":
+			target.toTag = val
+		case "from-tag":
+			target.fromTag = val
+		case "early-only":
+			target.earlyOnly = true
+		}
+	}
+	return target, target.callID != "" && target.toTag != "" && target.fromTag != ""
+}
+
+// findDialog 查找 Replaces 标识的对话所在的呼叫及其会话（A 路或 B 路）
+func (b *B2BUA) findDialog(target replacesTarget) (*B2BCall, *session.Session) {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		for _, sess := range []*session.Session{call.src, call.dest} {
+			if sess == nil {
+				continue
+			}
+			callID, localTag, remoteTag := sess.DialogID()
+			if callID == target.callID && localTag == target.toTag && remoteTag == target.fromTag {
+				return call, sess
+			}
+		}
+	}
+	return nil, nil
+}
+
+// replaceDialog 处理带 Replaces 的 INVITE（咨询转接的完成）：新的一路取代已建立呼叫中的一路，
+// 与被取代一路的对端接通，随后挂断被取代的一路。发送方须有权取代该呼叫（见 authorizeReplaces）。
+// 经过媒体中继时新的一路复用被取代一路的中继端口，否则向对端发送 re-INVITE。不带 Replaces 时返回 false
+func (b *B2BUA) replaceDialog(sess *session.Session, req sip.Request) bool {
+	hdrs := req.GetHeaders("Replaces")
+	if len(hdrs) == 0 {
+		return false
+	}
+	target, ok := parseReplaces(hdrs[0].Value())
+	if !ok {
+		sess.Reject(400, "Bad Request", b.warning(399, "invalid Replaces header"))
+		return true
+	}
+	call, replaced := b.findDialog(target)
+	if replaced == nil || replaced.Status() != session.Confirmed { // 只替换已建立的对话
+		sess.Reject(481, "Call/Transaction Does Not Exist")
+		return true
+	}
+	if target.earlyOnly {
+		sess.Reject(486, "Busy Here")
+		return true
+	}
+	if !b.authorizeReplaces(call, req) {
+		sess.Reject(403, "Forbidden", b.warning(399, "not a party to the replaced call"))
+		return true
+	}
+	leg := media.LegA
+	if replaced != call.src {
+		leg = media.LegB
+	}
+	peer := b.peerSession(call, leg)
+	offer := session.SdpBody(req)
+	if peer == nil || peer.Status() != session.Confirmed {
+		sess.Reject(481, "Call/Transaction Does Not Exist")
+		return true
+	}
+	if offer == "" { // 不支持不带 SDP 的 INVITE
+		sess.Reject(488, "Not Acceptable Here", b.warning(399, "offer required"))
+		return true
+	}
+
+	from, _ := req.From()
+	call.Log().Infof("%s-Leg replaced by %v", leg, from.Address)
+	go func() {
+		var answer string
+		if b.anchored(call) {
+			b.relaySDP(call, leg, offer) // 中继的该路端点改为新的一路，对端不变
+			answer = replaced.LocalSdp()
+		} else {
+			resp, err := peer.ReInviteWithContext(call.ctx, b.relaySDP(call, leg, offer))
+			if err != nil {
+				call.Log().Warnf("re-INVITE to %s-Leg for Replaces failed: %v", leg.Other(), err)
+				code, reason := sip.StatusCode(500), "Server Internal Error"
+				if reqErr, ok := err.(*sip.RequestError); ok {
+					code, reason = sip.StatusCode(reqErr.Code), reqErr.Reason
+				}
+				sess.Reject(code, reason)
+				return
+			}
+			answer = b.relaySDP(call, leg.Other(), session.SdpBody(resp))
+		}
+		b.replaceSession(replaced, sess)
+		call.Context.Set("replaced_by", fmt.Sprintf("%v", from.Address))
+		sess.ProvideAnswer(answer)
+		sess.Accept(200)
+		replaced.End()
+	}()
+	return true
+}
+
+// authorizeReplaces 检查带 Replaces 的 INVITE 的发送方能否取代呼叫：发送方是按来源确认、且承载呼叫一路的中继
+// （转接在中继侧完成），或认证的账户是呼叫的一方，或 Referred-By 指明的转接方是呼叫的一方、且正与发送方通话
+// （转接方在该通话中发出了 REFER）
+func (b *B2BUA) authorizeReplaces(call *B2BCall, req sip.Request) bool {
+	if trunk := b.sourceTrunk(req); trunk != nil {
+		return b.trunkParty(call, trunk)
+	}
+	user := b.authenticatedUser(req)
+	if user == "" {
+		return false
+	}
+	if b.callParty(call, user) {
+		return true
+	}
+	hdrs := req.GetHeaders("Referred-By")
+	if len(hdrs) == 0 {
+		return false
+	}
+	_, uri, _, err := parser.ParseAddressValue(hdrs[0].Value())
+	if err != nil || uri.User() == nil {
+		return false
+	}
+	transferor := uri.User().String()
+	if !b.callParty(call, transferor) {
+		return false
+	}
+	for _, other := range b.Calls() {
+		if other.ID != call.ID && b.callParty(other, user) && b.callParty(other, transferor) {
+			return true
+		}
+	}
+	return false
+}
+
+// trunkParty 检查呼叫是否有一路经过中继：A 路来自该中继，或某一分支经该中继呼出
+func (b *B2BUA) trunkParty(call *B2BCall, trunk *TrunkConfig) bool {
+	if call.src != nil {
+		if source := b.sourceTrunk(call.src.Request()); source != nil && source.Name == trunk.Name {
+			return true
+		}
+	}
+	for _, leg := range b.callLegs(call.ID) {
+		if leg.trunk != nil && leg.trunk.Name == trunk.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// callParty 检查账户是否为呼叫的一方：主叫、被叫或某一分支呼叫的本地账户
+func (b *B2BUA) callParty(call *B2BCall, user string) bool {
+	for _, party := range call.users {
+		if strings.SplitN(party, "@", 2)[0] == user {
+			return true
+		}
+	}
+	for _, leg := range b.callLegs(call.ID) {
+		if leg.dialed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceSession 在呼叫的所有分支中用新的会话取代被替换的会话
+func (b *B2BUA) replaceSession(replaced, sess *session.Session) {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	for _, call := range b.calls {
+		if call.src == replaced {
+			call.src = sess
+		}
+		if call.dest == replaced {
+			call.dest = sess
+		}
+	}
+}
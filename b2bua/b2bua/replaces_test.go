@@ -0,0 +1,73 @@
+package b2bua
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// TestAuthorizeReplaces checks who may replace a call: a party to it, the transferor named in Referred-By
+// when it is talking to the sender, or a confirmed trunk carrying one of its legs.
+func TestAuthorizeReplaces(t *testing.T) {
+	config := &B2BUAConfig{Trunks: []TrunkConfig{{
+		Name:    "carrier",
+		Domains: []string{"carrier.example.net"},
+		ACL:     ACLConfig{Allow: []string{"203.0.113.0/24"}},
+	}}}
+	acl, err := newACLFilter(nil, nil, config.Trunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &B2BUA{config: config, aclFilter: acl}
+
+	var sent []sip.Request
+	replaced := &B2BCall{ID: "replaced", users: []string{"100@example.com", "200@example.com"}, src: testLeg(t, "200", session.Confirmed, &sent)}
+	consult := &B2BCall{ID: "consult", users: []string{"200@example.com", "300@example.com"}, src: testLeg(t, "300", session.Confirmed, &sent)}
+	b.addCall(replaced)
+	b.addCall(consult)
+	trunked := *replaced
+	trunked.ID, trunked.trunk = "trunked", &config.Trunks[0]
+	b.addCall(&trunked)
+
+	invite := func(source, from, user, referredBy string) sip.Request {
+		lines := []string{
+			"INVITE sip:100@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + source + ";branch=z9hG4bK-replaces",
+			"From: <sip:" + from + ">;tag=replacing",
+			"To: <sip:100@example.com>",
+			"Call-ID: replacing@example.com",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:" + from + ">",
+			"Replaces: replaced@example.com;to-tag=a;from-tag=b",
+		}
+		if user != "" {
+			lines = append(lines, `Authorization: Digest username="`+user+`", realm="example.com", nonce="n", uri="sip:100@example.com", response="r"`)
+		}
+		if referredBy != "" {
+			lines = append(lines, "Referred-By: <sip:"+referredBy+"@example.com>")
+		}
+		return parseRequest(t, source, "udp", append(lines, "Content-Length: 0")...)
+	}
+
+	tests := []struct {
+		name string
+		call *B2BCall
+		req  sip.Request
+		want bool
+	}{
+		{"party", replaced, invite("192.168.1.10:5060", "100@example.com", "100", ""), true},
+		{"transferor", replaced, invite("192.168.1.30:5060", "300@example.com", "300", "200"), true},
+		{"transferor not talking to sender", replaced, invite("192.168.1.40:5060", "400@example.com", "400", "200"), false},
+		{"stranger", replaced, invite("192.168.1.40:5060", "400@example.com", "400", ""), false},
+		{"unauthenticated", replaced, invite("192.168.1.10:5060", "100@example.com", "", ""), false},
+		{"trunk", &trunked, invite("203.0.113.5:5060", "0123@carrier.example.net", "", ""), true},
+		{"trunk not on the call", replaced, invite("203.0.113.5:5060", "0123@carrier.example.net", "", ""), false},
+		{"trunk domain from another source", &trunked, invite("198.51.100.5:5060", "0123@carrier.example.net", "", ""), false},
+	}
+	for _, tt := range tests {
+		if got := b.authorizeReplaces(tt.call, tt.req); got != tt.want {
+			t.Errorf("%s: authorizeReplaces() = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
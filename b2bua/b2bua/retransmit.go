@@ -0,0 +1,24 @@
+package b2bua
+
+import (
+	"time"
+
+	"go-sip-ua/pkg/session"
+)
+
+// RetransmissionConfig UDP 上呼入 INVITE 的 200 OK 重传配置（RFC 3261 13.3.1.4）。
+// 200 OK 按 T1 起、每次加倍、不超过 T2 的间隔重传，直到收到 ACK；超时未收到 ACK 时发送 BYE 结束通话。
+// BYE 等其它请求的重传由事务层处理
+type RetransmissionConfig struct {
+	T1         int `json:"t1"`          // 首次重传间隔（毫秒），默认 500
+	T2         int `json:"t2"`          // 最大重传间隔（毫秒），默认 4000
+	ACKTimeout int `json:"ack_timeout"` // 等待 ACK 的时间（秒），默认 64*T1
+}
+
+func (c RetransmissionConfig) session() session.Retransmission {
+	return session.Retransmission{
+		T1:         time.Duration(c.T1) * time.Millisecond,
+		T2:         time.Duration(c.T2) * time.Millisecond,
+		ACKTimeout: time.Duration(c.ACKTimeout) * time.Second,
+	}
+}
@@ -0,0 +1,105 @@
+package b2bua
+
+import (
+	"time"
+
+	"go-sip-ua/pkg/session"
+)
+
+// RingTimeoutConfig 振铃超时配置：B 路超时未应答时取消（CANCEL），依次尝试下一个备用地址、被叫的无应答前转
+// 或语音信箱，都没有时以 480 拒绝 A 路
+type RingTimeoutConfig struct {
+	Default   int    `json:"default"`   // 默认振铃超时（秒），0 表示不限制；中继的 ring_timeout 和账户的 no_answer_timeout 优先
+	Voicemail string `json:"voicemail"` // 语音信箱的号码或 SIP URI，本地被叫振铃超时且未设置无应答前转时前转到此，为空时不使用
+}
+
+// accountRingTimeout 返回本地账户的振铃超时：账户的 no_answer_timeout，未设置时设置了无应答前转为 20 秒，
+// 否则使用全局默认值。返回 0 表示不限制
+func (b *B2BUA) accountRingTimeout(user string) time.Duration {
+	features := b.Features(user)
+	switch {
+	case features.NoAnswerTimeout > 0:
+		return time.Duration(features.NoAnswerTimeout) * time.Second
+	case features.ForwardNoAnswer != "":
+		return defaultNoAnswerTimeout * time.Second
+	}
+	return time.Duration(b.config.RingTimeout.Default) * time.Second
+}
+
+// watchNoAnswer 本地被叫振铃超时后取消呼叫该账户的所有分支，前转到无应答前转目的地或语音信箱，
+// 都没有时以 480 拒绝 A 路
+func (b *B2BUA) watchNoAnswer(call *B2BCall, user string) {
+	timeout := b.accountRingTimeout(user)
+	if timeout <= 0 {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		if !call.Context.answeredAt().IsZero() || !call.src.IsInProgress() {
+			return
+		}
+		legs := b.ringingLegs(call, user)
+		if len(legs) == 0 { // 已前转或已失败
+			return
+		}
+		call.Log().Infof("Ring timeout: %s did not answer within %v", user, timeout)
+		b.metrics.Inc(MetricRingTimeout + "account")
+		forward := *legs[0]
+		called := calledURI(&forward)
+		next := b.divert(&forward, user, called, ForwardNoAnswer)
+		if next == nil && b.config.RingTimeout.Voicemail != "" {
+			next = b.divertTo(&forward, user, called, ForwardNoAnswer, b.config.RingTimeout.Voicemail)
+		}
+		if next != nil {
+			b.routeCall(&forward, next)
+		} else {
+			b.ringTimedOut(call)
+		}
+		for _, leg := range legs {
+			leg.dest.End()
+		}
+	})
+}
+
+// watchRouteTimeout 出局分支振铃超时后取消，改用下一个备用地址；没有可用的备用地址时以 480 拒绝 A 路。
+// 本地被叫的分支由 watchNoAnswer 按账户处理
+func (b *B2BUA) watchRouteTimeout(leg *B2BCall, target routeTarget) {
+	if target.local {
+		return
+	}
+	timeout := time.Duration(b.config.RingTimeout.Default) * time.Second
+	if target.trunk != nil && target.trunk.RingTimeout > 0 {
+		timeout = time.Duration(target.trunk.RingTimeout) * time.Second
+	}
+	if timeout <= 0 {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		if !leg.Context.answeredAt().IsZero() || !leg.dest.IsInProgress() || !leg.src.IsInProgress() {
+			return
+		}
+		leg.Log().Infof("Ring timeout: %v did not answer within %v", target, timeout)
+		b.metrics.Inc(MetricRingTimeout + "route")
+		if !b.nextTarget(leg) {
+			b.ringTimedOut(leg)
+		}
+		leg.dest.End()
+	})
+}
+
+// nextTarget 向分支的下一个可用备用地址发起呼叫，成功发起时返回 true
+func (b *B2BUA) nextTarget(leg *B2BCall) bool {
+	for i, target := range leg.failover {
+		if b.inviteLeg(leg, target, leg.failover[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ringTimedOut 振铃超时且没有其它目的地时以 480 拒绝 A 路。A 路标记为失败，随后取消的 B 路不再结束 A 路
+func (b *B2BUA) ringTimedOut(call *B2BCall) {
+	call.Context.Set("ring_timeout", "true")
+	call.Context.release(CauseTimeout, 0)
+	call.src.Reject(480, "Temporarily Unavailable", b.warning(399, "ring timeout"))
+	call.src.SetState(session.Failure)
+}
@@ -0,0 +1,372 @@
+package b2bua
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	registry2 "go-sip-ua/b2bua/registry"
+	"go-sip-ua/pkg/account"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+	"go-sip-ua/pkg/stack"
+)
+
+// DNSConfig 出局路由的 DNS 解析配置
+type DNSConfig struct {
+	Server  string `json:"server"`  // DNS 服务器地址，为空时使用系统配置（/etc/resolv.conf）
+	Timeout int    `json:"timeout"` // 查询超时（秒）
+}
+
+func newResolver(config DNSConfig) *stack.Resolver {
+	return stack.NewResolver(config.Server, time.Duration(config.Timeout)*time.Second)
+}
+
+// routeTarget 一个出局目的地：Request-URI，以及经出局代理发送时的代理地址
+type routeTarget struct {
+	recipient sip.SipUri
+	proxy     *sip.SipUri       // 出局代理，作为 Route 头域加入请求；为 nil 时直接发往 recipient
+	trunk     *TrunkConfig      // 出局中继，为 nil 时不经中继
+	local     bool              // 被叫为本地注册的终端（内部呼叫）
+	profile   *SIPProfileConfig // 发出 B 路的 SIP profile，为 nil 时使用全局监听
+}
+
+func (t routeTarget) String() string {
+	if t.proxy != nil {
+		return t.recipient.String() + " via " + t.proxy.String()
+	}
+	return t.recipient.String()
+}
+
+// parseOutboundProxy 解析出局代理地址，补充 lr 参数（松散路由）
+func parseOutboundProxy(proxy string) (*sip.SipUri, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	uri, err := parser.ParseSipUri(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy %q: %w", proxy, err)
+	}
+	if uri.FUriParams == nil {
+		uri.FUriParams = sip.NewParams()
+	}
+	if !uri.FUriParams.Has("lr") {
+		uri.FUriParams.Add("lr", nil)
+	}
+	return &uri, nil
+}
+
+// resolveRoute 通过 NAPTR/SRV/A 记录解析出局目的地，返回按优先级排列的候选地址；
+// 解析失败时返回原地址，由传输层解析
+func (b *B2BUA) resolveRoute(call *B2BCall, recipient sip.SipUri) []sip.SipUri {
+	targets, err := b.resolver.Resolve(call.ctx, recipient)
+	if err != nil || len(targets) == 0 {
+		call.Log().Warnf("Resolve %v failed: %v", recipient.String(), err)
+		return []sip.SipUri{recipient}
+	}
+	return targets
+}
+
+// routeCall 将呼叫路由到被叫：本地注册的被叫按 q 值向联系地址分叉，否则按号码前缀经中继或发往上游。
+// 没有路由时拒绝 A 路
+func (b *B2BUA) routeCall(call *B2BCall, called sip.Uri) {
+	sess, req := call.src, call.src.Request()
+	if contacts, found := b.registry.GetContacts(b.registryAOR(routingURI(called))); found { // 查找被叫方的注册信息
+		b.classifyCall(call, req, true)
+		b.trying(call)
+		call.dialed = called.User().String()
+		bridged := false
+		nodes := make(map[string]bool)
+		var forks [][]routeTarget
+		for _, group := range registry2.ForkOrder(*contacts) {
+			var targets []routeTarget
+			for _, instance := range group {
+				profile := b.contactProfile(instance) // 从终端注册时所经的 profile 发出
+				if !b.bridges(call, profile) {
+					continue
+				}
+				bridged = true
+				recipient, ok := b.contactRecipient(call, called.User().String(), instance, nodes)
+				if !ok {
+					continue
+				}
+				targets = append(targets, routeTarget{recipient: recipient, local: true, profile: profile})
+			}
+			if len(targets) > 0 {
+				forks = append(forks, targets)
+			}
+		}
+		if !bridged { // 所有联系地址都在不允许桥接的 profile 上
+			b.rejectBridge(call)
+			return
+		}
+		if len(forks) == 0 { // 其它节点转发来的呼叫，被叫不在本节点注册
+			sess.Reject(480, "Temporarily Unavailable")
+			b.finishCall(call, session.Failure)
+			return
+		}
+		b.fork(call, forks)
+		b.watchNoAnswer(call, call.dialed)
+		return
+	}
+
+	if b.dispatcher != nil { // 负载分发模式
+		b.dispatch(call, called)
+		return
+	}
+
+	recipient, proxy, trunk := b.routeTrunk(called) // 按号码前缀经中继出局
+	if recipient == nil {
+		recipient, proxy = b.routeUpstream(called), b.outboundProxy // 本地未注册的被叫发往上游或紧急网关
+	}
+	if recipient != nil {
+		if b.exceedsHops(call, trunk) {
+			sess.Reject(483, "Too Many Hops", b.warning(399, "transit hop limit"))
+			b.finishCall(call, session.Failure)
+			return
+		}
+		if !b.bridges(call, b.trunkProfile(trunk)) {
+			b.rejectBridge(call)
+			return
+		}
+		b.classifyCall(call, req, false)
+		b.trying(call)
+		call.dialed = ""
+		targets := b.routeTargets(call, *recipient, proxy, trunk)
+		if trunk != nil { // 有 ENUM 记录时先经 SIP 直接呼叫，失败时切换到中继
+			targets = append(b.enumTargets(call, called, trunk), targets...)
+		}
+		if !b.dialTargets(call, targets) {
+			sess.Reject(503, "Service Unavailable", b.warning(399, "no reachable route"))
+			b.finishCall(call, session.Failure)
+		}
+		return
+	}
+	if b.SurvivalMode() { // 生存模式下上游不可达
+		sess.Reject(503, "Upstream Unavailable", b.warning(399, "survivability mode"))
+		b.finishCall(call, session.Failure)
+		return
+	}
+
+	sess.Reject(404, fmt.Sprintf("%v Not found", called)) // 如果未找到被叫方，返回 404
+	b.finishCall(call, session.Failure)
+}
+
+// inviteAccount 向本地账户 aor 注册的所有联系地址同时分叉（按 q 值从高到低发出），B 路的被叫为该账户，
+// 用于队列坐席和振铃组成员。至少发起了一个分支时返回 true
+func (b *B2BUA) inviteAccount(call *B2BCall, aor sip.Uri) bool {
+	contacts, found := b.registry.GetContacts(b.registryAOR(aor))
+	if !found || aor.User() == nil {
+		return false
+	}
+	user := aor.User().String()
+	leg := *call
+	leg.called = aor
+	leg.dialed = user
+	invited := false
+	nodes := make(map[string]bool)
+	for _, group := range registry2.ForkOrder(*contacts) {
+		for _, instance := range group {
+			profile := b.contactProfile(instance)
+			if !b.bridges(call, profile) {
+				continue
+			}
+			recipient, ok := b.contactRecipient(call, user, instance, nodes)
+			if !ok {
+				continue
+			}
+			if b.inviteLeg(&leg, routeTarget{recipient: recipient, local: true, profile: profile}, nil) {
+				invited = true
+			}
+		}
+	}
+	return invited
+}
+
+// fork 并行呼叫第一组能发起呼叫的联系地址，q 值较低的其余各组记录在分支上，由 nextFork 依次呼叫。
+// 至少发起了一个分支时返回 true
+func (b *B2BUA) fork(call *B2BCall, forks [][]routeTarget) bool {
+	for i, group := range forks {
+		leg := *call
+		leg.forks = forks[i+1:]
+		invited := false
+		for _, target := range group {
+			if b.inviteLeg(&leg, target, nil) {
+				invited = true
+			}
+		}
+		if invited {
+			return true
+		}
+	}
+	return false
+}
+
+// nextFork 本组联系地址的分支全部失败后并行呼叫 q 值较低的下一组，收到 6xx 时不再尝试其它联系地址。
+// 成功发起时返回 true
+func (b *B2BUA) nextFork(call *B2BCall, resp *sip.Response) bool {
+	code := finalCode(resp)
+	if len(call.forks) == 0 || code >= 600 || !call.src.IsInProgress() || b.hasOtherLegs(call) {
+		return false
+	}
+	call.Log().Infof("Contacts failed with %d, forking to %d contact(s) with lower q-value", code, len(call.forks[0]))
+	return b.fork(call, call.forks)
+}
+
+// trying 首次路由时向 A 路发送 100 Trying，前转时已发送过 181
+func (b *B2BUA) trying(call *B2BCall) {
+	if len(call.diversion) == 0 {
+		call.src.Provisional(100, "Trying")
+	}
+}
+
+// dialRoute 向出局目的地发起呼叫。配置了出局代理时解析代理地址，否则解析目的地本身，
+// 向第一个可用地址发起呼叫，其余地址用于失败切换
+func (b *B2BUA) dialRoute(call *B2BCall, recipient sip.SipUri, proxy *sip.SipUri, trunk *TrunkConfig) bool {
+	return b.dialTargets(call, b.routeTargets(call, recipient, proxy, trunk))
+}
+
+// routeTargets 解析出局目的地的候选地址：配置了出局代理时解析代理地址，否则解析目的地本身
+func (b *B2BUA) routeTargets(call *B2BCall, recipient sip.SipUri, proxy *sip.SipUri, trunk *TrunkConfig) []routeTarget {
+	var targets []routeTarget
+	profile := b.trunkProfile(trunk)
+	if proxy != nil {
+		for _, hop := range b.resolveRoute(call, *proxy) {
+			hop := hop
+			targets = append(targets, routeTarget{recipient: recipient, proxy: &hop, trunk: trunk, profile: profile})
+		}
+	} else {
+		for _, hop := range b.resolveRoute(call, recipient) {
+			targets = append(targets, routeTarget{recipient: hop, trunk: trunk, profile: profile})
+		}
+	}
+	return targets
+}
+
+// dialTargets 向第一个可用的候选地址发起呼叫，其余地址用于失败切换
+func (b *B2BUA) dialTargets(call *B2BCall, targets []routeTarget) bool {
+	for i, target := range targets {
+		if b.inviteLeg(call, target, targets[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// inviteLeg 向 target 发起 B 路呼叫，failover 为该分支失败后依次尝试的备用地址
+func (b *B2BUA) inviteLeg(call *B2BCall, target routeTarget, failover []routeTarget) bool {
+	request := call.src.Request()
+	to, _ := request.To()
+	callee := to.Address
+	if call.called != nil { // 已前转
+		callee = call.called
+	}
+	displayName := b.callerName(call, target)
+
+	from, _ := callerAddress(call)
+	caller := b.topology.hideURI(from, b.stack.GetNetworkInfo("udp").Host)
+	caller, displayName = b.rewriteCallerID(call, target, caller, displayName)
+	caller, displayName = b.privateCaller(call, target, caller, displayName)
+	profile := account.NewProfile(caller, displayName, nil, 0, b.stack)
+	if target.proxy != nil { // 经出局代理发送
+		profile.Routes = []sip.Uri{target.proxy}
+	}
+	b.secureTarget(call, target)
+	offer := call.offer
+	if offer == "" {
+		sdp := call.src.RemoteSdp()
+		if call.answer != "" { // A 路已在本地应答，只提供协商好的编解码
+			if restricted, err := media.RestrictOffer(sdp, call.answer); err == nil {
+				sdp = restricted
+			}
+		}
+		offer = b.relaySDP(call, media.LegA, b.applySDPPolicy(call, target, sdp))
+		offer = b.addTranscodingCodecs(call, offer)
+	}
+	recipient := withURIParams(target.recipient, bridgedURIParams(request)) // 保留 user=phone 等参数
+	emergency := b.isEmergency(callee)
+	parts := b.bodyParts(call, target, emergency)
+	headers := b.profileHeaders(call, target)
+	if emergency { // 紧急呼叫携带位置信息
+		var location []sip.Header
+		parts, location = b.emergencyLocation(call, target, parts)
+		headers = append(headers, location...)
+	}
+	headers = b.identityHeaders(call, target, headers)
+	headers = b.hopHeaders(call, headers)
+	for _, diversion := range call.diversion {
+		headers = append(headers, &sip.GenericHeader{HeaderName: "Diversion", Contents: diversion})
+	}
+	headers = b.autoAnswerHeaders(call, headers)
+	headers = b.rel100Headers(headers)
+	headers = b.manipulateHeaders(call, target, headers)
+	headers = b.sendFromProfile(target, profile, headers)
+	dest, err := b.ua.InviteWithParts(call.ctx, profile, callee, recipient, &offer, parts, headers...)
+	if err != nil {
+		call.Log().Errorf("B-Leg session error: %v", err)
+		return false
+	}
+	leg := *call
+	leg.dest = dest
+	leg.failover = failover
+	leg.sdpPolicy = b.sdpPolicy(call, target)
+	leg.trunk = target.trunk
+	b.addCall(&leg)
+	leg.Log().Infof("B-Leg to %v", target)
+	b.watchRouteTimeout(&leg, target)
+	return true
+}
+
+// callerName 返回 B 路 INVITE 的主叫显示名称：内部呼叫使用主叫账户的显示名称，
+// 未设置或非内部呼叫时沿用 A 路 From 的显示名称。使用的名称记录在呼叫上下文的 caller_name 中
+func (b *B2BUA) callerName(call *B2BCall, target routeTarget) string {
+	from, name := callerAddress(call)
+	if target.local && from.User() != nil {
+		if account := b.DisplayName(from.User().String()); account != "" {
+			name = account
+		}
+	}
+	if name != "" {
+		call.Context.Set("caller_name", name)
+	}
+	return name
+}
+
+// callerAddress 返回 B 路的主叫地址和 A 路 From 的显示名称。第三方呼叫控制发起的呼叫中 A 路 INVITE 的
+// From 为 B 方，主叫为 A 方，没有显示名称
+func callerAddress(call *B2BCall) (sip.Uri, string) {
+	if call.origin != nil {
+		return call.origin, ""
+	}
+	from, _ := call.src.Request().From()
+	name := ""
+	if from.DisplayName != nil {
+		name = from.DisplayName.String()
+	}
+	return from.Address, name
+}
+
+// finalCode 返回 B 路的最终响应码，没有响应（事务超时）时为 408
+func finalCode(resp *sip.Response) sip.StatusCode {
+	if resp != nil && *resp != nil {
+		return (*resp).StatusCode()
+	}
+	return 408
+}
+
+// failover B 路超时或返回 503 时改用下一个备用地址重新呼叫，成功发起时返回 true
+func (b *B2BUA) failover(call *B2BCall, resp *sip.Response) bool {
+	code := finalCode(resp)
+	if (code != 408 && code != 503) || !call.src.IsInProgress() {
+		return false
+	}
+	for i, target := range call.failover {
+		call.Log().Warnf("B-Leg failed with %d, trying %v", code, target)
+		b.metrics.Inc(MetricRouteFailover)
+		if b.inviteLeg(call, target, call.failover[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
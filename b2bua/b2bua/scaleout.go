@@ -0,0 +1,313 @@
+package b2bua
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	registry2 "go-sip-ua/b2bua/registry"
+)
+
+const (
+	defaultNodeSyncInterval = 5               // 默认向其它节点同步注册信息的间隔（秒）
+	nodeExpiryIntervals     = 3               // 超过几个同步间隔未收到某节点的注册信息时移除其注册
+	nodeSecretHeader        = "X-Node-Secret" // 节点间请求携带共享密钥的头域
+	nodeRegistrationsPath   = "/api/nodes/registrations"
+)
+
+// ScaleOutConfig 水平扩展：多个节点部署在负载均衡器后并共享注册信息。每个节点记录注册所经的节点（拥有该流的节点），
+// 定期将本节点拥有的注册发送给其它节点；呼叫注册在其它节点上的联系地址时，INVITE 转发给拥有该流的节点，
+// 由其经已有的连接或 NAT 映射发往终端
+type ScaleOutConfig struct {
+	Node         string                `json:"node"`          // 本节点名称，为空时不启用
+	Nodes        map[string]NodeConfig `json:"nodes"`         // 其它节点：名称 -> 地址
+	Secret       string                `json:"secret"`        // 节点间同步注册信息的共享密钥，所有节点配置相同的值
+	SyncInterval int                   `json:"sync_interval"` // 同步注册信息的间隔（秒），0 为 5 秒
+}
+
+// NodeConfig 一个节点的地址
+type NodeConfig struct {
+	SIP   string `json:"sip"`   // SIP 地址，转发的 INVITE 发往该地址，例如 sip:10.0.0.2:5060;transport=udp
+	Admin string `json:"admin"` // 管理接口地址，注册信息发往该地址，例如 http://10.0.0.2:6658
+}
+
+// NodeStatus 一个节点的同步状态
+type NodeStatus struct {
+	Node          string    `json:"node"`
+	SIP           string    `json:"sip"`
+	Registrations int       `json:"registrations"`        // 该节点拥有的注册数
+	LastSync      time.Time `json:"last_sync,omitempty"`  // 最近一次收到该节点注册信息的时间
+	LastError     string    `json:"last_error,omitempty"` // 最近一次向该节点发送注册信息失败的原因
+}
+
+// nodeRegistrations 节点间同步的注册信息
+type nodeRegistrations struct {
+	Node    string              `json:"node"`
+	Records []*registry2.Record `json:"records"`
+}
+
+// scaleOut 其它节点及同步状态
+type scaleOut struct {
+	config    ScaleOutConfig
+	client    *http.Client
+	sip       map[string]sip.SipUri // 节点 -> SIP 地址
+	mutex     sync.Mutex
+	lastSync  map[string]time.Time // 节点 -> 最近一次收到注册信息的时间
+	lastError map[string]string    // 节点 -> 最近一次发送失败的原因
+}
+
+// newScaleOut 按配置创建水平扩展
+func newScaleOut(config ScaleOutConfig) (*scaleOut, error) {
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultNodeSyncInterval
+	}
+	s := &scaleOut{
+		config:    config,
+		client:    &http.Client{Timeout: time.Duration(config.SyncInterval) * time.Second},
+		sip:       make(map[string]sip.SipUri),
+		lastSync:  make(map[string]time.Time),
+		lastError: make(map[string]string),
+	}
+	for name, node := range config.Nodes {
+		if name == config.Node {
+			return nil, fmt.Errorf("scale out: node %s is this node", name)
+		}
+		uri, err := parser.ParseSipUri(node.SIP)
+		if err != nil {
+			return nil, fmt.Errorf("scale out: parse SIP address of node %s: %w", name, err)
+		}
+		s.sip[name] = uri
+	}
+	return s, nil
+}
+
+// fromNode 返回请求来自的节点，不是其它节点发来时返回空
+func (b *B2BUA) fromNode(req sip.Request) string {
+	if b.scaleOut == nil {
+		return ""
+	}
+	host := req.Source()
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	for name, uri := range b.scaleOut.sip {
+		if uri.FHost == host {
+			return name
+		}
+	}
+	return ""
+}
+
+// contactRecipient 返回呼叫 user 注册的联系地址时 B 路的请求 URI：本节点拥有的流直接发往终端，同一来源注册的
+// 多个联系地址只发一次；其它节点拥有的流发往该节点，每个节点只发一次（由该节点向其上的所有联系地址分叉）。
+// 其它节点转发来的呼叫只发往本节点的流，避免节点间的环路。nodes 记录已发起分支的节点和来源。不需要发起分支时返回 false
+func (b *B2BUA) contactRecipient(call *B2BCall, user string, instance *registry2.ContactInstance, nodes map[string]bool) (sip.SipUri, bool) {
+	if instance.Node == "" || b.scaleOut == nil {
+		if nodes[instance.Source] {
+			return sip.SipUri{}, false
+		}
+		recipient, err := parser.ParseSipUri("sip:" + user + "@" + instance.Source + ";transport=" + instance.Transport)
+		if err != nil {
+			call.Log().Error(err)
+			return sip.SipUri{}, false
+		}
+		nodes[instance.Source] = true
+		return recipient, true
+	}
+	node, found := b.scaleOut.sip[instance.Node]
+	if !found || nodes[instance.Node] || b.fromNode(call.src.Request()) != "" {
+		return sip.SipUri{}, false
+	}
+	nodes[instance.Node] = true
+	recipient := node.Clone().(*sip.SipUri)
+	recipient.FUser = sip.String{Str: user}
+	call.Log().Infof("Contact of %s is registered on node %s, forwarding to %v", user, instance.Node, recipient)
+	b.metrics.Inc(MetricScaleOut + "forwarded")
+	return *recipient, true
+}
+
+// runScaleOut 定期向其它节点发送本节点拥有的注册，并移除长时间未同步的节点的注册
+func (b *B2BUA) runScaleOut() {
+	interval := time.Duration(b.scaleOut.config.SyncInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			b.shareRegistrations()
+			b.expireNodes(nodeExpiryIntervals * interval)
+		}
+	}
+}
+
+// shareRegistrations 将本节点拥有的注册发送给所有其它节点
+func (b *B2BUA) shareRegistrations() {
+	s := b.scaleOut
+	shared := nodeRegistrations{Node: s.config.Node, Records: []*registry2.Record{}}
+	for _, record := range b.registry.Snapshot() {
+		if record.Node == "" {
+			record.Node = s.config.Node
+			shared.Records = append(shared.Records, record)
+		}
+	}
+	body, err := json.Marshal(shared)
+	if err != nil {
+		logger.Errorf("Scale out: marshal registrations failed: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for name, node := range s.config.Nodes {
+		wg.Add(1)
+		go func(name string, node NodeConfig) {
+			defer wg.Done()
+			b.sharedWith(name, b.postRegistrations(node, body))
+		}(name, node)
+	}
+	wg.Wait()
+}
+
+// postRegistrations 向一个节点发送注册信息
+func (b *B2BUA) postRegistrations(node NodeConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(node.Admin, "/")+nodeRegistrationsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(nodeSecretHeader, b.scaleOut.config.Secret)
+	resp, err := b.scaleOut.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s returned %s", node.Admin, resp.Status)
+	}
+	return nil
+}
+
+// sharedWith 记录一次发送的结果，只在失败原因变化时记录日志
+func (b *B2BUA) sharedWith(name string, err error) {
+	s := b.scaleOut
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		if s.lastError[name] != "" {
+			logger.Infof("Scale out: sharing registrations with node %s recovered", name)
+		}
+		delete(s.lastError, name)
+		return
+	}
+	if s.lastError[name] != err.Error() {
+		logger.Warnf("Scale out: sharing registrations with node %s failed: %v", name, err)
+	}
+	s.lastError[name] = err.Error()
+	b.metrics.Inc(MetricScaleOut + "sync_failed")
+}
+
+// applyNodeRegistrations 以节点发来的注册替换本地保存的该节点的注册。终端已改为向本节点注册（绑定相同）时保留本节点的注册
+func (b *B2BUA) applyNodeRegistrations(shared *nodeRegistrations) error {
+	s := b.scaleOut
+	if _, found := s.sip[shared.Node]; !found {
+		return fmt.Errorf("unknown node %q", shared.Node)
+	}
+	now := time.Now()
+	received := make(map[string]bool, len(shared.Records))
+	for _, record := range shared.Records {
+		received[record.Key()] = true
+	}
+	owned := make(map[string]bool)
+	for _, record := range b.registry.Snapshot() {
+		key := record.Key()
+		switch {
+		case record.Node == "":
+			owned[key] = true
+		case record.Node == shared.Node && !received[key]:
+			if aor, instance, err := record.Instance(); err == nil {
+				b.registry.RemoveContact(aor, instance)
+			}
+		}
+	}
+	for _, record := range shared.Records {
+		if owned[record.Key()] {
+			continue
+		}
+		aor, instance, err := record.Instance()
+		if err != nil || instance.Expired(now) {
+			continue
+		}
+		instance.Node = shared.Node
+		b.registry.AddAor(aor, instance)
+	}
+	s.mutex.Lock()
+	s.lastSync[shared.Node] = now
+	s.mutex.Unlock()
+	return nil
+}
+
+// expireNodes 移除超过 timeout 未同步的节点的注册
+func (b *B2BUA) expireNodes(timeout time.Duration) {
+	s := b.scaleOut
+	s.mutex.Lock()
+	expired := make(map[string]bool)
+	for name, at := range s.lastSync {
+		if time.Since(at) > timeout {
+			expired[name] = true
+			delete(s.lastSync, name)
+		}
+	}
+	s.mutex.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	removed := 0
+	for _, record := range b.registry.Snapshot() {
+		if !expired[record.Node] {
+			continue
+		}
+		if aor, instance, err := record.Instance(); err == nil {
+			b.registry.RemoveContact(aor, instance)
+			removed++
+		}
+	}
+	for name := range expired {
+		logger.Warnf("Scale out: no registrations from node %s for %v, removing its registrations", name, timeout)
+	}
+	b.metrics.Add(MetricScaleOut+"expired", uint64(removed))
+}
+
+// Nodes 返回其它节点的同步状态，未启用水平扩展时返回 nil
+func (b *B2BUA) Nodes() []NodeStatus {
+	if b.scaleOut == nil {
+		return nil
+	}
+	s := b.scaleOut
+	counts := make(map[string]int)
+	for _, record := range b.registry.Snapshot() {
+		if record.Node != "" {
+			counts[record.Node]++
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := make([]NodeStatus, 0, len(s.config.Nodes))
+	for name, node := range s.config.Nodes {
+		nodes = append(nodes, NodeStatus{
+			Node:          name,
+			SIP:           node.SIP,
+			Registrations: counts[name],
+			LastSync:      s.lastSync[name],
+			LastError:     s.lastError[name],
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return nodes
+}
@@ -0,0 +1,105 @@
+package b2bua
+
+import (
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ScannerAction 表示匹配扫描器特征后的处理方式
+type ScannerAction string
+
+const (
+	ScannerDrop   ScannerAction = "drop"   // 静默丢弃（默认），不给扫描器任何回应
+	ScannerReject ScannerAction = "reject" // 返回 403
+)
+
+// defaultScannerUserAgents 内置的已知扫描器 User-Agent 特征（小写子串）
+var defaultScannerUserAgents = []string{
+	"friendly-scanner",
+	"sipvicious",
+	"sipcli",
+	"sip-scan",
+	"sundayddr",
+	"iwar",
+	"vaxsipuseragent",
+	"pplsip",
+	"siparmyknife",
+	"smap",
+}
+
+// ScannerFilterConfig 扫描器/攻击特征过滤配置
+type ScannerFilterConfig struct {
+	Disabled   bool          `json:"disabled"`    // 关闭特征过滤
+	UserAgents []string      `json:"user_agents"` // User-Agent 特征（不区分大小写的子串），为空时使用内置列表
+	ToDomains  []string      `json:"to_domains"`  // 可疑的 To 域名（不区分大小写）
+	Action     ScannerAction `json:"action"`      // 处理方式，默认 drop
+}
+
+// scannerFilter 根据特征识别扫描器流量
+type scannerFilter struct {
+	config     ScannerFilterConfig
+	userAgents []string
+	toDomains  map[string]bool
+}
+
+func newScannerFilter(config ScannerFilterConfig) *scannerFilter {
+	if config.Action == "" {
+		config.Action = ScannerDrop
+	}
+	userAgents := config.UserAgents
+	if len(userAgents) == 0 {
+		userAgents = defaultScannerUserAgents
+	}
+	sf := &scannerFilter{
+		config:    config,
+		toDomains: make(map[string]bool),
+	}
+	for _, ua := range userAgents {
+		sf.userAgents = append(sf.userAgents, strings.ToLower(ua))
+	}
+	for _, domain := range config.ToDomains {
+		sf.toDomains[strings.ToLower(domain)] = true
+	}
+	return sf
+}
+
+// Match 检查请求是否匹配扫描器特征，返回匹配的计数器名称
+func (sf *scannerFilter) Match(req sip.Request) (string, bool) {
+	if sf.config.Disabled {
+		return "", false
+	}
+	if hdrs := req.GetHeaders("User-Agent"); len(hdrs) > 0 {
+		userAgent := strings.ToLower(hdrs[0].Value())
+		for _, signature := range sf.userAgents {
+			if strings.Contains(userAgent, signature) {
+				return MetricScannerUA + signature, true
+			}
+		}
+	}
+	if to, ok := req.To(); ok && to.Address != nil {
+		domain := strings.ToLower(to.Address.Host())
+		if sf.toDomains[domain] {
+			return MetricScannerDomain + domain, true
+		}
+	}
+	return "", false
+}
+
+// filterScanner 处理匹配扫描器特征的请求，返回 false 表示请求已被丢弃或拒绝
+func (b *B2BUA) filterScanner(req sip.Request, tx sip.ServerTransaction) bool {
+	signature, matched := b.scannerFilter.Match(req)
+	if !matched {
+		return true
+	}
+	b.metrics.Inc(signature)
+	logger.Debugf("Scanner signature %s from %s", signature, req.Source())
+
+	if b.scannerFilter.config.Action == ScannerReject && tx != nil {
+		b.metrics.Inc(MetricScannerRejected)
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 403, "Forbidden", ""))
+		return false
+	}
+	b.metrics.Inc(MetricScannerDropped)
+	return false
+}
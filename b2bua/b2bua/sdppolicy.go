@@ -0,0 +1,140 @@
+package b2bua
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-sip-ua/pkg/media"
+)
+
+// SDPPolicy 转发到 B 路之前对 offer 的 SDP 处理策略。编解码名称不区分大小写，
+// 可以只写编码名（PCMA）或带采样率（opus/48000）。telephone-event 不受 Allow 限制，只能通过 Deny 去掉
+type SDPPolicy struct {
+	Allow          []string       `json:"allow"`           // 允许的编解码，为空时允许所有
+	Deny           []string       `json:"deny"`            // 禁止的编解码
+	Prefer         []string       `json:"prefer"`          // 编解码优先顺序，未列出的保持原顺序排在后面
+	Ptime          int            `json:"ptime"`           // 强制的打包时长（毫秒），0 表示不修改
+	StripVideo     bool           `json:"strip_video"`     // 拒绝视频流（端口置 0）
+	Bandwidth      map[string]int `json:"bandwidth"`       // 带宽上限（kbps），键为媒体类型（audio、video）或 session（会话级）。b=AS/b=TIAS 超过上限或没有时改写为上限，未列出的原样转发，如向受限的中继限制视频带宽
+	StripBandwidth bool           `json:"strip_bandwidth"` // 去掉未设上限的 b=AS/b=TIAS
+	Wideband       bool           `json:"wideband"`        // 保留宽带音频：宽带编解码（Opus、G.722 等）排在窄带之前（prefer 优先），使两路都支持时端到端使用宽带；必须转码时优先转为 A 路的宽带编解码
+}
+
+// sdpPolicy 返回呼叫发往 target 时使用的策略：中继策略优先，其次是主叫账户的策略，最后是全局策略
+func (b *B2BUA) sdpPolicy(call *B2BCall, target routeTarget) *SDPPolicy {
+	if target.trunk != nil && target.trunk.SDPPolicy != nil {
+		return target.trunk.SDPPolicy
+	}
+	from, _ := call.src.Request().From()
+	if from != nil && from.Address != nil && from.Address.User() != nil {
+		user := from.Address.User().String()
+		for _, key := range []string{user + "@" + from.Address.Host(), user} {
+			if policy, found := b.config.SDPPolicies[key]; found {
+				return &policy
+			}
+		}
+	}
+	return b.config.SDPPolicy
+}
+
+// applySDPPolicy 按策略改写发往 target 的 offer，无策略或解析失败时原样返回
+func (b *B2BUA) applySDPPolicy(call *B2BCall, target routeTarget, sdp string) string {
+	policy := b.sdpPolicy(call, target)
+	if policy == nil || sdp == "" {
+		return sdp
+	}
+	parsed, err := media.ParseSDP(sdp)
+	if err != nil {
+		call.Log().Warnf("SDP policy: %v", err)
+		return sdp
+	}
+	if limit, found := policy.Bandwidth["session"]; found {
+		if kbps, ok := parsed.Bandwidth(); !ok || kbps > limit {
+			parsed.SetBandwidth(limit)
+		}
+	} else if policy.StripBandwidth {
+		parsed.RemoveBandwidth()
+	}
+	for _, section := range parsed.Media {
+		if section.Port() == 0 {
+			continue
+		}
+		if policy.StripVideo && section.Type() == "video" {
+			section.SetPort(0)
+			continue
+		}
+		policy.limitBandwidth(section)
+		if section.Type() != "audio" {
+			continue
+		}
+
+		var formats []string
+		for _, format := range section.Formats() {
+			if policy.permits(section.Codec(format)) {
+				formats = append(formats, format)
+			}
+		}
+		if len(formats) == 0 { // 没有可用的编解码，拒绝该媒体流
+			call.Log().Warnf("SDP policy: no allowed codec in %s", section.Lines[0])
+			section.SetPort(0)
+			continue
+		}
+		sort.SliceStable(formats, func(i, j int) bool {
+			ri, rj := policy.rank(section.Codec(formats[i])), policy.rank(section.Codec(formats[j]))
+			if ri != rj || !policy.Wideband {
+				return ri < rj
+			}
+			return media.IsWideband(section.Codec(formats[i])) && !media.IsWideband(section.Codec(formats[j]))
+		})
+		section.SetFormats(formats)
+		if policy.Ptime > 0 {
+			section.SetAttribute("ptime", strconv.Itoa(policy.Ptime))
+		}
+	}
+	return parsed.String()
+}
+
+// limitBandwidth 按媒体类型的上限改写媒体流的 b=AS/b=TIAS
+func (p *SDPPolicy) limitBandwidth(section *media.MediaSection) {
+	limit, found := p.Bandwidth[section.Type()]
+	if !found {
+		if p.StripBandwidth {
+			section.RemoveBandwidth()
+		}
+		return
+	}
+	if kbps, ok := section.Bandwidth(); !ok || kbps > limit {
+		section.SetBandwidth(limit)
+	}
+}
+
+// permits 检查编解码是否允许
+func (p *SDPPolicy) permits(codec string) bool {
+	if matchCodec(p.Deny, codec) >= 0 {
+		return false
+	}
+	if len(p.Allow) == 0 || strings.HasPrefix(strings.ToLower(codec), "telephone-event/") {
+		return true
+	}
+	return matchCodec(p.Allow, codec) >= 0
+}
+
+// rank 返回编解码在优先顺序中的位置，未列出时排在最后
+func (p *SDPPolicy) rank(codec string) int {
+	if i := matchCodec(p.Prefer, codec); i >= 0 {
+		return i
+	}
+	return len(p.Prefer)
+}
+
+// matchCodec 返回 codec（如 PCMU/8000）在列表中的位置，未找到时返回 -1
+func matchCodec(names []string, codec string) int {
+	encoding := strings.SplitN(codec, "/", 2)[0]
+	for i, name := range names {
+		if strings.EqualFold(name, codec) || strings.EqualFold(name, encoding) {
+			return i
+		}
+	}
+	return -1
+}
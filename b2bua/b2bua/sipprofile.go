@@ -0,0 +1,267 @@
+package b2bua
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	registry2 "go-sip-ua/b2bua/registry"
+	"go-sip-ua/pkg/account"
+	"go-sip-ua/pkg/session"
+)
+
+// defaultProfile 全局监听（listen）所属的 profile 名称，用于 bridge 列表
+const defaultProfile = "default"
+
+// SIPProfileConfig SIP profile：在同一进程中运行的一组独立的监听、服务的域名和策略（类似 FreeSWITCH 的 sofia profile），
+// 如对内的 5060 与对外的 5080。请求按收到它的监听归属 profile；B 路从目的地所属 profile 的监听发出，
+// 从而在 profile 之间桥接呼叫。由于 Via 的主机固定为协议栈地址，各 profile 之间以端口区分
+type SIPProfileConfig struct {
+	Name      string          `json:"name"`      // 名称，不能为 default
+	Listen    ListenConfig    `json:"listen"`    // 监听地址，只监听配置了地址的传输协议，不使用 admin
+	Domains   []string        `json:"domains"`   // 服务的域名，REGISTER 和 INVITE 的请求 URI 不是其中的域名（或 IP 地址）时返回 404；为空时不限制
+	ACL       ACLConfig       `json:"acl"`       // 该 profile 的来源地址访问控制
+	Bridge    []string        `json:"bridge"`    // 允许把来自该 profile 的呼叫桥接到的其它 profile（default 为全局监听），为空时不限制
+	Overrides ConfigOverrides `json:"overrides"` // 覆盖认证策略、媒体模式、头域配置，优先于监听，低于中继
+}
+
+// profileListeners 返回需要为 profile 启动的 SIP 监听
+func (c *B2BUAConfig) profileListeners() (plain, secure []sipListener) {
+	for _, profile := range c.Profiles {
+		p, s := profile.Listen.explicitListeners(c.EnableTLS)
+		plain, secure = append(plain, p...), append(secure, s...)
+	}
+	return
+}
+
+// validateProfiles 检查 profile 的名称、监听端口、bridge 列表及中继引用的 profile
+func validateProfiles(config *B2BUAConfig) error {
+	names := map[string]bool{defaultProfile: true}
+	ports := make(map[string]string) // 传输协议/端口 -> 使用的 profile
+	plain, secure := config.Listen.sipListeners(config.EnableTLS)
+	for _, listener := range append(plain, secure...) {
+		ports[listener.network+"/"+listener.port()] = defaultProfile
+	}
+	for _, profile := range config.Profiles {
+		if profile.Name == "" || names[profile.Name] {
+			return fmt.Errorf("profiles: invalid or duplicate profile name %q", profile.Name)
+		}
+		names[profile.Name] = true
+		plain, secure := profile.Listen.explicitListeners(config.EnableTLS)
+		if len(plain)+len(secure) == 0 {
+			return fmt.Errorf("profile %s: no listener configured", profile.Name)
+		}
+		for _, listener := range append(plain, secure...) {
+			key := listener.network + "/" + listener.port()
+			if used, found := ports[key]; found {
+				return fmt.Errorf("profile %s: %s port %s already used by profile %s", profile.Name, listener.network, listener.port(), used)
+			}
+			ports[key] = profile.Name
+		}
+	}
+	for _, profile := range config.Profiles {
+		for _, name := range profile.Bridge {
+			if !names[name] {
+				return fmt.Errorf("profile %s: unknown bridge profile %q", profile.Name, name)
+			}
+		}
+	}
+	for _, trunk := range config.Trunks {
+		if trunk.Profile != "" && (trunk.Profile == defaultProfile || !names[trunk.Profile]) {
+			return fmt.Errorf("trunk %s: unknown profile %q", trunk.Name, trunk.Profile)
+		}
+	}
+	return nil
+}
+
+// profileNamed 按名称查找 profile，default 或未配置时返回 nil
+func (b *B2BUA) profileNamed(name string) *SIPProfileConfig {
+	for i := range b.config.Profiles {
+		if b.config.Profiles[i].Name == name {
+			return &b.config.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// profileForAddress 返回在本地地址 local 上以 transport 监听的 profile，全局监听返回 nil
+func (b *B2BUA) profileForAddress(transport, local string) *SIPProfileConfig {
+	_, port, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil
+	}
+	network := strings.ToLower(transport)
+	for i := range b.config.Profiles {
+		plain, secure := b.config.Profiles[i].Listen.explicitListeners(b.config.EnableTLS)
+		for _, listener := range append(plain, secure...) {
+			if listener.network == network && listener.port() == port {
+				return &b.config.Profiles[i]
+			}
+		}
+	}
+	return nil
+}
+
+// requestProfile 返回收到请求的监听所属的 profile
+func (b *B2BUA) requestProfile(req sip.Request) *SIPProfileConfig {
+	return b.profileForAddress(req.Transport(), req.Destination())
+}
+
+// contactProfile 返回本地终端注册时所经的 profile
+func (b *B2BUA) contactProfile(instance *registry2.ContactInstance) *SIPProfileConfig {
+	return b.profileForAddress(instance.Transport, instance.Local)
+}
+
+// trunkProfile 返回发往中继的 B 路使用的 profile
+func (b *B2BUA) trunkProfile(trunk *TrunkConfig) *SIPProfileConfig {
+	if trunk == nil || trunk.Profile == "" {
+		return nil
+	}
+	return b.profileNamed(trunk.Profile)
+}
+
+// profileName 返回 profile 的名称，全局监听为 default
+func profileName(profile *SIPProfileConfig) string {
+	if profile == nil {
+		return defaultProfile
+	}
+	return profile.Name
+}
+
+// filterDomain 拒绝发往 profile 不服务的域名的 REGISTER 和对话外 INVITE，返回 false 表示请求已被拒绝
+func (b *B2BUA) filterDomain(req sip.Request, tx sip.ServerTransaction) bool {
+	if req.Method() != sip.REGISTER && req.Method() != sip.INVITE {
+		return true
+	}
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") { // re-INVITE
+		return true
+	}
+	profile := b.requestProfile(req)
+	if profile == nil || len(profile.Domains) == 0 {
+		return true
+	}
+	host := strings.Trim(req.Recipient().Host(), "[]")
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, domain := range profile.Domains {
+		if strings.EqualFold(domain, host) {
+			return true
+		}
+	}
+	logger.Warnf("%s for %s from %s: domain not served by profile %s", req.Method(), host, req.Source(), profile.Name)
+	b.metrics.Inc(MetricProfileDomain + profile.Name)
+	if tx != nil {
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 404, "Not Found", ""))
+	}
+	return false
+}
+
+// bridges 检查来自 A 路 profile 的呼叫能否桥接到 egress profile
+func (b *B2BUA) bridges(call *B2BCall, egress *SIPProfileConfig) bool {
+	if call.profile == nil || len(call.profile.Bridge) == 0 || call.profile == egress {
+		return true
+	}
+	name := profileName(egress)
+	for _, allowed := range call.profile.Bridge {
+		if allowed == name {
+			return true
+		}
+	}
+	call.Log().Warnf("Bridging from profile %s to %s not allowed", call.profile.Name, name)
+	return false
+}
+
+// rejectBridge A 路所在的 profile 不允许桥接到目的地时以 403 拒绝呼叫
+func (b *B2BUA) rejectBridge(call *B2BCall) {
+	b.metrics.Inc(MetricProfileBridge + call.profile.Name)
+	call.src.Reject(403, "Forbidden", b.warning(399, "bridging between profiles not allowed"))
+	b.finishCall(call, session.Failure)
+}
+
+// sendFromProfile 目的地属于某个 profile 时，预置 Via 的端口使 B 路 INVITE 从该 profile 的监听发出，
+// Contact 也使用该端口
+func (b *B2BUA) sendFromProfile(target routeTarget, profile *account.Profile, headers []sip.Header) []sip.Header {
+	if target.profile == nil {
+		return headers
+	}
+	next := target.recipient
+	if target.proxy != nil {
+		next = *target.proxy
+	}
+	network := "udp"
+	if transport, ok := next.UriParams().Get("transport"); ok && transport != nil {
+		network = strings.ToLower(transport.String())
+	}
+	plain, secure := target.profile.Listen.explicitListeners(b.config.EnableTLS)
+	for _, listener := range append(plain, secure...) {
+		if listener.network != network {
+			continue
+		}
+		port, err := strconv.ParseUint(listener.port(), 10, 16)
+		if err != nil {
+			break
+		}
+		viaPort := sip.Port(port)
+		if profile.ContactURI != nil {
+			profile.ContactURI.SetPort(&viaPort)
+		}
+		return append(headers, sip.ViaHeader{&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       strings.ToUpper(network),
+			Port:            &viaPort,
+			Params:          sip.NewParams().Add("rport", nil),
+		}})
+	}
+	logger.Warnf("Profile %s has no %s listener, sending %v from the default listener", target.profile.Name, network, target)
+	return headers
+}
+
+// ProfileStatus 一个 SIP profile 的监听、注册数和通话数
+type ProfileStatus struct {
+	Name          string   `json:"name"`
+	Listeners     []string `json:"listeners"` // <传输协议>:<地址>
+	Domains       []string `json:"domains"`
+	Bridge        []string `json:"bridge"`
+	Registrations int      `json:"registrations"` // 经该 profile 注册的联系地址数
+	Calls         int      `json:"calls"`         // A 路来自该 profile 的通话数
+}
+
+// Profiles 返回各 SIP profile 的状态，第一项为全局监听（default）
+func (b *B2BUA) Profiles() []ProfileStatus {
+	statuses := []ProfileStatus{{Name: defaultProfile}}
+	index := map[string]int{defaultProfile: 0}
+	plain, secure := b.config.Listen.sipListeners(b.config.EnableTLS)
+	for _, listener := range append(plain, secure...) {
+		statuses[0].Listeners = append(statuses[0].Listeners, listener.network+":"+listener.addr)
+	}
+	for _, profile := range b.config.Profiles {
+		status := ProfileStatus{Name: profile.Name, Domains: profile.Domains, Bridge: profile.Bridge}
+		plain, secure := profile.Listen.explicitListeners(b.config.EnableTLS)
+		for _, listener := range append(plain, secure...) {
+			status.Listeners = append(status.Listeners, listener.network+":"+listener.addr)
+		}
+		index[profile.Name] = len(statuses)
+		statuses = append(statuses, status)
+	}
+
+	for _, contacts := range b.registry.GetAllContacts() {
+		for _, instance := range contacts {
+			if instance.Node != "" { // 其它节点的注册
+				continue
+			}
+			statuses[index[profileName(b.contactProfile(instance))]].Registrations++
+		}
+	}
+	seen := make(map[string]bool)
+	for _, call := range b.Calls() {
+		if !seen[call.ID] {
+			seen[call.ID] = true
+			statuses[index[profileName(call.profile)]].Calls++
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,167 @@
+package b2bua
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// eventSpool 按产生顺序保存待投递的事件。配置了文件时事件先写入本地文件，
+// 投递成功后才删除，进程重启后从文件继续投递（至少一次）
+type eventSpool struct {
+	mutex  sync.Mutex
+	path   string // 为空时只保存在内存中
+	limit  int    // 内存队列的长度上限，持久化时不限制
+	events []*Event
+	notify chan struct{}
+}
+
+// openEventSpool 打开事件队列，并加载文件中尚未投递的事件
+func openEventSpool(path string, limit int) (*eventSpool, error) {
+	s := &eventSpool{
+		path:   path,
+		limit:  limit,
+		notify: make(chan struct{}, 1),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			logger.Warnf("Spool %s: skip invalid event: %v", path, err) // 可能是写入时进程退出留下的半行
+			continue
+		}
+		s.events = append(s.events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read spool %s: %w", path, err)
+	}
+	if len(s.events) > 0 {
+		logger.Infof("Spool %s: %d pending events restored", path, len(s.events))
+		s.signal()
+	}
+	return s, nil
+}
+
+// Push 追加一个事件，内存队列已满时返回 false
+func (s *eventSpool) Push(event *Event) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.path == "" {
+		if len(s.events) >= s.limit {
+			return false
+		}
+	} else if err := s.append(event); err != nil {
+		logger.Errorf("Spool %s: write event failed: %v", s.path, err) // 仍保留在内存中投递
+	}
+	s.events = append(s.events, event)
+	s.signal()
+	return true
+}
+
+// Peek 返回队首最多 n 个事件
+func (s *eventSpool) Peek(n int) []*Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n > len(s.events) {
+		n = len(s.events)
+	}
+	return append([]*Event(nil), s.events[:n]...)
+}
+
+// Commit 删除队首已投递的 n 个事件
+func (s *eventSpool) Commit(n int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append([]*Event(nil), s.events[n:]...)
+	if s.path == "" {
+		return nil
+	}
+	return s.rewrite()
+}
+
+// Len 返回待投递的事件数
+func (s *eventSpool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.events)
+}
+
+// Notify 返回有新事件时收到通知的 channel
+func (s *eventSpool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+func (s *eventSpool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// append 将事件追加到文件末尾
+func (s *eventSpool) append(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rewrite 用内存中剩余的事件重写文件，先写临时文件再替换，避免中途退出时丢失事件
+func (s *eventSpool) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, event := range s.events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,181 @@
+package b2bua
+
+import (
+	"strings"
+	"time"
+
+	"go-sip-ua/pkg/media"
+)
+
+const (
+	defaultSurveyTimeout = 10      // 每个问题等待按键的默认时间（秒）
+	defaultSurveyDigits  = "12345" // 默认的有效按键
+)
+
+// callContextSurvey 通话上下文中的调查开关，值为 true 或 false 时覆盖按呼叫分类的选择（如由呼叫回调或 REST 接口设置）
+const callContextSurvey = "survey"
+
+// SurveyConfig 通话后调查配置：被叫先挂机时保留主叫一路，由媒体中继播放问题并收集按键，
+// 回答作为标签（source 为 survey）记录在话单中
+type SurveyConfig struct {
+	Enabled   bool             `json:"enabled"`   // 启用通话后调查，需要媒体中继
+	Classes   []string         `json:"classes"`   // 只调查这些分类的呼叫（如 inbound），为空时调查所有经媒体中继的已应答呼叫
+	Questions []SurveyQuestion `json:"questions"` // 按顺序提出的问题
+	Goodbye   string           `json:"goodbye"`   // 调查结束后播放一遍的提示音（WAV），为空时直接挂机
+	Timeout   int              `json:"timeout"`   // 每个问题等待按键的时间（秒），默认 10，超时未回答时结束调查
+}
+
+// SurveyQuestion 调查问题
+type SurveyQuestion struct {
+	Name   string `json:"name"`   // 问题名称，作为标签的 label
+	Prompt string `json:"prompt"` // 提示音（WAV），等待按键期间循环播放
+	Digits string `json:"digits"` // 有效按键，默认 12345；回答为 1-5 时同时记为评分
+}
+
+// survey 加载了提示音的调查
+type survey struct {
+	config  SurveyConfig
+	prompts []*media.Audio
+	goodbye *media.Audio
+}
+
+// newSurvey 加载调查的提示音，未启用时返回 nil
+func newSurvey(config SurveyConfig) (*survey, error) {
+	if !config.Enabled || len(config.Questions) == 0 {
+		return nil, nil
+	}
+	s := &survey{config: config}
+	for _, question := range config.Questions {
+		prompt, err := media.LoadWAV(question.Prompt)
+		if err != nil {
+			return nil, err
+		}
+		s.prompts = append(s.prompts, prompt)
+	}
+	if config.Goodbye != "" {
+		goodbye, err := media.LoadWAV(config.Goodbye)
+		if err != nil {
+			return nil, err
+		}
+		s.goodbye = goodbye
+	}
+	return s, nil
+}
+
+// surveys 检查是否对呼叫进行通话后调查
+func (b *B2BUA) surveys(call *B2BCall) bool {
+	if b.survey == nil || call.media == nil {
+		return false
+	}
+	if value, ok := call.Context.Get(callContextSurvey); ok {
+		return value == "true"
+	}
+	if len(b.survey.config.Classes) == 0 {
+		return true
+	}
+	for _, class := range b.survey.config.Classes {
+		if strings.EqualFold(class, call.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// startSurvey 被叫挂机后开始通话后调查，主叫一路保持到调查结束。不调查时返回 false
+func (b *B2BUA) startSurvey(call *B2BCall) bool {
+	if !b.surveys(call) || !b.anchored(call) || call.Context.answeredAt().IsZero() || call.Context.timedOut() || call.src.IsEnded() {
+		return false
+	}
+	digits := make(chan string, 1)
+	call.media.mutex.Lock()
+	call.media.survey = digits
+	call.media.mutex.Unlock()
+	call.Log().Infof("Survey: B-Leg hung up, starting post-call survey")
+	go b.runSurvey(call, digits)
+	return true
+}
+
+// inSurvey 检查呼叫是否正在进行通话后调查
+func (b *B2BUA) inSurvey(call *B2BCall) bool {
+	if call.media == nil {
+		return false
+	}
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	return call.media.survey != nil
+}
+
+// surveyDigit 将调查期间 A 路的按键交给调查
+func (b *B2BUA) surveyDigit(call *B2BCall, digit string) {
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	select {
+	case call.media.survey <- digit:
+	default: // 未在等待回答
+	}
+}
+
+// runSurvey 依次播放问题并等待按键，回答记录为呼叫的标签。全部回答、超时或主叫挂机后结束
+func (b *B2BUA) runSurvey(call *B2BCall, digits chan string) {
+	timeout := time.Duration(b.survey.config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSurveyTimeout * time.Second
+	}
+	defer func() {
+		call.media.mutex.Lock()
+		call.media.survey = nil
+		call.media.mutex.Unlock()
+		call.src.End()
+	}()
+
+	for i, question := range b.survey.config.Questions {
+		valid := question.Digits
+		if valid == "" {
+			valid = defaultSurveyDigits
+		}
+		if err := call.media.relay.Play(media.LegA, b.survey.prompts[i]); err != nil {
+			call.Log().Warnf("Survey: %v", err)
+			return
+		}
+		digit, answered := waitSurveyDigit(call, digits, valid, timeout)
+		call.media.relay.StopPlay(media.LegA)
+		if !answered {
+			call.Log().Infof("Survey: no answer to %s", question.Name)
+			return
+		}
+		tag := CallTag{Label: question.Name, Value: digit, Source: "survey", Time: time.Now()}
+		if digit >= "1" && digit <= "5" {
+			tag.Rating = int(digit[0] - '0')
+		}
+		call.Context.addTag(tag)
+		call.Log().Infof("Survey: %s answered %s", question.Name, digit)
+	}
+
+	if b.survey.goodbye != nil && call.media.relay.Play(media.LegA, b.survey.goodbye) == nil {
+		goodbye := b.survey.goodbye
+		time.Sleep(time.Duration(len(goodbye.Samples)) * time.Second / time.Duration(goodbye.Rate))
+		call.media.relay.StopPlay(media.LegA)
+	}
+}
+
+// waitSurveyDigit 等待一个有效按键，超时或呼叫结束时返回 false
+func waitSurveyDigit(call *B2BCall, digits chan string, valid string, timeout time.Duration) (string, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(mediaTimeoutCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case digit := <-digits:
+			if strings.Contains(valid, digit) {
+				return digit, true
+			}
+		case <-ticker.C:
+			if call.Context.isFinished() || call.src.IsEnded() {
+				return "", false
+			}
+		case <-deadline.C:
+			return "", false
+		}
+	}
+}
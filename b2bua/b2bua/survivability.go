@@ -0,0 +1,134 @@
+package b2bua
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// SurvivabilityConfig 分支机构生存模式配置，需要同时配置 RegisterRelay.Upstream。
+// 上游不可用时进入生存模式：本地分机互拨照常，紧急号码经本地网关呼出，其它外呼返回 503。
+type SurvivabilityConfig struct {
+	ProbeInterval    int      `json:"probe_interval"`    // 向上游发送 OPTIONS 探测的间隔（秒），0 表示仅根据转发失败判断
+	EmergencyNumbers []string `json:"emergency_numbers"` // 紧急号码
+	EmergencyGateway string   `json:"emergency_gateway"` // 生存模式下紧急呼叫使用的本地网关，例如 sip:10.0.0.2;transport=udp
+}
+
+// survivability 生存模式下的路由信息
+type survivability struct {
+	config    SurvivabilityConfig
+	emergency map[string]bool
+	gateway   *sip.SipUri // 本地紧急网关，未配置时为 nil
+}
+
+func newSurvivability(config SurvivabilityConfig) (*survivability, error) {
+	s := &survivability{
+		config:    config,
+		emergency: make(map[string]bool),
+	}
+	for _, number := range config.EmergencyNumbers {
+		s.emergency[number] = true
+	}
+	if config.EmergencyGateway != "" {
+		gateway, err := parser.ParseSipUri(config.EmergencyGateway)
+		if err != nil {
+			return nil, fmt.Errorf("parse emergency gateway %s: %w", config.EmergencyGateway, err)
+		}
+		s.gateway = &gateway
+	}
+	return s, nil
+}
+
+// IsEmergency 检查被叫是否为紧急号码
+func (s *survivability) IsEmergency(called sip.Uri) bool {
+	return called.User() != nil && s.emergency[routingNumber(called)]
+}
+
+// SurvivalMode 返回是否因上游不可用而处于生存模式
+func (b *B2BUA) SurvivalMode() bool {
+	return b.registerRelay != nil && b.registerRelay.IsDown()
+}
+
+// upstreamDown 标记上游不可用，首次发生时进入生存模式
+func (b *B2BUA) upstreamDown(err error) {
+	if b.registerRelay.MarkDown() {
+		logger.Warnf("Upstream %s down, entering survivability mode: %v", b.registerRelay.destination(), err)
+		b.emit(EventUpstreamDown, map[string]interface{}{
+			"upstream": b.registerRelay.destination(),
+			"error":    err.Error(),
+		})
+	}
+}
+
+// upstreamUp 标记上游恢复，退出生存模式
+func (b *B2BUA) upstreamUp() {
+	if b.registerRelay.MarkUp() {
+		logger.Infof("Upstream %s recovered, leaving survivability mode", b.registerRelay.destination())
+		b.emit(EventUpstreamUp, map[string]interface{}{
+			"upstream": b.registerRelay.destination(),
+		})
+	}
+}
+
+// monitorUpstream 定期向上游发送 OPTIONS，检测上游故障和恢复
+func (b *B2BUA) monitorUpstream(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			if err := b.probeUpstream(b.ctx); err != nil {
+				b.upstreamDown(err)
+			} else {
+				b.upstreamUp()
+			}
+		}
+	}
+}
+
+// probeUpstream 向上游发送一次 OPTIONS，任何最终响应都表示上游可达
+func (b *B2BUA) probeUpstream(ctx context.Context) error {
+	relay := b.registerRelay
+	transport := relay.transport()
+	local := b.stack.GetNetworkInfo(transport)
+	localUri := &sip.SipUri{FHost: local.Host, FPort: local.Port}
+	upstream := relay.upstream.Clone()
+
+	callID := sip.CallID(util.RandString(32))
+	maxForwards := sip.MaxForwards(70)
+	req := sip.NewRequest("", sip.OPTIONS, upstream, "SIP/2.0", []sip.Header{
+		&sip.FromHeader{Address: localUri, Params: sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})},
+		&sip.ToHeader{Address: upstream.Clone()},
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: sip.OPTIONS},
+		&maxForwards,
+	}, "", nil)
+
+	_, err := b.sendUpstream(ctx, req)
+	return err
+}
+
+// routeUpstream 为本地未注册的被叫选择路由。上游可用时发往上游；
+// 生存模式下只有紧急号码可以经本地紧急网关呼出。返回 nil 表示没有可用路由。
+func (b *B2BUA) routeUpstream(called sip.Uri) *sip.SipUri {
+	if b.registerRelay == nil || called.User() == nil {
+		return nil
+	}
+	user := called.User().String()
+	if !b.SurvivalMode() {
+		target := b.registerRelay.target(user)
+		return &target
+	}
+	if b.survivability.IsEmergency(called) && b.survivability.gateway != nil {
+		gateway := b.survivability.gateway.Clone().(*sip.SipUri)
+		gateway.FUser = sip.String{Str: user}
+		return gateway
+	}
+	return nil
+}
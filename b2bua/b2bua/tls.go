@@ -0,0 +1,113 @@
+package b2bua
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"go-sip-ua/pkg/stack"
+)
+
+// TLSConfig TLS/WSS 监听证书配置
+type TLSConfig struct {
+	// Certificates 证书列表，按 SNI 选择，第一个为默认证书；为空时使用 certs/cert.pem 和 certs/key.pem
+	Certificates []stack.CertFiles `json:"certificates"`
+	// ReloadInterval 检查证书文件变化的间隔（秒），0 表示只在调用 ReloadCertificates 时重新加载
+	ReloadInterval int `json:"reload_interval"`
+	// ClientCA 校验客户端证书的 CA 文件（PEM），双向 TLS 需要配置
+	ClientCA string `json:"client_ca"`
+	// ClientAuth 按监听传输协议（tls、wss）配置客户端证书要求
+	ClientAuth map[string]ClientAuthMode `json:"client_auth"`
+	// ClientIdentities 客户端证书主体到账户/中继的映射，映射成功的对端跳过摘要认证
+	ClientIdentities []ClientIdentity `json:"client_identities"`
+}
+
+// defaultCertificates 未配置证书时使用的证书文件
+var defaultCertificates = []stack.CertFiles{{Cert: "certs/cert.pem", Key: "certs/key.pem"}}
+
+// newCertStore 根据配置加载证书
+func newCertStore(config TLSConfig) (*stack.CertStore, error) {
+	files := config.Certificates
+	if len(files) == 0 {
+		files = defaultCertificates
+	}
+	return stack.NewCertStore(files)
+}
+
+// listenerTLSConfig 返回指定监听使用的 TLS 配置，按需启用客户端证书校验
+func listenerTLSConfig(certStore *stack.CertStore, config TLSConfig, listener string) (*tls.Config, error) {
+	tlsConfig := certStore.TLSConfig()
+	mode := config.ClientAuth[listener]
+	if mode == ClientAuthNone {
+		return tlsConfig, nil
+	}
+	if config.ClientCA == "" {
+		return nil, fmt.Errorf("client_auth on %s requires client_ca", listener)
+	}
+	pool, err := loadCertPool(config.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = pool
+	switch mode {
+	case ClientAuthVerify:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth mode %s on %s", mode, listener)
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool 从 PEM 文件加载 CA 证书
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ReloadCertificates 从磁盘重新加载 TLS 证书，新连接立即使用新证书，已建立的连接不受影响
+func (b *B2BUA) ReloadCertificates() error {
+	if b.certStore == nil {
+		return fmt.Errorf("TLS is not enabled")
+	}
+	if err := b.certStore.Reload(); err != nil {
+		logger.Errorf("Reload TLS certificates failed, keeping current ones: %v", err)
+		return err
+	}
+	logger.Infof("TLS certificates reloaded")
+	return nil
+}
+
+// Certificates 返回当前加载的 TLS 证书，未启用 TLS 时返回 nil
+func (b *B2BUA) Certificates() []stack.CertInfo {
+	if b.certStore == nil {
+		return nil
+	}
+	return b.certStore.Certificates()
+}
+
+// watchCertificates 定期检查证书文件，发生变化时重新加载
+func (b *B2BUA) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			if b.certStore.Changed() {
+				b.ReloadCertificates()
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package b2bua
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+)
+
+// topologyHeaders 记录路由路径和终端地址的头域，启用拓扑隐藏时不从 A 路复制到 B 路
+var topologyHeaders = []string{"Via", "Record-Route", "Route", "Contact", "Path", "Service-Route"}
+
+// defaultInternalNetworks 未配置时视为内部网络的地址段
+var defaultInternalNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10"}
+
+// TopologyHidingConfig 拓扑隐藏配置。B 路本身是新的对话（Via、Record-Route、Contact、Call-ID 由 B2BUA 生成），
+// 启用后还会去掉头域配置从 A 路复制的路由头域和私有头域，将 B 路 From 中的 IP 地址改为本机地址，
+// 并在两个方向的 SDP 中隐藏内部地址
+type TopologyHidingConfig struct {
+	Enabled    bool     `json:"enabled"`     // 启用拓扑隐藏
+	Strip      []string `json:"strip"`       // 另外不复制的头域，以 * 结尾时按前缀匹配（如 X-*、P-Internal-*）
+	Internal   []string `json:"internal"`    // 内部网络（CIDR），默认为私有、回环和链路本地地址段
+	SDPAddress string   `json:"sdp_address"` // 未经媒体中继的 SDP 中替换内部连接地址（c= 行）的地址，如内部终端所在 NAT 的公网地址；为空时保留 c= 行，只隐藏 o= 行和内部 ICE 候选地址
+}
+
+// topologyHider 按配置隐藏拓扑，未启用时为 nil
+type topologyHider struct {
+	config   TopologyHidingConfig
+	internal []*net.IPNet
+}
+
+// newTopologyHider 解析拓扑隐藏配置，未启用时返回 nil
+func newTopologyHider(config TopologyHidingConfig) (*topologyHider, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	networks := config.Internal
+	if len(networks) == 0 {
+		networks = defaultInternalNetworks
+	}
+	internal, err := parseNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+	return &topologyHider{config: config, internal: internal}, nil
+}
+
+// strips 检查头域是否不复制到 B 路
+func (h *topologyHider) strips(name string) bool {
+	for _, header := range topologyHeaders {
+		if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+	for _, pattern := range h.config.Strip {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInternal 检查地址是否属于内部网络
+func (h *topologyHider) isInternal(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range h.internal {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hideURI 返回主机部分为 IP 地址时改为 host 的 URI 副本，用于 B 路的 From
+func (h *topologyHider) hideURI(uri sip.Uri, host string) sip.Uri {
+	if h == nil || net.ParseIP(uri.Host()) == nil {
+		return uri
+	}
+	hidden := uri.Clone()
+	hidden.SetHost(host)
+	hidden.SetPort(nil)
+	return hidden
+}
+
+// hideSDP 隐藏未经媒体中继的 SDP 中的内部地址：o= 行改为 host，内部的 c= 地址改为 sdp_address，
+// 去掉内部地址的 ICE 候选
+func (h *topologyHider) hideSDP(sdp, host string) string {
+	if h == nil || sdp == "" {
+		return sdp
+	}
+	parsed, err := media.ParseSDP(sdp)
+	if err != nil {
+		return sdp
+	}
+	parsed.SetOrigin(host)
+	if h.config.SDPAddress != "" {
+		parsed.ReplaceConnections(func(addr string) string {
+			if h.isInternal(addr) {
+				return h.config.SDPAddress
+			}
+			return ""
+		})
+	}
+	for _, section := range parsed.Media {
+		section.FilterAttributes("candidate", func(value string) bool {
+			fields := strings.Fields(value)
+			return len(fields) < 5 || !h.isInternal(fields[4])
+		})
+	}
+	return parsed.String()
+}
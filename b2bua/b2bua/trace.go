@@ -0,0 +1,133 @@
+package b2bua
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// TraceInfo 描述一个按对端的 SIP 消息跟踪
+type TraceInfo struct {
+	Target  string    `json:"target"`         // 跟踪目标：来源/目的 IP，或用户（user 或 user@domain）
+	File    string    `json:"file,omitempty"` // 输出文件，为空时输出到控制台
+	Started time.Time `json:"started"`        // 开始时间
+}
+
+// peerTrace 一个进行中的跟踪
+type peerTrace struct {
+	info   TraceInfo
+	ip     net.IP // 按地址跟踪时的 IP，按用户跟踪时为 nil
+	output io.Writer
+	file   *os.File // 输出文件，输出到控制台时为 nil
+}
+
+// matches 检查消息是否属于跟踪目标：地址匹配对端 IP，用户匹配 From 或 To
+func (t *peerTrace) matches(msg sip.Message, outgoing bool) bool {
+	if t.ip != nil {
+		peer := msg.Source()
+		if outgoing {
+			peer = msg.Destination()
+		}
+		host, _, err := net.SplitHostPort(peer)
+		return err == nil && t.ip.Equal(net.ParseIP(host))
+	}
+	var uris []sip.Uri
+	if from, ok := msg.From(); ok {
+		uris = append(uris, from.Address)
+	}
+	if to, ok := msg.To(); ok {
+		uris = append(uris, to.Address)
+	}
+	for _, uri := range uris {
+		if strings.Contains(t.info.Target, "@") {
+			if strings.EqualFold(userOf(uri), t.info.Target) {
+				return true
+			}
+		} else if uri.User() != nil && uri.User().String() == t.info.Target {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTraces 进行中的跟踪，按目标索引
+type peerTraces struct {
+	mutex  sync.RWMutex
+	traces map[string]*peerTrace
+}
+
+// StartTrace 开始跟踪与 target（IP、user 或 user@domain）相关的 SIP 消息，
+// 原始消息写入 file，file 为空时输出到控制台。已有的同一目标的跟踪被替换
+func (b *B2BUA) StartTrace(target, file string) (TraceInfo, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return TraceInfo{}, fmt.Errorf("trace: empty target")
+	}
+	trace := &peerTrace{
+		info:   TraceInfo{Target: target, File: file, Started: time.Now()},
+		ip:     net.ParseIP(target),
+		output: os.Stdout,
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return TraceInfo{}, fmt.Errorf("trace: %w", err)
+		}
+		trace.output, trace.file = f, f
+	}
+
+	b.traces.mutex.Lock()
+	if previous, ok := b.traces.traces[target]; ok && previous.file != nil {
+		previous.file.Close()
+	}
+	b.traces.traces[target] = trace
+	b.traces.mutex.Unlock()
+	logger.Infof("Tracing SIP messages of %s", target)
+	return trace.info, nil
+}
+
+// StopTrace 停止跟踪 target，返回 false 表示该目标未被跟踪
+func (b *B2BUA) StopTrace(target string) bool {
+	b.traces.mutex.Lock()
+	defer b.traces.mutex.Unlock()
+	trace, ok := b.traces.traces[target]
+	if !ok {
+		return false
+	}
+	if trace.file != nil {
+		trace.file.Close()
+	}
+	delete(b.traces.traces, target)
+	logger.Infof("Stopped tracing SIP messages of %s", target)
+	return true
+}
+
+// Traces 返回进行中的跟踪，按目标排序
+func (b *B2BUA) Traces() []TraceInfo {
+	b.traces.mutex.RLock()
+	defer b.traces.mutex.RUnlock()
+	traces := make([]TraceInfo, 0, len(b.traces.traces))
+	for _, trace := range b.traces.traces {
+		traces = append(traces, trace.info)
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Target < traces[j].Target })
+	return traces
+}
+
+// traceMessage 将消息写入匹配的跟踪
+func (b *B2BUA) traceMessage(msg sip.Message, outgoing bool) {
+	b.traces.mutex.RLock()
+	defer b.traces.mutex.RUnlock()
+	for _, trace := range b.traces.traces {
+		if trace.matches(msg, outgoing) {
+			writeSIPTrace(trace.output, msg, outgoing)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package b2bua
+
+import (
+	"sync/atomic"
+
+	"go-sip-ua/pkg/media"
+)
+
+var defaultTranscodingCodecs = []string{"PCMU/8000", "PCMA/8000"}
+
+// TranscodingConfig 媒体中继的音频转码配置，需要启用媒体中继。
+// 发往 B 路的 offer 中追加可转码的编解码，B 路选择了 A 路没有的编解码时由媒体中继转码。
+// 内置 PCMU、PCMA 和 L16，其它编解码（如 Opus）需要通过 media.RegisterCodec 注册实现
+type TranscodingConfig struct {
+	Enabled     bool     `json:"enabled"`      // 是否启用转码
+	Codecs      []string `json:"codecs"`       // 追加到 offer 的编解码，默认 PCMU/8000、PCMA/8000
+	MaxSessions int      `json:"max_sessions"` // 同时转码的通话数上限（限制 CPU 占用），0 表示不限制
+}
+
+// transcodingAvailable 检查是否可以为新的 B 路提供转码
+func (b *B2BUA) transcodingAvailable(call *B2BCall) bool {
+	config := b.config.Transcoding
+	if !config.Enabled || call.media == nil {
+		return false
+	}
+	return config.MaxSessions <= 0 || int(atomic.LoadInt32(&b.transcodingSessions)) < config.MaxSessions
+}
+
+// addTranscodingCodecs 在发往 B 路的 offer 中追加可转码的编解码
+func (b *B2BUA) addTranscodingCodecs(call *B2BCall, offer string) string {
+	if offer == "" || !b.config.Transcoding.Enabled || call.media == nil {
+		return offer
+	}
+	if !b.transcodingAvailable(call) {
+		call.media.mutex.Lock()
+		call.media.unavailable = true
+		call.media.mutex.Unlock()
+		b.capacityExhausted(call, capacityTranscoding)
+		return offer
+	}
+	codecs := b.config.Transcoding.Codecs
+	if len(codecs) == 0 {
+		codecs = defaultTranscodingCodecs
+	}
+	augmented, err := media.AddCodecs(offer, codecs)
+	if err != nil {
+		call.Log().Warnf("Transcoding: %v", err)
+		return offer
+	}
+	return augmented
+}
+
+// transcodeAnswer 在两路没有共同编解码时启用转码，返回发往 A 路的 answer
+func (b *B2BUA) transcodeAnswer(call *B2BCall, answer string) string {
+	if answer == "" || !b.config.Transcoding.Enabled || call.media == nil {
+		return answer
+	}
+	rewritten, transcoded, err := call.media.relay.Transcode(answer, call.sdpPolicy != nil && call.sdpPolicy.Wideband)
+	if err != nil {
+		call.Log().Warnf("Transcoding: %v", err)
+		return answer
+	}
+	if transcoded {
+		call.media.mutex.Lock()
+		if !call.media.transcoding {
+			call.media.transcoding = true
+			atomic.AddInt32(&b.transcodingSessions, 1)
+			call.Log().Infof("Transcoding media between legs")
+		}
+		call.media.mutex.Unlock()
+	}
+	return rewritten
+}
+
+// releaseTranscoding 通话结束时释放转码容量
+func (b *B2BUA) releaseTranscoding(call *B2BCall) {
+	call.media.mutex.Lock()
+	defer call.media.mutex.Unlock()
+	if call.media.transcoding {
+		call.media.transcoding = false
+		atomic.AddInt32(&b.transcodingSessions, -1)
+	}
+}
+
+// TranscodingSessions 返回当前转码的通话数
+func (b *B2BUA) TranscodingSessions() int {
+	return int(atomic.LoadInt32(&b.transcodingSessions))
+}
@@ -0,0 +1,158 @@
+package b2bua
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/session"
+)
+
+// 呼叫转接的错误
+var (
+	ErrCallNotEstablished = errors.New("call not established")
+	ErrTransferNeedsRelay = errors.New("transfer requires the media relay")
+	ErrNoTransferRoute    = errors.New("no route to transfer target")
+)
+
+// LegInfo 描述呼叫的一个分支
+type LegInfo struct {
+	Callee  string         // 分支的被叫
+	Contact string         // B 路的联系地址
+	Status  session.Status // B 路的会话状态
+	Trunk   string         // 经过的中继，未经中继时为空
+}
+
+// CallDetail 描述一个呼叫及其所有分支
+type CallDetail struct {
+	ID      string            // 呼叫 ID
+	Caller  string            // 主叫
+	Callee  string            // 被叫
+	Class   string            // 呼叫分类
+	State   CallState         // 呼叫状态
+	Cause   ReleaseCause      // 释放原因，正在挂断时才有
+	Start   time.Time         // 呼叫开始时间
+	Source  string            // A 路的联系地址
+	Status  session.Status    // A 路的会话状态
+	Media   string            // 媒体处理：relay、release 或 none
+	Context map[string]string // 通话上下文
+	Legs    []LegInfo         // 各分支，按被叫和联系地址排序
+}
+
+// CallDetail 返回呼叫及其所有分支的详细信息
+func (b *B2BUA) CallDetail(id string) (*CallDetail, error) {
+	legs := b.callLegs(id)
+	if len(legs) == 0 {
+		return nil, ErrCallNotFound
+	}
+	call := legs[0]
+	detail := &CallDetail{
+		ID:      call.ID,
+		Caller:  call.Caller,
+		Callee:  call.Callee,
+		Class:   call.Class,
+		State:   call.State(),
+		Start:   call.Start,
+		Source:  call.src.Contact(),
+		Status:  call.src.Status(),
+		Media:   "none",
+		Context: call.Context.All(),
+	}
+	detail.Cause, _ = call.Context.releaseCause()
+	if call.media != nil {
+		detail.Media = "relay"
+		if !b.anchored(call) {
+			detail.Media = "release"
+		}
+	}
+	for _, leg := range legs {
+		if leg.dest == nil {
+			continue
+		}
+		info := LegInfo{Callee: leg.Callee, Contact: leg.dest.Contact(), Status: leg.dest.Status()}
+		if leg.trunk != nil {
+			info.Trunk = leg.trunk.Name
+		}
+		detail.Legs = append(detail.Legs, info)
+	}
+	sort.Slice(detail.Legs, func(i, j int) bool {
+		if detail.Legs[i].Callee != detail.Legs[j].Callee {
+			return detail.Legs[i].Callee < detail.Legs[j].Callee
+		}
+		return detail.Legs[i].Contact < detail.Legs[j].Contact
+	})
+	return detail, nil
+}
+
+// callLegs 返回呼叫 ID 为 id 的所有分支
+func (b *B2BUA) callLegs(id string) []*B2BCall {
+	b.callsMu.Lock()
+	defer b.callsMu.Unlock()
+	var legs []*B2BCall
+	for _, call := range b.calls {
+		if call.ID == id {
+			legs = append(legs, call)
+		}
+	}
+	return legs
+}
+
+// TransferCall 将已建立的呼叫盲转到 target（号码或 SIP URI，只有号码时使用被叫的域名）：A 路保持接通，
+// 向目标发起新的 B 路，发出后挂断原来的 B 路。新的 B 路复用媒体中继的 A 路端口，不需要向 A 路发送
+// re-INVITE，因此要求呼叫经过媒体中继；新的 B 路失败时 A 路随之挂断
+func (b *B2BUA) TransferCall(id, target string) error {
+	legs := b.callLegs(id)
+	if len(legs) == 0 {
+		return ErrCallNotFound
+	}
+	var established *B2BCall
+	for _, leg := range legs {
+		if leg.dest != nil && leg.dest.Status() == session.Confirmed {
+			established = leg
+		}
+	}
+	if established == nil || established.src.Status() != session.Confirmed {
+		return ErrCallNotEstablished
+	}
+	if !b.anchored(established) {
+		return ErrTransferNeedsRelay
+	}
+	called, err := forwardURI(target, calledURI(established))
+	if err != nil {
+		return err
+	}
+
+	leg := *established
+	leg.answer = established.src.LocalSdp() // A 路已应答，新的 B 路不再应答 A 路
+	leg.offer = ""
+	leg.forks = nil
+	leg.diversion = nil
+	if called.User() != nil {
+		leg.Callee = called.User().String()
+	}
+	established.Log().Infof("Transferring call to %v", called)
+	if !b.transferLeg(&leg, called) {
+		return ErrNoTransferRoute
+	}
+	established.Context.Set("transferred_to", called.String())
+	established.dest.End() // 新的 B 路已发出，A 路保留
+	return nil
+}
+
+// transferLeg 向转接或第三方呼叫的目标发起 B 路：本地账户向其所有联系地址分叉，否则按号码前缀经中继或发往上游
+func (b *B2BUA) transferLeg(call *B2BCall, called sip.Uri) bool {
+	if b.inviteAccount(call, called) {
+		return true
+	}
+	recipient, proxy, trunk := b.routeTrunk(called)
+	if recipient == nil {
+		recipient, proxy = b.routeUpstream(called), b.outboundProxy
+	}
+	if recipient == nil {
+		return false
+	}
+	call.called = called
+	call.dialed = ""
+	return b.dialTargets(call, b.routeTargets(call, *recipient, proxy, trunk))
+}
@@ -0,0 +1,65 @@
+package b2bua
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const defaultHopHeader = "X-B2BUA-Hops" // 默认的跳数头域
+
+// TransitConfig 经多个 B2BUA 实例或租户转接的呼叫的跳数限制。每次经本实例发出 B 路时跳数加一，
+// 记录在自定义头域中，防止实例之间的路由环路和经网状网络反复转接的计费滥用
+type TransitConfig struct {
+	Header  string `json:"header"`   // 记录跳数的头域，默认 X-B2BUA-Hops；网状网络中的所有实例须使用相同的头域
+	MaxHops int    `json:"max_hops"` // 收到的呼叫已转接的最大次数，达到时返回 483；0 表示不限制（仍会递增跳数）
+}
+
+// hopHeader 返回记录跳数的头域名称
+func (b *B2BUA) hopHeader() string {
+	if b.config.Transit.Header != "" {
+		return b.config.Transit.Header
+	}
+	return defaultHopHeader
+}
+
+// requestHops 返回 A 路 INVITE 已转接的次数，没有或无法解析跳数头域时为 0
+func (b *B2BUA) requestHops(req sip.Request) int {
+	hdrs := req.GetHeaders(b.hopHeader())
+	if len(hdrs) == 0 {
+		return 0
+	}
+	hops, err := strconv.Atoi(strings.TrimSpace(hdrs[0].Value()))
+	if err != nil || hops < 0 {
+		logger.Warnf("Invalid %s: %q", b.hopHeader(), hdrs[0].Value())
+		return 0
+	}
+	return hops
+}
+
+// exceedsHops 检查呼叫是否已达到跳数上限：trunk 为 nil 时按全局上限，否则按出局中继的上限
+func (b *B2BUA) exceedsHops(call *B2BCall, trunk *TrunkConfig) bool {
+	limit, scope := b.config.Transit.MaxHops, "global"
+	if trunk != nil {
+		limit, scope = trunk.MaxHops, "trunk."+trunk.Name
+	}
+	if limit <= 0 || call.hops < limit {
+		return false
+	}
+	call.Log().Warnf("Transit: %d hops reached the %s limit %d", call.hops, scope, limit)
+	b.metrics.Inc(MetricTransitRejected + scope)
+	return true
+}
+
+// hopHeaders 去掉头域配置复制的跳数头域，添加递增后的跳数
+func (b *B2BUA) hopHeaders(call *B2BCall, headers []sip.Header) []sip.Header {
+	name := b.hopHeader()
+	kept := headers[:0]
+	for _, header := range headers {
+		if !strings.EqualFold(header.Name(), name) {
+			kept = append(kept, header)
+		}
+	}
+	return append(kept, &sip.GenericHeader{HeaderName: name, Contents: strconv.Itoa(call.hops + 1)})
+}
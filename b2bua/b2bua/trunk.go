@@ -0,0 +1,127 @@
+package b2bua
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// TrunkConfig 描述一个 SIP 中继（运营商或对端平台）
+type TrunkConfig struct {
+	Name            string          `json:"name"`             // 中继名称
+	Domains         []string        `json:"domains"`          // 中继使用的域名，From 域名匹配时认为请求来自该中继
+	ACL             ACLConfig       `json:"acl"`              // 中继的来源地址访问控制
+	Destination     string          `json:"destination"`      // 出局目的地（如 sip:carrier.example.com），经 NAPTR/SRV 解析，超时或 503 时切换到下一个地址
+	Prefixes        []string        `json:"prefixes"`         // 经该中继出局的被叫号码前缀，最长前缀优先
+	OutboundProxy   string          `json:"outbound_proxy"`   // 该中继的出局代理（如边界 SBC），为空时使用全局出局代理
+	RequireLocation bool            `json:"require_location"` // 紧急呼叫经该中继出局时需要位置信息，主叫未提供时注入配置的静态位置
+	SDPPolicy       *SDPPolicy      `json:"sdp_policy"`       // 发往该中继的 SDP 策略，未配置时使用主叫账户或全局策略
+	StripParts      []string        `json:"strip_parts"`      // 发往该中继时从 multipart 消息体中去掉的部分（如 application/isup），"*" 表示只保留 SDP；未配置时使用全局设置
+	MaxHops         int             `json:"max_hops"`         // 经该中继出局的呼叫已转接的最大次数，达到时返回 483；0 表示只按全局 transit.max_hops 限制
+	RingTimeout     int             `json:"ring_timeout"`     // 经该中继出局的呼叫的振铃超时（秒），超时后取消并切换到下一个地址；0 使用全局 ring_timeout.default
+	Profile         string          `json:"profile"`          // 发往该中继的 B 路使用的 SIP profile（从其监听发出），为空时使用全局监听
+	Trusted         bool            `json:"trusted"`          // 中继属于可信域（RFC 3325），接受并向其传递 P-Asserted-Identity，需启用 asserted_identity，并配置 acl.allow 或 TLS 客户端身份以按来源确认
+	Overrides       ConfigOverrides `json:"overrides"`        // 该中继覆盖的认证策略（按 From 域名识别的来自中继的请求）、媒体模式、头域配置，优先于租户和监听
+}
+
+// trunkRoute 一个中继的出局路由
+type trunkRoute struct {
+	trunk       *TrunkConfig
+	destination *sip.SipUri
+	proxy       *sip.SipUri // 出局代理，为 nil 时使用全局出局代理
+}
+
+// newTrunkRoutes 解析中继的出局目的地
+func newTrunkRoutes(trunks []TrunkConfig) ([]trunkRoute, error) {
+	var routes []trunkRoute
+	for i := range trunks {
+		if trunks[i].Destination == "" {
+			continue
+		}
+		destination, err := parser.ParseSipUri(trunks[i].Destination)
+		if err != nil {
+			return nil, fmt.Errorf("trunk %s: invalid destination %q: %w", trunks[i].Name, trunks[i].Destination, err)
+		}
+		proxy, err := parseOutboundProxy(trunks[i].OutboundProxy)
+		if err != nil {
+			return nil, fmt.Errorf("trunk %s: %w", trunks[i].Name, err)
+		}
+		routes = append(routes, trunkRoute{trunk: &trunks[i], destination: &destination, proxy: proxy})
+	}
+	return routes, nil
+}
+
+// routeTrunk 按被叫号码前缀选择出局中继，返回目的地址、出局代理及中继，未匹配时返回 nil。
+// 目的地址保留完整的用户部分（如 isub 参数）
+func (b *B2BUA) routeTrunk(called sip.Uri) (*sip.SipUri, *sip.SipUri, *TrunkConfig) {
+	if called.User() == nil {
+		return nil, nil, nil
+	}
+	user := called.User().String()
+	number := routingNumber(called)
+	var matched *trunkRoute
+	longest := -1
+	for i := range b.trunkRoutes {
+		for _, prefix := range b.trunkRoutes[i].trunk.Prefixes {
+			if strings.HasPrefix(number, prefix) && len(prefix) > longest {
+				matched = &b.trunkRoutes[i]
+				longest = len(prefix)
+			}
+		}
+	}
+	if matched == nil {
+		return nil, nil, nil
+	}
+	recipient := matched.destination.Clone().(*sip.SipUri)
+	recipient.FUser = sip.String{Str: user}
+	if matched.proxy != nil {
+		return recipient, matched.proxy, matched.trunk
+	}
+	return recipient, b.outboundProxy, matched.trunk
+}
+
+// trunkForRequest 根据 From 域名查找请求所属的中继，未匹配时返回 nil
+func (b *B2BUA) trunkForRequest(req sip.Request) *TrunkConfig {
+	from, ok := req.From()
+	if !ok || from.Address == nil {
+		return nil
+	}
+	host := strings.ToLower(from.Address.Host())
+	for i := range b.config.Trunks {
+		for _, domain := range b.config.Trunks[i].Domains {
+			if strings.ToLower(domain) == host {
+				return &b.config.Trunks[i]
+			}
+		}
+	}
+	return nil
+}
+
+// trunkNamed 按名称查找中继，未配置时返回 nil
+func (b *B2BUA) trunkNamed(name string) *TrunkConfig {
+	for i := range b.config.Trunks {
+		if b.config.Trunks[i].Name == name {
+			return &b.config.Trunks[i]
+		}
+	}
+	return nil
+}
+
+// sourceTrunk 返回按来源确认的中继：双向 TLS 身份映射的中继，或 From 域名匹配且来源 IP 命中其 ACL allow 的中继，
+// 否则返回 nil。From 域名由发送方决定，只按域名匹配的中继不能放宽认证或被视为可信
+func (b *B2BUA) sourceTrunk(req sip.Request) *TrunkConfig {
+	if identity := b.clientIdentity(req); identity != nil && identity.Trunk != "" {
+		return b.trunkNamed(identity.Trunk)
+	}
+	trunk := b.trunkForRequest(req)
+	if trunk == nil || len(trunk.ACL.Allow) == 0 {
+		return nil
+	}
+	if acl, found := b.aclFilter.trunks[trunk.Name]; found && acl.Permits(net.ParseIP(sourceIP(req))) {
+		return trunk
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package b2bua
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// UnknownDialogAction 表示对不属于任何已知通话的对话内请求的处理方式
+type UnknownDialogAction string
+
+const (
+	UnknownDialogReject UnknownDialogAction = "reject" // 返回 481（默认）
+	UnknownDialogDrop   UnknownDialogAction = "drop"   // 静默丢弃
+	UnknownDialogAccept UnknownDialogAction = "accept" // 返回 200，兼容对 BYE 一律应答的终端
+)
+
+// UnknownDialogConfig 未知对话请求（BYE、re-INVITE、UPDATE、ACK）的处理配置
+type UnknownDialogConfig struct {
+	Action  UnknownDialogAction `json:"action"`  // 处理方式，默认 reject
+	Capture string              `json:"capture"` // 抓取文件路径，将请求原文追加到该文件，为空时不抓取
+}
+
+// unknownDialogCapture 串行写入抓取文件
+var unknownDialogCapture sync.Mutex
+
+// handleUnknownDialog 处理不属于任何已知通话的对话内请求
+func (b *B2BUA) handleUnknownDialog(req sip.Request, tx sip.ServerTransaction) {
+	if b.cluster != nil && b.clusterDialog(req, tx) { // 接管的通话
+		return
+	}
+	config := b.config.UnknownDialog
+	callID, _ := req.CallID()
+	logger.Warnf("%s for unknown dialog, Call-ID %v from %s", req.Method(), callID, req.Source())
+	b.metrics.Inc(MetricUnknownDialog + string(req.Method()))
+
+	if config.Capture != "" {
+		if err := captureRequest(config.Capture, req); err != nil {
+			logger.Errorf("Capture unknown dialog request failed: %v", err)
+		}
+	}
+
+	if tx == nil || req.IsAck() { // ACK 不需要响应
+		return
+	}
+	switch config.Action {
+	case UnknownDialogDrop:
+	case UnknownDialogAccept:
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", ""))
+	default:
+		tx.Respond(sip.NewResponseFromRequest(req.MessageID(), req, 481, "Call/Transaction Does Not Exist", ""))
+	}
+}
+
+// captureRequest 将请求原文追加到抓取文件
+func captureRequest(path string, req sip.Request) error {
+	unknownDialogCapture.Lock()
+	defer unknownDialogCapture.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "### %s from %s\n%s\n\n", time.Now().Format(time.RFC3339), req.Source(), req.String())
+	return err
+}
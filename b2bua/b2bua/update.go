@@ -0,0 +1,46 @@
+package b2bua
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// handleUpdate 将一路的 UPDATE（早期对话中的 SDP 变化，如运营商在应答前改变编解码）转发到另一路，
+// 用另一路的应答回复。没有 SDP 的 UPDATE（会话刷新）在本路直接应答，两路的会话定时器各自独立
+func (b *B2BUA) handleUpdate(sess *session.Session, req sip.Request) {
+	call := b.findCall(sess)
+	offer := session.SdpBody(req)
+	if call == nil || offer == "" {
+		sess.AnswerUpdate(sess.LocalSdp())
+		return
+	}
+	from := media.LegA
+	if call.dest == sess {
+		from = media.LegB
+	}
+	if from == media.LegB && sess.Status() != session.Confirmed && !call.Context.selectEarlyMedia(sess) { // 早期媒体未转发给主叫的分支
+		sess.RejectUpdate(491, "Request Pending")
+		return
+	}
+	peer := b.peerSession(call, from)
+	if peer == nil || !peer.CanUpdate() { // 另一路没有可以发送 UPDATE 的对话
+		sess.RejectUpdate(491, "Request Pending")
+		return
+	}
+
+	relayed := b.relaySDP(call, from, offer)
+	go func() {
+		resp, err := peer.UpdateWithContext(call.ctx, relayed)
+		if err != nil {
+			code, reason := sip.StatusCode(500), "Server Internal Error"
+			if reqErr, ok := err.(*sip.RequestError); ok {
+				code, reason = sip.StatusCode(reqErr.Code), reqErr.Reason
+			}
+			call.Log().Warnf("UPDATE to %s-Leg failed: %v", from.Other(), err)
+			sess.RejectUpdate(code, reason)
+			return
+		}
+		sess.AnswerUpdate(b.relaySDP(call, from.Other(), session.SdpBody(resp)))
+	}()
+}
@@ -0,0 +1,111 @@
+package b2bua
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// hopParams 只对下一跳有意义的 URI 参数，不跨 B2BUA 传递
+var hopParams = map[string]bool{
+	"transport": true,
+	"maddr":     true,
+	"ttl":       true,
+	"lr":        true,
+	"method":    true,
+	"ob":        true,
+}
+
+// bridgedURIParams 返回 A 路 Request-URI 中需要传递到 B 路的参数（如 user=phone）
+func bridgedURIParams(request sip.Request) sip.Params {
+	params := sip.NewParams()
+	uri, ok := request.Recipient().(*sip.SipUri)
+	if !ok || uri.FUriParams == nil {
+		return params
+	}
+	for _, key := range uri.FUriParams.Keys() {
+		if hopParams[strings.ToLower(key)] {
+			continue
+		}
+		value, _ := uri.FUriParams.Get(key)
+		params.Add(key, value)
+	}
+	return params
+}
+
+// withURIParams 返回加入 params 的 recipient 副本，recipient 已有的参数不被覆盖
+func withURIParams(recipient sip.SipUri, params sip.Params) sip.SipUri {
+	uri := recipient.Clone().(*sip.SipUri)
+	if params.Length() == 0 {
+		return *uri
+	}
+	if uri.FUriParams == nil {
+		uri.FUriParams = sip.NewParams()
+	}
+	for _, key := range params.Keys() {
+		if !uri.FUriParams.Has(key) {
+			value, _ := params.Get(key)
+			uri.FUriParams.Add(key, value)
+		}
+	}
+	return *uri
+}
+
+// routingNumber 返回用于路由的被叫号码：电话号码（user=phone）的用户部分去掉
+// isub、phone-context 等参数及分隔符，其它 URI 返回完整的用户部分
+func routingNumber(uri sip.Uri) string {
+	if uri.User() == nil {
+		return ""
+	}
+	user := uri.User().String()
+	params := uri.UriParams()
+	if params == nil {
+		return user
+	}
+	if value, ok := params.Get("user"); !ok || value == nil || !strings.EqualFold(value.String(), "phone") {
+		return user
+	}
+	if idx := strings.IndexByte(user, ';'); idx >= 0 {
+		user = user[:idx]
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, user)
+}
+
+// registryAOR 返回 URI 在注册表中的 AOR：主机为 IP 地址（请求发到本机地址）或 localhost 时换成默认域名，
+// 使向 IP 注册的终端和呼叫 IP 的请求对应同一账户
+func (b *B2BUA) registryAOR(uri sip.Uri) sip.Uri {
+	host := strings.Trim(uri.Host(), "[]")
+	if net.ParseIP(host) == nil && !strings.EqualFold(host, "localhost") {
+		return uri
+	}
+	domain := b.config.Domain
+	if domain == "" {
+		domain = b.stack.GetNetworkInfo("udp").Host
+	}
+	if strings.EqualFold(host, domain) {
+		return uri
+	}
+	clone := uri.Clone()
+	clone.SetHost(domain)
+	return clone
+}
+
+// routingURI 返回用户部分为路由号码的 URI 副本，用于注册表查找
+func routingURI(uri sip.Uri) sip.Uri {
+	number := routingNumber(uri)
+	if uri.User() == nil || number == uri.User().String() {
+		return uri
+	}
+	clone := uri.Clone()
+	if sipURI, ok := clone.(*sip.SipUri); ok {
+		sipURI.FUser = sip.String{Str: number}
+	}
+	return clone
+}
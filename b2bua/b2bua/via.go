@@ -0,0 +1,32 @@
+package b2bua
+
+import (
+	"fmt"
+	"strings"
+
+	"go-sip-ua/pkg/stack"
+)
+
+// ViaConfig 单个传输协议的 Via 处理（RFC 3581）
+type ViaConfig struct {
+	DisableRport   bool   `json:"disable_rport"`   // 出局请求的 Via 不携带 rport 参数
+	ResponseTarget string `json:"response_target"` // 响应的发送地址：symmetric（默认，按 received/rport）、received（received 地址加 Via 端口）、via（Via 中的 sent-by）
+}
+
+// newViaPolicies 将按传输协议配置的 Via 处理转换为协议栈的策略
+func newViaPolicies(configs map[string]ViaConfig) (map[string]stack.ViaPolicy, error) {
+	policies := make(map[string]stack.ViaPolicy, len(configs))
+	for transport, config := range configs {
+		target := stack.ResponseTarget(strings.ToLower(config.ResponseTarget))
+		switch target {
+		case "", stack.ResponseTargetSymmetric, stack.ResponseTargetReceived, stack.ResponseTargetVia:
+		default:
+			return nil, fmt.Errorf("via %s: unknown response target %q", transport, config.ResponseTarget)
+		}
+		policies[strings.ToUpper(transport)] = stack.ViaPolicy{
+			NoRport:        config.DisableRport,
+			ResponseTarget: target,
+		}
+	}
+	return policies, nil
+}
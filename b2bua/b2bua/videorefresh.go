@@ -0,0 +1,99 @@
+package b2bua
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go-sip-ua/pkg/media"
+	"go-sip-ua/pkg/session"
+)
+
+// 请求关键帧的方式
+const (
+	VideoRefreshInfo = "info" // SIP INFO 携带 picture_fast_update（RFC 5168），媒体直通时也可用
+	VideoRefreshRTCP = "rtcp" // 媒体中继发送 RTCP PLI（RFC 4585）
+	VideoRefreshBoth = "both" // 两者都发送
+)
+
+const (
+	videoRefreshDelay       = 500 * time.Millisecond // 应答或恢复通话后等待编码器启动的时间
+	defaultVideoRefreshRate = 1000                   // 默认向同一路请求关键帧的最小间隔（毫秒）
+)
+
+// VideoRefreshConfig 视频关键帧请求配置：应答、恢复保持的通话后，以及媒体中继检测到视频丢包时，
+// 向发送视频的一路请求关键帧，使另一路的画面恢复
+type VideoRefreshConfig struct {
+	Enabled     bool   `json:"enabled"`      // 启用视频关键帧请求
+	Method      string `json:"method"`       // info、rtcp 或 both（默认）；rtcp 只用于经媒体中继的通话
+	MinInterval int    `json:"min_interval"` // 因丢包向同一路请求关键帧的最小间隔（毫秒），默认 1000
+}
+
+// hasVideo 检查通话是否有视频
+func hasVideo(sdp string) bool {
+	return strings.Contains(sdp, "\nm=video ") || strings.HasPrefix(sdp, "m=video ")
+}
+
+// requestKeyFrame 请求 leg 一路的视频编码器发送关键帧
+func (b *B2BUA) requestKeyFrame(call *B2BCall, leg media.Leg, reason string) {
+	method := b.config.VideoRefresh.Method
+	if method == "" {
+		method = VideoRefreshBoth
+	}
+	call.Log().Debugf("Video refresh: requesting key frame from %s-Leg (%s)", leg, reason)
+	b.metrics.Inc(MetricVideoRefresh + reason)
+	if method != VideoRefreshInfo && b.anchored(call) {
+		if err := call.media.relay.RequestKeyFrame(leg); err != nil {
+			call.Log().Debugf("Video refresh: %v", err)
+		}
+	}
+	if method == VideoRefreshRTCP {
+		return
+	}
+	sess := call.src
+	if leg == media.LegB {
+		sess = b.peerSession(call, media.LegA)
+	}
+	if sess != nil && sess.Status() == session.Confirmed {
+		sess.Info(media.PictureFastUpdate, media.MediaControlType)
+	}
+}
+
+// refreshVideo 视频通话应答或恢复后，稍后请求两路各发送一个关键帧
+func (b *B2BUA) refreshVideo(call *B2BCall, reason string) {
+	if !b.config.VideoRefresh.Enabled || !hasVideo(call.src.RemoteSdp()) {
+		return
+	}
+	time.AfterFunc(videoRefreshDelay, func() {
+		if call.Context.isFinished() {
+			return
+		}
+		b.requestKeyFrame(call, media.LegA, reason)
+		b.requestKeyFrame(call, media.LegB, reason)
+	})
+}
+
+// watchVideoLoss 媒体中继检测到一路发送的视频丢包时向该路请求关键帧，按 min_interval 限制频率
+func (b *B2BUA) watchVideoLoss(call *B2BCall) {
+	if !b.config.VideoRefresh.Enabled || call.media == nil {
+		return
+	}
+	interval := time.Duration(b.config.VideoRefresh.MinInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultVideoRefreshRate * time.Millisecond
+	}
+	var mutex sync.Mutex
+	var last [2]time.Time
+	call.media.relay.OnVideoLoss(func(from media.Leg) {
+		mutex.Lock()
+		now := time.Now()
+		limited := now.Sub(last[from]) < interval
+		if !limited {
+			last[from] = now
+		}
+		mutex.Unlock()
+		if !limited {
+			go b.requestKeyFrame(call, from, "loss")
+		}
+	})
+}
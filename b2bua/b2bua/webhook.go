@@ -0,0 +1,210 @@
+package b2bua
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 5                // 默认请求超时（秒）
+	webhookQueueSize      = 1024             // 未配置本地队列文件时每个 webhook 的待发送事件数上限
+	webhookRetryMin       = time.Second      // 投递失败后的首次重试间隔
+	webhookRetryMax       = 60 * time.Second // 重试间隔上限
+	webhookSignature      = "X-Webhook-Signature"
+)
+
+// WebhookConfig webhook 配置。Tenant 为空的 webhook 是全局的，接收所有事件；
+// 租户 webhook 只接收涉及本租户用户的事件，不会收到其它租户或全局（如封禁、上游状态）事件。
+type WebhookConfig struct {
+	Name      string      `json:"name"`       // 名称，用于计数器，为空时使用 webhook<序号>
+	URL       string      `json:"url"`        // 接收事件的地址，以 JSON POST
+	Tenant    string      `json:"tenant"`     // 租户（SIP 域名），为空表示全局
+	Events    []EventType `json:"events"`     // 订阅的事件类型，为空表示全部
+	Users     []string    `json:"users"`      // 只接收涉及这些用户（租户内的用户名）的事件，为空表示全部
+	Timeout   int         `json:"timeout"`    // 请求超时（秒）
+	BatchSize int         `json:"batch_size"` // 大于 1 时以 JSON 数组批量投递，每批最多 BatchSize 个事件
+	BatchWait int         `json:"batch_wait"` // 等待凑满一批的时间（毫秒）
+	Spool     string      `json:"spool"`      // 本地队列文件，投递成功前事件保存在文件中，重启后继续投递；为空时只保存在内存中，队列满时丢弃
+	Secret    string      `json:"secret"`     // 签名密钥，不为空时以 HMAC-SHA256 签名请求体，放在 X-Webhook-Signature 头域（sha256=<十六进制>）
+}
+
+// webhook 一个 webhook 的发送队列
+type webhook struct {
+	config WebhookConfig
+	events map[EventType]bool
+	users  map[string]bool
+	spool  *eventSpool
+	client *http.Client
+}
+
+func newWebhook(config WebhookConfig, index int) (*webhook, error) {
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("webhook%d", index)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	config.Tenant = strings.ToLower(config.Tenant)
+	spool, err := openEventSpool(config.Spool, webhookQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	w := &webhook{
+		config: config,
+		events: make(map[EventType]bool),
+		users:  make(map[string]bool),
+		spool:  spool,
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}
+	for _, eventType := range config.Events {
+		w.events[eventType] = true
+	}
+	for _, user := range config.Users {
+		w.users[user] = true
+	}
+	return w, nil
+}
+
+// Accepts 检查事件是否应发送到该 webhook
+func (w *webhook) Accepts(event *Event) bool {
+	if len(w.events) > 0 && !w.events[event.Type] {
+		return false
+	}
+	if w.config.Tenant == "" {
+		return true
+	}
+	for _, user := range event.Users {
+		if tenantOf(user) != w.config.Tenant {
+			continue
+		}
+		if len(w.users) == 0 || w.users[strings.SplitN(user, "@", 2)[0]] {
+			return true
+		}
+	}
+	return false
+}
+
+// run 按顺序投递队列中的事件，失败时重试同一批次直到成功，因此同一通话的事件不会乱序
+func (w *webhook) run(b *B2BUA) {
+	retry := webhookRetryMin
+	for {
+		events := w.spool.Peek(w.config.BatchSize)
+		if len(events) == 0 {
+			select {
+			case <-b.stopCh:
+				return
+			case <-w.spool.Notify():
+			}
+			continue
+		}
+		if len(events) < w.config.BatchSize && w.config.BatchWait > 0 { // 等待凑满一批
+			if !w.wait(b, time.Duration(w.config.BatchWait)*time.Millisecond) {
+				return
+			}
+			events = w.spool.Peek(w.config.BatchSize)
+		}
+
+		if err := w.deliver(events); err != nil {
+			logger.Warnf("Webhook %s: deliver %d events failed, retry in %v: %v", w.config.Name, len(events), retry, err)
+			b.metrics.Inc(MetricWebhook + w.config.Name + ".failed")
+			if !w.wait(b, retry) {
+				return
+			}
+			if retry *= 2; retry > webhookRetryMax {
+				retry = webhookRetryMax
+			}
+			continue
+		}
+		retry = webhookRetryMin
+		if err := w.spool.Commit(len(events)); err != nil {
+			logger.Errorf("Webhook %s: update spool failed: %v", w.config.Name, err)
+		}
+		b.metrics.Add(MetricWebhook+w.config.Name+".delivered", uint64(len(events)))
+	}
+}
+
+// wait 等待指定时间，B2BUA 关闭时返回 false
+func (w *webhook) wait(b *B2BUA, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-b.stopCh:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// deliver 以 JSON POST 投递一批事件，未启用批量投递时只发送单个事件对象
+func (w *webhook) deliver(events []*Event) error {
+	var payload interface{} = events
+	if w.config.BatchSize == 1 {
+		payload = events[0]
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config.Secret != "" {
+		req.Header.Set(webhookSignature, signWebhook(w.config.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook 返回请求体的 HMAC-SHA256 签名，接收方以相同的密钥计算并比较
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// startWebhooks 启动所有 webhook 并订阅事件
+func (b *B2BUA) startWebhooks(configs []WebhookConfig) error {
+	if len(configs) == 0 {
+		return nil
+	}
+	webhooks := make([]*webhook, 0, len(configs))
+	for i, config := range configs {
+		w, err := newWebhook(config, i)
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, w)
+		go w.run(b)
+	}
+
+	b.OnEvent(func(event *Event) {
+		for _, w := range webhooks {
+			if !w.Accepts(event) {
+				continue
+			}
+			if !w.spool.Push(event) { // 队列已满，丢弃事件
+				b.metrics.Inc(MetricWebhook + w.config.Name + ".dropped")
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"fmt"
+	"go-sip-ua/b2bua/b2bua"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-bata/go-prompt"
+	"github.com/ghettovoice/gosip/log" // 导入 gosip 日志包
+	"go-sip-ua/pkg/utils"              // 导入工具函数
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Minute // drain 命令的默认超时时间
+	defaultQualityLimit = 10               // quality 命令默认显示的通话数
+	defaultHistoryLimit = 20               // history 命令默认显示的呼叫数
+)
+
+func init() {
+	registerCommand(&command{name: "help", args: "[命令]", help: "显示命令及用法", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		showHelp(out, args)
+		return nil
+	}})
+	registerCommand(&command{name: "users", aliases: []string{"ul"}, help: "显示 SIP 账户", handler: showUsers})
+	registerCommand(&command{name: "adduser", args: "<用户名> <密码>", help: "添加 SIP 账户并保存到账户文件", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := b2bua.CreateAccount(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已添加账户 %s\n", args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "deluser", args: "<用户名>", help: "删除 SIP 账户并注销其联系地址", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := b2bua.DeleteAccount(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已删除账户 %s\n", args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "passwd", args: "<用户名> [新密码]", help: "修改 SIP 账户的密码，不指定时提示输入", handler: changePassword})
+	registerCommand(&command{name: "setname", args: "<用户名> [显示名称]", help: "修改账户的显示名称并保存到账户文件，不指定时删除", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) < 1 {
+			return errUsage
+		}
+		name := strings.Join(args[1:], " ")
+		if err := b2bua.ChangeDisplayName(args[0], name); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已修改 %s 的显示名称\n", args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "onlines", aliases: []string{"rr"}, args: "[user=用户] [source=地址] [transport=协议]", help: "显示在线的 SIP 设备", handler: showOnlines})
+	registerCommand(&command{name: "calls", aliases: []string{"cl"}, args: "[user=用户] [class=分类]", help: "显示当前通话", handler: showCalls})
+	registerCommand(&command{name: "watch onlines", args: "[interval=秒] [user=用户] [source=地址] [transport=协议]", help: "定时刷新在线设备并高亮变化，按回车退出", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		return watch(b2bua, out, args, onlineFilterKeys, onlineLines)
+	}})
+	registerCommand(&command{name: "watch calls", args: "[interval=秒] [user=用户] [class=分类]", help: "定时刷新当前通话并高亮变化，按回车退出", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		return watch(b2bua, out, args, callFilterKeys, callLines)
+	}})
+	registerCommand(&command{name: "show call", args: "<呼叫ID>", help: "显示通话及其所有分支的详细信息", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		lines, err := callDetailLines(b2bua, args[0])
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "monitor", args: "<呼叫ID> [interval=秒]", help: "定时刷新通话的详细信息并高亮变化，按回车退出", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) == 0 || strings.Contains(args[0], "=") {
+			return errUsage
+		}
+		if _, err := b2bua.CallDetail(args[0]); err != nil {
+			return err
+		}
+		return watch(b2bua, out, args[1:], nil, monitorLines(args[0]))
+	}})
+	registerCommand(&command{name: "hangup", args: "<呼叫ID>", help: "挂断通话：未应答的呼叫返回 487，已建立的分支发送 BYE", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := b2bua.CancelCall(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已挂断 %s\n", args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "transfer", args: "<呼叫ID> <号码|SIP URI>", help: "将已建立的通话盲转到目标，需要启用媒体中继", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := b2bua.TransferCall(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "正在将 %s 转接到 %s\n", args[0], args[1])
+		return nil
+	}})
+	registerCommand(&command{name: "originate", args: "<主叫> <被叫>", help: "第三方呼叫（点击拨号）：先呼叫主叫，应答后呼叫被叫并接通，需要启用媒体中继", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		id, err := b2bua.Originate(args[0], args[1], 0)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "正在呼叫 %s，应答后接通 %s（呼叫 %s）\n", args[0], args[1], id)
+		return nil
+	}})
+	registerCommand(&command{name: "history", args: "[数量]", help: "显示最近结束的呼叫及通话时长和释放原因", handler: showHistory})
+	registerCommand(&command{name: "quality", args: "[数量]", help: "显示媒体质量最差的通话", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		limit := defaultQualityLimit
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return errUsage
+			}
+			limit = n
+		}
+		showQuality(b2bua, out, limit)
+		return nil
+	}})
+	registerCommand(&command{name: "set debug on", help: "开启调试日志", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		b2bua.SetLogLevel(log.DebugLevel) // 设置日志级别为 Debug
+		fmt.Fprintln(out, "已设置日志级别为 debug")
+		return nil
+	}})
+	registerCommand(&command{name: "set debug off", help: "关闭调试日志", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		b2bua.SetLogLevel(log.WarnLevel) // 设置日志级别为 Warn
+		fmt.Fprintln(out, "已设置日志级别为 warn")
+		return nil
+	}})
+	registerCommand(&command{name: "show loggers", help: "打印日志记录器", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		for prefix, log := range utils.GetLoggers() {
+			fmt.Fprintf(out, "%v => %v\n", prefix, log.Level()) // 打印日志记录器及其级别
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "registry flush", help: "清空内存中的注册表", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		b2bua.FlushRegistry()
+		fmt.Fprintln(out, "注册表已清空")
+		return nil
+	}})
+	registerCommand(&command{name: "registry reload", help: "清空注册表并从快照重建", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		report, err := b2bua.ReloadRegistry()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "重建完成: 恢复 %d, 过期 %d, 无效 %d\n", report.Restored, report.Expired, report.Invalid)
+		return nil
+	}})
+	registerCommand(&command{name: "registry reconcile", help: "将注册表与快照对账", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		report, err := b2bua.ReconcileRegistry()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "对账完成: 恢复 %d, 快照缺失 %d, 过期 %d, 无效 %d\n", report.Restored, report.Missing, report.Expired, report.Invalid)
+		return nil
+	}})
+	registerCommand(&command{name: "show contacts", args: "<aor>", help: "显示 AOR（用户名、user@域名或 SIP URI）注册的联系地址", handler: showContacts})
+	registerCommand(&command{name: "unregister", args: "<aor>", help: "注销 AOR 的所有联系地址，用于清除失效的绑定", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		aor, err := b2bua.ParseAOR(args[0])
+		if err != nil {
+			return err
+		}
+		removed, err := b2bua.Unregister(aor)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已注销 %v 的 %d 个联系地址\n", aor, removed)
+		return nil
+	}})
+	registerCommand(&command{name: "flush registrations", help: "注销所有联系地址并保存快照（registry flush 只清空内存）", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		fmt.Fprintf(out, "已注销 %d 个联系地址\n", b2bua.FlushRegistrations())
+		return nil
+	}})
+	registerCommand(&command{name: "bans", help: "显示被临时封禁的来源地址", handler: showBans})
+	registerCommand(&command{name: "unban", args: "<ip>", help: "解除封禁", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if b2bua.Unban(args[0]) {
+			fmt.Fprintf(out, "已解除封禁 %s\n", args[0])
+		} else {
+			fmt.Fprintf(out, "%s 未被封禁\n", args[0])
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "numbers", help: "显示号码黑白名单", handler: showNumbers})
+	registerCommand(&command{name: "numbers add", args: "<租户|*> <callers|callees> <blacklist|whitelist> <号码>", help: "将号码（以 * 结尾为前缀）加入名单", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 4 {
+			return errUsage
+		}
+		if err := b2bua.AddNumber(args[0], args[1], args[2], args[3]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已将 %s 加入 %s %s %s\n", args[3], args[0], args[1], args[2])
+		return nil
+	}})
+	registerCommand(&command{name: "numbers remove", args: "<租户|*> <callers|callees> <blacklist|whitelist> <号码>", help: "从名单中删除号码", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 4 {
+			return errUsage
+		}
+		removed, err := b2bua.RemoveNumber(args[0], args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if removed {
+			fmt.Fprintf(out, "已将 %s 从 %s %s %s 中删除\n", args[3], args[0], args[1], args[2])
+		} else {
+			fmt.Fprintf(out, "%s 不在名单中\n", args[3])
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "metrics", help: "显示计数器", handler: showMetrics})
+	registerCommand(&command{name: "alerts", help: "显示正在告警的内置告警规则", handler: showAlerts})
+	registerCommand(&command{name: "profiles", help: "显示各 SIP profile 的监听、注册数和通话数", handler: showProfiles})
+	registerCommand(&command{name: "conferences", help: "显示进行中的会议室及与会者", handler: showConferences})
+	registerCommand(&command{name: "conference mute", args: "<房间号> <呼叫ID>", help: "将与会者静音", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		return muteParticipant(b2bua, out, args, true)
+	}})
+	registerCommand(&command{name: "conference unmute", args: "<房间号> <呼叫ID>", help: "取消与会者静音", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		return muteParticipant(b2bua, out, args, false)
+	}})
+	registerCommand(&command{name: "queues", help: "显示呼叫队列的统计和坐席状态", handler: showQueues})
+	registerCommand(&command{name: "nodes", help: "显示水平扩展的其它节点及共享的注册数", handler: showNodes})
+	registerCommand(&command{name: "cluster", help: "显示主备角色和复制状态", handler: showCluster})
+	registerCommand(&command{name: "cluster role", args: "<active|standby>", help: "切换主备角色", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := b2bua.SetClusterRole(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已切换为 %s\n", args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "dispatcher", help: "显示负载分发各目标的状态", handler: showDispatcher})
+	registerCommand(&command{name: "queue agent", args: "<队列> <坐席> <available|busy>", help: "设置坐席空闲或示忙", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 3 {
+			return errUsage
+		}
+		if err := b2bua.SetAgentState(args[0], args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已将队列 %s 的坐席 %s 设置为 %s\n", args[0], args[1], args[2])
+		return nil
+	}})
+	registerCommand(&command{name: "conference kick", args: "<房间号> <呼叫ID>", help: "将与会者移出会议室并挂断", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := b2bua.KickParticipant(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已将 %s 移出会议室 %s\n", args[1], args[0])
+		return nil
+	}})
+	registerCommand(&command{name: "export state", args: "[--format json|prom] [> 文件]", help: "导出计数器、通话和注册的快照，不指定文件时输出到控制台", handler: exportState})
+	registerCommand(&command{name: "tls", help: "显示 TLS 证书", handler: showCertificates})
+	registerCommand(&command{name: "tls reload", help: "重新加载 TLS 证书", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if err := b2bua.ReloadCertificates(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "已重新加载 TLS 证书")
+		return nil
+	}})
+	registerCommand(&command{name: "config show effective", args: "[tenant=域名] [listener=协议] [profile=名称] [trunk=名称]", help: "显示按层级合并后生效的配置", handler: showEffectiveConfig})
+	registerCommand(&command{name: "upstream", help: "显示上游注册服务器状态（是否处于生存模式）", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if b2bua.SurvivalMode() {
+			fmt.Fprintln(out, "上游不可用，处于生存模式")
+		} else {
+			fmt.Fprintln(out, "上游正常")
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "trace", args: "[<ip|user> [文件]]", help: "跟踪对端的 SIP 消息，不带参数时列出跟踪", handler: trace})
+	registerCommand(&command{name: "untrace", args: "<ip|user>", help: "停止跟踪", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if b2bua.StopTrace(args[0]) {
+			fmt.Fprintf(out, "已停止跟踪 %s\n", args[0])
+		} else {
+			fmt.Fprintf(out, "%s 未被跟踪\n", args[0])
+		}
+		return nil
+	}})
+	registerCommand(&command{name: "drain", args: "[超时秒数]", help: "排空: 停止接受新呼叫和注册，通话结束后退出", handler: drain})
+	registerCommand(&command{name: "version", help: "显示版本", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		identity := b2bua.Identity()
+		fmt.Fprintf(out, "%s %s (build %s)\nUser-Agent: %s\nServer: %s\n", identity.Name, identity.Version, identity.Build, identity.UserAgent, identity.Server)
+		return nil
+	}})
+	registerCommand(&command{name: "exit", help: "退出程序", handler: func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+		fmt.Fprintln(out, "正在退出...")
+		b2bua.Shutdown() // 关闭 B2BUA
+		return errExit
+	}})
+}
+
+// showUsers 打印 SIP 账户
+func showUsers(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	accounts := b2bua.GetAccounts() // 获取所有账户
+	if len(accounts) == 0 {
+		fmt.Fprintln(out, "没有用户")
+		return nil
+	}
+	fmt.Fprintln(out, "用户:")
+	fmt.Fprintln(out, "用户名 \t 密码 \t 显示名称")
+	for user, pass := range accounts {
+		fmt.Fprintf(out, "%v \t\t %v \t %v\n", user, pass, b2bua.DisplayName(user)) // 打印用户名、密码和显示名称
+	}
+	return nil
+}
+
+// changePassword 修改账户密码，未在参数中给出新密码时提示输入两次
+func changePassword(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	if len(args) == 2 {
+		if err := b2bua.SetPassword(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "已修改 %s 的密码\n", args[0])
+		return nil
+	}
+	if _, found := b2bua.GetAccounts()[args[0]]; !found {
+		return fmt.Errorf("账户 %s 不存在", args[0])
+	}
+	if !interactive(out) { // 管理套接字需要在参数中给出新密码
+		return errUsage
+	}
+	noSuggest := func(prompt.Document) []prompt.Suggest { return nil }
+	password := prompt.Input("新密码: ", noSuggest)
+	if password == "" {
+		return errUsage
+	}
+	if prompt.Input("确认新密码: ", noSuggest) != password {
+		return fmt.Errorf("两次输入的密码不一致")
+	}
+	if err := b2bua.SetPassword(args[0], password); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "已修改 %s 的密码\n", args[0])
+	return nil
+}
+
+// showOnlines 打印匹配过滤条件的在线设备
+func showOnlines(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	filter, err := parseFilter(args, onlineFilterKeys)
+	if err != nil {
+		return err
+	}
+	lines := onlineLines(b2bua, filter)
+	if len(lines) == 0 {
+		fmt.Fprintln(out, "没有在线的设备")
+		return nil
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
+
+// showCalls 打印匹配过滤条件的当前通话
+func showCalls(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	filter, err := parseFilter(args, callFilterKeys)
+	if err != nil {
+		return err
+	}
+	lines := callLines(b2bua, filter)
+	if len(lines) == 0 {
+		fmt.Fprintln(out, "没有活跃的通话")
+		return nil
+	}
+	fmt.Fprintln(out, "通话:")
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
+
+// showContacts 打印 AOR 注册的联系地址及剩余有效期
+func showContacts(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	aor, err := b2bua.ParseAOR(args[0])
+	if err != nil {
+		return err
+	}
+	instances := b2bua.Contacts(aor)
+	if len(instances) == 0 {
+		fmt.Fprintf(out, "%v 没有注册的联系地址\n", aor)
+		return nil
+	}
+	fmt.Fprintf(out, "%v 的联系地址:\n", aor)
+	now := time.Now().Unix()
+	for _, instance := range instances {
+		contact := ""
+		if instance.Contact != nil && instance.Contact.Address != nil {
+			contact = instance.Contact.Address.String()
+		}
+		fmt.Fprintf(out, "%v, q: %v, 剩余: %ds, 来源: %v, 传输协议: %v, %v\n", contact, instance.Q,
+			int64(instance.LastUpdated)+int64(instance.RegExpires)-now, instance.Source, instance.Transport, instance.UserAgent)
+		if instance.InstanceID != "" {
+			fmt.Fprintf(out, "    +sip.instance: %v, reg-id: %v\n", instance.InstanceID, instance.RegID)
+		}
+		if instance.Node != "" {
+			fmt.Fprintf(out, "    节点: %v\n", instance.Node)
+		}
+	}
+	return nil
+}
+
+// showHistory 打印最近结束的呼叫，最近结束的在前
+func showHistory(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	limit := defaultHistoryLimit
+	if len(args) > 1 {
+		return errUsage
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return errUsage
+		}
+		limit = n
+	}
+	cdrs := b2bua.CallHistory(limit)
+	if len(cdrs) == 0 {
+		fmt.Fprintln(out, "没有已结束的呼叫")
+		return nil
+	}
+	fmt.Fprintln(out, "结束时间 \t 呼叫 \t 主叫 => 被叫 \t 结果 \t 时长 \t 释放原因")
+	for _, cdr := range cdrs {
+		cause := string(cdr.Cause)
+		if cdr.CauseCode != 0 {
+			cause = fmt.Sprintf("%v (%d)", cdr.Cause, cdr.CauseCode)
+		}
+		fmt.Fprintf(out, "%v \t %v \t %v => %v \t %v \t %.0fs \t %v\n", cdr.End.Format("2006-01-02 15:04:05"),
+			cdr.CallID, cdr.Caller, cdr.Callee, cdr.Disposition, cdr.Duration, cause)
+	}
+	return nil
+}
+
+// showBans 打印封禁的来源地址
+func showBans(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	bans := b2bua.Bans()
+	if len(bans) == 0 {
+		fmt.Fprintln(out, "没有被封禁的地址")
+		return nil
+	}
+	fmt.Fprintln(out, "地址 \t 原因 \t 解封时间")
+	for _, ban := range bans {
+		fmt.Fprintf(out, "%v \t %v \t %v\n", ban.IP, ban.Reason, ban.Until.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// showAlerts 打印正在告警的规则
+func showAlerts(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	alerts := b2bua.Alerts()
+	if len(alerts) == 0 {
+		fmt.Fprintln(out, "没有告警")
+		return nil
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Since.Before(alerts[j].Since) })
+	fmt.Fprintln(out, "规则 \t 中继 \t 开始时间 \t 说明")
+	for _, alert := range alerts {
+		fmt.Fprintf(out, "%v \t %v \t %v \t %v\n", alert.Rule, alert.Trunk, alert.Since.Format("2006-01-02 15:04:05"), alert.Message)
+	}
+	return nil
+}
+
+// showProfiles 打印各 SIP profile 的监听、注册数和通话数
+func showProfiles(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	fmt.Fprintln(out, "名称 \t 监听 \t 注册数 \t 通话数 \t 域名 \t 可桥接到")
+	for _, profile := range b2bua.Profiles() {
+		fmt.Fprintf(out, "%v \t %v \t %v \t %v \t %v \t %v\n", profile.Name, strings.Join(profile.Listeners, ","),
+			profile.Registrations, profile.Calls, strings.Join(profile.Domains, ","), strings.Join(profile.Bridge, ","))
+	}
+	return nil
+}
+
+// showConferences 打印进行中的会议室及与会者
+func showConferences(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	rooms := b2bua.Conferences()
+	if len(rooms) == 0 {
+		fmt.Fprintln(out, "没有进行中的会议")
+		return nil
+	}
+	for _, room := range rooms {
+		fmt.Fprintf(out, "会议室 %v \t %d 人 \t 开始于 %v\n", room.Name, len(room.Participants), room.Created.Format("2006-01-02 15:04:05"))
+		for _, p := range room.Participants {
+			muted := ""
+			if p.Muted {
+				muted = "静音"
+			}
+			fmt.Fprintf(out, "  %v \t %v \t %v \t %v\n", p.ID, p.Caller, p.Joined.Format("15:04:05"), muted)
+		}
+	}
+	return nil
+}
+
+// showQueues 打印呼叫队列的统计和坐席状态
+func showQueues(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	queues := b2bua.Queues()
+	if len(queues) == 0 {
+		fmt.Fprintln(out, "没有配置呼叫队列")
+		return nil
+	}
+	for _, q := range queues {
+		fmt.Fprintf(out, "队列 %v (%v) \t %v \t 等待 %d，最长 %.0fs \t 进入 %d \t 应答 %d \t 放弃 %d \t 超时 %d \t 平均等待 %.1fs\n",
+			q.Name, q.Number, q.Strategy, q.Waiting, q.LongestWait, q.Entered, q.Answered, q.Abandoned, q.TimedOut, q.AverageWait)
+		for _, agent := range q.Agents {
+			fmt.Fprintf(out, "  %v \t %v \t 应答 %d \t 空闲自 %v\n", agent.User, agent.State, agent.Answered, agent.IdleSince.Format("15:04:05"))
+		}
+	}
+	return nil
+}
+
+// showNodes 打印水平扩展的其它节点及共享的注册数
+func showNodes(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	nodes := b2bua.Nodes()
+	if len(nodes) == 0 {
+		fmt.Fprintln(out, "没有启用水平扩展")
+		return nil
+	}
+	for _, node := range nodes {
+		lastSync := "-"
+		if !node.LastSync.IsZero() {
+			lastSync = node.LastSync.Format("15:04:05")
+		}
+		fmt.Fprintf(out, "%v \t %v \t 注册 %d \t 最近同步 %v \t %v\n", node.Node, node.SIP, node.Registrations, lastSync, node.LastError)
+	}
+	return nil
+}
+
+// showCluster 打印主备角色和复制状态
+func showCluster(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	status := b2bua.Cluster()
+	if status == nil {
+		fmt.Fprintln(out, "没有启用主备")
+		return nil
+	}
+	fmt.Fprintf(out, "实例 %v \t 角色 %v \t 对端 %v \t 通话 %d\n", status.Node, status.Role, status.Peer, status.Calls)
+	if !status.LastSync.IsZero() {
+		fmt.Fprintf(out, "最近同步 %v\n", status.LastSync.Format("2006-01-02 15:04:05"))
+	}
+	if status.LastError != "" {
+		fmt.Fprintf(out, "错误 %v\n", status.LastError)
+	}
+	return nil
+}
+
+// showDispatcher 打印负载分发各目标的状态
+func showDispatcher(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	targets := b2bua.Dispatcher()
+	if len(targets) == 0 {
+		fmt.Fprintln(out, "没有启用负载分发")
+		return nil
+	}
+	for _, target := range targets {
+		state := "可用"
+		if !target.Up {
+			state = "不可用"
+		}
+		fmt.Fprintf(out, "%v \t 权重 %d \t %v \t 呼叫 %d \t 连续失败 %d \t %v\n", target.URI, target.Weight, state, target.Calls, target.Failures, target.LastError)
+	}
+	return nil
+}
+
+// muteParticipant 将与会者静音或取消静音
+func muteParticipant(b2bua *b2bua.B2BUA, out io.Writer, args []string, muted bool) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	if err := b2bua.MuteParticipant(args[0], args[1], muted); err != nil {
+		return err
+	}
+	if muted {
+		fmt.Fprintf(out, "已将 %s 静音\n", args[1])
+	} else {
+		fmt.Fprintf(out, "已取消 %s 静音\n", args[1])
+	}
+	return nil
+}
+
+// showNumbers 按租户打印号码黑白名单
+func showNumbers(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	lists := b2bua.NumberLists()
+	if len(lists) == 0 {
+		fmt.Fprintln(out, "没有号码名单")
+		return nil
+	}
+	tenants := make([]string, 0, len(lists))
+	for tenant := range lists {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	fmt.Fprintln(out, "租户 \t 类型 \t 名单 \t 号码")
+	for _, tenant := range tenants {
+		l := lists[tenant]
+		for _, list := range []struct {
+			kind, name string
+			numbers    []string
+		}{
+			{"callers", "blacklist", l.Callers.Blacklist},
+			{"callers", "whitelist", l.Callers.Whitelist},
+			{"callees", "blacklist", l.Callees.Blacklist},
+			{"callees", "whitelist", l.Callees.Whitelist},
+		} {
+			if len(list.numbers) > 0 {
+				fmt.Fprintf(out, "%v \t %v \t %v \t %v\n", tenant, list.kind, list.name, strings.Join(list.numbers, ","))
+			}
+		}
+	}
+	return nil
+}
+
+// showMetrics 按名称顺序打印计数器
+func showMetrics(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	metrics := b2bua.Metrics()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%v \t %v\n", name, metrics[name])
+	}
+	return nil
+}
+
+// exportState 将状态快照写到控制台或文件
+func exportState(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	format, file := "json", ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--format" && i+1 < len(args):
+			format = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--format="):
+			format = strings.TrimPrefix(args[i], "--format=")
+		case args[i] == ">" && i+1 < len(args):
+			file = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], ">") && len(args[i]) > 1:
+			file = args[i][1:]
+		default:
+			return errUsage
+		}
+	}
+	if file == "" {
+		return b2bua.ExportState(out, format)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := b2bua.ExportState(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "已导出到 %s\n", file)
+	return nil
+}
+
+// showCertificates 打印 TLS 证书
+func showCertificates(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	certs := b2bua.Certificates()
+	if len(certs) == 0 {
+		fmt.Fprintln(out, "未启用 TLS")
+		return nil
+	}
+	fmt.Fprintln(out, "证书 \t 域名 \t 到期时间")
+	for _, cert := range certs {
+		fmt.Fprintf(out, "%v \t %v \t %v\n", cert.Cert, strings.Join(cert.Names, ","), cert.NotAfter.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// trace 按对端跟踪 SIP 消息，不带参数时列出跟踪
+func trace(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+		for _, trace := range b2bua.Traces() {
+			output := trace.File
+			if output == "" {
+				output = "控制台"
+			}
+			fmt.Fprintf(out, "%v \t %v \t %v\n", trace.Target, output, trace.Started.Format("2006-01-02 15:04:05"))
+		}
+	case 1, 2:
+		file := ""
+		if len(args) == 2 {
+			file = args[1]
+		}
+		if _, err := b2bua.StartTrace(args[0], file); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "正在跟踪 %s\n", args[0])
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// drain 进入排空模式，等待通话结束或超时后退出命令行
+func drain(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	timeout := defaultDrainTimeout
+	if len(args) > 0 {
+		seconds, err := strconv.Atoi(args[0])
+		if err != nil || seconds <= 0 {
+			return errUsage
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	fmt.Fprintf(out, "正在排空，当前通话数: %d，超时: %v\n", len(b2bua.Calls()), timeout)
+	<-b2bua.Drain(timeout) // 等待通话结束或超时
+	fmt.Fprintln(out, "排空完成，正在退出...")
+	return errExit
+}
+
+// showQuality 按 MOS 升序打印媒体质量最差的通话，每路显示丢包率、抖动、往返时延和 MOS
+func showQuality(b2bua *b2bua.B2BUA, out io.Writer, limit int) {
+	reports := b2bua.WorstQuality(limit)
+	if len(reports) == 0 {
+		fmt.Fprintln(out, "没有经过媒体中继的活跃通话")
+		return
+	}
+	fmt.Fprintln(out, "通话 \t MOS \t A 路 丢包/抖动/时延 \t B 路 丢包/抖动/时延")
+	for _, report := range reports {
+		q := report.Quality
+		fmt.Fprintf(out, "%v (%v => %v) \t %.2f \t %.1f%%/%.0fms/%.0fms \t %.1f%%/%.0fms/%.0fms\n",
+			report.Call.ID, report.Call.Caller, report.Call.Callee, q.MOS,
+			q.A.Loss, q.A.Jitter, q.A.RTT, q.B.Loss, q.B.Jitter, q.B.RTT)
+	}
+}
+
+// showEffectiveConfig 打印按 全局 -> 租户 -> 监听 -> profile -> 中继 合并后生效的配置及来源层级
+func showEffectiveConfig(b2bua *b2bua.B2BUA, out io.Writer, args []string) error {
+	scope := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || (kv[0] != "tenant" && kv[0] != "listener" && kv[0] != "profile" && kv[0] != "trunk") {
+			return errUsage
+		}
+		scope[kv[0]] = kv[1]
+	}
+	effective, err := b2bua.EffectiveConfig(scope["tenant"], scope["listener"], scope["profile"], scope["trunk"])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "auth \t %v \t (%v)\n", effective.Auth.Value, effective.Auth.Source)
+	fmt.Fprintf(out, "media_mode \t %v \t (%v)\n", effective.MediaMode.Value, effective.MediaMode.Source)
+	fmt.Fprintf(out, "header_profile \t %v \t (%v)\n", effective.HeaderProfile.Value, effective.HeaderProfile.Source)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-sip-ua/b2bua/b2bua"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/c-bata/go-prompt" // 导入 go-prompt 包，用于命令行交互
+)
+
+var (
+	errUsage       = errors.New("usage")         // 命令参数错误，打印命令的用法
+	errExit        = errors.New("exit console")  // 退出命令行交互循环
+	errInteractive = errors.New("只能在命令行交互模式中使用") // 需要从终端读取输入的命令经管理套接字执行
+)
+
+// interactive 检查命令的输出是否为终端（命令行交互模式），管理套接字执行的命令输出到缓冲区
+func interactive(out io.Writer) bool {
+	return out == os.Stdout
+}
+
+// command 命令行命令，自动补全和 help 命令由注册的命令生成
+type command struct {
+	name    string                                                       // 命令名称，可以由多个单词组成（如 registry flush）
+	aliases []string                                                     // 别名，不出现在自动补全中
+	args    string                                                       // 参数说明，如 <ip> [文件]
+	help    string                                                       // 说明
+	handler func(b2bua *b2bua.B2BUA, out io.Writer, args []string) error // 处理函数，args 为命令名称之后的参数
+}
+
+// commands 按注册顺序保存的命令
+var commands []*command
+
+// registerCommand 注册命令行命令，在 init 中调用
+func registerCommand(cmd *command) {
+	commands = append(commands, cmd)
+}
+
+// usageOf 返回命令的用法
+func (c *command) usageOf() string {
+	if c.args == "" {
+		return c.name
+	}
+	return c.name + " " + c.args
+}
+
+// matches 返回命令名称或别名匹配输入时名称占用的单词数，不匹配时返回 0
+func (c *command) matches(words []string) int {
+	for _, name := range append([]string{c.name}, c.aliases...) {
+		fields := strings.Fields(name)
+		if len(words) >= len(fields) && strings.EqualFold(strings.Join(words[:len(fields)], " "), name) {
+			return len(fields)
+		}
+	}
+	return 0
+}
+
+// findCommand 返回匹配输入的最长的命令及其参数
+func findCommand(words []string) (*command, []string) {
+	var found *command
+	length := 0
+	for _, cmd := range commands {
+		if n := cmd.matches(words); n > length {
+			found, length = cmd, n
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return found, words[length:]
+}
+
+// completer 按注册的命令提供自动补全的建议，多个单词的命令逐词补全
+func completer(d prompt.Document) []prompt.Suggest {
+	input := strings.ToLower(strings.TrimLeft(d.TextBeforeCursor(), " "))
+	start := len(input) - len(d.GetWordBeforeCursor())
+	var suggests []prompt.Suggest
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd.name, input) {
+			description := cmd.help
+			if cmd.args != "" {
+				description += " (" + cmd.usageOf() + ")"
+			}
+			suggests = append(suggests, prompt.Suggest{Text: cmd.name[start:], Description: description})
+		}
+	}
+	return suggests
+}
+
+// showHelp 打印所有命令或指定命令的用法和说明
+func showHelp(out io.Writer, args []string) {
+	if len(args) > 0 {
+		cmd, _ := findCommand(args)
+		if cmd == nil {
+			fmt.Fprintf(out, "未知命令: %s\n", strings.Join(args, " "))
+			return
+		}
+		fmt.Fprintf(out, "用法: %s\n%s\n", cmd.usageOf(), cmd.help)
+		if len(cmd.aliases) > 0 {
+			fmt.Fprintf(out, "别名: %s\n", strings.Join(cmd.aliases, ", "))
+		}
+		return
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "%v \t %v\n", cmd.usageOf(), cmd.help)
+	}
+}
+
+// runCommand 执行一行输入，输出写到 out，返回 false 时退出命令行交互循环
+func runCommand(b2bua *b2bua.B2BUA, out io.Writer, input string) bool {
+	words := strings.Fields(input)
+	if len(words) == 0 {
+		return true
+	}
+	cmd, args := findCommand(words)
+	if cmd == nil {
+		fmt.Fprintf(out, "未知命令: %s，输入 help 查看命令\n", words[0])
+		return true
+	}
+	switch err := cmd.handler(b2bua, out, args); err {
+	case nil:
+	case errUsage:
+		fmt.Fprintf(out, "用法: %s\n", cmd.usageOf())
+	case errExit:
+		return false
+	default:
+		fmt.Fprintf(out, "%s 失败: %v\n", cmd.name, err)
+	}
+	return true
+}
+
+// consoleLoop 运行命令行交互循环
+func consoleLoop(b2bua *b2bua.B2BUA) {
+	fmt.Println("请选择一个命令，输入 help 查看命令。")
+	for {
+		// 使用 go-prompt 实现命令行输入
+		input := prompt.Input("CLI> ", completer,
+			prompt.OptionTitle(b2bua.Identity().Banner),                 // 设置命令行标题
+			prompt.OptionHistory([]string{"calls", "users", "onlines"}), // 设置历史命令
+			prompt.OptionPrefixTextColor(prompt.Yellow),                 // 设置前缀文本颜色
+			prompt.OptionPreviewSuggestionTextColor(prompt.Blue),        // 设置补全建议预览颜色
+			prompt.OptionSelectedSuggestionBGColor(prompt.LightGray),    // 设置选中建议的背景颜色
+			prompt.OptionSuggestionBGColor(prompt.DarkGray))             // 设置建议的背景颜色
+
+		if !runCommand(b2bua, os.Stdout, input) {
+			return
+		}
+	}
+}
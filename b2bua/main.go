@@ -9,114 +9,41 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-
-	"github.com/c-bata/go-prompt"      // 导入 go-prompt 包，用于命令行交互
-	"github.com/ghettovoice/gosip/log" // 导入 gosip 日志包
-	"go-sip-ua/pkg/utils"              // 导入工具函数
 )
 
-// completer 提供命令行自动补全的建议
-func completer(d prompt.Document) []prompt.Suggest {
-	return prompt.FilterHasPrefix([]prompt.Suggest{
-		{Text: "users", Description: "显示 SIP 账户"},
-		{Text: "onlines", Description: "显示在线的 SIP 设备"},
-		{Text: "calls", Description: "显示当前通话"},
-		{Text: "set debug on", Description: "开启调试日志"},
-		{Text: "set debug off", Description: "关闭调试日志"},
-		{Text: "show loggers", Description: "打印日志记录器"},
-		{Text: "exit", Description: "退出程序"},
-	}, d.GetWordBeforeCursor(), true)
-}
-
 // usage 打印命令行使用说明
 func usage() {
-	fmt.Fprintf(os.Stderr, `go pbx 版本: go-pbx/1.10.0
+	fmt.Fprintf(os.Stderr, `%s 版本: %s
 用法: server [-nc]
 
 选项:
-`)
+`, b2bua.ProductName, b2bua.Version)
 	flag.PrintDefaults()
 }
 
-// consoleLoop 运行命令行交互循环
-func consoleLoop(b2bua *b2bua.B2BUA) {
-	fmt.Println("请选择一个命令。")
-	for {
-		// 使用 go-prompt 实现命令行输入
-		input := prompt.Input("CLI> ", completer,
-			prompt.OptionTitle("GO B2BUA 1.0.0"),                        // 设置命令行标题
-			prompt.OptionHistory([]string{"calls", "users", "onlines"}), // 设置历史命令
-			prompt.OptionPrefixTextColor(prompt.Yellow),                 // 设置前缀文本颜色
-			prompt.OptionPreviewSuggestionTextColor(prompt.Blue),        // 设置补全建议预览颜色
-			prompt.OptionSelectedSuggestionBGColor(prompt.LightGray),    // 设置选中建议的背景颜色
-			prompt.OptionSuggestionBGColor(prompt.DarkGray))             // 设置建议的背景颜色
-
-		// 根据用户输入执行相应操作
-		switch input {
-		case "show loggers": // 显示日志记录器
-			loggers := utils.GetLoggers() // 获取所有日志记录器
-			for prefix, log := range loggers {
-				fmt.Printf("%v => %v\n", prefix, log.Level()) // 打印日志记录器及其级别
-			}
-		case "set debug on": // 开启调试日志
-			b2bua.SetLogLevel(log.DebugLevel) // 设置日志级别为 Debug
-			fmt.Println("已设置日志级别为 debug")
-		case "set debug off": // 关闭调试日志
-			b2bua.SetLogLevel(log.WarnLevel) // 设置日志级别为 Info
-			fmt.Println("已设置日志级别为 warn")
-		case "users", "ul": // 显示 SIP 账户
-			accounts := b2bua.GetAccounts() // 获取所有账户
-			if len(accounts) > 0 {
-				fmt.Println("用户:")
-				fmt.Println("用户名 \t 密码")
-				for user, pass := range accounts {
-					fmt.Printf("%v \t\t %v\n", user, pass) // 打印用户名和密码
-				}
-			} else {
-				fmt.Println("没有用户")
-			}
-		case "calls", "cl": // 显示当前通话
-			calls := b2bua.Calls() // 获取所有通话
-			if len(calls) > 0 {
-				fmt.Println("通话:")
-				for _, call := range calls {
-					fmt.Printf("%v:\n", call.String()) // 打印通话信息
-				}
-			} else {
-				fmt.Println("没有活跃的通话")
-			}
-		case "onlines", "rr": // 显示在线设备
-			aors := b2bua.GetRegistry().GetAllContacts() // 获取所有注册记录
-			if len(aors) > 0 {
-				for aor, instances := range aors {
-					fmt.Printf("AOR: %v:\n", aor) // 打印 AOR（Address of Record）
-					for _, instance := range instances {
-						fmt.Printf("\t%v, 过期时间: %d, 来源: %v, 传输协议: %v\n",
-							(*instance).UserAgent, (*instance).RegExpires, (*instance).Source, (*instance).Transport)
-					}
-				}
-			} else {
-				fmt.Println("没有在线的设备")
-			}
-		case "exit": // 退出程序
-			fmt.Println("正在退出...")
-			b2bua.Shutdown() // 关闭 B2BUA
-			return
-		}
-	}
-}
-
 func main() {
 	var (
-		noconsole   bool // 是否禁用命令行交互模式
-		disableAuth bool // 是否禁用认证
-		enableTLS   bool // 是否启用 TLS
-		h           bool // 是否显示帮助信息
+		noconsole   bool   // 是否禁用命令行交互模式
+		disableAuth bool   // 是否禁用认证
+		enableTLS   bool   // 是否启用 TLS
+		fpPolicy    string // 设备指纹异常处理策略
+		snapshot    string // 注册表快照文件
+		accounts    string // 账户文件
+		socket      string // 管理套接字地址
+		upstream    string // 上游注册服务器
+		configFile  string // 配置文件
+		h           bool   // 是否显示帮助信息
 	)
 	flag.BoolVar(&h, "h", false, "显示帮助信息")
+	flag.StringVar(&configFile, "c", "", "JSON 配置文件，命令行参数优先")
 	flag.BoolVar(&noconsole, "nc", false, "禁用命令行交互模式")
 	flag.BoolVar(&disableAuth, "da", false, "禁用认证")
 	flag.BoolVar(&enableTLS, "tls", false, "启用 TLS")
+	flag.StringVar(&fpPolicy, "fp", "", "注册设备指纹异常处理策略: alert|reauth|block")
+	flag.StringVar(&snapshot, "rs", "", "注册表快照文件，为空时不持久化注册信息")
+	flag.StringVar(&accounts, "af", "", "账户文件，保存命令行增删的账户和修改的密码，为空时使用示例账户")
+	flag.StringVar(&socket, "as", "", "管理套接字地址（unix:路径 或 host:port），接受与命令行相同的命令，每行一个 JSON 请求")
+	flag.StringVar(&upstream, "ru", "", "上游注册服务器，设置后将 REGISTER 转发到上游（例如 sip:registrar.example.com）")
 	flag.Usage = usage // 设置帮助信息函数
 	flag.Parse()       // 解析命令行参数
 
@@ -128,22 +55,84 @@ func main() {
 	stop := make(chan os.Signal, 1)                      // 创建一个信号通道
 	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT) // 监听 SIGTERM 和 SIGINT 信号
 
+	config := &b2bua.B2BUAConfig{}
+	if configFile != "" { // 加载配置文件
+		c, err := b2bua.LoadConfig(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "加载配置文件失败: %v\n", err)
+			os.Exit(1)
+		}
+		config = c
+	}
+	flag.Visit(func(f *flag.Flag) { // 显式指定的命令行参数覆盖配置文件
+		switch f.Name {
+		case "da":
+			config.DisableAuth = disableAuth
+		case "tls":
+			config.EnableTLS = enableTLS
+		case "fp":
+			config.Fingerprint.Policy = b2bua.FingerprintPolicy(fpPolicy)
+		case "rs":
+			config.RegistrySnapshot = snapshot
+		case "af":
+			config.AccountsFile = accounts
+		case "as":
+			config.Listen.Socket.Address = socket
+		case "ru":
+			config.RegisterRelay.Upstream = upstream
+		}
+	})
+
+	b2bua := b2bua.NewB2BUA(config) // 创建 B2BUA 实例
+
+	if addr := config.Listen.AdminAddress(); addr != "" {
+		go func() {
+			fmt.Printf("正在启动管理接口，地址 %s\n", addr)
+			if err := b2bua.ServeAPI(addr); err != nil { // REST 管理接口，需要令牌或客户端证书
+				fmt.Fprintf(os.Stderr, "管理接口退出: %v\n", err)
+			}
+		}()
+	}
+	if addr := config.Listen.PprofAddress(); addr != "" {
+		go func() {
+			fmt.Printf("正在启动 pprof，地址 %s\n", addr)
+			http.ListenAndServe(addr, nil) // 性能分析，单独监听
+		}()
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP) // 收到 SIGHUP 时重新加载 TLS 证书
 	go func() {
-		fmt.Println("正在启动 pprof，端口 :6658")
-		http.ListenAndServe(":6658", nil) // 启动 HTTP 服务器，用于性能分析
+		for range reload {
+			b2bua.ReloadCertificates()
+		}
 	}()
 
-	b2bua := b2bua.NewB2BUA(disableAuth, enableTLS) // 创建 B2BUA 实例
+	if config.AccountsFile == "" { // 未配置账户文件时添加示例账户
+		b2bua.AddAccount("100", "100")
+		b2bua.AddAccount("200", "200")
+	}
 
-	// 添加示例账户
-	b2bua.AddAccount("100", "100")
-	b2bua.AddAccount("200", "200")
+	if addr := config.Listen.SocketAddress(); addr != "" {
+		listener, err := listenAdmin(addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "启动管理套接字失败: %v\n", err)
+			os.Exit(1)
+		}
+		defer listener.Close()
+		fmt.Printf("正在启动管理套接字，地址 %s\n", addr)
+		go serveAdmin(b2bua, listener)
+	}
 
 	if !noconsole { // 如果未禁用命令行交互模式
 		consoleLoop(b2bua) // 进入命令行交互循环
 		return
 	}
 
-	<-stop           // 等待信号
-	b2bua.Shutdown() // 关闭 B2BUA
+	select {
+	case <-stop: // 等待信号
+		b2bua.Shutdown() // 关闭 B2BUA
+	case <-quit: // 经管理套接字执行了 exit 或 drain
+	case <-b2bua.Drained(): // 经 REST 接口排空完成
+	}
 }
@@ -2,152 +2,260 @@ package registry
 
 import (
 	"fmt"
+	"hash/fnv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/transport"
 )
 
-// MemoryRegistry 是一个基于内存的 Address-of-Record (AOR) 注册表，使用 sync.Mutex 保证并发安全。
+// registryShards 是 MemoryRegistry 的分片数，写操作只锁定 AOR 所在的分片。
+const registryShards = 4096
+
+// MemoryRegistry 是一个基于内存的 Address-of-Record (AOR) 注册表。AOR 按规范化的键分布在多个分片中，
+// 每个分片的内容只读、写时复制：查询不加锁，写操作只串行化同一分片内的修改，适合大量注册频繁刷新的场景。
 type MemoryRegistry struct {
-	mutex *sync.Mutex                             // 用于并发控制的互斥锁
-	aors  map[sip.Uri]map[string]*ContactInstance // 存储 AOR 和其对应的联系人实例
+	shards [registryShards]registryShard
+}
+
+// registryShard 是注册表的一个分片。
+type registryShard struct {
+	mutex sync.Mutex   // 串行化本分片的写操作
+	aors  atomic.Value // map[string]*aorEntry，发布后不再修改
+}
+
+// aorEntry 是一个 AOR 及其联系实例，instances 发布后不再修改。
+type aorEntry struct {
+	aor       sip.Uri
+	instances map[string]*ContactInstance // 绑定（来源地址和联系地址）-> 联系实例
 }
 
 // NewMemoryRegistry 创建一个新的 MemoryRegistry 实例。
 func NewMemoryRegistry() *MemoryRegistry {
-	return &MemoryRegistry{
-		aors:  make(map[sip.Uri]map[string]*ContactInstance),
-		mutex: new(sync.Mutex),
+	mr := &MemoryRegistry{}
+	for i := range mr.shards {
+		mr.shards[i].aors.Store(map[string]*aorEntry{})
 	}
+	return mr
 }
 
-// AddAor 添加一个 AOR 和对应的联系人实例到注册表中。
-func (mr *MemoryRegistry) AddAor(aor sip.Uri, instance *ContactInstance) error {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
+// AORKey 返回 AOR 的规范形式 user@host，用作注册表的键：按 RFC 3261 19.1.4 比较 URI 的规则，用户部分区分大小写，
+// 主机部分不区分大小写（转为小写），去掉 scheme、端口和参数。
+func AORKey(aor sip.Uri) string {
+	if aor == nil {
+		return ""
+	}
+	key := strings.ToLower(strings.Trim(aor.Host(), "[]"))
+	if aor.User() != nil && aor.User().String() != "" {
+		key = aor.User().String() + "@" + key
+	}
+	return key
+}
+
+// shard 返回键所在的分片。
+func (mr *MemoryRegistry) shard(key string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &mr.shards[h.Sum32()%registryShards]
+}
+
+// load 返回分片当前的内容。
+func (s *registryShard) load() map[string]*aorEntry {
+	return s.aors.Load().(map[string]*aorEntry)
+}
+
+// update 在分片的写锁内以 fn 修改 key 的联系实例（传入副本，AOR 不存在时为空），fn 返回 false 时不修改。
+// 修改后没有联系实例的 AOR 被移除。
+func (s *registryShard) update(key string, aor sip.Uri, fn func(instances map[string]*ContactInstance) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current := s.load()
+	entry := current[key]
+	instances := make(map[string]*ContactInstance)
+	if entry != nil {
+		aor = entry.aor
+		for source, instance := range entry.instances {
+			instances[source] = instance
+		}
+	}
+	if !fn(instances) {
+		return
+	}
 
-	instances, _ := findInstances(mr.aors, aor)
-	if instances != nil {
-		(*instances)[instance.Source] = instance // 如果 AOR 已存在，更新联系人实例
-		return nil
+	next := make(map[string]*aorEntry, len(current)+1)
+	for k, v := range current {
+		next[k] = v
 	}
+	if len(instances) == 0 {
+		delete(next, key)
+	} else {
+		next[key] = &aorEntry{aor: aor, instances: instances}
+	}
+	s.aors.Store(next)
+}
 
-	mr.aors[aor] = make(map[string]*ContactInstance) // 如果 AOR 不存在，创建新的映射
-	mr.aors[aor][instance.Source] = instance         // 添加联系人实例
+// AddAor 添加一个 AOR 和对应的联系人实例到注册表中，AOR 已存在时添加或更新该绑定的联系实例。
+// 同一设备（+sip.instance 和 reg-id 相同）换了来源地址重新注册时，替换该设备原来的联系实例。
+func (mr *MemoryRegistry) AddAor(aor sip.Uri, instance *ContactInstance) error {
+	key := AORKey(aor)
+	mr.shard(key).update(key, aor, func(instances map[string]*ContactInstance) bool {
+		replaceBinding(instances, instance)
+		return true
+	})
 	return nil
 }
 
+// replaceBinding 以 instance 替换同一绑定或同一设备的联系实例。
+func replaceBinding(instances map[string]*ContactInstance, instance *ContactInstance) {
+	binding := instance.Binding()
+	for key, existing := range instances {
+		if key != binding && sameBinding(existing, instance) {
+			delete(instances, key)
+		}
+	}
+	instances[binding] = instance
+}
+
 // RemoveAor 从注册表中移除指定的 AOR。
 func (mr *MemoryRegistry) RemoveAor(aor sip.Uri) error {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
-	for key := range mr.aors {
-		if key.Equals(aor) {
-			delete(mr.aors, key) // 删除匹配的 AOR
-			break
+	key := AORKey(aor)
+	mr.shard(key).update(key, aor, func(instances map[string]*ContactInstance) bool {
+		if len(instances) == 0 {
+			return false
 		}
-	}
+		for source := range instances {
+			delete(instances, source)
+		}
+		return true
+	})
 	return nil
 }
 
 // AorIsRegistered 检查指定的 AOR 是否已注册。
 func (mr *MemoryRegistry) AorIsRegistered(aor sip.Uri) bool {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
-	_, ok := mr.aors[aor]
+	key := AORKey(aor)
+	_, ok := mr.shard(key).load()[key]
 	return ok
 }
 
-// UpdateContact 更新指定 AOR 的联系人实例。
+// UpdateContact 更新指定 AOR 的联系人实例（同一设备的旧联系实例被替换），AOR 未注册时返回错误。
 func (mr *MemoryRegistry) UpdateContact(aor sip.Uri, instance *ContactInstance) error {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
-	instances, err := findInstances(mr.aors, aor)
-	if err != nil {
-		return err
+	key := AORKey(aor)
+	found := false
+	mr.shard(key).update(key, aor, func(instances map[string]*ContactInstance) bool {
+		if len(instances) == 0 {
+			return false
+		}
+		found = true
+		replaceBinding(instances, instance)
+		return true
+	})
+	if !found {
+		return fmt.Errorf("not found instances for %v", aor)
 	}
-
-	(*instances)[instance.Source] = instance // 更新联系人实例
 	return nil
 }
 
-// RemoveContact 从指定 AOR 中移除一个联系人实例。
+// RemoveContact 从指定 AOR 中移除一个联系人实例，AOR 的联系人实例为空时移除整个 AOR。
 func (mr *MemoryRegistry) RemoveContact(aor sip.Uri, instance *ContactInstance) error {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
-	instances, err := findInstances(mr.aors, aor)
-	if instances != nil {
-		delete(*instances, instance.Source) // 删除联系人实例
-
-		// 如果 AOR 的联系人实例为空，移除整个 AOR
-		if len(*instances) == 0 {
-			for key := range mr.aors {
-				if key.Equals(aor) {
-					delete(mr.aors, key)
-					break
-				}
-			}
+	key := AORKey(aor)
+	found := false
+	mr.shard(key).update(key, aor, func(instances map[string]*ContactInstance) bool {
+		if len(instances) == 0 {
+			return false
 		}
-		return nil
+		found = true
+		delete(instances, instance.Binding())
+		return true
+	})
+	if !found {
+		return fmt.Errorf("not found instances for %v", aor)
 	}
-	return err
+	return nil
 }
 
 // HandleConnectionError 处理连接错误，移除与错误源相关的联系人实例。
 func (mr *MemoryRegistry) HandleConnectionError(connError *transport.ConnectionError) bool {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
 	result := false
-	for aor, cis := range mr.aors {
-		for source := range cis {
-			if source == connError.Source {
-				delete(cis, source) // 删除与错误源相关的联系人实例
-				result = true
-				break
+	for i := range mr.shards {
+		shard := &mr.shards[i]
+		for key, entry := range shard.load() {
+			if !hasSource(entry.instances, connError.Source) {
+				continue
 			}
+			shard.update(key, entry.aor, func(instances map[string]*ContactInstance) bool {
+				removed := false
+				for binding, instance := range instances {
+					if instance.Source == connError.Source { // 删除与错误源相关的联系人实例
+						delete(instances, binding)
+						removed = true
+					}
+				}
+				result = result || removed
+				return removed
+			})
 		}
+	}
+	return result
+}
 
-		// 如果 AOR 的联系人实例为空，移除整个 AOR
-		if len(cis) == 0 {
-			delete(mr.aors, aor)
-			break
+// hasSource 检查联系实例中是否有来自 source 的实例。
+func hasSource(instances map[string]*ContactInstance, source string) bool {
+	for _, instance := range instances {
+		if instance.Source == source {
+			return true
 		}
 	}
-	return result
+	return false
 }
 
-// GetContacts 获取指定 AOR 的所有联系人实例。
+// GetContacts 获取指定 AOR 的所有联系人实例。返回的映射只读。
 func (mr *MemoryRegistry) GetContacts(aor sip.Uri) (*map[string]*ContactInstance, bool) {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
-
-	instance, err := findInstances(mr.aors, aor)
-	if err != nil {
+	key := AORKey(aor)
+	entry, ok := mr.shard(key).load()[key]
+	if !ok {
 		return nil, false
 	}
-	return instance, true
+	instances := entry.instances
+	return &instances, true
 }
 
-// GetAllContacts 获取注册表中所有 AOR 及其联系人实例。
+// GetAllContacts 获取注册表中所有 AOR 及其联系人实例。返回的内层映射只读。
 func (mr *MemoryRegistry) GetAllContacts() map[sip.Uri]map[string]*ContactInstance {
-	mr.mutex.Lock()
-	defer mr.mutex.Unlock()
+	all := make(map[sip.Uri]map[string]*ContactInstance)
+	for i := range mr.shards {
+		for _, entry := range mr.shards[i].load() {
+			all[entry.aor] = entry.instances
+		}
+	}
+	return all
+}
 
-	return mr.aors
+// Flush 清空注册表中的所有 AOR 及其联系实例。
+func (mr *MemoryRegistry) Flush() {
+	for i := range mr.shards {
+		shard := &mr.shards[i]
+		shard.mutex.Lock()
+		shard.aors.Store(map[string]*aorEntry{})
+		shard.mutex.Unlock()
+	}
 }
 
-// findInstances 根据 AOR 查找对应的联系人实例映射。
-func findInstances(aors map[sip.Uri]map[string]*ContactInstance, aor sip.Uri) (*map[string]*ContactInstance, error) {
-	for key, instances := range aors {
-		if key.User() == aor.User() { // 根据用户部分匹配 AOR
-			return &instances, nil
+// Snapshot 导出注册表中所有联系实例的快照。
+func (mr *MemoryRegistry) Snapshot() []*Record {
+	var records []*Record
+	for i := range mr.shards {
+		for _, entry := range mr.shards[i].load() {
+			for _, instance := range entry.instances {
+				records = append(records, NewRecord(entry.aor, instance))
+			}
 		}
 	}
-	return nil, fmt.Errorf("not found instances for %v", aor)
+	if records == nil {
+		records = make([]*Record, 0)
+	}
+	return records
 }
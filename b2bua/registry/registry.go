@@ -1,11 +1,18 @@
 package registry
 
 import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/transport"
 )
 
-// ContactInstance 表示一个联系实例，包含联系信息、注册过期时间、最后更新时间、来源、用户代理和传输协议。
+// ContactInstance 表示一个联系实例，包含联系信息、注册过期时间、最后更新时间、来源、用户代理、传输协议、
+// 收到注册的本地地址、拥有该流的节点、联系地址的优先级以及设备标识（RFC 5626 的 +sip.instance 和 reg-id）。
 type ContactInstance struct {
 	Contact     *sip.ContactHeader
 	RegExpires  uint32
@@ -13,26 +20,182 @@ type ContactInstance struct {
 	Source      string
 	UserAgent   string
 	Transport   string
+	Local       string
+	Node        string  // 收到注册、拥有该流（连接或 NAT 映射）的节点，本节点收到的注册为空
+	Q           float64 // Contact 的 q 参数（0 到 1），越大越优先；未携带时为 1
+	InstanceID  string  // Contact 的 +sip.instance 参数（如 urn:uuid:...），设备未携带时为空
+	RegID       string  // Contact 的 reg-id 参数，同一设备的多个流（RFC 5626）以此区分
+}
+
+// DefaultExpires 是 REGISTER 的联系地址既没有 expires 参数、请求也没有 Expires 头域时的注册有效期（秒）。
+const DefaultExpires = 3600
+
+// NewContactInstancesForRequest 为 REGISTER 请求的每个联系地址创建联系实例（RFC 3261 10.3）。请求的有效期取
+// 联系地址的 expires 参数，没有时取 Expires 头域，都没有时为 DefaultExpires；有效期为 0 表示注销该联系地址。
+// 请求没有 Contact 头域（查询）或为 Contact: * 时返回空。
+func NewContactInstancesForRequest(request sip.Request) []*ContactInstance {
+	if IsWildcard(request) {
+		return nil
+	}
+	expires, ok := RequestExpires(request)
+	if !ok {
+		expires = DefaultExpires
+	}
+	var instances []*ContactInstance
+	for _, header := range request.GetHeaders("Contact") {
+		contact, ok := header.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			continue
+		}
+		contactExpires := expires
+		if value, err := strconv.ParseUint(contactParam(contact, "expires"), 10, 32); err == nil {
+			contactExpires = sip.Expires(value)
+		}
+		instances = append(instances, newContactInstance(request, contact, contactExpires))
+	}
+	return instances
+}
+
+// IsWildcard 检查请求是否为 Contact: *（注销 AOR 的所有联系地址）。
+func IsWildcard(request sip.Request) bool {
+	for _, header := range request.GetHeaders("Contact") {
+		if contact, ok := header.(*sip.ContactHeader); ok && contact.Address != nil {
+			if _, wildcard := contact.Address.(sip.WildcardUri); wildcard {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequestExpires 返回请求的 Expires 头域，以及请求是否携带该头域。
+func RequestExpires(request sip.Request) (sip.Expires, bool) {
+	hdrs := request.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	if value, ok := hdrs[0].(*sip.Expires); ok && value != nil {
+		return *value, true
+	}
+	return 0, true
+}
+
+// GrantedExpires 返回注册服务器在 REGISTER 的 2xx 响应中授予联系地址的有效期：取响应中 URI 相同的 Contact 的
+// expires 参数，没有时取 Expires 头域。响应都没有携带时返回 false。
+func GrantedExpires(response sip.Response, contact *sip.ContactHeader) (sip.Expires, bool) {
+	for _, header := range response.GetHeaders("Contact") {
+		granted, ok := header.(*sip.ContactHeader)
+		if !ok || granted.Address == nil || contact.Address == nil || !granted.Address.Equals(contact.Address) {
+			continue
+		}
+		if value, err := strconv.ParseUint(contactParam(granted, "expires"), 10, 32); err == nil {
+			return sip.Expires(value), true
+		}
+	}
+	hdrs := response.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	if value, ok := hdrs[0].(*sip.Expires); ok && value != nil {
+		return *value, true
+	}
+	return 0, false
 }
 
-// NewContactInstanceForRequest 根据 SIP 请求创建一个新的联系实例。
-func NewContactInstanceForRequest(request sip.Request) *ContactInstance {
-	expiresHeaders := request.GetHeaders("Expires")
-	var expires sip.Expires = 0
-	if len(expiresHeaders) > 0 {
-		expires = *expiresHeaders[0].(*sip.Expires)
+// newContactInstance 根据请求中的一个联系地址创建联系实例。
+func newContactInstance(request sip.Request, contact *sip.ContactHeader, expires sip.Expires) *ContactInstance {
+	// 紧凑形式（m:）的 Contact 由解析器转换为 Contact 头域
+	instance := &ContactInstance{
+		Contact:     contact.Clone().(*sip.ContactHeader),
+		Source:      request.Source(),
+		RegExpires:  uint32(expires),
+		LastUpdated: uint32(time.Now().Unix()),
+		Transport:   request.Transport(),
+		Local:       request.Destination(),
+		Q:           contactQ(contact),
+		InstanceID:  contactInstanceID(contact),
+		RegID:       contactParam(contact, "reg-id"),
 	}
+	if hdrs := request.GetHeaders("User-Agent"); len(hdrs) > 0 {
+		instance.UserAgent = hdrs[0].String()
+	}
+	return instance
+}
+
+// Binding 返回联系实例在 AOR 下的键：来源地址和联系地址。按 RFC 3261 10.3，绑定以联系地址区分，
+// 同一来源可以注册多个联系地址。
+func (ci *ContactInstance) Binding() string {
+	if ci.Contact == nil || ci.Contact.Address == nil {
+		return ci.Source
+	}
+	return ci.Source + "|" + ci.Contact.Address.String()
+}
 
-	contacts, _ := request.Contact()
-	userAgentHeader := request.GetHeaders("User-Agent")[0].(*sip.UserAgentHeader)
+// contactQ 返回 Contact 头域的 q 参数，未携带或取值无效时为 1。
+func contactQ(contact *sip.ContactHeader) float64 {
+	if contact == nil || contact.Params == nil {
+		return 1
+	}
+	value, ok := contact.Params.Get("q")
+	if !ok || value == nil {
+		return 1
+	}
+	q, err := strconv.ParseFloat(value.String(), 64)
+	if err != nil || q < 0 || q > 1 {
+		return 1
+	}
+	return q
+}
 
-	return &ContactInstance{
-		Source:     request.Source(),
-		RegExpires: uint32(expires),
-		Contact:    contacts.Clone().(*sip.ContactHeader),
-		UserAgent:  userAgentHeader.String(),
-		Transport:  request.Transport(),
+// contactParam 返回 Contact 头域参数的值，没有该参数时为空。
+func contactParam(contact *sip.ContactHeader, name string) string {
+	if contact == nil || contact.Params == nil {
+		return ""
+	}
+	value, ok := contact.Params.Get(name)
+	if !ok || value == nil {
+		return ""
+	}
+	return value.String()
+}
+
+// contactInstanceID 返回 Contact 头域 +sip.instance 参数中的设备标识，去掉引号和尖括号并转为小写。
+// 快照中保存的 Contact 的参数值经过转义，这里一并还原。
+func contactInstanceID(contact *sip.ContactHeader) string {
+	id := strings.Trim(contactParam(contact, "+sip.instance"), `"`)
+	if unescaped, err := url.PathUnescape(id); err == nil {
+		id = unescaped
+	}
+	return strings.ToLower(strings.Trim(id, "<>"))
+}
+
+// sameBinding 检查两个联系实例是否为同一设备的同一流：+sip.instance 与 reg-id 都相同。
+// 设备未携带 +sip.instance 时无法识别，返回 false。
+func sameBinding(a, b *ContactInstance) bool {
+	return a.InstanceID != "" && a.InstanceID == b.InstanceID && a.RegID == b.RegID
+}
+
+// ForkOrder 按 q 值从高到低将联系实例分组（RFC 3261 16.6）：同一组的联系地址并行分叉，前一组的分支全部失败后
+// 再呼叫下一组。组内按来源地址排序，使分叉顺序稳定。
+func ForkOrder(instances map[string]*ContactInstance) [][]*ContactInstance {
+	ordered := make([]*ContactInstance, 0, len(instances))
+	for _, instance := range instances {
+		ordered = append(ordered, instance)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Q != ordered[j].Q {
+			return ordered[i].Q > ordered[j].Q
+		}
+		return ordered[i].Source < ordered[j].Source
+	})
+	var groups [][]*ContactInstance
+	for i, instance := range ordered {
+		if i == 0 || instance.Q != ordered[i-1].Q {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], instance)
 	}
+	return groups
 }
 
 // Registry 是 Address-of-Record (AOR) 注册表的接口。
@@ -45,4 +208,6 @@ type Registry interface {
 	GetContacts(aor sip.Uri) (*map[string]*ContactInstance, bool)    // 获取一个 AOR 的所有联系实例
 	GetAllContacts() map[sip.Uri]map[string]*ContactInstance         // 获取所有 AOR 及其联系实例
 	HandleConnectionError(connError *transport.ConnectionError) bool // 处理连接错误
+	Flush()                                                          // 清空所有 AOR 及其联系实例
+	Snapshot() []*Record                                             // 导出所有联系实例的快照
 }
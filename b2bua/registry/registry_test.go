@@ -0,0 +1,429 @@
+package registry_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-sip-ua/b2bua/registry"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var logger = log.NewDefaultLogrusLogger()
+
+// parseRegister parses a raw REGISTER; lines are joined with CRLF.
+func parseRegister(t *testing.T, lines ...string) sip.Request {
+	msg, err := parser.ParseMessage([]byte(strings.Join(lines, "\r\n")+"\r\n\r\n"), logger)
+	if err != nil {
+		t.Fatalf("parse REGISTER: %v", err)
+	}
+	request, ok := msg.(sip.Request)
+	if !ok {
+		t.Fatalf("parsed %T; want sip.Request", msg)
+	}
+	request.SetSource("192.168.1.20:5060")
+	request.SetTransport("UDP")
+	return request
+}
+
+// singleInstance returns the only contact instance of a REGISTER.
+func singleInstance(t *testing.T, request sip.Request) *registry.ContactInstance {
+	t.Helper()
+	instances := registry.NewContactInstancesForRequest(request)
+	if len(instances) != 1 {
+		t.Fatalf("NewContactInstancesForRequest() = %d instances; want 1", len(instances))
+	}
+	return instances[0]
+}
+
+func TestContactInstanceWithoutUserAgent(t *testing.T) {
+	// Grandstream HT-series firmware omits User-Agent on re-registrations
+	request := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK1915374261;rport",
+		"From: <sip:1001@pbx.example.com>;tag=1462281021",
+		"To: <sip:1001@pbx.example.com>",
+		"Call-ID: 1204613957-5060-1@BA.BBB.B.CA",
+		"CSeq: 2 REGISTER",
+		"Contact: <sip:1001@192.168.1.20:5060>;reg-id=1",
+		"Max-Forwards: 70",
+		"Expires: 3600",
+		"Content-Length: 0",
+	)
+	instance := singleInstance(t, request)
+	if instance.UserAgent != "" {
+		t.Errorf("UserAgent = %q; want empty", instance.UserAgent)
+	}
+	if instance.RegExpires != 3600 {
+		t.Errorf("RegExpires = %d; want 3600", instance.RegExpires)
+	}
+	if instance.Contact == nil || instance.Contact.Address.Host() != "192.168.1.20" {
+		t.Errorf("Contact = %v; want sip:1001@192.168.1.20:5060", instance.Contact)
+	}
+	if instance.Source != "192.168.1.20:5060" || instance.Transport != "UDP" {
+		t.Errorf("Source, Transport = %s, %s; want 192.168.1.20:5060, UDP", instance.Source, instance.Transport)
+	}
+}
+
+func TestContactInstanceCompactForm(t *testing.T) {
+	// Linksys/Cisco SPA ATAs send compact headers and no Expires header
+	request := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"v: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-8a3f2c1d",
+		"f: 1002 <sip:1002@pbx.example.com>;tag=c0a80114-13c4",
+		"t: 1002 <sip:1002@pbx.example.com>",
+		"i: 5a6b7c8d-c0a80114@192.168.1.20",
+		"CSeq: 57 REGISTER",
+		"Max-Forwards: 70",
+		"m: 1002 <sip:1002@192.168.1.20:5060>;expires=3600",
+		"User-Agent: Linksys/SPA2102-5.2.10",
+		"l: 0",
+	)
+	instance := singleInstance(t, request)
+	if instance.Contact == nil || instance.Contact.Address.User().String() != "1002" {
+		t.Errorf("Contact = %v; want sip:1002@192.168.1.20:5060", instance.Contact)
+	}
+	if instance.RegExpires != 3600 {
+		t.Errorf("RegExpires = %d; want 3600", instance.RegExpires)
+	}
+	if !strings.Contains(instance.UserAgent, "SPA2102") {
+		t.Errorf("UserAgent = %q; want SPA2102", instance.UserAgent)
+	}
+}
+
+func TestContactInstancesForRequest(t *testing.T) {
+	request := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-multi",
+		"From: <sip:1005@pbx.example.com>;tag=multi",
+		"To: <sip:1005@pbx.example.com>",
+		"Call-ID: multi",
+		"CSeq: 1 REGISTER",
+		"Contact: <sip:1005@192.168.1.20:5060>;expires=0, <sip:1005@192.168.1.20:5062>",
+		"Contact: <sip:1005@192.168.1.20:5064>;expires=120",
+		"Expires: 600",
+		"Content-Length: 0",
+	)
+	instances := registry.NewContactInstancesForRequest(request)
+	var got []uint32
+	for _, instance := range instances {
+		got = append(got, instance.RegExpires)
+	}
+	if len(got) != 3 || got[0] != 0 || got[1] != 600 || got[2] != 120 {
+		t.Fatalf("RegExpires = %v; want [0 600 120]", got)
+	}
+	if instances[1].Binding() == instances[2].Binding() {
+		t.Errorf("contacts from one source share binding %s", instances[1].Binding())
+	}
+
+	wildcard := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-wildcard",
+		"From: <sip:1005@pbx.example.com>;tag=wildcard",
+		"To: <sip:1005@pbx.example.com>",
+		"Call-ID: multi",
+		"CSeq: 2 REGISTER",
+		"Contact: *",
+		"Expires: 0",
+		"Content-Length: 0",
+	)
+	if !registry.IsWildcard(wildcard) || registry.IsWildcard(request) {
+		t.Errorf("IsWildcard() did not distinguish Contact: *")
+	}
+	if instances := registry.NewContactInstancesForRequest(wildcard); len(instances) != 0 {
+		t.Errorf("NewContactInstancesForRequest(Contact: *) = %v; want none", instances)
+	}
+
+	// some ATA firmware sends keep-alive REGISTERs without Contact, answered as a query
+	query := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-524287-1",
+		"From: <sip:1003@pbx.example.com>;tag=4d2f1a",
+		"To: <sip:1003@pbx.example.com>",
+		"Call-ID: 7f0e3b2a@192.168.1.20",
+		"CSeq: 101 REGISTER",
+		"Expires: 60",
+		"Content-Length: 0",
+	)
+	if instances := registry.NewContactInstancesForRequest(query); len(instances) != 0 {
+		t.Errorf("NewContactInstancesForRequest(no Contact) = %v; want none", instances)
+	}
+}
+
+// newInstance returns a contact instance of user registered from source.
+func newInstance(t testing.TB, user, source string) (sip.Uri, *registry.ContactInstance) {
+	aor, err := parser.ParseUri("sip:" + user + "@pbx.example.com")
+	if err != nil {
+		t.Fatalf("parse AOR: %v", err)
+	}
+	contact, err := parser.ParseUri("sip:" + user + "@" + source)
+	if err != nil {
+		t.Fatalf("parse Contact: %v", err)
+	}
+	return aor, &registry.ContactInstance{
+		Contact:    &sip.ContactHeader{Address: contact},
+		RegExpires: 3600,
+		Source:     source,
+		Transport:  "UDP",
+	}
+}
+
+func TestGrantedExpires(t *testing.T) {
+	msg, err := parser.ParseMessage([]byte(strings.Join([]string{
+		"SIP/2.0 200 OK",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-granted",
+		"From: <sip:1005@pbx.example.com>;tag=granted",
+		"To: <sip:1005@pbx.example.com>;tag=upstream",
+		"Call-ID: granted",
+		"CSeq: 1 REGISTER",
+		"Contact: <sip:1005@192.168.1.20:5060>;expires=600",
+		"Contact: <sip:1005@10.8.0.9:5062>",
+		"Expires: 900",
+		"Content-Length: 0",
+	}, "\r\n")+"\r\n\r\n"), logger)
+	if err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	response := msg.(sip.Response)
+	tests := []struct {
+		contact string
+		want    sip.Expires
+	}{
+		{"sip:1005@192.168.1.20:5060", 600}, // the contact's expires parameter
+		{"sip:1005@10.8.0.9:5062", 900},     // no parameter, the Expires header
+		{"sip:1005@10.8.0.10:5060", 900},    // not listed, the Expires header
+	}
+	for _, tt := range tests {
+		uri, _ := parser.ParseUri(tt.contact)
+		if got, ok := registry.GrantedExpires(response, &sip.ContactHeader{Address: uri}); !ok || got != tt.want {
+			t.Errorf("GrantedExpires(%s) = %d, %v; want %d", tt.contact, got, ok, tt.want)
+		}
+	}
+}
+
+func TestMemoryRegistryContacts(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	aor, desk := newInstance(t, "1001", "192.168.1.20:5060")
+	_, mobile := newInstance(t, "1001", "10.8.0.7:5062")
+	r.AddAor(aor, desk)
+	r.AddAor(aor, mobile)
+
+	lookup, _ := parser.ParseUri("sip:1001@pbx.example.com")
+	if !r.AorIsRegistered(lookup) {
+		t.Fatalf("AorIsRegistered(%v) = false; want true", lookup)
+	}
+	contacts, found := r.GetContacts(lookup)
+	if !found || len(*contacts) != 2 {
+		t.Fatalf("GetContacts(%v) = %v, %v; want 2 contacts", lookup, contacts, found)
+	}
+
+	r.RemoveContact(aor, desk)
+	contacts, _ = r.GetContacts(lookup)
+	if len(*contacts) != 1 || (*contacts)[mobile.Binding()] != mobile {
+		t.Errorf("after RemoveContact, contacts = %v; want only %s", *contacts, mobile.Source)
+	}
+	if !r.HandleConnectionError(&transport.ConnectionError{Source: mobile.Source}) {
+		t.Errorf("HandleConnectionError() = false; want true")
+	}
+	if r.AorIsRegistered(lookup) {
+		t.Errorf("AorIsRegistered(%v) = true after the last contact was removed", lookup)
+	}
+	if err := r.UpdateContact(aor, desk); err == nil {
+		t.Errorf("UpdateContact() of an unregistered AOR succeeded")
+	}
+}
+
+func TestMemoryRegistryReadersSeeStableContacts(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	aor, desk := newInstance(t, "1002", "192.168.1.21:5060")
+	r.AddAor(aor, desk)
+	contacts, _ := r.GetContacts(aor)
+
+	_, mobile := newInstance(t, "1002", "10.8.0.8:5062")
+	r.AddAor(aor, mobile)
+	if len(*contacts) != 1 {
+		t.Errorf("contacts returned before AddAor changed to %v", *contacts)
+	}
+	if all := r.GetAllContacts(); len(all) != 1 {
+		t.Errorf("GetAllContacts() has %d AORs; want 1", len(all))
+	}
+	if records := r.Snapshot(); len(records) != 2 {
+		t.Errorf("Snapshot() has %d records; want 2", len(records))
+	}
+}
+
+func TestAORKey(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"sip:100@a.com", "100@a.com"},
+		{"sip:100@PBX.Example.COM:5080;transport=tcp", "100@pbx.example.com"},
+		{"sips:Alice@example.com", "Alice@example.com"},
+		{"sip:example.com", "example.com"},
+	}
+	for _, tt := range tests {
+		uri, err := parser.ParseUri(tt.uri)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tt.uri, err)
+		}
+		if got := registry.AORKey(uri); got != tt.want {
+			t.Errorf("AORKey(%s) = %q; want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRegistryKeysByDomain(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	_, desk := newInstance(t, "100", "192.168.1.22:5060")
+	_, other := newInstance(t, "100", "192.168.1.23:5060")
+	a, _ := parser.ParseUri("sip:100@a.com")
+	b, _ := parser.ParseUri("sip:100@b.com")
+	r.AddAor(a, desk)
+	r.AddAor(b, other)
+
+	contacts, _ := r.GetContacts(a)
+	if len(*contacts) != 1 || (*contacts)[desk.Binding()] != desk {
+		t.Errorf("GetContacts(%v) = %v; want only %s", a, *contacts, desk.Source)
+	}
+	lookup, _ := parser.ParseUri("sip:100@A.COM:5060")
+	if !r.AorIsRegistered(lookup) {
+		t.Errorf("AorIsRegistered(%v) = false; want true", lookup)
+	}
+	r.RemoveAor(a)
+	if !r.AorIsRegistered(b) {
+		t.Errorf("RemoveAor(%v) removed %v", a, b)
+	}
+}
+
+func TestForkOrder(t *testing.T) {
+	request := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK-q",
+		"From: <sip:1003@pbx.example.com>;tag=q",
+		"To: <sip:1003@pbx.example.com>",
+		"Call-ID: q-value",
+		"CSeq: 1 REGISTER",
+		"Contact: <sip:1003@192.168.1.20:5060>;q=0.5",
+		"Content-Length: 0",
+	)
+	low := singleInstance(t, request)
+	if low.Q != 0.5 {
+		t.Fatalf("Q = %v; want 0.5", low.Q)
+	}
+	aor, _ := parser.ParseUri("sip:1003@pbx.example.com")
+	if _, restored, err := registry.NewRecord(aor, low).Instance(); err != nil || restored.Q != 0.5 {
+		t.Fatalf("restored instance = %v, %v; want Q 0.5", restored, err)
+	}
+
+	_, desk := newInstance(t, "1003", "192.168.1.21:5060")
+	_, mobile := newInstance(t, "1003", "10.8.0.9:5062")
+	desk.Q, mobile.Q = 1, 1
+	groups := registry.ForkOrder(map[string]*registry.ContactInstance{
+		low.Source:    low,
+		desk.Source:   desk,
+		mobile.Source: mobile,
+	})
+	if len(groups) != 2 || len(groups[0]) != 2 || len(groups[1]) != 1 || groups[1][0] != low {
+		t.Fatalf("ForkOrder() = %v; want [[desk mobile] [low]]", groups)
+	}
+	if groups[0][0] != mobile || groups[0][1] != desk {
+		t.Errorf("ForkOrder() group 0 = %v; want ordered by source", groups[0])
+	}
+}
+
+// registerFrom parses a REGISTER of 1004 from source with the given Contact parameters.
+func registerFrom(t *testing.T, source, params string) *registry.ContactInstance {
+	request := parseRegister(t,
+		"REGISTER sip:pbx.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP "+source+";branch=z9hG4bK-"+source,
+		"From: <sip:1004@pbx.example.com>;tag=instance",
+		"To: <sip:1004@pbx.example.com>",
+		"Call-ID: instance",
+		"CSeq: 1 REGISTER",
+		"Contact: <sip:1004@"+source+";ob>"+params,
+		"Content-Length: 0",
+	)
+	request.SetSource(source)
+	instance := singleInstance(t, request)
+	return instance
+}
+
+func TestMemoryRegistryReplacesReconnectedInstance(t *testing.T) {
+	const device = `;+sip.instance="<urn:uuid:00000000-0000-1000-8000-AABBCCDDEEFF>"`
+	aor, _ := parser.ParseUri("sip:1004@pbx.example.com")
+	r := registry.NewMemoryRegistry()
+
+	first := registerFrom(t, "192.168.1.30:5060", device+";reg-id=1")
+	if first.InstanceID != "urn:uuid:00000000-0000-1000-8000-aabbccddeeff" || first.RegID != "1" {
+		t.Fatalf("InstanceID, RegID = %q, %q", first.InstanceID, first.RegID)
+	}
+	r.AddAor(aor, first)
+	second := registerFrom(t, "192.168.1.30:40112", device+";reg-id=1") // same device, new source port
+	r.AddAor(aor, second)
+	flow := registerFrom(t, "10.8.0.10:5062", device+";reg-id=2") // second flow of the device
+	r.AddAor(aor, flow)
+	other := registerFrom(t, "192.168.1.31:5060", "") // no +sip.instance
+	r.AddAor(aor, other)
+
+	contacts, _ := r.GetContacts(aor)
+	if len(*contacts) != 3 || (*contacts)[first.Binding()] != nil || (*contacts)[second.Binding()] != second {
+		t.Errorf("contacts = %v; want %s, %s and %s", *contacts, second.Source, flow.Source, other.Source)
+	}
+
+	_, restored, err := registry.NewRecord(aor, second).Instance()
+	if err != nil || restored.InstanceID != second.InstanceID || restored.RegID != "1" {
+		t.Errorf("restored instance = %+v, %v; want the instance ID of %s", restored, err, second.Source)
+	}
+}
+
+// populate registers n AORs with one contact each.
+func populate(b *testing.B, r registry.Registry, n int) []sip.Uri {
+	aors := make([]sip.Uri, n)
+	for i := 0; i < n; i++ {
+		aor, instance := newInstance(b, strconv.Itoa(100000+i), "10."+strconv.Itoa(i/65536%256)+"."+strconv.Itoa(i/256%256)+"."+strconv.Itoa(i%256)+":5060")
+		r.AddAor(aor, instance)
+		aors[i] = aor
+	}
+	return aors
+}
+
+func BenchmarkMemoryRegistryGetContacts(b *testing.B) {
+	r := registry.NewMemoryRegistry()
+	aors := populate(b, r, 100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, found := r.GetContacts(aors[i%len(aors)]); !found {
+				b.Fatal("contact not found")
+			}
+			i += 7919
+		}
+	})
+}
+
+func BenchmarkMemoryRegistryRefresh(b *testing.B) {
+	r := registry.NewMemoryRegistry()
+	aors := populate(b, r, 100000)
+	instances := make([]*registry.ContactInstance, len(aors))
+	for i, aor := range aors {
+		contacts, _ := r.GetContacts(aor)
+		for _, instance := range *contacts {
+			instances[i] = instance
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			n := i % len(aors)
+			r.AddAor(aors[n], instances[n])
+			i += 7919
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// Record 是联系实例的可序列化形式，用于持久化注册表快照。
+type Record struct {
+	AOR         string `json:"aor"`
+	Contact     string `json:"contact"`
+	RegExpires  uint32 `json:"expires"`
+	LastUpdated uint32 `json:"last_updated"`
+	Source      string `json:"source"`
+	UserAgent   string `json:"user_agent"`
+	Transport   string `json:"transport"`
+	Local       string `json:"local,omitempty"`
+	Node        string `json:"node,omitempty"`
+}
+
+// Backend 是注册表快照的持久化后端。
+type Backend interface {
+	Save(records []*Record) error // 保存完整的快照
+	Load() ([]*Record, error)     // 读取快照
+}
+
+// FileBackend 将注册表快照以 JSON 格式保存到本地文件。
+type FileBackend struct {
+	path string
+}
+
+// NewFileBackend 创建一个基于文件的快照后端。
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{path: path}
+}
+
+// Save 原子地写入快照：先写临时文件，再重命名。
+func (fb *FileBackend) Save(records []*Record) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fb.path), filepath.Base(fb.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fb.path)
+}
+
+// Load 读取快照，文件不存在时返回空快照。
+func (fb *FileBackend) Load() ([]*Record, error) {
+	data, err := ioutil.ReadFile(fb.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("parse snapshot %s: %w", fb.path, err)
+	}
+	return records, nil
+}
+
+// NewRecord 根据 AOR 和联系实例创建快照记录。
+func NewRecord(aor sip.Uri, instance *ContactInstance) *Record {
+	contact := ""
+	if instance.Contact != nil {
+		contact = instance.Contact.Value()
+	}
+	return &Record{
+		AOR:         aor.String(),
+		Contact:     contact,
+		RegExpires:  instance.RegExpires,
+		LastUpdated: instance.LastUpdated,
+		Source:      instance.Source,
+		UserAgent:   instance.UserAgent,
+		Transport:   instance.Transport,
+		Local:       instance.Local,
+		Node:        instance.Node,
+	}
+}
+
+// Key 返回记录对应绑定的键：AOR、来源地址和联系地址。
+func (r *Record) Key() string {
+	contact := r.Contact
+	if _, uri, _, err := parser.ParseAddressValue(r.Contact); err == nil && uri != nil {
+		contact = uri.String()
+	}
+	return r.AOR + "|" + r.Source + "|" + contact
+}
+
+// Instance 将快照记录还原为 AOR 和联系实例。
+func (r *Record) Instance() (sip.Uri, *ContactInstance, error) {
+	aor, err := parser.ParseUri(r.AOR)
+	if err != nil {
+		return nil, nil, err
+	}
+	displayName, uri, params, err := parser.ParseAddressValue(r.Contact)
+	if err != nil {
+		return nil, nil, err
+	}
+	contact := &sip.ContactHeader{
+		DisplayName: displayName,
+		Address:     uri,
+		Params:      params,
+	}
+	return aor, &ContactInstance{
+		Contact:     contact,
+		RegExpires:  r.RegExpires,
+		LastUpdated: r.LastUpdated,
+		Source:      r.Source,
+		UserAgent:   r.UserAgent,
+		Transport:   r.Transport,
+		Local:       r.Local,
+		Node:        r.Node,
+		Q:           contactQ(contact),
+		InstanceID:  contactInstanceID(contact),
+		RegID:       contactParam(contact, "reg-id"),
+	}, nil
+}
+
+// Expired 检查联系实例在给定时间是否已过期。
+func (ci *ContactInstance) Expired(now time.Time) bool {
+	return int64(ci.LastUpdated)+int64(ci.RegExpires) < now.Unix()
+}
+
+// ReconcileReport 描述一次注册表与快照对账的结果。
+type ReconcileReport struct {
+	Restored int `json:"restored"` // 从快照恢复到内存的绑定数
+	Missing  int `json:"missing"`  // 仅存在于内存、快照中缺失的绑定数
+	Expired  int `json:"expired"`  // 已过期并被移除的绑定数
+	Invalid  int `json:"invalid"`  // 无法解析的快照记录数
+}
+
+// Reconcile 将快照与注册表对账：恢复快照中存在但内存缺失的有效绑定，
+// 统计仅存在于内存中的绑定，并移除两边已过期的绑定。
+func Reconcile(registry Registry, records []*Record, now time.Time) ReconcileReport {
+	var report ReconcileReport
+
+	inMemory := make(map[string]bool)
+	for _, record := range registry.Snapshot() {
+		aor, instance, err := record.Instance()
+		if err == nil && instance.Expired(now) {
+			registry.RemoveContact(aor, instance)
+			report.Expired++
+			continue
+		}
+		inMemory[record.Key()] = true
+	}
+
+	inSnapshot := make(map[string]bool)
+	for _, record := range records {
+		key := record.Key()
+		inSnapshot[key] = true
+		if inMemory[key] {
+			continue
+		}
+		aor, instance, err := record.Instance()
+		if err != nil {
+			report.Invalid++
+			continue
+		}
+		if instance.Expired(now) {
+			report.Expired++
+			continue
+		}
+		registry.AddAor(aor, instance)
+		report.Restored++
+	}
+
+	for key := range inMemory {
+		if !inSnapshot[key] {
+			report.Missing++
+		}
+	}
+	return report
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go-sip-ua/b2bua/b2bua"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultWatchInterval = 2 * time.Second // watch 命令默认的刷新间隔
+
+// 终端颜色
+const (
+	colorAdded   = "\033[32m" // 新出现的行
+	colorRemoved = "\033[31m" // 消失的行，只显示一次
+	colorReset   = "\033[0m"
+	clearScreen  = "\033[H\033[2J"
+)
+
+// 过滤条件的键
+var (
+	callFilterKeys   = []string{"user", "class"}
+	onlineFilterKeys = []string{"user", "source", "transport"}
+)
+
+// parseFilter 解析 key=value 形式的过滤条件，只接受 keys 中的键
+func parseFilter(args []string, keys []string) (map[string]string, error) {
+	filter := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || !contains(keys, kv[0]) {
+			return nil, errUsage
+		}
+		filter[kv[0]] = kv[1]
+	}
+	return filter, nil
+}
+
+// contains 检查列表中是否有 s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUser 检查 SIP 地址的用户部分是否为 user
+func hasUser(addr, user string) bool {
+	return strings.Contains(addr, ":"+user+"@")
+}
+
+// callLines 返回匹配过滤条件的通话，每路一行，按内容排序
+func callLines(b2bua *b2bua.B2BUA, filter map[string]string) []string {
+	var lines []string
+	for _, call := range b2bua.Calls() {
+		if user, ok := filter["user"]; ok && !hasUser(call.Caller, user) && !hasUser(call.Callee, user) {
+			continue
+		}
+		if class, ok := filter["class"]; ok && !strings.EqualFold(class, call.Class) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%v  %v: %v, %v", call.ID, call.String(), call.Class, call.State())) // 呼叫 ID、通话信息、呼叫分类及状态
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// callDetailLines 返回通话的详细信息：主叫、被叫、A 路、媒体、上下文及每个分支一行
+func callDetailLines(b2bua *b2bua.B2BUA, id string) ([]string, error) {
+	detail, err := b2bua.CallDetail(id)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{
+		fmt.Sprintf("呼叫: %v, 分类: %v, 状态: %v, 开始时间: %v (%v)", detail.ID, detail.Class, detail.State,
+			detail.Start.Format("2006-01-02 15:04:05"), time.Since(detail.Start).Truncate(time.Second)),
+		fmt.Sprintf("主叫: %v => 被叫: %v", detail.Caller, detail.Callee),
+		fmt.Sprintf("A 路: %v, 状态: %v, 媒体: %v", detail.Source, detail.Status, detail.Media),
+	}
+	if detail.Cause != "" {
+		lines = append(lines, fmt.Sprintf("释放原因: %v", detail.Cause))
+	}
+	keys := make([]string, 0, len(detail.Context))
+	for key := range detail.Context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("上下文: %v = %v", key, detail.Context[key]))
+	}
+	for _, leg := range detail.Legs {
+		line := fmt.Sprintf("B 路: %v %v, 状态: %v", leg.Callee, leg.Contact, leg.Status)
+		if leg.Trunk != "" {
+			line += ", 中继: " + leg.Trunk
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// monitorLines 返回 monitor 命令刷新的内容：通话 id 的详细信息，通话结束后为错误信息
+func monitorLines(id string) func(*b2bua.B2BUA, map[string]string) []string {
+	return func(b2bua *b2bua.B2BUA, filter map[string]string) []string {
+		lines, err := callDetailLines(b2bua, id)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return lines
+	}
+}
+
+// onlineLines 返回匹配过滤条件的在线设备，每个联系地址一行，按内容排序
+func onlineLines(b2bua *b2bua.B2BUA, filter map[string]string) []string {
+	var lines []string
+	for aor, instances := range b2bua.GetRegistry().GetAllContacts() {
+		if user, ok := filter["user"]; ok && (aor.User() == nil || aor.User().String() != user) {
+			continue
+		}
+		for _, instance := range instances {
+			if source, ok := filter["source"]; ok && !strings.HasPrefix(instance.Source, source) {
+				continue
+			}
+			if transport, ok := filter["transport"]; ok && !strings.EqualFold(transport, instance.Transport) {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("AOR: %v \t %v, 过期时间: %d, 来源: %v, 传输协议: %v",
+				aor, instance.UserAgent, instance.RegExpires, instance.Source, instance.Transport))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// watch 定时刷新 lines 的输出，新出现的行显示为绿色，消失的行以红色显示一次，按回车退出
+func watch(b2bua *b2bua.B2BUA, out io.Writer, args []string, keys []string, lines func(*b2bua.B2BUA, map[string]string) []string) error {
+	if !interactive(out) {
+		return errInteractive
+	}
+	interval := defaultWatchInterval
+	var rest []string
+	for _, arg := range args {
+		if value := strings.TrimPrefix(arg, "interval="); value != arg {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return errUsage
+			}
+			interval = time.Duration(seconds) * time.Second
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	filter, err := parseFilter(rest, keys)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() { // 等待回车
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		close(done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var previous []string
+	for first := true; ; first = false {
+		current := lines(b2bua, filter)
+		fmt.Fprint(out, clearScreen)
+		fmt.Fprintf(out, "%s  每 %v 刷新，共 %d 项，按回车退出\n\n", time.Now().Format("2006-01-02 15:04:05"), interval, len(current))
+		if first { // 第一次刷新，不高亮
+			previous = current
+		}
+		printDiff(out, previous, current)
+		previous = current
+
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// printDiff 打印 current，标出相对 previous 新增和消失的行（两者均已排序）
+func printDiff(out io.Writer, previous, current []string) {
+	i, j := 0, 0
+	for i < len(previous) || j < len(current) {
+		switch {
+		case j == len(current) || (i < len(previous) && previous[i] < current[j]):
+			fmt.Fprintln(out, colorRemoved+"- "+previous[i]+colorReset)
+			i++
+		case i == len(previous) || current[j] < previous[i]:
+			fmt.Fprintln(out, colorAdded+"+ "+current[j]+colorReset)
+			j++
+		default:
+			fmt.Fprintln(out, "  "+current[j])
+			i++
+			j++
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"math/rand"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +33,9 @@ type AuthSession struct {
 
 type RequestCredentialCallback func(username string) (password string, ha1 string, err error)
 
+// AuthFailureCallback is called when a request fails digest authentication.
+type AuthFailureCallback func(request sip.Request, reason string)
+
 // ServerAuthorizer Proxy-Authorization | WWW-Authenticate
 type ServerAuthorizer struct {
 	// a map[call id]authSession pair
@@ -37,6 +43,8 @@ type ServerAuthorizer struct {
 	requestCredential RequestCredentialCallback
 	useAuthInt        bool
 	realm             string
+	onFailure         AuthFailureCallback
+	nonceSecret       []byte
 	log               log.Logger
 
 	mx sync.RWMutex
@@ -65,6 +73,21 @@ func NewServerAuthorizer(callback RequestCredentialCallback, realm string, authI
 	return auth
 }
 
+// SetNonceSecret switches to stateless nonces signed with the given secret.
+// Nodes sharing the same secret accept each other's nonces, so a client may be
+// challenged by one node and authenticate against another, and nonces stay valid
+// across a restart. Without a secret, nonces are kept in memory and a restart
+// invalidates them: clients are challenged again. An empty secret switches back
+// to in-memory nonces.
+func (auth *ServerAuthorizer) SetNonceSecret(secret []byte) {
+	if len(secret) == 0 {
+		secret = nil
+	}
+	auth.mx.Lock()
+	auth.nonceSecret = secret
+	auth.mx.Unlock()
+}
+
 // ServerAuthorizer handles Authenticate requests.
 func (auth *ServerAuthorizer) Authenticate(request sip.Request, tx sip.ServerTransaction) (string, bool) {
 	logger := auth.log
@@ -92,6 +115,28 @@ func (auth *ServerAuthorizer) Authenticate(request sip.Request, tx sip.ServerTra
 	return auth.checkAuthorization(request, tx, authArgs, from)
 }
 
+// OnAuthFailure registers the callback called on authentication failures.
+func (auth *ServerAuthorizer) OnAuthFailure(callback AuthFailureCallback) {
+	auth.mx.Lock()
+	auth.onFailure = callback
+	auth.mx.Unlock()
+}
+
+func (auth *ServerAuthorizer) authFailed(request sip.Request, reason string) {
+	auth.mx.RLock()
+	callback := auth.onFailure
+	auth.mx.RUnlock()
+	if callback != nil {
+		callback(request, reason)
+	}
+}
+
+// Challenge sends a fresh 401 challenge, forcing the client to authenticate again.
+func (auth *ServerAuthorizer) Challenge(request sip.Request, tx sip.ServerTransaction) {
+	from, _ := request.From()
+	auth.requestAuthentication(request, tx, from)
+}
+
 func (auth *ServerAuthorizer) requestAuthentication(request sip.Request, tx sip.ServerTransaction, from *sip.FromHeader) {
 	callID, ok := request.CallID()
 	if !ok {
@@ -100,7 +145,7 @@ func (auth *ServerAuthorizer) requestAuthentication(request sip.Request, tx sip.
 	}
 
 	response := sip.NewResponseFromRequest(request.MessageID(), request, 401, "Unauthorized", "")
-	nonce := generateNonce(8)
+	nonce := auth.newNonce(callID.String())
 	opaque := generateNonce(4)
 
 	digest := sip.NewParams()
@@ -122,9 +167,11 @@ func (auth *ServerAuthorizer) requestAuthentication(request sip.Request, tx sip.
 
 	from.Params.Add("tag", sip.String{Str: generateNonce(8)})
 	auth.mx.Lock()
-	auth.sessions[callID.String()] = AuthSession{
-		nonce:   nonce,
-		created: time.Now(),
+	if auth.nonceSecret == nil {
+		auth.sessions[callID.String()] = AuthSession{
+			nonce:   nonce,
+			created: time.Now(),
+		}
 	}
 	auth.mx.Unlock()
 	response.SetBody("", true)
@@ -139,9 +186,7 @@ func (auth *ServerAuthorizer) checkAuthorization(request sip.Request, tx sip.Ser
 		return "", false
 	}
 
-	auth.mx.RLock()
-	session, found := auth.sessions[callID.String()]
-	auth.mx.RUnlock()
+	session, found := auth.lookupSession(callID.String(), authArgs)
 	if !found {
 		auth.requestAuthentication(request, tx, from)
 		return "", false
@@ -166,6 +211,7 @@ func (auth *ServerAuthorizer) checkAuthorization(request sip.Request, tx sip.Ser
 	password, ha1, err := auth.requestCredential(username)
 	if err != nil {
 		sendResponse(request, tx, 404, "User not found")
+		auth.authFailed(request, "user not found")
 		return "", false
 	}
 
@@ -207,12 +253,62 @@ func (auth *ServerAuthorizer) checkAuthorization(request sip.Request, tx sip.Ser
 
 	if result != response.String() {
 		sendResponse(request, tx, 403, "Forbidden (Bad auth)")
+		auth.authFailed(request, "bad credentials")
 		return "", false
 	}
 
 	return username, true
 }
 
+// newNonce returns a random nonce, or a signed one when a nonce secret is set.
+func (auth *ServerAuthorizer) newNonce(callID string) string {
+	auth.mx.RLock()
+	secret := auth.nonceSecret
+	auth.mx.RUnlock()
+	if secret == nil {
+		return generateNonce(8)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 16)
+	return timestamp + signNonce(secret, timestamp, callID)
+}
+
+// lookupSession returns the auth session of the call. With signed nonces the
+// session is rebuilt from the nonce presented by the client.
+func (auth *ServerAuthorizer) lookupSession(callID string, authArgs sip.Params) (AuthSession, bool) {
+	auth.mx.RLock()
+	secret := auth.nonceSecret
+	session, found := auth.sessions[callID]
+	auth.mx.RUnlock()
+	if secret == nil {
+		return session, found
+	}
+
+	value, ok := authArgs.Get("nonce")
+	if !ok {
+		return AuthSession{}, false
+	}
+	nonce := value.String()
+	size := sha256.Size * 2
+	if len(nonce) <= size {
+		return AuthSession{}, false
+	}
+	timestamp := nonce[:len(nonce)-size]
+	if !hmac.Equal([]byte(nonce[len(timestamp):]), []byte(signNonce(secret, timestamp, callID))) {
+		return AuthSession{}, false
+	}
+	unix, err := strconv.ParseInt(timestamp, 16, 64)
+	if err != nil {
+		return AuthSession{}, false
+	}
+	return AuthSession{nonce: nonce, created: time.Unix(unix, 0)}, true
+}
+
+func signNonce(secret []byte, timestamp, callID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + ":" + callID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // parseAuthHeader .
 func parseAuthHeader(value string) sip.Params {
 	authArgs := sip.NewParams()
@@ -0,0 +1,130 @@
+package media
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Answer records the offer of a leg as Rewrite does and returns an SDP answer that ends
+// the media in the relay, so that the call can be answered locally and prompts played
+// to the leg with Play. The first audio stream is accepted with the first codec of the
+// offer the relay can encode, plus telephone-event if offered; other streams are rejected.
+func (s *RelaySession) Answer(from Leg, offer string) (string, error) {
+	rewritten, err := s.Rewrite(from, offer)
+	if err != nil {
+		return "", err
+	}
+	sdp, err := ParseSDP(rewritten)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	answered := false
+	for i, media := range sdp.Media {
+		if media.Port() == 0 {
+			continue
+		}
+		stream := s.streams[i]
+		formats := answerFormats(media)
+		if answered || stream.raw || media.Type() != "audio" || len(formats) == 0 {
+			media.SetPort(0)
+			continue
+		}
+		answered = true
+		local := stream.legs[from]
+		media.SetFormats(formats)
+		media.SetPort(local.rtp.LocalAddr().(*net.UDPAddr).Port)
+		removeAttributes(media, iceAttributes...)
+		if s.relay.config.ICELite {
+			media.Lines = append(media.Lines, "a=ice-ufrag:"+local.iceUfrag, "a=ice-pwd:"+local.icePwd)
+			media.Lines = append(media.Lines, local.candidates(s.relay.config.PublicIP)...)
+		}
+		switch media.Direction() {
+		case "sendonly":
+			media.SetDirection("recvonly")
+		case "recvonly":
+			media.SetDirection("sendonly")
+		}
+	}
+	if !answered {
+		return "", fmt.Errorf("media relay: no audio codec to answer %s-Leg", from)
+	}
+	return sdp.String(), nil
+}
+
+// answerFormats returns the first payload type of an audio section the relay can encode,
+// followed by telephone-event if present.
+func answerFormats(media *MediaSection) []string {
+	var codec, event string
+	for _, format := range media.Formats() {
+		name := media.Codec(format)
+		switch {
+		case strings.HasPrefix(strings.ToLower(name), "telephone-event/"):
+			if event == "" {
+				event = format
+			}
+		case isEventCodec(name): // comfort noise
+		case codec == "" && lookupCodec(name) != nil:
+			codec = format
+		}
+	}
+	if codec == "" {
+		return nil
+	}
+	if event != "" {
+		return []string{codec, event}
+	}
+	return []string{codec}
+}
+
+// RestrictOffer keeps in every media section of an offer only the payload types of the
+// same section of an answer to it, and rejects the sections the answer rejected, so that
+// a leg added after the offerer was answered (e.g. a queue agent) is offered only what
+// the offerer already receives.
+func RestrictOffer(offer, answer string) (string, error) {
+	offerSDP, err := ParseSDP(offer)
+	if err != nil {
+		return "", err
+	}
+	answerSDP, err := ParseSDP(answer)
+	if err != nil {
+		return "", err
+	}
+	for i, media := range offerSDP.Media {
+		if i >= len(answerSDP.Media) || answerSDP.Media[i].Port() == 0 {
+			media.SetPort(0)
+			continue
+		}
+		answered := make(map[string]bool)
+		for _, format := range answerSDP.Media[i].Formats() {
+			answered[format] = true
+		}
+		var formats []string
+		for _, format := range media.Formats() {
+			if answered[format] {
+				formats = append(formats, format)
+			}
+		}
+		if len(formats) > 0 {
+			media.SetFormats(formats)
+		}
+	}
+	return offerSDP.String(), nil
+}
+
+// offerTemplate is the remote SDP assumed for the other leg when the relay makes an offer:
+// one audio stream with the G.711 codecs and telephone-event, without a media address.
+const offerTemplate = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n" +
+	"m=audio 9 RTP/AVP 0 8 101\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\na=fmtp:101 0-16\r\na=sendrecv\r\n"
+
+// Offer returns an SDP offer for a leg that has no peer yet, e.g. the first party called
+// in third-party call control: one audio stream on the relay ports of the leg with PCMU,
+// PCMA and telephone-event. The answer of the leg is then passed to Rewrite to make the
+// offer for the other leg.
+func (s *RelaySession) Offer(to Leg) (string, error) {
+	return s.Rewrite(to.Other(), offerTemplate)
+}
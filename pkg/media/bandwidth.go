@@ -0,0 +1,158 @@
+package media
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Bandwidth estimates used when a stream declares no b= line, in kbps including the
+// IP/UDP/RTP overhead of 20 ms packets.
+const (
+	rtpOverheadKbps       = 16  // 40 bytes of headers at 50 packets per second
+	defaultAudioKbps      = 64  // payload rate of codecs not in codecBandwidth
+	defaultVideoKbps      = 384 // video stream without a declared bandwidth
+	defaultOtherMediaKbps = 16  // application and image (T.38) streams
+)
+
+// codecBandwidth is the payload bit rate of common audio codecs in kbps.
+var codecBandwidth = map[string]int{
+	"PCMU":   64,
+	"PCMA":   64,
+	"G722":   64,
+	"G729":   8,
+	"G723":   6,
+	"GSM":    13,
+	"ILBC":   15,
+	"OPUS":   40,
+	"SPEEX":  24,
+	"AMR":    12,
+	"AMR-WB": 24,
+}
+
+// bandwidthOf returns the bandwidth declared by the b= lines of a section in kbps:
+// b=TIAS (bps, RFC 3890) if present, otherwise b=AS.
+func bandwidthOf(lines []string) (int, bool) {
+	as, tias := -1, -1
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "b=TIAS:"):
+			if bps, err := strconv.Atoi(strings.TrimSpace(line[len("b=TIAS:"):])); err == nil && bps >= 0 {
+				tias = (bps + 999) / 1000
+			}
+		case strings.HasPrefix(line, "b=AS:"):
+			if kbps, err := strconv.Atoi(strings.TrimSpace(line[len("b=AS:"):])); err == nil && kbps >= 0 {
+				as = kbps
+			}
+		}
+	}
+	if tias >= 0 {
+		return tias, true
+	}
+	return as, as >= 0
+}
+
+// withBandwidth replaces the b=AS and b=TIAS lines of a section; before lists the line
+// types that precede b= lines ("vosiuepc" at session level). A negative kbps only
+// removes them.
+func withBandwidth(lines []string, kbps int, before string) []string {
+	kept := make([]string, 0, len(lines)+2)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "b=AS:") && !strings.HasPrefix(line, "b=TIAS:") {
+			kept = append(kept, line)
+		}
+	}
+	if kbps < 0 {
+		return kept
+	}
+	at := len(kept)
+	for i, line := range kept {
+		if i > 0 && !strings.ContainsRune(before+"b", rune(line[0])) {
+			at = i
+			break
+		}
+	}
+	bandwidth := []string{"b=AS:" + strconv.Itoa(kbps), "b=TIAS:" + strconv.Itoa(kbps*1000)}
+	return append(kept[:at], append(bandwidth, kept[at:]...)...)
+}
+
+// Bandwidth returns the bandwidth the section declares in kbps, false if it has no
+// b=AS or b=TIAS line.
+func (m *MediaSection) Bandwidth() (int, bool) {
+	return bandwidthOf(m.Lines)
+}
+
+// SetBandwidth replaces the b=AS and b=TIAS lines of the section with a bandwidth in
+// kbps; the TIAS value is the same bandwidth in bps.
+func (m *MediaSection) SetBandwidth(kbps int) {
+	m.Lines = withBandwidth(m.Lines, kbps, "mic")
+}
+
+// RemoveBandwidth drops the b=AS and b=TIAS lines of the section.
+func (m *MediaSection) RemoveBandwidth() {
+	m.Lines = withBandwidth(m.Lines, -1, "mic")
+}
+
+// Bandwidth returns the session level bandwidth in kbps, false if there is none.
+func (s *SDP) Bandwidth() (int, bool) {
+	return bandwidthOf(s.Session)
+}
+
+// SetBandwidth replaces the session level b=AS and b=TIAS lines.
+func (s *SDP) SetBandwidth(kbps int) {
+	s.Session = withBandwidth(s.Session, kbps, "vosiuepc")
+}
+
+// RemoveBandwidth drops the session level b=AS and b=TIAS lines.
+func (s *SDP) RemoveBandwidth() {
+	s.Session = withBandwidth(s.Session, -1, "vosiuepc")
+}
+
+// estimate returns the bandwidth of an active stream in kbps: the declared one, or an
+// estimate from the first codec for audio and a default for other media.
+func (m *MediaSection) estimate() int {
+	if kbps, ok := m.Bandwidth(); ok {
+		return kbps
+	}
+	switch m.Type() {
+	case "audio":
+		for _, format := range m.Formats() {
+			codec := m.Codec(format)
+			if isEventCodec(codec) {
+				continue
+			}
+			if kbps, found := codecBandwidth[strings.ToUpper(strings.SplitN(codec, "/", 2)[0])]; found {
+				return kbps + rtpOverheadKbps
+			}
+			return defaultAudioKbps + rtpOverheadKbps
+		}
+		return defaultAudioKbps + rtpOverheadKbps
+	case "video":
+		return defaultVideoKbps
+	}
+	return defaultOtherMediaKbps
+}
+
+// EstimateBandwidth returns the bandwidth in kbps one direction of the media of an
+// SDP needs, for call admission control: the sum of the active streams, each from its
+// b= lines or estimated from its codec. A session level bandwidth is used when no
+// stream declares one. It returns 0 for an empty or invalid SDP.
+func EstimateBandwidth(body string) int {
+	sdp, err := ParseSDP(body)
+	if err != nil {
+		return 0
+	}
+	total, declared := 0, false
+	for _, media := range sdp.Media {
+		if media.Port() == 0 {
+			continue
+		}
+		if _, ok := media.Bandwidth(); ok {
+			declared = true
+		}
+		total += media.estimate()
+	}
+	if session, ok := sdp.Bandwidth(); ok && !declared && total > 0 {
+		return session
+	}
+	return total
+}
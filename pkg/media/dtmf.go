@@ -0,0 +1,218 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dtmfDigits are the DTMF digits by RFC 4733 event code.
+const dtmfDigits = "0123456789*#ABCD"
+
+const (
+	dtmfPacketInterval = 20 * time.Millisecond
+	dtmfClockRate      = 8000 // telephone-event/8000
+	dtmfVolume         = 10   // -10 dBm0
+)
+
+// DTMFDigit returns the digit of a telephone-event code.
+func DTMFDigit(event byte) (string, bool) {
+	if int(event) >= len(dtmfDigits) {
+		return "", false
+	}
+	return dtmfDigits[event : event+1], true
+}
+
+// DTMFEvent returns the telephone-event code of a digit.
+func DTMFEvent(digit string) (byte, bool) {
+	if len(digit) != 1 {
+		return 0, false
+	}
+	i := strings.IndexByte(dtmfDigits, strings.ToUpper(digit)[0])
+	if i < 0 {
+		return 0, false
+	}
+	return byte(i), true
+}
+
+// TelephoneEvent is an RFC 4733 telephone-event payload.
+type TelephoneEvent struct {
+	Event     byte
+	End       bool
+	Duration  uint16 // in timestamp units
+	Timestamp uint32 // RTP timestamp of the event start, identifies the event
+}
+
+// ParseTelephoneEvent parses an RTP packet carrying a telephone-event payload.
+func ParseTelephoneEvent(packet []byte) (TelephoneEvent, bool) {
+	payload, _, timestamp, ok := rtpPayload(packet)
+	if !ok || len(payload) < 4 {
+		return TelephoneEvent{}, false
+	}
+	return TelephoneEvent{
+		Event:     payload[0],
+		End:       payload[1]&0x80 != 0,
+		Duration:  binary.BigEndian.Uint16(payload[2:]),
+		Timestamp: timestamp,
+	}, true
+}
+
+// ParseDTMFInfo parses the body of a SIP INFO carrying a digit, either
+// application/dtmf-relay ("Signal=5\r\nDuration=160") or application/dtmf ("5").
+func ParseDTMFInfo(contentType, body string) (string, time.Duration, bool) {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case "application/dtmf-relay":
+		digit, duration := "", time.Duration(0)
+		for _, line := range strings.Split(body, "\n") {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(kv[1])
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "signal":
+				digit = value
+			case "duration":
+				if ms, err := strconv.Atoi(value); err == nil {
+					duration = time.Duration(ms) * time.Millisecond
+				}
+			}
+		}
+		if _, ok := DTMFEvent(digit); ok {
+			return strings.ToUpper(digit), duration, true
+		}
+	case "application/dtmf":
+		digit := strings.TrimSpace(body)
+		if _, ok := DTMFEvent(digit); ok {
+			return strings.ToUpper(digit), 0, true
+		}
+		if event, err := strconv.Atoi(digit); err == nil && event >= 0 && event < len(dtmfDigits) { // event code, e.g. 11 for #
+			return dtmfDigits[event : event+1], 0, true
+		}
+	}
+	return "", 0, false
+}
+
+// DTMFInfoBody returns an application/dtmf-relay body for a digit.
+func DTMFInfoBody(digit string, duration time.Duration) string {
+	return fmt.Sprintf("Signal=%s\r\nDuration=%d\r\n", digit, duration/time.Millisecond)
+}
+
+// HasTelephoneEvent reports whether the leg negotiated telephone-event on any stream.
+func (s *RelaySession) HasTelephoneEvent(leg Leg) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, stream := range s.streams {
+		if stream == nil {
+			continue
+		}
+		if _, ok := stream.legs[leg].telephoneEvent(); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// telephoneEvent returns the telephone-event payload type of the endpoint.
+func (e *relayEndpoint) telephoneEvent() (byte, bool) {
+	for pt, codec := range e.codecs {
+		if strings.HasPrefix(strings.ToLower(codec), "telephone-event/") {
+			return pt, true
+		}
+	}
+	return 0, false
+}
+
+// SendDTMF sends a digit to a leg as RFC 4733 telephone-event packets, in the RTP
+// stream relayed to that leg. It returns once the event is sent.
+func (s *RelaySession) SendDTMF(to Leg, digit string, duration time.Duration) error {
+	event, ok := DTMFEvent(digit)
+	if !ok {
+		return fmt.Errorf("invalid DTMF digit %q", digit)
+	}
+
+	s.mutex.Lock()
+	var stream *relayStream
+	var pt byte
+	for _, candidate := range s.streams {
+		if candidate == nil {
+			continue
+		}
+		if p, ok := candidate.legs[to].telephoneEvent(); ok {
+			stream, pt = candidate, p
+			break
+		}
+	}
+	if stream == nil || s.closed {
+		s.mutex.Unlock()
+		return fmt.Errorf("media relay: %s-Leg has no telephone-event stream", to)
+	}
+	receiver := stream.legs[to]
+	if receiver.ssrc == 0 {
+		receiver.ssrc = rand.Uint32()
+	}
+	ssrc, timestamp := receiver.ssrc, receiver.timestamp+dtmfClockRate/50
+	s.mutex.Unlock()
+
+	steps := int(duration / dtmfPacketInterval)
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 1; i <= steps+2; i++ { // the end packet is sent three times
+		end := i >= steps
+		length := uint16(steps * dtmfClockRate / 50)
+		if !end {
+			length = uint16(i * dtmfClockRate / 50)
+		}
+		packet := make([]byte, 16)
+		packet[0] = 0x80
+		packet[1] = pt
+		if i == 1 {
+			packet[1] |= 0x80 // marker
+		}
+		binary.BigEndian.PutUint32(packet[4:], timestamp)
+		binary.BigEndian.PutUint32(packet[8:], ssrc)
+		packet[12] = event
+		packet[13] = dtmfVolume
+		if end {
+			packet[13] |= 0x80
+		}
+		binary.BigEndian.PutUint16(packet[14:], length)
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return fmt.Errorf("media relay: session closed")
+		}
+		receiver.seqOffset++
+		receiver.seq++
+		binary.BigEndian.PutUint16(packet[2:], receiver.seq)
+		target := receiver.remote
+		packet = receiver.protect(packet, false)
+		s.mutex.Unlock()
+		if target != nil && packet != nil {
+			receiver.rtp.WriteToUDP(packet, target)
+		}
+		if i < steps {
+			time.Sleep(dtmfPacketInterval)
+		}
+	}
+	return nil
+}
+
+// sent records the header of an RTP packet forwarded to the endpoint and renumbers it
+// to account for injected packets. Must be called with the session locked.
+func (e *relayEndpoint) sent(packet []byte) {
+	if len(packet) < 12 {
+		return
+	}
+	seq := binary.BigEndian.Uint16(packet[2:]) + e.seqOffset
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	e.seq = seq
+	e.timestamp = binary.BigEndian.Uint32(packet[4:])
+	e.ssrc = binary.BigEndian.Uint32(packet[8:])
+}
@@ -0,0 +1,110 @@
+package media
+
+import (
+	"math"
+	"strings"
+)
+
+// FaxTone is a tone that identifies a fax call.
+type FaxTone string
+
+const (
+	FaxCNG FaxTone = "CNG" // 1100 Hz calling tone of the sending fax
+	FaxCED FaxTone = "CED" // 2100 Hz answer tone of the receiving fax (V.25/V.8 ANS)
+)
+
+// faxTones are the detected tones with their frequency and the minimum continuous
+// duration in samples at 8000 Hz (CNG bursts last 0.5 s, CED at least 2.6 s).
+var faxTones = []struct {
+	tone      FaxTone
+	frequency float64
+	duration  int
+}{
+	{FaxCNG, 1100, 3200},
+	{FaxCED, 2100, 4000},
+}
+
+const (
+	faxToneRatio     = 0.6   // minimum share of the frame energy at the tone frequency
+	faxToneMinEnergy = 100.0 // minimum RMS amplitude of a tone frame, about -50 dBm0
+)
+
+// FaxDetector detects fax tones in the G.711 RTP packets one leg sends. It is not
+// safe for concurrent use.
+type FaxDetector struct {
+	runs     []int // continuous samples of each tone
+	reported bool
+}
+
+// NewFaxDetector creates a detector.
+func NewFaxDetector() *FaxDetector {
+	return &FaxDetector{runs: make([]int, len(faxTones))}
+}
+
+// Detect analyses an RTP packet of the given codec and returns the tone once it has
+// lasted long enough. Each detector reports a single tone; packets of other codecs
+// are ignored.
+func (d *FaxDetector) Detect(codec string, packet []byte) (FaxTone, bool) {
+	if d.reported {
+		return "", false
+	}
+	var decode func(byte) int16
+	switch strings.ToUpper(strings.SplitN(codec, "/", 2)[0]) {
+	case "PCMU":
+		decode = DecodeULaw
+	case "PCMA":
+		decode = DecodeALaw
+	default:
+		return "", false
+	}
+	payload, _, _, ok := rtpPayload(packet)
+	if !ok || len(payload) == 0 {
+		return "", false
+	}
+	samples := make([]float64, len(payload))
+	energy := 0.0
+	for i, b := range payload {
+		samples[i] = float64(decode(b))
+		energy += samples[i] * samples[i]
+	}
+	loud := math.Sqrt(energy/float64(len(samples))) >= faxToneMinEnergy
+
+	for i, tone := range faxTones {
+		power := goertzel(samples, tone.frequency, 8000)
+		// a pure tone puts energy*N/2 into its Goertzel bin
+		if loud && power >= faxToneRatio*energy*float64(len(samples))/2 {
+			d.runs[i] += len(samples)
+		} else {
+			d.runs[i] = 0
+		}
+		if d.runs[i] >= tone.duration {
+			d.reported = true
+			return tone.tone, true
+		}
+	}
+	return "", false
+}
+
+// goertzel returns the squared magnitude of one frequency in the samples.
+func goertzel(samples []float64, frequency, rate float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*frequency/rate)
+	var s1, s2 float64
+	for _, x := range samples {
+		s1, s2 = x+coeff*s1-s2, s1
+	}
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+// IsT38 reports whether an SDP offers T.38 fax (an image stream over UDPTL).
+func IsT38(body string) bool {
+	sdp, err := ParseSDP(body)
+	if err != nil {
+		return false
+	}
+	for _, media := range sdp.Media {
+		if media.Port() != 0 && media.Type() == "image" && strings.EqualFold(strings.Join(media.Formats(), " "), "t38") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package media
+
+// DecodeULaw converts a G.711 mu-law sample to 16-bit linear PCM.
+func DecodeULaw(u byte) int16 {
+	u = ^u
+	t := (int16(u&0x0f) << 3) + 0x84
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+// DecodeALaw converts a G.711 A-law sample to 16-bit linear PCM.
+func DecodeALaw(a byte) int16 {
+	a ^= 0x55
+	t := int16(a&0x0f) << 4
+	switch seg := (a & 0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+// EncodeULaw converts a 16-bit linear PCM sample to G.711 mu-law.
+func EncodeULaw(sample int16) byte {
+	const bias, clip = 0x84, 32635
+	s := int32(sample)
+	sign := byte(0)
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+	exponent := byte(7)
+	for mask := int32(0x4000); s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(s>>(uint(exponent)+3)) & 0x0f
+	return ^(sign | exponent<<4 | mantissa)
+}
+
+// EncodeALaw converts a 16-bit linear PCM sample to G.711 A-law.
+func EncodeALaw(sample int16) byte {
+	s := int32(sample) >> 3
+	sign := byte(0x80)
+	if s < 0 {
+		s = -s - 1
+		sign = 0
+	}
+	if s > 0xfff {
+		s = 0xfff
+	}
+	var a byte
+	if s < 32 {
+		a = byte(s >> 1)
+	} else {
+		exponent := byte(1)
+		for v := s >> 5; v > 1; v >>= 1 {
+			exponent++
+		}
+		a = exponent<<4 | byte(s>>exponent)&0x0f
+	}
+	return (a | sign) ^ 0x55
+}
@@ -0,0 +1,200 @@
+package media
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	mixerRate      = 8000                                                   // sample rate audio is mixed at
+	mixerFrame     = mixerRate * int(playPacketInterval) / int(time.Second) // samples mixed per tick
+	mixerMaxBuffer = 8 * mixerFrame                                         // samples buffered per member before the oldest are dropped
+)
+
+// Mixer mixes the audio of the members of a conference: every member hears the sum of
+// the other members that are not muted. A member is a leg of a relay session answered
+// locally with Answer; the audio it sends is decoded from the relay's RTP handler and
+// the mix is sent to it as Play does.
+type Mixer struct {
+	mutex   sync.Mutex
+	members map[string]*mixerMember
+	stop    chan struct{}
+}
+
+// mixerMember is a member of a mixer, with its received and mixed samples at mixerRate.
+type mixerMember struct {
+	session *RelaySession
+	leg     Leg
+	muted   bool
+	in      []int16 // samples received from the member, not mixed yet
+	out     []int16 // mixed samples not sent to the member yet
+}
+
+// NewMixer creates a mixer and starts mixing every 20 ms until Close is called.
+func NewMixer() *Mixer {
+	m := &Mixer{members: make(map[string]*mixerMember), stop: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+// Add adds a leg of a session to the mixer under an id. The leg must have been answered
+// with Answer and not be playing audio.
+func (m *Mixer) Add(id string, session *RelaySession, leg Leg) error {
+	member := &mixerMember{session: session, leg: leg}
+	m.mutex.Lock()
+	if _, found := m.members[id]; found {
+		m.mutex.Unlock()
+		return fmt.Errorf("mixer: member %s already added", id)
+	}
+	m.members[id] = member
+	m.mutex.Unlock()
+
+	session.OnRTP(func(from Leg, codec string, packet []byte) {
+		if from == leg {
+			m.receive(member, codec, packet)
+		}
+	})
+	if err := session.Stream(leg, func(frame []int16, rate int) { m.send(member, frame, rate) }); err != nil {
+		m.Remove(id)
+		return err
+	}
+	return nil
+}
+
+// Remove removes a member from the mixer and stops sending the mix to it.
+func (m *Mixer) Remove(id string) {
+	m.mutex.Lock()
+	member, found := m.members[id]
+	delete(m.members, id)
+	m.mutex.Unlock()
+	if found {
+		member.session.StopPlay(member.leg)
+	}
+}
+
+// SetMuted mutes or unmutes a member: a muted member still hears the others but is not
+// heard. It returns false if there is no such member.
+func (m *Mixer) SetMuted(id string, muted bool) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	member, found := m.members[id]
+	if found {
+		member.muted = muted
+	}
+	return found
+}
+
+// Len returns the number of members.
+func (m *Mixer) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.members)
+}
+
+// Close stops mixing and sending the mix to the members.
+func (m *Mixer) Close() {
+	m.mutex.Lock()
+	members := m.members
+	m.members = make(map[string]*mixerMember)
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	m.mutex.Unlock()
+	for _, member := range members {
+		member.session.StopPlay(member.leg)
+	}
+}
+
+// receive decodes an RTP packet a member sent and buffers its samples. Packets of codecs
+// the relay cannot decode (e.g. telephone-event) are ignored.
+func (m *Mixer) receive(member *mixerMember, name string, packet []byte) {
+	codec := lookupCodec(name)
+	if codec == nil || isEventCodec(name) {
+		return
+	}
+	payload, _, _, ok := rtpPayload(packet)
+	if !ok {
+		return
+	}
+	samples := resample(codec.Decode(payload), codec.ClockRate(), mixerRate)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	member.in = append(member.in, samples...)
+	if excess := len(member.in) - mixerMaxBuffer; excess > 0 {
+		member.in = member.in[excess:]
+	}
+}
+
+// send fills a frame to a member with the mix at the rate of its codec.
+func (m *Mixer) send(member *mixerMember, frame []int16, rate int) {
+	n := len(frame) * mixerRate / rate
+	samples := make([]int16, n)
+	m.mutex.Lock()
+	taken := copy(samples, member.out)
+	member.out = member.out[taken:]
+	m.mutex.Unlock()
+	copy(frame, resample(samples, mixerRate, rate))
+}
+
+// run mixes a frame of every member every 20 ms.
+func (m *Mixer) run() {
+	ticker := time.NewTicker(playPacketInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.mix()
+	}
+}
+
+// mix takes a frame from every member and adds to every member's output the sum of the
+// frames of the other members that are not muted.
+func (m *Mixer) mix() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sum := make([]int32, mixerFrame)
+	frames := make(map[*mixerMember][]int16, len(m.members))
+	for _, member := range m.members {
+		frame := make([]int16, mixerFrame)
+		taken := copy(frame, member.in)
+		member.in = member.in[taken:]
+		if member.muted {
+			continue
+		}
+		frames[member] = frame
+		for i, sample := range frame {
+			sum[i] += int32(sample)
+		}
+	}
+	for _, member := range m.members {
+		own := frames[member]
+		for i := range sum {
+			value := sum[i]
+			if own != nil {
+				value -= int32(own[i])
+			}
+			member.out = append(member.out, clip(value))
+		}
+		if excess := len(member.out) - mixerMaxBuffer; excess > 0 {
+			member.out = member.out[excess:]
+		}
+	}
+}
+
+// clip limits a mixed sample to 16 bits.
+func clip(value int32) int16 {
+	switch {
+	case value > 32767:
+		return 32767
+	case value < -32768:
+		return -32768
+	}
+	return int16(value)
+}
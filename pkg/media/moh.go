@@ -0,0 +1,165 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"time"
+)
+
+const playPacketInterval = 20 * time.Millisecond
+
+// Audio is mono 16-bit audio, e.g. music on hold.
+type Audio struct {
+	Samples []int16
+	Rate    int // sample rate in Hz
+}
+
+// LoadWAV reads a mono 16-bit PCM WAV file.
+func LoadWAV(path string) (*Audio, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("%s: not a WAV file", path)
+	}
+	audio := &Audio{}
+	for offset := 12; offset+8 <= len(data); {
+		id, size := string(data[offset:offset+4]), int(binary.LittleEndian.Uint32(data[offset+4:]))
+		body := data[offset+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("%s: invalid fmt chunk", path)
+			}
+			format, channels, bits := binary.LittleEndian.Uint16(body), binary.LittleEndian.Uint16(body[2:]), binary.LittleEndian.Uint16(body[14:])
+			if format != 1 || channels != 1 || bits != 16 {
+				return nil, fmt.Errorf("%s: only mono 16-bit PCM is supported", path)
+			}
+			audio.Rate = int(binary.LittleEndian.Uint32(body[4:]))
+		case "data":
+			audio.Samples = make([]int16, size/2)
+			for i := range audio.Samples {
+				audio.Samples[i] = int16(binary.LittleEndian.Uint16(body[2*i:]))
+			}
+		}
+		offset += 8 + size + size%2 // chunks are word aligned
+	}
+	if audio.Rate == 0 || len(audio.Samples) == 0 {
+		return nil, fmt.Errorf("%s: no audio", path)
+	}
+	return audio, nil
+}
+
+// Play streams the audio in a loop to a leg, in the first audio stream of that leg
+// whose codec can be encoded, until StopPlay is called or the session closes. Packets
+// the other leg sends are not relayed to the leg while playing.
+func (s *RelaySession) Play(to Leg, audio *Audio) error {
+	var samples []int16
+	position := 0
+	return s.Stream(to, func(frame []int16, rate int) {
+		if samples == nil {
+			samples = resample(audio.Samples, audio.Rate, rate)
+		}
+		for i := range frame {
+			frame[i] = samples[position]
+			position = (position + 1) % len(samples)
+		}
+	})
+}
+
+// SampleSource fills a frame of 20 ms with samples at the given rate.
+type SampleSource func(frame []int16, rate int)
+
+// Stream plays the samples of a source to a leg as Play does, until StopPlay is called
+// or the session closes. The source is called from a single goroutine.
+func (s *RelaySession) Stream(to Leg, source SampleSource) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("media relay: session closed")
+	}
+	for _, stream := range s.streams {
+		if stream == nil || stream.raw {
+			continue
+		}
+		receiver := stream.legs[to]
+		for _, pt := range receiver.order {
+			codec := lookupCodec(receiver.codecs[pt])
+			if codec == nil || isEventCodec(receiver.codecs[pt]) {
+				continue
+			}
+			if receiver.playing != nil {
+				return nil
+			}
+			if receiver.ssrc == 0 {
+				receiver.ssrc = rand.Uint32()
+			}
+			stop := make(chan struct{})
+			receiver.playing = stop
+			go s.play(receiver, pt, codec, source, stop)
+			return nil
+		}
+	}
+	return fmt.Errorf("media relay: %s-Leg has no stream to play to", to)
+}
+
+// StopPlay stops playing to a leg and resumes relaying the other leg's packets.
+func (s *RelaySession) StopPlay(to Leg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, stream := range s.streams {
+		if stream != nil && stream.legs[to].playing != nil {
+			close(stream.legs[to].playing)
+			stream.legs[to].playing = nil
+		}
+	}
+}
+
+// play sends one packet of samples every 20 ms, continuing the sequence numbers and
+// timestamps of the stream relayed to the endpoint.
+func (s *RelaySession) play(receiver *relayEndpoint, pt byte, codec AudioCodec, source SampleSource, stop chan struct{}) {
+	frame := codec.ClockRate() * int(playPacketInterval) / int(time.Second)
+	ticker := time.NewTicker(playPacketInterval)
+	defer ticker.Stop()
+	chunk := make([]int16, frame)
+	for first := true; ; first = false {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		source(chunk, codec.ClockRate())
+		packet := make([]byte, 12, 12+2*frame)
+		packet[0] = 0x80
+		packet[1] = pt
+		if first {
+			packet[1] |= 0x80 // marker
+		}
+		packet = append(packet, codec.Encode(chunk)...)
+
+		s.mutex.Lock()
+		if s.closed || receiver.playing != stop {
+			s.mutex.Unlock()
+			return
+		}
+		receiver.seqOffset++
+		receiver.seq++
+		receiver.timestamp += uint32(frame)
+		binary.BigEndian.PutUint16(packet[2:], receiver.seq)
+		binary.BigEndian.PutUint32(packet[4:], receiver.timestamp)
+		binary.BigEndian.PutUint32(packet[8:], receiver.ssrc)
+		target := receiver.remote
+		packet = receiver.protect(packet, false)
+		s.mutex.Unlock()
+		if target != nil && packet != nil {
+			receiver.rtp.WriteToUDP(packet, target)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package media
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quality is the media quality of one leg: the worst of what the relay measures on the
+// RTP the leg sends and what the leg reports in RTCP about the RTP it receives.
+type Quality struct {
+	Packets uint64  `json:"packets"` // RTP packets received from the leg
+	Lost    uint64  `json:"lost"`    // packets of the leg missing at the relay
+	Loss    float64 `json:"loss"`    // packet loss in percent
+	Jitter  float64 `json:"jitter"`  // interarrival jitter in ms
+	RTT     float64 `json:"rtt"`     // round-trip time between the relay and the leg in ms, 0 if unknown
+	MOS     float64 `json:"mos"`     // estimated mean opinion score, 1 to 4.5
+	Reports int     `json:"rtcp"`    // RTCP reports received from the leg
+}
+
+// srHistory is the number of forwarded sender reports kept to compute the RTT.
+const srHistory = 8
+
+// streamStats collects the statistics of one leg of a stream.
+type streamStats struct {
+	packets      uint64
+	ssrc         uint32
+	started      bool
+	baseSeq      uint32  // extended sequence number of the first packet of the SSRC
+	maxSeq       uint32  // highest extended sequence number of the SSRC
+	expected     uint64  // packets expected from previous SSRCs
+	received     uint64  // packets received from previous SSRCs and the current one
+	timed        bool    // transit holds the transit time of a previous packet
+	transit      float64 // relative transit time of the last packet in seconds
+	jitter       float64 // RFC 3550 interarrival jitter in seconds
+	clockRate    int
+	epoch        time.Time
+	reports      int
+	lossReport   float64 // fraction lost reported by the leg
+	jitterReport float64 // jitter reported by the leg in seconds
+	rtt          time.Duration
+	srSent       [srHistory]srRecord // sender reports of the other leg forwarded to the leg
+	srNext       int
+}
+
+// srRecord is a sender report forwarded to a leg, by the middle 32 bits of its NTP time.
+type srRecord struct {
+	lsr uint32
+	at  time.Time
+}
+
+// receive accounts an RTP packet the leg sent with the codec of its payload type. It
+// reports whether packets are missing before it (a sequence number gap).
+func (s *streamStats) receive(packet []byte, codec string, now time.Time) (gap bool) {
+	if len(packet) < 12 {
+		return false
+	}
+	seq := uint32(binary.BigEndian.Uint16(packet[2:]))
+	ssrc := binary.BigEndian.Uint32(packet[8:])
+	s.packets++
+	if !s.started || ssrc != s.ssrc {
+		if s.started {
+			s.expected += uint64(s.maxSeq - s.baseSeq + 1)
+		}
+		s.started, s.ssrc = true, ssrc
+		s.baseSeq, s.maxSeq = seq, seq
+		s.timed = false
+		s.epoch = now
+	} else {
+		extended := s.maxSeq&^0xffff | seq
+		if int32(extended-s.maxSeq) < -0x8000 { // wrapped
+			extended += 0x10000
+		} else if int32(extended-s.maxSeq) > 0x8000 { // late packet from before the wrap
+			extended -= 0x10000
+		}
+		if int32(extended-s.maxSeq) > 0 {
+			gap = extended-s.maxSeq > 1
+			s.maxSeq = extended
+		}
+	}
+	s.received++
+
+	if isEventCodec(codec) { // event timestamps do not advance with the packets
+		return gap
+	}
+	s.clockRate = clockRate(codec)
+	arrival := now.Sub(s.epoch).Seconds()
+	transit := arrival - float64(binary.BigEndian.Uint32(packet[4:]))/float64(s.clockRate)
+	if s.timed {
+		s.jitter += (math.Abs(transit-s.transit) - s.jitter) / 16
+	}
+	s.timed, s.transit = true, transit
+	return gap
+}
+
+// forwarded records a sender report of the other leg forwarded to the leg.
+func (s *streamStats) forwarded(packet []byte, now time.Time) {
+	if len(packet) < 16 {
+		return
+	}
+	s.srSent[s.srNext] = srRecord{lsr: binary.BigEndian.Uint32(packet[10:]), at: now}
+	s.srNext = (s.srNext + 1) % srHistory
+}
+
+// report reads the report blocks of the RTCP sender and receiver reports the leg sent.
+func (s *streamStats) report(compound []byte, now time.Time) {
+	for len(compound) >= 8 && compound[0]>>6 == 2 {
+		length := 4 * (int(binary.BigEndian.Uint16(compound[2:])) + 1)
+		if length > len(compound) {
+			return
+		}
+		packet := compound[:length]
+		compound = compound[length:]
+
+		offset := 0
+		switch packet[1] {
+		case 200: // SR
+			offset = 28
+		case 201: // RR
+			offset = 8
+		default:
+			continue
+		}
+		if count := int(packet[0] & 0x1f); count > 0 && len(packet) >= offset+24 {
+			s.block(packet[offset:offset+24], now)
+		}
+	}
+}
+
+// block reads the first report block, which describes the stream the relay sends.
+func (s *streamStats) block(block []byte, now time.Time) {
+	s.reports++
+	s.lossReport = float64(block[4]) / 256
+	rate := s.clockRate
+	if rate == 0 {
+		rate = 8000
+	}
+	s.jitterReport = float64(binary.BigEndian.Uint32(block[12:])) / float64(rate)
+	lsr, dlsr := binary.BigEndian.Uint32(block[16:]), binary.BigEndian.Uint32(block[20:])
+	if lsr == 0 {
+		return
+	}
+	for _, sr := range s.srSent {
+		if sr.lsr == lsr && !sr.at.IsZero() {
+			if rtt := now.Sub(sr.at) - time.Duration(dlsr)*time.Second/65536; rtt >= 0 {
+				s.rtt = rtt
+			}
+			return
+		}
+	}
+}
+
+// quality returns the quality of the leg.
+func (s *streamStats) quality() Quality {
+	expected := s.expected
+	if s.started {
+		expected += uint64(s.maxSeq - s.baseSeq + 1)
+	}
+	q := Quality{Packets: s.packets, Reports: s.reports}
+	if expected > s.received {
+		q.Lost = expected - s.received
+	}
+	if expected > 0 {
+		q.Loss = 100 * float64(q.Lost) / float64(expected)
+	}
+	if loss := 100 * s.lossReport; loss > q.Loss {
+		q.Loss = loss
+	}
+	q.Jitter = 1000 * math.Max(s.jitter, s.jitterReport)
+	q.RTT = float64(s.rtt) / float64(time.Millisecond)
+	q.MOS = EstimateMOS(q.Loss, q.Jitter, q.RTT)
+	return q
+}
+
+// clockRate returns the RTP clock rate of a codec such as PCMU/8000, 8000 if unknown.
+func clockRate(codec string) int {
+	fields := strings.SplitN(codec, "/", 3)
+	if len(fields) >= 2 {
+		if rate, err := strconv.Atoi(fields[1]); err == nil && rate > 0 {
+			return rate
+		}
+	}
+	return 8000
+}
+
+// EstimateMOS estimates the mean opinion score from packet loss in percent, jitter and
+// round-trip time in ms with the simplified ITU-T G.107 E-model for G.711.
+func EstimateMOS(loss, jitter, rtt float64) float64 {
+	latency := rtt/2 + 2*jitter + 10
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= 2.5 * loss
+	if r <= 0 {
+		return 1
+	}
+	if r >= 100 {
+		return 4.5
+	}
+	mos := 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+	return math.Round(100*math.Min(4.5, math.Max(1, mos))) / 100
+}
+
+// Quality returns the quality of each leg, from the first RTP stream that has carried
+// packets. ok is false if no leg has sent RTP yet.
+func (s *RelaySession) Quality() (legs [2]Quality, ok bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, stream := range s.streams {
+		if stream == nil || stream.raw {
+			continue
+		}
+		if stream.legs[LegA].stats.packets == 0 && stream.legs[LegB].stats.packets == 0 {
+			continue
+		}
+		for leg, endpoint := range stream.legs {
+			legs[leg] = endpoint.stats.quality()
+		}
+		return legs, true
+	}
+	return legs, false
+}
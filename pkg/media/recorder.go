@@ -0,0 +1,179 @@
+package media
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordRate   = 8000 // samples per second of recordings
+	recordJitter = recordRate
+	wavHeaderLen = 44
+)
+
+// Recorder mixes the G.711 audio of both legs of a call into a mono 8 kHz 16-bit WAV
+// file. Packets are placed by their RTP timestamps, so the directions stay aligned;
+// audio older than one second is written out. Other codecs are ignored.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	start   time.Time
+	legs    [2]recordedLeg
+	mix     []int32 // samples not yet written, starting at sample index written
+	written int64
+	closed  bool
+}
+
+// recordedLeg maps the RTP timestamps of a leg to sample indexes of the recording.
+type recordedLeg struct {
+	started bool
+	ssrc    uint32
+	base    int64  // sample index of the first packet
+	baseTS  uint32 // RTP timestamp of the first packet
+}
+
+// NewRecorder creates the WAV file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(wavHeader(0)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Recorder{file: file, start: time.Now()}, nil
+}
+
+// WriteRTP adds an RTP packet sent by leg. It can be used as an RTPHandler.
+func (r *Recorder) WriteRTP(from Leg, codec string, packet []byte) {
+	var decode func(byte) int16
+	switch {
+	case strings.HasPrefix(strings.ToUpper(codec), "PCMU/"):
+		decode = DecodeULaw
+	case strings.HasPrefix(strings.ToUpper(codec), "PCMA/"):
+		decode = DecodeALaw
+	default:
+		return
+	}
+	payload, timestamp, ssrc, ok := rtpPayload(packet)
+	if !ok {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	now := int64(time.Since(r.start) * recordRate / time.Second)
+	leg := &r.legs[from]
+	if !leg.started || leg.ssrc != ssrc { // new stream: align to the arrival time
+		*leg = recordedLeg{started: true, ssrc: ssrc, base: now, baseTS: timestamp}
+	}
+	pos := leg.base + int64(int32(timestamp-leg.baseTS))
+	if pos < r.written || pos > now+recordJitter { // too late, or timestamp jump
+		leg.base, leg.baseTS, pos = now, timestamp, now
+		if pos < r.written {
+			return
+		}
+	}
+
+	end := pos - r.written + int64(len(payload))
+	for int64(len(r.mix)) < end {
+		r.mix = append(r.mix, 0)
+	}
+	for i, sample := range payload {
+		r.mix[pos-r.written+int64(i)] += int32(decode(sample))
+	}
+	r.flush(now - recordJitter)
+}
+
+// flush writes the mixed samples before sample index until.
+func (r *Recorder) flush(until int64) {
+	n := until - r.written
+	if n <= 0 {
+		return
+	}
+	for int64(len(r.mix)) < n { // silence where no leg sent audio
+		r.mix = append(r.mix, 0)
+	}
+	buf := make([]byte, 2*n)
+	for i, sample := range r.mix[:n] {
+		if sample > 32767 {
+			sample = 32767
+		} else if sample < -32768 {
+			sample = -32768
+		}
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(sample)))
+	}
+	r.file.Write(buf)
+	r.mix = r.mix[n:]
+	r.written += n
+}
+
+// Duration returns the length of the recording so far.
+func (r *Recorder) Duration() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return time.Duration(r.written+int64(len(r.mix))) * time.Second / recordRate
+}
+
+// Close writes the remaining audio and completes the WAV header.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.flush(r.written + int64(len(r.mix)))
+	if _, err := r.file.WriteAt(wavHeader(uint32(2*r.written)), 0); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// rtpPayload returns the payload, timestamp and SSRC of an RTP packet.
+func rtpPayload(packet []byte) ([]byte, uint32, uint32, bool) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return nil, 0, 0, false
+	}
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 { // header extension
+		if len(packet) < offset+4 {
+			return nil, 0, 0, false
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > offset { // padding
+		end -= int(packet[end-1])
+	}
+	if offset > end {
+		return nil, 0, 0, false
+	}
+	return packet[offset:end], binary.BigEndian.Uint32(packet[4:]), binary.BigEndian.Uint32(packet[8:]), true
+}
+
+// wavHeader returns the header of a mono 16-bit PCM WAV file with dataLen bytes of audio.
+func wavHeader(dataLen uint32) []byte {
+	h := make([]byte, wavHeaderLen)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataLen)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)           // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)            // PCM
+	binary.LittleEndian.PutUint16(h[22:], 1)            // mono
+	binary.LittleEndian.PutUint32(h[24:], recordRate)   // sample rate
+	binary.LittleEndian.PutUint32(h[28:], recordRate*2) // byte rate
+	binary.LittleEndian.PutUint16(h[32:], 2)            // block align
+	binary.LittleEndian.PutUint16(h[34:], 16)           // bits per sample
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataLen)
+	return h
+}
@@ -0,0 +1,513 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-sip-ua/pkg/media/rtp"
+)
+
+// ErrNoPorts is returned when the relay port range is exhausted.
+var ErrNoPorts = errors.New("media relay: no free port")
+
+// Leg identifies one side of a relayed call.
+type Leg int
+
+const (
+	LegA Leg = iota // the calling side
+	LegB            // the called side
+)
+
+// Other returns the opposite leg.
+func (l Leg) Other() Leg {
+	return 1 - l
+}
+
+func (l Leg) String() string {
+	if l == LegA {
+		return "A"
+	}
+	return "B"
+}
+
+// RelayConfig configures the media relay sockets.
+type RelayConfig struct {
+	BindIP   string // address the media sockets are bound to, all interfaces if empty
+	PublicIP string // address advertised in SDP
+	PortMin  int    // first media port, rtp.DefaultPortMin if 0
+	PortMax  int    // last media port, rtp.DefaultPortMax if 0
+
+	// TerminateSRTP decrypts SDES-SRTP from each leg and encrypts what is sent to legs
+	// that use SRTP, so a secure leg can talk to a plain RTP leg. Otherwise crypto
+	// attributes are passed through and SRTP is relayed untouched.
+	TerminateSRTP bool
+
+	ICELite    bool   // answer ICE connectivity checks and advertise the relay ports as ICE lite candidates
+	STUNServer string // host:port of a STUN server used to gather server reflexive candidates
+}
+
+// Relay anchors the media of calls: each stream gets an RTP/RTCP port pair per leg and
+// packets received from one leg are forwarded to the other.
+type Relay struct {
+	config RelayConfig
+}
+
+// NewRelay creates a relay.
+func NewRelay(config RelayConfig) *Relay {
+	if config.PortMin <= 0 {
+		config.PortMin = rtp.DefaultPortMin
+	}
+	if config.PortMax <= 0 {
+		config.PortMax = rtp.DefaultPortMax
+	}
+	return &Relay{config: config}
+}
+
+// allocate opens an even RTP port and the RTCP port following it.
+func (r *Relay) allocate() (*net.UDPConn, *net.UDPConn, error) {
+	ip := net.ParseIP(r.config.BindIP)
+	first := (r.config.PortMin + 1) &^ 1
+	pairs := (r.config.PortMax - first + 1) / 2
+	if pairs <= 0 {
+		return nil, nil, fmt.Errorf("media relay: empty port range %d-%d", r.config.PortMin, r.config.PortMax)
+	}
+	start := rand.Intn(pairs)
+	for i := 0; i < pairs; i++ {
+		port := first + 2*((start+i)%pairs)
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			continue
+		}
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		return rtpConn, rtcpConn, nil
+	}
+	return nil, nil, fmt.Errorf("%w in %d-%d", ErrNoPorts, r.config.PortMin, r.config.PortMax)
+}
+
+// RTPHandler is called for every relayed RTP packet with the leg that sent it and the
+// codec (e.g. PCMU/8000) of its payload type. It must not retain or modify the packet.
+type RTPHandler func(from Leg, codec string, packet []byte)
+
+// RelaySession relays the media streams of one call.
+type RelaySession struct {
+	relay    *Relay
+	mutex    sync.RWMutex
+	streams  []*relayStream // by m= line, nil for rejected streams
+	handlers []RTPHandler
+	onLoss   []VideoLossHandler
+	closed   bool
+	received time.Time // when a leg last sent a media packet
+	secure   [2]bool   // legs using SRTP, with TerminateSRTP
+}
+
+// relayEndpoint is one leg of a stream.
+type relayEndpoint struct {
+	rtp, rtcp  *net.UDPConn    // sockets the leg sends to
+	remote     *net.UDPAddr    // RTP address of the leg, from SDP and then latched
+	signaled   *net.UDPAddr    // RTP address of the leg in its last SDP
+	remoteRTCP *net.UDPAddr    // RTCP address of the leg
+	codecs     map[byte]string // payload types of the leg's SDP
+	order      []byte          // payload types in SDP order
+	ssrc       uint32          // SSRC of the last RTP packet sent to the leg
+	seq        uint16          // sequence number of the last RTP packet sent to the leg
+	timestamp  uint32          // timestamp of the last RTP packet sent to the leg
+	seqOffset  uint16          // packets injected into the stream sent to the leg (DTMF, music on hold)
+	playing    chan struct{}   // closed to stop playing to the leg, nil when not playing
+	stats      streamStats     // RTP received from the leg and RTCP reports of the leg
+	srtpIn     *srtpContext    // keys of the SRTP the leg sends, nil for RTP
+	srtpOut    *srtpContext    // keys of the SRTP the relay sends to the leg, nil for RTP
+	iceUfrag   string          // ICE credentials of the relay towards the leg, with ICELite
+	icePwd     string
+	mapped     *net.UDPAddr // public address of the RTP socket from the STUN server, nil if unknown
+}
+
+// protect encrypts an RTP or RTCP packet sent to the endpoint if the leg uses SRTP.
+// It returns nil if the packet cannot be protected.
+func (e *relayEndpoint) protect(packet []byte, rtcp bool) []byte {
+	if e.srtpOut == nil {
+		return packet
+	}
+	var err error
+	if rtcp {
+		packet, err = e.srtpOut.protectRTCP(packet)
+	} else {
+		packet, err = e.srtpOut.protectRTP(packet)
+	}
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+// relayStream relays one m= line.
+type relayStream struct {
+	legs        [2]*relayEndpoint
+	transcoders [2]*transcoder // by sending leg, nil when the legs share a codec
+	raw         bool           // not RTP (e.g. T.38 over UDPTL), relayed untouched
+	video       bool           // m=video
+}
+
+// NewSession creates an empty relay session; streams are opened by Rewrite.
+func (r *Relay) NewSession() *RelaySession {
+	return &RelaySession{relay: r, received: time.Now()}
+}
+
+// LastReceived returns when either leg last sent a media packet (RTP or UDPTL), or when
+// the session was created if none has arrived yet.
+func (s *RelaySession) LastReceived() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.received
+}
+
+// OnRTP adds a handler called for every relayed RTP packet.
+func (s *RelaySession) OnRTP(handler RTPHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Rewrite records the media addresses and codecs of an SDP received from a leg and
+// returns the SDP to send to the other leg, pointing to the relay ports of that leg.
+// Streams are matched by position and opened on first use.
+func (s *RelaySession) Rewrite(from Leg, body string) (string, error) {
+	sdp, err := ParseSDP(body)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", fmt.Errorf("media relay: session closed")
+	}
+	for i, media := range sdp.Media {
+		if media.Port() == 0 {
+			continue
+		}
+		for len(s.streams) <= i {
+			s.streams = append(s.streams, nil)
+		}
+		if s.streams[i] == nil {
+			stream, err := s.openStream()
+			if err != nil {
+				return "", err
+			}
+			s.streams[i] = stream
+		}
+		stream := s.streams[i]
+		stream.raw = !strings.HasPrefix(strings.ToUpper(media.Proto()), "RTP/")
+		stream.video = media.Type() == "video"
+		if stream.raw {
+			stream.transcoders = [2]*transcoder{}
+		}
+
+		endpoint := stream.legs[from]
+		if ip := net.ParseIP(sdp.Connection(media)); ip != nil && !ip.IsUnspecified() {
+			endpoint.remote = &net.UDPAddr{IP: ip, Port: media.Port()}
+			endpoint.signaled = endpoint.remote
+			endpoint.remoteRTCP = &net.UDPAddr{IP: ip, Port: media.Port() + 1}
+			if values := media.Attributes("rtcp"); len(values) > 0 { // RFC 3605
+				if port, err := strconv.Atoi(strings.Fields(values[0])[0]); err == nil {
+					endpoint.remoteRTCP.Port = port
+				}
+			}
+		}
+		endpoint.codecs = make(map[byte]string)
+		endpoint.order = nil
+		for _, format := range media.Formats() {
+			if pt, err := strconv.Atoi(format); err == nil && pt < 128 {
+				endpoint.codecs[byte(pt)] = media.Codec(format)
+				endpoint.order = append(endpoint.order, byte(pt))
+			}
+		}
+
+		if s.relay.config.TerminateSRTP && !stream.raw {
+			if err := s.terminateSRTP(stream, from, media); err != nil {
+				return "", err
+			}
+		}
+
+		media.SetPort(stream.legs[from.Other()].rtp.LocalAddr().(*net.UDPAddr).Port)
+		removeAttributes(media, iceAttributes...)
+		if s.relay.config.ICELite {
+			local := stream.legs[from.Other()]
+			media.Lines = append(media.Lines, "a=ice-ufrag:"+local.iceUfrag, "a=ice-pwd:"+local.icePwd)
+			media.Lines = append(media.Lines, local.candidates(s.relay.config.PublicIP)...)
+		}
+	}
+	sdp.Session = removeSessionAttributes(sdp.Session, iceAttributes[1:]...)
+	if s.relay.config.ICELite {
+		sdp.Session = append(sdp.Session, "a=ice-lite")
+	}
+	sdp.SetConnection(s.relay.config.PublicIP)
+	return sdp.String(), nil
+}
+
+// SetSecure sets whether a leg uses SRTP before an SDP is sent to it. A leg is also
+// marked secure or not by the profile of the SDP it sends. Only used with TerminateSRTP.
+func (s *RelaySession) SetSecure(leg Leg, secure bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.secure[leg] = secure
+}
+
+// terminateSRTP takes the keys of a media section received from a leg and replaces
+// them with the relay's own keys if the other leg uses SRTP, or with a plain RTP
+// profile if it does not. The relay answers with the tag and suite the other leg
+// offered, if any.
+func (s *RelaySession) terminateSRTP(stream *relayStream, from Leg, media *MediaSection) error {
+	sender, receiver := stream.legs[from], stream.legs[from.Other()]
+	s.secure[from] = isSecureProto(media.Proto())
+	if s.secure[from] {
+		keys, err := parseCrypto(media)
+		if err != nil {
+			return err
+		}
+		if sender.srtpIn == nil || !bytes.Equal(sender.srtpIn.master, keys.master) { // keep the rollover state of unchanged keys
+			sender.srtpIn = keys
+		}
+	} else {
+		sender.srtpIn = nil
+	}
+	removeAttributes(media, "crypto")
+
+	secure := s.secure[from.Other()]
+	media.SetProto(secureProto(media.Proto(), secure))
+	if !secure {
+		receiver.srtpOut = nil
+		return nil
+	}
+	tag, suite := "1", SuiteAES128SHA80
+	if receiver.srtpIn != nil {
+		tag, suite = receiver.srtpIn.tag, receiver.srtpIn.suite
+	}
+	if receiver.srtpOut == nil || receiver.srtpOut.tag != tag || receiver.srtpOut.suite != suite {
+		keys, err := newLocalSRTPContext(tag, suite)
+		if err != nil {
+			return err
+		}
+		receiver.srtpOut = keys
+	}
+	media.Lines = append(media.Lines, "a=crypto:"+receiver.srtpOut.attribute())
+	return nil
+}
+
+// iceAttributes refer to the transport addresses and ICE agent of the leg that sent an
+// SDP; they are dropped from the SDP relayed to the other leg.
+var iceAttributes = []string{"rtcp", "candidate", "ice-ufrag", "ice-pwd", "ice-options", "ice-lite", "end-of-candidates", "remote-candidates"}
+
+// removeSessionAttributes drops session level attributes.
+func removeSessionAttributes(lines []string, names ...string) []string {
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		keep := true
+		for _, name := range names {
+			if line == "a="+name || strings.HasPrefix(line, "a="+name+":") {
+				keep = false
+			}
+		}
+		if keep {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// removeAttributes drops attributes that refer to the original transport addresses.
+func removeAttributes(media *MediaSection, names ...string) {
+	lines := media.Lines[:1]
+	for _, line := range media.Lines[1:] {
+		keep := true
+		for _, name := range names {
+			if line == "a="+name || strings.HasPrefix(line, "a="+name+":") {
+				keep = false
+			}
+		}
+		if keep {
+			lines = append(lines, line)
+		}
+	}
+	media.Lines = lines
+}
+
+// openStream opens the sockets of both legs of a stream and starts relaying.
+func (s *RelaySession) openStream() (*relayStream, error) {
+	stream := &relayStream{}
+	for leg := range stream.legs {
+		rtpConn, rtcpConn, err := s.relay.allocate()
+		if err != nil {
+			for _, endpoint := range stream.legs[:leg] {
+				endpoint.rtp.Close()
+				endpoint.rtcp.Close()
+			}
+			return nil, err
+		}
+		endpoint := &relayEndpoint{rtp: rtpConn, rtcp: rtcpConn}
+		if s.relay.config.ICELite {
+			endpoint.iceUfrag, endpoint.icePwd = iceCredential(iceUfragLen), iceCredential(icePwdLen)
+			if s.relay.config.STUNServer != "" {
+				endpoint.mapped = gatherMapped(rtpConn, s.relay.config.STUNServer)
+			}
+		}
+		stream.legs[leg] = endpoint
+	}
+	for _, leg := range []Leg{LegA, LegB} {
+		go s.forward(stream, leg, false)
+		go s.forward(stream, leg, true)
+	}
+	return stream, nil
+}
+
+// forward relays the packets a leg sends on its RTP or RTCP socket to the other leg,
+// latching the leg's address to the packet source (symmetric RTP).
+func (s *RelaySession) forward(stream *relayStream, from Leg, rtcp bool) {
+	in, out := stream.legs[from].rtp, stream.legs[from.Other()].rtp
+	if rtcp {
+		in, out = stream.legs[from].rtcp, stream.legs[from.Other()].rtcp
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, source, err := in.ReadFromUDP(buf)
+		if err != nil {
+			return // socket closed
+		}
+
+		s.mutex.Lock()
+		sender, receiver := stream.legs[from], stream.legs[from.Other()]
+		packet := buf[:n]
+		if isSTUN(packet) { // ICE connectivity check or STUN keep-alive
+			if s.relay.config.ICELite && sender.answerBinding(in, packet, source) {
+				if rtcp {
+					sender.remoteRTCP = source
+				} else {
+					sender.remote = source
+				}
+			}
+			s.mutex.Unlock()
+			continue
+		}
+		if !stream.raw && sender.srtpIn != nil { // SRTP terminated at the relay
+			if rtcp {
+				packet, err = sender.srtpIn.unprotectRTCP(packet)
+			} else {
+				packet, err = sender.srtpIn.unprotectRTP(packet)
+			}
+			if err != nil {
+				s.mutex.Unlock()
+				continue
+			}
+		}
+		var target *net.UDPAddr
+		now := time.Now()
+		if rtcp {
+			sender.remoteRTCP = source
+			target = receiver.remoteRTCP
+			if !stream.raw {
+				sender.stats.report(packet, now)
+				if len(packet) >= 28 && packet[1] == 200 { // SR, the receiver's reports refer to it
+					receiver.stats.forwarded(packet, now)
+				}
+			}
+		} else {
+			sender.remote = source
+			target = receiver.remote
+			s.received = now
+		}
+		handlers := s.handlers
+		var lossHandlers []VideoLossHandler
+		codec := ""
+		if !rtcp && len(packet) >= 12 {
+			codec = sender.codecs[packet[1]&0x7f]
+			if !stream.raw && sender.stats.receive(packet, codec, now) && stream.video {
+				lossHandlers = s.onLoss
+			}
+		}
+		raw := stream.raw
+		if rtcp && !raw {
+			packet = receiver.protect(packet, true)
+		}
+		s.mutex.Unlock()
+
+		for _, handler := range lossHandlers {
+			handler(from)
+		}
+
+		muted := false
+		if !rtcp && !raw {
+			for _, handler := range handlers {
+				handler(from, codec, packet)
+			}
+			s.mutex.Lock()
+			if muted = receiver.playing != nil; !muted { // audio is being played to the receiver
+				if transcoder := stream.transcoders[from]; transcoder != nil {
+					packet = transcoder.convert(packet)
+				}
+				receiver.sent(packet)
+				packet = receiver.protect(packet, false)
+			}
+			s.mutex.Unlock()
+		}
+		if target != nil && !muted && packet != nil {
+			out.WriteToUDP(packet, target)
+		}
+	}
+}
+
+// Close closes all sockets of the session.
+func (s *RelaySession) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, stream := range s.streams {
+		if stream == nil {
+			continue
+		}
+		for _, endpoint := range stream.legs {
+			endpoint.rtp.Close()
+			endpoint.rtcp.Close()
+		}
+	}
+}
+
+// DirectPath reports whether media could flow between the legs without the relay:
+// connected is true once both legs have sent RTP on every stream, and direct is true
+// if each leg also sends from the address its SDP advertises. A leg behind NAT sends
+// from a translated address, so its media needs the relay to be latched.
+func (s *RelaySession) DirectPath() (connected, direct bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	direct = true
+	for _, stream := range s.streams {
+		if stream == nil || stream.legs[LegA].signaled == nil || stream.legs[LegB].signaled == nil {
+			continue // rejected by a leg
+		}
+		if stream.raw { // UDPTL is not measured, keep it relayed
+			return false, false
+		}
+		for _, endpoint := range stream.legs {
+			if endpoint.stats.packets == 0 {
+				return false, false
+			}
+			if !endpoint.signaled.IP.Equal(endpoint.remote.IP) || endpoint.signaled.Port != endpoint.remote.Port {
+				direct = false
+			}
+		}
+		connected = true
+	}
+	return connected, connected && direct
+}
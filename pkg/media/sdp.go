@@ -1 +1,370 @@
 package media
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// staticPayloadTypes are the codecs of the static RTP payload types (RFC 3551).
+var staticPayloadTypes = map[string]string{
+	"0":  "PCMU/8000",
+	"3":  "GSM/8000",
+	"4":  "G723/8000",
+	"8":  "PCMA/8000",
+	"9":  "G722/8000",
+	"13": "CN/8000",
+	"18": "G729/8000",
+}
+
+// directions are the SDP media direction attributes.
+var directions = []string{"sendrecv", "sendonly", "recvonly", "inactive"}
+
+// SDP is a session description split into the session section and the media sections.
+// Lines not changed through the accessors are kept verbatim.
+type SDP struct {
+	Session []string
+	Media   []*MediaSection
+}
+
+// MediaSection is a media description, starting with its m= line.
+type MediaSection struct {
+	Lines []string
+}
+
+// ParseSDP splits a session description into sections.
+func ParseSDP(body string) (*SDP, error) {
+	sdp := &SDP{}
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, fmt.Errorf("invalid SDP line %q", line)
+		}
+		switch {
+		case strings.HasPrefix(line, "m="):
+			sdp.Media = append(sdp.Media, &MediaSection{Lines: []string{line}})
+		case len(sdp.Media) > 0:
+			media := sdp.Media[len(sdp.Media)-1]
+			media.Lines = append(media.Lines, line)
+		default:
+			sdp.Session = append(sdp.Session, line)
+		}
+	}
+	if len(sdp.Session) == 0 || sdp.Session[0] != "v=0" {
+		return nil, fmt.Errorf("invalid SDP: missing v=0")
+	}
+	return sdp, nil
+}
+
+// String serializes the session description.
+func (s *SDP) String() string {
+	var b strings.Builder
+	for _, line := range s.Session {
+		b.WriteString(line + "\r\n")
+	}
+	for _, media := range s.Media {
+		for _, line := range media.Lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// Connection returns the connection address of a media section, which defaults to the
+// session level c= line.
+func (s *SDP) Connection(media *MediaSection) string {
+	if addr := connectionAddress(media.Lines); addr != "" {
+		return addr
+	}
+	return connectionAddress(s.Session)
+}
+
+// SetConnection replaces the connection addresses and the origin address with an IPv4
+// address, adding a session level c= line if a media section would be left without one.
+func (s *SDP) SetConnection(addr string) {
+	hasSession := false
+	for i, line := range s.Session {
+		switch {
+		case strings.HasPrefix(line, "c="):
+			s.Session[i] = "c=IN IP4 " + addr
+			hasSession = true
+		case strings.HasPrefix(line, "o="):
+			if fields := strings.Fields(line); len(fields) == 6 {
+				fields[4], fields[5] = "IP4", addr
+				s.Session[i] = strings.Join(fields, " ")
+			}
+		}
+	}
+	for _, media := range s.Media {
+		for i, line := range media.Lines {
+			if strings.HasPrefix(line, "c=") {
+				media.Lines[i] = "c=IN IP4 " + addr
+			}
+		}
+	}
+	if hasSession {
+		return
+	}
+	for i, line := range s.Session { // c= goes before the first t= line
+		if strings.HasPrefix(line, "t=") {
+			s.Session = append(s.Session[:i], append([]string{"c=IN IP4 " + addr}, s.Session[i:]...)...)
+			return
+		}
+	}
+	s.Session = append(s.Session, "c=IN IP4 "+addr)
+}
+
+// SetOrigin replaces the address of the origin line.
+func (s *SDP) SetOrigin(addr string) {
+	for i, line := range s.Session {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "o=") && len(fields) == 6 {
+			fields[4], fields[5] = "IP4", addr
+			s.Session[i] = strings.Join(fields, " ")
+		}
+	}
+}
+
+// ReplaceConnections replaces the address of each c= line for which replace returns a
+// non-empty address.
+func (s *SDP) ReplaceConnections(replace func(addr string) string) {
+	sections := [][]string{s.Session}
+	for _, media := range s.Media {
+		sections = append(sections, media.Lines)
+	}
+	for _, lines := range sections {
+		for i, line := range lines {
+			if !strings.HasPrefix(line, "c=") {
+				continue
+			}
+			if addr := replace(connectionAddress([]string{line})); addr != "" {
+				lines[i] = "c=IN IP4 " + addr
+			}
+		}
+	}
+}
+
+func connectionAddress(lines []string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "c=") {
+			if fields := strings.Fields(line[2:]); len(fields) == 3 {
+				return strings.SplitN(fields[2], "/", 2)[0] // strip multicast TTL
+			}
+		}
+	}
+	return ""
+}
+
+func (m *MediaSection) field(i int) string {
+	fields := strings.Fields(m.Lines[0][2:])
+	if i < len(fields) {
+		return fields[i]
+	}
+	return ""
+}
+
+// Type returns the media type, e.g. audio.
+func (m *MediaSection) Type() string {
+	return m.field(0)
+}
+
+// Port returns the media port, 0 for a rejected or disabled stream.
+func (m *MediaSection) Port() int {
+	port, _ := strconv.Atoi(strings.SplitN(m.field(1), "/", 2)[0])
+	return port
+}
+
+// SetPort replaces the media port.
+func (m *MediaSection) SetPort(port int) {
+	fields := strings.Fields(m.Lines[0][2:])
+	if len(fields) > 1 {
+		fields[1] = strconv.Itoa(port)
+		m.Lines[0] = "m=" + strings.Join(fields, " ")
+	}
+}
+
+// Proto returns the transport protocol, e.g. RTP/AVP.
+func (m *MediaSection) Proto() string {
+	return m.field(2)
+}
+
+// SetProto replaces the transport protocol.
+func (m *MediaSection) SetProto(proto string) {
+	fields := strings.Fields(m.Lines[0][2:])
+	if len(fields) > 2 {
+		fields[2] = proto
+		m.Lines[0] = "m=" + strings.Join(fields, " ")
+	}
+}
+
+// Formats returns the payload types of the media line.
+func (m *MediaSection) Formats() []string {
+	fields := strings.Fields(m.Lines[0][2:])
+	if len(fields) < 3 {
+		return nil
+	}
+	return fields[3:]
+}
+
+// SetFormats replaces the payload types of the media line and drops the rtpmap, fmtp
+// and rtcp-fb attributes of the removed ones.
+func (m *MediaSection) SetFormats(formats []string) {
+	fields := strings.Fields(m.Lines[0][2:])
+	if len(fields) < 3 {
+		return
+	}
+	m.Lines[0] = "m=" + strings.Join(append(fields[:3], formats...), " ")
+
+	keep := make(map[string]bool, len(formats))
+	for _, format := range formats {
+		keep[format] = true
+	}
+	lines := m.Lines[:1]
+	for _, line := range m.Lines[1:] {
+		removed := false
+		for _, name := range []string{"rtpmap", "fmtp", "rtcp-fb"} {
+			if strings.HasPrefix(line, "a="+name+":") {
+				pt := strings.Fields(line[len("a="+name+":"):])
+				removed = len(pt) > 0 && pt[0] != "*" && !keep[pt[0]]
+			}
+		}
+		if !removed {
+			lines = append(lines, line)
+		}
+	}
+	m.Lines = lines
+}
+
+// SetAttribute replaces the a=name:value attributes with the given name by a single one.
+func (m *MediaSection) SetAttribute(name, value string) {
+	lines := m.Lines[:1]
+	for _, line := range m.Lines[1:] {
+		if !strings.HasPrefix(line, "a="+name+":") {
+			lines = append(lines, line)
+		}
+	}
+	m.Lines = append(lines, "a="+name+":"+value)
+}
+
+// Attributes returns the values of the a=name:value attributes with the given name.
+func (m *MediaSection) Attributes(name string) []string {
+	var values []string
+	for _, line := range m.Lines {
+		if strings.HasPrefix(line, "a="+name+":") {
+			values = append(values, line[len("a="+name+":"):])
+		}
+	}
+	return values
+}
+
+// FilterAttributes drops the a=name:value attributes whose value keep rejects.
+func (m *MediaSection) FilterAttributes(name string, keep func(value string) bool) {
+	lines := m.Lines[:1]
+	for _, line := range m.Lines[1:] {
+		if !strings.HasPrefix(line, "a="+name+":") || keep(line[len("a="+name+":"):]) {
+			lines = append(lines, line)
+		}
+	}
+	m.Lines = lines
+}
+
+// HasAttribute reports whether the section has the property attribute a=name.
+func (m *MediaSection) HasAttribute(name string) bool {
+	for _, line := range m.Lines {
+		if line == "a="+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Codec returns the encoding name and clock rate (e.g. PCMU/8000) of a payload type.
+func (m *MediaSection) Codec(payloadType string) string {
+	for _, rtpmap := range m.Attributes("rtpmap") {
+		if fields := strings.Fields(rtpmap); len(fields) == 2 && fields[0] == payloadType {
+			return fields[1]
+		}
+	}
+	return staticPayloadTypes[payloadType]
+}
+
+// Direction returns the direction attribute, sendrecv if absent.
+func (m *MediaSection) Direction() string {
+	for _, direction := range directions {
+		if m.HasAttribute(direction) {
+			return direction
+		}
+	}
+	return "sendrecv"
+}
+
+// SetDirection replaces the direction attribute.
+func (m *MediaSection) SetDirection(direction string) {
+	lines := m.Lines[:1]
+	for _, line := range m.Lines[1:] {
+		isDirection := false
+		for _, d := range directions {
+			if line == "a="+d {
+				isDirection = true
+			}
+		}
+		if !isDirection {
+			lines = append(lines, line)
+		}
+	}
+	m.Lines = append(lines, "a="+direction)
+}
+
+// IsHold reports whether an SDP puts the audio on hold: a sendonly or inactive audio
+// stream, or the connection address 0.0.0.0 (RFC 2543).
+func IsHold(body string) bool {
+	sdp, err := ParseSDP(body)
+	if err != nil {
+		return false
+	}
+	for _, media := range sdp.Media {
+		if media.Port() == 0 || media.Type() != "audio" {
+			continue
+		}
+		if direction := media.Direction(); direction == "sendonly" || direction == "inactive" || sdp.Connection(media) == "0.0.0.0" {
+			return true
+		}
+	}
+	return false
+}
+
+// NextVersion returns body with the origin line of previous, the last SDP sent in the
+// dialog, and its version incremented, so the body can be offered as a change of the
+// session (RFC 3264, section 8).
+func NextVersion(previous, body string) (string, error) {
+	sdp, err := ParseSDP(body)
+	if err != nil {
+		return "", err
+	}
+	last, err := ParseSDP(previous)
+	if err != nil {
+		return "", err
+	}
+	origin := ""
+	for _, line := range last.Session {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "o=") && len(fields) == 6 {
+			version, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid SDP origin %q", line)
+			}
+			fields[2] = strconv.FormatUint(version+1, 10)
+			origin = strings.Join(fields, " ")
+		}
+	}
+	if origin == "" {
+		return "", fmt.Errorf("invalid SDP: missing o= line")
+	}
+	for i, line := range sdp.Session {
+		if strings.HasPrefix(line, "o=") {
+			sdp.Session[i] = origin
+		}
+	}
+	return sdp.String(), nil
+}
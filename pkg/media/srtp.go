@@ -0,0 +1,374 @@
+package media
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SDES crypto suites (RFC 4568) supported by the relay.
+const (
+	SuiteAES128SHA80 = "AES_CM_128_HMAC_SHA1_80"
+	SuiteAES128SHA32 = "AES_CM_128_HMAC_SHA1_32"
+)
+
+const (
+	srtpKeyLen     = 16 // AES-128 master and session key
+	srtpSaltLen    = 14 // master and session salt
+	srtpAuthKeyLen = 20 // HMAC-SHA1 session key
+	srtcpTagLen    = 10 // SRTCP always uses the 80-bit tag
+	srtcpIndexLen  = 4  // E flag and SRTCP index
+	srtpSeqHalf    = 0x8000
+	srtpReplaySize = 64 // packets covered by the replay window
+)
+
+// Errors for packets that are dropped.
+var (
+	errSRTPAuth   = errors.New("srtp: authentication failed")
+	errSRTPReplay = errors.New("srtp: replayed packet")
+)
+
+// srtpKeys are the session keys of one direction for RTP or RTCP.
+type srtpKeys struct {
+	block cipher.Block
+	salt  []byte
+	auth  []byte
+}
+
+// srtpSource is the rollover state and replay window of one SSRC.
+type srtpSource struct {
+	roc     uint32
+	lastSeq uint16
+	started bool
+	replay  replayWindow
+}
+
+// replayWindow remembers which of the last srtpReplaySize packet indexes were received
+// (RFC 3711 section 3.3.2).
+type replayWindow struct {
+	top     uint64 // highest index received
+	mask    uint64 // bit i is set when index top-i was received
+	started bool
+}
+
+// check reports whether a packet index is new: above the window or inside it and not
+// received yet. Indexes below the window are treated as replays.
+func (w *replayWindow) check(index uint64) bool {
+	if !w.started || index > w.top {
+		return true
+	}
+	diff := w.top - index
+	return diff < srtpReplaySize && w.mask&(1<<diff) == 0
+}
+
+// accept records an authenticated packet index.
+func (w *replayWindow) accept(index uint64) {
+	switch {
+	case !w.started:
+		w.top, w.mask, w.started = index, 1, true
+	case index > w.top:
+		if shift := index - w.top; shift < srtpReplaySize {
+			w.mask = w.mask<<shift | 1
+		} else {
+			w.mask = 1
+		}
+		w.top = index
+	default:
+		w.mask |= 1 << (w.top - index)
+	}
+}
+
+// srtpContext protects or unprotects the SRTP and SRTCP of one direction of a stream,
+// keyed by an SDES crypto attribute. It is not safe for concurrent use.
+type srtpContext struct {
+	tag       string // crypto attribute tag
+	suite     string
+	master    []byte // master key and salt, as sent in the SDP
+	tagLen    int    // SRTP authentication tag length
+	rtp, rtcp srtpKeys
+	sources   map[uint32]*srtpSource
+	rtcpIndex uint32 // last SRTCP index sent
+	rtcpRecv  replayWindow
+}
+
+// newSRTPContext derives the session keys from a master key and salt.
+func newSRTPContext(tag, suite string, master []byte) (*srtpContext, error) {
+	tagLen := 0
+	switch suite {
+	case SuiteAES128SHA80:
+		tagLen = 10
+	case SuiteAES128SHA32:
+		tagLen = 4
+	default:
+		return nil, fmt.Errorf("srtp: unsupported crypto suite %s", suite)
+	}
+	if len(master) != srtpKeyLen+srtpSaltLen {
+		return nil, fmt.Errorf("srtp: invalid master key length %d", len(master))
+	}
+	block, err := aes.NewCipher(master[:srtpKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	salt := master[srtpKeyLen:]
+	c := &srtpContext{tag: tag, suite: suite, master: master, tagLen: tagLen, sources: make(map[uint32]*srtpSource)}
+	for i, keys := range []*srtpKeys{&c.rtp, &c.rtcp} {
+		label := byte(3 * i) // 0-2 for SRTP, 3-5 for SRTCP
+		key := deriveSRTPKey(block, salt, label, srtpKeyLen)
+		if keys.block, err = aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+		keys.auth = deriveSRTPKey(block, salt, label+1, srtpAuthKeyLen)
+		keys.salt = deriveSRTPKey(block, salt, label+2, srtpSaltLen)
+	}
+	return c, nil
+}
+
+// newLocalSRTPContext creates a context with a random master key.
+func newLocalSRTPContext(tag, suite string) (*srtpContext, error) {
+	master := make([]byte, srtpKeyLen+srtpSaltLen)
+	if _, err := rand.Read(master); err != nil {
+		return nil, err
+	}
+	return newSRTPContext(tag, suite, master)
+}
+
+// deriveSRTPKey is the AES-CM key derivation of RFC 3711 section 4.3 with a key
+// derivation rate of 0.
+func deriveSRTPKey(master cipher.Block, salt []byte, label byte, length int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	iv[7] ^= label
+	key := make([]byte, length)
+	cipher.NewCTR(master, iv).XORKeyStream(key, key)
+	return key
+}
+
+// parseCrypto reads the first crypto attribute of a media section with a supported
+// suite, a single inline key and no MKI or session parameters.
+func parseCrypto(media *MediaSection) (*srtpContext, error) {
+	for _, value := range media.Attributes("crypto") {
+		fields := strings.Fields(value)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "inline:") {
+			continue
+		}
+		params := strings.Split(strings.TrimPrefix(fields[2], "inline:"), "|")
+		if len(params) > 2 || (len(params) == 2 && strings.Contains(params[1], ":")) { // MKI
+			continue
+		}
+		master, err := base64.StdEncoding.DecodeString(params[0])
+		if err != nil {
+			continue
+		}
+		if c, err := newSRTPContext(fields[0], fields[1], master); err == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("srtp: no supported crypto attribute in %s stream", media.Type())
+}
+
+// attribute returns the crypto attribute value advertising the context's master key.
+func (c *srtpContext) attribute() string {
+	return c.tag + " " + c.suite + " inline:" + base64.StdEncoding.EncodeToString(c.master)
+}
+
+// rtpHeaderLen returns the length of an RTP header with CSRCs and extension.
+func rtpHeaderLen(packet []byte) (int, bool) {
+	if len(packet) < 12 {
+		return 0, false
+	}
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return 0, false
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	return offset, offset <= len(packet)
+}
+
+// index estimates the rollover counter of a sequence number (RFC 3711 section 3.3.1).
+func (s *srtpSource) index(seq uint16) uint32 {
+	if !s.started {
+		return s.roc
+	}
+	if s.lastSeq < srtpSeqHalf {
+		if int(seq)-int(s.lastSeq) > srtpSeqHalf && s.roc > 0 {
+			return s.roc - 1
+		}
+	} else if int(s.lastSeq)-srtpSeqHalf > int(seq) {
+		return s.roc + 1
+	}
+	return s.roc
+}
+
+// update advances the rollover state after a packet was accepted or sent.
+func (s *srtpSource) update(roc uint32, seq uint16) {
+	if !s.started || roc > s.roc || (roc == s.roc && seq > s.lastSeq) {
+		s.started, s.roc, s.lastSeq = true, roc, seq
+	}
+}
+
+func (c *srtpContext) source(ssrc uint32) *srtpSource {
+	source := c.sources[ssrc]
+	if source == nil {
+		source = &srtpSource{}
+		c.sources[ssrc] = source
+	}
+	return source
+}
+
+// cryptRTP applies the AES-CM keystream to the payload of an RTP packet.
+func (c *srtpContext) cryptRTP(packet []byte, header int, roc uint32) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, c.rtp.salt)
+	for i, b := range packet[8:12] { // SSRC
+		iv[4+i] ^= b
+	}
+	var index [6]byte
+	binary.BigEndian.PutUint32(index[:], roc)
+	copy(index[4:], packet[2:4])
+	for i, b := range index {
+		iv[8+i] ^= b
+	}
+	cipher.NewCTR(c.rtp.block, iv).XORKeyStream(packet[header:], packet[header:])
+}
+
+// authRTP returns the authentication tag of an RTP packet.
+func (c *srtpContext) authRTP(packet []byte, roc uint32) []byte {
+	mac := hmac.New(sha1.New, c.rtp.auth)
+	mac.Write(packet)
+	var rocBytes [4]byte
+	binary.BigEndian.PutUint32(rocBytes[:], roc)
+	mac.Write(rocBytes[:])
+	return mac.Sum(nil)[:c.tagLen]
+}
+
+// protectRTP encrypts an RTP packet and returns it with the authentication tag.
+func (c *srtpContext) protectRTP(packet []byte) ([]byte, error) {
+	header, ok := rtpHeaderLen(packet)
+	if !ok {
+		return nil, fmt.Errorf("srtp: invalid RTP packet")
+	}
+	out := make([]byte, len(packet), len(packet)+c.tagLen)
+	copy(out, packet)
+	seq := binary.BigEndian.Uint16(out[2:])
+	source := c.source(binary.BigEndian.Uint32(out[8:]))
+	roc := source.index(seq)
+	c.cryptRTP(out, header, roc)
+	source.update(roc, seq)
+	return append(out, c.authRTP(out, roc)...), nil
+}
+
+// unprotectRTP authenticates and decrypts an SRTP packet in place and returns the RTP
+// packet without the authentication tag. Replayed packets are dropped.
+func (c *srtpContext) unprotectRTP(packet []byte) ([]byte, error) {
+	header, ok := rtpHeaderLen(packet)
+	if !ok || len(packet) < header+c.tagLen {
+		return nil, fmt.Errorf("srtp: invalid SRTP packet")
+	}
+	body := packet[:len(packet)-c.tagLen]
+	seq := binary.BigEndian.Uint16(body[2:])
+	source := c.source(binary.BigEndian.Uint32(body[8:]))
+	roc := source.index(seq)
+	index := uint64(roc)<<16 | uint64(seq)
+	if !source.replay.check(index) {
+		return nil, errSRTPReplay
+	}
+	if !hmac.Equal(packet[len(body):], c.authRTP(body, roc)) {
+		return nil, errSRTPAuth
+	}
+	c.cryptRTP(body, header, roc)
+	source.update(roc, seq)
+	source.replay.accept(index)
+	return body, nil
+}
+
+// cryptRTCP applies the AES-CM keystream to an RTCP compound packet after the first
+// header and sender SSRC.
+func (c *srtpContext) cryptRTCP(packet []byte, index uint32) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, c.rtcp.salt)
+	for i, b := range packet[4:8] {
+		iv[4+i] ^= b
+	}
+	var indexBytes [4]byte
+	binary.BigEndian.PutUint32(indexBytes[:], index)
+	for i, b := range indexBytes {
+		iv[10+i] ^= b
+	}
+	cipher.NewCTR(c.rtcp.block, iv).XORKeyStream(packet[8:], packet[8:])
+}
+
+// authRTCP returns the authentication tag of an SRTCP packet including its index.
+func (c *srtpContext) authRTCP(packet []byte) []byte {
+	mac := hmac.New(sha1.New, c.rtcp.auth)
+	mac.Write(packet)
+	return mac.Sum(nil)[:srtcpTagLen]
+}
+
+// protectRTCP encrypts an RTCP compound packet and appends the index and tag.
+func (c *srtpContext) protectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < 8 {
+		return nil, fmt.Errorf("srtp: invalid RTCP packet")
+	}
+	c.rtcpIndex = (c.rtcpIndex + 1) & 0x7fffffff
+	out := make([]byte, len(packet), len(packet)+srtcpIndexLen+srtcpTagLen)
+	copy(out, packet)
+	c.cryptRTCP(out, c.rtcpIndex)
+	var index [srtcpIndexLen]byte
+	binary.BigEndian.PutUint32(index[:], c.rtcpIndex|0x80000000) // E flag: encrypted
+	out = append(out, index[:]...)
+	return append(out, c.authRTCP(out)...), nil
+}
+
+// unprotectRTCP authenticates and decrypts an SRTCP packet in place and returns the
+// RTCP compound packet. Replayed packets are dropped.
+func (c *srtpContext) unprotectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < 8+srtcpIndexLen+srtcpTagLen {
+		return nil, fmt.Errorf("srtp: invalid SRTCP packet")
+	}
+	signed := packet[:len(packet)-srtcpTagLen]
+	body := signed[:len(signed)-srtcpIndexLen]
+	index := binary.BigEndian.Uint32(signed[len(body):])
+	if !c.rtcpRecv.check(uint64(index & 0x7fffffff)) {
+		return nil, errSRTPReplay
+	}
+	if !hmac.Equal(packet[len(signed):], c.authRTCP(signed)) {
+		return nil, errSRTPAuth
+	}
+	if index&0x80000000 != 0 {
+		c.cryptRTCP(body, index&0x7fffffff)
+	}
+	c.rtcpRecv.accept(uint64(index & 0x7fffffff))
+	return body, nil
+}
+
+// secureProto returns the SRTP or RTP profile matching a media protocol, e.g.
+// RTP/SAVPF for RTP/AVPF.
+func secureProto(proto string, secure bool) string {
+	upper := strings.ToUpper(proto)
+	feedback := strings.HasSuffix(upper, "F")
+	if !strings.HasPrefix(upper, "RTP/") || strings.Contains(upper, "TLS") { // e.g. UDP/TLS/RTP/SAVPF (DTLS)
+		return proto
+	}
+	profile := "RTP/AVP"
+	if secure {
+		profile = "RTP/SAVP"
+	}
+	if feedback {
+		profile += "F"
+	}
+	return profile
+}
+
+// isSecureProto reports whether a media protocol is an SRTP profile.
+func isSecureProto(proto string) bool {
+	return strings.Contains(strings.ToUpper(proto), "/SAVP")
+}
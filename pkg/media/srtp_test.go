@@ -0,0 +1,115 @@
+package media
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %s: %v", s, err)
+	}
+	return b
+}
+
+// TestSRTPKeyDerivation checks the key derivation against RFC 3711 appendix B.3.
+func TestSRTPKeyDerivation(t *testing.T) {
+	masterKey := unhex(t, "E1F97A0D3E018BE0D64FA32C06DE4139")
+	masterSalt := unhex(t, "0EC675AD498AFEEBB6960B3AABE6")
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		label  byte
+		length int
+		want   string
+	}{
+		{"cipher key", 0, srtpKeyLen, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{"cipher salt", 2, srtpSaltLen, "30CBBC08863D8C85D49DB34A9AE1"},
+		{"auth key", 1, srtpAuthKeyLen, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+	}
+	for _, tt := range tests {
+		if got := deriveSRTPKey(block, masterSalt, tt.label, tt.length); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("%s = %X; want %s", tt.name, got, tt.want)
+		}
+	}
+
+	c, err := newSRTPContext("1", SuiteAES128SHA80, append(append([]byte{}, masterKey...), masterSalt...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "30CBBC08863D8C85D49DB34A9AE1"); !bytes.Equal(c.rtp.salt, want) {
+		t.Errorf("context salt = %X; want %X", c.rtp.salt, want)
+	}
+	if want := unhex(t, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"); !bytes.Equal(c.rtp.auth, want) {
+		t.Errorf("context auth key = %X; want %X", c.rtp.auth, want)
+	}
+}
+
+// TestSRTPKeystream checks the AES-CM keystream of an RTP payload against RFC 3711
+// appendix B.2 (SSRC, ROC and sequence number zero).
+func TestSRTPKeystream(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "2B7E151628AED2A6ABF7158809CF4F3C"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &srtpContext{rtp: srtpKeys{block: block, salt: unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD")}}
+
+	packet := make([]byte, 12+3*aes.BlockSize)
+	packet[0] = 0x80
+	c.cryptRTP(packet, 12, 0)
+	want := unhex(t, "E03EAD0935C95E80E166B16DD92B4EB4"+
+		"D23513162B02D0F72A43A2FE4A5F97AB"+
+		"41E95B3BB0A2E8DD477901E4FCA894C0")
+	if !bytes.Equal(packet[12:], want) {
+		t.Errorf("keystream = %X; want %X", packet[12:], want)
+	}
+}
+
+// TestSRTPReplay checks that replayed and too old packets are dropped.
+func TestSRTPReplay(t *testing.T) {
+	master := make([]byte, srtpKeyLen+srtpSaltLen)
+	sender, _ := newSRTPContext("1", SuiteAES128SHA80, master)
+	receiver, _ := newSRTPContext("1", SuiteAES128SHA80, master)
+
+	rtp := func(seq uint16) []byte {
+		packet := []byte{0x80, 0, byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0, 0, 0, 1, 'h', 'i'}
+		out, err := sender.protectRTP(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	first, late, last := rtp(1), rtp(2), rtp(100)
+	if _, err := receiver.unprotectRTP(append([]byte{}, first...)); err != nil {
+		t.Fatalf("first packet: %v", err)
+	}
+	if _, err := receiver.unprotectRTP(append([]byte{}, first...)); err != errSRTPReplay {
+		t.Errorf("replayed packet: err = %v; want %v", err, errSRTPReplay)
+	}
+	if _, err := receiver.unprotectRTP(append([]byte{}, last...)); err != nil {
+		t.Fatalf("packet 100: %v", err)
+	}
+	if _, err := receiver.unprotectRTP(append([]byte{}, late...)); err != errSRTPReplay {
+		t.Errorf("packet behind the window: err = %v; want %v", err, errSRTPReplay)
+	}
+
+	report := []byte{0x80, 200, 0, 1, 0, 0, 0, 1}
+	srtcp, err := sender.protectRTCP(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.unprotectRTCP(append([]byte{}, srtcp...)); err != nil {
+		t.Fatalf("SRTCP packet: %v", err)
+	}
+	if _, err := receiver.unprotectRTCP(append([]byte{}, srtcp...)); err != errSRTPReplay {
+		t.Errorf("replayed SRTCP packet: err = %v; want %v", err, errSRTPReplay)
+	}
+}
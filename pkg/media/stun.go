@@ -0,0 +1,274 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"time"
+)
+
+// STUN message types and attributes (RFC 5389, RFC 8445).
+const (
+	stunBindingRequest = 0x0001
+	stunBindingSuccess = 0x0101
+	stunMagicCookie    = 0x2112a442
+	stunHeaderLen      = 20
+	stunFingerprintXOR = 0x5354554e
+	stunGatherTimeout  = 500 * time.Millisecond
+
+	stunAttrMapped      = 0x0001
+	stunAttrUsername    = 0x0006
+	stunAttrIntegrity   = 0x0008
+	stunAttrXORMapped   = 0x0020
+	stunAttrFingerprint = 0x8028
+)
+
+// ICE lite credentials and candidates.
+const (
+	iceUfragLen        = 8
+	icePwdLen          = 24
+	iceCandidateFormat = "%d %d UDP %d %s %d typ %s"
+	iceHostPriority    = 2130706431 // type preference 126, local preference 65535, component 1
+	iceSrflxPriority   = 1694498815 // type preference 100
+)
+
+const iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+
+// stunAttribute is a type-length-value attribute of a STUN message.
+type stunAttribute struct {
+	typ   uint16
+	value []byte
+}
+
+// stunMessage is a parsed STUN message; raw keeps the received bytes for integrity checks.
+type stunMessage struct {
+	typ        uint16
+	txID       []byte
+	attributes []stunAttribute
+	raw        []byte
+}
+
+// isSTUN reports whether a packet received on a media socket is a STUN message
+// (RFC 7983: first byte 0-3 and the magic cookie).
+func isSTUN(packet []byte) bool {
+	return len(packet) >= stunHeaderLen && packet[0] < 4 && binary.BigEndian.Uint32(packet[4:]) == stunMagicCookie
+}
+
+// parseSTUN parses a STUN message.
+func parseSTUN(packet []byte) (*stunMessage, error) {
+	if !isSTUN(packet) {
+		return nil, errors.New("stun: not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if stunHeaderLen+length > len(packet) {
+		return nil, errors.New("stun: truncated message")
+	}
+	msg := &stunMessage{
+		typ:  binary.BigEndian.Uint16(packet),
+		txID: packet[8:stunHeaderLen],
+		raw:  packet[:stunHeaderLen+length],
+	}
+	for body := msg.raw[stunHeaderLen:]; len(body) >= 4; {
+		typ, size := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+		if 4+size > len(body) {
+			return nil, errors.New("stun: truncated attribute")
+		}
+		msg.attributes = append(msg.attributes, stunAttribute{typ: typ, value: body[4 : 4+size]})
+		body = body[4+(size+3)&^3:]
+	}
+	return msg, nil
+}
+
+// get returns the value of the first attribute of a type.
+func (m *stunMessage) get(typ uint16) ([]byte, bool) {
+	for _, attr := range m.attributes {
+		if attr.typ == typ {
+			return attr.value, true
+		}
+	}
+	return nil, false
+}
+
+// verify checks the MESSAGE-INTEGRITY attribute with the short-term password.
+func (m *stunMessage) verify(password string) bool {
+	offset := stunHeaderLen
+	for _, attr := range m.attributes {
+		if attr.typ == stunAttrIntegrity {
+			if len(attr.value) != sha1.Size {
+				return false
+			}
+			signed := make([]byte, offset)
+			copy(signed, m.raw[:offset])
+			// the length covers the message up to and including MESSAGE-INTEGRITY
+			binary.BigEndian.PutUint16(signed[2:], uint16(offset-stunHeaderLen+4+sha1.Size))
+			mac := hmac.New(sha1.New, []byte(password))
+			mac.Write(signed)
+			return hmac.Equal(mac.Sum(nil), attr.value)
+		}
+		offset += 4 + (len(attr.value)+3)&^3
+	}
+	return false
+}
+
+// xorAddress returns the address of a (XOR-)MAPPED-ADDRESS attribute.
+func xorAddress(value []byte, xor bool) *net.UDPAddr {
+	if len(value) < 8 || value[1] != 0x01 { // IPv4 only
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, 4)
+	copy(ip, value[4:8])
+	if xor {
+		port ^= stunMagicCookie >> 16
+		var cookie [4]byte
+		binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+		for i := range ip {
+			ip[i] ^= cookie[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// stunBuilder builds a STUN message.
+type stunBuilder struct {
+	buf []byte
+}
+
+func newSTUN(typ uint16, txID []byte) *stunBuilder {
+	buf := make([]byte, stunHeaderLen, 128)
+	binary.BigEndian.PutUint16(buf, typ)
+	binary.BigEndian.PutUint32(buf[4:], stunMagicCookie)
+	copy(buf[8:], txID)
+	return &stunBuilder{buf: buf}
+}
+
+// add appends an attribute, padded to four bytes, and updates the message length.
+func (b *stunBuilder) add(typ uint16, value []byte) {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[:], typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	b.buf = append(b.buf, header[:]...)
+	b.buf = append(b.buf, value...)
+	for len(b.buf)%4 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	binary.BigEndian.PutUint16(b.buf[2:], uint16(len(b.buf)-stunHeaderLen))
+}
+
+// addXORAddress appends an XOR-MAPPED-ADDRESS attribute.
+func (b *stunBuilder) addXORAddress(addr *net.UDPAddr) {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return
+	}
+	value := make([]byte, 8)
+	value[1] = 0x01
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^stunMagicCookie>>16)
+	binary.BigEndian.PutUint32(value[4:], binary.BigEndian.Uint32(ip)^stunMagicCookie)
+	b.add(stunAttrXORMapped, value)
+}
+
+// sign appends MESSAGE-INTEGRITY with the short-term password and FINGERPRINT.
+func (b *stunBuilder) sign(password string) []byte {
+	binary.BigEndian.PutUint16(b.buf[2:], uint16(len(b.buf)-stunHeaderLen+4+sha1.Size))
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(b.buf)
+	b.add(stunAttrIntegrity, mac.Sum(nil))
+	return b.fingerprint()
+}
+
+// fingerprint appends FINGERPRINT and returns the message.
+func (b *stunBuilder) fingerprint() []byte {
+	binary.BigEndian.PutUint16(b.buf[2:], uint16(len(b.buf)-stunHeaderLen+8))
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, crc32.ChecksumIEEE(b.buf)^stunFingerprintXOR)
+	b.add(stunAttrFingerprint, value)
+	return b.buf
+}
+
+// iceCredential returns a random ICE ufrag or password of the given length.
+func iceCredential(length int) string {
+	random := make([]byte, length)
+	rand.Read(random)
+	for i, b := range random {
+		random[i] = iceChars[int(b)%len(iceChars)]
+	}
+	return string(random)
+}
+
+// gatherMapped asks a STUN server for the public address of a socket before the socket
+// is used for media. It returns nil if the server does not answer in time.
+func gatherMapped(conn *net.UDPConn, server string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil
+	}
+	txID := make([]byte, 12)
+	rand.Read(txID)
+	if _, err := conn.WriteToUDP(newSTUN(stunBindingRequest, txID).fingerprint(), addr); err != nil {
+		return nil
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	conn.SetReadDeadline(time.Now().Add(stunGatherTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		msg, err := parseSTUN(buf[:n])
+		if err != nil || msg.typ != stunBindingSuccess || string(msg.txID) != string(txID) {
+			continue
+		}
+		if value, ok := msg.get(stunAttrXORMapped); ok {
+			return xorAddress(value, true)
+		}
+		if value, ok := msg.get(stunAttrMapped); ok {
+			return xorAddress(value, false)
+		}
+		return nil
+	}
+}
+
+// answerBinding answers an ICE connectivity check or a plain STUN binding request
+// received by an endpoint. It returns false if the request is not valid for the endpoint.
+func (e *relayEndpoint) answerBinding(conn *net.UDPConn, packet []byte, source *net.UDPAddr) bool {
+	msg, err := parseSTUN(packet)
+	if err != nil || msg.typ != stunBindingRequest {
+		return false
+	}
+	response := newSTUN(stunBindingSuccess, msg.txID)
+	response.addXORAddress(source)
+	username, checked := msg.get(stunAttrUsername)
+	if !checked { // not ICE: a keep-alive or NAT discovery request
+		conn.WriteToUDP(response.fingerprint(), source)
+		return true
+	}
+	if e.iceUfrag == "" || !strings.HasPrefix(string(username), e.iceUfrag+":") || !msg.verify(e.icePwd) {
+		return false
+	}
+	conn.WriteToUDP(response.sign(e.icePwd), source)
+	return true
+}
+
+// candidates returns the ICE candidate attributes of an endpoint: host candidates of
+// the public address and, if a STUN server mapped the RTP port, server reflexive ones.
+func (e *relayEndpoint) candidates(publicIP string) []string {
+	port := e.rtp.LocalAddr().(*net.UDPAddr).Port
+	lines := []string{
+		"a=candidate:" + fmt.Sprintf(iceCandidateFormat, 1, 1, iceHostPriority, publicIP, port, "host"),
+		"a=candidate:" + fmt.Sprintf(iceCandidateFormat, 1, 2, iceHostPriority-1, publicIP, port+1, "host"),
+	}
+	if e.mapped != nil && (e.mapped.IP.String() != publicIP || e.mapped.Port != port) {
+		lines = append(lines,
+			"a=candidate:"+fmt.Sprintf(iceCandidateFormat, 2, 1, iceSrflxPriority, e.mapped.IP, e.mapped.Port, "srflx")+fmt.Sprintf(" raddr %s rport %d", publicIP, port),
+			"a=candidate:"+fmt.Sprintf(iceCandidateFormat, 2, 2, iceSrflxPriority-1, e.mapped.IP, e.mapped.Port+1, "srflx")+fmt.Sprintf(" raddr %s rport %d", publicIP, port+1))
+	}
+	return append(lines, "a=end-of-candidates")
+}
@@ -0,0 +1,337 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AudioCodec converts between an RTP payload and 16-bit linear samples.
+type AudioCodec interface {
+	ClockRate() int
+	Decode(payload []byte) []int16
+	Encode(samples []int16) []byte
+}
+
+var (
+	audioCodecsMu sync.RWMutex
+	audioCodecs   = map[string]AudioCodec{
+		"PCMU/8000": g711Codec{encode: EncodeULaw, decode: DecodeULaw},
+		"PCMA/8000": g711Codec{encode: EncodeALaw, decode: DecodeALaw},
+		"L16/8000":  l16Codec{rate: 8000},
+		"L16/16000": l16Codec{rate: 16000},
+	}
+)
+
+// RegisterCodec adds a codec (e.g. an Opus binding) that the relay can transcode.
+// name is the encoding name and clock rate as in rtpmap, e.g. opus/48000.
+func RegisterCodec(name string, codec AudioCodec) {
+	audioCodecsMu.Lock()
+	defer audioCodecsMu.Unlock()
+	audioCodecs[codecKey(name)] = codec
+}
+
+// TranscodableCodecs returns the names of the codecs the relay can transcode.
+func TranscodableCodecs() []string {
+	audioCodecsMu.RLock()
+	defer audioCodecsMu.RUnlock()
+	names := make([]string, 0, len(audioCodecs))
+	for name := range audioCodecs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// lookupCodec returns the codec of an rtpmap encoding, ignoring the channel count.
+func lookupCodec(name string) AudioCodec {
+	audioCodecsMu.RLock()
+	defer audioCodecsMu.RUnlock()
+	return audioCodecs[codecKey(name)]
+}
+
+// codecKey normalizes an encoding name: upper case except opus, without channels.
+func codecKey(name string) string {
+	fields := strings.SplitN(name, "/", 3)
+	if len(fields) < 2 {
+		return strings.ToUpper(name)
+	}
+	encoding := strings.ToUpper(fields[0])
+	if encoding == "OPUS" {
+		encoding = "opus"
+	}
+	return encoding + "/" + fields[1]
+}
+
+type g711Codec struct {
+	encode func(int16) byte
+	decode func(byte) int16
+}
+
+func (c g711Codec) ClockRate() int { return 8000 }
+
+func (c g711Codec) Decode(payload []byte) []int16 {
+	samples := make([]int16, len(payload))
+	for i, b := range payload {
+		samples[i] = c.decode(b)
+	}
+	return samples
+}
+
+func (c g711Codec) Encode(samples []int16) []byte {
+	payload := make([]byte, len(samples))
+	for i, s := range samples {
+		payload[i] = c.encode(s)
+	}
+	return payload
+}
+
+// l16Codec is 16-bit linear PCM in network byte order (RFC 3551).
+type l16Codec struct {
+	rate int
+}
+
+func (c l16Codec) ClockRate() int { return c.rate }
+
+func (c l16Codec) Decode(payload []byte) []int16 {
+	samples := make([]int16, len(payload)/2)
+	for i := range samples {
+		samples[i] = int16(binary.BigEndian.Uint16(payload[2*i:]))
+	}
+	return samples
+}
+
+func (c l16Codec) Encode(samples []int16) []byte {
+	payload := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.BigEndian.PutUint16(payload[2*i:], uint16(s))
+	}
+	return payload
+}
+
+// resample converts samples between clock rates by linear interpolation.
+func resample(samples []int16, from, to int) []int16 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	out := make([]int16, len(samples)*to/from)
+	for i := range out {
+		pos := i * from
+		j, frac := pos/to, pos%to
+		next := j + 1
+		if next >= len(samples) {
+			next = len(samples) - 1
+		}
+		out[i] = int16((int(samples[j])*(to-frac) + int(samples[next])*frac) / to)
+	}
+	return out
+}
+
+// transcoder converts the packets one leg sends to the codec of the other leg.
+type transcoder struct {
+	inPT, outPT     byte
+	in, out         AudioCodec
+	eventPT         [2]byte // telephone-event payload types (in, out), mapped when both legs have one
+	events          bool
+	started         bool
+	baseIn, baseOut uint32 // first input timestamp and the output timestamp it maps to
+}
+
+// convert returns the packet transcoded to the other leg's codec, or the packet itself
+// when its payload type is not transcoded.
+func (t *transcoder) convert(packet []byte) []byte {
+	if len(packet) < 12 {
+		return packet
+	}
+	pt := packet[1] & 0x7f
+	if t.events && pt == t.eventPT[0] {
+		packet[1] = packet[1]&0x80 | t.eventPT[1]
+		return packet
+	}
+	if pt != t.inPT {
+		return packet
+	}
+	payload, _, timestamp, ok := rtpPayload(packet)
+	if !ok {
+		return packet
+	}
+	samples := resample(t.in.Decode(payload), t.in.ClockRate(), t.out.ClockRate())
+
+	if !t.started {
+		t.started, t.baseIn, t.baseOut = true, timestamp, timestamp
+	}
+	elapsed := uint64(timestamp - t.baseIn)
+	outTimestamp := t.baseOut + uint32(elapsed*uint64(t.out.ClockRate())/uint64(t.in.ClockRate()))
+
+	converted := make([]byte, 12, 12+2*len(samples))
+	copy(converted, packet[:12])
+	converted[0] &^= 0x3f // no padding, extension or CSRCs
+	converted[1] = packet[1]&0x80 | t.outPT
+	binary.BigEndian.PutUint32(converted[4:], outTimestamp)
+	return append(converted, t.out.Encode(samples)...)
+}
+
+// Transcode compares the answer of the B-leg, already passed through Rewrite, with the
+// codecs the A-leg offered. For each stream without a common codec it transcodes
+// between the B-leg's codec and the first convertible codec of the A-leg, and rewrites
+// the answer to that codec. With preferWideband a wideband codec of the B-leg is
+// converted to the first convertible wideband codec of the A-leg, if any, rather than
+// down to narrowband. It returns the answer for the A-leg and whether any stream is
+// transcoded; the answer is unchanged when no stream needs transcoding.
+func (s *RelaySession) Transcode(answer string, preferWideband bool) (string, bool, error) {
+	sdp, err := ParseSDP(answer)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transcoded := false
+	for i, media := range sdp.Media {
+		if media.Port() == 0 || i >= len(s.streams) || s.streams[i] == nil || media.Type() != "audio" {
+			continue
+		}
+		stream := s.streams[i]
+		a, b := stream.legs[LegA], stream.legs[LegB]
+
+		var bPT byte
+		bCodec := ""
+		for _, format := range media.Formats() {
+			codec := media.Codec(format)
+			if pt, err := strconv.Atoi(format); err == nil && !isEventCodec(codec) {
+				bPT, bCodec = byte(pt), codec
+				break
+			}
+		}
+		if bCodec == "" || a.hasCodec(bCodec) {
+			continue
+		}
+		out := lookupCodec(bCodec)
+		if out == nil {
+			return "", false, fmt.Errorf("media relay: cannot transcode %s", bCodec)
+		}
+		aPT, aCodec := byte(0), ""
+		for _, pt := range a.order {
+			if codec := a.codecs[pt]; !isEventCodec(codec) && lookupCodec(codec) != nil {
+				if aCodec == "" {
+					aPT, aCodec = pt, codec
+				}
+				if !preferWideband || !IsWideband(bCodec) || IsWideband(codec) {
+					aPT, aCodec = pt, codec
+					break
+				}
+			}
+		}
+		if aCodec == "" {
+			return "", false, fmt.Errorf("media relay: no A-Leg codec convertible to %s", bCodec)
+		}
+		in := lookupCodec(aCodec)
+
+		stream.transcoders[LegA] = &transcoder{inPT: aPT, outPT: bPT, in: in, out: out}
+		stream.transcoders[LegB] = &transcoder{inPT: bPT, outPT: aPT, in: out, out: in}
+		formats := []string{strconv.Itoa(int(aPT))}
+		rtpmap := []string{strconv.Itoa(int(aPT)) + " " + aCodec}
+		if aEvent, ok := a.telephoneEvent(); ok {
+			if bEvent, ok := b.telephoneEvent(); ok && codecKey(a.codecs[aEvent]) == codecKey(b.codecs[bEvent]) {
+				stream.transcoders[LegA].eventPT, stream.transcoders[LegA].events = [2]byte{aEvent, bEvent}, true
+				stream.transcoders[LegB].eventPT, stream.transcoders[LegB].events = [2]byte{bEvent, aEvent}, true
+				formats = append(formats, strconv.Itoa(int(aEvent)))
+				rtpmap = append(rtpmap, strconv.Itoa(int(aEvent))+" "+a.codecs[aEvent])
+			}
+		}
+
+		media.SetFormats(formats)
+		lines := media.Lines[:1]
+		for _, line := range media.Lines[1:] {
+			if !strings.HasPrefix(line, "a=rtpmap:") && !strings.HasPrefix(line, "a=fmtp:") {
+				lines = append(lines, line)
+			}
+		}
+		for _, value := range rtpmap {
+			lines = append(lines, "a=rtpmap:"+value)
+		}
+		media.Lines = lines
+		transcoded = true
+	}
+	if !transcoded {
+		return answer, false, nil
+	}
+	return sdp.String(), true, nil
+}
+
+// AddCodecs appends the given transcodable codecs to the audio streams of an offer that
+// do not list them yet, so that the answerer can pick one when it shares no codec with
+// the offerer. Static payload types are used where defined, dynamic ones otherwise.
+func AddCodecs(offer string, codecs []string) (string, error) {
+	sdp, err := ParseSDP(offer)
+	if err != nil {
+		return "", err
+	}
+	for _, media := range sdp.Media {
+		if media.Port() == 0 || media.Type() != "audio" {
+			continue
+		}
+		formats := media.Formats()
+		used := make(map[string]bool)
+		present := make(map[string]bool)
+		for _, format := range formats {
+			used[format] = true
+			present[codecKey(media.Codec(format))] = true
+		}
+		for _, codec := range codecs {
+			if present[codecKey(codec)] || lookupCodec(codec) == nil {
+				continue
+			}
+			format := ""
+			for pt, static := range staticPayloadTypes {
+				if codecKey(static) == codecKey(codec) && !used[pt] {
+					format = pt
+				}
+			}
+			if format == "" {
+				for pt := 96; pt < 128; pt++ {
+					if !used[strconv.Itoa(pt)] {
+						format = strconv.Itoa(pt)
+						break
+					}
+				}
+			}
+			if format == "" {
+				break
+			}
+			used[format], present[codecKey(codec)] = true, true
+			formats = append(formats, format)
+			media.SetFormats(formats)
+			if _, static := staticPayloadTypes[format]; !static {
+				media.Lines = append(media.Lines, "a=rtpmap:"+format+" "+codec)
+			}
+		}
+	}
+	return sdp.String(), nil
+}
+
+// hasCodec reports whether the endpoint offered the codec.
+func (e *relayEndpoint) hasCodec(codec string) bool {
+	for _, c := range e.codecs {
+		if codecKey(c) == codecKey(codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWideband reports whether a codec carries wideband audio: G.722 (whose RTP clock
+// rate is 8000 for historical reasons), Opus, or any codec sampled at 16 kHz or more.
+func IsWideband(codec string) bool {
+	encoding := strings.ToUpper(strings.SplitN(codec, "/", 2)[0])
+	if encoding == "G722" || encoding == "OPUS" {
+		return true
+	}
+	return !isEventCodec(codec) && clockRate(codec) >= 16000
+}
+
+func isEventCodec(codec string) bool {
+	encoding := strings.ToLower(strings.SplitN(codec, "/", 2)[0])
+	return encoding == "telephone-event" || encoding == "cn"
+}
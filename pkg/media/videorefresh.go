@@ -0,0 +1,84 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+)
+
+// PictureFastUpdate is the XML body of a SIP INFO asking the receiver's video encoder
+// for a key frame (RFC 5168).
+const PictureFastUpdate = `<?xml version="1.0" encoding="utf-8" ?>
+<media_control>
+  <vc_primitive>
+    <to_encoder>
+      <picture_fast_update/>
+    </to_encoder>
+  </vc_primitive>
+</media_control>
+`
+
+// MediaControlType is the content type of PictureFastUpdate.
+const MediaControlType = "application/media_control+xml"
+
+// VideoLossHandler is called when RTP packets of a video stream sent by a leg are
+// missing at the relay, so the receiver's picture is likely corrupted until the next key
+// frame. It is called from the forwarding goroutine and must not block.
+type VideoLossHandler func(from Leg)
+
+// OnVideoLoss registers a handler called on packet loss in the video a leg sends.
+func (s *RelaySession) OnVideoLoss(handler VideoLossHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onLoss = append(s.onLoss, handler)
+}
+
+// HasVideo reports whether the session relays a video stream.
+func (s *RelaySession) HasVideo() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, stream := range s.streams {
+		if stream != nil && stream.video && !stream.raw {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestKeyFrame sends an RTCP Picture Loss Indication (RFC 4585) to a leg on each of
+// its video streams, asking its encoder for a key frame. It fails if the leg has not sent
+// video yet, since the PLI must name the SSRC of the leg's stream.
+func (s *RelaySession) RequestKeyFrame(to Leg) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("media relay: session closed")
+	}
+	sent := false
+	for _, stream := range s.streams {
+		if stream == nil || !stream.video || stream.raw {
+			continue
+		}
+		endpoint := stream.legs[to]
+		if !endpoint.stats.started || endpoint.remoteRTCP == nil {
+			continue
+		}
+		if endpoint.ssrc == 0 {
+			endpoint.ssrc = rand.Uint32()
+		}
+		pli := make([]byte, 12)
+		pli[0] = 0x80 | 1 // V=2, FMT=1 (PLI)
+		pli[1] = 206      // payload-specific feedback
+		binary.BigEndian.PutUint16(pli[2:], 2)
+		binary.BigEndian.PutUint32(pli[4:], endpoint.ssrc)
+		binary.BigEndian.PutUint32(pli[8:], endpoint.stats.ssrc)
+		if packet := endpoint.protect(pli, true); packet != nil {
+			endpoint.rtcp.WriteToUDP(packet, endpoint.remoteRTCP)
+			sent = true
+		}
+	}
+	if !sent {
+		return fmt.Errorf("media relay: no video received from %s-Leg", to)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// BodyPart is a non-SDP part of a multipart message body, e.g. SIP-T ISUP or PIDF-LO.
+type BodyPart struct {
+	Header textproto.MIMEHeader
+	Body   string
+}
+
+// ContentType returns the media type of the part without parameters.
+func (p BodyPart) ContentType() string {
+	mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// contentType returns the Content-Type of msg, empty if none.
+func contentType(msg sip.Message) string {
+	if hdrs := msg.GetHeaders("Content-Type"); len(hdrs) > 0 {
+		return hdrs[0].Value()
+	}
+	return ""
+}
+
+// isMultipart reports whether msg has a multipart body.
+func isMultipart(msg sip.Message) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType(msg))), "multipart/")
+}
+
+// SplitBody separates the SDP of a message body from its other parts. Bodies that are
+// not multipart are returned unchanged as SDP.
+func SplitBody(msg sip.Message) (string, []BodyPart) {
+	mediaType, params, err := mime.ParseMediaType(contentType(msg))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return msg.Body(), nil
+	}
+	sdp := ""
+	var parts []BodyPart
+	reader := multipart.NewReader(strings.NewReader(msg.Body()), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			break
+		}
+		bodyPart := BodyPart{Header: part.Header, Body: string(data)}
+		if sdp == "" && bodyPart.ContentType() == "application/sdp" {
+			sdp = bodyPart.Body
+			continue
+		}
+		parts = append(parts, bodyPart)
+	}
+	return sdp, parts
+}
+
+// SdpBody returns the SDP of a message body, extracted from multipart bodies.
+func SdpBody(msg sip.Message) string {
+	sdp, _ := SplitBody(msg)
+	return sdp
+}
+
+// JoinBody builds a message body from an SDP and additional parts. Without parts the SDP
+// is returned as is with Content-Type application/sdp, otherwise a multipart/mixed body.
+func JoinBody(sdp string, parts []BodyPart) (string, string) {
+	if len(parts) == 0 {
+		return sdp, "application/sdp"
+	}
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	if sdp != "" {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/sdp")
+		w, _ := writer.CreatePart(header)
+		w.Write([]byte(sdp))
+	}
+	for _, part := range parts {
+		w, _ := writer.CreatePart(part.Header)
+		w.Write([]byte(part.Body))
+	}
+	writer.Close()
+	return buf.String(), "multipart/mixed;boundary=" + writer.Boundary()
+}
@@ -0,0 +1,106 @@
+package session
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// DialogState is the serializable state of an established dialog: what another
+// instance needs to send in-dialog requests (e.g. BYE) to the remote party after
+// taking over the dialog.
+type DialogState struct {
+	CallID       string   `json:"call_id"`
+	LocalURI     string   `json:"local_uri"`           // From of the requests we send, with our tag
+	RemoteURI    string   `json:"remote_uri"`          // To of the requests we send, with the remote tag
+	RemoteTarget string   `json:"remote_target"`       // Request-URI of in-dialog requests
+	LocalContact string   `json:"local_contact"`       // our Contact, for responses to in-dialog requests
+	RouteSet     []string `json:"route_set,omitempty"` // Route headers of in-dialog requests, in order
+	LocalCSeq    uint32   `json:"local_cseq"`          // CSeq of the last request we sent
+	LocalSdp     string   `json:"local_sdp,omitempty"` // last SDP we sent to the remote party
+	Transport    string   `json:"transport"`
+	Destination  string   `json:"destination"` // host:port the remote party is reached at
+}
+
+// DialogState returns the current state of the dialog.
+func (s *Session) DialogState() DialogState {
+	s.lock.Lock()
+	cseq := s.localCSeq
+	s.lock.Unlock()
+	if cseq == 0 {
+		if hdr, ok := s.request.CSeq(); ok {
+			cseq = hdr.SeqNo
+		}
+	}
+
+	state := DialogState{
+		CallID:    string(s.callID),
+		LocalURI:  s.localURI.String(),
+		RemoteURI: s.remoteURI.String(),
+		LocalCSeq: cseq,
+		LocalSdp:  s.LocalSdp(),
+		Transport: s.request.Transport(),
+	}
+	if s.remoteTarget != nil {
+		state.RemoteTarget = s.remoteTarget.String()
+	}
+	if s.contact != nil {
+		state.LocalContact = s.contact.Value()
+	}
+
+	var recordRoute []sip.Header
+	if s.uaType == "UAC" {
+		state.Destination = s.request.Destination()
+		if s.response != nil {
+			recordRoute = s.response.GetHeaders("Record-Route")
+			if contact, ok := s.response.Contact(); ok && contact.Address != nil { // the 2xx Contact is the remote target
+				state.RemoteTarget = contact.Address.String()
+			}
+		}
+		// the route set of a UAC is the Record-Route of the response in reverse order
+		for i := len(recordRoute) - 1; i >= 0; i-- {
+			state.RouteSet = append(state.RouteSet, routeAddresses(recordRoute[i], true)...)
+		}
+	} else {
+		state.Destination = s.request.Source()
+		for _, header := range s.request.GetHeaders("Record-Route") {
+			state.RouteSet = append(state.RouteSet, routeAddresses(header, false)...)
+		}
+	}
+	return state
+}
+
+// routeAddresses returns the addresses of a Record-Route header, reversed if needed.
+func routeAddresses(header sip.Header, reverse bool) []string {
+	rr, ok := header.(*sip.RecordRouteHeader)
+	if !ok {
+		return nil
+	}
+	addresses := make([]string, 0, len(rr.Addresses))
+	for _, uri := range rr.Addresses {
+		addresses = append(addresses, "<"+uri.String()+">")
+	}
+	if reverse {
+		for i, j := 0, len(addresses)-1; i < j; i, j = i+1, j-1 {
+			addresses[i], addresses[j] = addresses[j], addresses[i]
+		}
+	}
+	return addresses
+}
+
+// DialogID returns the Call-ID and the local and remote tags identifying the dialog,
+// e.g. to match the Replaces header of an incoming INVITE (RFC 3891).
+func (s *Session) DialogID() (callID, localTag, remoteTag string) {
+	callID = string(s.callID)
+	localTag, remoteTag = addressTag(s.localURI), addressTag(s.remoteURI)
+	return callID, localTag, remoteTag
+}
+
+// addressTag returns the tag parameter of a From or To address, empty if there is none.
+func addressTag(address sip.Address) string {
+	if address.Params == nil {
+		return ""
+	}
+	if tag, ok := address.Params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+	return ""
+}
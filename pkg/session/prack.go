@@ -0,0 +1,209 @@
+package session
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// Extension100rel is the option tag of reliable provisional responses (RFC 3262).
+const Extension100rel = "100rel"
+
+// HasOption reports whether a header of msg named name (e.g. Supported or Require)
+// lists the option tag.
+func HasOption(msg sip.Message, name, option string) bool {
+	for _, header := range msg.GetHeaders(name) {
+		for _, tag := range strings.Split(header.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(tag), option) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsReliable reports whether response is a reliable provisional response.
+func IsReliable(response sip.Response) bool {
+	code := response.StatusCode()
+	return code > 100 && code < 200 && HasOption(response, "Require", Extension100rel)
+}
+
+// headerNumber returns the first number in the value of the header named name.
+func headerNumber(msg sip.Message, name string) (uint32, bool) {
+	hdrs := msg.GetHeaders(name)
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	fields := strings.Fields(hdrs[0].Value())
+	if len(fields) == 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 32)
+	return uint32(n), err == nil
+}
+
+// SupportsReliable reports whether the caller of an incoming session supports or
+// requires reliable provisional responses.
+func (s *Session) SupportsReliable() bool {
+	return s.uaType == "UAS" && (HasOption(s.request, "Supported", Extension100rel) ||
+		HasOption(s.request, "Require", Extension100rel))
+}
+
+// SetPrackTimeout sets the function called when no PRACK arrives for a reliable
+// provisional response within 64*T1.
+func (s *Session) SetPrackTimeout(onTimeout func()) {
+	s.onPrackTimeout = onTimeout
+}
+
+// queuedProvisional is a reliable provisional response waiting for the PRACK of the
+// previous one.
+type queuedProvisional struct {
+	statusCode sip.StatusCode
+	reason     string
+}
+
+// ProvisionalReliable sends a provisional response reliably: it carries Require: 100rel
+// and an RSeq, and is retransmitted until the PRACK arrives. Only one reliable provisional
+// response may be unacknowledged; while one is, the response is queued and sent once the
+// PRACK arrives (RFC 3262 3).
+func (s *Session) ProvisionalReliable(statusCode sip.StatusCode, reason string) {
+	s.lock.Lock()
+	if s.response != nil && s.response.StatusCode() >= 200 { // dequeued by a PRACK that crossed the final response
+		s.lock.Unlock()
+		return
+	}
+	if s.prack != nil {
+		s.queued = append(s.queued, queuedProvisional{statusCode: statusCode, reason: reason})
+		s.lock.Unlock()
+		s.Log().Debugf("Reliable provisional response pending, queueing %d until its PRACK", statusCode)
+		return
+	}
+	response := s.provisionalResponse(statusCode, reason)
+	if s.rseq == 0 {
+		s.rseq = uint32(rand.Int31n(1<<30)) + 1 // leaves room below 2**31-1 for later responses
+	} else {
+		s.rseq++
+	}
+	response.AppendHeader(&sip.RequireHeader{Options: []string{Extension100rel}})
+	response.AppendHeader(&sip.GenericHeader{HeaderName: "RSeq", Contents: strconv.FormatUint(uint64(s.rseq), 10)})
+	s.prack = response
+	s.response = response // also written from the PRACK handler via AcknowledgeProvisional
+	s.lock.Unlock()
+
+	tx := (s.transaction.(sip.ServerTransaction))
+	tx.Respond(response)
+	go s.retransmitReliable(tx, response)
+}
+
+// AcknowledgeProvisional matches a PRACK against the reliable provisional response
+// waiting for it and stops its retransmission. It reports false when the RAck matches
+// no such response. The next queued reliable provisional response, if any, is sent.
+// Offers in the PRACK body are not negotiated.
+func (s *Session) AcknowledgeProvisional(prack sip.Request) bool {
+	hdrs := prack.GetHeaders("RAck")
+	if len(hdrs) == 0 {
+		return false
+	}
+	fields := strings.Fields(hdrs[0].Value())
+	if len(fields) != 3 {
+		return false
+	}
+	rseq, err1 := strconv.ParseUint(fields[0], 10, 32)
+	cseq, err2 := strconv.ParseUint(fields[1], 10, 32)
+	invite, ok := s.request.CSeq()
+	if err1 != nil || err2 != nil || !ok || uint32(cseq) != invite.SeqNo || !strings.EqualFold(fields[2], string(sip.INVITE)) {
+		return false
+	}
+
+	s.lock.Lock()
+	if s.prack == nil || uint32(rseq) != s.rseq {
+		s.lock.Unlock()
+		return false
+	}
+	s.prack = nil
+	var next queuedProvisional
+	queued := len(s.queued) > 0
+	if queued {
+		next, s.queued = s.queued[0], s.queued[1:]
+	}
+	s.lock.Unlock()
+	if queued {
+		s.ProvisionalReliable(next.statusCode, next.reason)
+	}
+	return true
+}
+
+// stopReliable stops retransmitting the unacknowledged reliable provisional response, if
+// any, and drops the queued ones once the INVITE got a final response.
+func (s *Session) stopReliable() {
+	s.lock.Lock()
+	s.prack = nil
+	s.queued = nil
+	s.lock.Unlock()
+}
+
+// retransmitReliable resends a reliable provisional response over UDP, starting after T1
+// and doubling the interval, until its PRACK or a final response is sent. Without a PRACK
+// within 64*T1 the PRACK timeout is reported on any transport.
+func (s *Session) retransmitReliable(tx sip.ServerTransaction, response sip.Response) {
+	t1 := s.retransmission.T1
+	if t1 <= 0 {
+		t1 = transaction.T1
+	}
+	udp := strings.EqualFold(s.request.Transport(), "udp")
+	deadline := time.Now().Add(64 * t1)
+	interval := t1
+	for {
+		time.Sleep(interval)
+		s.lock.Lock()
+		pending := s.prack == response
+		s.lock.Unlock()
+		if !pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.Log().Warnf("No PRACK for %s within %v", response.Short(), 64*t1)
+			s.stopReliable()
+			if s.onPrackTimeout != nil {
+				s.onPrackTimeout()
+			}
+			return
+		}
+		if udp {
+			s.Log().Debugf("Retransmit %s", response.Short())
+			tx.Respond(response)
+		}
+		interval *= 2
+	}
+}
+
+// Prack acknowledges a reliable provisional response received for an outgoing INVITE.
+// It reports false for retransmissions and responses received out of order, which are
+// discarded without being passed on (RFC 3262 4).
+func (s *Session) Prack(response sip.Response) bool {
+	rseq, ok := headerNumber(response, "RSeq")
+	if !ok {
+		return true // a response without RSeq is not reliable after all
+	}
+	s.lock.Lock()
+	if s.rseq != 0 && rseq != s.rseq+1 {
+		s.lock.Unlock()
+		return false
+	}
+	s.rseq = rseq
+	s.lock.Unlock()
+
+	invite, _ := s.request.CSeq()
+	req := s.makeRequest(s.uaType, sip.PRACK, sip.MessageID(s.callID), s.request, response)
+	req.AppendHeader(&sip.GenericHeader{
+		HeaderName: "RAck",
+		Contents:   fmt.Sprintf("%d %d %s", rseq, invite.SeqNo, sip.INVITE),
+	})
+	s.sendRequest(req)
+	return true
+}
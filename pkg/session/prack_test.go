@@ -0,0 +1,163 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+var logger = log.NewDefaultLogrusLogger()
+
+// fakeServerTx records the responses sent on a server transaction.
+type fakeServerTx struct {
+	mutex     sync.Mutex
+	responses []sip.Response
+}
+
+func (tx *fakeServerTx) Origin() sip.Request         { return nil }
+func (tx *fakeServerTx) Key() sip.TransactionKey     { return "" }
+func (tx *fakeServerTx) String() string              { return "fake server transaction" }
+func (tx *fakeServerTx) Errors() <-chan error        { return nil }
+func (tx *fakeServerTx) Done() <-chan bool           { return nil }
+func (tx *fakeServerTx) Acks() <-chan sip.Request    { return nil }
+func (tx *fakeServerTx) Cancels() <-chan sip.Request { return nil }
+func (tx *fakeServerTx) Respond(res sip.Response) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.responses = append(tx.responses, res)
+	return nil
+}
+
+// sent returns the responses sent so far.
+func (tx *fakeServerTx) sent() []sip.Response {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return append([]sip.Response(nil), tx.responses...)
+}
+
+// parseMessage parses a raw SIP message; lines are joined with CRLF.
+func parseMessage(t *testing.T, lines ...string) sip.Message {
+	t.Helper()
+	msg, err := parser.ParseMessage([]byte(strings.Join(lines, "\r\n")+"\r\n\r\n"), logger)
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	return msg
+}
+
+// newIncoming returns a session for an incoming INVITE over TCP whose caller supports
+// 100rel, and the transaction its responses are sent on.
+func newIncoming(t *testing.T) (*Session, *fakeServerTx) {
+	t.Helper()
+	lines := []string{
+		"INVITE sip:200@example.com SIP/2.0",
+		"Via: SIP/2.0/TCP 192.168.1.20:5060;branch=z9hG4bK-incoming",
+		"From: <sip:100@example.com>;tag=caller",
+		"To: <sip:200@example.com>",
+		"Call-ID: incoming@192.168.1.20",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:100@192.168.1.20:5060;transport=tcp>",
+		"Supported: 100rel",
+		"Content-Length: 0",
+	}
+	req := parseMessage(t, lines...).(sip.Request)
+	req.SetTransport("TCP")
+	callID, _ := req.CallID()
+	contact, _ := req.Contact()
+	tx := &fakeServerTx{}
+	local := &sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: "b2bua"}, FHost: "127.0.0.1"}}
+	s := NewInviteSession(nil, "UAS", local, req, *callID, tx, Incoming, logger)
+	s.remoteTarget = contact.Address
+	return s, tx
+}
+
+// rack returns a PRACK acknowledging the reliable provisional response with rseq.
+func rack(t *testing.T, rseq uint32) sip.Request {
+	return parseMessage(t,
+		"PRACK sip:b2bua@127.0.0.1 SIP/2.0",
+		"Via: SIP/2.0/TCP 192.168.1.20:5060;branch=z9hG4bK-prack",
+		"From: <sip:100@example.com>;tag=caller",
+		"To: <sip:200@example.com>;tag=callee",
+		"Call-ID: incoming@192.168.1.20",
+		"CSeq: 2 PRACK",
+		fmt.Sprintf("RAck: %d 1 INVITE", rseq),
+		"Content-Length: 0",
+	).(sip.Request)
+}
+
+func TestProvisionalReliable(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string // 18x: reliable response, prack/stale: PRACK of the last one sent, accepted or not, 486: final response
+		want  []string // sent responses: code/RSeq offset from the first reliable response
+	}{
+		{"RSeq increments", []string{"180", "prack", "183"}, []string{"180/0", "183/1"}},
+		{"queued while PRACK pending", []string{"180", "183"}, []string{"180/0"}},
+		{"queue drained on PRACK", []string{"180", "183", "181", "prack", "prack"}, []string{"180/0", "183/1", "181/2"}},
+		{"repeated PRACK", []string{"180", "prack", "stale"}, []string{"180/0"}},
+		{"queue dropped on final response", []string{"180", "183", "486", "stale"}, []string{"180/0", "486"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, tx := newIncoming(t)
+			var first, last uint32
+			for _, step := range tt.steps {
+				switch step {
+				case "prack", "stale":
+					if got := s.AcknowledgeProvisional(rack(t, last)); got != (step == "prack") {
+						t.Fatalf("AcknowledgeProvisional(RAck %d) = %v; want %v", last, got, step == "prack")
+					}
+				case "486":
+					s.Reject(486, "Busy Here")
+				default:
+					var code int
+					fmt.Sscan(step, &code)
+					s.ProvisionalReliable(sip.StatusCode(code), "Ringing")
+				}
+				if sent := tx.sent(); len(sent) > 0 {
+					if rseq, ok := headerNumber(sent[len(sent)-1], "RSeq"); ok {
+						if first == 0 {
+							first = rseq
+						}
+						last = rseq
+					}
+				}
+			}
+
+			var got []string
+			for _, response := range tx.sent() {
+				entry := fmt.Sprint(response.StatusCode())
+				if IsReliable(response) {
+					rseq, _ := headerNumber(response, "RSeq")
+					entry += fmt.Sprintf("/%d", rseq-first)
+				}
+				got = append(got, entry)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("sent %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrackTimeout(t *testing.T) {
+	s, _ := newIncoming(t)
+	s.retransmission.T1 = time.Millisecond
+	timeout := make(chan struct{})
+	s.SetPrackTimeout(func() { close(timeout) })
+	s.ProvisionalReliable(180, "Ringing")
+	select {
+	case <-timeout:
+	case <-time.After(time.Second):
+		t.Fatal("no PRACK timeout within 64*T1")
+	}
+	if s.AcknowledgeProvisional(rack(t, s.rseq)) {
+		t.Error("late PRACK accepted after the timeout")
+	}
+}
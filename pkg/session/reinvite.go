@@ -0,0 +1,121 @@
+package session
+
+import (
+	"context"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// setLocalSdp stores the SDP this side sent last.
+func (s *Session) setLocalSdp(sdp string) {
+	if s.uaType == "UAC" {
+		s.offer = sdp
+	} else {
+		s.answer = sdp
+	}
+}
+
+// setRemoteSdp stores the SDP the other side sent last.
+func (s *Session) setRemoteSdp(sdp string) {
+	if s.uaType == "UAC" {
+		s.answer = sdp
+	} else {
+		s.offer = sdp
+	}
+}
+
+// StoreReInvite keeps a re-INVITE received in the confirmed dialog until it is answered
+// with AnswerReInvite or RejectReInvite. The initial INVITE stays the dialog's request.
+func (s *Session) StoreReInvite(request sip.Request, tx sip.ServerTransaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reinvite = request
+	s.reinviteTx = tx
+}
+
+// ReInviteRequest returns the pending re-INVITE, nil if there is none.
+func (s *Session) ReInviteRequest() sip.Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reinvite
+}
+
+// AnswerReInvite answers the pending re-INVITE with 200 and the given SDP. The SDP of
+// the re-INVITE, if any, becomes the remote SDP.
+func (s *Session) AnswerReInvite(sdp string) {
+	s.lock.Lock()
+	request, tx := s.reinvite, s.reinviteTx
+	s.reinvite, s.reinviteTx = nil, nil
+	s.lock.Unlock()
+	if request == nil {
+		return
+	}
+
+	if offer := SdpBody(request); offer != "" {
+		s.setRemoteSdp(offer)
+	}
+	s.setLocalSdp(sdp)
+	response := sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", "")
+	if sdp != "" {
+		contentType := sip.ContentType("application/sdp")
+		response.AppendHeader(&contentType)
+		response.SetBody(sdp, true)
+	}
+	response.AppendHeader(s.contact)
+
+	s.lock.Lock()
+	s.reinviteACK = true
+	s.lock.Unlock()
+	tx.Respond(response)
+}
+
+// RejectReInvite answers the pending re-INVITE with a failure response; the dialog and
+// its media stay as they were.
+func (s *Session) RejectReInvite(statusCode sip.StatusCode, reason string, headers ...sip.Header) {
+	s.lock.Lock()
+	request, tx := s.reinvite, s.reinviteTx
+	s.reinvite, s.reinviteTx = nil, nil
+	s.lock.Unlock()
+	if request == nil {
+		return
+	}
+
+	response := sip.NewResponseFromRequest(request.MessageID(), request, statusCode, reason, "")
+	for _, header := range headers {
+		response.AppendHeader(header)
+	}
+	tx.Respond(response)
+}
+
+// AckReInvite reports whether an ACK for an answered re-INVITE was expected, and
+// consumes the expectation.
+func (s *Session) AckReInvite() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expected := s.reinviteACK
+	s.reinviteACK = false
+	return expected
+}
+
+// ReInviteWithContext sends a re-INVITE with the given SDP in the confirmed dialog and
+// waits for the final response. On success the SDP becomes the local SDP and the SDP
+// of the response the remote SDP; on failure the session is left unchanged.
+func (s *Session) ReInviteWithContext(ctx context.Context, sdp string) (sip.Response, error) {
+	req := s.makeRequest(s.uaType, sip.INVITE, sip.MessageID(s.callID), s.request, s.response)
+	req.SetBody(sdp, true)
+	contentType := sip.ContentType("application/sdp")
+	req.AppendHeader(&contentType)
+
+	s.Log().Debugf(s.uaType+" send re-INVITE => \n%v", req)
+	s.sendingOffer(true)
+	defer s.sendingOffer(false)
+	response, err := s.requestCallbck(ctx, req, nil, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	s.setLocalSdp(sdp)
+	if answer := SdpBody(response); answer != "" {
+		s.setRemoteSdp(answer)
+	}
+	return response, nil
+}
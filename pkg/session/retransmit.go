@@ -0,0 +1,65 @@
+package session
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// Retransmission configures how a UAS retransmits a 2xx response to INVITE over an
+// unreliable transport until the ACK arrives (RFC 3261 13.3.1.4).
+type Retransmission struct {
+	T1         time.Duration // first retransmission interval, transaction.T1 if 0
+	T2         time.Duration // maximum retransmission interval, transaction.T2 if 0
+	ACKTimeout time.Duration // time to wait for the ACK, 64*T1 if 0
+}
+
+// SetRetransmission sets the 2xx retransmission parameters. onRetransmit is called for
+// every retransmitted 2xx and onTimeout when no ACK arrives in time; either may be nil.
+func (s *Session) SetRetransmission(config Retransmission, onRetransmit, onTimeout func()) {
+	if config.T1 <= 0 {
+		config.T1 = transaction.T1
+	}
+	if config.T2 <= 0 {
+		config.T2 = transaction.T2
+	}
+	if config.ACKTimeout <= 0 {
+		config.ACKTimeout = 64 * config.T1
+	}
+	s.retransmission = config
+	s.onRetransmit = onRetransmit
+	s.onACKTimeout = onTimeout
+}
+
+// retransmit resends a 2xx response until the session leaves WaitingForACK.
+func (s *Session) retransmit(tx sip.ServerTransaction, response sip.Response) {
+	if !strings.EqualFold(s.request.Transport(), "udp") || s.retransmission.T1 <= 0 {
+		return
+	}
+	config := s.retransmission
+	deadline := time.Now().Add(config.ACKTimeout)
+	interval := config.T1
+	for {
+		time.Sleep(interval)
+		if s.Status() != WaitingForACK || s.response != response {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.Log().Warnf("No ACK for %s within %v", response.Short(), config.ACKTimeout)
+			if s.onACKTimeout != nil {
+				s.onACKTimeout()
+			}
+			return
+		}
+		s.Log().Debugf("Retransmit %s", response.Short())
+		tx.Respond(response)
+		if s.onRetransmit != nil {
+			s.onRetransmit()
+		}
+		if interval *= 2; interval > config.T2 {
+			interval = config.T2
+		}
+	}
+}
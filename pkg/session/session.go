@@ -20,6 +20,7 @@ type Session struct {
 	callID         sip.CallID
 	offer          string
 	answer         string
+	parts          []BodyPart // non-SDP parts of the remote body
 	request        sip.Request
 	response       sip.Response
 	transaction    sip.Transaction
@@ -30,6 +31,20 @@ type Session struct {
 	remoteURI      sip.Address
 	remoteTarget   sip.Uri
 	logger         log.Logger
+	retransmission Retransmission // 2xx retransmission, disabled when T1 is 0
+	onRetransmit   func()
+	onACKTimeout   func()
+	localCSeq      uint32      // CSeq of the last request sent in the dialog
+	reinvite       sip.Request // re-INVITE received and not answered yet
+	reinviteTx     sip.ServerTransaction
+	reinviteACK    bool        // an ACK for an answered re-INVITE is expected
+	update         sip.Request // UPDATE received and not answered yet
+	updateTx       sip.ServerTransaction
+	offering       bool                // an offer sent in an UPDATE or re-INVITE awaits its answer
+	rseq           uint32              // RSeq of the last reliable provisional response sent (UAS) or acknowledged (UAC)
+	prack          sip.Response        // reliable provisional response waiting for its PRACK
+	queued         []queuedProvisional // reliable provisional responses waiting to be sent
+	onPrackTimeout func()
 }
 
 func NewInviteSession(reqcb RequestCallback, uaType string,
@@ -61,12 +76,12 @@ func NewInviteSession(reqcb RequestCallback, uaType string,
 		s.localURI = sip.Address{Uri: to.Address, Params: to.Params}
 		s.remoteURI = sip.Address{Uri: from.Address, Params: from.Params}
 		s.remoteTarget = contact.Address
-		s.offer = req.Body()
+		s.offer, s.parts = SplitBody(req)
 	} else if uaType == "UAC" {
 		s.localURI = sip.Address{Uri: from.Address, Params: from.Params}
 		s.remoteURI = sip.Address{Uri: to.Address, Params: to.Params}
 		s.remoteTarget = req.Recipient()
-		s.offer = req.Body()
+		s.offer = SdpBody(req)
 	}
 
 	s.request = req
@@ -103,6 +118,11 @@ func (s *Session) RemoteSdp() string {
 	return s.answer
 }
 
+// RemoteBodyParts returns the non-SDP parts of the remote multipart body.
+func (s *Session) RemoteBodyParts() []BodyPart {
+	return s.parts
+}
+
 func (s *Session) Contact() string {
 	return s.contact.String()
 }
@@ -116,6 +136,8 @@ func (s *Session) Request() sip.Request {
 }
 
 func (s *Session) Response() sip.Response {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.response
 }
 
@@ -174,7 +196,10 @@ func (s *Session) StoreResponse(response sip.Response) {
 			s.remoteURI = sip.Address{Uri: to.Address, Params: to.Params}
 		}
 
-		sdp := response.Body()
+		sdp, parts := SplitBody(response)
+		if len(parts) > 0 {
+			s.parts = parts
+		}
 		if len(sdp) > 0 {
 			s.answer = sdp
 		}
@@ -251,13 +276,17 @@ func (s *Session) sendRequest(req sip.Request) (sip.Response, error) {
 	return s.requestCallbck(context.TODO(), req, nil, false, 1)
 }
 
-// Reject Reject incoming call or for re-INVITE or UPDATE,
-func (s *Session) Reject(statusCode sip.StatusCode, reason string) {
+// Reject Reject incoming call or for re-INVITE or UPDATE, extra headers (e.g. Retry-After) are appended to the response.
+func (s *Session) Reject(statusCode sip.StatusCode, reason string, headers ...sip.Header) {
 	tx := (s.transaction.(sip.ServerTransaction))
 	request := s.request
 	s.Log().Debugf("Reject: Request => %s, body => %s", request.Short(), request.Body())
 	response := sip.NewResponseFromRequest(request.MessageID(), request, statusCode, reason, "")
 	response.AppendHeader(s.contact)
+	for _, header := range headers {
+		response.AppendHeader(header)
+	}
+	s.stopReliable()
 	tx.Respond(response)
 }
 
@@ -316,7 +345,7 @@ func (s *Session) Accept(statusCode sip.StatusCode) {
 	response := sip.NewResponseFromRequest(request.MessageID(), request, statusCode, "OK", s.answer)
 
 	hdrs := request.GetHeaders("Content-Type")
-	if len(hdrs) == 0 {
+	if len(hdrs) == 0 || isMultipart(request) { // the answer is plain SDP
 		contentType := sip.ContentType("application/sdp")
 		response.AppendHeader(&contentType)
 	} else {
@@ -326,10 +355,14 @@ func (s *Session) Accept(statusCode sip.StatusCode) {
 	response.AppendHeader(s.contact)
 	response.SetBody(s.answer, true)
 
+	s.lock.Lock()
 	s.response = response
+	s.lock.Unlock()
+	s.stopReliable()
 	tx.Respond(response)
 
 	s.SetState(WaitingForACK)
+	go s.retransmit(tx, response)
 }
 
 // Redirect send a 3xx
@@ -343,12 +376,20 @@ func (s *Session) Redirect(target sip.Uri, code sip.StatusCode, reason string) {
 	s.contact.Address = target
 	response.AppendHeader(s.contact)
 
+	s.stopReliable()
 	tx.Respond(response)
 }
 
 // Provisional send a provisional code 100|180|183
 func (s *Session) Provisional(statusCode sip.StatusCode, reason string) {
 	tx := (s.transaction.(sip.ServerTransaction))
+	response := s.provisionalResponse(statusCode, reason)
+	s.response = response
+	tx.Respond(response)
+}
+
+// provisionalResponse builds a provisional response carrying the answer, if there is one.
+func (s *Session) provisionalResponse(statusCode sip.StatusCode, reason string) sip.Response {
 	request := s.request
 	var response sip.Response
 	if len(s.answer) > 0 {
@@ -365,9 +406,7 @@ func (s *Session) Provisional(statusCode sip.StatusCode, reason string) {
 		response = sip.NewResponseFromRequest(request.MessageID(), request, statusCode, reason, "")
 	}
 	response.AppendHeader(s.contact)
-
-	s.response = response
-	tx.Respond(response)
+	return response
 }
 
 func (s *Session) makeRequest(uaType string, method sip.RequestMethod, msgID sip.MessageID, inviteRequest sip.Request, inviteResponse sip.Response) sip.Request {
@@ -420,7 +459,13 @@ func (s *Session) makeRequest(uaType string, method sip.RequestMethod, msgID sip
 	sip.CopyHeaders("CSeq", inviteRequest, newRequest)
 
 	cseq, _ := newRequest.CSeq()
-	cseq.SeqNo++
+	s.lock.Lock()
+	if s.localCSeq == 0 {
+		s.localCSeq = cseq.SeqNo
+	}
+	s.localCSeq++
+	cseq.SeqNo = s.localCSeq
+	s.lock.Unlock()
 	cseq.MethodName = method
 
 	return newRequest
@@ -89,7 +89,8 @@ type Status string
 const (
 	InviteSent       Status = "InviteSent"       /**< After INVITE s sent */
 	InviteReceived   Status = "InviteReceived"   /**< After INVITE s received. */
-	ReInviteReceived Status = "ReInviteReceived" /**< After re-INVITE/UPDATE s received */
+	ReInviteReceived Status = "ReInviteReceived" /**< After re-INVITE s received */
+	UpdateReceived   Status = "UpdateReceived"   /**< After UPDATE s received */
 	//Answer         Status = "Answer"           /**< After response for re-INVITE/UPDATE. */
 	Provisional      Status = "Provisional" /**< After response for 1XX. */
 	EarlyMedia       Status = "EarlyMedia"  /**< After response 1XX with sdp. */
@@ -0,0 +1,145 @@
+package session
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// StoreUpdate keeps an UPDATE received in an early or confirmed dialog until it is
+// answered with AnswerUpdate or RejectUpdate. An UPDATE overlapping a pending offer is
+// rejected here and false is returned (RFC 3311 5.2): with 491 when it carries an offer
+// while our own offer awaits its answer, with 500 and a Retry-After when an UPDATE or
+// re-INVITE received earlier is not answered yet.
+func (s *Session) StoreUpdate(request sip.Request, tx sip.ServerTransaction) bool {
+	s.lock.Lock()
+	offering := s.offering
+	answering := s.update != nil || (s.reinvite != nil && SdpBody(s.reinvite) != "")
+	if !answering && !(offering && SdpBody(request) != "") {
+		s.update = request
+		s.updateTx = tx
+		s.lock.Unlock()
+		return true
+	}
+	s.lock.Unlock()
+
+	var response sip.Response
+	if answering {
+		response = sip.NewResponseFromRequest(request.MessageID(), request, 500, "Server Internal Error", "")
+		retryAfter := sip.GenericHeader{HeaderName: "Retry-After", Contents: strconv.Itoa(rand.Intn(11))}
+		response.AppendHeader(&retryAfter)
+	} else {
+		response = sip.NewResponseFromRequest(request.MessageID(), request, 491, "Request Pending", "")
+	}
+	s.Log().Debugf("UPDATE overlaps a pending offer, rejecting with %d", response.StatusCode())
+	tx.Respond(response)
+	return false
+}
+
+// sendingOffer marks an offer sent in an UPDATE or re-INVITE as awaiting its answer.
+func (s *Session) sendingOffer(pending bool) {
+	s.lock.Lock()
+	s.offering = pending
+	s.lock.Unlock()
+}
+
+// UpdateRequest returns the pending UPDATE, nil if there is none.
+func (s *Session) UpdateRequest() sip.Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.update
+}
+
+// CanUpdate reports whether an UPDATE with an offer can be sent: the dialog is confirmed,
+// or early with the offer/answer of the INVITE completed (RFC 3311 5.1).
+func (s *Session) CanUpdate() bool {
+	switch s.Status() {
+	case Confirmed:
+		return true
+	case EarlyMedia:
+		return s.uaType == "UAC"
+	case WaitingForAnswer:
+		return s.uaType == "UAS" && s.response != nil && s.response.IsProvisional() && SdpBody(s.response) != ""
+	}
+	return false
+}
+
+// AnswerUpdate answers the pending UPDATE with 200. The SDP is sent only when the UPDATE
+// carried an offer, which becomes the remote SDP. The Session-Expires of a session refresh
+// is echoed in the response (RFC 4028 9).
+func (s *Session) AnswerUpdate(sdp string) {
+	s.lock.Lock()
+	request, tx := s.update, s.updateTx
+	s.update, s.updateTx = nil, nil
+	s.lock.Unlock()
+	if request == nil {
+		return
+	}
+
+	response := sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", "")
+	if offer := SdpBody(request); offer != "" {
+		s.setRemoteSdp(offer)
+		s.setLocalSdp(sdp)
+		contentType := sip.ContentType("application/sdp")
+		response.AppendHeader(&contentType)
+		response.SetBody(sdp, true)
+	}
+	if len(request.GetHeaders("Session-Expires")) > 0 {
+		sip.CopyHeaders("Session-Expires", request, response)
+		if HasOption(request, "Supported", "timer") {
+			response.AppendHeader(&sip.RequireHeader{Options: []string{"timer"}})
+		}
+	}
+	response.AppendHeader(s.contact)
+	tx.Respond(response)
+}
+
+// RejectUpdate answers the pending UPDATE with a failure response; the session and its
+// media stay as they were.
+func (s *Session) RejectUpdate(statusCode sip.StatusCode, reason string, headers ...sip.Header) {
+	s.lock.Lock()
+	request, tx := s.update, s.updateTx
+	s.update, s.updateTx = nil, nil
+	s.lock.Unlock()
+	if request == nil {
+		return
+	}
+
+	response := sip.NewResponseFromRequest(request.MessageID(), request, statusCode, reason, "")
+	for _, header := range headers {
+		response.AppendHeader(header)
+	}
+	tx.Respond(response)
+}
+
+// UpdateWithContext sends an UPDATE in the early or confirmed dialog and waits for the
+// final response. An empty SDP sends a session refresh without an offer. On success the
+// SDP becomes the local SDP and the SDP of the response the remote SDP; on failure the
+// session is left unchanged.
+func (s *Session) UpdateWithContext(ctx context.Context, sdp string) (sip.Response, error) {
+	req := s.makeRequest(s.uaType, sip.UPDATE, sip.MessageID(s.callID), s.request, s.response)
+	if sdp != "" {
+		req.SetBody(sdp, true)
+		contentType := sip.ContentType("application/sdp")
+		req.AppendHeader(&contentType)
+	}
+
+	s.Log().Debugf(s.uaType+" send UPDATE => \n%v", req)
+	if sdp != "" {
+		s.sendingOffer(true)
+		defer s.sendingOffer(false)
+	}
+	response, err := s.requestCallbck(ctx, req, nil, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	if sdp != "" {
+		s.setLocalSdp(sdp)
+		if answer := SdpBody(response); answer != "" {
+			s.setRemoteSdp(answer)
+		}
+	}
+	return response, nil
+}
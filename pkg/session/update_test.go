@@ -0,0 +1,167 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	testOffer  = "v=0\r\no=- 1 1 IN IP4 192.168.1.20\r\ns=-\r\nc=IN IP4 192.168.1.20\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+	testAnswer = "v=0\r\no=- 2 2 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\n"
+)
+
+// newConfirmed returns a confirmed incoming session whose requests are answered by
+// answer; a nil answer lets requests fail.
+func newConfirmed(t *testing.T, answer func(sip.Request) sip.Response) (*Session, *fakeServerTx) {
+	t.Helper()
+	s, tx := newIncoming(t)
+	response := sip.NewResponseFromRequest("", s.request, 200, "OK", "")
+	s.response = response
+	s.SetState(Confirmed)
+	s.requestCallbck = func(ctx context.Context, request sip.Request, authorizer sip.Authorizer, waitForResult bool, attempt int) (sip.Response, error) {
+		if answer == nil {
+			return nil, fmt.Errorf("no answer")
+		}
+		return answer(request), nil
+	}
+	return s, tx
+}
+
+// inDialog returns a request of the caller in the dialog with cseq and an optional SDP body.
+func inDialog(t *testing.T, method string, cseq int, sdp string) sip.Request {
+	lines := []string{
+		method + " sip:b2bua@127.0.0.1 SIP/2.0",
+		fmt.Sprintf("Via: SIP/2.0/TCP 192.168.1.20:5060;branch=z9hG4bK-%s-%d", method, cseq),
+		"From: <sip:100@example.com>;tag=caller",
+		"To: <sip:200@example.com>;tag=callee",
+		"Call-ID: incoming@192.168.1.20",
+		fmt.Sprintf("CSeq: %d %s", cseq, method),
+	}
+	if sdp == "" {
+		return parseMessage(t, append(lines, "Content-Length: 0")...).(sip.Request)
+	}
+	lines = append(lines, "Content-Type: application/sdp", fmt.Sprintf("Content-Length: %d", len(sdp)))
+	msg := parseMessage(t, lines...).(sip.Request)
+	msg.SetBody(sdp, true)
+	return msg
+}
+
+// okWith answers request with 200 carrying sdp.
+func okWith(sdp string) func(sip.Request) sip.Response {
+	return func(request sip.Request) sip.Response {
+		return sip.NewResponseFromRequest("", request, 200, "OK", sdp)
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending string // offer pending when the UPDATE arrives: reinvite/update sent by us, received-reinvite/received-update
+		sdp     string
+		want    int // response sent to the UPDATE, 0 when it is stored
+	}{
+		{"no offer pending", "", testOffer, 0},
+		{"crossing our re-INVITE", "reinvite", testOffer, 491},
+		{"crossing our UPDATE", "update", testOffer, 491},
+		{"refresh while we offer", "reinvite", "", 0},
+		{"crossing a received re-INVITE", "received-reinvite", testOffer, 500},
+		{"second UPDATE", "received-update", "", 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}), make(chan struct{})
+			s, _ := newConfirmed(t, func(request sip.Request) sip.Response {
+				close(started)
+				<-release
+				return okWith(testAnswer)(request)
+			})
+			done := make(chan struct{})
+			switch tt.pending {
+			case "reinvite":
+				go func() { s.ReInviteWithContext(context.Background(), testAnswer); close(done) }()
+				<-started
+			case "update":
+				go func() { s.UpdateWithContext(context.Background(), testAnswer); close(done) }()
+				<-started
+			case "received-reinvite":
+				s.StoreReInvite(inDialog(t, "INVITE", 2, testOffer), &fakeServerTx{})
+			case "received-update":
+				s.StoreUpdate(inDialog(t, "UPDATE", 2, testOffer), &fakeServerTx{})
+			}
+
+			tx := &fakeServerTx{}
+			update := inDialog(t, "UPDATE", 3, tt.sdp)
+			stored := s.StoreUpdate(update, tx)
+			if stored != (tt.want == 0) {
+				t.Errorf("StoreUpdate() = %v; want %v", stored, tt.want == 0)
+			}
+			if sent := tx.sent(); tt.want == 0 && len(sent) != 0 {
+				t.Errorf("sent %v; want none", sent)
+			} else if tt.want != 0 && (len(sent) != 1 || int(sent[0].StatusCode()) != tt.want) {
+				t.Errorf("sent %v; want %d", sent, tt.want)
+			} else if tt.want == 500 && len(sent[0].GetHeaders("Retry-After")) == 0 {
+				t.Errorf("500 without Retry-After")
+			}
+			if stored && s.UpdateRequest() != update {
+				t.Errorf("UpdateRequest() does not return the stored UPDATE")
+			}
+
+			if tt.pending == "reinvite" || tt.pending == "update" {
+				close(release)
+				<-done
+				if tt.want == 491 && !s.StoreUpdate(inDialog(t, "UPDATE", 4, testOffer), &fakeServerTx{}) {
+					t.Errorf("UPDATE after our offer was answered rejected")
+				}
+			}
+		})
+	}
+}
+
+// TestUpdateAnswer checks the SDP of an offer/answer exchange in an UPDATE in both directions:
+// the answer to a received offer is returned in the 200, and the answer to our offer is taken
+// from the 200 to be relayed to the other leg.
+func TestUpdateAnswer(t *testing.T) {
+	s, _ := newConfirmed(t, okWith(testOffer))
+	tx := &fakeServerTx{}
+	s.StoreUpdate(inDialog(t, "UPDATE", 2, testOffer), tx)
+	s.AnswerUpdate(testAnswer)
+	sent := tx.sent()
+	if len(sent) != 1 || sent[0].StatusCode() != 200 || sent[0].Body() != testAnswer {
+		t.Fatalf("sent %v; want 200 with the answer", sent)
+	}
+	if s.RemoteSdp() != testOffer || s.LocalSdp() != testAnswer {
+		t.Errorf("remote, local SDP = %q, %q; want the offer and the answer", s.RemoteSdp(), s.LocalSdp())
+	}
+	if s.UpdateRequest() != nil {
+		t.Errorf("UPDATE still pending after the answer")
+	}
+
+	refresh := &fakeServerTx{}
+	s.StoreUpdate(inDialog(t, "UPDATE", 3, ""), refresh)
+	s.AnswerUpdate(testOffer)
+	if sent := refresh.sent(); len(sent) != 1 || sent[0].StatusCode() != 200 || sent[0].Body() != "" {
+		t.Errorf("refresh answered with %v; want 200 without SDP", sent)
+	}
+
+	const reoffer = "v=0\r\no=- 2 3 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 5002 RTP/AVP 0\r\n"
+	response, err := s.UpdateWithContext(context.Background(), reoffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SdpBody(response) != testOffer || s.RemoteSdp() != testOffer || s.LocalSdp() != reoffer {
+		t.Errorf("after our UPDATE: answer %q, remote %q, local %q", SdpBody(response), s.RemoteSdp(), s.LocalSdp())
+	}
+
+	failing, _ := newConfirmed(t, nil)
+	failing.StoreUpdate(inDialog(t, "UPDATE", 2, testOffer), &fakeServerTx{})
+	failing.AnswerUpdate(testAnswer)
+	if _, err := failing.UpdateWithContext(context.Background(), reoffer); err == nil {
+		t.Fatal("UpdateWithContext() succeeded without an answer")
+	}
+	if failing.LocalSdp() != testAnswer {
+		t.Errorf("local SDP = %q after a failed UPDATE; want it unchanged", failing.LocalSdp())
+	}
+}
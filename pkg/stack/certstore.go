@@ -0,0 +1,167 @@
+package stack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertFiles is a certificate/key pair on disk.
+type CertFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// loadedCert is a parsed certificate with the files it was loaded from.
+type loadedCert struct {
+	files   CertFiles
+	cert    *tls.Certificate
+	names   []string // DNS names, lower case; wildcard names keep the "*." prefix
+	modTime time.Time
+}
+
+// CertStore holds TLS certificates that can be reloaded from disk at runtime
+// (e.g. after a Let's Encrypt renewal) and are selected by SNI.
+// The first certificate is used when the client sends no or an unknown server name.
+type CertStore struct {
+	mutex sync.RWMutex
+	files []CertFiles
+	certs []*loadedCert
+}
+
+// NewCertStore loads the given certificates.
+func NewCertStore(files []CertFiles) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no TLS certificates configured")
+	}
+	s := &CertStore{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads all certificates. On error the previously loaded certificates stay in use.
+func (s *CertStore) Reload() error {
+	certs := make([]*loadedCert, 0, len(s.files))
+	for _, files := range s.files {
+		cert, err := loadCert(files)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	s.mutex.Lock()
+	s.certs = certs
+	s.mutex.Unlock()
+	return nil
+}
+
+// Changed reports whether any certificate file was modified since it was loaded.
+func (s *CertStore) Changed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, cert := range s.certs {
+		if modTime(cert.files).After(cert.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate selects a certificate by SNI, for use as tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, fmt.Errorf("no TLS certificates loaded")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		wildcard := ""
+		if idx := strings.Index(name, "."); idx > 0 {
+			wildcard = "*" + name[idx:]
+		}
+		for _, cert := range s.certs {
+			for _, certName := range cert.names {
+				if certName == name {
+					return cert.cert, nil
+				}
+			}
+		}
+		for _, cert := range s.certs {
+			for _, certName := range cert.names {
+				if wildcard != "" && certName == wildcard {
+					return cert.cert, nil
+				}
+			}
+		}
+	}
+	return s.certs[0].cert, nil
+}
+
+// Certificates returns a summary of the loaded certificates: names and expiry.
+func (s *CertStore) Certificates() []CertInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	infos := make([]CertInfo, 0, len(s.certs))
+	for _, cert := range s.certs {
+		info := CertInfo{Cert: cert.files.Cert, Names: cert.names}
+		if cert.cert.Leaf != nil {
+			info.NotAfter = cert.cert.Leaf.NotAfter
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// TLSConfig returns a *tls.Config serving certificates from the store.
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate}
+}
+
+// CertInfo describes a loaded certificate.
+type CertInfo struct {
+	Cert     string    `json:"cert"`
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func loadCert(files CertFiles) (*loadedCert, error) {
+	loaded := &loadedCert{files: files, modTime: modTime(files)}
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate %s: %w", files.Cert, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse TLS certificate %s: %w", files.Cert, err)
+	}
+	cert.Leaf = leaf
+	loaded.cert = &cert
+
+	for _, name := range leaf.DNSNames {
+		loaded.names = append(loaded.names, strings.ToLower(name))
+	}
+	if len(loaded.names) == 0 && leaf.Subject.CommonName != "" {
+		loaded.names = append(loaded.names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return loaded, nil
+}
+
+// modTime returns the latest modification time of the certificate and key files.
+func modTime(files CertFiles) time.Time {
+	var latest time.Time
+	for _, path := range []string{files.Cert, files.Key} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
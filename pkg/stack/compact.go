@@ -0,0 +1,97 @@
+package stack
+
+import (
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// compactForms maps header names to their compact forms (RFC 3261 7.3.3 and the
+// IANA SIP header registry).
+var compactForms = map[string]string{
+	"accept-contact":      "a",
+	"allow-events":        "u",
+	"call-id":             "i",
+	"contact":             "m",
+	"content-encoding":    "e",
+	"content-length":      "l",
+	"content-type":        "c",
+	"event":               "o",
+	"from":                "f",
+	"identity":            "y",
+	"refer-to":            "r",
+	"referred-by":         "b",
+	"reject-contact":      "j",
+	"request-disposition": "d",
+	"session-expires":     "x",
+	"subject":             "s",
+	"supported":           "k",
+	"to":                  "t",
+	"via":                 "v",
+}
+
+// expandedForms maps the compact forms the parser keeps as generic headers to
+// canonical header names.
+var expandedForms = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"j": "Reject-Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"u": "Allow-Events",
+	"x": "Session-Expires",
+	"y": "Identity",
+}
+
+// compactListenOption makes a protocol send messages with compact header names.
+type compactListenOption struct{}
+
+func (o compactListenOption) ApplyListen(opts *transport.ListenOptions) {}
+
+func listenCompact(options []transport.ListenOption) bool {
+	for _, opt := range options {
+		if _, ok := opt.(compactListenOption); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandCompactHeaders renames received headers in compact form that the parser does
+// not recognize (e.g. "o" for Event), so that they can be looked up by their full name.
+func expandCompactHeaders(msg sip.Message) {
+	for compact, name := range expandedForms {
+		hdrs := msg.GetHeaders(compact)
+		if len(hdrs) == 0 {
+			continue
+		}
+		msg.RemoveHeader(compact)
+		for _, h := range hdrs {
+			msg.AppendHeader(&sip.GenericHeader{HeaderName: name, Contents: h.Value()})
+		}
+	}
+}
+
+// compactHeaders rewrites the header names of a serialized message to their compact
+// forms, leaving the start line and body unchanged.
+func compactHeaders(data string) string {
+	end := strings.Index(data, "\r\n\r\n")
+	if end < 0 {
+		return data
+	}
+	lines := strings.Split(data[:end], "\r\n")
+	for i := 1; i < len(lines); i++ {
+		colon := strings.IndexByte(lines[i], ':')
+		if colon < 0 {
+			continue
+		}
+		if compact, ok := compactForms[strings.ToLower(strings.TrimSpace(lines[i][:colon]))]; ok {
+			lines[i] = compact + ":" + strings.TrimLeft(lines[i][colon+1:], " ")
+		}
+	}
+	return strings.Join(lines, "\r\n") + data[end:]
+}
@@ -0,0 +1,115 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultENUMDomain is the public ENUM tree (RFC 6116).
+const DefaultENUMDomain = "e164.arpa"
+
+// ENUMName returns the domain name of an E.164 number in an ENUM tree: the digits
+// in reverse order separated by dots, e.g. +4689761234 in e164.arpa is
+// 4.3.2.1.6.7.9.8.6.4.e164.arpa. Characters other than digits are ignored.
+func ENUMName(number, domain string) string {
+	var labels []string
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] >= '0' && number[i] <= '9' {
+			labels = append(labels, number[i:i+1])
+		}
+	}
+	return strings.Join(append(labels, strings.Trim(domain, ".")), ".")
+}
+
+// LookupENUM queries the NAPTR records of a number in the ENUM trees in order and
+// returns the SIP URI of the first terminal E2U+sip record, with the number the
+// regular expression was applied to (the digits with a leading +). It returns an
+// empty URI if no tree has a SIP record for the number.
+func (r *Resolver) LookupENUM(ctx context.Context, number string, domains []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	digits := strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return c
+		}
+		return -1
+	}, number)
+	if digits == "" {
+		return "", fmt.Errorf("enum: %q is not a number", number)
+	}
+	if len(domains) == 0 {
+		domains = []string{DefaultENUMDomain}
+	}
+	var lastErr error
+	for _, domain := range domains {
+		records, err := r.lookupNAPTR(ctx, ENUMName(digits, domain))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, record := range records {
+			if !strings.EqualFold(record.Flags, "u") || !isSIPService(record.Service) {
+				continue
+			}
+			uri, err := applyENUMRegexp(record.Regexp, "+"+digits)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(uri), "sip:") || strings.HasPrefix(strings.ToLower(uri), "sips:") {
+				return uri, nil
+			}
+		}
+	}
+	return "", lastErr
+}
+
+// isSIPService reports whether a NAPTR service field is an ENUM SIP service: E2U+sip
+// (RFC 3764), a type with a sip subtype such as E2U+voice:sip, or the obsolete sip+E2U.
+func isSIPService(service string) bool {
+	service = strings.ToLower(service)
+	if service == "sip+e2u" {
+		return true
+	}
+	if !strings.HasPrefix(service, "e2u+") {
+		return false
+	}
+	for _, name := range strings.Split(strings.TrimPrefix(service, "e2u+"), "+") {
+		if name == "sip" || strings.HasPrefix(name, "sip:") || strings.HasSuffix(name, ":sip") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyENUMRegexp applies the substitution expression of a NAPTR record, such as
+// !^\+46(.*)$!sip:\1@example.com!, to a number. The first character is the delimiter;
+// back-references \1 to \9 refer to the groups of the pattern. A trailing i flag
+// makes the pattern case-insensitive.
+func applyENUMRegexp(expression, number string) (string, error) {
+	if len(expression) < 3 {
+		return "", fmt.Errorf("enum: invalid regexp %q", expression)
+	}
+	delimiter := expression[:1]
+	parts := strings.Split(expression[1:], delimiter)
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "i") {
+		return "", fmt.Errorf("enum: invalid regexp %q", expression)
+	}
+	pattern := parts[0]
+	if parts[2] == "i" {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("enum: invalid regexp %q: %w", expression, err)
+	}
+	match := re.FindStringSubmatchIndex(number)
+	if match == nil {
+		return "", fmt.Errorf("enum: regexp %q does not match %s", expression, number)
+	}
+	template := regexp.MustCompile(`\\([0-9])`).ReplaceAllString(parts[1], "$${$1}")
+	return string(re.ExpandString(nil, template, number, match)), nil
+}
@@ -0,0 +1,391 @@
+package stack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	dnsTypeNAPTR = 35
+	dnsClassINET = 1
+
+	defaultDNSTimeout = 3 * time.Second
+)
+
+// naptrServices maps NAPTR service fields (RFC 3263) to SIP transports.
+var naptrServices = map[string]string{
+	"SIP+D2U":  "udp",
+	"SIP+D2T":  "tcp",
+	"SIPS+D2T": "tls",
+	"SIP+D2W":  "ws",
+	"SIPS+D2W": "wss",
+}
+
+// srvPrefixes maps SIP transports to SRV record prefixes.
+var srvPrefixes = map[string]string{
+	"udp": "_sip._udp.",
+	"tcp": "_sip._tcp.",
+	"tls": "_sips._tcp.",
+	"ws":  "_sip._ws.",
+	"wss": "_sips._ws.",
+}
+
+// naptrRecord is a NAPTR resource record.
+type naptrRecord struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// Resolver locates SIP servers as described in RFC 3263: NAPTR records select the
+// transport, SRV records the servers (ordered by priority, shuffled by weight),
+// and A records their addresses.
+type Resolver struct {
+	server   string // DNS server host:port, empty for the system resolver
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+// NewResolver creates a resolver. server is a DNS server address (host or host:port);
+// when empty the servers in /etc/resolv.conf are used.
+func NewResolver(server string, timeout time.Duration) *Resolver {
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	r := &Resolver{timeout: timeout, resolver: net.DefaultResolver}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.server = server
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+// Resolve returns the destinations for the URI in the order they should be tried.
+// Each returned URI has a numeric host, a port and a transport parameter.
+func (r *Resolver) Resolve(ctx context.Context, uri sip.SipUri) ([]sip.SipUri, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	transport := ""
+	if params := uri.UriParams(); params != nil {
+		if value, ok := params.Get("transport"); ok && value != nil {
+			transport = strings.ToLower(value.String())
+		}
+	}
+	if uri.IsEncrypted() && transport == "" {
+		transport = "tls"
+	}
+
+	host := uri.Host()
+	if ip := net.ParseIP(host); ip != nil || uri.Port() != nil { // explicit address or port: A records only
+		if transport == "" {
+			transport = "udp"
+		}
+		port := defaultPort(transport)
+		if uri.Port() != nil {
+			port = int(*uri.Port())
+		}
+		return r.lookupHost(ctx, uri, transport, host, port)
+	}
+
+	var targets []sip.SipUri
+	var srvs []*net.SRV
+	var transports []string
+	if transport == "" {
+		records, _ := r.lookupNAPTR(ctx, host) // NAPTR is optional, fall back to SRV on errors
+		for _, record := range records {
+			service, ok := naptrServices[strings.ToUpper(record.Service)]
+			if !ok || !strings.EqualFold(record.Flags, "s") || (uri.IsEncrypted() && !strings.HasPrefix(record.Service, "SIPS")) {
+				continue
+			}
+			if _, addrs, err := r.resolver.LookupSRV(ctx, "", "", record.Replacement); err == nil {
+				for range addrs {
+					transports = append(transports, service)
+				}
+				srvs = append(srvs, addrs...)
+			}
+		}
+	}
+	if len(srvs) == 0 { // no usable NAPTR records: query SRV per transport
+		candidates := []string{"udp", "tcp", "tls"}
+		if transport != "" {
+			candidates = []string{transport}
+		} else if uri.IsEncrypted() {
+			candidates = []string{"tls"}
+		}
+		for _, candidate := range candidates {
+			if _, addrs, err := r.resolver.LookupSRV(ctx, "", "", srvPrefixes[candidate]+host); err == nil {
+				for range addrs {
+					transports = append(transports, candidate)
+				}
+				srvs = append(srvs, addrs...)
+			}
+		}
+	}
+
+	for i, srv := range srvs {
+		if resolved, err := r.lookupHost(ctx, uri, transports[i], strings.TrimSuffix(srv.Target, "."), int(srv.Port)); err == nil {
+			targets = append(targets, resolved...)
+		}
+	}
+	if len(srvs) > 0 {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("resolve %s: no address for SRV targets", host)
+		}
+		return targets, nil
+	}
+
+	if transport == "" { // no SRV records: A records with the default port
+		transport = "udp"
+	}
+	return r.lookupHost(ctx, uri, transport, host, defaultPort(transport))
+}
+
+// lookupHost resolves the IPv4 addresses of host and builds a destination for each of them.
+func (r *Resolver) lookupHost(ctx context.Context, uri sip.SipUri, transport, host string, port int) ([]sip.SipUri, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := r.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				ips = append(ips, addr.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolve %s: no IPv4 address", host)
+	}
+
+	targets := make([]sip.SipUri, 0, len(ips))
+	for _, ip := range ips {
+		target := uri.Clone().(*sip.SipUri)
+		target.FHost = ip.String()
+		p := sip.Port(port)
+		target.FPort = &p
+		if target.FUriParams == nil {
+			target.FUriParams = sip.NewParams()
+		}
+		target.FUriParams.Add("transport", sip.String{Str: transport})
+		targets = append(targets, *target)
+	}
+	return targets, nil
+}
+
+// lookupNAPTR queries the NAPTR records of name, sorted by order and preference.
+// The standard library has no NAPTR lookup, so the query is sent directly over UDP.
+func (r *Resolver) lookupNAPTR(ctx context.Context, name string) ([]naptrRecord, error) {
+	servers := []string{r.server}
+	if r.server == "" {
+		servers = systemDNSServers()
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		records, err := queryNAPTR(ctx, server, name)
+		if err == nil {
+			sort.SliceStable(records, func(i, j int) bool {
+				if records[i].Order != records[j].Order {
+					return records[i].Order < records[j].Order
+				}
+				return records[i].Preference < records[j].Preference
+			})
+			return records, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// queryNAPTR sends a NAPTR query to server and parses the answers.
+func queryNAPTR(ctx context.Context, server, name string) ([]naptrRecord, error) {
+	id := uint16(rand.Intn(0x10000))
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(query[4:], 1)      // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name %q", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, dnsTypeNAPTR, 0, dnsClassINET)
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 4096)
+	for {
+		n, err := conn.Read(msg)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(msg) == id {
+			return parseNAPTR(msg[:n])
+		}
+	}
+}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// parseNAPTR parses the NAPTR answers of a DNS response.
+func parseNAPTR(msg []byte) ([]naptrRecord, error) {
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch rcode := flags & 0x000f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("DNS query failed, rcode %d", rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+
+	var records []naptrRecord
+	for i := 0; i < answers; i++ {
+		_, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		offset = data + length
+		if offset > len(msg) {
+			return nil, errDNSMessage
+		}
+		if rrType != dnsTypeNAPTR || length < 4 {
+			continue
+		}
+
+		record := naptrRecord{
+			Order:      binary.BigEndian.Uint16(msg[data:]),
+			Preference: binary.BigEndian.Uint16(msg[data+2:]),
+		}
+		pos := data + 4
+		for _, field := range []*string{&record.Flags, &record.Service, &record.Regexp} {
+			if pos >= offset || pos+1+int(msg[pos]) > offset {
+				return nil, errDNSMessage
+			}
+			*field = string(msg[pos+1 : pos+1+int(msg[pos])])
+			pos += 1 + int(msg[pos])
+		}
+		if record.Replacement, _, err = readDNSName(msg, pos); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// readDNSName reads a possibly compressed domain name at offset and returns it with
+// the offset following the name.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0: // compression pointer
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// systemDNSServers returns the name servers in /etc/resolv.conf.
+func systemDNSServers() []string {
+	servers := []string{}
+	if file, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, "127.0.0.1:53")
+	}
+	return servers
+}
+
+func defaultPort(transport string) int {
+	if transport == "tls" || transport == "wss" {
+		return 5061
+	}
+	return 5060
+}
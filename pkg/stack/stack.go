@@ -2,6 +2,8 @@ package stack
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -31,6 +33,35 @@ const (
 // tx argument can be nil for 2xx ACK request
 type RequestHandler func(req sip.Request, tx sip.ServerTransaction)
 
+// RequestFilter is called for every incoming request before it is routed to its handler,
+// returning false drops the request (the filter may respond on its own).
+// tx argument can be nil for 2xx ACK request
+type RequestFilter func(req sip.Request, tx sip.ServerTransaction) bool
+
+// ResponseTarget selects where responses are sent, see ViaPolicy.
+type ResponseTarget string
+
+const (
+	// ResponseTargetSymmetric sends responses to the received/rport address of the request (RFC 3581).
+	ResponseTargetSymmetric ResponseTarget = "symmetric"
+	// ResponseTargetReceived sends responses to the received address and the port in Via, ignoring rport.
+	ResponseTargetReceived ResponseTarget = "received"
+	// ResponseTargetVia sends responses to the sent-by address in Via, ignoring received and rport.
+	ResponseTargetVia ResponseTarget = "via"
+)
+
+// ViaPolicy controls the Via handling of a transport.
+type ViaPolicy struct {
+	// NoRport disables the rport parameter in the Via of outgoing requests.
+	NoRport bool
+	// ResponseTarget selects where responses are sent, defaults to ResponseTargetSymmetric.
+	ResponseTarget ResponseTarget
+}
+
+// MessageTap is called for every SIP message received or sent by the stack, e.g. to mirror
+// traffic to a capture server. It is called synchronously and must not block.
+type MessageTap func(msg sip.Message, outgoing bool)
+
 // RequiresChallengeHandler will check if each request requires 401/407 authentication.
 type RequiresChallengeHandler func(req sip.Request) bool
 
@@ -50,6 +81,16 @@ type SipStackConfig struct {
 	MsgMapper         sip.MessageMapper
 	ServerAuthManager ServerAuthManager
 	UserAgent         string
+	// Server is the Server header of responses, defaults to UserAgent.
+	Server string
+	// ViaPolicies are the Via policies by transport (UDP, TCP, TLS, WS, WSS).
+	ViaPolicies map[string]ViaPolicy
+	// TelDomain is the host of the SIP URIs that tel: URIs of messages received over
+	// UDP and TCP are mapped to, defaults to Host.
+	TelDomain string
+	// CompactHeaders are the transports (e.g. UDP) on which messages are sent with compact
+	// header names, to keep them below the MTU.
+	CompactHeaders []string
 }
 
 // SipStack a golang SIP Stack
@@ -65,10 +106,13 @@ type SipStack struct {
 	hmu                   *sync.RWMutex
 	requestHandlers       map[sip.RequestMethod]RequestHandler
 	handleConnectionError func(err *transport.ConnectionError)
+	requestFilter         RequestFilter
+	messageTaps           []MessageTap
 	extensions            []string
 	invites               map[transaction.TxKey]sip.Request
 	invitesLock           *sync.RWMutex
 	authenticator         *ServerAuthManager
+	peerCerts             sync.Map // transport + remote address -> verified TLS client certificate
 	log                   log.Logger
 }
 
@@ -136,10 +180,12 @@ func NewSipStack(config *SipStackConfig) *SipStack {
 	s.log = logger
 	s.tp = transport.NewLayer(ip, dnsResolver, config.MsgMapper, utils.NewLogrusLogger(log.DebugLevel, "transport.Layer", nil))
 	sipTp := &sipTransport{
-		tpl: s.tp,
-		s:   s,
+		tpl:      s.tp,
+		s:        s,
+		messages: make(chan sip.Message),
 	}
 	s.tx = transaction.NewLayer(sipTp, utils.NewLogrusLogger(log.DebugLevel, "transaction.Layer", nil))
+	go sipTp.receive()
 
 	s.running.Set()
 	go s.serve()
@@ -156,11 +202,11 @@ func (s *SipStack) Log() log.Logger {
 func (s *SipStack) ListenTLS(protocol string, listenAddr string, options *transport.TLSConfig) error {
 	var err error
 	network := strings.ToUpper(protocol)
+	listenOptions := s.listenOptions(network)
 	if options != nil {
-		err = s.tp.Listen(network, listenAddr, options)
-	} else {
-		err = s.tp.Listen(network, listenAddr)
+		listenOptions = append(listenOptions, options)
 	}
+	err = s.tp.Listen(network, listenAddr, listenOptions...)
 	if err == nil {
 		target, err := transport.NewTargetFromAddr(listenAddr)
 		if err != nil {
@@ -174,6 +220,100 @@ func (s *SipStack) ListenTLS(protocol string, listenAddr string, options *transp
 	return err
 }
 
+// ListenTLSConfig starts a TLS or WSS listener using the given *tls.Config, which allows
+// SNI certificate selection and certificate reload through tls.Config.GetCertificate.
+func (s *SipStack) ListenTLSConfig(protocol string, listenAddr string, config *tls.Config) error {
+	network := strings.ToUpper(protocol)
+	if config.ClientAuth >= tls.VerifyClientCertIfGiven {
+		config = s.trackPeerCertificates(network, config)
+	}
+	listenOptions := append(s.listenOptions(network), tlsListenOption{config: config})
+	if err := s.tp.Listen(network, listenAddr, listenOptions...); err != nil {
+		return err
+	}
+	target, err := transport.NewTargetFromAddr(listenAddr)
+	if err != nil {
+		return err
+	}
+	target = transport.FillTargetHostAndPort(network, target)
+	if _, ok := s.listenPorts[network]; !ok {
+		s.listenPorts[network] = target.Port
+	}
+	return nil
+}
+
+// listenOptions returns the stack wide listen options of a transport.
+func (s *SipStack) listenOptions(network string) []transport.ListenOption {
+	telDomain := s.config.TelDomain
+	if telDomain == "" {
+		telDomain = s.host
+	}
+	options := []transport.ListenOption{telListenOption{domain: telDomain}}
+	for _, compact := range s.config.CompactHeaders {
+		if strings.EqualFold(compact, network) {
+			options = append(options, compactListenOption{})
+		}
+	}
+	return options
+}
+
+// secureTransports are the transports whose connections can carry a TLS client certificate.
+var secureTransports = []string{"TLS", "WSS"}
+
+// peerKey returns the key of a TLS client certificate: the transport and the remote
+// address, so that a UDP or TCP request from the same address never matches it.
+func peerKey(network, source string) string {
+	return strings.ToUpper(network) + " " + source
+}
+
+// trackPeerCertificates wraps the TLS config of a TLS or WSS listener so that verified
+// client certificates are remembered by transport and remote address and can be looked
+// up with PeerCertificate. A certificate is forgotten when its connection is closed.
+func (s *SipStack) trackPeerCertificates(network string, base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		source := peerKey(network, hello.Conn.RemoteAddr().String())
+		connConfig := base.Clone()
+		connConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+				s.peerCerts.Delete(source)
+				return nil
+			}
+			cert := state.PeerCertificates[0]
+			s.peerCerts.Store(source, cert)
+			if conn, ok := hello.Conn.(interface{ Closed() <-chan struct{} }); ok {
+				go func() {
+					<-conn.Closed()
+					// a new connection from the same address may have replaced the entry
+					if v, ok := s.peerCerts.Load(source); ok && v == cert {
+						s.peerCerts.Delete(source)
+					}
+				}()
+			}
+			return nil
+		}
+		return connConfig, nil
+	}
+	return config
+}
+
+// PeerCertificate returns the verified TLS client certificate of the connection a request
+// was received on, or nil if the request did not arrive over TLS or WSS or the peer did
+// not authenticate with a certificate.
+func (s *SipStack) PeerCertificate(transport, source string) *x509.Certificate {
+	secure := false
+	for _, network := range secureTransports {
+		secure = secure || strings.EqualFold(transport, network)
+	}
+	if !secure {
+		return nil
+	}
+	if v, ok := s.peerCerts.Load(peerKey(transport, source)); ok {
+		return v.(*x509.Certificate)
+	}
+	return nil
+}
+
 func (s *SipStack) Listen(protocol string, listenAddr string) error {
 	return s.ListenTLS(protocol, listenAddr, nil)
 }
@@ -247,8 +387,14 @@ func (s *SipStack) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 
 	s.hmu.RLock()
 	handler, ok := s.requestHandlers[req.Method()]
+	filter := s.requestFilter
 	s.hmu.RUnlock()
 
+	if filter != nil && !filter(req, tx) {
+		logger.Debugf("SIP request %v dropped by filter", req.Method())
+		return
+	}
+
 	if !ok {
 		logger.Warnf("SIP request %v handler not found", req.Method())
 
@@ -386,6 +532,10 @@ func (s *SipStack) prepareRequest(req sip.Request) sip.Request {
 			viaHop,
 		}, "Route")
 	}
+	if s.viaPolicy(req.Transport()).NoRport {
+		viaHop, _ := req.ViaHop()
+		viaHop.Params.Remove("rport")
+	}
 
 	s.appendAutoHeaders(req)
 
@@ -433,14 +583,63 @@ func (s *SipStack) Send(msg sip.Message) error {
 		msg = s.prepareResponse(m)
 	}
 
-	return s.tp.Send(msg)
+	if err := s.tp.Send(msg); err != nil {
+		return err
+	}
+	s.tap(msg, true)
+	return nil
+}
+
+// OnMessage adds a tap called for every received and sent SIP message
+func (s *SipStack) OnMessage(tap MessageTap) {
+	s.hmu.Lock()
+	s.messageTaps = append(s.messageTaps, tap)
+	s.hmu.Unlock()
+}
+
+func (s *SipStack) tap(msg sip.Message, outgoing bool) {
+	s.hmu.RLock()
+	taps := s.messageTaps
+	s.hmu.RUnlock()
+	for _, tap := range taps {
+		tap(msg, outgoing)
+	}
 }
 
 func (s *SipStack) prepareResponse(res sip.Response) sip.Response {
 	s.appendAutoHeaders(res)
+	s.routeResponse(res)
 	return res
 }
 
+func (s *SipStack) viaPolicy(transport string) ViaPolicy {
+	return s.config.ViaPolicies[strings.ToUpper(transport)]
+}
+
+// routeResponse applies the response target of the Via policy
+func (s *SipStack) routeResponse(res sip.Response) {
+	target := s.viaPolicy(res.Transport()).ResponseTarget
+	if target == "" || target == ResponseTargetSymmetric {
+		return
+	}
+	viaHop, ok := res.ViaHop()
+	if !ok {
+		return
+	}
+
+	host := viaHop.Host
+	port := sip.DefaultPort(res.Transport())
+	if viaHop.Port != nil {
+		port = *viaHop.Port
+	}
+	if target == ResponseTargetReceived && viaHop.Params != nil {
+		if received, ok := viaHop.Params.Get("received"); ok && received != nil && received.String() != "" {
+			host = received.String()
+		}
+	}
+	res.SetDestination(fmt.Sprintf("%v:%v", host, port))
+}
+
 // Shutdown gracefully shutdowns SIP server
 func (s *SipStack) Shutdown() {
 	if !s.running.IsSet() {
@@ -466,6 +665,13 @@ func (s *SipStack) OnRequest(method sip.RequestMethod, handler RequestHandler) e
 	return nil
 }
 
+// OnRequestFilter registers the filter applied to all incoming requests
+func (s *SipStack) OnRequestFilter(filter RequestFilter) {
+	s.hmu.Lock()
+	s.requestFilter = filter
+	s.hmu.Unlock()
+}
+
 func (s *SipStack) OnConnectionError(handler func(err *transport.ConnectionError)) {
 	s.hmu.Lock()
 	s.handleConnectionError = handler
@@ -511,7 +717,19 @@ func (s *SipStack) appendAutoHeaders(msg sip.Message) {
 		}
 	}
 
-	if hdrs := msg.GetHeaders("User-Agent"); len(hdrs) == 0 {
+	if _, ok := msg.(sip.Response); ok {
+		server := s.config.Server
+		if server == "" {
+			server = s.config.UserAgent
+		}
+		if server == "" {
+			server = DefaultUserAgent
+		}
+		msg.RemoveHeader("User-Agent")
+		msg.RemoveHeader("Server")
+		serverHeader := sip.ServerHeader(server)
+		msg.AppendHeader(&serverHeader)
+	} else if hdrs := msg.GetHeaders("User-Agent"); len(hdrs) == 0 {
 		userAgent := DefaultUserAgent
 		if len(s.config.UserAgent) > 0 {
 			userAgent = s.config.UserAgent
@@ -559,12 +777,27 @@ func (s *SipStack) getAllowedMethods() []sip.RequestMethod {
 }
 
 type sipTransport struct {
-	tpl transport.Layer
-	s   *SipStack
+	tpl      transport.Layer
+	s        *SipStack
+	messages chan sip.Message
+}
+
+// receive passes the messages of the transport layer to the transaction layer
+func (tp *sipTransport) receive() {
+	defer close(tp.messages)
+	for msg := range tp.tpl.Messages() {
+		expandCompactHeaders(msg)
+		tp.s.tap(msg, false)
+		select {
+		case tp.messages <- msg:
+		case <-tp.s.tx.Done():
+			return
+		}
+	}
 }
 
 func (tp *sipTransport) Messages() <-chan sip.Message {
-	return tp.tpl.Messages()
+	return tp.messages
 }
 
 func (tp *sipTransport) Send(msg sip.Message) error {
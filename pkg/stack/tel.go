@@ -0,0 +1,234 @@
+package stack
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// maxHeaderSize bounds the bytes buffered while looking for the end of a message header.
+const maxHeaderSize = 64 * 1024
+
+// telListenOption passes the domain that tel: URIs are mapped to to the UDP, TCP and TLS protocols.
+type telListenOption struct {
+	domain string
+}
+
+func (o telListenOption) ApplyListen(opts *transport.ListenOptions) {}
+
+// listenTelDomain returns the tel: mapping domain from the listen options, empty if none.
+func listenTelDomain(options []transport.ListenOption) string {
+	for _, opt := range options {
+		if o, ok := opt.(telListenOption); ok {
+			return o.domain
+		}
+	}
+	return ""
+}
+
+// telToSip maps a tel: URI to a SIP URI as described in RFC 3261 19.1.6, e.g.
+// tel:+1-212-555-0100;ext=12 becomes sip:+12125550100;ext=12@domain;user=phone.
+// Visual separators are removed from the number.
+func telToSip(uri, domain string) string {
+	number := uri[len("tel:"):]
+	params := ""
+	if i := strings.IndexByte(number, ';'); i >= 0 {
+		number, params = number[:i], number[i:]
+	}
+	number = strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '.', '(', ')', ' ':
+			return -1
+		}
+		return r
+	}, number)
+	return "sip:" + number + params + "@" + domain + ";user=phone"
+}
+
+func hasTelPrefix(s string) bool {
+	return len(s) >= 4 && strings.EqualFold(s[:4], "tel:")
+}
+
+// normalizeTelURIs rewrites the tel: URIs in a message header (start line and header
+// fields, without the body) to SIP URIs in domain, since the parser only accepts
+// sip: and sips: URIs.
+func normalizeTelURIs(header []byte, domain string) []byte {
+	if !bytes.Contains(bytes.ToLower(header), []byte("tel:")) {
+		return header
+	}
+	lines := strings.Split(string(header), "\r\n")
+	start := true
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if start { // request line: every parameter belongs to the URI
+			start = false
+			if parts := strings.Split(line, " "); len(parts) == 3 && hasTelPrefix(parts[1]) {
+				parts[1] = telToSip(parts[1], domain)
+				lines[i] = strings.Join(parts, " ")
+			}
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		lines[i] = line[:colon+1] + normalizeTelValue(line[colon+1:], domain)
+	}
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+// normalizeTelValue rewrites the tel: URIs of a header field value. Parameters of a
+// bare URI are header parameters, so the mapped URI is enclosed in angle brackets.
+func normalizeTelValue(value, domain string) string {
+	trimmed := strings.TrimLeft(value, " \t")
+	if hasTelPrefix(trimmed) {
+		end := strings.IndexAny(trimmed, ";, \t")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		return value[:len(value)-len(trimmed)] + "<" + telToSip(trimmed[:end], domain) + ">" + trimmed[end:]
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(strings.ToLower(value), "<tel:")
+		if i < 0 {
+			break
+		}
+		end := strings.IndexByte(value[i:], '>')
+		if end < 0 {
+			break
+		}
+		b.WriteString(value[:i+1])
+		b.WriteString(telToSip(value[i+1:i+end], domain))
+		value = value[i+end:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// contentLength returns the Content-Length of a message header, 0 if absent.
+func contentLength(header []byte) int {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		if name == "content-length" || name == "l" {
+			n, _ := strconv.Atoi(strings.TrimSpace(line[colon+1:]))
+			return n
+		}
+	}
+	return 0
+}
+
+// splitHeader returns the message header including the blank line, and the body.
+// ok is false when data holds no complete header.
+func splitHeader(data []byte) (header, body []byte, ok bool) {
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, data, false
+	}
+	return data[:i+4], data[i+4:], true
+}
+
+// telPacketConn normalizes tel: URIs in received datagrams.
+type telPacketConn struct {
+	*net.UDPConn
+	domain string
+}
+
+func (c *telPacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(buf)
+	if err != nil || n == 0 {
+		return n, addr, err
+	}
+	header, body, ok := splitHeader(buf[:n])
+	if !ok {
+		return n, addr, err
+	}
+	normalized := normalizeTelURIs(header, c.domain)
+	if len(normalized) == len(header) {
+		return n, addr, err
+	}
+	if len(normalized)+len(body) > len(buf) { // no room for the longer message
+		return n, addr, err
+	}
+	data := append(append(make([]byte, 0, len(normalized)+len(body)), normalized...), body...)
+	return copy(buf, data), addr, nil
+}
+
+// telConn normalizes tel: URIs in messages received on a stream connection. Headers
+// are rewritten as a whole; bodies, delimited by Content-Length, pass through unchanged.
+type telConn struct {
+	net.Conn
+	domain   string
+	in       []byte // received bytes not yet processed
+	out      []byte // processed bytes not yet returned
+	bodyLeft int    // body bytes of the current message still to pass through
+}
+
+func (c *telConn) Read(buf []byte) (int, error) {
+	for len(c.out) == 0 {
+		switch {
+		case c.bodyLeft > 0 && len(c.in) > 0:
+			n := c.bodyLeft
+			if n > len(c.in) {
+				n = len(c.in)
+			}
+			c.out, c.in = c.in[:n], c.in[n:]
+			c.bodyLeft -= n
+			continue
+		case c.bodyLeft == 0 && len(c.in) > 0:
+			if header, body, ok := splitHeader(c.in); ok {
+				c.out = normalizeTelURIs(header, c.domain)
+				c.bodyLeft = contentLength(header)
+				c.in = body
+				continue
+			}
+			if len(c.in) > maxHeaderSize { // not SIP, let the parser report it
+				c.out, c.in = c.in, nil
+				continue
+			}
+		}
+
+		chunk := make([]byte, 4096)
+		n, err := c.Conn.Read(chunk)
+		c.in = append(c.in, chunk[:n]...)
+		if err != nil {
+			if len(c.in) > 0 {
+				c.out, c.in = c.in, nil
+				break
+			}
+			return 0, err
+		}
+	}
+	n := copy(buf, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// telListener wraps accepted connections with telConn.
+type telListener struct {
+	net.Listener
+	network string
+	domain  string
+}
+
+func (l *telListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &telConn{Conn: conn, domain: l.domain}, nil
+}
+
+func (l *telListener) Network() string {
+	return strings.ToUpper(l.network)
+}
@@ -0,0 +1,329 @@
+package stack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+const sockTTL = time.Hour
+
+func init() {
+	defaultFactory := transport.GetProtocolFactory()
+	transport.SetProtocolFactory(func(
+		network string,
+		output chan<- sip.Message,
+		errs chan<- error,
+		cancel <-chan struct{},
+		msgMapper sip.MessageMapper,
+		logger log.Logger,
+	) (transport.Protocol, error) {
+		switch strings.ToLower(network) {
+		case "tcp", "tls", "wss":
+			return newStreamProtocol(strings.ToLower(network), output, errs, cancel, msgMapper, logger), nil
+		case "udp":
+			return newUDPProtocol(output, errs, cancel, msgMapper, logger), nil
+		}
+		return defaultFactory(network, output, errs, cancel, msgMapper, logger)
+	})
+}
+
+// tlsListenOption passes a *tls.Config to the TLS/WSS protocol.
+type tlsListenOption struct {
+	config *tls.Config
+}
+
+func (o tlsListenOption) ApplyListen(opts *transport.ListenOptions) {}
+
+// networkListener reports the SIP network of a listener to the gosip listener pool.
+type networkListener struct {
+	net.Listener
+	network string
+}
+
+func (l *networkListener) Network() string {
+	return strings.ToUpper(l.network)
+}
+
+// closeNotifyListener wraps accepted connections so that their closing can be observed,
+// e.g. to forget the client certificate of a TLS connection.
+type closeNotifyListener struct {
+	net.Listener
+}
+
+func (l closeNotifyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyConn{Conn: conn, closed: make(chan struct{})}, nil
+}
+
+// closeNotifyConn is a connection whose Closed channel is closed once it is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+func (c *closeNotifyConn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// streamProtocol serves TCP, TLS and WSS listeners. TLS and WSS listeners use a caller
+// supplied *tls.Config, so that certificates can be selected by SNI and replaced at
+// runtime. Listeners configured with certificate files (transport.TLSConfig) are still
+// supported. TCP connections normalize received tel: URIs. Messages are optionally sent
+// with compact header names.
+// Outbound connections are only dialed for TCP and TLS; WSS messages are sent over
+// connections opened by the clients.
+type streamProtocol struct {
+	network     string
+	telDomain   string
+	compact     bool // send compact header names
+	log         log.Logger
+	listeners   transport.ListenerPool
+	connections transport.ConnectionPool
+	conns       chan transport.Connection
+}
+
+func newStreamProtocol(
+	network string,
+	output chan<- sip.Message,
+	errs chan<- error,
+	cancel <-chan struct{},
+	msgMapper sip.MessageMapper,
+	logger log.Logger,
+) transport.Protocol {
+	p := &streamProtocol{
+		network: network,
+		conns:   make(chan transport.Connection),
+	}
+	p.log = logger.
+		WithPrefix("transport.Protocol").
+		WithFields(log.Fields{
+			"protocol_ptr": fmt.Sprintf("%p", p),
+		})
+	p.listeners = transport.NewListenerPool(p.conns, errs, cancel, p.log)
+	p.connections = transport.NewConnectionPool(output, errs, cancel, msgMapper, p.log)
+	go p.pipePools()
+	return p
+}
+
+func (p *streamProtocol) Done() <-chan struct{} {
+	return p.connections.Done()
+}
+
+func (p *streamProtocol) Network() string {
+	return strings.ToUpper(p.network)
+}
+
+func (p *streamProtocol) Reliable() bool {
+	return true
+}
+
+func (p *streamProtocol) Streamed() bool {
+	return true
+}
+
+func (p *streamProtocol) String() string {
+	return fmt.Sprintf("transport.Protocol<%s>", p.log.Fields().WithFields(log.Fields{"network": p.network}))
+}
+
+// pipePools pipes accepted connections to the connection pool for serving.
+func (p *streamProtocol) pipePools() {
+	defer close(p.conns)
+
+	for {
+		select {
+		case <-p.listeners.Done():
+			return
+		case conn := <-p.conns:
+			if err := p.connections.Put(conn, sockTTL); err != nil {
+				p.log.Errorf("put %s connection to the pool failed: %s", conn.Key(), err)
+				conn.Close()
+			}
+		}
+	}
+}
+
+func (p *streamProtocol) Listen(target *transport.Target, options ...transport.ListenOption) error {
+	target = transport.FillTargetHostAndPort(p.Network(), target)
+	p.compact = listenCompact(options)
+	if p.network == "tcp" {
+		return p.listenTCP(target, options)
+	}
+
+	config, err := listenTLSConfig(options)
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("load TLS config for %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	inner, err := net.Listen("tcp", target.Addr())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("listen on %s %s address", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	listener := tls.NewListener(closeNotifyListener{inner}, config)
+	p.log.Debugf("begin listening on %s %s", p.Network(), target.Addr())
+
+	var serving net.Listener = &networkListener{Listener: listener, network: p.network}
+	if p.network == "wss" {
+		serving = transport.NewWsListener(listener, p.network, p.log)
+	}
+
+	key := transport.ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
+	if err := p.listeners.Put(key, serving); err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("put %s listener to the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	return nil
+}
+
+func (p *streamProtocol) listenTCP(target *transport.Target, options []transport.ListenOption) error {
+	listener, err := net.Listen("tcp", target.Addr())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("listen on %s %s address", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	p.log.Debugf("begin listening on %s %s", p.Network(), target.Addr())
+
+	p.telDomain = listenTelDomain(options)
+	var serving net.Listener = &networkListener{Listener: listener, network: p.network}
+	if p.telDomain != "" {
+		serving = &telListener{Listener: listener, network: p.network, domain: p.telDomain}
+	}
+
+	key := transport.ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
+	if err := p.listeners.Put(key, serving); err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("put %s listener to the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	return nil
+}
+
+// listenTLSConfig builds the listener *tls.Config from the listen options.
+func listenTLSConfig(options []transport.ListenOption) (*tls.Config, error) {
+	optsHash := transport.ListenOptions{}
+	for _, opt := range options {
+		if o, ok := opt.(tlsListenOption); ok {
+			return o.config, nil
+		}
+		opt.ApplyListen(&optsHash)
+	}
+	if optsHash.TLSConfig.Cert == "" {
+		return nil, fmt.Errorf("no TLS certificate configured")
+	}
+	cert, err := tls.LoadX509KeyPair(optsHash.TLSConfig.Cert, optsHash.TLSConfig.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certficate %s: %w", optsHash.TLSConfig.Cert, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (p *streamProtocol) Send(target *transport.Target, msg sip.Message) error {
+	target = transport.FillTargetHostAndPort(p.Network(), target)
+	if target.Host == "" {
+		return &transport.ProtocolError{
+			Err:      fmt.Errorf("empty remote target host"),
+			Op:       fmt.Sprintf("send SIP message to %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	raddr, err := net.ResolveTCPAddr("tcp", target.Addr())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("resolve target address %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	conn, err := p.getOrCreateConnection(raddr)
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("get or create %s connection", p.Network()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	data := msg.String()
+	if p.compact {
+		data = compactHeaders(data)
+	}
+	if _, err = conn.Write([]byte(data)); err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("write SIP message to the %s connection", conn.Key()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	return nil
+}
+
+func (p *streamProtocol) getOrCreateConnection(raddr *net.TCPAddr) (transport.Connection, error) {
+	key := transport.ConnectionKey(p.network + ":" + raddr.String())
+	if conn, err := p.connections.Get(key); err == nil {
+		return conn, nil
+	}
+	if p.network == "wss" {
+		return nil, fmt.Errorf("no %s connection to %s", p.Network(), raddr)
+	}
+
+	p.log.Debugf("connection for remote address %s %s not found, create a new one", p.Network(), raddr)
+	var baseConn net.Conn
+	var err error
+	if p.network == "tcp" {
+		baseConn, err = net.DialTCP("tcp", nil, raddr)
+		if err == nil && p.telDomain != "" {
+			baseConn = &telConn{Conn: baseConn, domain: p.telDomain}
+		}
+	} else {
+		baseConn, err = tls.Dial("tcp", raddr.String(), &tls.Config{
+			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				return nil
+			},
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
+	}
+
+	conn := transport.NewConnection(baseConn, key, p.network, p.log)
+	if err := p.connections.Put(conn, sockTTL); err != nil {
+		return conn, fmt.Errorf("put %s connection to the pool: %w", conn.Key(), err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,148 @@
+package stack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// udpProtocol serves UDP listeners like the gosip UDP protocol, normalizing tel: URIs in
+// received datagrams and optionally sending compact header names.
+type udpProtocol struct {
+	compact     bool // send compact header names
+	log         log.Logger
+	connections transport.ConnectionPool
+}
+
+func newUDPProtocol(
+	output chan<- sip.Message,
+	errs chan<- error,
+	cancel <-chan struct{},
+	msgMapper sip.MessageMapper,
+	logger log.Logger,
+) transport.Protocol {
+	p := &udpProtocol{}
+	p.log = logger.
+		WithPrefix("transport.Protocol").
+		WithFields(log.Fields{
+			"protocol_ptr": fmt.Sprintf("%p", p),
+		})
+	p.connections = transport.NewConnectionPool(output, errs, cancel, msgMapper, p.log)
+	return p
+}
+
+func (p *udpProtocol) Done() <-chan struct{} {
+	return p.connections.Done()
+}
+
+func (p *udpProtocol) Network() string {
+	return "UDP"
+}
+
+func (p *udpProtocol) Reliable() bool {
+	return false
+}
+
+func (p *udpProtocol) Streamed() bool {
+	return false
+}
+
+func (p *udpProtocol) String() string {
+	return fmt.Sprintf("transport.Protocol<%s>", p.log.Fields().WithFields(log.Fields{"network": "udp"}))
+}
+
+func (p *udpProtocol) Listen(target *transport.Target, options ...transport.ListenOption) error {
+	target = transport.FillTargetHostAndPort(p.Network(), target)
+	laddr, err := net.ResolveUDPAddr("udp", target.Addr())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("resolve target address %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("listen on %s %s address", p.Network(), laddr),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	p.log.Debugf("begin listening on %s %s", p.Network(), laddr)
+
+	p.compact = listenCompact(options)
+	var baseConn net.Conn = udpConn
+	if domain := listenTelDomain(options); domain != "" {
+		baseConn = &telPacketConn{UDPConn: udpConn, domain: domain}
+	}
+	key := transport.ConnectionKey(fmt.Sprintf("udp:0.0.0.0:%d", laddr.Port))
+	conn := transport.NewConnection(baseConn, key, "udp", p.log)
+	if err := p.connections.Put(conn, 0); err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("put %s connection to the pool", conn.Key()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	return nil
+}
+
+// Send writes the message from the listener bound to the port of its source address.
+func (p *udpProtocol) Send(target *transport.Target, msg sip.Message) error {
+	target = transport.FillTargetHostAndPort(p.Network(), target)
+	if target.Host == "" {
+		return &transport.ProtocolError{
+			Err:      fmt.Errorf("empty remote target host"),
+			Op:       fmt.Sprintf("send SIP message to %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", target.Addr())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("resolve target address %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	_, port, err := net.SplitHostPort(msg.Source())
+	if err != nil {
+		return &transport.ProtocolError{
+			Err:      err,
+			Op:       "resolve source port",
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	data := msg.String()
+	if p.compact {
+		data = compactHeaders(data)
+	}
+	for _, conn := range p.connections.All() {
+		parts := strings.Split(string(conn.Key()), ":")
+		if parts[2] != port {
+			continue
+		}
+		if _, err := conn.WriteTo([]byte(data), raddr); err != nil {
+			return &transport.ProtocolError{
+				Err:      err,
+				Op:       fmt.Sprintf("write SIP message to the %s connection", conn.Key()),
+				ProtoPtr: fmt.Sprintf("%p", p),
+			}
+		}
+		return nil
+	}
+
+	return &transport.ProtocolError{
+		Err:      fmt.Errorf("connection on port %s not found", port),
+		Op:       "search connection",
+		ProtoPtr: fmt.Sprintf("%p", p),
+	}
+}
@@ -24,6 +24,12 @@ type Register struct {
 }
 
 func NewRegister(ua *UserAgent, profile *account.Profile, recipient sip.SipUri, data interface{}) *Register {
+	return NewRegisterWithContext(context.Background(), ua, profile, recipient, data)
+}
+
+// NewRegisterWithContext creates a registration whose requests and refreshes are
+// aborted when ctx is done.
+func NewRegisterWithContext(ctx context.Context, ua *UserAgent, profile *account.Profile, recipient sip.SipUri, data interface{}) *Register {
 	r := &Register{
 		ua:        ua,
 		profile:   profile,
@@ -31,7 +37,7 @@ func NewRegister(ua *UserAgent, profile *account.Profile, recipient sip.SipUri,
 		request:   nil,
 		data:      data,
 	}
-	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.ctx, r.cancel = context.WithCancel(ctx)
 	return r
 }
 
@@ -3,7 +3,8 @@ package ua
 import (
 	"context"
 	"fmt"
-	//"strconv"
+	"net"
+	"strconv"
 	"sync"
 
 	"go-sip-ua/pkg/account"
@@ -35,19 +36,44 @@ func NewSessionKey(callID sip.CallID, tagID sip.MaybeString) SessionKey {
 
 // UserAgentConfig .
 type UserAgentConfig struct {
-	SipStack *stack.SipStack
+	SipStack       *stack.SipStack
+	Retransmission session.Retransmission // 2xx retransmission of incoming calls over UDP
 }
 
+// Retransmission kinds reported to the RetransmitHandler.
+const (
+	RetransmitInvite = "invite"        // duplicate INVITE outside its transaction, answered with 482
+	RetransmitACK    = "ack"           // ACK for an already confirmed session, absorbed
+	Retransmit2xx    = "2xx"           // 2xx to INVITE retransmitted while waiting for the ACK
+	ACKTimeout       = "ack_timeout"   // no ACK for a 2xx, the session is ended with BYE
+	PrackTimeout     = "prack_timeout" // no PRACK for a reliable provisional, the INVITE is rejected with 504
+)
+
+// RetransmitHandler is called for absorbed or sent retransmissions, e.g. to count them.
+type RetransmitHandler func(kind string)
+
 // InviteSessionHandler .
 type InviteSessionHandler func(s *session.Session, req *sip.Request, resp *sip.Response, status session.Status)
 
 // RegisterHandler .
 type RegisterHandler func(regState account.RegisterState)
 
+// UnknownDialogHandler is called for in-dialog requests (BYE, re-INVITE, UPDATE, ACK)
+// that match no known session. tx is nil for ACK. The handler is responsible for responding;
+// when no handler is set the request is answered with 481.
+type UnknownDialogHandler func(req sip.Request, tx sip.ServerTransaction)
+
+// InfoHandler is called for INFO requests within a session (e.g. DTMF) after they are
+// answered with 200.
+type InfoHandler func(s *session.Session, req sip.Request)
+
 // UserAgent .
 type UserAgent struct {
 	InviteStateHandler   InviteSessionHandler
 	RegisterStateHandler RegisterHandler
+	UnknownDialogHandler UnknownDialogHandler
+	InfoHandler          InfoHandler
+	RetransmitHandler    RetransmitHandler
 	config               *UserAgentConfig
 	iss                  sync.Map /*Invite Session*/
 	log                  log.Logger
@@ -68,6 +94,8 @@ func NewUserAgent(config *UserAgentConfig) *UserAgent {
 	stack.OnRequest(sip.BYE, ua.handleBye)
 	stack.OnRequest(sip.CANCEL, ua.handleCancel)
 	stack.OnRequest(sip.UPDATE, ua.handleUpdate)
+	stack.OnRequest(sip.INFO, ua.handleInfo)
+	stack.OnRequest(sip.PRACK, ua.handlePrack)
 	return ua
 }
 
@@ -75,6 +103,12 @@ func (ua *UserAgent) Log() log.Logger {
 	return ua.log
 }
 
+func (ua *UserAgent) retransmitted(kind string) {
+	if ua.RetransmitHandler != nil {
+		ua.RetransmitHandler(kind)
+	}
+}
+
 func (ua *UserAgent) handleInviteState(is *session.Session, request *sip.Request, response *sip.Response, state session.Status, tx *sip.Transaction) {
 	if request != nil && *request != nil {
 		is.StoreRequest(*request)
@@ -131,7 +165,13 @@ func (ua *UserAgent) buildRequest(
 }
 
 func (ua *UserAgent) SendRegister(profile *account.Profile, recipient sip.SipUri, expires uint32, userdata interface{}) (*Register, error) {
-	register := NewRegister(ua, profile, recipient, userdata)
+	return ua.SendRegisterWithContext(context.TODO(), profile, recipient, expires, userdata)
+}
+
+// SendRegisterWithContext sends a REGISTER and keeps refreshing it until the registration
+// is removed or ctx is done.
+func (ua *UserAgent) SendRegisterWithContext(ctx context.Context, profile *account.Profile, recipient sip.SipUri, expires uint32, userdata interface{}) (*Register, error) {
+	register := NewRegisterWithContext(ctx, ua, profile, recipient, userdata)
 	err := register.SendRegister(expires)
 	if err != nil {
 		ua.Log().Errorf("SendRegister failed, err => %v", err)
@@ -145,6 +185,12 @@ func (ua *UserAgent) Invite(profile *account.Profile, target sip.Uri, recipient
 }
 
 func (ua *UserAgent) InviteWithContext(ctx context.Context, profile *account.Profile, target sip.Uri, recipient sip.SipUri, body *string) (*session.Session, error) {
+	return ua.InviteWithParts(ctx, profile, target, recipient, body, nil)
+}
+
+// InviteWithParts sends an INVITE whose body carries the SDP together with additional
+// parts (e.g. SIP-T ISUP) as multipart/mixed. Extra headers (e.g. Geolocation) are appended to the request.
+func (ua *UserAgent) InviteWithParts(ctx context.Context, profile *account.Profile, target sip.Uri, recipient sip.SipUri, body *string, parts []session.BodyPart, headers ...sip.Header) (*session.Session, error) {
 
 	from := &sip.Address{
 		DisplayName: sip.String{Str: profile.DisplayName},
@@ -165,10 +211,18 @@ func (ua *UserAgent) InviteWithContext(ctx context.Context, profile *account.Pro
 	}
 
 	if body != nil {
-		(*request).SetBody(*body, true)
-		contentType := sip.ContentType("application/sdp")
+		data, mediaType := session.JoinBody(*body, parts)
+		(*request).SetBody(data, true)
+		contentType := sip.ContentType(mediaType)
 		(*request).AppendHeader(&contentType)
 	}
+	for _, header := range headers {
+		if via, ok := header.(sip.ViaHeader); ok { // a preset Via selects the listener to send from
+			(*request).PrependHeaderAfter(via, "Route")
+			continue
+		}
+		(*request).AppendHeader(header)
+	}
 
 	var authorizer *auth.ClientAuthorizer = nil
 	if profile.AuthInfo != nil {
@@ -203,21 +257,54 @@ func (ua *UserAgent) Request(req *sip.Request) (sip.ClientTransaction, error) {
 	return ua.config.SipStack.Request(*req)
 }
 
-func (ua *UserAgent) handleBye(request sip.Request, tx sip.ServerTransaction) {
-	ua.Log().Debugf("handleBye: Request => %s, body => %s", request.Short(), request.Body())
-	response := sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", "")
-	tx.Respond(response)
+// findSession looks up the session an in-dialog request belongs to. Requests sent by the
+// remote side of an outgoing session carry our tag in To rather than in From.
+func (ua *UserAgent) findSession(request sip.Request) (SessionKey, *session.Session, bool) {
 	callID, ok := request.CallID()
 	fromHeader, ok2 := request.From()
-	if ok && ok2 {
-		fromTag, _ := fromHeader.Params.Get("tag")
-		if v, found := ua.iss.Load(NewSessionKey(*callID, fromTag)); found {
-			is := v.(*session.Session)
-			ua.iss.Delete(NewSessionKey(*callID, fromTag))
-			var transaction sip.Transaction = tx.(sip.Transaction)
-			ua.handleInviteState(is, &request, &response, session.Terminated, &transaction)
+	if !ok || !ok2 {
+		return SessionKey{}, nil, false
+	}
+	fromTag, _ := fromHeader.Params.Get("tag")
+	key := NewSessionKey(*callID, fromTag)
+	if v, found := ua.iss.Load(key); found {
+		return key, v.(*session.Session), true
+	}
+	if toHeader, ok := request.To(); ok {
+		if toTag, ok := toHeader.Params.Get("tag"); ok {
+			key = NewSessionKey(*callID, toTag)
+			if v, found := ua.iss.Load(key); found {
+				return key, v.(*session.Session), true
+			}
 		}
 	}
+	return SessionKey{}, nil, false
+}
+
+// handleUnknownDialog handles an in-dialog request that matches no known session.
+func (ua *UserAgent) handleUnknownDialog(request sip.Request, tx sip.ServerTransaction) {
+	if ua.UnknownDialogHandler != nil {
+		ua.UnknownDialogHandler(request, tx)
+		return
+	}
+	ua.Log().Debugf("%s for unknown dialog: %s", request.Method(), request.Short())
+	if tx != nil && !request.IsAck() {
+		tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, sip.StatusCode(481), "Call/Transaction Does Not Exist", ""))
+	}
+}
+
+func (ua *UserAgent) handleBye(request sip.Request, tx sip.ServerTransaction) {
+	ua.Log().Debugf("handleBye: Request => %s, body => %s", request.Short(), request.Body())
+	key, is, found := ua.findSession(request)
+	if !found {
+		ua.handleUnknownDialog(request, tx)
+		return
+	}
+	response := sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", "")
+	tx.Respond(response)
+	ua.iss.Delete(key)
+	var transaction sip.Transaction = tx.(sip.Transaction)
+	ua.handleInviteState(is, &request, &response, session.Terminated, &transaction)
 }
 
 func (ua *UserAgent) handleCancel(request sip.Request, tx sip.ServerTransaction) {
@@ -242,17 +329,20 @@ func (ua *UserAgent) handleCancel(request sip.Request, tx sip.ServerTransaction)
 
 func (ua *UserAgent) handleACK(request sip.Request, tx sip.ServerTransaction) {
 	ua.Log().Debugf("handleACK => %s, body => %s", request.Short(), request.Body())
-	callID, ok := request.CallID()
-	fromHeader, ok2 := request.From()
-	if ok && ok2 {
-		fromTag, _ := fromHeader.Params.Get("tag")
-		if v, found := ua.iss.Load(NewSessionKey(*callID, fromTag)); found {
-			// handle Ringing or Processing with sdp
-			is := v.(*session.Session)
-			is.SetState(session.Confirmed)
-			ua.handleInviteState(is, &request, nil, session.Confirmed, nil)
+	_, is, found := ua.findSession(request)
+	if !found {
+		ua.handleUnknownDialog(request, tx)
+		return
+	}
+	if is.Status() == session.Confirmed { // ACK for a re-INVITE, or a retransmitted ACK
+		if !is.AckReInvite() {
+			ua.retransmitted(RetransmitACK)
 		}
+		return
 	}
+	// handle Ringing or Processing with sdp
+	is.SetState(session.Confirmed)
+	ua.handleInviteState(is, &request, nil, session.Confirmed, nil)
 }
 
 func (ua *UserAgent) handleInvite(request sip.Request, tx sip.ServerTransaction) {
@@ -264,29 +354,46 @@ func (ua *UserAgent) handleInvite(request sip.Request, tx sip.ServerTransaction)
 	if ok && ok2 {
 		fromTag, _ := fromHeader.Params.Get("tag")
 		var transaction sip.Transaction = tx.(sip.Transaction)
-		v, found := ua.iss.Load(NewSessionKey(*callID, fromTag))
+		key := NewSessionKey(*callID, fromTag)
+		_, found := ua.iss.Load(key)
 		if toHdr, ok := request.To(); ok && toHdr.Params.Has("tag") {
-			if found {
-				is := v.(*session.Session)
-				is.SetState(session.ReInviteReceived)
-				ua.handleInviteState(is, &request, nil, session.ReInviteReceived, &transaction)
+			if _, is, found := ua.findSession(request); found {
+				// the dialog stays confirmed; the handler answers with AnswerReInvite or RejectReInvite
+				is.StoreReInvite(request, tx)
+				if ua.InviteStateHandler != nil {
+					ua.InviteStateHandler(is, &request, nil, session.ReInviteReceived)
+				}
 			} else {
-				// reinvite for transaction we have no record of; reject it
-				response := sip.NewResponseFromRequest(request.MessageID(), request, sip.StatusCode(481), "Call/Transaction does not exist", "")
-				tx.Respond(response)
+				// reinvite for transaction we have no record of
+				ua.handleUnknownDialog(request, tx)
 			}
 		} else {
+			var is *session.Session
+			if !found {
+				contactHdr, _ := request.Contact()
+				contactAddr := ua.updateContact2UAAddr(request.Transport(), contactHdr.Address)
+				if port := localPort(request); port != nil { // received on a listener other than the default one
+					contactAddr.SetPort(port)
+				}
+				contactHdr.Address = contactAddr
+
+				is = session.NewInviteSession(ua.RequestWithContext, "UAS", contactHdr, request, *callID, transaction, session.Incoming, ua.Log())
+				_, found = ua.iss.LoadOrStore(key, is) // concurrent duplicates must not create a second session
+			}
 			if found {
 				// retransmission; reject it
+				ua.retransmitted(RetransmitInvite)
 				response := sip.NewResponseFromRequest(request.MessageID(), request, sip.StatusCode(482), "Loop Detected", "")
 				tx.Respond(response)
 			} else {
-				contactHdr, _ := request.Contact()
-				contactAddr := ua.updateContact2UAAddr(request.Transport(), contactHdr.Address)
-				contactHdr.Address = contactAddr
-
-				is := session.NewInviteSession(ua.RequestWithContext, "UAS", contactHdr, request, *callID, transaction, session.Incoming, ua.Log())
-				ua.iss.Store(NewSessionKey(*callID, fromTag), is)
+				is.SetRetransmission(ua.config.Retransmission, func() {
+					ua.retransmitted(Retransmit2xx)
+				}, func() {
+					ua.handleACKTimeout(key, is)
+				})
+				is.SetPrackTimeout(func() {
+					ua.handlePrackTimeout(key, is)
+				})
 				is.SetState(session.InviteReceived)
 				ua.handleInviteState(is, &request, nil, session.InviteReceived, &transaction)
 				is.SetState(session.WaitingForAnswer)
@@ -323,22 +430,102 @@ func (ua *UserAgent) handleInvite(request sip.Request, tx sip.ServerTransaction)
 	}()
 }
 
+// handleACKTimeout ends a session whose 2xx was never acknowledged (RFC 3261 13.3.1.4).
+func (ua *UserAgent) handleACKTimeout(key SessionKey, is *session.Session) {
+	ua.retransmitted(ACKTimeout)
+	if _, found := ua.iss.Load(key); !found {
+		return
+	}
+	ua.iss.Delete(key)
+	is.Bye()
+	is.SetState(session.Terminated)
+	ua.handleInviteState(is, nil, nil, session.Terminated, nil)
+}
+
+// handlePrackTimeout rejects an incoming INVITE whose reliable provisional response was
+// never acknowledged (RFC 3262 3).
+func (ua *UserAgent) handlePrackTimeout(key SessionKey, is *session.Session) {
+	ua.retransmitted(PrackTimeout)
+	if _, found := ua.iss.Load(key); !found {
+		return
+	}
+	ua.iss.Delete(key)
+	is.Reject(504, "Server Time-out")
+	is.SetState(session.Failure)
+	ua.handleInviteState(is, nil, nil, session.Failure, nil)
+}
+
+// handlePrack answers a PRACK for a reliable provisional response of an incoming session.
+func (ua *UserAgent) handlePrack(request sip.Request, tx sip.ServerTransaction) {
+	ua.Log().Debugf("handlePrack: Request => %s", request.Short())
+	_, is, found := ua.findSession(request)
+	if !found {
+		ua.handleUnknownDialog(request, tx)
+		return
+	}
+	if !is.AcknowledgeProvisional(request) {
+		tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 481, "Call/Transaction Does Not Exist", ""))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", ""))
+}
+
+// handleUpdate passes an UPDATE in an early or confirmed dialog to the handler, which answers
+// it with AnswerUpdate or RejectUpdate; the session state does not change. Without a handler
+// the UPDATE is answered with the current local SDP.
 func (ua *UserAgent) handleUpdate(request sip.Request, tx sip.ServerTransaction) {
 	ua.Log().Debugf("handleUpdate: Request => %s", request.Short())
+	_, is, found := ua.findSession(request)
+	if !found {
+		ua.handleUnknownDialog(request, tx)
+		return
+	}
+	if !is.StoreUpdate(request, tx) {
+		return
+	}
+	if ua.InviteStateHandler == nil {
+		is.AnswerUpdate(is.LocalSdp())
+		return
+	}
+	ua.InviteStateHandler(is, &request, nil, session.UpdateReceived)
+}
+
+func (ua *UserAgent) handleInfo(request sip.Request, tx sip.ServerTransaction) {
+	ua.Log().Debugf("handleInfo: Request => %s, body => %s", request.Short(), request.Body())
+	_, is, found := ua.findSession(request)
+	if !found {
+		ua.handleUnknownDialog(request, tx)
+		return
+	}
 	response := sip.NewResponseFromRequest(request.MessageID(), request, 200, "OK", "")
 	tx.Respond(response)
+	if ua.InfoHandler != nil {
+		ua.InfoHandler(is, request)
+	}
 }
 
 // RequestWithContext .
 func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request, authorizer sip.Authorizer, waitForResult bool, attempt int) (sip.Response, error) {
 	s := ua.config.SipStack
+	// the transport layer fills in the Via port only when it is not preset
+	var viaPort *sip.Port
+	if hop, ok := request.ViaHop(); ok && hop.Port != nil {
+		port := *hop.Port
+		viaPort = &port
+	}
 	tx, err := s.Request(request)
 	if err != nil {
 		return nil, err
 	}
 	var cts sip.Transaction = tx.(sip.Transaction)
 
-	if request.IsInvite() {
+	// a re-INVITE in an existing dialog neither creates a session nor changes its state
+	reinvite := false
+	if to, ok := request.To(); ok && request.IsInvite() {
+		reinvite = to.Params != nil && to.Params.Has("tag")
+	}
+
+	if request.IsInvite() && !reinvite {
 
 		callID, ok := request.CallID()
 		fromHeader, ok2 := request.From()
@@ -347,10 +534,13 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 			if _, found := ua.iss.Load(NewSessionKey(*callID, fromTag)); !found {
 				contactHdr, _ := request.Contact()
 				contactAddr := ua.updateContact2UAAddr(request.Transport(), contactHdr.Address)
+				if viaPort != nil { // sent from a listener other than the default one
+					contactAddr.SetPort(viaPort)
+				}
 				contactHdr.Address = contactAddr
 				is := session.NewInviteSession(ua.RequestWithContext, "UAC", contactHdr, request, *callID, cts, session.Outgoing, ua.Log())
 				ua.iss.Store(NewSessionKey(*callID, fromTag), is)
-				is.ProvideOffer(request.Body())
+				is.ProvideOffer(session.SdpBody(request))
 				is.SetState(session.InviteSent)
 				ua.handleInviteState(is, &request, nil, session.InviteSent, &cts)
 			}
@@ -474,6 +664,9 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 		for {
 			select {
 			case provisional := <-provisionals:
+				if reinvite || !request.IsInvite() { // provisional responses to UPDATE, PRACK etc. do not change the session
+					continue
+				}
 				callID, ok := provisional.CallID()
 				fromHeader, ok2 := provisional.From()
 				if ok && ok2 {
@@ -481,6 +674,9 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 					if v, found := ua.iss.Load(NewSessionKey(*callID, fromTag)); found {
 						is := v.(*session.Session)
 						is.StoreResponse(provisional)
+						if session.IsReliable(provisional) && !is.Prack(provisional) {
+							continue // retransmitted reliable provisional response
+						}
 						// handle Ringing or Processing with sdp
 						ua.handleInviteState(is, &request, &provisional, session.Provisional, cts)
 						if len(provisional.Body()) > 0 {
@@ -496,6 +692,9 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 					//errs <- sip.NewRequestError(408, "Request Timeout", nil, nil)
 					return nil, err
 				}
+				if reinvite || request.Method() == sip.PRACK || request.Method() == sip.UPDATE { // a failed PRACK or UPDATE does not end the session
+					return nil, err
+				}
 				request := (err.(*sip.RequestError)).Request
 				response := (err.(*sip.RequestError)).Response
 				callID, ok := request.CallID()
@@ -511,6 +710,9 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 				}
 				return nil, err
 			case response := <-responses:
+				if reinvite {
+					return response, nil
+				}
 				callID, ok := response.CallID()
 				fromHeader, ok2 := request.From()
 				if ok && ok2 {
@@ -540,10 +742,34 @@ func (ua *UserAgent) RequestWithContext(ctx context.Context, request sip.Request
 	return waitForResponse(&cts)
 }
 
+// Sessions returns a snapshot of the current invite sessions.
+func (ua *UserAgent) Sessions() []*session.Session {
+	sessions := make([]*session.Session, 0)
+	ua.iss.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, value.(*session.Session))
+		return true
+	})
+	return sessions
+}
+
 func (ua *UserAgent) Shutdown() {
 	ua.config.SipStack.Shutdown()
 }
 
+// localPort returns the port of the local address an incoming request was received on
+func localPort(request sip.Request) *sip.Port {
+	_, portStr, err := net.SplitHostPort(request.Destination())
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil
+	}
+	p := sip.Port(port)
+	return &p
+}
+
 func (ua *UserAgent) updateContact2UAAddr(transport string, from sip.ContactUri) sip.ContactUri {
 	stackAddr := ua.config.SipStack.GetNetworkInfo(transport)
 	ret := from.Clone()
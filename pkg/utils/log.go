@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/ghettovoice/gosip/log"
 	"github.com/sirupsen/logrus"
@@ -11,6 +12,7 @@ import (
 type MyLogger struct {
 	Logger *log.LogrusLogger
 	level  log.Level
+	output *logrus.Logger
 }
 
 func (ml *MyLogger) Level() string {
@@ -34,7 +36,8 @@ func (ml *MyLogger) Level() string {
 }
 
 var (
-	loggers map[string]*MyLogger
+	loggers   map[string]*MyLogger
+	logOutput io.Writer // nil for stderr
 )
 
 func init() {
@@ -54,10 +57,14 @@ func NewLogrusLogger(level log.Level, prefix string, fields log.Fields) log.Logg
 		ForceFormatting: true,
 	}
 	l.SetReportCaller(true)
+	if logOutput != nil {
+		setOutput(l, logOutput)
+	}
 	logger := log.NewLogrusLogger(l, "main", fields)
 	loggers[prefix] = &MyLogger{
 		Logger: logger,
 		level:  level,
+		output: l,
 	}
 	logger.SetLevel(level)
 	return logger.WithPrefix(prefix)
@@ -72,6 +79,23 @@ func SetLogLevel(prefix string, level log.Level) error {
 	return fmt.Errorf("logger [%v] not found", prefix)
 }
 
+// SetLogOutput redirects all loggers, including those created later, to w.
+// Colors are disabled since the output is usually a file.
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+	for _, logger := range loggers {
+		setOutput(logger.output, w)
+	}
+}
+
+func setOutput(l *logrus.Logger, w io.Writer) {
+	l.SetOutput(w)
+	if formatter, ok := l.Formatter.(*prefixed.TextFormatter); ok {
+		formatter.ForceColors = false
+		formatter.DisableColors = true
+	}
+}
+
 func GetLoggers() map[string]*MyLogger {
 	return loggers
 }
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotateTimeFormat = "20060102-150405"
+
+// RotateConfig describes when a RotatingFile is rotated and how many old files are kept.
+type RotateConfig struct {
+	Path       string
+	MaxSize    int64         // rotate when the file would exceed MaxSize bytes, 0 disables
+	Interval   time.Duration // rotate at every multiple of Interval (e.g. 24h), 0 disables
+	MaxBackups int           // number of rotated files to keep, 0 keeps all
+	Compress   bool          // gzip rotated files
+}
+
+// RotatingFile is an io.Writer appending to a file that is rotated by size and time.
+type RotatingFile struct {
+	mutex  sync.Mutex
+	config RotateConfig
+	file   *os.File
+	size   int64
+	period time.Time
+}
+
+// NewRotatingFile opens (or creates) the file at config.Path.
+func NewRotatingFile(config RotateConfig) (*RotatingFile, error) {
+	if dir := filepath.Dir(config.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	r := &RotatingFile{config: config}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.period = r.currentPeriod()
+	return nil
+}
+
+func (r *RotatingFile) currentPeriod() time.Time {
+	if r.config.Interval <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Truncate(r.config.Interval)
+}
+
+// Write writes p to the file, rotating it first if needed.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if (r.config.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.config.MaxSize) ||
+		(r.config.Interval > 0 && !r.currentPeriod().Equal(r.period)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate %s: %v\n", r.config.Path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file immediately.
+func (r *RotatingFile) Rotate() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rotate()
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := r.config.Path + "." + time.Now().Format(rotateTimeFormat)
+	if _, err := os.Stat(backup); err == nil { // same second, keep both
+		backup += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	renameErr := os.Rename(r.config.Path, backup)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	go func() {
+		if r.config.Compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "compress %s: %v\n", backup, err)
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups.
+func (r *RotatingFile) prune() {
+	if r.config.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.config.Path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups) // names embed the rotation time
+	for len(backups) > r.config.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// compressFile gzips path to path.gz and removes path.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}